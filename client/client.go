@@ -0,0 +1,254 @@
+// Package client is a Go client for the prio-load-balancer API
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	DefaultMaxTries = 3
+	DefaultBackoff  = 100 * time.Millisecond
+	MaxBackoff      = 2 * time.Second
+)
+
+// Client sends simulation requests to a prio-load-balancer. It is safe for concurrent use.
+type Client struct {
+	url        string
+	httpClient *http.Client
+	maxTries   int
+	backoff    time.Duration
+
+	verificationKeys [][]byte // (optional) see WithResponseVerification
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client to use (i.e. the one of a httptest.Server)
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithMaxTries sets the maximum number of attempts for retryable errors (1 disables retries)
+func WithMaxTries(maxTries int) Option {
+	return func(c *Client) { c.maxTries = maxTries }
+}
+
+// WithBackoff sets the initial wait time between retries, which is doubled after every attempt (up to MaxBackoff)
+func WithBackoff(backoff time.Duration) Option {
+	return func(c *Client) { c.backoff = backoff }
+}
+
+// New returns a client for the balancer at url (i.e. "http://localhost:8080/sim")
+func New(url string, opts ...Option) *Client {
+	c := &Client{
+		url:        url,
+		httpClient: http.DefaultClient,
+		maxTries:   DefaultMaxTries,
+		backoff:    DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.maxTries < 1 {
+		c.maxTries = 1
+	}
+	return c
+}
+
+type simulateOptions struct {
+	isHighPrio     bool
+	isFastTrack    bool
+	priorityLevel  *int
+	timeout        time.Duration
+	queueDeadline  time.Duration
+	proxyTimeout   time.Duration
+	requestID      string
+	idempotencyKey string
+}
+
+type SimulateOption func(*simulateOptions)
+
+// WithHighPriority queues the request with high priority
+func WithHighPriority() SimulateOption {
+	return func(o *simulateOptions) { o.isHighPrio = true }
+}
+
+// WithFastTrack queues the request in the fast-track queue
+func WithFastTrack() SimulateOption {
+	return func(o *simulateOptions) { o.isFastTrack = true }
+}
+
+// WithPriorityLevel sets the X-Priority header, instead of WithHighPriority and WithFastTrack: 0 is fast-track, 1
+// high-prio, the last level (PRIORITY_LEVELS-1 of the balancer) low-prio, and the levels in between are queued after
+// the high-prio requests
+func WithPriorityLevel(level int) SimulateOption {
+	return func(o *simulateOptions) { o.priorityLevel = &level }
+}
+
+// WithTimeout limits the total duration of Simulate, including retries
+func WithTimeout(timeout time.Duration) SimulateOption {
+	return func(o *simulateOptions) { o.timeout = timeout }
+}
+
+// WithQueueDeadline sets the X-Request-Deadline-Ms header: the balancer answers with a request timeout (which is
+// retryable) if the request is still queued after the deadline, instead of the timeout of its priority
+func WithQueueDeadline(deadline time.Duration) SimulateOption {
+	return func(o *simulateOptions) { o.queueDeadline = deadline }
+}
+
+// WithProxyTimeout sets the X-Proxy-Timeout-Ms header: the timeout of the proxy requests to the nodes, instead of the
+// proxy timeout of its priority (i.e. for long sims). It must not exceed REQUEST_PROXY_TIMEOUT_MAX of the balancer.
+func WithProxyTimeout(timeout time.Duration) SimulateOption {
+	return func(o *simulateOptions) { o.proxyTimeout = timeout }
+}
+
+// WithRequestID sets the X-Request-ID header, which is used in the logs of the balancer
+func WithRequestID(reqID string) SimulateOption {
+	return func(o *simulateOptions) { o.requestID = reqID }
+}
+
+// WithIdempotencyKey sets the X-Idempotency-Key header. The same key is sent on all retries.
+func WithIdempotencyKey(key string) SimulateOption {
+	return func(o *simulateOptions) { o.idempotencyKey = key }
+}
+
+// Response is a successful simulation response
+type Response struct {
+	StatusCode    int
+	Payload       []byte
+	NodeURI       string // empty if the balancer hides the node URI
+	SimDuration   time.Duration
+	QueueDuration time.Duration
+	Tries         int // number of tries on the balancer side (for the last attempt of the client)
+	Attempts      int // number of attempts of the client
+	RequestID     string
+	SignedAt      time.Time // time of the verified response signature (zero without WithResponseVerification)
+}
+
+// Simulate sends the payload to the balancer, and retries retryable errors (see Error.Retryable) with backoff.
+// Errors returned by the balancer are of type *Error, and can be checked with errors.Is (i.e. errors.Is(err, ErrQueueFull)).
+func (c *Client) Simulate(ctx context.Context, payload []byte, opts ...SimulateOption) (*Response, error) {
+	o := simulateOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := c.simulate(ctx, payload, &o)
+		if err == nil {
+			resp.Attempts = attempt
+			return resp, nil
+		}
+
+		if attempt >= c.maxTries || !isRetryable(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
+
+func (c *Client) simulate(ctx context.Context, payload []byte, o *simulateOptions) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if o.isHighPrio {
+		req.Header.Set("X-High-Priority", "true")
+	}
+	if o.isFastTrack {
+		req.Header.Set("X-Fast-Track", "true")
+	}
+	if o.priorityLevel != nil {
+		req.Header.Set("X-Priority", strconv.Itoa(*o.priorityLevel))
+	}
+	if o.queueDeadline > 0 {
+		ms := (o.queueDeadline + time.Millisecond - 1) / time.Millisecond // rounded up, the header has at least 1
+		req.Header.Set("X-Request-Deadline-Ms", strconv.FormatInt(int64(ms), 10))
+	}
+	if o.proxyTimeout > 0 {
+		ms := (o.proxyTimeout + time.Millisecond - 1) / time.Millisecond // rounded up, the header has at least 1
+		req.Header.Set("X-Proxy-Timeout-Ms", strconv.FormatInt(int64(ms), 10))
+	}
+	if o.requestID != "" {
+		req.Header.Set("X-Request-ID", o.requestID)
+	}
+	if o.idempotencyKey != "" {
+		req.Header.Set("X-Idempotency-Key", o.idempotencyKey)
+	}
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, &transportError{err}
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, &transportError{err}
+	}
+
+	tries, _ := strconv.Atoi(httpResp.Header.Get("X-Tries"))
+	if httpResp.StatusCode >= 400 {
+		return nil, newError(httpResp, body, tries)
+	}
+
+	resp := &Response{
+		StatusCode:    httpResp.StatusCode,
+		Payload:       body,
+		NodeURI:       httpResp.Header.Get("X-Node-URI"),
+		SimDuration:   headerMs(httpResp.Header, "X-Sim-Duration-Ms"),
+		QueueDuration: headerMs(httpResp.Header, "X-Queue-Duration-Ms"),
+		Tries:         tries,
+		RequestID:     httpResp.Header.Get("X-Request-ID"),
+	}
+	if len(c.verificationKeys) > 0 {
+		resp.SignedAt, err = VerifySignature(httpResp.Header.Get("X-Response-Signature"), resp.RequestID, body, c.verificationKeys...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func headerMs(h http.Header, key string) time.Duration {
+	ms, _ := strconv.ParseInt(h.Get(key), 10, 64)
+	return time.Duration(ms) * time.Millisecond
+}
+
+// transportError is an error sending the request or reading the response (always retryable)
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("request to balancer failed: %v", e.err)
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+	"github.com/flashbots/prio-load-balancer/simtest"
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+// newTestBalancer runs the balancer in-process, with a fake node
+func newTestBalancer(t *testing.T) *simtest.Balancer {
+	t.Helper()
+	balancer, err := simtest.Start(simtest.Options{
+		Node: testutils.FakeNodeOpts{Responses: map[string]interface{}{"eth_callBundle": "cool"}},
+	})
+	require.Nil(t, err, err)
+	t.Cleanup(balancer.Close)
+	return balancer
+}
+
+func testPayload(t *testing.T) []byte {
+	t.Helper()
+	payload, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+	return payload
+}
+
+func TestErrorKindsMatchServer(t *testing.T) {
+	require.Equal(t, server.ErrorKindQueueFull, ErrorKindQueueFull)
+	require.Equal(t, server.ErrorKindRequestTimeout, ErrorKindRequestTimeout)
+	require.Equal(t, server.ErrorKindNodeTimeout, ErrorKindNodeTimeout)
+	require.Equal(t, server.ErrorKindNoNodesAvailable, ErrorKindNoNodesAvailable)
+	require.Equal(t, server.ErrorKindProxyTimeout, ErrorKindProxyTimeout)
+	require.Equal(t, server.ErrorKindNodeError, ErrorKindNodeError)
+	require.Equal(t, server.ErrorKindProxyError, ErrorKindProxyError)
+	require.Equal(t, server.ErrorKindShuttingDown, ErrorKindShuttingDown)
+	require.Equal(t, server.ErrorKindLoadShed, ErrorKindLoadShed)
+	require.Equal(t, server.ErrorKindRetryBudgetExhausted, ErrorKindRetryBudgetExhausted)
+	require.Equal(t, server.ErrorKindClientQueueLimit, ErrorKindClientQueueLimit)
+	require.Equal(t, server.ErrorKindMiddleware, ErrorKindMiddleware)
+	require.Equal(t, server.ErrorKindValidationFailed, ErrorKindValidationFailed)
+	require.Equal(t, server.ErrorKindDuplicateSubmission, ErrorKindDuplicate)
+}
+
+func TestSimulate(t *testing.T) {
+	balancer := newTestBalancer(t)
+	c := New(balancer.SimURL, WithHTTPClient(balancer.Client()), WithBackoff(time.Millisecond))
+
+	resp, err := c.Simulate(context.Background(), testPayload(t), WithHighPriority(), WithRequestID("foo"), WithIdempotencyKey("bar"), WithQueueDeadline(time.Second), WithProxyTimeout(2*time.Second))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `{"id":1,"result":"cool","jsonrpc":"2.0"}`+"\n", string(resp.Payload))
+	require.NotEmpty(t, resp.NodeURI)
+	require.Equal(t, 1, resp.Tries)
+	require.Equal(t, 1, resp.Attempts)
+	lastRequest, _ := balancer.Node().LastRequest()
+	require.Equal(t, "foo", lastRequest.Header.Get("X-Request-ID"))
+
+	// Node errors were already retried by the balancer, and are not retried again
+	balancer.Node().Reset()
+	balancer.Node().SetOpts(testutils.FakeNodeOpts{ErrorRate: 1, ErrorStatusCode: http.StatusInternalServerError})
+	_, err = c.Simulate(context.Background(), testPayload(t), WithFastTrack())
+	require.True(t, errors.Is(err, ErrNodeError), err)
+	var balancerErr *Error
+	require.True(t, errors.As(err, &balancerErr))
+	require.Equal(t, http.StatusInternalServerError, balancerErr.StatusCode)
+	require.Equal(t, server.RequestMaxTries, balancerErr.Tries)
+	require.Equal(t, server.RequestMaxTries, balancer.Node().NumRequests())
+
+	// Timeout option
+	balancer.Node().SetOpts(testutils.FakeNodeOpts{Latency: 200 * time.Millisecond})
+	_, err = c.Simulate(context.Background(), testPayload(t), WithTimeout(50*time.Millisecond))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+}
+
+func TestSimulateInvalidRequest(t *testing.T) {
+	defer func(validate bool) { server.ValidateJSONRPC = validate }(server.ValidateJSONRPC)
+	server.ValidateJSONRPC = true
+
+	balancer := newTestBalancer(t)
+	c := New(balancer.SimURL, WithHTTPClient(balancer.Client()))
+
+	_, err := c.Simulate(context.Background(), []byte("foo"))
+	var balancerErr *Error
+	require.True(t, errors.As(err, &balancerErr), err)
+	require.Equal(t, http.StatusBadRequest, balancerErr.StatusCode)
+	require.Equal(t, "", balancerErr.Kind)
+	require.Equal(t, server.ErrorCodeInvalidJSONRPC, balancerErr.Code)
+	require.Contains(t, balancerErr.Message, "invalid JSON-RPC request")
+	require.NotEmpty(t, balancerErr.RequestID)
+	require.False(t, balancerErr.Retryable())
+}
+
+func TestSimulateRetries(t *testing.T) {
+	// The balancer is full for the first 2 requests
+	numRequests := atomic.NewInt32(0)
+	balancer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "key1", req.Header.Get("X-Idempotency-Key"))
+		if numRequests.Inc() <= 2 {
+			w.Header().Set("X-Error-Kind", ErrorKindQueueFull)
+			http.Error(w, "queue full", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"result":"cool"}`))
+	}))
+	defer balancer.Close()
+
+	c := New(balancer.URL, WithHTTPClient(balancer.Client()), WithBackoff(time.Millisecond))
+	resp, err := c.Simulate(context.Background(), []byte("{}"), WithIdempotencyKey("key1"))
+	require.Nil(t, err, err)
+	require.Equal(t, 3, resp.Attempts)
+	require.Equal(t, `{"result":"cool"}`, string(resp.Payload))
+
+	// Gives up after maxTries
+	numRequests.Store(0)
+	c = New(balancer.URL, WithHTTPClient(balancer.Client()), WithBackoff(time.Millisecond), WithMaxTries(2))
+	_, err = c.Simulate(context.Background(), []byte("{}"), WithIdempotencyKey("key1"))
+	require.True(t, errors.Is(err, ErrQueueFull), err)
+	require.Equal(t, "queue full", err.(*Error).Message)
+	require.Equal(t, int32(2), numRequests.Load())
+}
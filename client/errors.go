@@ -0,0 +1,124 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error kinds, as returned by the balancer in the X-Error-Kind response header
+const (
+	ErrorKindQueueFull        = "queue_full"
+	ErrorKindRequestTimeout   = "request_timeout"
+	ErrorKindNodeTimeout      = "node_timeout"
+	ErrorKindNoNodesAvailable = "no_nodes_available"
+	ErrorKindProxyTimeout     = "proxy_timeout"
+	ErrorKindNodeError        = "node_error"
+	ErrorKindProxyError       = "proxy_error"
+	ErrorKindShuttingDown     = "shutting_down"
+	ErrorKindLoadShed         = "load_shed"
+
+	ErrorKindRetryBudgetExhausted = "retry_budget_exhausted"
+	ErrorKindClientQueueLimit     = "client_queue_limit"
+	ErrorKindMiddleware           = "middleware_error"
+	ErrorKindValidationFailed     = "validation_failed"
+	ErrorKindDuplicate            = "duplicate_submission"
+)
+
+// Sentinel errors for use with errors.Is
+var (
+	ErrQueueFull        = &Error{Kind: ErrorKindQueueFull}
+	ErrRequestTimeout   = &Error{Kind: ErrorKindRequestTimeout}
+	ErrNodeTimeout      = &Error{Kind: ErrorKindNodeTimeout}
+	ErrNoNodesAvailable = &Error{Kind: ErrorKindNoNodesAvailable}
+	ErrProxyTimeout     = &Error{Kind: ErrorKindProxyTimeout}
+	ErrNodeError        = &Error{Kind: ErrorKindNodeError}
+	ErrProxyError       = &Error{Kind: ErrorKindProxyError}
+	ErrShuttingDown     = &Error{Kind: ErrorKindShuttingDown}
+	ErrLoadShed         = &Error{Kind: ErrorKindLoadShed}
+
+	ErrRetryBudgetExhausted = &Error{Kind: ErrorKindRetryBudgetExhausted}
+	ErrClientQueueLimit     = &Error{Kind: ErrorKindClientQueueLimit}
+	ErrMiddleware           = &Error{Kind: ErrorKindMiddleware}
+	ErrValidationFailed     = &Error{Kind: ErrorKindValidationFailed}
+	ErrDuplicate            = &Error{Kind: ErrorKindDuplicate}
+)
+
+// Error is an error response of the balancer
+type Error struct {
+	StatusCode int
+	Kind       string // one of the ErrorKind constants, empty if the balancer didn't classify the error (i.e. invalid request)
+	Code       string // machine-readable code of the JSON error response (i.e. QUEUE_FULL or INVALID_REQUEST), empty for node error payloads
+	Message    string
+	RequestID  string
+	NodeURI    string
+	Tries      int
+}
+
+func (e *Error) Error() string {
+	if e.Kind == "" {
+		return fmt.Sprintf("balancer error - statusCode: %d / %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("balancer error %s - statusCode: %d / %s", e.Kind, e.StatusCode, e.Message)
+}
+
+// Is matches errors of the same kind
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind != "" && t.Kind == e.Kind
+}
+
+// Retryable returns whether the request may succeed when sent again. Node errors are not retryable, because
+// the balancer already retried them on its side, and neither are errors of an exhausted retry budget of the balancer.
+func (e *Error) Retryable() bool {
+	switch e.Kind {
+	case ErrorKindQueueFull, ErrorKindRequestTimeout, ErrorKindNodeTimeout, ErrorKindNoNodesAvailable, ErrorKindShuttingDown, ErrorKindLoadShed, ErrorKindClientQueueLimit:
+		return true
+	case "":
+		return e.StatusCode == http.StatusBadGateway || e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusGatewayTimeout
+	default:
+		return false
+	}
+}
+
+// errorResponse is the JSON body of error responses of the balancer
+type errorResponse struct {
+	Error struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"requestId"`
+	} `json:"error"`
+}
+
+// newError creates an Error from an error response. Bodies which are not a JSON error response (i.e. node error
+// payloads) are used as message.
+func newError(httpResp *http.Response, body []byte, tries int) *Error {
+	e := &Error{
+		StatusCode: httpResp.StatusCode,
+		Kind:       httpResp.Header.Get("X-Error-Kind"),
+		Message:    strings.TrimSpace(string(body)),
+		RequestID:  httpResp.Header.Get("X-Request-ID"),
+		NodeURI:    httpResp.Header.Get("X-Node-URI"),
+		Tries:      tries,
+	}
+
+	var res errorResponse
+	if strings.HasPrefix(httpResp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &res) == nil && res.Error.Code != "" {
+		e.Code, e.Message = res.Error.Code, res.Error.Message
+		if res.Error.RequestID != "" {
+			e.RequestID = res.Error.RequestID
+		}
+	}
+	return e
+}
+
+func isRetryable(err error) bool {
+	var balancerErr *Error
+	if errors.As(err, &balancerErr) {
+		return balancerErr.Retryable()
+	}
+	var transportErr *transportError
+	return errors.As(err, &transportErr)
+}
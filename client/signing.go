@@ -0,0 +1,57 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSignature is returned for a successful response whose X-Response-Signature header is missing or doesn't
+// match any of the keys of WithResponseVerification
+var ErrInvalidSignature = errors.New("invalid response signature")
+
+// WithResponseVerification verifies the X-Response-Signature header of successful responses (see RESPONSE_SIGNING_KEY
+// of the balancer). A signature of any of the keys is accepted, so that the keys can be rotated: add the new key here
+// first, then switch the balancer to it, and remove the old key once it's no longer used.
+func WithResponseVerification(keys ...[]byte) Option {
+	return func(c *Client) { c.verificationKeys = keys }
+}
+
+// VerifySignature checks the X-Response-Signature header value against the request ID (X-Request-ID response header)
+// and the uncompressed response body, and returns the signing time. A signature of any of the keys is accepted.
+func VerifySignature(header, requestID string, body []byte, keys ...[]byte) (time.Time, error) {
+	var t string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return time.Time{}, ErrInvalidSignature
+	}
+
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(t + "." + requestID + "."))
+		mac.Write(body)
+		expected := mac.Sum(nil)
+		for _, sig := range signatures {
+			if hmac.Equal(sig, expected) {
+				return time.Unix(unix, 0), nil
+			}
+		}
+	}
+	return time.Time{}, ErrInvalidSignature
+}
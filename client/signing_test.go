@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+	"github.com/stretchr/testify/require"
+)
+
+// useSigningKeys signs the responses of the balancers started in the test with the keys
+func useSigningKeys(t *testing.T, primary, secondary string) {
+	t.Helper()
+	_primary, _secondary := server.ResponseSigningKey, server.ResponseSigningKeySecondary
+	t.Cleanup(func() { server.ResponseSigningKey, server.ResponseSigningKeySecondary = _primary, _secondary })
+	server.ResponseSigningKey, server.ResponseSigningKeySecondary = primary, secondary
+}
+
+func TestSimulateVerifiesSignature(t *testing.T) {
+	useSigningKeys(t, "key1", "")
+	balancer := newTestBalancer(t)
+
+	c := New(balancer.SimURL, WithHTTPClient(balancer.Client()), WithResponseVerification([]byte("key1")))
+	resp, err := c.Simulate(context.Background(), testPayload(t), WithRequestID("foo"))
+	require.Nil(t, err, err)
+	require.Equal(t, "foo", resp.RequestID)
+	require.WithinDuration(t, time.Now(), resp.SignedAt, 2*time.Second)
+
+	// A wrong key is rejected, and not retried
+	numRequests := balancer.Node().NumRequests()
+	c = New(balancer.SimURL, WithHTTPClient(balancer.Client()), WithResponseVerification([]byte("key2")))
+	_, err = c.Simulate(context.Background(), testPayload(t))
+	require.ErrorIs(t, err, ErrInvalidSignature)
+	require.Equal(t, numRequests+1, balancer.Node().NumRequests())
+
+	// Without verification, the signature is ignored
+	c = New(balancer.SimURL, WithHTTPClient(balancer.Client()))
+	resp, err = c.Simulate(context.Background(), testPayload(t))
+	require.Nil(t, err, err)
+	require.True(t, resp.SignedAt.IsZero())
+}
+
+func TestSimulateSignatureRotation(t *testing.T) {
+	// The balancer signs with the new key first, and still with the old one
+	useSigningKeys(t, "new", "old")
+	balancer := newTestBalancer(t)
+	for _, keys := range [][][]byte{{[]byte("old")}, {[]byte("new")}, {[]byte("other"), []byte("new")}} {
+		c := New(balancer.SimURL, WithHTTPClient(balancer.Client()), WithResponseVerification(keys...))
+		_, err := c.Simulate(context.Background(), testPayload(t))
+		require.Nil(t, err, err)
+	}
+
+	// The client already accepts the new key, while the balancer signs with the old one only
+	useSigningKeys(t, "old", "")
+	balancer = newTestBalancer(t)
+	c := New(balancer.SimURL, WithHTTPClient(balancer.Client()), WithResponseVerification([]byte("new"), []byte("old")))
+	_, err := c.Simulate(context.Background(), testPayload(t))
+	require.Nil(t, err, err)
+	c = New(balancer.SimURL, WithHTTPClient(balancer.Client()), WithResponseVerification([]byte("new")))
+	_, err = c.Simulate(context.Background(), testPayload(t))
+	require.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestSimulateTamperedResponse(t *testing.T) {
+	signer := server.NewResponseSigner("key1")
+	signedBody := []byte(`{"result":"cool"}`)
+	var body []byte
+	balancer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Request-ID", "req1")
+		w.Header().Set("X-Response-Signature", signer.Sign(time.Now(), "req1", signedBody))
+		w.Write(body)
+	}))
+	defer balancer.Close()
+	c := New(balancer.URL, WithHTTPClient(balancer.Client()), WithResponseVerification([]byte("key1")))
+
+	body = signedBody
+	_, err := c.Simulate(context.Background(), []byte("{}"))
+	require.Nil(t, err, err)
+
+	body = []byte(`{"result":"evil"}`)
+	_, err = c.Simulate(context.Background(), []byte("{}"))
+	require.True(t, errors.Is(err, ErrInvalidSignature), err)
+}
+
+func TestVerifySignature(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	header := server.NewResponseSigner("key1", "key2").Sign(ts, "req1", []byte("body"))
+
+	signedAt, err := VerifySignature(header, "req1", []byte("body"), []byte("key2"))
+	require.Nil(t, err, err)
+	require.Equal(t, ts, signedAt)
+
+	for _, tc := range []struct {
+		header, reqID, body string
+	}{
+		{header, "req2", "body"}, // the request ID is signed
+		{header, "req1", "bodx"},
+		{"t=1700000001," + header[len("t=1700000000,"):], "req1", "body"}, // the timestamp is signed
+		{"", "req1", "body"},
+		{"t=1700000000", "req1", "body"},
+		{"v1=" + server.ResponseSignature([]byte("key1"), "", "req1", []byte("body")), "req1", "body"},
+	} {
+		_, err := VerifySignature(tc.header, tc.reqID, []byte(tc.body), []byte("key1"))
+		require.ErrorIs(t, err, ErrInvalidSignature, tc)
+	}
+}
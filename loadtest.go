@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/loadtest"
+	"github.com/flashbots/prio-load-balancer/simtest"
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"go.uber.org/zap"
+)
+
+// runLoadtest runs the loadtest subcommand: `prio-load-balancer loadtest [flags]`
+func runLoadtest(args []string) {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	targetPtr := flags.String("target", "http://localhost:8080/sim", "balancer URL to send the requests to")
+	statsPtr := flags.String("stats", "http://localhost:8080/stats/queue", "queue stats endpoint of the balancer, for the report ('' to skip)")
+	ratePtr := flags.Float64("rate", 100, "requests per second (0 for as fast as -concurrency allows)")
+	durationPtr := flags.Duration("duration", 10*time.Second, "how long to send requests")
+	concurrencyPtr := flags.Int("concurrency", loadtest.DefaultConcurrency, "maximum number of requests in flight")
+	payloadSizePtr := flags.Int("payload-size", loadtest.DefaultPayloadSize, "approximate size of the request payloads in bytes")
+	mixPtr := flags.String("mix", "fast-track=1,high-prio=2,low-prio=7", "relative weights of the priorities")
+	jsonPtr := flags.Bool("json", false, "print the report as JSON")
+	localPtr := flags.Bool("local", false, "run against an in-process balancer with fake nodes (ignores -target and -stats)")
+	localNodesPtr := flags.Int("local-nodes", 4, "number of fake nodes with -local")
+	localWorkersPtr := flags.Int("local-workers", 8, "workers per fake node with -local")
+	localLatencyPtr := flags.Duration("local-node-latency", 20*time.Millisecond, "response time of the fake nodes with -local")
+	perr(flags.Parse(args))
+
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+
+	mix, err := loadtest.ParseMix(*mixPtr)
+	perr(err)
+	opts := loadtest.Options{
+		TargetURL:   *targetPtr,
+		StatsURL:    *statsPtr,
+		Rate:        *ratePtr,
+		Duration:    *durationPtr,
+		Concurrency: *concurrencyPtr,
+		PayloadSize: *payloadSizePtr,
+		Mix:         mix,
+	}
+
+	if *localPtr {
+		balancer, err := simtest.Start(simtest.Options{
+			Log:            log.Desugar().WithOptions(zap.IncreaseLevel(zap.WarnLevel)).Sugar(),
+			NumNodes:       *localNodesPtr,
+			Node:           testutils.FakeNodeOpts{Latency: *localLatencyPtr},
+			WorkersPerNode: int32(*localWorkersPtr),
+		})
+		perr(err)
+		defer balancer.Close()
+		opts.TargetURL, opts.StatsURL = balancer.SimURL, balancer.URL+"/stats/queue"
+	}
+
+	// Stop sending requests on SIGINT / SIGTERM, and report the ones sent so far
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	log.Infow("Starting load test", "target", opts.TargetURL, "rate", opts.Rate, "duration", opts.Duration, "concurrency", opts.Concurrency, "mix", *mixPtr, "local", *localPtr)
+	report := loadtest.Run(ctx, opts)
+	if *jsonPtr {
+		perr(json.NewEncoder(os.Stdout).Encode(report))
+	} else {
+		fmt.Print(report.String())
+	}
+}
@@ -0,0 +1,299 @@
+// Package loadtest sends a configurable mix of sim requests to a balancer, and reports the latencies by priority
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+	"github.com/pkg/errors"
+)
+
+var (
+	DefaultConcurrency = 100
+	DefaultPayloadSize = 1024
+
+	ErrInvalidMix = errors.New("invalid priority mix")
+)
+
+// Priorities in the order of the report
+var Priorities = []string{server.PriorityFastTrack, server.PriorityHighPrio, server.PriorityLowPrio}
+
+// Mix are the relative weights of the priorities of the requests
+type Mix struct {
+	FastTrack float64 `json:"fastTrack"`
+	HighPrio  float64 `json:"highPrio"`
+	LowPrio   float64 `json:"lowPrio"`
+}
+
+// ParseMix parses weights by priority, i.e. "fast-track=1,high-prio=2,low-prio=7" (missing priorities are 0)
+func ParseMix(s string) (mix Mix, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		priority, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.ParseFloat(value, 64)
+		if !found || err != nil || weight < 0 {
+			return mix, errors.Wrap(ErrInvalidMix, entry)
+		}
+		switch priority {
+		case server.PriorityFastTrack:
+			mix.FastTrack = weight
+		case server.PriorityHighPrio:
+			mix.HighPrio = weight
+		case server.PriorityLowPrio:
+			mix.LowPrio = weight
+		default:
+			return mix, errors.Wrap(ErrInvalidMix, entry)
+		}
+	}
+	if mix.FastTrack+mix.HighPrio+mix.LowPrio == 0 {
+		return mix, errors.Wrap(ErrInvalidMix, "all weights are 0")
+	}
+	return mix, nil
+}
+
+func (m Mix) weights() []float64 {
+	return []float64{m.FastTrack, m.HighPrio, m.LowPrio} // in the order of Priorities
+}
+
+// Options of a load test
+type Options struct {
+	TargetURL   string        // i.e. "http://localhost:8080/sim"
+	StatsURL    string        // (optional) queue stats endpoint of the balancer for the report, i.e. "http://localhost:8080/stats/queue"
+	Rate        float64       // requests per second (0 for as fast as Concurrency allows)
+	Duration    time.Duration // how long to send requests
+	Concurrency int           // maximum number of requests in flight (default: DefaultConcurrency)
+	PayloadSize int           // approximate size of the request payloads in bytes (default: DefaultPayloadSize)
+	Mix         Mix           // default: only low-prio requests
+	HTTPClient  *http.Client  // default: http.DefaultClient
+}
+
+// PriorityReport are the results of the requests of one priority
+type PriorityReport struct {
+	NumRequests  int                       `json:"numRequests"`
+	NumSucceeded int                       `json:"numSucceeded"`
+	NumFailed    int                       `json:"numFailed"`
+	Errors       map[string]int            `json:"errors"`    // by error kind (X-Error-Kind), or http_<status code>
+	LatencyUs    server.LatencyPercentiles `json:"latencyUs"` // end-to-end, including the queue wait
+}
+
+// Report of a load test
+type Report struct {
+	Duration       time.Duration              `json:"duration"`
+	NumRequests    int                        `json:"numRequests"`
+	RequestsPerSec float64                    `json:"requestsPerSec"`
+	Priorities     map[string]*PriorityReport `json:"priorities"`
+	QueueStats     *server.QueueStatsResponse `json:"queueStats,omitempty"`      // fetched from StatsURL after the load
+	QueueStatsErr  string                     `json:"queueStatsError,omitempty"` // if fetching the queue stats failed
+}
+
+func (r Report) String() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "%d requests in %s (%.1f req/s)\n", r.NumRequests, r.Duration.Round(time.Millisecond), r.RequestsPerSec)
+	fmt.Fprintf(b, "%-10s %8s %8s %10s %10s %10s %10s  %s\n", "priority", "ok", "failed", "p50_us", "p90_us", "p99_us", "max_us", "errors")
+	for _, priority := range Priorities {
+		p := r.Priorities[priority]
+		errorKinds := make([]string, 0, len(p.Errors))
+		for kind, count := range p.Errors {
+			errorKinds = append(errorKinds, fmt.Sprintf("%s=%d", kind, count))
+		}
+		sort.Strings(errorKinds)
+		line := fmt.Sprintf("%-10s %8d %8d %10d %10d %10d %10d  %s", priority, p.NumSucceeded, p.NumFailed,
+			p.LatencyUs.P50, p.LatencyUs.P90, p.LatencyUs.P99, p.LatencyUs.Max, strings.Join(errorKinds, " "))
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+
+	if r.QueueStats != nil {
+		fmt.Fprintf(b, "queue: fast-track=%d high-prio=%d low-prio=%d bytes=%d\n", r.QueueStats.NumFastTrack, r.QueueStats.NumHighPrio, r.QueueStats.NumLowPrio, r.QueueStats.NumBytes)
+		for _, priority := range Priorities {
+			if wait, found := r.QueueStats.WaitTimes[priority]; found {
+				fmt.Fprintf(b, "queue wait %-10s (last %s): requests=%d p50_us=%d p90_us=%d p99_us=%d max_us=%d\n", priority, wait.Summary.Window,
+					wait.Summary.NumRequests, wait.Summary.Us.P50, wait.Summary.Us.P90, wait.Summary.Us.P99, wait.Summary.Us.Max)
+			}
+		}
+	} else if r.QueueStatsErr != "" {
+		fmt.Fprintf(b, "queue stats unavailable: %s\n", r.QueueStatsErr)
+	}
+	return b.String()
+}
+
+// Run sends requests to the target balancer for opts.Duration (or until ctx is cancelled), and returns the report
+// once all responses are received
+func Run(ctx context.Context, opts Options) Report {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.PayloadSize <= 0 {
+		opts.PayloadSize = DefaultPayloadSize
+	}
+	if opts.Mix == (Mix{}) {
+		opts.Mix = Mix{LowPrio: 1}
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	payload := newPayload(opts.PayloadSize)
+
+	var (
+		lock      sync.Mutex
+		wg        sync.WaitGroup
+		latencies = make(map[string][]int64)
+		report    = Report{Priorities: make(map[string]*PriorityReport)}
+		sem       = make(chan struct{}, opts.Concurrency)
+		picker    = newPriorityPicker(opts.Mix)
+		startTime = time.Now()
+		endTime   = startTime.Add(opts.Duration)
+	)
+	for _, priority := range Priorities {
+		report.Priorities[priority] = &PriorityReport{Errors: make(map[string]int)}
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, endTime)
+	defer cancel()
+
+schedule:
+	for i := 0; ; i++ {
+		// Wait until the request is due
+		if opts.Rate > 0 {
+			due := startTime.Add(time.Duration(float64(i) / opts.Rate * float64(time.Second)))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-ctx.Done():
+					break schedule
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			break schedule
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(priority string) {
+			defer func() { <-sem; wg.Done() }()
+			// Requests in flight are completed after the end of the load test
+			latency, errorKind := send(context.Background(), opts, priority, payload)
+
+			lock.Lock()
+			defer lock.Unlock()
+			p := report.Priorities[priority]
+			p.NumRequests++
+			latencies[priority] = append(latencies[priority], latency.Microseconds())
+			if errorKind != "" {
+				p.NumFailed++
+				p.Errors[errorKind]++
+			} else {
+				p.NumSucceeded++
+			}
+		}(picker.next())
+	}
+	wg.Wait()
+
+	report.Duration = time.Since(startTime)
+	for priority, p := range report.Priorities {
+		p.LatencyUs = server.Percentiles(latencies[priority])
+		report.NumRequests += p.NumRequests
+	}
+	report.RequestsPerSec = float64(report.NumRequests) / report.Duration.Seconds()
+
+	if opts.StatsURL != "" {
+		queueStats, err := fetchQueueStats(opts.HTTPClient, opts.StatsURL)
+		if err != nil {
+			report.QueueStatsErr = err.Error()
+		} else {
+			report.QueueStats = queueStats
+		}
+	}
+	return report
+}
+
+// priorityPicker picks the priorities of the requests by their weights (smooth weighted round-robin, so that the
+// mix is exact and evenly spread over time)
+type priorityPicker struct {
+	weights []float64
+	current []float64
+}
+
+func newPriorityPicker(mix Mix) *priorityPicker {
+	weights := mix.weights()
+	return &priorityPicker{weights: weights, current: make([]float64, len(weights))}
+}
+
+func (p *priorityPicker) next() string {
+	total, best := 0.0, 0
+	for i, weight := range p.weights {
+		p.current[i] += weight
+		total += weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= total
+	return Priorities[best]
+}
+
+// newPayload returns an eth_callBundle request of about size bytes
+func newPayload(size int) []byte {
+	const envelope = `{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[{"txs":["0x"],"blockNumber":"0x1","stateBlockNumber":"latest"}]}`
+	padding := size - len(envelope)
+	if padding < 0 {
+		padding = 0
+	}
+	return []byte(strings.Replace(envelope, `"0x"`, `"0x`+strings.Repeat("00", padding/2)+`"`, 1))
+}
+
+// send sends one request, and returns the latency and the error kind (empty on success)
+func send(ctx context.Context, opts Options, priority string, payload []byte) (time.Duration, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.TargetURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "request_error"
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch priority {
+	case server.PriorityFastTrack:
+		req.Header.Set("X-Fast-Track", "true")
+	case server.PriorityHighPrio:
+		req.Header.Set("X-High-Priority", "true")
+	default:
+		req.Header.Set("X-High-Priority", "false")
+	}
+
+	start := time.Now()
+	resp, err := opts.HTTPClient.Do(req)
+	if err != nil {
+		return time.Since(start), "transport_error"
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	latency := time.Since(start)
+
+	if resp.StatusCode == http.StatusOK {
+		return latency, ""
+	} else if errorKind := resp.Header.Get("X-Error-Kind"); errorKind != "" {
+		return latency, errorKind
+	}
+	return latency, fmt.Sprintf("http_%d", resp.StatusCode)
+}
+
+func fetchQueueStats(httpClient *http.Client, url string) (*server.QueueStatsResponse, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	stats := new(server.QueueStatsResponse)
+	return stats, json.NewDecoder(resp.Body).Decode(stats)
+}
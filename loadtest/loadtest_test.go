@@ -0,0 +1,85 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+	"github.com/flashbots/prio-load-balancer/simtest"
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := ParseMix("fast-track=1, high-prio=2,low-prio=7")
+	require.Nil(t, err, err)
+	require.Equal(t, Mix{FastTrack: 1, HighPrio: 2, LowPrio: 7}, mix)
+
+	mix, err = ParseMix("high-prio=0.5")
+	require.Nil(t, err, err)
+	require.Equal(t, Mix{HighPrio: 0.5}, mix)
+
+	for _, s := range []string{"", "high-prio", "high-prio=x", "urgent=1", "low-prio=-1", "low-prio=0"} {
+		_, err := ParseMix(s)
+		require.ErrorIs(t, err, ErrInvalidMix, s)
+	}
+}
+
+func TestPriorityPicker(t *testing.T) {
+	picker := newPriorityPicker(Mix{FastTrack: 1, HighPrio: 2, LowPrio: 7})
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		counts[picker.next()]++
+	}
+	require.Equal(t, map[string]int{server.PriorityFastTrack: 10, server.PriorityHighPrio: 20, server.PriorityLowPrio: 70}, counts)
+
+	picker = newPriorityPicker(Mix{HighPrio: 1})
+	for i := 0; i < 10; i++ {
+		require.Equal(t, server.PriorityHighPrio, picker.next())
+	}
+}
+
+func TestNewPayload(t *testing.T) {
+	for _, size := range []int{1, 1024, 10_000} {
+		payload := newPayload(size)
+		require.True(t, json.Valid(payload))
+		if size > 200 {
+			require.InDelta(t, size, len(payload), 1)
+		}
+	}
+}
+
+// TestLoadtestLocal runs a 2 second load against an in-process balancer with fake nodes
+func TestLoadtestLocal(t *testing.T) {
+	balancer, err := simtest.Start(simtest.Options{NumNodes: 2, Node: testutils.FakeNodeOpts{Latency: 5 * time.Millisecond}})
+	require.Nil(t, err, err)
+	defer balancer.Close()
+
+	report := Run(context.Background(), Options{
+		TargetURL:   balancer.SimURL,
+		StatsURL:    balancer.URL + "/stats/queue",
+		Rate:        100,
+		Duration:    2 * time.Second,
+		Concurrency: 20,
+		PayloadSize: 512,
+		Mix:         Mix{FastTrack: 1, HighPrio: 1, LowPrio: 2},
+	})
+	t.Log("\n" + report.String())
+
+	require.InDelta(t, 200, report.NumRequests, 10)
+	require.GreaterOrEqual(t, report.Duration, 2*time.Second)
+	require.InDelta(t, report.NumRequests/4, report.Priorities[server.PriorityFastTrack].NumRequests, 1)
+	require.InDelta(t, report.NumRequests/2, report.Priorities[server.PriorityLowPrio].NumRequests, 1)
+	for _, priority := range Priorities {
+		p := report.Priorities[priority]
+		require.Equal(t, p.NumRequests, p.NumSucceeded, priority)
+		require.GreaterOrEqual(t, p.LatencyUs.P50, int64(5000), priority) // at least the node latency
+	}
+
+	require.Empty(t, report.QueueStatsErr)
+	require.NotNil(t, report.QueueStats)
+	require.Equal(t, report.Priorities[server.PriorityLowPrio].NumRequests, report.QueueStats.WaitTimes[server.PriorityLowPrio].Summary.NumRequests)
+	require.Contains(t, report.String(), "queue wait low-prio")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/flashbots/prio-load-balancer/replay"
 	"github.com/flashbots/prio-load-balancer/server"
 	"github.com/flashbots/prio-load-balancer/testutils"
 	"go.uber.org/zap"
@@ -23,12 +25,18 @@ var (
 	// Default values
 	// defaultDebug       = os.Getenv("DEBUG") == "1"
 	defaultRedis       = getEnv("REDIS_URI", "dev")
+	defaultStateFile   = getEnv("STATE_FILE", "")
+	defaultNodeStore   = getEnv("NODE_STORE", "")
 	defaultListenAddr  = getEnv("LISTEN_ADDR", "localhost:8080")
-	defaultlogProd     = os.Getenv("LOG_PROD") == "1"
-	defaultLogService  = os.Getenv("LOG_SERVICE")
+	defaultHTTPSAddr   = getEnv("HTTPS_LISTEN_ADDR", "")
+	defaultTLSCert     = getEnv("TLS_CERT_FILE", "")
+	defaultTLSKey      = getEnv("TLS_KEY_FILE", "")
+	defaultAdminAddr   = getEnv("ADMIN_LISTEN_ADDR", "")
+	defaultlogProd     = getEnv("LOG_PROD", "") == "1"
+	defaultLogService  = getEnv("LOG_SERVICE", "")
 	defaultNodeWorkers = getEnvInt("NUM_NODE_WORKERS", 8) // number of maximum concurrent requests per node
-	defaultNodes       = os.Getenv("NODES")
-	defaultBackends    = os.Getenv("BACKENDS")
+	defaultNodes       = getEnv("NODES", "")
+	defaultBackends    = getEnv("BACKENDS", "")
 
 	// Flags
 	httpAddrPtr = flag.String("http", defaultListenAddr, "http service address")
@@ -36,10 +44,24 @@ var (
 	nodeWorkersPtr = flag.Int("node-workers", defaultNodeWorkers, "number of concurrent workers per node")
 	nodesPtr       = flag.String("nodes", defaultNodes, "nodes to use (comma separated)")
 	backendsPtr    = flag.String("backends", defaultBackends, "backend nodes to use (comma separated URLs to proxy requests to)")
-	redisPtr       = flag.String("redis", defaultRedis, "redis URI ('dev' for built-in)")
+	redisPtr       = flag.String("redis", defaultRedis, "redis URI, also redis-sentinel:// and redis-cluster:// ('dev' for built-in)")
+	stateFilePtr   = flag.String("state-file", defaultStateFile, "JSON file to store the nodes and tenants in, instead of redis (optional)")
+	nodeStorePtr   = flag.String("node-store", defaultNodeStore, "'redis' or 'file:<path>' (same as -state-file)")
 	useMockNodePtr = flag.Bool("mock-node", false, "run a mock node backend")
 	logProdPtr     = flag.Bool("log-prod", defaultlogProd, "production logging")
 	logServicePtr  = flag.String("log-service", defaultLogService, "'service' tag to logs")
+	httpsAddrPtr   = flag.String("https", defaultHTTPSAddr, "https service address (optional, requires -tls-cert and -tls-key)")
+	tlsCertPtr     = flag.String("tls-cert", defaultTLSCert, "TLS certificate file (reloaded when changed or on SIGHUP)")
+	tlsKeyPtr      = flag.String("tls-key", defaultTLSKey, "TLS key file (reloaded when changed or on SIGHUP)")
+	adminAddrPtr   = flag.String("admin", defaultAdminAddr, "separate listen address for the admin routes (optional)")
+
+	// Replay mode: re-submit the requests of a recording (see RECORD_FILE) instead of running the server
+	replayPtr            = flag.String("replay", "", "recording file to replay (newline-delimited JSON)")
+	replayTargetPtr      = flag.String("replay-target", "http://localhost:8080/sim", "balancer URL to replay the requests to")
+	replayTimingPtr      = flag.Bool("replay-timing", false, "preserve the original inter-arrival timing of the requests")
+	replayRatePtr        = flag.Float64("replay-rate", 0, "requests per second (0 for as fast as possible, ignored with -replay-timing)")
+	replayConcurrencyPtr = flag.Int("replay-concurrency", replay.DefaultConcurrency, "maximum number of replayed requests in flight")
+	replayAPIKeyPtr      = flag.String("replay-api-key", "", "X-API-Key header of the replayed requests (optional)")
 )
 
 func perr(err error) {
@@ -49,23 +71,39 @@ func perr(err error) {
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		runLoadtest(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	// Setup logging
-	var logger *zap.Logger
+	// The level is shared by all loggers, and can be changed at runtime with /admin/loglevel
+	logConfig := zap.NewDevelopmentConfig()
 	if *logProdPtr {
-		logger, _ = zap.NewProduction()
-	} else {
-		logger, _ = zap.NewDevelopment()
+		logConfig = zap.NewProductionConfig()
 	}
+	logger, _ := logConfig.Build()
 	log := logger.Sugar()
 	if *logServicePtr != "" {
 		log = log.With("service", *logServicePtr)
 	}
+	if *replayPtr != "" {
+		runReplay(log)
+		return
+	}
+
 	log.Infow("Starting prio-load-balancer", "version", version)
 
-	// Setup the redis connection
-	if *redisPtr == "dev" {
+	// Setup the redis connection (unless a state file is used instead)
+	stateFile, err := server.StateFileFromNodeStore(*nodeStorePtr, *stateFilePtr)
+	perr(err)
+	*stateFilePtr = stateFile
+	if *stateFilePtr != "" && *redisPtr == "dev" {
+		*redisPtr = ""
+	} else if *redisPtr == "dev" {
 		log.Info("Using integrated in-memory Redis instance")
 		redisServer, err := miniredis.Run()
 		perr(err)
@@ -75,8 +113,14 @@ func main() {
 	serverOpts := server.ServerOpts{
 		Log:            log,
 		RedisURI:       *redisPtr,
+		StateFile:      *stateFilePtr,
 		WorkersPerNode: int32(*nodeWorkersPtr),
 		HTTPAddrPtr:    *httpAddrPtr,
+		HTTPSAddr:      *httpsAddrPtr,
+		TLSCertFile:    *tlsCertPtr,
+		TLSKeyFile:     *tlsKeyPtr,
+		AdminAddr:      *adminAddrPtr,
+		LogLevel:       &logConfig.Level,
 	}
 
 	srv, err := server.NewServer(serverOpts)
@@ -116,32 +160,72 @@ func main() {
 		}
 	}()
 
-	// Handle shutdown gracefully
+	// Reload the TLS certificate and the config file (CONFIG_FILE) on SIGHUP
+	srv.ReloadOnSignal(context.Background(), syscall.SIGHUP)
+
+	// Handle shutdown gracefully: drain the queue for SHUTDOWN_GRACE_PERIOD_SEC (also with /admin/shutdown)
 	go func() {
 		exit := make(chan os.Signal, 1)
 		signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
 		<-exit
 		log.Info("Shutting down...")
-		srv.Shutdown()
+
+		// Exit anyway if draining hangs past SHUTDOWN_HARD_TIMEOUT_SEC, or on a second signal
+		server.ShutdownWithDeadline(log, func() {
+			srv.StartShutdown(server.ShutdownOpts{GracePeriod: server.ShutdownGracePeriod, Exit: true})
+			<-srv.Done()
+		}, server.ShutdownHardTimeout, exit, os.Exit)
 	}()
 
 	// Log the current config
 	server.LogConfig(log)
 
 	// Start the server
-	srv.Start()
+	go srv.Start()
+	<-srv.Done()
+	if status := srv.ShutdownStatus(); status != nil && !status.Exit {
+		log.Info("Stopped serving, not exiting")
+		select {}
+	} else if status != nil {
+		log.Infow("bye", "exitCode", status.ExitCode)
+		os.Exit(status.ExitCode)
+	}
 	log.Info("bye")
 }
 
+// runReplay re-submits the requests of the -replay recording to the -replay-target balancer, and logs the summary
+func runReplay(log *zap.SugaredLogger) {
+	file, err := os.Open(*replayPtr)
+	perr(err)
+	records, err := server.ReadRecordedRequests(file)
+	file.Close()
+	perr(err)
+
+	// Stop scheduling requests on SIGINT / SIGTERM, but wait for the ones in flight
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	log.Infow("Replaying requests", "file", *replayPtr, "numRequests", len(records), "target", *replayTargetPtr, "preserveTiming", *replayTimingPtr, "rate", *replayRatePtr)
+	summary := replay.Run(ctx, records, replay.Options{
+		TargetURL:      *replayTargetPtr,
+		PreserveTiming: *replayTimingPtr,
+		Rate:           *replayRatePtr,
+		Concurrency:    *replayConcurrencyPtr,
+		APIKey:         *replayAPIKeyPtr,
+	})
+	log.Infow("Replay finished", "summary", summary.String())
+}
+
+// getEnv returns the value of the config file (CONFIG_FILE) or the environment, see server.LookupConfig
 func getEnv(key, defaultValue string) string {
-	if value, ok := os.LookupEnv(key); ok {
+	if value, ok := server.LookupConfig(key); ok {
 		return value
 	}
 	return defaultValue
 }
 
 func getEnvInt(key string, defaultValue int) int {
-	if value, ok := os.LookupEnv(key); ok {
+	if value, ok := server.LookupConfig(key); ok {
 		val, err := strconv.Atoi(value)
 		if err == nil {
 			return val
@@ -0,0 +1,160 @@
+// Package replay re-submits recorded requests (see server.RequestRecorder) to a balancer
+package replay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+)
+
+var DefaultConcurrency = 100
+
+// Options of a replay. Without PreserveTiming and Rate, the requests are sent as fast as possible.
+type Options struct {
+	TargetURL      string       // i.e. "http://localhost:8080/sim"
+	PreserveTiming bool         // keep the original inter-arrival times of the recording
+	Rate           float64      // requests per second (ignored with PreserveTiming)
+	Concurrency    int          // maximum number of requests in flight (default: DefaultConcurrency)
+	APIKey         string       // sent as X-API-Key header (optional, for multi-tenancy)
+	HTTPClient     *http.Client // default: http.DefaultClient
+}
+
+// Summary of a replay
+type Summary struct {
+	NumRequests  int                       `json:"numRequests"`
+	NumSucceeded int                       `json:"numSucceeded"`
+	NumFailed    int                       `json:"numFailed"`
+	Errors       map[string]int            `json:"errors"` // by error kind (X-Error-Kind), or http_<status code>
+	LatencyUs    server.LatencyPercentiles `json:"latencyUs"`
+	Duration     time.Duration             `json:"duration"`
+}
+
+func (s Summary) String() string {
+	errorKinds := make([]string, 0, len(s.Errors))
+	for kind, count := range s.Errors {
+		errorKinds = append(errorKinds, fmt.Sprintf("%s=%d", kind, count))
+	}
+	sort.Strings(errorKinds)
+	return fmt.Sprintf("requests=%d succeeded=%d failed=%d errors=[%s] latency_us=[p50=%d p90=%d p99=%d max=%d] duration=%s",
+		s.NumRequests, s.NumSucceeded, s.NumFailed, strings.Join(errorKinds, " "),
+		s.LatencyUs.P50, s.LatencyUs.P90, s.LatencyUs.P99, s.LatencyUs.Max, s.Duration.Round(time.Millisecond))
+}
+
+// Run sends the records to the target balancer, in order, and returns the summary once all responses are received.
+// Stops scheduling requests when ctx is cancelled.
+func Run(ctx context.Context, records []server.RecordedRequest, opts Options) Summary {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+
+	var (
+		lock      sync.Mutex
+		wg        sync.WaitGroup
+		latencies = make([]int64, 0, len(records))
+		summary   = Summary{Errors: make(map[string]int)}
+		sem       = make(chan struct{}, opts.Concurrency)
+		startTime = time.Now()
+	)
+
+schedule:
+	for i, record := range records {
+		// Wait until the request is due
+		var due time.Time
+		if opts.PreserveTiming {
+			due = startTime.Add(record.Timestamp.Sub(records[0].Timestamp))
+		} else if opts.Rate > 0 {
+			due = startTime.Add(time.Duration(float64(i) / opts.Rate * float64(time.Second)))
+		}
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-ctx.Done():
+				break schedule
+			case <-time.After(wait):
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			break schedule
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(record server.RecordedRequest) {
+			defer func() { <-sem; wg.Done() }()
+			latency, errorKind := send(ctx, opts, record)
+
+			lock.Lock()
+			defer lock.Unlock()
+			summary.NumRequests++
+			latencies = append(latencies, latency.Microseconds())
+			if errorKind != "" {
+				summary.NumFailed++
+				summary.Errors[errorKind]++
+			} else {
+				summary.NumSucceeded++
+			}
+		}(record)
+	}
+	wg.Wait()
+
+	summary.Duration = time.Since(startTime)
+	summary.LatencyUs = server.Percentiles(latencies)
+	return summary
+}
+
+// send submits one recorded request, and returns the latency and the error kind (empty on success)
+func send(ctx context.Context, opts Options, record server.RecordedRequest) (time.Duration, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.TargetURL, bytes.NewReader(record.Body()))
+	if err != nil {
+		return 0, "request_error"
+	}
+	contentType := record.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch record.Priority {
+	case server.PriorityFastTrack:
+		req.Header.Set("X-Fast-Track", "true")
+	case server.PriorityHighPrio:
+		req.Header.Set("X-High-Priority", "true")
+	default: // explicitly low-prio, so that priority rules of the target don't reclassify the request
+		req.Header.Set("X-High-Priority", "false")
+	}
+	if record.ReqID != "" {
+		req.Header.Set("X-Request-ID", record.ReqID)
+	}
+	if record.ClientID != "" {
+		req.Header.Set("X-Client-ID", record.ClientID)
+	}
+	if opts.APIKey != "" {
+		req.Header.Set("X-API-Key", opts.APIKey)
+	}
+
+	start := time.Now()
+	resp, err := opts.HTTPClient.Do(req)
+	if err != nil {
+		return time.Since(start), "transport_error"
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	latency := time.Since(start)
+
+	if resp.StatusCode == http.StatusOK {
+		return latency, ""
+	} else if errorKind := resp.Header.Get("X-Error-Kind"); errorKind != "" {
+		return latency, errorKind
+	}
+	return latency, fmt.Sprintf("http_%d", resp.StatusCode)
+}
@@ -0,0 +1,138 @@
+package replay
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+	"github.com/flashbots/prio-load-balancer/simtest"
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// record sends a handful of requests (interval apart) to an in-process balancer with RECORD_FILE, and returns the
+// recording
+func record(t *testing.T, interval time.Duration) []server.RecordedRequest {
+	t.Helper()
+	defer func(recordFile string) { server.RecordFile = recordFile }(server.RecordFile)
+	server.RecordFile = filepath.Join(t.TempDir(), "recording.jsonl")
+	balancer, err := simtest.Start(simtest.Options{})
+	require.Nil(t, err, err)
+
+	requests := []struct {
+		method  string
+		headers map[string]string
+	}{
+		{"eth_callBundle", map[string]string{"X-Fast-Track": "true"}},
+		{"eth_callBundle", map[string]string{"X-High-Priority": "true", "X-Client-ID": "alice"}},
+		{"net_version", nil},
+		{"eth_fail", nil},
+	}
+	for i, r := range requests {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		req, err := http.NewRequest(http.MethodPost, balancer.SimURL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"`+r.method+`","params":[]}`))
+		require.Nil(t, err, err)
+		for key, value := range r.headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := balancer.Client().Do(req)
+		require.Nil(t, err, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	balancer.Close() // writes the recording
+
+	file, err := os.Open(server.RecordFile)
+	require.Nil(t, err, err)
+	defer file.Close()
+	records, err := server.ReadRecordedRequests(file)
+	require.Nil(t, err, err)
+	require.Equal(t, len(requests), len(records))
+	require.Equal(t, "alice", records[1].ClientID)
+	return records
+}
+
+func TestReplay(t *testing.T) {
+	records := record(t, 50*time.Millisecond)
+
+	// The node of the target fails the eth_fail requests. The recorded priorities are kept, even if priority rules
+	// of the target would reclassify the requests.
+	defer func(rules string) { server.PriorityRulesConfig = rules }(server.PriorityRulesConfig)
+	server.PriorityRulesConfig = `[{"pattern":"eth_","priority":"fast-track"}]`
+	target, err := simtest.Start(simtest.Options{
+		Node: testutils.FakeNodeOpts{Responses: map[string]interface{}{"eth_fail": testutils.HTTPErrorResponse{StatusCode: http.StatusBadGateway, Body: "error"}}},
+	})
+	require.Nil(t, err, err)
+	defer target.Close()
+	priorities := make(chan string, 100)
+	target.OnQueuePop(func(r *server.SimRequest, wait time.Duration) {
+		priorities <- r.Priority()
+	})
+
+	tests := []struct {
+		name        string
+		opts        Options
+		minDuration time.Duration
+	}{
+		{"as fast as possible", Options{Concurrency: 1}, 0},
+		{"preserve timing", Options{PreserveTiming: true}, 150 * time.Millisecond},
+		{"fixed rate", Options{Rate: 20}, 150 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.TargetURL = target.SimURL
+			test.opts.HTTPClient = target.Client()
+			summary := Run(context.Background(), records, test.opts)
+			require.Equal(t, 4, summary.NumRequests)
+			require.Equal(t, 3, summary.NumSucceeded)
+			require.Equal(t, 1, summary.NumFailed)
+			require.Equal(t, map[string]int{server.ErrorKindNodeError: 1}, summary.Errors)
+			require.Greater(t, summary.LatencyUs.Max, int64(0))
+			require.GreaterOrEqual(t, summary.Duration, test.minDuration)
+			require.Contains(t, summary.String(), "requests=4 succeeded=3 failed=1 errors=[node_error=1]")
+
+			received := []string{}
+			for len(priorities) > 0 {
+				received = append(received, <-priorities)
+			}
+			// eth_fail is tried RequestMaxTries times
+			require.Equal(t, 3+server.RequestMaxTries, len(received))
+			require.Contains(t, received, server.PriorityHighPrio)
+			require.Contains(t, received, server.PriorityLowPrio)
+		})
+	}
+
+	// The original request IDs are kept, up to the node of the target
+	var forwarded []testutils.CapturedRequest
+	for _, req := range target.Node().Requests() {
+		if req.Header.Get("X-Request-ID") == records[1].ReqID {
+			forwarded = append(forwarded, req)
+		}
+	}
+	require.Equal(t, len(tests), len(forwarded))
+}
+
+func TestReplayCancelled(t *testing.T) {
+	records := record(t, 0)
+	records[3].Timestamp = records[0].Timestamp.Add(time.Hour)
+
+	target, err := simtest.Start(simtest.Options{})
+	require.Nil(t, err, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	summary := Run(ctx, records, Options{TargetURL: target.SimURL, HTTPClient: target.Client(), PreserveTiming: true})
+	require.Equal(t, 3, summary.NumRequests) // the last one is not sent
+	require.Less(t, summary.Duration, time.Minute)
+
+	// Transport errors
+	target.Close()
+	summary = Run(context.Background(), records[:1], Options{TargetURL: target.SimURL})
+	require.Equal(t, map[string]int{"transport_error": 1}, summary.Errors)
+}
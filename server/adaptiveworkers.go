@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// AdaptiveWorkersConfig configures the adaptive concurrency of the nodes (AIMD): after every Window proxied requests
+// of a node, its active workers are halved if at least DecreaseErrorRate of them failed (down to a single probe
+// worker), and one worker is added back if less than IncreaseErrorRate failed. The other workers of the node don't
+// take requests from the queue, so that a failing node doesn't sacrifice them.
+type AdaptiveWorkersConfig struct {
+	Window            int
+	DecreaseErrorRate float64
+	IncreaseErrorRate float64
+}
+
+func (c AdaptiveWorkersConfig) validate() error {
+	if c.Window < 1 {
+		return fmt.Errorf("the window must be at least 1")
+	} else if c.DecreaseErrorRate <= 0 || c.DecreaseErrorRate > 1 || c.IncreaseErrorRate < 0 || c.IncreaseErrorRate > c.DecreaseErrorRate {
+		return fmt.Errorf("the error rates must be between 0 and 1, the increase rate at most the decrease rate")
+	}
+	return nil
+}
+
+// adaptiveWorkers is the number of active workers of a node, adapted to its error rate
+type adaptiveWorkers struct {
+	config AdaptiveWorkersConfig
+
+	lock         sync.Mutex
+	limit        int32 // the active workers, 0 means all
+	numSuccess   int   // in the current window
+	numFailed    int
+	changed      chan struct{} // closed when the limit changes
+	numDecreases int64
+	numIncreases int64
+}
+
+func newAdaptiveWorkers(config AdaptiveWorkersConfig) *adaptiveWorkers {
+	return &adaptiveWorkers{config: config, changed: make(chan struct{})}
+}
+
+// active returns the number of active workers of numWorkers
+func (a *adaptiveWorkers) active(numWorkers int32) int32 {
+	if a == nil {
+		return numWorkers
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a._active(numWorkers)
+}
+
+// _active is active with the lock held
+func (a *adaptiveWorkers) _active(numWorkers int32) int32 {
+	if a.limit > 0 && a.limit < numWorkers {
+		return a.limit
+	}
+	return numWorkers
+}
+
+// paused returns nil if the worker with the id may take requests, otherwise a channel which is closed when the number
+// of active workers changes
+func (a *adaptiveWorkers) paused(id, numWorkers int32) <-chan struct{} {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if id <= a._active(numWorkers) {
+		return nil
+	}
+	return a.changed
+}
+
+// observe counts the result of a proxied request, and adapts the active workers at the end of the window. Returns the
+// new number of active workers if it changed.
+func (a *adaptiveWorkers) observe(failed bool, numWorkers int32) (active int32, changed bool) {
+	if a == nil {
+		return numWorkers, false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if failed {
+		a.numFailed++
+	} else {
+		a.numSuccess++
+	}
+	if a.numSuccess+a.numFailed < a.config.Window {
+		return a._active(numWorkers), false
+	}
+
+	errorRate := float64(a.numFailed) / float64(a.numSuccess+a.numFailed)
+	a.numSuccess, a.numFailed = 0, 0
+	previous := a._active(numWorkers)
+	active = previous
+	if errorRate >= a.config.DecreaseErrorRate && previous > 1 {
+		active = previous / 2
+		a.numDecreases++
+	} else if errorRate < a.config.IncreaseErrorRate && previous < numWorkers {
+		active = previous + 1
+		a.numIncreases++
+	}
+	if active == previous {
+		return active, false
+	}
+
+	a.limit = active
+	if active >= numWorkers {
+		a.limit = 0 // all workers, also after scaling up
+	}
+	close(a.changed)
+	a.changed = make(chan struct{})
+	return active, true
+}
+
+func (a *adaptiveWorkers) counts() (numDecreases, numIncreases int64) {
+	if a == nil {
+		return 0, 0
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.numDecreases, a.numIncreases
+}
+
+// observeResult adapts the active workers and the circuit breaker of the node to the result of a proxied request (if
+// enabled)
+func (n *Node) observeResult(failed bool) {
+	n.observeBreaker(failed)
+	numWorkers := atomic.LoadInt32(&n.numWorkers)
+	if active, changed := n.adaptive.observe(failed, numWorkers); changed {
+		n.log.Infow("adapted the active node workers to the error rate", "uri", n.URI, "activeWorkers", active, "numWorkers", numWorkers)
+	}
+}
+
+// SetAdaptiveWorkers enables the adaptive concurrency of the nodes (nil disables it). Must be called before nodes
+// are added.
+func (gp *NodePool) SetAdaptiveWorkers(config *AdaptiveWorkersConfig) error {
+	if config != nil {
+		if err := config.validate(); err != nil {
+			return err
+		}
+	}
+	gp.adaptiveWorkers = config
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveWorkers(t *testing.T) {
+	a := newAdaptiveWorkers(AdaptiveWorkersConfig{Window: 4, DecreaseErrorRate: 0.5, IncreaseErrorRate: 0.25})
+	observe := func(numFailed, numSuccess int) (active int32, changed bool) {
+		for i := 0; i < numFailed; i++ {
+			active, changed = a.observe(true, 8)
+		}
+		for i := 0; i < numSuccess; i++ {
+			active, changed = a.observe(false, 8)
+		}
+		return active, changed
+	}
+
+	// Halved at the end of every window with an error rate of at least 50%, down to one worker
+	for _, expected := range []int32{4, 2, 1} {
+		active, changed := observe(2, 2)
+		require.True(t, changed)
+		require.Equal(t, expected, active)
+	}
+	active, changed := observe(4, 0)
+	require.False(t, changed)
+	require.Equal(t, int32(1), active)
+	require.Nil(t, a.paused(1, 8))
+	paused := a.paused(2, 8)
+	require.NotNil(t, paused)
+
+	// One worker is added back per window below 25%, an error rate in between keeps the workers
+	active, changed = observe(0, 4)
+	require.True(t, changed)
+	require.Equal(t, int32(2), active)
+	<-paused // closed
+	require.Nil(t, a.paused(2, 8))
+	_, changed = observe(1, 3)
+	require.False(t, changed)
+	for i := 0; i < 6; i++ {
+		active, _ = observe(0, 4)
+	}
+	require.Equal(t, int32(8), active)
+	require.Equal(t, int32(16), a.active(16)) // all workers, also after scaling up
+	numDecreases, numIncreases := a.counts()
+	require.Equal(t, int64(3), numDecreases)
+	require.Equal(t, int64(7), numIncreases)
+
+	// Disabled
+	var disabled *adaptiveWorkers
+	require.Nil(t, disabled.paused(8, 8))
+	require.Equal(t, int32(8), disabled.active(8))
+
+	require.NotNil(t, AdaptiveWorkersConfig{Window: 0, DecreaseErrorRate: 0.5}.validate())
+	require.NotNil(t, AdaptiveWorkersConfig{Window: 10, DecreaseErrorRate: 0.1, IncreaseErrorRate: 0.5}.validate())
+	require.Nil(t, AdaptiveWorkersConfig{Window: 10, DecreaseErrorRate: 0.5, IncreaseErrorRate: 0.1}.validate())
+}
+
+func TestNodeAdaptiveWorkers(t *testing.T) {
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 10 * time.Millisecond})
+	defer node.Close()
+	nodePool := NewNodePool(testLog, nil, 8)
+	defer nodePool.Shutdown()
+	require.Nil(t, nodePool.SetAdaptiveWorkers(&AdaptiveWorkersConfig{Window: 8, DecreaseErrorRate: 0.5, IncreaseErrorRate: 0.1}))
+	require.Nil(t, nodePool.AddNode(node.URL))
+
+	// Keep the workers busy
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		payload := []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+		for ctx.Err() == nil {
+			select {
+			case nodePool.JobC <- NewSimRequest(context.Background(), "", payload, false, false):
+			case <-ctx.Done():
+			}
+		}
+	}()
+	pullRate := func() int {
+		node.Reset()
+		time.Sleep(200 * time.Millisecond)
+		return node.NumRequests()
+	}
+	activeWorkers := func() int32 { return nodePool.NodeStats()[0].ActiveWorkers }
+
+	healthyRate := pullRate()
+	require.Equal(t, int32(8), activeWorkers())
+
+	// The failing node is left with a single probe worker
+	node.SetOpts(testutils.FakeNodeOpts{Latency: 10 * time.Millisecond, ErrorRate: 1})
+	require.Eventually(t, func() bool { return activeWorkers() == 1 }, 2*time.Second, 5*time.Millisecond)
+	degradedRate := pullRate()
+	require.Less(t, degradedRate*3, healthyRate, "healthy: %d, degraded: %d", healthyRate, degradedRate)
+	stats := nodePool.NodeStats()[0]
+	require.Equal(t, int32(8), stats.NumWorkers)
+	require.Equal(t, int64(3), stats.NumWorkerDecreases)
+
+	// All workers are restored once the node healed
+	node.SetOpts(testutils.FakeNodeOpts{Latency: 10 * time.Millisecond})
+	require.Eventually(t, func() bool { return activeWorkers() == 8 }, 3*time.Second, 5*time.Millisecond)
+	require.Greater(t, pullRate(), degradedRate*3)
+	require.Equal(t, int64(7), nodePool.NodeStats()[0].NumWorkerIncreases)
+}
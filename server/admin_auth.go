@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminAuthEnabled returns true if a credential for the admin routes is configured
+func AdminAuthEnabled() bool {
+	return AdminToken != "" || AdminPassword != ""
+}
+
+// secretEqual compares in constant time (hashing first, to not leak the length of the secret)
+func secretEqual(given, expected string) bool {
+	givenHash := sha256.Sum256([]byte(given))
+	expectedHash := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(givenHash[:], expectedHash[:]) == 1
+}
+
+// checkAdminAuth returns http.StatusOK if the request has a valid admin credential (bearer token or basic auth),
+// http.StatusUnauthorized if it has none, and http.StatusForbidden if it's invalid
+func checkAdminAuth(req *http.Request) int {
+	if !AdminAuthEnabled() {
+		return http.StatusOK
+	}
+
+	authHeader := req.Header.Get("Authorization")
+	if authHeader == "" {
+		return http.StatusUnauthorized
+	}
+
+	if token, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
+		if AdminToken != "" && secretEqual(token, AdminToken) {
+			return http.StatusOK
+		}
+		return http.StatusForbidden
+	}
+
+	if user, password, ok := req.BasicAuth(); ok {
+		if AdminPassword != "" && secretEqual(user, AdminUser) && secretEqual(password, AdminPassword) {
+			return http.StatusOK
+		}
+		return http.StatusForbidden
+	}
+
+	return http.StatusUnauthorized
+}
+
+// AdminAuthMiddleware only lets requests with a valid admin credential through
+func AdminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch checkAdminAuth(req) {
+		case http.StatusOK:
+			next.ServeHTTP(w, req)
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", `Basic realm="prio-load-balancer admin"`)
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "unauthorized")
+		default:
+			writeError(w, http.StatusForbidden, ErrorCodeForbidden, "forbidden")
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func setTestAdminAuth(t *testing.T, token, user, password string) {
+	t.Helper()
+	origToken, origUser, origPassword := AdminToken, AdminUser, AdminPassword
+	t.Cleanup(func() { AdminToken, AdminUser, AdminPassword = origToken, origUser, origPassword })
+	AdminToken, AdminUser, AdminPassword = token, user, password
+}
+
+func TestCheckAdminAuth(t *testing.T) {
+	newRequest := func(authorization string) *http.Request {
+		req := httptest.NewRequest("GET", "/nodes", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return req
+	}
+	basicAuth := func(user, password string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(user, password)
+		return req.Header.Get("Authorization")
+	}
+
+	// Unprotected if nothing is configured
+	setTestAdminAuth(t, "", "admin", "")
+	require.Equal(t, http.StatusOK, checkAdminAuth(newRequest("")))
+
+	setTestAdminAuth(t, "secret", "admin", "")
+	require.Equal(t, http.StatusUnauthorized, checkAdminAuth(newRequest("")))
+	require.Equal(t, http.StatusUnauthorized, checkAdminAuth(newRequest("Foo bar")))
+	require.Equal(t, http.StatusForbidden, checkAdminAuth(newRequest("Bearer wrong")))
+	require.Equal(t, http.StatusForbidden, checkAdminAuth(newRequest("Bearer ")))
+	require.Equal(t, http.StatusForbidden, checkAdminAuth(newRequest(basicAuth("admin", ""))))
+	require.Equal(t, http.StatusOK, checkAdminAuth(newRequest("Bearer secret")))
+
+	setTestAdminAuth(t, "", "admin", "pass")
+	require.Equal(t, http.StatusForbidden, checkAdminAuth(newRequest("Bearer ")))
+	require.Equal(t, http.StatusForbidden, checkAdminAuth(newRequest(basicAuth("admin", "wrong"))))
+	require.Equal(t, http.StatusForbidden, checkAdminAuth(newRequest(basicAuth("root", "pass"))))
+	require.Equal(t, http.StatusOK, checkAdminAuth(newRequest(basicAuth("admin", "pass"))))
+}
+
+func TestWebserverAdminRoutes(t *testing.T) {
+	setTestAdminAuth(t, "secret", "admin", "")
+	simPayload, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+
+	serve := func(handler http.Handler, method, path, token string, body []byte) int {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("same listener", func(t *testing.T) {
+		webserver, _ := newTestWebserver(t, 1)
+		api, admin := webserver.Handlers()
+		require.Nil(t, admin)
+
+		require.Equal(t, http.StatusUnauthorized, serve(api, "GET", "/nodes", "", nil))
+		require.Equal(t, http.StatusForbidden, serve(api, "GET", "/nodes", "wrong", nil))
+		require.Equal(t, http.StatusForbidden, serve(api, "DELETE", "/nodes", "wrong", []byte(`{"uri":"http://foo"}`)))
+		require.Equal(t, http.StatusUnauthorized, serve(api, "GET", "/admin/profile", "", nil))
+		require.Equal(t, http.StatusOK, serve(api, "GET", "/nodes", "secret", nil))
+		require.Equal(t, 1, len(webserver.nodePool.NodeUris()))
+
+		// The sim endpoint doesn't need the admin credential
+		require.Equal(t, http.StatusOK, serve(api, "POST", "/", "", simPayload))
+	})
+
+	t.Run("separate admin listener", func(t *testing.T) {
+		webserver, _ := newTestWebserver(t, 1)
+		webserver.EnableAdminListener("localhost:9497")
+		api, admin := webserver.Handlers()
+		require.NotNil(t, admin)
+
+		// Admin routes are not served on the API listener, even with the credential
+		require.Equal(t, http.StatusNotFound, serve(api, "GET", "/nodes", "secret", nil))
+		require.Equal(t, http.StatusNotFound, serve(api, "GET", "/admin/profile", "secret", nil))
+		require.Equal(t, http.StatusOK, serve(api, "POST", "/", "", simPayload))
+
+		// And the sim endpoint is not served on the admin listener
+		require.Equal(t, http.StatusUnauthorized, serve(admin, "GET", "/nodes", "", nil))
+		require.Equal(t, http.StatusOK, serve(admin, "GET", "/nodes", "secret", nil))
+		require.Equal(t, http.StatusOK, serve(admin, "GET", "/admin/profile", "secret", nil))
+		require.Equal(t, http.StatusNotFound, serve(admin, "POST", "/sim", "", simPayload))
+	})
+}
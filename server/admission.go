@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// AdmissionResponse is the answer of /admission: whether a request of the priority would be accepted now, and
+// roughly how long it would wait in the queue
+type AdmissionResponse struct {
+	Priority        string   `json:"priority"`
+	Accepted        bool     `json:"accepted"`
+	Reason          string   `json:"reason,omitempty"`          // the error kind of the rejection
+	QueuedAhead     int      `json:"queuedAhead"`               // requests which are processed before it
+	DrainRatePerSec float64  `json:"drainRatePerSec"`           // requests popped from the queue per second in the last minute
+	EstimatedWaitMs *float64 `json:"estimatedWaitMs,omitempty"` // omitted without a drain rate, if requests are queued ahead
+}
+
+// parseAdmissionPriority accepts the priority classes, and their short forms
+func parseAdmissionPriority(s string) (priority string, ok bool) {
+	switch s {
+	case PriorityFastTrack, "fast":
+		return PriorityFastTrack, true
+	case PriorityHighPrio, "high":
+		return PriorityHighPrio, true
+	case PriorityLowPrio, "low", "":
+		return PriorityLowPrio, true
+	}
+	return "", false
+}
+
+// queuedAhead returns the number of queued requests which are processed before a new request of the priority. In
+// the queue, fast-track and high-prio requests are interleaved, which is approximated by counting both for high-prio.
+func queuedAhead(q Queue, priority string) int {
+	lenFastTrack, lenHighPrio, lenLowPrio := q.Len()
+	switch priority {
+	case PriorityFastTrack:
+		return lenFastTrack
+	case PriorityHighPrio:
+		return lenFastTrack + lenHighPrio
+	}
+	return lenFastTrack + lenHighPrio + lenLowPrio
+}
+
+// admission checks a request of the client without queueing it, with the same checks as the sim endpoint
+func (s *Webserver) admission(r *SimRequest, now time.Time) AdmissionResponse {
+	res := AdmissionResponse{
+		Priority:        r.Priority(),
+		QueuedAhead:     queuedAhead(s.prioQueue, r.Priority()),
+		DrainRatePerSec: s.queueWait.drainRate(now),
+	}
+	switch {
+	case s.prioQueue.IsClosed():
+		res.Reason = ErrorKindShuttingDown
+	case s.nodePool.numNodes() == 0:
+		res.Reason = ErrorKindNoNodesAvailable
+	case r.Priority() == PriorityLowPrio && s.shedder != nil && s.shedder.Stats().Shedding:
+		res.Reason = ErrorKindLoadShed
+	case s.clientQueue != nil && r.ClientID != unknownClientID && !s.clientQueue.canAcquire(r.ClientID, r.Priority()):
+		res.Reason = ErrorKindClientQueueLimit
+	case s.reservations.rejects(r):
+		res.Reason = ErrorKindFastTrackReserved
+	case !s.prioQueue.CanPush(r):
+		res.Reason = ErrorKindQueueFull
+	}
+	res.Accepted = res.Reason == ""
+
+	res.EstimatedWaitMs = estimatedWaitMs(res.QueuedAhead, res.DrainRatePerSec)
+	return res
+}
+
+// HandleAdmissionRequest answers whether a request with the priority of the query (fast-track, high-prio or low-prio,
+// default low-prio) would be accepted now, and estimates its queue wait, without queueing anything. Clients are
+// identified like on the sim endpoint (X-API-Key with multi-tenancy, or X-Client-ID), with their fast-track
+// reservation (X-Reservation-Token).
+func (s *Webserver) HandleAdmissionRequest(w http.ResponseWriter, req *http.Request) {
+	priority, ok := parseAdmissionPriority(req.URL.Query().Get("priority"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid priority, must be one of fast-track, high-prio, low-prio")
+		return
+	}
+
+	tenant := ""
+	if s.tenants != nil {
+		var found bool
+		tenant, found = s.tenants.TenantForAPIKey(req.Header.Get("X-API-Key"))
+		if !found {
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "unknown API key")
+			return
+		}
+	}
+
+	isHighPrio, isFastTrack, err := s.limitTenantPriority(tenant, priority == PriorityHighPrio, priority == PriorityFastTrack)
+	if err != nil {
+		writeError(w, http.StatusForbidden, ErrorCodePriorityNotAllowed, err.Error())
+		return
+	}
+	r := NewSimRequest(context.Background(), "", nil, isHighPrio, isFastTrack)
+	r.Tenant = tenant
+	r.ClientID = clientIDForStats(req, tenant)
+	if token := req.Header.Get("X-Reservation-Token"); token != "" {
+		reservation, ok := s.reservations.Lookup(token)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid or expired reservation token")
+			return
+		}
+		r.Reservation = reservation
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.admission(r, time.Now())); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
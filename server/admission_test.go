@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func newAdmissionTestWebserver(t *testing.T, prioQueue *PrioQueue) *Webserver {
+	t.Helper()
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	t.Cleanup(node.Close)
+	nodePool := NewNodePool(testLog, nil, 1)
+	t.Cleanup(nodePool.Shutdown)
+	require.Nil(t, nodePool.AddNode(node.URL))
+	return NewWebserver(testLog, ":12345", prioQueue, nodePool) // without main loop, queued requests stay queued
+}
+
+func getAdmission(t *testing.T, handler http.Handler, query, clientID string) AdmissionResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/admission"+query, nil)
+	if clientID != "" {
+		req.Header.Set("X-Client-ID", clientID)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var res AdmissionResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&res))
+	return res
+}
+
+func TestAdmission(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 2, 0, 2, false, PriorityAging{})
+	webserver := newAdmissionTestWebserver(t, prioQueue)
+	handler := webserver.Handler()
+
+	res := getAdmission(t, handler, "", "")
+	require.Equal(t, PriorityLowPrio, res.Priority)
+	require.True(t, res.Accepted)
+	require.Equal(t, 0.0, *res.EstimatedWaitMs)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admission?priority=urgent", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The queue limit of the priority
+	for i := 0; i < 2; i++ {
+		require.True(t, prioQueue.Push(NewSimRequest(context.Background(), "high", []byte("x"), true, false)))
+	}
+	res = getAdmission(t, handler, "?priority=high", "")
+	require.False(t, res.Accepted)
+	require.Equal(t, ErrorKindQueueFull, res.Reason)
+	require.Equal(t, 2, res.QueuedAhead)
+	require.True(t, getAdmission(t, handler, "?priority=fast-track", "").Accepted)
+	require.Equal(t, 0, getAdmission(t, handler, "?priority=fast", "").QueuedAhead)
+
+	// Load shedding only rejects low-prio requests
+	webserver.EnableLoadShedding(NewLoadShedder(2, 0, 0.5), false)
+	webserver.shouldShed()
+	res = getAdmission(t, handler, "?priority=low", "")
+	require.Equal(t, ErrorKindLoadShed, res.Reason)
+	require.Equal(t, 2, res.QueuedAhead)
+	require.True(t, getAdmission(t, handler, "?priority=fast-track", "").Accepted)
+	webserver.EnableLoadShedding(nil, false)
+
+	// Per-client limits, requests without a client ID are not limited
+	webserver.EnableClientQueueLimits(ClientQueueLimits{LowPrio: 1})
+	require.True(t, webserver.clientQueue.acquire("a", PriorityLowPrio))
+	require.Equal(t, ErrorKindClientQueueLimit, getAdmission(t, handler, "", "a").Reason)
+	require.True(t, getAdmission(t, handler, "", "b").Accepted)
+	require.True(t, getAdmission(t, handler, "", "").Accepted)
+	require.Equal(t, 1, webserver.clientQueue.numQueued("a")) // nothing was counted
+
+	// Nothing was queued
+	require.Equal(t, 2, prioQueue.NumRequests())
+
+	prioQueue.Close()
+	require.Equal(t, ErrorKindShuttingDown, getAdmission(t, handler, "?priority=fast-track", "").Reason)
+}
+
+func TestAdmissionNoNodes(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	res := getAdmission(t, webserver.Handler(), "?priority=high-prio", "")
+	require.False(t, res.Accepted)
+	require.Equal(t, ErrorKindNoNodesAvailable, res.Reason)
+}
+
+func TestAdmissionEstimatedWait(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	webserver := newAdmissionTestWebserver(t, prioQueue)
+	now := time.Now()
+	probe := func(priority string) AdmissionResponse {
+		return webserver.admission(NewSimRequest(context.Background(), "", nil, priority == PriorityHighPrio, priority == PriorityFastTrack), now)
+	}
+
+	// Without a drain rate, the wait is unknown
+	require.True(t, prioQueue.Push(NewSimRequest(context.Background(), "low", []byte("x"), false, false)))
+	res := probe(PriorityLowPrio)
+	require.True(t, res.Accepted)
+	require.Equal(t, 1, res.QueuedAhead)
+	require.Nil(t, res.EstimatedWaitMs)
+
+	// 2 requests per second (older samples are outside of the window)
+	for i := 0; i < 120; i++ {
+		webserver.queueWait.observeAt(PriorityHighPrio, time.Millisecond, now.Add(-time.Duration(i)*500*time.Millisecond))
+	}
+	res = probe(PriorityLowPrio)
+	require.InDelta(t, 2.0, res.DrainRatePerSec, 0.05)
+	require.InDelta(t, 500, *res.EstimatedWaitMs, 15)
+
+	// The estimate grows with the queue depth, and with lower priorities
+	prevWait := *res.EstimatedWaitMs
+	for i := 0; i < 3; i++ {
+		require.True(t, prioQueue.Push(NewSimRequest(context.Background(), "high", []byte("x"), true, false)))
+		res = probe(PriorityLowPrio)
+		require.Greater(t, *res.EstimatedWaitMs, prevWait)
+		prevWait = *res.EstimatedWaitMs
+	}
+	require.Less(t, *probe(PriorityHighPrio).EstimatedWaitMs, prevWait)
+	require.Equal(t, 0.0, *probe(PriorityFastTrack).EstimatedWaitMs)
+
+	// And shrinks with a higher drain rate
+	for i := 0; i < 120; i++ {
+		webserver.queueWait.observeAt(PriorityLowPrio, time.Millisecond, now.Add(-time.Duration(i)*500*time.Millisecond))
+	}
+	require.Less(t, *probe(PriorityLowPrio).EstimatedWaitMs, prevWait)
+}
@@ -0,0 +1,46 @@
+package server
+
+import "time"
+
+// PriorityAging promotes the requests which waited too long (since they were created) into the next lane, so that a
+// steady stream of higher priority requests doesn't starve them: low-prio requests into the high-prio lane after
+// LowPrioAfter, high-prio requests into the fast-track lane after HighPrioAfter (0 disables either). A promoted request
+// keeps its priority (i.e. its timeout), but counts against the limit of its new lane, and is promoted again once it
+// waited long enough for that lane. Requests are promoted lazily in Pop, only the oldest requests of a lane are checked.
+type PriorityAging struct {
+	LowPrioAfter  time.Duration
+	HighPrioAfter time.Duration
+}
+
+// promoteAged moves the aged requests at the heads of the low-prio and high-prio lanes into the next lane, before the
+// newer requests there (low-prio first, so that a request aged for both lanes is promoted twice). Aged low-prio
+// requests stay queued while the low-prio queue is paused. The lock must be held.
+func (q *PrioQueue) promoteAged(now time.Time) {
+	if q.aging.LowPrioAfter > 0 && !q.lowPrioPaused {
+		for len(q.lowPrio) > 0 && now.Sub(q.lowPrio[0].CreatedAt) >= q.aging.LowPrioAfter {
+			q.highPrio = insertByCreatedAt(q.highPrio, q.lowPrio[0])
+			q.lowPrio = q.lowPrio[1:]
+		}
+	}
+	if q.aging.HighPrioAfter > 0 {
+		for len(q.highPrio) > 0 && now.Sub(q.highPrio[0].CreatedAt) >= q.aging.HighPrioAfter {
+			q.fastTrack = insertByCreatedAt(q.fastTrack, q.highPrio[0])
+			q.highPrio = q.highPrio[1:]
+		}
+	}
+}
+
+// insertByCreatedAt inserts r before the first request of the lane which was created after it
+func insertByCreatedAt(lane []*SimRequest, r *SimRequest) []*SimRequest {
+	idx := len(lane)
+	for i, queued := range lane {
+		if queued.CreatedAt.After(r.CreatedAt) {
+			idx = i
+			break
+		}
+	}
+	lane = append(lane, nil)
+	copy(lane[idx+1:], lane[idx:])
+	lane[idx] = r
+	return lane
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrioQueueAging(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{LowPrioAfter: time.Minute, HighPrioAfter: 5 * time.Minute})
+	defer q.Close()
+	push := func(id string, age time.Duration, isHighPrio, isFastTrack bool) {
+		r := NewSimRequest(context.Background(), id, []byte(id), isHighPrio, isFastTrack)
+		r.CreatedAt = time.Now().Add(-age)
+		require.True(t, q.Push(r))
+	}
+	popOrder := func(n int) (ids []string) {
+		for i := 0; i < n; i++ {
+			ids = append(ids, q.Pop().ID)
+		}
+		return ids
+	}
+
+	// Below the threshold, the low-prio request waits for the high-prio ones
+	push("l1", 30*time.Second, false, false)
+	push("h1", 20*time.Second, true, false)
+	push("h2", 0, true, false)
+	require.Equal(t, []string{"h1", "h2", "l1"}, popOrder(3))
+
+	// Once aged past the threshold, it overtakes the newer high-prio requests (the older ones keep their place)
+	push("h1", 2*time.Minute, true, false)
+	push("l1", 90*time.Second, false, false)
+	push("l2", 0, false, false)
+	push("h2", 10*time.Second, true, false)
+	push("h3", 0, true, false)
+	require.Equal(t, []string{"h1", "l1", "h2", "h3", "l2"}, popOrder(5))
+
+	// Aged high-prio requests move into the fast-track queue, a low-prio request which waited long enough as well
+	push("f1", 0, true, true)
+	push("l1", 6*time.Minute, false, false)
+	push("h1", 0, true, false)
+	require.Equal(t, []string{"l1", "f1", "h1"}, popOrder(3))
+
+	// Aged low-prio requests stay queued while the low-prio queue is paused
+	q.SetLowPrioScheduling(true, 0)
+	push("l1", 2*time.Minute, false, false)
+	push("h1", 0, true, false)
+	require.Equal(t, []string{"h1"}, popOrder(1))
+	_, _, lenLowPrio := q.Len()
+	require.Equal(t, 1, lenLowPrio)
+
+	// Disabled
+	q = NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer q.Close()
+	push("l1", time.Hour, false, false)
+	push("h1", 0, true, false)
+	require.Equal(t, []string{"h1", "l1"}, popOrder(2))
+}
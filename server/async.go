@@ -0,0 +1,283 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Status of an async request
+const (
+	AsyncStatusQueued     = "queued"     // waiting for a node worker (or for the backoff of a retry)
+	AsyncStatusProcessing = "processing" // being proxied
+	AsyncStatusPending    = "pending"    // submitted to another instance (with an AsyncResultStore), which knows its status
+)
+
+var errAsyncDuplicateID = errors.New("an async request with this ID is pending already")
+
+// AsyncStatusResponse is the response of POST /sim?async=1 (202), and of GET /sim/{id} while the request is pending
+type AsyncStatusResponse struct {
+	ID              string   `json:"id"`
+	Status          string   `json:"status"`
+	Position        *int     `json:"position,omitempty"`        // queued requests which are processed before it (only while queued)
+	EstimatedWaitMs *float64 `json:"estimatedWaitMs,omitempty"` // omitted without a drain rate, if requests are queued ahead
+}
+
+// AsyncResultStore stores the results of async requests outside of the instance (i.e. in redis, see RedisState), so
+// that they can be fetched from any instance. Until the result is saved, the request is marked as pending.
+type AsyncResultStore interface {
+	SaveAsyncPending(tenant, id string, ttl time.Duration) error
+	DeleteAsyncPending(tenant, id string) error                                             // i.e. if the queue rejected it
+	SaveAsyncResult(tenant, id string, result SimsResponseEntry, ttl time.Duration) error   // removes the pending marker
+	TakeAsyncResult(tenant, id string) (result *SimsResponseEntry, pending bool, err error) // removes the result, nil if not found (or expired)
+}
+
+var _ AsyncResultStore = (*RedisState)(nil)
+
+// storedAsyncResult is the JSON of a result in an AsyncResultStore. The payload is base64 encoded, because a
+// json.RawMessage would be compacted.
+type storedAsyncResult struct {
+	SimsResponseEntry
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// asyncResults holds the async requests until their result was fetched, or expired. The store is bounded, pending
+// requests count towards the limit as well. With an AsyncResultStore, the results are kept there instead (unless
+// saving one fails), and don't count towards the limit.
+type asyncResults struct {
+	lock       sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[pendingRequestKey]*asyncEntry
+	completed  []asyncCompletion // in the order of completion, which is the order of expiry
+
+	log   *zap.SugaredLogger
+	store AsyncResultStore // (optional) see SetAsyncResultStore
+}
+
+type asyncEntry struct {
+	req    *SimRequest
+	result *SimsResponseEntry // nil until completed
+}
+
+type asyncCompletion struct {
+	key       pendingRequestKey
+	entry     *asyncEntry
+	expiresAt time.Time
+}
+
+func newAsyncResults(maxEntries int, ttl time.Duration) *asyncResults {
+	return &asyncResults{maxEntries: maxEntries, ttl: ttl, entries: make(map[pendingRequestKey]*asyncEntry)}
+}
+
+// add registers the async request before it's queued. Fails if the store is full, or a request with the ID was
+// submitted already and its result wasn't fetched yet (only the results kept in memory are checked). With an
+// AsyncResultStore, the request is marked as pending there for its timeout and the TTL, so that the other instances
+// answer it with 202 too.
+func (a *asyncResults) add(r *SimRequest, now time.Time) error {
+	if err := a.addEntry(r, now); err != nil {
+		return err
+	}
+	if a.store != nil {
+		if err := a.store.SaveAsyncPending(r.Tenant, r.ID, r.Timeout+a.ttl); err != nil {
+			a.log.Errorw("Marking the async request as pending failed, only this instance knows it", "error", err, "reqID", r.ID)
+		}
+	}
+	return nil
+}
+
+func (a *asyncResults) addEntry(r *SimRequest, now time.Time) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.evictExpired(now)
+	key := pendingRequestKey{tenant: r.Tenant, id: r.ID}
+	if _, found := a.entries[key]; found {
+		return errAsyncDuplicateID
+	} else if len(a.entries) >= a.maxEntries {
+		return ErrAsyncLimit
+	}
+	a.entries[key] = &asyncEntry{req: r}
+	return nil
+}
+
+// remove drops the pending request, i.e. if the queue rejected it
+func (a *asyncResults) remove(r *SimRequest) {
+	if a == nil || !a.removeEntry(r) || a.store == nil {
+		return
+	}
+	if err := a.store.DeleteAsyncPending(r.Tenant, r.ID); err != nil {
+		a.log.Errorw("Deleting the pending marker of the async request failed", "error", err, "reqID", r.ID)
+	}
+}
+
+// removeEntry drops the pending request from memory. Returns false if it's not pending.
+func (a *asyncResults) removeEntry(r *SimRequest) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := pendingRequestKey{tenant: r.Tenant, id: r.ID}
+	if entry := a.entries[key]; entry != nil && entry.req == r && entry.result == nil {
+		delete(a.entries, key)
+		return true
+	}
+	return false
+}
+
+// complete stores the result of the request, which is kept for the TTL
+func (a *asyncResults) complete(r *SimRequest, result SimsResponseEntry, now time.Time) {
+	key := pendingRequestKey{tenant: r.Tenant, id: r.ID}
+	if a.store != nil {
+		if err := a.store.SaveAsyncResult(r.Tenant, r.ID, result, a.ttl); err != nil {
+			a.log.Errorw("Saving the async result failed, keeping it in memory", "error", err, "reqID", r.ID)
+		} else {
+			a.removeEntry(r)
+			return
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entry := a.entries[key]
+	if entry == nil || entry.req != r {
+		return
+	}
+	entry.result = &result
+	a.completed = append(a.completed, asyncCompletion{key: key, entry: entry, expiresAt: now.Add(a.ttl)})
+}
+
+// get returns the request with the ID, and its result once it completed. A result is removed when it's returned.
+// Results in the AsyncResultStore are returned without the request, also those of other instances. The requests
+// pending at other instances are found without request and result.
+func (a *asyncResults) get(tenant, id string, now time.Time) (r *SimRequest, result *SimsResponseEntry, found bool, err error) {
+	if r, result, found = a.getEntry(tenant, id, now); found || a.store == nil {
+		return r, result, found, nil
+	}
+	result, pending, err := a.store.TakeAsyncResult(tenant, id)
+	return nil, result, result != nil || pending, err
+}
+
+func (a *asyncResults) getEntry(tenant, id string, now time.Time) (r *SimRequest, result *SimsResponseEntry, found bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.evictExpired(now)
+	key := pendingRequestKey{tenant: tenant, id: id}
+	entry := a.entries[key]
+	if entry == nil {
+		return nil, nil, false
+	} else if entry.result != nil {
+		delete(a.entries, key)
+	}
+	return entry.req, entry.result, true
+}
+
+func (a *asyncResults) evictExpired(now time.Time) {
+	n := 0
+	for ; n < len(a.completed) && !now.Before(a.completed[n].expiresAt); n++ {
+		if c := a.completed[n]; a.entries[c.key] == c.entry {
+			delete(a.entries, c.key)
+		}
+	}
+	a.completed = a.completed[n:]
+}
+
+// estimatedWaitMs returns the estimated queue wait of a request with the number of requests queued ahead, or nil
+// without a drain rate
+func estimatedWaitMs(queuedAhead int, drainRatePerSec float64) *float64 {
+	if queuedAhead == 0 {
+		estimate := 0.0
+		return &estimate
+	} else if drainRatePerSec > 0 {
+		estimate := float64(queuedAhead) / drainRatePerSec * 1000
+		return &estimate
+	}
+	return nil
+}
+
+// asyncStatus returns the status of a pending async request, with its position in the queue while it's queued
+func (s *Webserver) asyncStatus(r *SimRequest) AsyncStatusResponse {
+	res := AsyncStatusResponse{ID: r.ID, Status: AsyncStatusProcessing}
+	if r.queueState.Load() == requestQueued {
+		res.Status = AsyncStatusQueued
+	}
+	if q, ok := s.prioQueue.(*PrioQueue); ok {
+		if ahead, queued := q.Position(r); queued {
+			res.Status = AsyncStatusQueued
+			res.Position = &ahead
+			res.EstimatedWaitMs = estimatedWaitMs(ahead, s.queueWait.drainRate(time.Now()))
+		}
+	}
+	return res
+}
+
+// completeAsync waits for the response of the queued async request in the background, and stores its result for
+// GET /sim/{id}, or sends it to the callback URL. The request has a deadline, so that it's answered when it passes in
+// the queue. With queue persistence, the requests which were flushed by a shutdown are left for the next instance.
+func (s *Webserver) completeAsync(log *zap.SugaredLogger, simReq *SimRequest, payload Payload, startTime time.Time, callbackURL string) {
+	defer payload.Close()
+	resp, _ := s.waitForBatchElement(simReq.Context, log, simReq, startTime) // the context is never cancelled
+	if s.queuePersistence != nil && errors.Is(resp.Error, ErrShuttingDown) {
+		log.Infow("Async request not completed because of the shutdown, it's queued again on the next start")
+		return
+	}
+	result := newSimsResponseEntry(simReq, resp, startTime)
+	s.finishAsync(simReq, result, callbackURL)
+	log.Infow("Async request completed", "durationMs", time.Since(startTime).Milliseconds(), "statusCode", result.StatusCode, "errorKind", result.ErrorKind, "nodeURI", resp.NodeURI, "requestTries", simReq.Tries)
+}
+
+// finishAsync stores the result of the async request, or sends it to the callback URL
+func (s *Webserver) finishAsync(simReq *SimRequest, result SimsResponseEntry, callbackURL string) {
+	if callbackURL != "" {
+		s.callbacks.Send(callbackURL, CallbackDocument{SimsResponseEntry: result, PayloadSHA256: payloadSHA256(simReq.Payload)}, s.signer)
+	} else {
+		s.asyncResults.complete(simReq, result, time.Now())
+	}
+	s.queuePersistence.Delete(simReq)
+}
+
+// HandleAsyncResultRequest returns the async request with the ID (its X-Request-ID, with multi-tenancy only of the
+// tenant of the X-API-Key header): 202 with its status while it's pending (AsyncStatusPending if it's pending at
+// another instance), and 200 with the result once it's done (see SimsResponseEntry), which is removed then. Unknown,
+// fetched and expired IDs are 404.
+func (s *Webserver) HandleAsyncResultRequest(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	tenant := ""
+	if s.tenants != nil {
+		var found bool
+		if tenant, found = s.tenants.TenantForAPIKey(req.Header.Get("X-API-Key")); !found {
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "unknown API key")
+			return
+		}
+	}
+	if s.asyncResults == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "no async request with this ID")
+		return
+	}
+
+	r, result, found, err := s.asyncResults.get(tenant, id, time.Now())
+	if err != nil {
+		s.log.Errorw("Fetching the async result failed", "error", err, "reqID", id)
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, "fetching the result failed")
+		return
+	} else if !found {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "no async request with this ID")
+		return
+	}
+	var res interface{} = result
+	statusCode := http.StatusOK
+	if result == nil && r == nil {
+		res, statusCode = AsyncStatusResponse{ID: id, Status: AsyncStatusPending}, http.StatusAccepted
+	} else if result == nil {
+		res, statusCode = s.asyncStatus(r), http.StatusAccepted
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writePayload(w, req, statusCode, append(payload, '\n'))
+}
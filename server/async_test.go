@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncResults(t *testing.T) {
+	now := time.Now()
+	results := newAsyncResults(2, time.Minute)
+	r1 := NewSimRequest(context.Background(), "r1", []byte("x"), false, false)
+	r2 := NewSimRequest(context.Background(), "r2", []byte("x"), false, false)
+	require.Nil(t, results.add(r1, now))
+	require.Equal(t, errAsyncDuplicateID, results.add(NewSimRequest(context.Background(), "r1", []byte("x"), false, false), now))
+	require.Nil(t, results.add(r2, now))
+	require.Equal(t, ErrAsyncLimit, results.add(NewSimRequest(context.Background(), "r3", []byte("x"), false, false), now))
+
+	// Pending requests are returned without result, and removed once rejected
+	r, result, found, _ := results.get("", "r1", now)
+	require.True(t, found)
+	require.Equal(t, r1, r)
+	require.Nil(t, result)
+	results.remove(r2)
+	_, _, found, _ = results.get("", "r2", now)
+	require.False(t, found)
+
+	// A result is returned once
+	results.complete(r1, SimsResponseEntry{RequestID: "r1", StatusCode: http.StatusOK}, now)
+	_, result, found, _ = results.get("", "r1", now)
+	require.True(t, found)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	_, _, found, _ = results.get("", "r1", now)
+	require.False(t, found)
+	results.remove(r1) // no-op
+
+	// Results expire after the TTL, and free their slot
+	require.Nil(t, results.add(r1, now))
+	require.Nil(t, results.add(r2, now))
+	results.complete(r2, SimsResponseEntry{RequestID: "r2"}, now)
+	_, _, found, _ = results.get("", "r2", now.Add(time.Minute))
+	require.False(t, found)
+	require.Nil(t, results.add(NewSimRequest(context.Background(), "r3", []byte("x"), false, false), now.Add(time.Minute)))
+	require.Equal(t, 2, len(results.entries))
+}
+
+func TestWebserverAsync(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	proxied := make(chan struct{}, 1)
+	release := make(chan struct{})
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		proxied <- struct{}{}
+		<-release
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}
+	handler := webserver.Handler()
+	getResult := func(id string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sim/"+id, nil))
+		return rr
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/sim?async=1", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+	req.Header.Set("X-Request-ID", "async-1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var status AsyncStatusResponse
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, "async-1", status.ID)
+
+	// Pending while it's proxied
+	<-proxied
+	rr = getResult("async-1")
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var pending AsyncStatusResponse
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &pending))
+	require.Equal(t, AsyncStatusResponse{ID: "async-1", Status: AsyncStatusProcessing}, pending)
+
+	// The result is returned once
+	close(release)
+	require.Eventually(t, func() bool { return getResult("async-1").Code != http.StatusAccepted }, time.Second, 5*time.Millisecond)
+	rr = getResult("async-1")
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Equal(t, ErrorCodeNotFound, decodeErrorResponse(t, rr).Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/sim?async=1", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+	req.Header.Set("X-Request-ID", "async-2")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	var result SimsResponseEntry
+	require.Eventually(t, func() bool {
+		rr = getResult("async-2")
+		return rr.Code == http.StatusOK
+	}, time.Second, 5*time.Millisecond)
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	require.Equal(t, "async-2", result.RequestID)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	require.Equal(t, `{"jsonrpc":"2.0","result":"0x1","id":1}`, string(result.Payload))
+	require.Equal(t, 1, result.Tries)
+	require.NotEmpty(t, result.NodeURI)
+
+	// Batches are not supported
+	defer func(split bool) { SplitJSONRPCBatches = split }(SplitJSONRPCBatches)
+	SplitJSONRPCBatches = true
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/sim?async=1", bytes.NewBufferString(`[{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}]`)))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// TestServerAsyncRedis fetches the result of an async request from another instance using the same redis
+func TestServerAsyncRedis(t *testing.T) {
+	resetTestRedis()
+	submitting, err := NewServer(ServerOpts{Log: testLog, RedisURI: redisTestServer.Addr(), WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	defer submitting.Shutdown()
+	fetching, err := NewServer(ServerOpts{Log: testLog, RedisURI: redisTestServer.Addr(), WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	defer fetching.Shutdown()
+
+	release := make(chan struct{})
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if strings.Contains(string(body), "eth_estimateGas") {
+			<-release
+		}
+		if strings.Contains(string(body), "eth_callBundle") {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0", "result":"0x1","id":1}`))
+	}
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+	require.Nil(t, submitting.AddNode(mockNodeServer.URL+"?_healthcheck_success=status"))
+	go submitting.Run()
+
+	submit := func(id, method string) {
+		req := httptest.NewRequest(http.MethodPost, "/sim?async=1", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"`+method+`","params":[],"id":1}`))
+		req.Header.Set("X-Request-ID", id)
+		rr := httptest.NewRecorder()
+		submitting.webserver.Handler().ServeHTTP(rr, req)
+		require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+	fetch := func(id string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		fetching.webserver.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sim/"+id, nil))
+		return rr
+	}
+	fetchResult := func(id string) (result SimsResponseEntry) {
+		var rr *httptest.ResponseRecorder
+		require.Eventually(t, func() bool {
+			rr = fetch(id)
+			return rr.Code == http.StatusOK
+		}, 2*time.Second, 5*time.Millisecond)
+		require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		return result
+	}
+
+	// The other instance knows the pending request
+	submit("async-0", "eth_estimateGas")
+	rr := fetch("async-0")
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var status AsyncStatusResponse
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, AsyncStatusResponse{ID: "async-0", Status: AsyncStatusPending}, status)
+	close(release)
+	require.Equal(t, http.StatusOK, fetchResult("async-0").StatusCode)
+
+	// The result is fetched from the other instance, once
+	submit("async-1", "eth_call")
+	result := fetchResult("async-1")
+	require.Equal(t, "async-1", result.RequestID)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	require.JSONEq(t, `{"jsonrpc":"2.0","result":"0x1","id":1}`, string(result.Payload))
+	require.Equal(t, 1, result.Tries)
+	require.Equal(t, http.StatusNotFound, fetch("async-1").Code)
+
+	// With the error kind of a failed request
+	submit("async-2", "eth_callBundle")
+	result = fetchResult("async-2")
+	require.Equal(t, http.StatusBadGateway, result.StatusCode)
+	require.Equal(t, ErrorKindNodeError, result.ErrorKind)
+	require.Equal(t, ErrorCodeNodeError, result.Error.Code)
+	require.JSONEq(t, `{"jsonrpc":"2.0","result":"0x1","id":1}`, string(result.Payload))
+
+	// Not kept in memory by the submitting instance
+	rr = httptest.NewRecorder()
+	submitting.webserver.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sim/async-2", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Empty(t, submitting.webserver.asyncResults.entries)
+}
+
+func TestWebserverAsyncQueueTimeout(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	webserver := newAdmissionTestWebserver(t, prioQueue)
+	handler := webserver.Handler()
+	for i := 0; i < 2; i++ {
+		require.True(t, prioQueue.Push(NewSimRequest(context.Background(), "queued", []byte("x"), false, false)))
+	}
+
+	// The position in the queue
+	req := httptest.NewRequest(http.MethodPost, "/sim?async=1", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+	req.Header.Set("X-Request-ID", "async-timeout")
+	req.Header.Set("X-Request-Deadline-Ms", "100")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var status AsyncStatusResponse
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, AsyncStatusQueued, status.Status)
+	require.Equal(t, 2, *status.Position)
+
+	// GET /sim/{id} returns the updated position while it's queued
+	require.NotNil(t, prioQueue.Pop())
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sim/async-timeout", nil))
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, 1, *status.Position)
+
+	// The deadline passes in the queue, which is the result
+	var rrResult *httptest.ResponseRecorder
+	require.Eventually(t, func() bool {
+		rrResult = httptest.NewRecorder()
+		handler.ServeHTTP(rrResult, httptest.NewRequest(http.MethodGet, "/sim/async-timeout", nil))
+		return rrResult.Code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	var result SimsResponseEntry
+	require.Nil(t, json.Unmarshal(rrResult.Body.Bytes(), &result))
+	require.Equal(t, http.StatusInternalServerError, result.StatusCode)
+	require.Equal(t, ErrorKindRequestTimeout, result.ErrorKind)
+	require.Equal(t, ErrorCodeRequestTimeout, result.Error.Code)
+	require.True(t, result.Error.Retryable)
+}
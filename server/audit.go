@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// AuditRecord is a compact record of a completed request, for postmortems. It doesn't contain the payload.
+type AuditRecord struct {
+	ReqID           string    `json:"reqID"`
+	ClientID        string    `json:"clientID,omitempty"`
+	Tenant          string    `json:"tenant,omitempty"`
+	Priority        string    `json:"priority"` // fast-track, high-prio or low-prio
+	NodeURI         string    `json:"nodeURI,omitempty"`
+	Tries           int       `json:"tries"`
+	StatusCode      int       `json:"statusCode"`
+	ErrorKind       string    `json:"errorKind,omitempty"` // see X-Error-Kind
+	Error           string    `json:"error,omitempty"`
+	PayloadSHA256   string    `json:"payloadSHA256"`
+	PayloadSize     int64     `json:"payloadSize"`
+	QueueDurationUs int64     `json:"queueDurationUs"`
+	SimDurationUs   int64     `json:"simDurationUs"`
+	TotalDurationUs int64     `json:"totalDurationUs"`
+	CreatedAt       time.Time `json:"createdAt"`
+	CompletedAt     time.Time `json:"completedAt"`
+}
+
+// AuditStore persists audit records, which expire after ttl. Implemented by RedisState.
+type AuditStore interface {
+	SaveAuditRecord(record AuditRecord, ttl time.Duration) error
+	GetAuditRecord(reqID string) (record *AuditRecord, err error) // nil if not found (or expired)
+}
+
+var _ AuditStore = (*RedisState)(nil)
+
+// AuditStats are the counters of an AuditSink
+type AuditStats struct {
+	TTLSec     int64 `json:"ttlSec"`
+	NumWritten int64 `json:"numWritten"`
+	NumDropped int64 `json:"numDropped"` // dropped because the buffer was full
+	NumFailed  int64 `json:"numFailed"`  // failed writes to the store
+}
+
+// AuditSink writes audit records to an AuditStore in the background. Records are dropped (and counted) if the
+// buffer is full, so that recording never blocks the response.
+type AuditSink struct {
+	log     *zap.SugaredLogger
+	store   AuditStore
+	ttl     time.Duration
+	records chan AuditRecord
+	wg      sync.WaitGroup
+
+	lock       sync.RWMutex // protects closing the records channel
+	closed     bool
+	numWritten atomic.Int64
+	numDropped atomic.Int64
+	numFailed  atomic.Int64
+}
+
+func NewAuditSink(log *zap.SugaredLogger, store AuditStore, ttl time.Duration, bufferSize int) *AuditSink {
+	sink := &AuditSink{
+		log:     log,
+		store:   store,
+		ttl:     ttl,
+		records: make(chan AuditRecord, bufferSize),
+	}
+	sink.wg.Add(1)
+	go sink.run()
+	return sink
+}
+
+func (sink *AuditSink) run() {
+	defer sink.wg.Done()
+	for record := range sink.records {
+		if err := sink.store.SaveAuditRecord(record, sink.ttl); err != nil {
+			sink.numFailed.Inc()
+			sink.log.Debugw("Saving audit record failed", "reqID", record.ReqID, "error", err)
+			continue
+		}
+		sink.numWritten.Inc()
+	}
+}
+
+// Record queues the audit record of a completed request (with the final response)
+func (sink *AuditSink) Record(simReq *SimRequest, resp SimResponse, startTime time.Time) {
+	if sink == nil {
+		return
+	}
+
+	record := AuditRecord{
+		ReqID:           simReq.ID,
+		ClientID:        simReq.ClientID,
+		Tenant:          simReq.Tenant,
+		Priority:        simReq.Priority(),
+		NodeURI:         resp.NodeURI,
+		Tries:           simReq.Tries,
+		StatusCode:      resp.StatusCode,
+		PayloadSHA256:   payloadSHA256(simReq.Payload),
+		PayloadSize:     simReq.Payload.Len(),
+		SimDurationUs:   resp.SimDuration.Microseconds(),
+		TotalDurationUs: time.Since(startTime).Microseconds(),
+		CreatedAt:       simReq.CreatedAt,
+		CompletedAt:     time.Now().UTC(),
+	}
+	if !resp.SimAt.IsZero() {
+		record.QueueDurationUs = resp.SimAt.Sub(startTime).Microseconds()
+	} else {
+		record.QueueDurationUs = record.TotalDurationUs
+	}
+	if resp.Error != nil {
+		record.ErrorKind = errorKind(resp)
+		record.Error = resp.Error.Error()
+		if record.StatusCode == 0 {
+			record.StatusCode = http.StatusInternalServerError
+		}
+	} else if record.StatusCode == 0 {
+		record.StatusCode = http.StatusOK
+	}
+
+	sink.lock.RLock()
+	defer sink.lock.RUnlock()
+	if sink.closed {
+		sink.numDropped.Inc()
+		return
+	}
+	select {
+	case sink.records <- record:
+	default:
+		sink.numDropped.Inc()
+	}
+}
+
+// payloadSHA256 returns the hex encoded sha256 hash of the payload (empty if it can't be read)
+func payloadSHA256(payload Payload) string {
+	r, err := payload.Open()
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (sink *AuditSink) Stats() AuditStats {
+	return AuditStats{
+		TTLSec:     int64(sink.ttl.Seconds()),
+		NumWritten: sink.numWritten.Load(),
+		NumDropped: sink.numDropped.Load(),
+		NumFailed:  sink.numFailed.Load(),
+	}
+}
+
+// Close writes the buffered records and stops the sink. Records recorded afterwards are dropped.
+func (sink *AuditSink) Close() {
+	if sink == nil {
+		return
+	}
+	sink.lock.Lock()
+	if !sink.closed {
+		sink.closed = true
+		close(sink.records)
+	}
+	sink.lock.Unlock()
+	sink.wg.Wait()
+}
+
+// HandleAuditRequest returns the audit record of a request (GET /audit/{id}), or the stats of the sink (GET /audit)
+func (s *Webserver) HandleAuditRequest(w http.ResponseWriter, req *http.Request) {
+	if s.audit == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "audit records are not enabled")
+		return
+	}
+
+	var res interface{} = s.audit.Stats()
+	if reqID := mux.Vars(req)["id"]; reqID != "" {
+		record, err := s.audit.store.GetAuditRecord(reqID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		} else if record == nil {
+			writeError(w, http.StatusNotFound, ErrorCodeNotFound, "audit record not found")
+			return
+		}
+		res = record
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func getAuditRecord(t *testing.T, webserver *Webserver, reqID string) (int, AuditRecord) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	webserver.HandleAuditRequest(rr, mux.SetURLVars(httptest.NewRequest("GET", "/audit/"+reqID, nil), map[string]string{"id": reqID}))
+	record := AuditRecord{}
+	if rr.Code == http.StatusOK {
+		require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &record))
+	}
+	return rr.Code, record
+}
+
+func TestWebserverAudit(t *testing.T) {
+	resetTestRedis()
+	_RequestTimeout := RequestTimeout
+	defer func() { RequestTimeout = _RequestTimeout }()
+
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	rr := httptest.NewRecorder()
+	webserver.HandleAuditRequest(rr, httptest.NewRequest("GET", "/audit/x", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	sink := NewAuditSink(testLog, redisTestState, time.Hour, 100)
+	defer sink.Close()
+	webserver.EnableAudit(sink)
+
+	payload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`
+	sendRequest := func(reqID string, headers map[string]string) int {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(payload))
+		req.Header.Set("X-Request-ID", reqID)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		return rr.Code
+	}
+	waitForRecord := func(reqID string) AuditRecord {
+		var record AuditRecord
+		require.Eventually(t, func() bool {
+			var code int
+			code, record = getAuditRecord(t, webserver, reqID)
+			return code == http.StatusOK
+		}, time.Second, 10*time.Millisecond)
+		return record
+	}
+	payloadHash := sha256.Sum256([]byte(payload))
+
+	// Success
+	require.Equal(t, http.StatusOK, sendRequest("audit-ok", map[string]string{"X-Client-ID": "alice", "X-High-Priority": "true"}))
+	record := waitForRecord("audit-ok")
+	require.Equal(t, "audit-ok", record.ReqID)
+	require.Equal(t, "alice", record.ClientID)
+	require.Equal(t, "high-prio", record.Priority)
+	require.NotEmpty(t, record.NodeURI)
+	require.Equal(t, 1, record.Tries)
+	require.Equal(t, http.StatusOK, record.StatusCode)
+	require.Empty(t, record.ErrorKind)
+	require.Equal(t, hex.EncodeToString(payloadHash[:]), record.PayloadSHA256)
+	require.Equal(t, int64(len(payload)), record.PayloadSize)
+	require.GreaterOrEqual(t, record.TotalDurationUs, record.SimDurationUs)
+	require.False(t, record.CompletedAt.Before(record.CreatedAt))
+
+	// Node error
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body) //nolint:errcheck
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	require.Equal(t, http.StatusBadGateway, sendRequest("audit-err", map[string]string{"X-Fast-Track": "true"}))
+	record = waitForRecord("audit-err")
+	require.Equal(t, "fast-track", record.Priority)
+	require.Equal(t, http.StatusBadGateway, record.StatusCode)
+	require.Equal(t, ErrorKindNodeError, record.ErrorKind)
+	require.NotEmpty(t, record.Error)
+
+	// Timeout
+	RequestTimeout = 0
+	require.Equal(t, http.StatusInternalServerError, sendRequest("audit-timeout", nil))
+	record = waitForRecord("audit-timeout")
+	require.Equal(t, "low-prio", record.Priority)
+	require.Equal(t, http.StatusInternalServerError, record.StatusCode)
+	require.Equal(t, ErrorKindRequestTimeout, record.ErrorKind)
+	require.Empty(t, record.NodeURI)
+
+	require.Equal(t, AuditStats{TTLSec: 3600, NumWritten: 3}, sink.Stats())
+
+	// Records expire after the TTL
+	require.Equal(t, time.Hour, redisTestServer.TTL(redisTestState.key(RedisKeyAuditPrefix+"audit-ok")))
+	redisTestServer.FastForward(time.Hour + time.Second)
+	code, _ := getAuditRecord(t, webserver, "audit-ok")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+// blockingAuditStore blocks saving records until unblock is closed
+type blockingAuditStore struct {
+	started chan struct{}
+	unblock chan struct{}
+	saved   []AuditRecord
+}
+
+func (s *blockingAuditStore) SaveAuditRecord(record AuditRecord, ttl time.Duration) error {
+	if len(s.saved) == 0 {
+		close(s.started)
+	}
+	<-s.unblock
+	s.saved = append(s.saved, record)
+	return nil
+}
+
+func (s *blockingAuditStore) GetAuditRecord(reqID string) (*AuditRecord, error) {
+	return nil, nil
+}
+
+func TestAuditSinkBackpressure(t *testing.T) {
+	store := &blockingAuditStore{started: make(chan struct{}), unblock: make(chan struct{})}
+	sink := NewAuditSink(testLog, store, time.Hour, 1)
+	simReq := NewSimRequest(httptest.NewRequest("POST", "/", nil).Context(), "1", []byte("x"), false, false)
+
+	sink.Record(simReq, SimResponse{}, time.Now())
+	<-store.started // the writer is blocked with the first record
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ { // one is buffered, two are dropped
+			sink.Record(simReq, SimResponse{}, time.Now())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked")
+	}
+	require.Equal(t, int64(2), sink.Stats().NumDropped)
+
+	close(store.unblock)
+	sink.Close()
+	require.Equal(t, 2, len(store.saved))
+	require.Equal(t, int64(2), sink.Stats().NumWritten)
+
+	// Records after closing are dropped
+	sink.Record(simReq, SimResponse{}, time.Now())
+	require.Equal(t, int64(3), sink.Stats().NumDropped)
+}
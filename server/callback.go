@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CallbackDocument is POSTed to the callback_url of a request once it completed: the result of the request (see
+// SimsResponseEntry), and the hash of its payload
+type CallbackDocument struct {
+	SimsResponseEntry
+	PayloadSHA256 string `json:"payloadSHA256"`
+}
+
+// CallbackOpts configure a CallbackSender
+type CallbackOpts struct {
+	Workers      int           // number of concurrent deliveries
+	QueueSize    int           // number of callbacks waiting for a worker, further callbacks are dropped
+	MaxTries     int           // deliveries which failed with a connection error or a 5xx are retried up to this many tries
+	RetryBackoff time.Duration // delay before the first retry, doubled with every further retry
+	Timeout      time.Duration // of a single try
+	AllowedHosts []string      // the hosts callback URLs may have (empty allows any)
+}
+
+// CallbackSender delivers the callbacks of completed requests in the background, with its own workers, so that slow
+// receivers don't hold up the node workers
+type CallbackSender struct {
+	log    *zap.SugaredLogger
+	opts   CallbackOpts
+	client *http.Client
+	jobs   chan callbackJob
+	wg     sync.WaitGroup
+
+	lock   sync.RWMutex // protects closing the jobs channel
+	closed bool
+}
+
+type callbackJob struct {
+	url       string
+	reqID     string
+	body      []byte
+	signature string // X-Response-Signature, if responses are signed
+}
+
+func NewCallbackSender(log *zap.SugaredLogger, opts CallbackOpts) *CallbackSender {
+	sender := &CallbackSender{
+		log:  log,
+		opts: opts,
+		client: &http.Client{
+			Timeout:       opts.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }, // only the allowed hosts
+		},
+		jobs: make(chan callbackJob, opts.QueueSize),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		sender.wg.Add(1)
+		go sender.run()
+	}
+	return sender
+}
+
+// parseURL returns the callback URL, if it's an http(s) URL of an allowed host
+func (c *CallbackSender) parseURL(callbackURL string) (string, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid callback_url: %w", err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid callback_url: not an http(s) URL")
+	}
+	if len(c.opts.AllowedHosts) == 0 {
+		return u.String(), nil
+	}
+	for _, host := range c.opts.AllowedHosts {
+		if strings.EqualFold(host, u.Hostname()) || strings.EqualFold(host, u.Host) {
+			return u.String(), nil
+		}
+	}
+	return "", fmt.Errorf("callback_url host %s is not allowed", u.Host)
+}
+
+// Send queues the callback. Returns false if it was dropped, because the queue is full.
+func (c *CallbackSender) Send(callbackURL string, doc CallbackDocument, signer *ResponseSigner) bool {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		c.log.Errorw("Encoding the callback failed", "reqID", doc.RequestID, "err", err)
+		return false
+	}
+	job := callbackJob{url: callbackURL, reqID: doc.RequestID, body: body}
+	if signer != nil {
+		job.signature = signer.Sign(time.Now(), doc.RequestID, body)
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		c.log.Warnw("Callback dropped, shutting down", "reqID", doc.RequestID, "callbackURL", callbackURL)
+		return false
+	}
+	select {
+	case c.jobs <- job:
+		return true
+	default:
+		c.log.Warnw("Callback dropped, too many pending callbacks", "reqID", doc.RequestID, "callbackURL", callbackURL)
+		return false
+	}
+}
+
+func (c *CallbackSender) run() {
+	defer c.wg.Done()
+	for job := range c.jobs {
+		c.deliver(job)
+	}
+}
+
+// deliver POSTs the callback, and retries it with backoff on connection errors and 5xx responses
+func (c *CallbackSender) deliver(job callbackJob) {
+	backoff := c.opts.RetryBackoff
+	for try := 1; ; try++ {
+		retryable, err := c.post(job)
+		if err == nil {
+			c.log.Debugw("Callback delivered", "reqID", job.reqID, "callbackURL", job.url, "tries", try)
+			return
+		} else if !retryable || try >= c.opts.MaxTries {
+			c.log.Warnw("Callback delivery failed, dropping it", "reqID", job.reqID, "callbackURL", job.url, "tries", try, "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (c *CallbackSender) post(job callbackJob) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, job.url, bytes.NewReader(job.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", job.reqID)
+	if job.signature != "" {
+		req.Header.Set("X-Response-Signature", job.signature)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck // for reusing the connection
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("status code %d", resp.StatusCode)
+	} else if resp.StatusCode >= 300 {
+		return false, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// Close delivers the queued callbacks and stops the sender. Callbacks sent afterwards are dropped.
+func (c *CallbackSender) Close() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.jobs)
+	}
+	c.lock.Unlock()
+	c.wg.Wait()
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newCallbackReceiver(t *testing.T, statusCodes ...int) (url string, received <-chan *http.Request, docs <-chan CallbackDocument) {
+	t.Helper()
+	requests, documents := make(chan *http.Request, 10), make(chan CallbackDocument, 10)
+	numRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var doc CallbackDocument
+		require.Nil(t, json.NewDecoder(req.Body).Decode(&doc))
+		requests <- req
+		documents <- doc
+		if numRequests < len(statusCodes) {
+			w.WriteHeader(statusCodes[numRequests])
+		}
+		numRequests++
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests, documents
+}
+
+func TestCallbackSender(t *testing.T) {
+	sender := NewCallbackSender(testLog, CallbackOpts{Workers: 1, QueueSize: 10, MaxTries: 3, RetryBackoff: 10 * time.Millisecond, Timeout: time.Second})
+	defer sender.Close()
+
+	// Retried after a 5xx
+	url, received, _ := newCallbackReceiver(t, http.StatusServiceUnavailable, http.StatusOK)
+	require.True(t, sender.Send(url, CallbackDocument{SimsResponseEntry: SimsResponseEntry{RequestID: "cb-1"}}, nil))
+	for i := 0; i < 2; i++ {
+		select {
+		case req := <-received:
+			require.Equal(t, "cb-1", req.Header.Get("X-Request-ID"))
+			require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		case <-time.After(time.Second):
+			t.Fatal("callback not retried")
+		}
+	}
+
+	// Not retried after a 4xx, and dropped after the last try
+	for _, statusCodes := range [][]int{{http.StatusBadRequest}, {500, 500, 500}} {
+		url, received, _ = newCallbackReceiver(t, statusCodes...)
+		require.True(t, sender.Send(url, CallbackDocument{SimsResponseEntry: SimsResponseEntry{RequestID: "cb-2"}}, nil))
+		for range statusCodes {
+			<-received
+		}
+		select {
+		case <-received:
+			t.Fatal("callback retried too often")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Signed like the responses
+	signer := NewResponseSigner("secret")
+	url, received, _ = newCallbackReceiver(t)
+	require.True(t, sender.Send(url, CallbackDocument{SimsResponseEntry: SimsResponseEntry{RequestID: "cb-3"}}, signer))
+	require.NotEmpty(t, (<-received).Header.Get("X-Response-Signature"))
+
+	sender.Close()
+	require.False(t, sender.Send(url, CallbackDocument{}, nil))
+}
+
+func TestCallbackURL(t *testing.T) {
+	sender := NewCallbackSender(testLog, CallbackOpts{AllowedHosts: []string{"hooks.example.com", "10.0.0.1:8080"}})
+	defer sender.Close()
+	for callbackURL, valid := range map[string]bool{
+		"https://hooks.example.com/sims": true,
+		"http://HOOKS.example.com:9000/": true,
+		"http://10.0.0.1:8080/hook":      true,
+		"http://10.0.0.1:9090/hook":      false,
+		"https://evil.example.com/":      false,
+		"ftp://hooks.example.com/":       false,
+		"/relative":                      false,
+	} {
+		_, err := sender.parseURL(callbackURL)
+		require.Equal(t, valid, err == nil, callbackURL)
+	}
+}
+
+func TestWebserverCallback(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	handler := webserver.Handler()
+	payload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`
+	submit := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/sim"+query, bytes.NewBufferString(payload))
+		req.Header.Set("X-Request-ID", "cb-req")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	url, _, docs := newCallbackReceiver(t)
+
+	rr := submit("?callback_url=" + url)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "callbacks are disabled", decodeErrorResponse(t, rr).Message)
+
+	webserver.EnableCallbacks(NewCallbackSender(testLog, CallbackOpts{Workers: 1, QueueSize: 10, MaxTries: 1, Timeout: time.Second}))
+	require.Equal(t, http.StatusBadRequest, submit("?callback_url=ftp://localhost").Code)
+	require.Equal(t, http.StatusBadRequest, submit("?async=1&callback_url="+url).Code)
+
+	rr = submit("?callback_url=" + url)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var status AsyncStatusResponse
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, "cb-req", status.ID)
+	select {
+	case doc := <-docs:
+		hash := sha256.Sum256([]byte(payload))
+		require.Equal(t, "cb-req", doc.RequestID)
+		require.Equal(t, http.StatusOK, doc.StatusCode)
+		require.Equal(t, hex.EncodeToString(hash[:]), doc.PayloadSHA256)
+		require.NotEmpty(t, doc.NodeURI)
+		require.NotEmpty(t, doc.Payload)
+		require.Nil(t, doc.Error)
+	case <-time.After(time.Second):
+		t.Fatal("no callback")
+	}
+
+	// The result is only sent to the callback URL
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sim/cb-req", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CancelResponse is the response of DELETE /sim/{id}
+type CancelResponse struct {
+	ID       string `json:"id"`
+	Priority string `json:"priority"`
+	AgeMs    int64  `json:"ageMs"` // since the request was received
+}
+
+// pendingRequests are the accepted requests which wait for their response, by tenant and ID (the last accepted one of
+// duplicate IDs), so that they can be cancelled
+type pendingRequests struct {
+	lock     sync.Mutex
+	requests map[pendingRequestKey]*SimRequest
+}
+
+type pendingRequestKey struct {
+	tenant string
+	id     string
+}
+
+// add registers r until the returned func is called
+func (p *pendingRequests) add(r *SimRequest) (remove func()) {
+	key := pendingRequestKey{tenant: r.Tenant, id: r.ID}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.requests == nil {
+		p.requests = make(map[pendingRequestKey]*SimRequest)
+	}
+	p.requests[key] = r
+	return func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if p.requests[key] == r {
+			delete(p.requests, key)
+		}
+	}
+}
+
+func (p *pendingRequests) get(tenant, id string) *SimRequest {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.requests[pendingRequestKey{tenant: tenant, id: id}]
+}
+
+// withdraw cancels the request if its current try wasn't taken by a node worker yet, and answers the waiting client
+// with ErrRequestCancelled. The main loop and the node workers discard withdrawn requests (see IsCancelled).
+func (r *SimRequest) withdraw() bool {
+	if !r.queueState.CompareAndSwap(requestQueued, requestWithdrawn) {
+		return false
+	}
+	// not with SendResponse, which drops the responses of cancelled requests
+	select {
+	case r.ResponseC <- SimResponse{StatusCode: http.StatusGone, Error: ErrRequestCancelled}:
+	default:
+	}
+	return true
+}
+
+// HandleCancelRequest cancels the request with the ID (its X-Request-ID, with multi-tenancy only of the tenant of the
+// X-API-Key header) which waits for a node worker, and removes it from the queue. Its client gets a 410 with the
+// REQUEST_CANCELLED error code. A request which is being proxied can't be cancelled anymore (409).
+func (s *Webserver) HandleCancelRequest(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	tenant := ""
+	if s.tenants != nil {
+		var found bool
+		if tenant, found = s.tenants.TenantForAPIKey(req.Header.Get("X-API-Key")); !found {
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "unknown API key")
+			return
+		}
+	}
+
+	r := s.pending.get(tenant, id)
+	if r == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "no pending request with this ID")
+		return
+	} else if !r.withdraw() {
+		writeError(w, http.StatusConflict, ErrorCodeAlreadyProxied, "the request is being proxied already")
+		return
+	}
+	s.prioQueue.Remove(r) // not queued anymore if it was popped already, then it's discarded before proxying
+	r.releaseWaiters(nil) // the identical requests which waited for it are queued again
+
+	age := time.Since(r.CreatedAt)
+	s.log.Infow("Request cancelled", "reqID", id, "tenant", tenant, "priority", r.Priority(), "ageMs", age.Milliseconds())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(CancelResponse{ID: id, Priority: r.Priority(), AgeMs: age.Milliseconds()}); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebserverCancelRequest(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	proxied := make(chan string, 10)
+	release := make(chan struct{})
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		proxied <- req.Header.Get("X-Request-ID")
+		<-release
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}
+	handler := webserver.Handler()
+	sim := func(reqID string) <-chan *httptest.ResponseRecorder {
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			req := newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+			req.Header.Set("X-Request-ID", reqID)
+			rr := httptest.NewRecorder()
+			webserver.HandleQueueRequest(rr, req)
+			res <- rr
+		}()
+		return res
+	}
+	cancel := func(reqID string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/sim/"+reqID, nil))
+		return rr
+	}
+
+	// The only worker is busy, the next requests wait in the job channel and the queue
+	busy := sim("busy")
+	require.Equal(t, "busy", <-proxied)
+	dispatched := sim("dispatched")
+	require.Eventually(t, func() bool { return len(webserver.nodePool.JobC) == 1 }, time.Second, 5*time.Millisecond)
+	for i := 0; i < JobChannelBuffer; i++ {
+		filler := fmt.Sprintf("filler%d", i)
+		sim(filler)
+		require.Eventually(t, func() bool {
+			return webserver.pending.get("", filler) != nil && webserver.prioQueue.NumRequests() == 0
+		}, time.Second, 5*time.Millisecond)
+	}
+	queued := sim("queued")
+	require.Eventually(t, func() bool { return webserver.pending.get("", "queued") != nil }, time.Second, 5*time.Millisecond)
+	require.Equal(t, 1, webserver.prioQueue.NumRequests())
+
+	rr := cancel("queued")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var res CancelResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&res))
+	require.Equal(t, CancelResponse{ID: "queued", Priority: PriorityLowPrio, AgeMs: res.AgeMs}, res)
+	require.Equal(t, 0, webserver.prioQueue.NumRequests())
+
+	// The clients of the cancelled requests get the cancellation right away, also if it was dispatched already
+	require.Equal(t, http.StatusOK, cancel("dispatched").Code)
+	for _, res := range []<-chan *httptest.ResponseRecorder{queued, dispatched} {
+		select {
+		case rr := <-res:
+			require.Equal(t, http.StatusGone, rr.Code)
+			require.Equal(t, ErrorKindRequestCancelled, rr.Header().Get("X-Error-Kind"))
+			require.Equal(t, ErrorCodeRequestCancelled, decodeErrorResponse(t, rr).Code)
+		case <-time.After(time.Second):
+			t.Fatal("the cancelled request was not answered")
+		}
+	}
+
+	// Too late for the request being proxied, and unknown (or already cancelled) IDs
+	rr = cancel("busy")
+	require.Equal(t, http.StatusConflict, rr.Code)
+	require.Equal(t, ErrorCodeAlreadyProxied, decodeErrorResponse(t, rr).Code)
+	require.Equal(t, http.StatusNotFound, cancel("queued").Code)
+	require.Equal(t, http.StatusNotFound, cancel("unknown").Code)
+
+	// The cancelled requests are never proxied
+	close(release)
+	require.Equal(t, http.StatusOK, (<-busy).Code)
+	for i := 0; i < JobChannelBuffer; i++ {
+		require.Equal(t, fmt.Sprintf("filler%d", i), <-proxied)
+	}
+	select {
+	case reqID := <-proxied:
+		t.Fatalf("%s was proxied", reqID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
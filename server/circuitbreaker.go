@@ -0,0 +1,240 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Circuit breaker states, as in the node stats
+const (
+	CircuitClosed   = "closed"    // the workers of the node take requests
+	CircuitOpen     = "open"      // the workers of the node don't take requests until the cool-down ended
+	CircuitHalfOpen = "half-open" // a single worker takes a probe request, whose result closes or opens the circuit
+)
+
+// CircuitBreakerConfig configures the circuit breakers of the nodes: after Threshold consecutive failed proxy requests
+// of a node, its workers stop taking requests for CoolDown. Then a single probe request is let through, which closes the
+// circuit if it succeeds, and opens it again if it fails.
+type CircuitBreakerConfig struct {
+	Threshold int
+	CoolDown  time.Duration
+}
+
+func (c CircuitBreakerConfig) validate() error {
+	if c.Threshold < 1 {
+		return fmt.Errorf("the threshold must be at least 1")
+	} else if c.CoolDown <= 0 {
+		return fmt.Errorf("the cool-down must be positive")
+	}
+	return nil
+}
+
+// circuitBreakerArg returns the circuit breaker config of a node, which the `_breaker` (threshold, 0 disables it) and
+// `_breaker_cooldown_ms` query params of its URI override. Returns nil if the breaker is disabled.
+func circuitBreakerArg(log *zap.SugaredLogger, uri string, config *CircuitBreakerConfig) *CircuitBreakerConfig {
+	pURL, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return config
+	}
+	thresholdArg, coolDownArg := pURL.Query().Get("_breaker"), pURL.Query().Get("_breaker_cooldown_ms")
+	if thresholdArg == "" && coolDownArg == "" {
+		return config
+	}
+
+	nodeConfig := CircuitBreakerConfig{Threshold: NodeBreakerThreshold, CoolDown: NodeBreakerCoolDown}
+	if config != nil {
+		nodeConfig = *config
+	}
+	if thresholdArg != "" {
+		threshold, err := strconv.Atoi(thresholdArg)
+		if err != nil || threshold < 0 {
+			log.Errorw("Error parsing breaker query param", "err", err, "uri", uri)
+			return config
+		}
+		nodeConfig.Threshold = threshold
+	}
+	if coolDownArg != "" {
+		coolDownMs, err := strconv.Atoi(coolDownArg)
+		if err != nil || coolDownMs <= 0 {
+			log.Errorw("Error parsing breaker cool-down query param", "err", err, "uri", uri)
+			return config
+		}
+		nodeConfig.CoolDown = time.Duration(coolDownMs) * time.Millisecond
+	}
+	if nodeConfig.Threshold == 0 {
+		log.Infow("Circuit breaker disabled", "uri", uri)
+		return nil
+	}
+	log.Infow("Using custom circuit breaker", "threshold", nodeConfig.Threshold, "coolDown", nodeConfig.CoolDown, "uri", uri)
+	return &nodeConfig
+}
+
+// circuitBreaker stops the workers of a node while it fails
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+
+	lock        sync.Mutex
+	state       string
+	numFailures int           // consecutive, while closed
+	probeWorker int32         // the worker which takes the probe request while half-open, 0 if none
+	changed     chan struct{} // closed when the state changes, or the probe worker exited
+	numOpened   int64
+	onHalfOpen  func() // (optional) called when the cool-down ended
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig, onHalfOpen func()) *circuitBreaker {
+	return &circuitBreaker{config: config, state: CircuitClosed, changed: make(chan struct{}), onHalfOpen: onHalfOpen}
+}
+
+// _notify wakes the waiting workers, with the lock held
+func (b *circuitBreaker) _notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// paused returns whether the worker with the id may not take requests, and a channel which is closed when the state
+// changes. While half-open, the first worker which asks takes the probe request.
+func (b *circuitBreaker) paused(id int32) (paused bool, changed <-chan struct{}) {
+	if b == nil {
+		return false, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		return true, b.changed
+	case CircuitHalfOpen:
+		if b.probeWorker != 0 && b.probeWorker != id {
+			return true, b.changed
+		}
+		b.probeWorker = id // also if its request was skipped, until a result is observed
+	}
+	return false, b.changed
+}
+
+// release lets another worker take the probe request, if the exiting worker with the id was the probe worker
+func (b *circuitBreaker) release(id int32) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == CircuitHalfOpen && b.probeWorker == id {
+		b.probeWorker = 0
+		b._notify()
+	}
+}
+
+// observe counts the result of a proxied request. Returns the new state if it changed.
+func (b *circuitBreaker) observe(failed bool) (state string, changed bool) {
+	if b == nil {
+		return "", false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		if !failed {
+			b.numFailures = 0
+			return b.state, false
+		} else if b.numFailures++; b.numFailures < b.config.Threshold {
+			return b.state, false
+		}
+		b._open()
+	case CircuitHalfOpen:
+		if failed {
+			b._open()
+		} else {
+			b.state, b.numFailures, b.probeWorker = CircuitClosed, 0, 0
+			b._notify()
+		}
+	default:
+		return b.state, false // the results of the requests proxied before the circuit opened
+	}
+	return b.state, true
+}
+
+// _open opens the circuit until the cool-down ended, with the lock held
+func (b *circuitBreaker) _open() {
+	b.state, b.probeWorker = CircuitOpen, 0
+	b.numOpened++
+	b._notify()
+	time.AfterFunc(b.config.CoolDown, func() {
+		b.lock.Lock()
+		halfOpened := b.state == CircuitOpen
+		if halfOpened {
+			b.state = CircuitHalfOpen
+			b._notify()
+		}
+		b.lock.Unlock()
+		if halfOpened && b.onHalfOpen != nil {
+			b.onHalfOpen()
+		}
+	})
+}
+
+// capacity returns how many of the active workers take requests
+func (b *circuitBreaker) capacity(active int32) int32 {
+	if b == nil {
+		return active
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == CircuitOpen {
+		return 0
+	} else if b.state == CircuitHalfOpen && active > 1 {
+		return 1
+	}
+	return active
+}
+
+// stats returns the state (empty if the breaker is disabled) and how often the circuit opened
+func (b *circuitBreaker) stats() (state string, numOpened int64) {
+	if b == nil {
+		return "", 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state, b.numOpened
+}
+
+// observeBreaker updates the circuit breaker of the node (if enabled) with the result of a proxied request
+func (n *Node) observeBreaker(failed bool) {
+	state, changed := n.breaker.observe(failed)
+	if !changed {
+		return
+	}
+	if state == CircuitOpen {
+		n.log.Warnw("circuit breaker opened, the node workers pause", "uri", n.URI, "coolDown", n.breaker.config.CoolDown)
+	} else {
+		n.log.Infow("circuit breaker closed, the node workers resume", "uri", n.URI)
+	}
+	if n.loadChanged != nil {
+		n.loadChanged()
+	}
+}
+
+// breakerHalfOpened lets a probe request through after the cool-down
+func (n *Node) breakerHalfOpened() {
+	n.log.Infow("circuit breaker half-open, probing the node", "uri", n.URI)
+	if n.loadChanged != nil {
+		n.loadChanged()
+	}
+}
+
+// SetCircuitBreaker enables the circuit breakers of the nodes (nil disables them, nodes can override it with the
+// `_breaker` and `_breaker_cooldown_ms` URI query params). Must be called before nodes are added.
+func (gp *NodePool) SetCircuitBreaker(config *CircuitBreakerConfig) error {
+	if config != nil {
+		if err := config.validate(); err != nil {
+			return err
+		}
+	}
+	gp.circuitBreaker = config
+	return nil
+}
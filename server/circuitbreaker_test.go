@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(CircuitBreakerConfig{Threshold: 3, CoolDown: 50 * time.Millisecond}, nil)
+
+	// A success resets the consecutive failures
+	for _, failed := range []bool{true, true, false, true, true} {
+		_, changed := b.observe(failed)
+		require.False(t, changed)
+	}
+	isPaused, _ := b.paused(1)
+	require.False(t, isPaused)
+	state, changed := b.observe(true)
+	require.True(t, changed)
+	require.Equal(t, CircuitOpen, state)
+
+	// No worker takes requests during the cool-down, then a single probe
+	isPaused, paused := b.paused(1)
+	require.True(t, isPaused)
+	isPaused, _ = b.paused(2)
+	require.True(t, isPaused)
+	require.Equal(t, int32(0), b.capacity(4))
+	_, changed = b.observe(false) // proxied before the circuit opened
+	require.False(t, changed)
+	select {
+	case <-paused:
+	case <-time.After(time.Second):
+		t.Fatal("the cool-down didn't end")
+	}
+	for i := 0; i < 2; i++ { // also for the next request, if the probe was skipped
+		isPaused, _ = b.paused(2)
+		require.False(t, isPaused)
+	}
+	isPaused, paused = b.paused(1)
+	require.True(t, isPaused)
+	require.Equal(t, int32(1), b.capacity(4))
+	state, _ = b.stats()
+	require.Equal(t, CircuitHalfOpen, state)
+
+	// Another worker probes if the probe worker exits
+	b.release(2)
+	<-paused // closed
+	isPaused, _ = b.paused(1)
+	require.False(t, isPaused)
+
+	// A failed probe opens the circuit again, a successful one closes it
+	state, changed = b.observe(true)
+	require.True(t, changed)
+	require.Equal(t, CircuitOpen, state)
+	require.Eventually(t, func() bool {
+		isPaused, _ := b.paused(3)
+		return !isPaused
+	}, time.Second, 5*time.Millisecond)
+	state, changed = b.observe(false)
+	require.True(t, changed)
+	require.Equal(t, CircuitClosed, state)
+	isPaused, _ = b.paused(1)
+	require.False(t, isPaused)
+	require.Equal(t, int32(4), b.capacity(4))
+	state, numOpened := b.stats()
+	require.Equal(t, CircuitClosed, state)
+	require.Equal(t, int64(2), numOpened)
+
+	// Disabled
+	var disabled *circuitBreaker
+	isPaused, paused = disabled.paused(1)
+	require.False(t, isPaused)
+	require.Nil(t, paused)
+	require.Equal(t, int32(4), disabled.capacity(4))
+
+	require.NotNil(t, CircuitBreakerConfig{Threshold: 0, CoolDown: time.Second}.validate())
+	require.NotNil(t, CircuitBreakerConfig{Threshold: 3}.validate())
+	require.Nil(t, CircuitBreakerConfig{Threshold: 3, CoolDown: time.Second}.validate())
+}
+
+func TestCircuitBreakerArg(t *testing.T) {
+	config := &CircuitBreakerConfig{Threshold: 5, CoolDown: time.Second}
+	require.Equal(t, config, circuitBreakerArg(testLog, "http://node:8545", config))
+	require.Nil(t, circuitBreakerArg(testLog, "http://node:8545", nil))
+	require.Equal(t, &CircuitBreakerConfig{Threshold: 2, CoolDown: time.Second}, circuitBreakerArg(testLog, "http://node:8545?_breaker=2", config))
+	require.Equal(t, &CircuitBreakerConfig{Threshold: 2, CoolDown: NodeBreakerCoolDown}, circuitBreakerArg(testLog, "http://node:8545?_breaker=2", nil))
+	require.Equal(t, &CircuitBreakerConfig{Threshold: 5, CoolDown: 100 * time.Millisecond}, circuitBreakerArg(testLog, "http://node:8545?_breaker_cooldown_ms=100", config))
+	require.Nil(t, circuitBreakerArg(testLog, "http://node:8545?_breaker=0", config))
+	require.Equal(t, config, circuitBreakerArg(testLog, "http://node:8545?_breaker=x", config)) // invalid
+}
+
+func TestNodeCircuitBreaker(t *testing.T) {
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node.Close()
+	nodePool := NewNodePool(testLog, nil, 2)
+	defer nodePool.Shutdown()
+	require.Nil(t, nodePool.SetCircuitBreaker(&CircuitBreakerConfig{Threshold: 3, CoolDown: 200 * time.Millisecond}))
+	require.Nil(t, nodePool.AddNode(node.URL))
+	payload := []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+	sim := func() *SimRequest {
+		r := NewSimRequest(context.Background(), "", payload, true, false)
+		nodePool.JobC <- r
+		return r
+	}
+	circuitState := func() string { return nodePool.NodeStats()[0].CircuitState }
+	require.Equal(t, CircuitClosed, circuitState())
+
+	// The consecutive failures open the circuit, the workers stop taking requests
+	node.SetOpts(testutils.FakeNodeOpts{ErrorRate: 1})
+	for i := 0; i < 3; i++ {
+		res := <-sim().ResponseC
+		require.NotNil(t, res.Error)
+		require.True(t, res.ShouldRetry)
+	}
+	require.Equal(t, CircuitOpen, circuitState())
+	node.Reset()
+	r := sim()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, node.NumRequests())
+
+	// After the cool-down the request is the probe, which fails and opens the circuit again
+	res := <-r.ResponseC
+	require.NotNil(t, res.Error)
+	require.Equal(t, 1, node.NumRequests())
+	require.Equal(t, CircuitOpen, circuitState())
+	require.Equal(t, int64(2), nodePool.NodeStats()[0].NumCircuitOpened)
+
+	// Once the node recovered, a successful probe closes the circuit
+	node.SetOpts(testutils.FakeNodeOpts{})
+	res = <-sim().ResponseC
+	require.Nil(t, res.Error, res.Error)
+	require.Equal(t, CircuitClosed, circuitState())
+	res = <-sim().ResponseC
+	require.Nil(t, res.Error, res.Error)
+}
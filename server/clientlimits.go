@@ -0,0 +1,122 @@
+package server
+
+import (
+	"sync"
+)
+
+// ClientQueueLimits are the max. numbers of requests a client may have queued or in flight at the same time, in total
+// and per priority (0 means no limit). Clients are identified like in the client usage stats (the tenant, or the
+// X-Client-ID header), requests without a client ID are not limited.
+type ClientQueueLimits struct {
+	Total     int
+	FastTrack int
+	HighPrio  int
+	LowPrio   int
+}
+
+func (l ClientQueueLimits) forPriority(priority string) int {
+	switch priority {
+	case PriorityFastTrack:
+		return l.FastTrack
+	case PriorityHighPrio:
+		return l.HighPrio
+	default:
+		return l.LowPrio
+	}
+}
+
+// clientQueueCounter counts the queued and in-flight requests per client, to enforce the ClientQueueLimits. Clients
+// are removed once they have no requests, so the counter doesn't grow with the number of clients.
+type clientQueueCounter struct {
+	lock   sync.Mutex
+	limits ClientQueueLimits
+	counts map[string]map[string]int // by client ID and priority
+	totals map[string]int            // by client ID
+}
+
+func newClientQueueCounter(limits ClientQueueLimits) *clientQueueCounter {
+	return &clientQueueCounter{limits: limits, counts: make(map[string]map[string]int), totals: make(map[string]int)}
+}
+
+// acquire counts a new request of the client, and returns false without counting it if a limit is reached. Every
+// successful acquire must be followed by a release.
+func (c *clientQueueCounter) acquire(clientID, priority string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.belowLimits(clientID, priority) {
+		return false
+	}
+	if c.counts[clientID] == nil {
+		c.counts[clientID] = make(map[string]int)
+	}
+	c.counts[clientID][priority]++
+	c.totals[clientID]++
+	return true
+}
+
+// canAcquire returns whether acquire would succeed now, without counting a request
+func (c *clientQueueCounter) canAcquire(clientID, priority string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.belowLimits(clientID, priority)
+}
+
+// belowLimits must be called with the lock held
+func (c *clientQueueCounter) belowLimits(clientID, priority string) bool {
+	if limit := c.limits.forPriority(priority); limit > 0 && c.counts[clientID][priority] >= limit {
+		return false
+	}
+	return c.limits.Total <= 0 || c.totals[clientID] < c.limits.Total
+}
+
+// release counts a completed (or failed, cancelled, timed out) request of the client
+func (c *clientQueueCounter) release(clientID, priority string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.totals[clientID] <= 0 {
+		return
+	}
+	c.counts[clientID][priority]--
+	if c.counts[clientID][priority] <= 0 {
+		delete(c.counts[clientID], priority)
+	}
+	c.totals[clientID]--
+	if c.totals[clientID] <= 0 {
+		delete(c.totals, clientID)
+		delete(c.counts, clientID)
+	}
+}
+
+// numQueued returns the counted requests of the client
+func (c *clientQueueCounter) numQueued(clientID string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.totals[clientID]
+}
+
+// EnableClientQueueLimits rejects requests of clients which have too many requests queued or in flight, with 429
+func (s *Webserver) EnableClientQueueLimits(limits ClientQueueLimits) {
+	s.clientQueue = newClientQueueCounter(limits)
+}
+
+// acquireClientSlot counts the request towards the limits of its client. If it returns true, releaseClientSlot must
+// be called once the request is done. Rejected requests are counted as such.
+func (s *Webserver) acquireClientSlot(r *SimRequest) bool {
+	if s.clientQueue == nil || r.ClientID == "" || r.ClientID == unknownClientID {
+		return true
+	}
+	if s.clientQueue.acquire(r.ClientID, r.Priority()) {
+		return true
+	}
+	s.clientStats.Rejected(r)
+	s.requests.rejected()
+	s.metricsRejected(r, ErrorKindClientQueueLimit)
+	return false
+}
+
+func (s *Webserver) releaseClientSlot(r *SimRequest) {
+	if s.clientQueue == nil || r.ClientID == "" || r.ClientID == unknownClientID {
+		return
+	}
+	s.clientQueue.release(r.ClientID, r.Priority())
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientQueueCounter(t *testing.T) {
+	c := newClientQueueCounter(ClientQueueLimits{Total: 3, FastTrack: 1})
+	require.True(t, c.acquire("a", PriorityFastTrack))
+	require.False(t, c.acquire("a", PriorityFastTrack))
+	require.True(t, c.acquire("b", PriorityFastTrack)) // per client
+	require.True(t, c.acquire("a", PriorityLowPrio))
+	require.True(t, c.acquire("a", PriorityHighPrio))
+	require.False(t, c.acquire("a", PriorityLowPrio)) // the total
+	require.Equal(t, 3, c.numQueued("a"))
+
+	c.release("a", PriorityFastTrack)
+	require.True(t, c.acquire("a", PriorityFastTrack))
+	for _, priority := range []string{PriorityFastTrack, PriorityHighPrio, PriorityLowPrio} {
+		c.release("a", priority)
+	}
+	c.release("b", PriorityFastTrack)
+	c.release("b", PriorityFastTrack) // more releases than acquires are ignored
+	require.Empty(t, c.counts)
+	require.Empty(t, c.totals)
+}
+
+func TestWebserverClientQueueLimits(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 1, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	webserver.EnableClientQueueLimits(ClientQueueLimits{Total: 3, LowPrio: 1})
+	handler := webserver.Handler()
+
+	// send returns the response once the request completes (there is no main loop)
+	send := func(ctx context.Context, clientID, payload string, isHighPrio bool) <-chan *httptest.ResponseRecorder {
+		req := newSimTestRequest(payload).WithContext(ctx)
+		req.Header.Set("X-Client-ID", clientID)
+		if isHighPrio {
+			req.Header.Set("X-High-Priority", "true")
+		}
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			res <- rr
+		}()
+		return res
+	}
+	waitForQueued := func(n int) {
+		t.Helper()
+		require.Eventually(t, func() bool { return prioQueue.NumRequests() == n }, time.Second, 5*time.Millisecond)
+	}
+	requireReleased := func() {
+		t.Helper()
+		require.Eventually(t, func() bool { return webserver.clientQueue.numQueued("a") == 0 }, time.Second, 5*time.Millisecond)
+	}
+	requireRejected := func(rr *httptest.ResponseRecorder) {
+		t.Helper()
+		require.Equal(t, http.StatusTooManyRequests, rr.Code)
+		require.Equal(t, ErrorKindClientQueueLimit, rr.Header().Get("X-Error-Kind"))
+		require.Equal(t, ErrorCodeClientQueueLimit, decodeErrorResponse(t, rr).Code)
+	}
+
+	// Completion: one low-prio request per client, other clients are not affected
+	queued := send(context.Background(), "a", `{"id":1}`, false)
+	waitForQueued(1)
+	requireRejected(<-send(context.Background(), "a", `{"id":1}`, false))
+	other := send(context.Background(), "b", `{"id":1}`, false)
+	waitForQueued(2)
+	prioQueue.Pop().SendResponse(SimResponse{Payload: []byte(`{"result":1}`)})
+	require.Equal(t, http.StatusOK, (<-queued).Code)
+	prioQueue.Pop().SendResponse(SimResponse{Payload: []byte(`{"result":1}`)})
+	<-other
+	requireReleased()
+
+	// Timeout and node errors
+	queued = send(context.Background(), "a", `{"id":1}`, false)
+	waitForQueued(1)
+	prioQueue.Pop().SendResponse(SimResponse{Error: ErrRequestTimeout})
+	require.Equal(t, ErrorKindRequestTimeout, (<-queued).Header().Get("X-Error-Kind"))
+	requireReleased()
+
+	// Cancellation by the client
+	ctx, cancel := context.WithCancel(context.Background())
+	queued = send(ctx, "a", `{"id":1}`, false)
+	waitForQueued(1)
+	cancel()
+	<-queued
+	requireReleased()
+	prioQueue.Pop()
+
+	// Flushed by the load shedding
+	queued = send(context.Background(), "a", `{"id":1}`, false)
+	waitForQueued(1)
+	for _, r := range prioQueue.DropLowPrio() {
+		r.SendResponse(SimResponse{Error: ErrLoadShed, StatusCode: http.StatusServiceUnavailable})
+	}
+	require.Equal(t, http.StatusServiceUnavailable, (<-queued).Code)
+	requireReleased()
+
+	// Rejected by the full queue (one high-prio request), and the total limit
+	queued = send(context.Background(), "a", `{"id":1}`, true)
+	waitForQueued(1)
+	require.Equal(t, ErrorKindQueueFull, (<-send(context.Background(), "a", `{"id":1}`, true)).Header().Get("X-Error-Kind"))
+	require.Equal(t, 1, webserver.clientQueue.numQueued("a"))
+	lowPrio := send(context.Background(), "a", `{"id":1}`, false)
+	waitForQueued(2)
+	requireRejected(<-send(context.Background(), "a", `{"id":1}`, false))
+	prioQueue.Pop().SendResponse(SimResponse{Payload: []byte(`{"result":1}`)})
+	prioQueue.Pop().SendResponse(SimResponse{Payload: []byte(`{"result":1}`)})
+	<-queued
+	<-lowPrio
+	requireReleased()
+
+	// Batch elements count individually
+	defer func(split bool) { SplitJSONRPCBatches = split }(SplitJSONRPCBatches)
+	SplitJSONRPCBatches = true
+	batch := send(context.Background(), "a", `[{"id":1},{"id":2}]`, false)
+	waitForQueued(1)
+	prioQueue.Pop().SendResponse(SimResponse{Payload: []byte(`{"id":1,"result":1}`)})
+	rr := <-batch
+	var responses []json.RawMessage
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&responses))
+	require.Len(t, responses, 2)
+	require.Equal(t, `{"id":1,"result":1}`, string(responses[0]))
+	require.True(t, strings.Contains(string(responses[1]), ErrClientQueueLimit.Error()), string(responses[1]))
+	requireReleased()
+
+	// Requests without client ID are not limited
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		send(ctx, "", `{"id":1}`, false)
+	}
+	waitForQueued(2)
+}
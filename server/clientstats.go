@@ -0,0 +1,259 @@
+package server
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+const clientStatsNumBuckets = 60 // the sliding window consists of this many buckets
+
+// clientStatsBucket holds the counters of a client for one part of the sliding window
+type clientStatsBucket struct {
+	epoch        int64 // number of the bucket since the unix epoch, to detect stale buckets
+	numFastTrack int64
+	numHighPrio  int64
+	numLowPrio   int64
+	numBytes     int64
+	numErrors    int64
+	numCompleted int64
+	latencySum   time.Duration
+}
+
+type clientStats struct {
+	clientID  string
+	buckets   [clientStatsNumBuckets]clientStatsBucket
+	numQueued int64 // not windowed
+	lastSeen  time.Time
+}
+
+// ClientUsage are the aggregated stats of a client over the sliding window (or a bucket of it)
+type ClientUsage struct {
+	ClientID     string     `json:"clientID,omitempty"`
+	Start        *time.Time `json:"start,omitempty"` // only set for buckets
+	NumRequests  int64      `json:"numRequests"`
+	NumFastTrack int64      `json:"numFastTrack"`
+	NumHighPrio  int64      `json:"numHighPrio"`
+	NumLowPrio   int64      `json:"numLowPrio"`
+	NumBytes     int64      `json:"numBytes"`
+	NumErrors    int64      `json:"numErrors"`
+	AvgLatencyMs float64    `json:"avgLatencyMs"`
+	NumQueued    int64      `json:"numQueued"`          // requests currently queued or being processed
+	LastSeen     *time.Time `json:"lastSeen,omitempty"` // not set for buckets
+}
+
+func (u *ClientUsage) add(b clientStatsBucket, latencySum *time.Duration, numCompleted *int64) {
+	u.NumFastTrack += b.numFastTrack
+	u.NumHighPrio += b.numHighPrio
+	u.NumLowPrio += b.numLowPrio
+	u.NumRequests += b.numFastTrack + b.numHighPrio + b.numLowPrio
+	u.NumBytes += b.numBytes
+	u.NumErrors += b.numErrors
+	*latencySum += b.latencySum
+	*numCompleted += b.numCompleted
+}
+
+func avgLatencyMs(latencySum time.Duration, numCompleted int64) float64 {
+	if numCompleted == 0 {
+		return 0
+	}
+	return float64(latencySum.Microseconds()) / float64(numCompleted) / 1000
+}
+
+// ClientStatsTracker counts requests, bytes, errors and latencies per client over a sliding window. At most
+// maxClients are tracked, the least recently seen clients are evicted first.
+type ClientStatsTracker struct {
+	lock           sync.Mutex
+	maxClients     int
+	bucketDuration time.Duration
+	clients        map[string]*list.Element // values of the elements are *clientStats
+	lru            *list.List               // most recently seen clients first
+	now            func() time.Time
+}
+
+func NewClientStatsTracker(maxClients int, window time.Duration) *ClientStatsTracker {
+	bucketDuration := window / clientStatsNumBuckets
+	if bucketDuration <= 0 {
+		bucketDuration = time.Second
+	}
+	return &ClientStatsTracker{
+		maxClients:     maxClients,
+		bucketDuration: bucketDuration,
+		clients:        make(map[string]*list.Element),
+		lru:            list.New(),
+		now:            time.Now,
+	}
+}
+
+// Window returns the duration of the sliding window
+func (t *ClientStatsTracker) Window() time.Duration {
+	return t.bucketDuration * clientStatsNumBuckets
+}
+
+// bucket returns the current bucket of the client (reset if stale). The lock must be held.
+func (t *ClientStatsTracker) bucket(stats *clientStats, now time.Time) *clientStatsBucket {
+	epoch := now.UnixNano() / int64(t.bucketDuration)
+	b := &stats.buckets[epoch%clientStatsNumBuckets]
+	if b.epoch != epoch {
+		*b = clientStatsBucket{epoch: epoch}
+	}
+	return b
+}
+
+// getOrAdd returns the stats of the client and marks it as most recently seen, evicting the least recently seen
+// client if there are too many. The lock must be held.
+func (t *ClientStatsTracker) getOrAdd(clientID string, now time.Time) *clientStats {
+	if elem, ok := t.clients[clientID]; ok {
+		t.lru.MoveToFront(elem)
+		stats := elem.Value.(*clientStats)
+		stats.lastSeen = now
+		return stats
+	}
+
+	stats := &clientStats{clientID: clientID, lastSeen: now}
+	t.clients[clientID] = t.lru.PushFront(stats)
+	for t.maxClients > 0 && t.lru.Len() > t.maxClients {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.clients, oldest.Value.(*clientStats).clientID)
+	}
+	return stats
+}
+
+func (t *ClientStatsTracker) count(r *SimRequest, isError bool) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	stats := t.getOrAdd(r.ClientID, now)
+	b := t.bucket(stats, now)
+	if r.IsFastTrack {
+		b.numFastTrack++
+	} else if r.IsHighPrio {
+		b.numHighPrio++
+	} else {
+		b.numLowPrio++
+	}
+	b.numBytes += r.Payload.Len()
+	if isError {
+		b.numErrors++
+	} else {
+		stats.numQueued++
+	}
+}
+
+// Queued counts a request which was added to the queue
+func (t *ClientStatsTracker) Queued(r *SimRequest) {
+	t.count(r, false)
+}
+
+// Rejected counts a request which could not be queued as error
+func (t *ClientStatsTracker) Rejected(r *SimRequest) {
+	t.count(r, true)
+}
+
+// Finished records the final response of a queued request. Requests cancelled by the client (ok=false) are
+// only removed from the queued requests.
+func (t *ClientStatsTracker) Finished(r *SimRequest, resp SimResponse, ok bool) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	elem, found := t.clients[r.ClientID]
+	if !found { // evicted in the meantime
+		return
+	}
+
+	stats := elem.Value.(*clientStats)
+	stats.numQueued--
+	if !ok {
+		return
+	}
+
+	now := t.now()
+	b := t.bucket(stats, now)
+	b.numCompleted++
+	b.latencySum += now.Sub(r.CreatedAt)
+	if resp.Error != nil {
+		b.numErrors++
+	}
+}
+
+// usage aggregates the buckets of the client which are in the window. The lock must be held.
+func (t *ClientStatsTracker) usage(stats *clientStats, now time.Time) ClientUsage {
+	lastSeen := stats.lastSeen
+	u := ClientUsage{ClientID: stats.clientID, NumQueued: stats.numQueued, LastSeen: &lastSeen}
+	var latencySum time.Duration
+	var numCompleted int64
+	minEpoch := now.UnixNano()/int64(t.bucketDuration) - clientStatsNumBuckets + 1
+	for _, b := range stats.buckets {
+		if b.epoch >= minEpoch {
+			u.add(b, &latencySum, &numCompleted)
+		}
+	}
+	u.AvgLatencyMs = avgLatencyMs(latencySum, numCompleted)
+	return u
+}
+
+// Clients returns the usage of all tracked clients within the window, sorted by number of requests (descending) and
+// client ID
+func (t *ClientStatsTracker) Clients() []ClientUsage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	res := make([]ClientUsage, 0, len(t.clients))
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		res = append(res, t.usage(elem.Value.(*clientStats), now))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].NumRequests == res[j].NumRequests {
+			return res[i].ClientID < res[j].ClientID
+		}
+		return res[i].NumRequests > res[j].NumRequests
+	})
+	return res
+}
+
+// ClientUsageDetail is the usage of a client over the window, and per bucket of the window (oldest first)
+type ClientUsageDetail struct {
+	ClientUsage
+	Buckets []ClientUsage `json:"buckets"`
+}
+
+// Client returns the usage of a client, with the non-empty buckets of the window
+func (t *ClientStatsTracker) Client(clientID string) (detail ClientUsageDetail, found bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	elem, found := t.clients[clientID]
+	if !found {
+		return detail, false
+	}
+
+	now := t.now()
+	stats := elem.Value.(*clientStats)
+	detail.ClientUsage = t.usage(stats, now)
+	detail.Buckets = []ClientUsage{}
+	epoch := now.UnixNano() / int64(t.bucketDuration)
+	for e := epoch - clientStatsNumBuckets + 1; e <= epoch; e++ {
+		b := stats.buckets[e%clientStatsNumBuckets]
+		if b.epoch != e {
+			continue
+		}
+		start := time.Unix(0, e*int64(t.bucketDuration)).UTC()
+		u := ClientUsage{Start: &start}
+		var latencySum time.Duration
+		var numCompleted int64
+		u.add(b, &latencySum, &numCompleted)
+		u.AvgLatencyMs = avgLatencyMs(latencySum, numCompleted)
+		detail.Buckets = append(detail.Buckets, u)
+	}
+	return detail, true
+}
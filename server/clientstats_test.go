@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func newClientRequest(clientID string, payload string, isHighPrio, isFastTrack bool) *SimRequest {
+	r := NewSimRequest(context.Background(), "1", []byte(payload), isHighPrio, isFastTrack)
+	r.ClientID = clientID
+	return r
+}
+
+func TestClientStatsTracker(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := NewClientStatsTracker(10, time.Hour)
+	tracker.now = func() time.Time { return now }
+
+	// Client a: 2 low-prio requests, one succeeds after 10ms and one fails after 30ms
+	r1, r2 := newClientRequest("a", "12345", false, false), newClientRequest("a", "12345", false, false)
+	r1.CreatedAt, r2.CreatedAt = now.Add(-10*time.Millisecond), now.Add(-30*time.Millisecond)
+	tracker.Queued(r1)
+	tracker.Queued(r2)
+	tracker.Finished(r1, SimResponse{}, true)
+	tracker.Finished(r2, SimResponse{Error: errors.New("error")}, true)
+
+	// Client b: 1 fast-track request still queued, and one rejected high-prio request
+	tracker.Queued(newClientRequest("b", "12", false, true))
+	tracker.Rejected(newClientRequest("b", "123", true, false))
+
+	clients := tracker.Clients()
+	require.Equal(t, 2, len(clients))
+	require.Equal(t, ClientUsage{ClientID: "a", NumRequests: 2, NumLowPrio: 2, NumBytes: 10, NumErrors: 1, AvgLatencyMs: 20, LastSeen: &now}, clients[0])
+	require.Equal(t, ClientUsage{ClientID: "b", NumRequests: 2, NumFastTrack: 1, NumHighPrio: 1, NumBytes: 5, NumErrors: 1, NumQueued: 1, LastSeen: &now}, clients[1])
+
+	// Requests older than the window are not counted anymore
+	now = now.Add(30 * time.Minute)
+	tracker.Queued(newClientRequest("a", "1", true, false))
+	detail, found := tracker.Client("a")
+	require.True(t, found)
+	require.Equal(t, int64(3), detail.NumRequests)
+	require.Equal(t, 2, len(detail.Buckets))
+	require.Equal(t, int64(2), detail.Buckets[0].NumRequests)
+	require.Equal(t, int64(1), detail.Buckets[1].NumRequests)
+
+	now = now.Add(45 * time.Minute)
+	detail, _ = tracker.Client("a")
+	require.Equal(t, int64(1), detail.NumRequests)
+	require.Equal(t, int64(1), detail.NumHighPrio)
+	require.Equal(t, int64(1), detail.NumQueued)
+
+	_, found = tracker.Client("c")
+	require.False(t, found)
+}
+
+func TestClientStatsTrackerBounded(t *testing.T) {
+	tracker := NewClientStatsTracker(3, time.Hour)
+	for i := 0; i < 1000; i++ {
+		tracker.Queued(newClientRequest(fmt.Sprint(i), "x", false, false))
+		tracker.Queued(newClientRequest("regular", "x", false, false)) // recently seen, so never evicted
+	}
+	require.Equal(t, 3, len(tracker.clients))
+	require.Equal(t, 3, tracker.lru.Len())
+
+	_, found := tracker.Client("regular")
+	require.True(t, found)
+	_, found = tracker.Client("999")
+	require.True(t, found)
+	_, found = tracker.Client("0")
+	require.False(t, found)
+
+	// Finishing a request of an evicted client is ignored
+	tracker.Finished(newClientRequest("0", "x", false, false), SimResponse{}, true)
+	require.Equal(t, 3, len(tracker.clients))
+}
+
+func TestWebserverClientStats(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 4)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if bytes.Contains(body, []byte(`"fail"`)) {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"id":1,"result":"ok","jsonrpc":"2.0"}`))
+	}
+
+	payloads := make(map[string][]byte)
+	for _, method := range []string{"eth_callBundle", "fail"} {
+		payload, err := json.Marshal(testutils.NewJSONRPCRequest1(1, method, "0x1"))
+		require.Nil(t, err, err)
+		payloads[method] = payload
+	}
+	sendRequest := func(clientID, method string, isHighPrio bool) {
+		payload := payloads[method]
+		req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(payload))
+		req.Header.Set("X-Client-ID", clientID)
+		if isHighPrio {
+			req.Header.Set("X-High-Priority", "true")
+		}
+		webserver.HandleQueueRequest(httptest.NewRecorder(), req)
+	}
+
+	// Three clients with different traffic
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(3)
+		go func() { defer wg.Done(); sendRequest("alice", "eth_callBundle", true) }()
+		go func() { defer wg.Done(); sendRequest("bob", "eth_callBundle", false) }()
+		go func() { defer wg.Done(); sendRequest("carol", "fail", false) }()
+	}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() { defer wg.Done(); sendRequest("alice", "eth_callBundle", false) }()
+	}
+	wg.Wait()
+
+	rr := httptest.NewRecorder()
+	webserver.HandleClientStatsRequest(rr, httptest.NewRequest("GET", "/stats/clients", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	res := ClientStatsResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	require.Equal(t, 3, len(res.Clients))
+	usage := make(map[string]ClientUsage)
+	for _, u := range res.Clients {
+		usage[u.ClientID] = u
+		require.Equal(t, int64(0), u.NumQueued)
+		require.Greater(t, u.AvgLatencyMs, float64(0))
+	}
+	require.Equal(t, "alice", res.Clients[0].ClientID)
+	require.Equal(t, int64(10), usage["alice"].NumRequests)
+	require.Equal(t, int64(5), usage["alice"].NumHighPrio)
+	require.Equal(t, int64(5), usage["alice"].NumLowPrio)
+	require.Equal(t, int64(10*len(payloads["eth_callBundle"])), usage["alice"].NumBytes)
+	require.Equal(t, int64(0), usage["alice"].NumErrors)
+
+	require.Equal(t, int64(5), usage["bob"].NumRequests)
+	require.Equal(t, int64(5), usage["bob"].NumLowPrio)
+	require.Equal(t, int64(5*len(payloads["eth_callBundle"])), usage["bob"].NumBytes)
+	require.Equal(t, int64(0), usage["bob"].NumErrors)
+
+	require.Equal(t, int64(5), usage["carol"].NumRequests)
+	require.Equal(t, int64(5*len(payloads["fail"])), usage["carol"].NumBytes)
+	require.Equal(t, int64(5), usage["carol"].NumErrors)
+
+	// Drill-down of a single client
+	rr = httptest.NewRecorder()
+	webserver.HandleClientStatsRequest(rr, mux.SetURLVars(httptest.NewRequest("GET", "/stats/clients/carol", nil), map[string]string{"clientID": "carol"}))
+	require.Equal(t, http.StatusOK, rr.Code)
+	detail := ClientUsageDetail{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &detail))
+	require.Equal(t, int64(5), detail.NumRequests)
+	require.NotEmpty(t, detail.Buckets)
+
+	rr = httptest.NewRecorder()
+	webserver.HandleClientStatsRequest(rr, mux.SetURLVars(httptest.NewRequest("GET", "/stats/clients/dave", nil), map[string]string{"clientID": "dave"}))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
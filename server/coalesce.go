@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// coalesceKey identifies identical requests: the same tenant, Content-Type and payload
+type coalesceKey struct {
+	tenant      string
+	contentType string
+	payloadHash string
+}
+
+// coalescedGroup is a request which is queued or being proxied (the leader), and the identical requests which were
+// pushed in the meantime. The waiters get the response of the leader's try. If the leader drops out before it's
+// proxied (its client went away, it was withdrawn, or it timed out in the queue), they are queued again in owner, the
+// first one becomes the new leader. The waiters are guarded by the lock of the queue.
+type coalescedGroup struct {
+	queue   *PrioQueue
+	owner   Queue
+	key     coalesceKey
+	leader  *SimRequest
+	waiters []*SimRequest
+}
+
+// SetCoalescing enables the coalescing of identical requests: a request with the same tenant, Content-Type and
+// payload as one which is queued or being proxied isn't queued itself, it waits for the response of the other one
+// without taking room in the queue. If it has a higher priority, the queued request moves up into its queue (like
+// with the PriorityAging, the timeouts stay the same). Only pending work is shared, completed responses are not
+// cached. Streamed and reverse proxy requests are not coalesced.
+func (q *PrioQueue) SetCoalescing(enabled bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.coalescing.Store(enabled)
+	if q.coalesced == nil {
+		q.coalesced = make(map[coalesceKey]*coalescedGroup)
+	}
+}
+
+// coalesceKey returns the key of r, ok is false if it's not coalesced. The payload is hashed only once.
+func (q *PrioQueue) coalesceKey(r *SimRequest) (key coalesceKey, ok bool) {
+	if !q.coalescing.Load() || r.Stream || r.HTTP != nil {
+		return key, false
+	}
+	if r.payloadHash == "" {
+		r.payloadHash = payloadSHA256(r.Payload)
+	}
+	if r.payloadHash == "" { // the spooled payload couldn't be read
+		return key, false
+	}
+	return coalesceKey{tenant: r.Tenant, contentType: r.ContentType, payloadHash: r.payloadHash}, true
+}
+
+// join adds r to the waiters of the identical request, if there is one which is still pending. The lock must be held.
+func (q *PrioQueue) join(key coalesceKey, r *SimRequest) bool {
+	group := q.coalesced[key]
+	if group == nil || group.leader == r || group.leader.IsCancelled() || group.leader.queueState.Load() == requestExpired {
+		return false
+	}
+	r.QueuedAt = time.Now()
+	r.coalesced = group
+	group.waiters = append(group.waiters, r)
+	q.upgrade(group.leader, r)
+	return true
+}
+
+// lead makes the queued r the leader of the identical requests pushed until its try is over. A previous leader which
+// dropped out hands over its waiters when it's discarded. A leader which is queued again (i.e. handed back by a
+// stopped node worker) keeps its waiters. The lock must be held.
+func (q *PrioQueue) lead(key coalesceKey, r *SimRequest, owner Queue) {
+	if group := q.coalesced[key]; group != nil && group.leader == r {
+		return
+	}
+	group := &coalescedGroup{queue: q, owner: owner, key: key, leader: r}
+	r.coalesced = group
+	q.coalesced[key] = group
+}
+
+// upgrade moves the queued leader into the queue of the priority of r, if that is higher and has room for it (see
+// isFull and fastTrackReservedFull). Nothing changes once the leader is being proxied. The lock must be held.
+func (q *PrioQueue) upgrade(leader, r *SimRequest) {
+	target := q.lane(r)
+	above := true // whether the lanes so far are above the one of r
+	for _, lane := range q.lanes() {
+		if lane == target {
+			above = false
+		}
+		for i, queued := range *lane {
+			if queued != leader {
+				continue
+			}
+			if !above && lane != target && !q.isFull(r) && !q.fastTrackReservedFull(r) {
+				*lane = append((*lane)[:i], (*lane)[i+1:]...)
+				*target = insertByCreatedAt(*target, leader)
+			}
+			return
+		}
+	}
+}
+
+// release ends the group, identical requests pushed from now on are queued themselves. Returns the waiters, only
+// once.
+func (g *coalescedGroup) release() []*SimRequest {
+	g.queue.cond.L.Lock()
+	defer g.queue.cond.L.Unlock()
+	if g.queue.coalesced[g.key] == g {
+		delete(g.queue.coalesced, g.key)
+	}
+	waiters := g.waiters
+	g.waiters = nil
+	return waiters
+}
+
+// releaseWaiters ends the coalescing with the leader r once its try is over: the waiters get resp, and retry on their
+// own if it's retryable. If resp is nil (r was discarded without proxying), r was cancelled, or it timed out before
+// it was proxied, the waiters are queued again instead.
+func (r *SimRequest) releaseWaiters(resp *SimResponse) {
+	group := r.coalesced
+	if group == nil || group.leader != r {
+		return
+	}
+	waiters := group.release()
+	if len(waiters) == 0 {
+		return
+	}
+
+	if resp == nil || r.IsCancelled() || errors.Is(resp.Error, ErrRequestTimeout) {
+		for _, w := range waiters {
+			if w.IsCancelled() || w.queueState.Load() != requestQueued {
+				continue // gone, or answered with its own deadline
+			}
+			if !group.owner.Push(w) {
+				if group.owner.IsClosed() {
+					w.SendResponse(SimResponse{Error: ErrShuttingDown, StatusCode: http.StatusServiceUnavailable})
+				} else {
+					w.SendResponse(SimResponse{Error: ErrQueueFull, StatusCode: http.StatusInternalServerError})
+				}
+			}
+		}
+		return
+	}
+
+	for _, w := range waiters {
+		if w.IsCancelled() || !w.take() {
+			continue
+		}
+		if resp.NodeURI != "" { // a try of the node, which counts against the retries of the waiter as well
+			w.Tries++
+		}
+		w.SendResponse(*resp)
+	}
+}
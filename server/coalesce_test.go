@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestPrioQueueCoalescing(t *testing.T) {
+	q := NewPrioQueue(0, 0, 1, 2, false, PriorityAging{})
+	defer q.Close()
+	q.SetCoalescing(true)
+	newRequest := func(id, payload string, isHighPrio, isFastTrack bool) *SimRequest {
+		return NewSimRequest(context.Background(), id, []byte(payload), isHighPrio, isFastTrack)
+	}
+
+	// Concurrent pushes of the same payload queue it once, the duplicates don't need room in the queue
+	var wg sync.WaitGroup
+	requests := make([]*SimRequest, 10)
+	for i := range requests {
+		requests[i] = newRequest(fmt.Sprint(i), "payload", false, false)
+		wg.Add(1)
+		go func(r *SimRequest) {
+			defer wg.Done()
+			require.True(t, q.Push(r))
+		}(requests[i])
+	}
+	wg.Wait()
+	require.Equal(t, 1, q.NumRequests())
+	require.False(t, q.Push(newRequest("other", "other payload", false, false)))
+
+	// The response of the single try is fanned out to all of them
+	leader := q.Pop()
+	require.Equal(t, 0, q.NumRequests())
+	require.True(t, leader.take())
+	leader.Tries++
+	require.True(t, q.Push(newRequest("in-flight", "payload", false, false))) // in flight still counts
+	require.Equal(t, 0, q.NumRequests())
+	leader.SendResponse(SimResponse{Payload: []byte("result"), NodeURI: "node"})
+	for _, r := range requests {
+		select {
+		case resp := <-r.ResponseC:
+			require.Equal(t, "result", string(resp.Payload))
+			require.Equal(t, 1, r.Tries)
+		case <-time.After(time.Second):
+			t.Fatalf("request %s got no response", r.ID)
+		}
+	}
+
+	// Completed responses are not shared
+	r := newRequest("after", "payload", false, false)
+	require.True(t, q.Push(r))
+	require.Equal(t, 1, q.NumRequests())
+	require.Equal(t, r, q.Pop())
+	r.SendResponse(SimResponse{})
+
+	// A duplicate with a higher priority moves the queued request up
+	low := newRequest("low", "bundle", false, false)
+	require.True(t, q.Push(low))
+	require.True(t, q.Push(newRequest("high", "bundle", true, false)))
+	require.True(t, q.Push(newRequest("other-high", "other bundle", true, false)))
+	lenFastTrack, lenHighPrio, lenLowPrio := q.Len()
+	require.Equal(t, []int{0, 2, 0}, []int{lenFastTrack, lenHighPrio, lenLowPrio})
+	require.True(t, q.Push(newRequest("fast", "bundle", true, true)))
+	require.True(t, q.Push(newRequest("low2", "bundle", false, false))) // doesn't move it down again
+	lenFastTrack, lenHighPrio, lenLowPrio = q.Len()
+	require.Equal(t, []int{1, 1, 0}, []int{lenFastTrack, lenHighPrio, lenLowPrio})
+	require.Equal(t, low, q.Pop())
+	require.Equal(t, "other-high", q.Pop().ID)
+	low.SendResponse(SimResponse{})
+
+	// Only if there is room for it in the higher queue
+	full := NewPrioQueue(0, 1, 0, 2, false, PriorityAging{})
+	defer full.Close()
+	full.SetCoalescing(true)
+	require.True(t, full.Push(newRequest("high", "high bundle", true, false)))
+	require.True(t, full.Push(newRequest("low", "bundle", false, false)))
+	require.True(t, full.Push(newRequest("high-duplicate", "bundle", true, false)))
+	lenFastTrack, lenHighPrio, lenLowPrio = full.Len()
+	require.Equal(t, []int{0, 1, 1}, []int{lenFastTrack, lenHighPrio, lenLowPrio})
+
+	// If the request drops out before it's proxied, the waiting ones are queued again, the first one as the leader
+	cancelled := newRequest("cancelled", "sim", true, false)
+	waiter1, waiter2 := newRequest("waiter1", "sim", true, false), newRequest("waiter2", "sim", true, false)
+	require.True(t, q.Push(cancelled))
+	require.True(t, q.Push(waiter1))
+	require.True(t, q.Push(waiter2))
+	cancelled.Cancelled = true
+	require.True(t, q.Push(newRequest("new", "sim", true, false))) // doesn't wait for the cancelled one
+	require.Equal(t, 2, q.NumRequests())
+	require.Equal(t, cancelled, q.Pop())
+	cancelled.skip()
+	require.Equal(t, 1, q.NumRequests()) // the waiters joined the new one
+	newLeader := q.Pop()
+	require.Equal(t, "new", newLeader.ID)
+	newLeader.SendResponse(SimResponse{Payload: []byte("new result")})
+	require.Equal(t, "new result", string((<-waiter1.ResponseC).Payload))
+	require.Equal(t, "new result", string((<-waiter2.ResponseC).Payload))
+
+	withdrawn, waiter3 := newRequest("withdrawn", "sim2", true, false), newRequest("waiter3", "sim2", true, false)
+	require.True(t, q.Push(withdrawn))
+	require.True(t, q.Push(waiter3))
+	require.True(t, withdrawn.withdraw())
+	require.True(t, q.Remove(withdrawn))
+	withdrawn.releaseWaiters(nil)
+	require.Equal(t, waiter3, q.Pop())
+
+	// A leader which is queued again (i.e. handed back by a stopped worker) keeps its waiters
+	handedBack, waiter4 := newRequest("handed-back", "sim3", true, false), newRequest("waiter4", "sim3", true, false)
+	require.True(t, q.Push(handedBack))
+	require.True(t, q.Push(waiter4))
+	require.Equal(t, handedBack, q.Pop())
+	require.True(t, q.Push(handedBack))
+	require.Equal(t, 1, q.NumRequests())
+	require.Equal(t, handedBack, q.Pop())
+	handedBack.SendResponse(SimResponse{Payload: []byte("handed back result")})
+	require.Equal(t, "handed back result", string((<-waiter4.ResponseC).Payload))
+
+	// Disabled
+	q.SetCoalescing(false)
+	require.True(t, q.Push(newRequest("a", "same", false, false)))
+	require.False(t, q.Push(newRequest("b", "same", false, false)))
+}
+
+func TestTenantQueueCoalescing(t *testing.T) {
+	q, err := NewTenantQueue([]TenantConfig{{Name: "a", APIKey: "key-a", Weight: 1}, {Name: "b", APIKey: "key-b", Weight: 1}}, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	defer q.Close()
+	q.SetCoalescing(true)
+	push := func(id, tenant string) *SimRequest {
+		r := NewSimRequest(context.Background(), id, []byte("payload"), false, false)
+		r.Tenant = tenant
+		require.True(t, q.Push(r))
+		return r
+	}
+
+	// Only the requests of the same tenant are coalesced
+	leaderA := push("a1", "a")
+	waiterA := push("a2", "a")
+	push("b1", "b")
+	require.Equal(t, 2, q.NumRequests())
+
+	// The waiter is queued again through the tenant queue
+	leaderA.Cancelled = true
+	var popped []*SimRequest
+	for r := q.Pop(); r != leaderA; r = q.Pop() {
+		popped = append(popped, r)
+	}
+	leaderA.skip()
+	for q.NumRequests() > 0 {
+		popped = append(popped, q.Pop())
+	}
+	require.Len(t, popped, 2)
+	require.Contains(t, popped, waiterA)
+}
+
+func TestWebserverCoalescing(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	webserver.prioQueue.(*PrioQueue).SetCoalescing(true)
+	var numProxied atomic.Int32
+	release := make(chan struct{})
+	deadlines := make(map[string]string) // X-Request-Deadline-Ms by request ID
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		numProxied.Inc()
+		<-release
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}
+	sim := func(reqID, payload string, cancel <-chan struct{}) <-chan *httptest.ResponseRecorder {
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			req := newSimTestRequest(payload)
+			req.Header.Set("X-Request-ID", reqID)
+			if deadline, ok := deadlines[reqID]; ok {
+				req.Header.Set("X-Request-Deadline-Ms", deadline)
+			}
+			ctx, cancelCtx := context.WithCancel(req.Context())
+			defer cancelCtx()
+			go func() {
+				select {
+				case <-cancel:
+					cancelCtx()
+				case <-ctx.Done():
+				}
+			}()
+			rr := httptest.NewRecorder()
+			webserver.HandleQueueRequest(rr, req.WithContext(ctx))
+			res <- rr
+		}()
+		return res
+	}
+	payload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`
+
+	// Identical requests which arrive while the first one is proxied share its node call
+	var results []<-chan *httptest.ResponseRecorder
+	for i := 0; i < 5; i++ {
+		results = append(results, sim(fmt.Sprintf("req%d", i), payload, nil))
+	}
+	require.Eventually(t, func() bool {
+		for i := 0; i < 5; i++ {
+			if webserver.pending.get("", fmt.Sprintf("req%d", i)) == nil {
+				return false
+			}
+		}
+		return numProxied.Load() == 1
+	}, time.Second, 5*time.Millisecond)
+	close(release)
+	for _, res := range results {
+		select {
+		case rr := <-res:
+			require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+			require.Equal(t, `{"jsonrpc":"2.0","result":"0x1","id":1}`, rr.Body.String())
+		case <-time.After(time.Second):
+			t.Fatal("the coalesced request was not answered")
+		}
+	}
+	require.Equal(t, int32(1), numProxied.Load())
+
+	// Once answered, the same payload is proxied again
+	require.Equal(t, http.StatusOK, (<-sim("again", payload, nil)).Code)
+	require.Equal(t, int32(2), numProxied.Load())
+
+	// If the client of the first request goes away while it's queued, the waiting one is proxied instead
+	blocker := make(chan struct{})
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		numProxied.Inc()
+		if req.Header.Get("X-Request-ID") == "busy" {
+			<-blocker
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x2","id":1}`))
+	}
+	busy := sim("busy", `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":2}`, nil)
+	require.Eventually(t, func() bool { return numProxied.Load() == 3 }, time.Second, 5*time.Millisecond)
+	gone := make(chan struct{})
+	first := sim("first", payload, gone)
+	require.Eventually(t, func() bool { return webserver.pending.get("", "first") != nil }, time.Second, 5*time.Millisecond)
+	second := sim("second", payload, nil)
+	require.Eventually(t, func() bool { return webserver.pending.get("", "second") != nil }, time.Second, 5*time.Millisecond)
+	close(gone)
+	<-first
+	close(blocker)
+	require.Equal(t, http.StatusOK, (<-busy).Code)
+	select {
+	case rr := <-second:
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Equal(t, `{"jsonrpc":"2.0","result":"0x2","id":1}`, rr.Body.String())
+	case <-time.After(time.Second):
+		t.Fatal("the waiting request was not answered")
+	}
+	require.Equal(t, int32(4), numProxied.Load()) // the first one was never proxied
+
+	// If the deadline of the first request passes in the queue, the waiting one is queued again right away (instead
+	// of when the first one is taken by a worker)
+	blocker = make(chan struct{})
+	busy = sim("busy", `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":2}`, nil)
+	require.Eventually(t, func() bool { return numProxied.Load() == 5 }, time.Second, 5*time.Millisecond)
+	deadlines["short"], deadlines["long"] = "50", "5000"
+	short := sim("short", payload, nil)
+	require.Eventually(t, func() bool { return webserver.pending.get("", "short") != nil }, time.Second, 5*time.Millisecond)
+	long := sim("long", payload, nil)
+	require.Eventually(t, func() bool { return webserver.pending.get("", "long") != nil }, time.Second, 5*time.Millisecond)
+	longReq := webserver.pending.get("", "long")
+	rr := <-short
+	require.Equal(t, ErrorKindRequestTimeout, rr.Header().Get("X-Error-Kind"), rr.Body.String())
+	q := webserver.prioQueue.(*PrioQueue)
+	q.cond.L.Lock()
+	isLeader := longReq.coalesced != nil && longReq.coalesced.leader == longReq // doesn't wait for the expired one
+	q.cond.L.Unlock()
+	require.True(t, isLeader)
+	close(blocker)
+	require.Equal(t, http.StatusOK, (<-busy).Code)
+	select {
+	case rr := <-long:
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Equal(t, `{"jsonrpc":"2.0","result":"0x2","id":1}`, rr.Body.String())
+	case <-time.After(time.Second):
+		t.Fatal("the waiting request was not answered")
+	}
+	require.Equal(t, int32(6), numProxied.Load())
+}
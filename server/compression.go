@@ -0,0 +1,50 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isGzipEncoded returns true if the request body is gzip compressed (`Content-Encoding: gzip`)
+func isGzipEncoded(req *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(req.Header.Get("Content-Encoding")), "gzip")
+}
+
+// acceptsGzip returns true if the client accepts gzip compressed responses (`Accept-Encoding: gzip`)
+func acceptsGzip(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+
+		// honor an explicit `q=0`
+		key, value, found := strings.Cut(strings.TrimSpace(params), "=")
+		if found && strings.TrimSpace(key) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// writePayload writes the payload with the status code, gzip compressed if the client accepts it
+// and the payload is at least ResponseGzipMinBytes large.
+func writePayload(w http.ResponseWriter, req *http.Request, statusCode int, payload []byte) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if ResponseGzipMinBytes <= 0 || len(payload) < ResponseGzipMinBytes || !acceptsGzip(req) {
+		w.WriteHeader(statusCode)
+		w.Write(payload)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(statusCode)
+	gz := gzip.NewWriter(w)
+	gz.Write(payload)
+	gz.Close()
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip", true},
+		{"gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"br, deflate", false},
+		{"gzipx", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/", nil)
+			req.Header.Set("Accept-Encoding", tt.header)
+			require.Equal(t, tt.expected, acceptsGzip(req))
+		})
+	}
+}
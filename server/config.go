@@ -0,0 +1,430 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoConfigFile      = errors.New("no config file (CONFIG_FILE) set")
+	ErrInvalidConfigFile = errors.New("invalid config file")
+
+	configKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// configValues are the values of the config file (CONFIG_FILE), loaded on first use and replaced by ReloadConfig
+var configValues = &configFileValues{}
+
+type configFileValues struct {
+	once   sync.Once
+	lock   sync.RWMutex
+	path   string
+	values map[string]string
+	err    error // if loading the file at startup failed
+}
+
+func (c *configFileValues) get() (values map[string]string, path string, err error) {
+	c.once.Do(func() {
+		if ConfigFile == "" {
+			return
+		}
+		c.path = ConfigFile
+		c.values, c.err = readConfigFile(ConfigFile)
+	})
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.values, c.path, c.err
+}
+
+func (c *configFileValues) set(path string, values map[string]string) {
+	c.get() // don't load the file later
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.path, c.values, c.err = path, values, nil
+}
+
+// LookupConfig returns the value of a setting from the config file (CONFIG_FILE), or from the environment if it is
+// not in the file
+func LookupConfig(key string) (string, bool) {
+	values, _, _ := configValues.get()
+	if value, ok := values[key]; ok {
+		return value, true
+	}
+	return os.LookupEnv(key)
+}
+
+// ParseConfigFile parses KEY=VALUE lines. Blank lines and lines starting with # are ignored, values can be quoted
+// and an "export " prefix is allowed (like in .env files).
+func ParseConfigFile(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024) // PRIORITY_RULES and TENANTS can be long
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !found || !configKeyRegex.MatchString(key) {
+			return nil, errors.Wrapf(ErrInvalidConfigFile, "line %d: expected KEY=VALUE", lineNum)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values, err := ParseConfigFile(file)
+	return values, errors.Wrap(err, path)
+}
+
+// ConfigChange is a setting which differs between the running config and the reloaded config file
+type ConfigChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"` // only set for the applied settings (the others can be secrets)
+	New string `json:"new,omitempty"`
+}
+
+// ConfigReloadResult are the changes of a config reload
+type ConfigReloadResult struct {
+	Applied         []ConfigChange `json:"applied"`
+	RequiresRestart []ConfigChange `json:"requiresRestart"` // changed, but they only take effect after a restart
+	NodesAdded      []string       `json:"nodesAdded"`
+	NodesRemoved    []string       `json:"nodesRemoved"`
+}
+
+// liveSetting is a setting which can be changed at runtime. prepare validates the new value (ok is false if the key
+// was removed, then the default is used) and returns the function which applies it, so that either all or no changes
+// are applied.
+type liveSetting struct {
+	prepare   func(s *Server, value string, ok bool) (apply func(), err error)
+	available func(s *Server) bool // (optional) false if the setting requires a restart in this server (i.e. with multi-tenancy)
+}
+
+func intSetting(defaultValue int, set func(s *Server, value int)) liveSetting {
+	return liveSetting{prepare: func(s *Server, value string, ok bool) (func(), error) {
+		val := defaultValue
+		if ok {
+			var err error
+			if val, err = strconv.Atoi(value); err != nil {
+				return nil, err
+			}
+		}
+		return func() { set(s, val) }, nil
+	}}
+}
+
+func secondsSetting(defaultSeconds int, set func(s *Server, value time.Duration)) liveSetting {
+	return intSetting(defaultSeconds, func(s *Server, value int) {
+		set(s, time.Duration(value)*time.Second)
+	})
+}
+
+func floatSetting(defaultValue float64, set func(s *Server, value float64)) liveSetting {
+	return liveSetting{prepare: func(s *Server, value string, ok bool) (func(), error) {
+		val := defaultValue
+		if ok {
+			var err error
+			if val, err = strconv.ParseFloat(value, 64); err != nil {
+				return nil, err
+			}
+		}
+		return func() { set(s, val) }, nil
+	}}
+}
+
+// queueSetting can only be changed without multi-tenancy (the tenant queues are configured by /admin/tenants)
+func queueSetting(defaultValue int, set func(s *Server, q *PrioQueue, value int)) liveSetting {
+	setting := intSetting(defaultValue, func(s *Server, value int) {
+		set(s, s.prioQueue.(*PrioQueue), value)
+	})
+	setting.available = func(s *Server) bool {
+		_, ok := s.prioQueue.(*PrioQueue)
+		return ok
+	}
+	return setting
+}
+
+// configPayloadMaxBytes returns MAX_REQUEST_PAYLOAD_BYTES, or the deprecated PAYLOAD_MAX_KB (in KB) if it's not set
+func configPayloadMaxBytes() int {
+	return GetEnvInt("MAX_REQUEST_PAYLOAD_BYTES", GetEnvInt("PAYLOAD_MAX_KB", 8192)*1024)
+}
+
+// payloadMaxBytesSetting applies PayloadMaxBytes from both settings of the reloaded config (which is read by the
+// time the changes are applied)
+var payloadMaxBytesSetting = intSetting(0, func(s *Server, _ int) {
+	PayloadMaxBytes = configPayloadMaxBytes()
+})
+
+// liveSettings are the settings applied by ReloadConfig, all others require a restart. The nodes (NODES and
+// BACKENDS) are reconciled separately.
+var liveSettings = map[string]liveSetting{
+	"ITEMS_FASTTRACK_MAX": queueSetting(0, func(s *Server, q *PrioQueue, value int) {
+		MaxQueueItemsFastTrack = value
+		q.SetLimits(MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio)
+	}),
+	"ITEMS_HIGHPRIO_MAX": queueSetting(0, func(s *Server, q *PrioQueue, value int) {
+		MaxQueueItemsHighPrio = value
+		q.SetLimits(MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio)
+	}),
+	"ITEMS_LOWPRIO_MAX": queueSetting(0, func(s *Server, q *PrioQueue, value int) {
+		MaxQueueItemsLowPrio = value
+		q.SetLimits(MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio)
+	}),
+	"ITEMS_FASTTRACK_PER_HIGHPRIO": queueSetting(2, func(s *Server, q *PrioQueue, value int) {
+		FastTrackPerHighPrio = value
+		q.SetInterleaveWeights(FastTrackPerHighPrio, HighPrioWeight)
+	}),
+	"ITEMS_HIGHPRIO_WEIGHT": queueSetting(1, func(s *Server, q *PrioQueue, value int) {
+		HighPrioWeight = value
+		q.SetInterleaveWeights(FastTrackPerHighPrio, HighPrioWeight)
+	}),
+	"RETRIES_MAX": intSetting(3, func(s *Server, value int) {
+		RequestMaxTries = value
+	}),
+	"MAX_REQUEST_PAYLOAD_BYTES": payloadMaxBytesSetting,
+	"PAYLOAD_MAX_KB":            payloadMaxBytesSetting,
+	"NODE_RESPONSE_MAX_KB": intSetting(65536, func(s *Server, value int) {
+		NodeResponseMaxBytes = value * 1024
+	}),
+	"REQUEST_TIMEOUT": secondsSetting(5, func(s *Server, value time.Duration) {
+		RequestTimeout = value
+	}),
+	"REQUEST_TIMEOUT_FASTTRACK": secondsSetting(0, func(s *Server, value time.Duration) {
+		RequestTimeoutFastTrack = value
+	}),
+	"REQUEST_TIMEOUT_HIGHPRIO": secondsSetting(0, func(s *Server, value time.Duration) {
+		RequestTimeoutHighPrio = value
+	}),
+	"REQUEST_TIMEOUT_LOWPRIO": secondsSetting(0, func(s *Server, value time.Duration) {
+		RequestTimeoutLowPrio = value
+	}),
+	"JOB_SEND_TIMEOUT": secondsSetting(2, func(s *Server, value time.Duration) {
+		ServerJobSendTimeout = value
+	}),
+	"NODE_HEALTHCHECK_INTERVAL_SEC": secondsSetting(10, func(s *Server, value time.Duration) {
+		NodeHealthCheckInterval = value
+		s.restartHealthChecks()
+	}),
+	"EVENTS_QUEUE_THRESHOLD": intSetting(100, func(s *Server, value int) {
+		EventsQueueThreshold = value
+		s.webserver.setQueueThreshold(value)
+	}),
+	"RETRY_BUDGET_RATIO": floatSetting(0, func(s *Server, value float64) {
+		RetryBudgetRatio = value
+		s.webserver.retryBudget.SetLimits(RetryBudgetRatio, RetryBudgetMinPerSec, RetryBudgetBurst)
+	}),
+	"RETRY_BUDGET_MIN_PER_SEC": floatSetting(1, func(s *Server, value float64) {
+		RetryBudgetMinPerSec = value
+		s.webserver.retryBudget.SetLimits(RetryBudgetRatio, RetryBudgetMinPerSec, RetryBudgetBurst)
+	}),
+	"RETRY_BUDGET_BURST": floatSetting(10, func(s *Server, value float64) {
+		RetryBudgetBurst = value
+		s.webserver.retryBudget.SetLimits(RetryBudgetRatio, RetryBudgetMinPerSec, RetryBudgetBurst)
+	}),
+	"PRIORITY_RULES": {prepare: func(s *Server, value string, ok bool) (func(), error) {
+		rules, err := ParsePriorityRules(value)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			PriorityRulesConfig = value
+			_ = s.webserver.SetPriorityRules(rules) // validated above
+		}, nil
+	}},
+}
+
+// configNodeKeys are the settings with the node URIs (comma separated)
+var configNodeKeys = []string{"NODES", "BACKENDS"}
+
+// ReloadConfig re-reads the config file (CONFIG_FILE), and applies the changed settings which can be changed at
+// runtime (see liveSettings). Nodes added to NODES or BACKENDS are added to the pool, and the removed ones are
+// removed from it. Nodes added with /nodes are kept. If a changed value is invalid, no change is applied.
+func (s *Server) ReloadConfig() (result ConfigReloadResult, err error) {
+	s.configReloadLock.Lock()
+	defer s.configReloadLock.Unlock()
+
+	oldValues, path, _ := configValues.get()
+	if path == "" {
+		return result, ErrNoConfigFile
+	}
+	newValues, err := readConfigFile(path)
+	if err != nil {
+		return result, err
+	}
+
+	// The changed keys, with the environment as fallback of both (the running config)
+	keys := make([]string, 0, len(oldValues)+len(newValues))
+	for key := range oldValues {
+		keys = append(keys, key)
+	}
+	for key := range newValues {
+		if _, found := oldValues[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var applyFuncs []func()
+	for _, key := range keys {
+		oldValue, oldOk := lookupConfigIn(oldValues, key)
+		newValue, newOk := lookupConfigIn(newValues, key)
+		if oldValue == newValue && oldOk == newOk {
+			continue
+		} else if key == configNodeKeys[0] || key == configNodeKeys[1] {
+			continue // reconciled below
+		}
+
+		setting, found := liveSettings[key]
+		if !found || (setting.available != nil && !setting.available(s)) {
+			result.RequiresRestart = append(result.RequiresRestart, ConfigChange{Key: key})
+			continue
+		}
+		apply, err := setting.prepare(s, newValue, newOk)
+		if err != nil {
+			return ConfigReloadResult{}, errors.Wrapf(err, "invalid %s", key)
+		}
+		applyFuncs = append(applyFuncs, apply)
+		result.Applied = append(result.Applied, ConfigChange{Key: key, Old: oldValue, New: newValue})
+	}
+
+	configValues.set(path, newValues)
+	for _, apply := range applyFuncs {
+		apply()
+	}
+	for _, change := range result.Applied {
+		s.log.Infow("Config setting changed", "key", change.Key, "old", change.Old, "new", change.New)
+	}
+	for _, change := range result.RequiresRestart {
+		s.log.Warnw("Config setting changed, but it requires a restart to take effect", "key", change.Key)
+	}
+
+	// Reconcile the nodes of the config
+	oldNodes, newNodes := configNodes(oldValues), configNodes(newValues)
+	var nodeErrs []string
+	for uri := range newNodes {
+		if oldNodes[uri] {
+			continue
+		}
+		if err := s.nodePool.AddNode(uri); err != nil {
+			nodeErrs = append(nodeErrs, fmt.Sprintf("adding %s: %s", uri, err))
+			continue
+		}
+		result.NodesAdded = append(result.NodesAdded, uri)
+	}
+	for uri := range oldNodes {
+		if newNodes[uri] {
+			continue
+		}
+		deleted, err := s.nodePool.DelNode(uri)
+		if err != nil {
+			nodeErrs = append(nodeErrs, fmt.Sprintf("removing %s: %s", uri, err))
+		} else if deleted {
+			result.NodesRemoved = append(result.NodesRemoved, uri)
+		}
+	}
+	sort.Strings(result.NodesAdded)
+	sort.Strings(result.NodesRemoved)
+	if len(nodeErrs) > 0 {
+		sort.Strings(nodeErrs)
+		return result, errors.New("updating the nodes failed: " + strings.Join(nodeErrs, ", "))
+	}
+	return result, nil
+}
+
+func lookupConfigIn(values map[string]string, key string) (string, bool) {
+	if value, ok := values[key]; ok {
+		return value, true
+	}
+	return os.LookupEnv(key)
+}
+
+// configNodes returns the node URIs of NODES and BACKENDS
+func configNodes(values map[string]string) map[string]bool {
+	nodes := make(map[string]bool)
+	for _, key := range configNodeKeys {
+		value, _ := lookupConfigIn(values, key)
+		for _, uri := range splitCommaList(value) {
+			nodes[uri] = true
+		}
+	}
+	return nodes
+}
+
+// ReloadOnSignal reloads the TLS certificate and the config file (if CONFIG_FILE is set) whenever one of the signals
+// is received (i.e. SIGHUP), until ctx is done. The signals are subscribed to before it returns.
+func (s *Server) ReloadOnSignal(ctx context.Context, sig ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c:
+			}
+
+			if err := s.ReloadCertificate(); err != nil {
+				s.log.Errorw("TLS certificate reload failed", "error", err)
+			} else if s.certLoader != nil {
+				s.log.Info("TLS certificate reloaded")
+			}
+			if _, path, _ := configValues.get(); path == "" {
+				continue
+			}
+			if _, err := s.ReloadConfig(); err != nil {
+				s.log.Errorw("Config reload failed", "error", err)
+			} else {
+				s.log.Info("Config reloaded")
+			}
+		}
+	}()
+}
+
+// EnableConfigReload enables reloading the config with /admin/config/reload
+func (s *Webserver) EnableConfigReload(reload func() (ConfigReloadResult, error)) {
+	s.reloadConfig = reload
+}
+
+// HandleConfigReloadRequest reloads the config file, and returns the changes
+func (s *Webserver) HandleConfigReloadRequest(w http.ResponseWriter, req *http.Request) {
+	if s.reloadConfig == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "config reload is not enabled")
+		return
+	}
+	result, err := s.reloadConfig()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
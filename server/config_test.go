@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// useConfigFile writes a temporary config file, and uses it like CONFIG_FILE until the end of the test. The
+// settings which can be changed by a reload are restored as well.
+func useConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.env")
+	require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	values, err := readConfigFile(path)
+	require.Nil(t, err, err)
+	configValues.set(path, values)
+
+	maxFastTrack, maxHighPrio, maxLowPrio, fastTrackPerHighPrio, highPrioWeight := MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio, FastTrackPerHighPrio, HighPrioWeight
+	maxTries, payloadMaxBytes, requestTimeout, jobSendTimeout := RequestMaxTries, PayloadMaxBytes, RequestTimeout, ServerJobSendTimeout
+	healthCheckInterval, queueThreshold, priorityRules := NodeHealthCheckInterval, EventsQueueThreshold, PriorityRulesConfig
+	retryBudgetRatio, retryBudgetMinPerSec, retryBudgetBurst := RetryBudgetRatio, RetryBudgetMinPerSec, RetryBudgetBurst
+	t.Cleanup(func() {
+		configValues.set("", nil)
+		MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio, FastTrackPerHighPrio, HighPrioWeight = maxFastTrack, maxHighPrio, maxLowPrio, fastTrackPerHighPrio, highPrioWeight
+		RequestMaxTries, PayloadMaxBytes, RequestTimeout, ServerJobSendTimeout = maxTries, payloadMaxBytes, requestTimeout, jobSendTimeout
+		NodeHealthCheckInterval, EventsQueueThreshold, PriorityRulesConfig = healthCheckInterval, queueThreshold, priorityRules
+		RetryBudgetRatio, RetryBudgetMinPerSec, RetryBudgetBurst = retryBudgetRatio, retryBudgetMinPerSec, retryBudgetBurst
+	})
+	return path
+}
+
+func TestParseConfigFile(t *testing.T) {
+	values, err := ParseConfigFile(strings.NewReader(`
+# comment
+ITEMS_LOWPRIO_MAX=10
+  export RETRIES_MAX = 5
+PRIORITY_RULES='[{"method":"eth_call","priority":"high-prio"}]'
+NODES="http://a:8545,http://b:8545"
+EMPTY=
+`))
+	require.Nil(t, err, err)
+	require.Equal(t, map[string]string{
+		"ITEMS_LOWPRIO_MAX": "10",
+		"RETRIES_MAX":       "5",
+		"PRIORITY_RULES":    `[{"method":"eth_call","priority":"high-prio"}]`,
+		"NODES":             "http://a:8545,http://b:8545",
+		"EMPTY":             "",
+	}, values)
+
+	for _, content := range []string{"ITEMS_LOWPRIO_MAX", "=10", "ITEMS LOWPRIO=10"} {
+		_, err := ParseConfigFile(strings.NewReader("A=1\n" + content))
+		require.ErrorIs(t, err, ErrInvalidConfigFile, content)
+		require.Contains(t, err.Error(), "line 2")
+	}
+}
+
+func TestLookupConfig(t *testing.T) {
+	t.Setenv("CONFIG_TEST_FILE_KEY", "env")
+	t.Setenv("CONFIG_TEST_ENV_KEY", "env")
+	useConfigFile(t, "CONFIG_TEST_FILE_KEY=file\nCONFIG_TEST_ONLY_FILE_KEY=\n")
+
+	for key, expected := range map[string]string{"CONFIG_TEST_FILE_KEY": "file", "CONFIG_TEST_ENV_KEY": "env", "CONFIG_TEST_ONLY_FILE_KEY": ""} {
+		value, ok := LookupConfig(key)
+		require.True(t, ok, key)
+		require.Equal(t, expected, value, key)
+	}
+	_, ok := LookupConfig("CONFIG_TEST_MISSING_KEY")
+	require.False(t, ok)
+	require.Equal(t, 5, GetEnvInt("CONFIG_TEST_MISSING_KEY", 5))
+}
+
+// sendSimRequest sends a request without priority headers to the sim endpoint. If wait is false, it only waits until
+// the request is queued or rejected (the server has no main loop), and the request is cancelled at the end of the test.
+func sendSimRequest(t *testing.T, handler http.Handler, method string, wait bool) *httptest.ResponseRecorder {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/sim", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":[]}`)).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	if wait {
+		defer cancel()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(rr, req)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return rr
+}
+
+func TestReloadConfigOnSignal(t *testing.T) {
+	node1 := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node1.Close()
+	node2 := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node2.Close()
+
+	path := useConfigFile(t, "ITEMS_LOWPRIO_MAX=0\nNODES="+node1.URL+"\n")
+	srv, err := NewServer(ServerOpts{Log: testLog, WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	defer srv.Shutdown()
+	require.Nil(t, srv.AddNode(node1.URL))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.ReloadOnSignal(ctx, syscall.SIGHUP)
+
+	newConfig := strings.Join([]string{
+		"ITEMS_LOWPRIO_MAX=1",
+		`PRIORITY_RULES=[{"method":"eth_callBundle","priority":"high-prio"}]`,
+		"PAYLOAD_MAX_KB=1",
+		"NODES=" + node2.URL,
+		"REDIS_PREFIX=other", // requires a restart
+	}, "\n")
+	require.Nil(t, os.WriteFile(path, []byte(newConfig), 0o600))
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool {
+		uris := srv.nodePool.NodeUris()
+		return len(uris) == 1 && uris[0] == node2.URL // the nodes are reconciled last
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The lowered queue limit rejects the second low-prio request
+	handler := srv.Handler()
+	sendSimRequest(t, handler, "eth_call", false)
+	require.Eventually(t, func() bool {
+		_, _, lenLowPrio := srv.QueueSize()
+		return lenLowPrio == 1
+	}, time.Second, 5*time.Millisecond)
+	rr := sendSimRequest(t, handler, "eth_call", true)
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, ErrorKindQueueFull, rr.Header().Get("X-Error-Kind"))
+
+	// The priority rules apply to new requests
+	sendSimRequest(t, handler, "eth_callBundle", false)
+	require.Eventually(t, func() bool {
+		_, lenHighPrio, _ := srv.QueueSize()
+		return lenHighPrio == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// The payload limit
+	req := httptest.NewRequest(http.MethodPost, "/sim", strings.NewReader(`{"id":1,"params":["`+strings.Repeat("0", 2000)+`"]}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	require.Contains(t, rr.Body.String(), ErrorCodePayloadTooLarge)
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Setenv("RETRIES_MAX", "4")
+	path := useConfigFile(t, "REQUEST_TIMEOUT=7\nTLS_CERT_RELOAD_INTERVAL_SEC=10\n")
+	srv, err := NewServer(ServerOpts{Log: testLog})
+	require.Nil(t, err, err)
+	defer srv.Shutdown()
+	handler := srv.Handler()
+
+	reload := func(content string) *httptest.ResponseRecorder {
+		require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/config/reload", nil))
+		return rr
+	}
+
+	// A removed key falls back to the environment or the default, and unknown changed keys require a restart
+	rr := reload("RETRIES_MAX=2\nTLS_CERT_RELOAD_INTERVAL_SEC=20\nEVENTS_QUEUE_THRESHOLD=10\n")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var result ConfigReloadResult
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&result))
+	require.Equal(t, []ConfigChange{
+		{Key: "EVENTS_QUEUE_THRESHOLD", Old: "", New: "10"},
+		{Key: "REQUEST_TIMEOUT", Old: "7", New: ""},
+		{Key: "RETRIES_MAX", Old: "4", New: "2"},
+	}, result.Applied)
+	require.Equal(t, []ConfigChange{{Key: "TLS_CERT_RELOAD_INTERVAL_SEC"}}, result.RequiresRestart)
+	require.Equal(t, 2, RequestMaxTries)
+	require.Equal(t, 5*time.Second, RequestTimeout)
+	require.Equal(t, 10, EventsQueueThreshold)
+
+	// Nothing is applied if a value is invalid
+	rr = reload("RETRIES_MAX=1\nREQUEST_TIMEOUT=x\n")
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), "invalid REQUEST_TIMEOUT")
+	require.Equal(t, 2, RequestMaxTries)
+	rr = reload(`PRIORITY_RULES=[{"priority":"urgent"}]`)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The payload limit in bytes, or in KB with the deprecated setting
+	require.Equal(t, http.StatusOK, reload("PAYLOAD_MAX_KB=2\n").Code)
+	require.Equal(t, 2048, PayloadMaxBytes)
+	require.Equal(t, http.StatusOK, reload("PAYLOAD_MAX_KB=2\nMAX_REQUEST_PAYLOAD_BYTES=1500\n").Code)
+	require.Equal(t, 1500, PayloadMaxBytes)
+	require.Equal(t, http.StatusOK, reload("").Code)
+	require.Equal(t, 8192*1024, PayloadMaxBytes)
+
+	// An unreachable node fails the reload, but the other changes are applied
+	require.Nil(t, os.WriteFile(path, []byte("RETRIES_MAX=1\nNODES=http://localhost:1\n"), 0o600))
+	result, err = srv.ReloadConfig()
+	require.ErrorContains(t, err, "adding http://localhost:1")
+	require.Equal(t, 1, RequestMaxTries)
+	require.Empty(t, result.NodesAdded)
+
+	// Without a config file
+	configValues.set("", nil)
+	_, err = srv.ReloadConfig()
+	require.ErrorIs(t, err, ErrNoConfigFile)
+}
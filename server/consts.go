@@ -8,9 +8,27 @@ import (
 )
 
 var (
-	JobChannelBuffer = GetEnvInt("JOB_CHAN_BUFFER", 2)          // buffer for JobC in backends (for transporting jobs from server -> backend node)
-	RequestMaxTries  = GetEnvInt("RETRIES_MAX", 3)              // 3 tries means it will be retried 2 additional times, and on third error would fail
-	PayloadMaxBytes  = GetEnvInt("PAYLOAD_MAX_KB", 8192) * 1024 // Max payload size in bytes. If a payload sent to the webserver is larger, it returns "400 Bad Request".
+	ConfigFile = os.Getenv("CONFIG_FILE") // (optional) KEY=VALUE file with the settings, which override the environment. Reloaded on SIGHUP and with /admin/config/reload.
+
+	JobChannelBuffer = GetEnvInt("JOB_CHAN_BUFFER", 2) // buffer for JobC in backends (for transporting jobs from server -> backend node)
+	RequestMaxTries  = GetEnvInt("RETRIES_MAX", 3)     // 3 tries means it will be retried 2 additional times, and on third error would fail
+	PayloadMaxBytes  = configPayloadMaxBytes()         // Max payload size in bytes (MAX_REQUEST_PAYLOAD_BYTES, or the deprecated PAYLOAD_MAX_KB in KB, default 8 MB). If a payload sent to the webserver is larger, it returns "413 Request Entity Too Large".
+
+	NodeResponseMaxBytes = GetEnvInt("NODE_RESPONSE_MAX_KB", 65536) * 1024 // Max size of the node responses in bytes (of all transports, not of streamed responses), larger ones fail with RESPONSE_TOO_LARGE. 0 disables the limit.
+
+	PayloadSpoolThreshold = GetEnvInt("PAYLOAD_SPOOL_THRESHOLD_KB", 0) * 1024 // Payloads larger than this are spooled to a temp file instead of kept in memory. 0 disables spooling.
+	PayloadSpoolDir       = GetEnv("PAYLOAD_SPOOL_DIR", "")                   // Directory for spooled payloads (default: os.TempDir)
+	ResponseGzipMinBytes  = GetEnvInt("RESPONSE_GZIP_MIN_BYTES", 1024)        // Responses at least this large are gzip compressed if the client sends `Accept-Encoding: gzip`. 0 disables compression.
+	StreamResponses       = GetEnv("STREAM_RESPONSES", "") == "1"             // Stream the successful responses of HTTP nodes to the clients, instead of buffering them (not with response validation, proxy middlewares, response signing or batch splitting)
+
+	ValidateJSONRPC       = GetEnv("VALIDATE_JSONRPC", "") == "1"                                        // Reject payloads which are not a valid JSON-RPC 2.0 request with "400 Bad Request" (default: raw passthrough)
+	JSONRPCAllowedMethods = ParseMethodAllowlist(GetEnv("JSONRPC_ALLOWED_METHODS", ""))                  // Comma separated list of allowed JSON-RPC methods, if ValidateJSONRPC is enabled. Empty allows all methods.
+	SplitJSONRPCBatches   = GetEnv("SPLIT_JSONRPC_BATCHES", "") == "1"                                   // Split JSON-RPC batches into individual requests, which are processed in parallel
+	SimsMaxBatchSize      = GetEnvInt("SIMS_MAX_BATCH_SIZE", 200)                                        // Max. number of payloads of a POST /sims request
+	PassthroughMode       = GetEnv("PASSTHROUGH_MODE", "") == "1"                                        // Forward payloads of any content type unchanged, preserving the Content-Type of requests and responses (disables JSON-RPC validation and batch splitting). Can be enabled per node with the `_passthrough=1` URI query param.
+	ResponseValidation    = GetEnv("RESPONSE_VALIDATION", "")                                            // Comma separated checks of successful node responses, which are retried on another try if they fail: "json" (valid JSON), "result" (non-empty JSON-RPC result), "min=<bytes>", "max=<bytes>". Empty disables the validation.
+	ReverseProxyPath      = GetEnv("REVERSE_PROXY_PATH", "")                                             // Requests of any method below this path (i.e. "/api") are queued, and forwarded with their method, the path below it, the query string and the REVERSE_PROXY_HEADERS to the nodes with the `_proxy=1` URI query param. Empty disables the route.
+	ReverseProxyHeaders   = ParseHeaderAllowlist(GetEnv("REVERSE_PROXY_HEADERS", "Accept,Content-Type")) // Comma separated headers of reverse proxy requests which are forwarded to the nodes
 
 	MaxQueueItemsFastTrack = GetEnvInt("ITEMS_FASTTRACK_MAX", 0) // Max number of items in fast-track queue. 0 means no limit.
 	MaxQueueItemsHighPrio  = GetEnvInt("ITEMS_HIGHPRIO_MAX", 0)  // Max number of items in high-prio queue. 0 means no limit.
@@ -18,15 +36,212 @@ var (
 
 	// How often fast-track queue items should be popped before popping a high-priority item
 	FastTrackPerHighPrio = GetEnvInt("ITEMS_FASTTRACK_PER_HIGHPRIO", 2)
-	FastTrackDrainFirst  = os.Getenv("FASTTRACK_DRAIN_FIRST") == "1" // whether to fully drain the fast-track queue first
+	HighPrioWeight       = GetEnvInt("ITEMS_HIGHPRIO_WEIGHT", 1)      // how many high-prio items are popped for every ITEMS_FASTTRACK_PER_HIGHPRIO fast-track ones (i.e. 3 and 2 for a 3:2 ratio)
+	FastTrackDrainFirst  = GetEnv("FASTTRACK_DRAIN_FIRST", "") == "1" // whether to fully drain the fast-track queue first
+	LowPrioEveryN        = GetEnvInt("ITEMS_LOWPRIO_EVERY_N", 0)      // pop a low-prio request after every n fast-track and high-prio ones (0: only when both are empty, not with multi-tenancy)
+	PriorityLevels       = GetEnvInt("PRIORITY_LEVELS", 3)            // number of priority levels of the X-Priority header (at least 3): 0 is fast-track, 1 high-prio, the last one low-prio, and the ones in between are high-prio requests popped after the high-prio ones
+	TenantsConfig        = GetEnv("TENANTS", "")                      // JSON list of tenants (name, apiKey, weight and queue limits) to enable multi-tenancy. Tenants saved in redis take precedence.
+
+	TenantPriorityCapReject = GetEnv("TENANT_PRIORITY_CAP_REJECT", "") == "1" // reject requests above the maxPriority of their tenant with 403, instead of downgrading them
+
+	LowPrioSchedule         = GetEnv("LOWPRIO_SCHEDULE", "")             // JSON list of daily windows with other low-prio settings, i.e. `[{"name":"peak","start":"13:30","end":"20:00","paused":true},{"name":"night","start":"22:00","end":"06:00","everyN":1}]`. Outside of the windows ITEMS_LOWPRIO_EVERY_N applies. Not supported with multi-tenancy.
+	LowPrioScheduleTimezone = GetEnv("LOWPRIO_SCHEDULE_TIMEZONE", "UTC") // IANA timezone of the LOWPRIO_SCHEDULE windows, i.e. "America/New_York"
+
+	PromoteLowPrioAfter  = time.Duration(GetEnvInt("PROMOTE_LOWPRIO_AFTER_MS", 0)) * time.Millisecond  // low-prio requests which waited this long since their creation are moved into the high-prio queue (0 disables)
+	PromoteHighPrioAfter = time.Duration(GetEnvInt("PROMOTE_HIGHPRIO_AFTER_MS", 0)) * time.Millisecond // high-prio requests which waited this long are moved into the fast-track queue (0 disables)
+
+	ReservationSyncInterval = time.Duration(GetEnvInt("FASTTRACK_RESERVATIONS_SYNC_INTERVAL_SEC", 5)) * time.Second // how often the fast-track reservations are reloaded from redis (granted or revoked by other instances) and expired
+
+	Peers              = GetEnv("PEERS", "")                                                      // comma-separated base URLs of other instances, which serve the requests rejected by the queue (full or shedding)
+	PeerMaxHops        = GetEnvInt("PEER_MAX_HOPS", 1)                                            // how often a request may be forwarded between instances
+	PeerStatusCacheTTL = time.Duration(GetEnvInt("PEER_STATUS_CACHE_MS", 500)) * time.Millisecond // how long the admission status of the peers is cached
+	PeerForwardTimeout = time.Duration(GetEnvInt("PEER_FORWARD_TIMEOUT_SEC", 10)) * time.Second   // timeout of the requests to the peers
+
+	DryRunAPIKeys       = GetEnv("DRYRUN_API_KEYS", "")         // comma-separated API keys (X-API-Key header) which may send dry runs to the canary node with POST /sim/dryrun, which is disabled without keys
+	DryRunMaxConcurrent = GetEnvInt("DRYRUN_MAX_CONCURRENT", 2) // max. number of concurrent dry runs, more are rejected
+
+	SmallestFirstFastTrack = GetEnv("SMALLEST_FIRST_FASTTRACK", "") == "1"                                   // pop the queued fast-track request with the smallest payload first, instead of the oldest one
+	SmallestFirstHighPrio  = GetEnv("SMALLEST_FIRST_HIGHPRIO", "") == "1"                                    // the same for high-prio requests
+	SmallestFirstLowPrio   = GetEnv("SMALLEST_FIRST_LOWPRIO", "") == "1"                                     // the same for low-prio requests
+	SmallestFirstMaxSkips  = GetEnvInt("SMALLEST_FIRST_MAX_SKIPS", 10)                                       // with smallest-first order, a request is passed by at most this many smaller ones (0 means no limit)
+	SmallestFirstMaxWait   = time.Duration(GetEnvInt("SMALLEST_FIRST_MAX_WAIT_MS", 1000)) * time.Millisecond // with smallest-first order, a request is not passed anymore once it waited this long (0 means no limit)
+
+	PriorityRulesConfig = GetEnv("PRIORITY_RULES", "") // JSON list of rules which assign the priority of requests without priority headers, i.e. `[{"method":"eth_callBundle","priority":"fast-track"},{"method":"eth_call","priority":"high-prio"}]`. The first matching rule wins, otherwise low-prio.
 
 	RequestTimeout       = time.Duration(GetEnvInt("REQUEST_TIMEOUT", 5)) * time.Second       // Time between creation and receive in the node worker, after which a SimRequest will not be processed anymore
 	ServerJobSendTimeout = time.Duration(GetEnvInt("JOB_SEND_TIMEOUT", 2)) * time.Second      // How long the server tries to send a job into the nodepool for processing
 	ProxyRequestTimeout  = time.Duration(GetEnvInt("REQUEST_PROXY_TIMEOUT", 3)) * time.Second // HTTP request timeout for proxy requests to the backend node
 
-	RedisPrefix        = GetEnv("REDIS_PREFIX", "prio-load-balancer:") // All redis keys will be prefixed with this
-	EnableErrorTestAPI = os.Getenv("ENABLE_ERROR_TEST_API") == "1"     // will enable /debug/testLogLevels which prints errors and ends with a panic (also enabled if mock-node is used)
-	EnablePprof        = os.Getenv("ENABLE_PPROF") == "1"              // will enable /debug/pprof
+	// Per-priority defaults of RequestTimeout and ProxyRequestTimeout, for requests without their own timeout (0 means the default of all priorities)
+	RequestTimeoutFastTrack      = time.Duration(GetEnvInt("REQUEST_TIMEOUT_FASTTRACK", 0)) * time.Second
+	RequestTimeoutHighPrio       = time.Duration(GetEnvInt("REQUEST_TIMEOUT_HIGHPRIO", 0)) * time.Second
+	RequestTimeoutLowPrio        = time.Duration(GetEnvInt("REQUEST_TIMEOUT_LOWPRIO", 0)) * time.Second
+	ProxyRequestTimeoutFastTrack = time.Duration(GetEnvInt("REQUEST_PROXY_TIMEOUT_FASTTRACK", 0)) * time.Second
+	ProxyRequestTimeoutHighPrio  = time.Duration(GetEnvInt("REQUEST_PROXY_TIMEOUT_HIGHPRIO", 0)) * time.Second
+	ProxyRequestTimeoutLowPrio   = time.Duration(GetEnvInt("REQUEST_PROXY_TIMEOUT_LOWPRIO", 0)) * time.Second
+
+	ProxyRequestTimeoutMax = time.Duration(GetEnvInt("REQUEST_PROXY_TIMEOUT_MAX", 30)) * time.Second // max. proxy timeout which requests can set with the X-Proxy-Timeout-Ms header (0 rejects the header)
+
+	ProxyWatchdogGrace = time.Duration(GetEnvInt("PROXY_WATCHDOG_GRACE_MS", 2000)) * time.Millisecond // a proxy call which didn't return this long after its proxy timeout is force-completed with a timeout, and its worker continues (0 disables the watchdog)
+
+	TLSCertReloadInterval = time.Duration(GetEnvInt("TLS_CERT_RELOAD_INTERVAL_SEC", 10)) * time.Second // How often the TLS certificate files are checked for changes
+
+	ShutdownGracePeriod = time.Duration(GetEnvInt("SHUTDOWN_GRACE_PERIOD_SEC", 30)) * time.Second // on SIGTERM and /admin/shutdown, how long the queued and in-flight requests may drain before the rest is answered with a shutdown error
+	ShutdownExitCode    = GetEnvInt("SHUTDOWN_EXIT_CODE", 0)                                      // exit code of the process after /admin/shutdown
+	ShutdownHardTimeout = time.Duration(GetEnvInt("SHUTDOWN_HARD_TIMEOUT_SEC", 90)) * time.Second // on SIGTERM, exit with code 1 if the shutdown didn't complete after this long (should be longer than the grace period plus the proxy timeout, 0 waits forever)
+
+	NodeStopTimeout = time.Duration(GetEnvInt("NODE_STOP_TIMEOUT_SEC", 30)) * time.Second // how long the shutdown and the removal of a node wait for its workers to finish their current requests
+
+	RedisPrefix        = GetEnv("REDIS_PREFIX", DefaultRedisPrefix) // All redis keys will be prefixed with this. Keys with the default prefix are copied to a new prefix on the first start.
+	EnableErrorTestAPI = GetEnv("ENABLE_ERROR_TEST_API", "") == "1" // will enable /debug/testLogLevels which prints errors and ends with a panic (also enabled if mock-node is used)
+	EnablePprof        = GetEnv("ENABLE_PPROF", "") == "1"          // will enable /debug/pprof
+
+	EnableFaultInjection      = GetEnv("ENABLE_FAULT_INJECTION", "") == "1"                                      // will enable /admin/faults, to inject failures for resilience testing (not for production!)
+	FaultInjectionMaxDuration = time.Duration(GetEnvInt("FAULT_INJECTION_MAX_DURATION_SEC", 3600)) * time.Second // max. duration of an injection, after which it's disabled again
+
+	RedisMaxRetries     = GetEnvInt("REDIS_MAX_RETRIES", 5)                                          // How often failed redis reads/writes of the node and tenant state are retried (i.e. during a sentinel failover)
+	RedisRetryBackoff   = time.Duration(GetEnvInt("REDIS_RETRY_BACKOFF_MS", 200)) * time.Millisecond // Backoff between redis retries, increases linearly with each try
+	RedisReplayInterval = time.Duration(GetEnvInt("REDIS_REPLAY_INTERVAL_SEC", 5)) * time.Second     // While redis is unavailable (degraded mode), how often to try replaying the queued writes
+
+	RedisUsername              = GetEnv("REDIS_USERNAME", "")                        // ACL username for redis (overrides the one of the redis URI)
+	RedisPassword              = GetEnv("REDIS_PASSWORD", "")                        // password for redis (overrides the one of the redis URI)
+	RedisTLS                   = GetEnv("REDIS_TLS", "") == "1"                      // connect to redis with TLS (also enabled by rediss:// URIs and the other REDIS_TLS_* options)
+	RedisTLSCAFile             = GetEnv("REDIS_TLS_CA_FILE", "")                     // CA certificate(s) to verify the redis server (default: system roots)
+	RedisTLSCertFile           = GetEnv("REDIS_TLS_CERT_FILE", "")                   // client certificate for redis, together with REDIS_TLS_KEY_FILE
+	RedisTLSKeyFile            = GetEnv("REDIS_TLS_KEY_FILE", "")                    // client key for redis, together with REDIS_TLS_CERT_FILE
+	RedisTLSInsecureSkipVerify = GetEnv("REDIS_TLS_INSECURE_SKIP_VERIFY", "") == "1" // don't verify the redis server certificate (only for development!)
+
+	RedisDB               = GetEnvInt("REDIS_DB", 0)              // redis database (overrides the one of the redis URI if not 0, not supported by clusters)
+	RedisSentinelPassword = GetEnv("REDIS_SENTINEL_PASSWORD", "") // password for the sentinels (overrides the sentinelPassword of redis-sentinel:// URIs)
+
+	AdminToken    = GetEnv("ADMIN_TOKEN", "")     // bearer token for the admin routes (node management, profiling, events, pprof)
+	AdminUser     = GetEnv("ADMIN_USER", "admin") // basic auth user for the admin routes (if ADMIN_PASSWORD is set)
+	AdminPassword = GetEnv("ADMIN_PASSWORD", "")  // basic auth password for the admin routes. If neither ADMIN_TOKEN nor ADMIN_PASSWORD are set, admin routes are unprotected.
+
+	ResponseSigningKey          = GetEnv("RESPONSE_SIGNING_KEY", "")           // shared secret of the HMAC signature of every sim response (X-Response-Signature). Empty disables signing.
+	ResponseSigningKeySecondary = GetEnv("RESPONSE_SIGNING_KEY_SECONDARY", "") // responses are also signed with this key, for key rotation
+
+	SimAllowCIDRs     = GetEnv("SIM_ALLOW_CIDRS", "")     // comma separated CIDRs which may use the sim endpoint (empty: all)
+	SimDenyCIDRs      = GetEnv("SIM_DENY_CIDRS", "")      // comma separated CIDRs which may not use the sim endpoint (takes precedence over the allowlist)
+	AdminAllowCIDRs   = GetEnv("ADMIN_ALLOW_CIDRS", "")   // comma separated CIDRs which may use the admin routes (empty: all)
+	AdminDenyCIDRs    = GetEnv("ADMIN_DENY_CIDRS", "")    // comma separated CIDRs which may not use the admin routes (takes precedence over the allowlist)
+	TrustedProxyCIDRs = GetEnv("TRUSTED_PROXY_CIDRS", "") // X-Forwarded-For is only used for IP filtering if the request comes from one of these CIDRs
+
+	AccessLogSampling  = ParseAccessLogSampling(GetEnv("ACCESS_LOG_SAMPLING", "")) // per-path access log sampling, i.e. "/=0,/nodes=10" (0: don't log, N: log every N-th request)
+	ProfilerBufferSize = GetEnvInt("PROFILER_BUFFER_SIZE", 10_000)                 // max number of request timings kept in a latency profiling window (/admin/profile)
+	HideNodeURIHeader  = GetEnv("HIDE_NODE_URI_HEADER", "") == "1"                 // don't expose the URI of the node which served the request in the X-Node-URI response header
+
+	ClientStatsMaxClients = GetEnvInt("CLIENT_STATS_MAX_CLIENTS", 1000)                             // max number of clients with usage stats (/stats/clients), the least recently seen are evicted first. 0 disables the stats.
+	ClientStatsWindow     = time.Duration(GetEnvInt("CLIENT_STATS_WINDOW_SEC", 3600)) * time.Second // sliding window of the per-client usage stats
+
+	AuditTTL        = time.Duration(GetEnvInt("AUDIT_TTL_SEC", 0)) * time.Second // how long audit records of completed requests are kept in redis (/audit/{id}). 0 disables audit records.
+	AuditBufferSize = GetEnvInt("AUDIT_BUFFER_SIZE", 1000)                       // number of audit records buffered for writing, further records are dropped
+
+	RecordFile        = GetEnv("RECORD_FILE", "")                  // append the submitted requests to this file (newline-delimited JSON), to replay them with `-replay`. Empty disables recording to a file.
+	RecordRedis       = GetEnv("RECORD_REDIS", "") == "1"          // append the submitted requests to a redis stream (prio-load-balancer:recording)
+	RecordRedisMaxLen = GetEnvInt("RECORD_REDIS_MAX_LEN", 100_000) // the redis stream is capped at about this many requests
+	RecordBufferSize  = GetEnvInt("RECORD_BUFFER_SIZE", 1000)      // number of recorded requests buffered for writing, further requests are dropped
+
+	QueueWaitBuckets = ParseQueueWaitBuckets(GetEnv("QUEUE_WAIT_BUCKETS_MS", "")) // upper bounds of the queue wait time histogram buckets (/stats/queue), comma separated in ms, i.e. "10,100,1000". Default: DefaultQueueWaitBuckets
+
+	PayloadSizeClasses  = ParsePayloadSizeClasses(GetEnv("PAYLOAD_SIZE_CLASSES_KB", "")) // max sizes of small and medium payloads in KB, larger ones are large (/stats/payloads), i.e. "16,256". Default: DefaultPayloadSizeClasses
+	ProxyLatencyBuckets = ParseQueueWaitBuckets(GetEnv("PROXY_LATENCY_BUCKETS_MS", ""))  // upper bounds of the proxy latency histogram buckets by size class (/stats/payloads), comma separated in ms. Default: DefaultQueueWaitBuckets
+
+	TracingEnabled = GetEnv("TRACING_ENABLED", "") == "1" // export OpenTelemetry traces of the sim requests with OTLP over HTTP, configured with the OTEL_EXPORTER_OTLP_* env vars
+
+	PayloadLogSampling    = ParsePayloadLogSampling(GetEnv("PAYLOAD_LOG_SAMPLING", "")) // log the request and response payloads of 1 in N requests (by request ID) and/or all failed requests, i.e. "100,errors". Empty disables payload logging.
+	PayloadLogMaxBytes    = GetEnvInt("PAYLOAD_LOG_MAX_BYTES", 2048)                    // logged payloads are truncated to this size (after redaction). 0 means no limit.
+	PayloadLogRedactPaths = GetEnv("PAYLOAD_LOG_REDACT_PATHS", "")                      // comma separated JSON paths whose values are redacted in logged payloads, i.e. "params.0.signature,*.params" ("*" matches any key or index)
+	PayloadLogRedactRegex = GetEnv("PAYLOAD_LOG_REDACT_REGEX", "")                      // matches of this regex are redacted in logged payloads (after the JSON paths)
+
+	NodeHealthCheckPayload     = GetEnv("NODE_HEALTHCHECK_PAYLOAD", `{"jsonrpc":"2.0","method":"net_version","params":[],"id":123}`) // health check probe, posted to the node
+	NodeHealthCheckContentType = GetEnv("NODE_HEALTHCHECK_CONTENT_TYPE", "application/json")                                         // Content-Type of the health check probe
+	NodeHealthCheckMethod      = GetEnv("NODE_HEALTHCHECK_METHOD", "")                                                               // if set, the probe is a JSON-RPC request of this method (instead of NODE_HEALTHCHECK_PAYLOAD), per node with the `_healthcheck_method` URI query param
+	NodeHealthCheckParams      = GetEnv("NODE_HEALTHCHECK_PARAMS", "[]")                                                             // JSON params of the NODE_HEALTHCHECK_METHOD probe (`_healthcheck_params`)
+	NodeHealthCheckID          = GetEnv("NODE_HEALTHCHECK_ID", "123")                                                                // JSON id of the NODE_HEALTHCHECK_METHOD probe (`_healthcheck_id`)
+	NodeHealthCheckSuccess     = GetEnv("NODE_HEALTHCHECK_SUCCESS", HealthCheckSuccessResult)                                        // "result": a node is healthy if it answers the probe with a success status code and a JSON-RPC 2.0 response with the id of the probe, a result and no error, "status": only with a success status code (`_healthcheck_success`)
+	NodeHealthCheckResultRegex = GetEnv("NODE_HEALTHCHECK_RESULT_REGEX", "")                                                         // if set, the JSON-RPC result of the probe must match this regex (strings without their quotes, `_healthcheck_result_regex`)
+	NodeHealthCheckPath        = GetEnv("NODE_HEALTHCHECK_PATH", "")                                                                 // if set, health checks are a GET request to this path of the node (i.e. "/health") instead of posting the probe payload
+	NodeHealthCheckErrorCodes  = GetEnv("NODE_HEALTHCHECK_ERROR_CODES", "")                                                          // if set, only JSON-RPC errors with these comma separated codes (i.e. "-32601") fail the check, instead of all errors (`_healthcheck_error_codes`)
+	NodeHealthCheckMaxBlockAge = time.Duration(GetEnvInt("NODE_HEALTHCHECK_MAX_BLOCK_AGE_SEC", 0)) * time.Second                     // if set, the result of the probe (i.e. of eth_blockNumber) is a block number which must advance within this time (`_healthcheck_max_block_age_sec`, 0 disables)
+	NodeHealthCheckStopWorkers = GetEnv("NODE_HEALTHCHECK_STOP_WORKERS", "1") == "1"                                                 // stop the workers of nodes which fail a health check, until they pass one again ("0" keeps them taking requests)
+
+	NodeHealthCheckInterval = time.Duration(GetEnvInt("NODE_HEALTHCHECK_INTERVAL_SEC", 10)) * time.Second // how often all nodes are health checked (0 disables)
+	NodePrewarmConns        = GetEnvInt("NODE_PREWARM_CONNS", 0)                                          // idle connections which are established to every node when it's added (or becomes healthy) with health check probes, per node with the `_prewarm=N` URI query param (0 disables)
+	NodePrewarmInterval     = time.Duration(GetEnvInt("NODE_PREWARM_INTERVAL_SEC", 30)) * time.Second     // while a node had no requests for this long, its pre-warmed connections are kept alive with probes. Must be below the idle timeout of the nodes and ProxyIdleConnTimeout.
+
+	// Adaptive node workers: after every NODE_ADAPTIVE_WINDOW proxied requests of a node, halve its active workers at NODE_ADAPTIVE_DECREASE_ERROR_RATE (down to 1), and add one back below NODE_ADAPTIVE_INCREASE_ERROR_RATE
+	NodeAdaptiveWorkers           = GetEnv("NODE_ADAPTIVE_WORKERS", "") == "1"
+	NodeAdaptiveWindow            = GetEnvInt("NODE_ADAPTIVE_WINDOW", 20)
+	NodeAdaptiveDecreaseErrorRate = GetEnvFloat("NODE_ADAPTIVE_DECREASE_ERROR_RATE", 0.5)
+	NodeAdaptiveIncreaseErrorRate = GetEnvFloat("NODE_ADAPTIVE_INCREASE_ERROR_RATE", 0.1)
+
+	NodeBreakerThreshold = GetEnvInt("NODE_BREAKER_THRESHOLD", 0)                                        // circuit breaker: consecutive failed proxy requests after which the workers of a node pause, per node with the `_breaker=N` URI query param (0 disables)
+	NodeBreakerCoolDown  = time.Duration(GetEnvInt("NODE_BREAKER_COOLDOWN_MS", 5000)) * time.Millisecond // circuit breaker: how long the workers pause before a single probe request is let through, per node with `_breaker_cooldown_ms=N`
+
+	// TLS of the connections to the nodes (https:// and wss:// URIs), per node with the `_tls_cert`, `_tls_key`, `_tls_ca` and `_tls_server_name` URI query params
+	NodeTLSCertFile   = GetEnv("NODE_TLS_CERT_FILE", "")   // client certificate for mutual TLS, together with NODE_TLS_KEY_FILE (reloaded when the files changed, and on SIGHUP)
+	NodeTLSKeyFile    = GetEnv("NODE_TLS_KEY_FILE", "")    // client key for mutual TLS, together with NODE_TLS_CERT_FILE
+	NodeTLSCAFile     = GetEnv("NODE_TLS_CA_FILE", "")     // CA certificate(s) to verify the nodes (default: system roots)
+	NodeTLSServerName = GetEnv("NODE_TLS_SERVER_NAME", "") // the name the node certificates are verified against, i.e. for nodes addressed by IP
+
+	NodeGzipMinBytes = GetEnvInt("NODE_GZIP_MIN_BYTES", 0) // payloads at least this large are sent gzip compressed to HTTP nodes (`Content-Encoding: gzip`), per node with the `_gzip_min_bytes=N` URI query param (0 disables). Gzip compressed responses are always accepted.
+
+	EventsQueueThreshold = GetEnvInt("EVENTS_QUEUE_THRESHOLD", 100)                               // /events: number of queued requests which triggers a queue_threshold event (0 disables)
+	EventsStatsInterval  = time.Duration(GetEnvInt("EVENTS_STATS_INTERVAL_SEC", 5)) * time.Second // /events: how often a stats snapshot is sent (0 disables)
+	EventsBufferSize     = GetEnvInt("EVENTS_BUFFER_SIZE", 100)                                   // /events: number of events buffered per connection, further events are dropped for slow consumers
+
+	ShedHighPrioDepth  = GetEnvInt("SHED_HIGHPRIO_DEPTH", 0)                                        // load shedding: reject new low-prio requests while at least this many fast-track and high-prio requests are queued (0 disables)
+	ShedHighPrioAge    = time.Duration(GetEnvInt("SHED_HIGHPRIO_AGE_MS", 0)) * time.Millisecond     // load shedding: reject new low-prio requests while the oldest queued fast-track or high-prio request waited this long (0 disables)
+	ShedResumeFraction = GetEnvFloat("SHED_RESUME_FRACTION", 0.5)                                   // load shedding stops once the high-prio backlog dropped below this fraction of the thresholds
+	ShedFlushLowPrio   = GetEnv("SHED_FLUSH_LOWPRIO", "") == "1"                                    // when load shedding starts, also fail the queued low-prio requests
+	ShedCheckInterval  = time.Duration(GetEnvInt("SHED_CHECK_INTERVAL_MS", 100)) * time.Millisecond // how often the high-prio backlog is checked, besides on every low-prio request
+
+	RetryBudgetRatio     = GetEnvFloat("RETRY_BUDGET_RATIO", 0)        // retries of failed requests may be at most this fraction of the requests (i.e. 0.2), 0 disables the retry budget
+	RetryBudgetMinPerSec = GetEnvFloat("RETRY_BUDGET_MIN_PER_SEC", 1)  // retries per second which are allowed regardless of the ratio, for low request rates
+	RetryBudgetBurst     = GetEnvFloat("RETRY_BUDGET_BURST", 10)       // max. number of unused retries which are saved up
+	RetryRouting         = GetEnv("RETRY_ROUTING", RetryRoutingPrefer) // whether retries are passed on by the nodes which failed them already: off, prefer (a few times) or strict (as long as another healthy node exists)
+
+	RetryBackoff    = time.Duration(GetEnvInt("RETRY_BACKOFF_MS", 0)) * time.Millisecond        // delay before the first retry of a failed request, doubled with every further retry (0 disables)
+	RetryBackoffMax = time.Duration(GetEnvInt("RETRY_BACKOFF_MAX_MS", 1000)) * time.Millisecond // the max. retry backoff
+
+	NodeSelection = GetEnv("NODE_SELECTION", NodeSelectionLeastLoaded) // how requests are handed to the nodes: least-loaded (to the node with a free worker and the lowest in-flight/capacity ratio) or shared (the workers of all nodes take them from a shared channel)
+
+	DuplicateMaxSubmissions  = GetEnvInt("DUPLICATE_MAX_SUBMISSIONS", 0)                          // a client may submit a byte-identical payload at most this many times within DUPLICATE_WINDOW_SEC, the extras are rejected (0 disables)
+	DuplicateWindow          = time.Duration(GetEnvInt("DUPLICATE_WINDOW_SEC", 10)) * time.Second // sliding window of DUPLICATE_MAX_SUBMISSIONS
+	DuplicateMaxEntries      = GetEnvInt("DUPLICATE_MAX_ENTRIES", 100_000)                        // max. number of tracked (client, payload) pairs, the least recently submitted ones are evicted first
+	DuplicateExemptFastTrack = GetEnv("DUPLICATE_EXEMPT_FASTTRACK", "") == "1"                    // fast-track requests are not checked for duplicates
+
+	CoalesceRequests = GetEnv("COALESCE_REQUESTS", "") == "1" // a request with the same tenant, Content-Type and payload as a queued or in-flight one gets its response instead of a node call of its own
+
+	ClientMaxQueued          = GetEnvInt("CLIENT_MAX_QUEUED", 0)           // max. requests a client (tenant or X-Client-ID) may have queued or in flight, 0 means no limit
+	ClientMaxQueuedFastTrack = GetEnvInt("CLIENT_MAX_QUEUED_FASTTRACK", 0) // the same, only for fast-track requests
+	ClientMaxQueuedHighPrio  = GetEnvInt("CLIENT_MAX_QUEUED_HIGHPRIO", 0)  // the same, only for high-prio requests
+	ClientMaxQueuedLowPrio   = GetEnvInt("CLIENT_MAX_QUEUED_LOWPRIO", 0)   // the same, only for low-prio requests
+
+	AsyncMaxResults = GetEnvInt("ASYNC_MAX_RESULTS", 10_000)                             // max. async requests (POST /sim?async=1) which are pending or whose result wasn't fetched yet, more are rejected (0 disables the async mode)
+	AsyncResultTTL  = time.Duration(GetEnvInt("ASYNC_RESULT_TTL_SEC", 60)) * time.Second // how long the result of an async request is kept for GET /sim/{id}
+
+	QueuePersistenceRedisURI   = GetEnv("QUEUE_PERSISTENCE_REDIS_URI", "")          // persist the queued async and callback requests to this redis, and queue them again on startup (empty disables the persistence)
+	QueuePersistenceBufferSize = GetEnvInt("QUEUE_PERSISTENCE_BUFFER_SIZE", 10_000) // number of persistence writes buffered for the background writer, further writes are dropped
+
+	CallbackWorkers      = GetEnvInt("CALLBACK_WORKERS", 0)                                              // number of workers which POST the results of requests with a callback_url, 0 disables callbacks
+	CallbackQueueSize    = GetEnvInt("CALLBACK_QUEUE_SIZE", 1000)                                        // max. callbacks waiting for a worker, further callbacks are dropped
+	CallbackMaxTries     = GetEnvInt("CALLBACK_MAX_TRIES", 3)                                            // callbacks which failed with a connection error or a 5xx are retried up to this many tries
+	CallbackRetryBackoff = time.Duration(GetEnvInt("CALLBACK_RETRY_BACKOFF_MS", 500)) * time.Millisecond // delay before the first retry of a callback, doubled with every further retry
+	CallbackTimeout      = time.Duration(GetEnvInt("CALLBACK_TIMEOUT_MS", 5000)) * time.Millisecond      // timeout of a callback try
+	CallbackAllowedHosts = GetEnv("CALLBACK_ALLOWED_HOSTS", "")                                          // comma separated hosts which callback URLs may have (empty allows any)
+
+	StatsLogInterval = time.Duration(GetEnvInt("STATS_LOG_INTERVAL_SEC", 0)) * time.Second // how often a one-line summary of the queue, request rates and nodes is logged (0 disables)
+
+	MetricsStatsDAddr           = GetEnv("METRICS_STATSD_ADDR", "")                                           // push metrics to this DogStatsD agent, "host:port" (UDP) or "unix:///path/to/dsd.socket". Empty disables DogStatsD.
+	MetricsStatsDPrefix         = GetEnv("METRICS_STATSD_PREFIX", "prio_load_balancer.")                      // prefix of the DogStatsD metric names
+	MetricsStatsDTags           = GetEnv("METRICS_STATSD_TAGS", "")                                           // comma separated tags of all DogStatsD metrics, i.e. "env:prod,service:prio-lb"
+	MetricsStatsDSampleRate     = GetEnvFloat("METRICS_STATSD_SAMPLE_RATE", 1)                                // fraction of the DogStatsD counts and timings which are sent (gauges are always sent), for high request rates
+	MetricsStatsDMaxPacketBytes = GetEnvInt("METRICS_STATSD_MAX_PACKET_BYTES", 0)                             // DogStatsD metrics are buffered into datagrams of at most this size (default: 1432 for UDP, 8192 for UDS)
+	MetricsStatsDFlushInterval  = time.Duration(GetEnvInt("METRICS_STATSD_FLUSH_MS", 100)) * time.Millisecond // how often the buffered DogStatsD metrics are sent
+	MetricsGaugeInterval        = time.Duration(GetEnvInt("METRICS_GAUGE_INTERVAL_SEC", 10)) * time.Second    // how often the queue and node gauges are sent to the metrics sinks (0 disables)
+	MetricsPrometheus           = GetEnv("METRICS_PROMETHEUS", "") == "1"                                     // serve Prometheus metrics on /metrics (an admin route), with the sim duration buckets of PROXY_LATENCY_BUCKETS_MS
 
 	ProxyMaxIdleConns        = GetEnvInt("ProxyMaxIdleConns", 100)
 	ProxyMaxConnsPerHost     = GetEnvInt("ProxyMaxConnsPerHost", 100)
@@ -36,19 +251,169 @@ var (
 
 func LogConfig(log *zap.SugaredLogger) {
 	log.Infow("config",
+		"ConfigFile", ConfigFile,
 		"JobChannelBuffer", JobChannelBuffer,
 		"RequestMaxTries", RequestMaxTries,
 		"MaxQueueItemsHighPrio", MaxQueueItemsHighPrio,
 		"MaxQueueItemsLowPrio", MaxQueueItemsLowPrio,
 		"FastTrackPerHighPrio", FastTrackPerHighPrio,
+		"HighPrioWeight", HighPrioWeight,
 		"FastTrackDrainFirst", FastTrackDrainFirst,
+		"MultiTenancy", TenantsConfig != "",
+		"TenantPriorityCapReject", TenantPriorityCapReject,
+		"LowPrioEveryN", LowPrioEveryN,
+		"PriorityLevels", PriorityLevels,
+		"LowPrioSchedule", LowPrioSchedule,
+		"LowPrioScheduleTimezone", LowPrioScheduleTimezone,
+		"PromoteLowPrioAfter", PromoteLowPrioAfter,
+		"PromoteHighPrioAfter", PromoteHighPrioAfter,
+		"ReservationSyncInterval", ReservationSyncInterval,
+		"Peers", Peers,
+		"PeerMaxHops", PeerMaxHops,
+		"PeerStatusCacheTTL", PeerStatusCacheTTL,
+		"PeerForwardTimeout", PeerForwardTimeout,
+		"DryRunEnabled", DryRunAPIKeys != "",
+		"DryRunMaxConcurrent", DryRunMaxConcurrent,
+		"SmallestFirstFastTrack", SmallestFirstFastTrack,
+		"SmallestFirstHighPrio", SmallestFirstHighPrio,
+		"SmallestFirstLowPrio", SmallestFirstLowPrio,
+		"SmallestFirstMaxSkips", SmallestFirstMaxSkips,
+		"SmallestFirstMaxWait", SmallestFirstMaxWait,
+		"PriorityRules", PriorityRulesConfig,
 		"PayloadMaxBytes", PayloadMaxBytes,
+		"NodeResponseMaxBytes", NodeResponseMaxBytes,
+		"PayloadSpoolThreshold", PayloadSpoolThreshold,
+		"PayloadSpoolDir", PayloadSpoolDir,
+		"ResponseGzipMinBytes", ResponseGzipMinBytes,
+		"StreamResponses", StreamResponses,
+		"ResponseValidation", ResponseValidation,
+		"ReverseProxyPath", ReverseProxyPath,
+		"ReverseProxyHeaders", ReverseProxyHeaders,
+		"ValidateJSONRPC", ValidateJSONRPC,
+		"JSONRPCAllowedMethods", JSONRPCAllowedMethods,
+		"SplitJSONRPCBatches", SplitJSONRPCBatches,
+		"SimsMaxBatchSize", SimsMaxBatchSize,
+		"PassthroughMode", PassthroughMode,
 		"RequestTimeout", RequestTimeout,
 		"ServerJobSendTimeout", ServerJobSendTimeout,
 		"ProxyRequestTimeout", ProxyRequestTimeout,
+		"RequestTimeoutFastTrack", RequestTimeoutFastTrack,
+		"RequestTimeoutHighPrio", RequestTimeoutHighPrio,
+		"RequestTimeoutLowPrio", RequestTimeoutLowPrio,
+		"ProxyRequestTimeoutFastTrack", ProxyRequestTimeoutFastTrack,
+		"ProxyRequestTimeoutHighPrio", ProxyRequestTimeoutHighPrio,
+		"ProxyRequestTimeoutLowPrio", ProxyRequestTimeoutLowPrio,
+		"ProxyRequestTimeoutMax", ProxyRequestTimeoutMax,
+		"ProxyWatchdogGrace", ProxyWatchdogGrace,
+		"TLSCertReloadInterval", TLSCertReloadInterval,
+		"ShutdownGracePeriod", ShutdownGracePeriod,
+		"ShutdownExitCode", ShutdownExitCode,
+		"ShutdownHardTimeout", ShutdownHardTimeout,
+		"NodeStopTimeout", NodeStopTimeout,
 		"RedisPrefix", RedisPrefix,
+		"RedisMaxRetries", RedisMaxRetries,
+		"RedisRetryBackoff", RedisRetryBackoff,
+		"RedisReplayInterval", RedisReplayInterval,
+		"RedisUsername", RedisUsername,
+		"RedisTLS", RedisTLS,
+		"RedisDB", RedisDB,
+		"RedisTLSCAFile", RedisTLSCAFile,
+		"RedisTLSCertFile", RedisTLSCertFile,
+		"RedisTLSInsecureSkipVerify", RedisTLSInsecureSkipVerify,
 		"EnableErrorTestAPI", EnableErrorTestAPI,
 		"EnablePprof", EnablePprof,
+		"EnableFaultInjection", EnableFaultInjection,
+		"FaultInjectionMaxDuration", FaultInjectionMaxDuration,
+		"AdminAuthEnabled", AdminAuthEnabled(),
+		"ResponseSigning", ResponseSigningKey != "" || ResponseSigningKeySecondary != "",
+		"SimAllowCIDRs", SimAllowCIDRs,
+		"SimDenyCIDRs", SimDenyCIDRs,
+		"AdminAllowCIDRs", AdminAllowCIDRs,
+		"AdminDenyCIDRs", AdminDenyCIDRs,
+		"TrustedProxyCIDRs", TrustedProxyCIDRs,
+		"AccessLogSampling", AccessLogSampling,
+		"ProfilerBufferSize", ProfilerBufferSize,
+		"HideNodeURIHeader", HideNodeURIHeader,
+		"ClientStatsMaxClients", ClientStatsMaxClients,
+		"ClientStatsWindow", ClientStatsWindow,
+		"AuditTTL", AuditTTL,
+		"AuditBufferSize", AuditBufferSize,
+		"RecordFile", RecordFile,
+		"RecordRedis", RecordRedis,
+		"RecordRedisMaxLen", RecordRedisMaxLen,
+		"RecordBufferSize", RecordBufferSize,
+		"QueueWaitBuckets", QueueWaitBuckets,
+		"StatsLogInterval", StatsLogInterval,
+		"ShedHighPrioDepth", ShedHighPrioDepth,
+		"ShedHighPrioAge", ShedHighPrioAge,
+		"ShedResumeFraction", ShedResumeFraction,
+		"ShedFlushLowPrio", ShedFlushLowPrio,
+		"ShedCheckInterval", ShedCheckInterval,
+		"RetryBudgetRatio", RetryBudgetRatio,
+		"RetryBudgetMinPerSec", RetryBudgetMinPerSec,
+		"RetryBudgetBurst", RetryBudgetBurst,
+		"RetryRouting", RetryRouting,
+		"RetryBackoff", RetryBackoff,
+		"RetryBackoffMax", RetryBackoffMax,
+		"NodeSelection", NodeSelection,
+		"DuplicateMaxSubmissions", DuplicateMaxSubmissions,
+		"DuplicateWindow", DuplicateWindow,
+		"DuplicateMaxEntries", DuplicateMaxEntries,
+		"DuplicateExemptFastTrack", DuplicateExemptFastTrack,
+		"CoalesceRequests", CoalesceRequests,
+		"ClientMaxQueued", ClientMaxQueued,
+		"ClientMaxQueuedFastTrack", ClientMaxQueuedFastTrack,
+		"ClientMaxQueuedHighPrio", ClientMaxQueuedHighPrio,
+		"ClientMaxQueuedLowPrio", ClientMaxQueuedLowPrio,
+		"AsyncMaxResults", AsyncMaxResults,
+		"AsyncResultTTL", AsyncResultTTL,
+		"QueuePersistenceRedisURI", RedactRedisURI(QueuePersistenceRedisURI),
+		"QueuePersistenceBufferSize", QueuePersistenceBufferSize,
+		"CallbackWorkers", CallbackWorkers,
+		"CallbackQueueSize", CallbackQueueSize,
+		"CallbackMaxTries", CallbackMaxTries,
+		"CallbackRetryBackoff", CallbackRetryBackoff,
+		"CallbackTimeout", CallbackTimeout,
+		"CallbackAllowedHosts", CallbackAllowedHosts,
+		"MetricsStatsDAddr", MetricsStatsDAddr,
+		"MetricsStatsDPrefix", MetricsStatsDPrefix,
+		"MetricsStatsDTags", MetricsStatsDTags,
+		"MetricsStatsDSampleRate", MetricsStatsDSampleRate,
+		"MetricsStatsDMaxPacketBytes", MetricsStatsDMaxPacketBytes,
+		"MetricsStatsDFlushInterval", MetricsStatsDFlushInterval,
+		"MetricsGaugeInterval", MetricsGaugeInterval,
+		"MetricsPrometheus", MetricsPrometheus,
+		"PayloadSizeClasses", PayloadSizeClasses,
+		"ProxyLatencyBuckets", ProxyLatencyBuckets,
+		"TracingEnabled", TracingEnabled,
+		"PayloadLogSampling", PayloadLogSampling,
+		"PayloadLogMaxBytes", PayloadLogMaxBytes,
+		"PayloadLogRedactPaths", PayloadLogRedactPaths,
+		"PayloadLogRedactRegex", PayloadLogRedactRegex,
+		"NodeHealthCheckErrorCodes", NodeHealthCheckErrorCodes,
+		"NodeHealthCheckMaxBlockAge", NodeHealthCheckMaxBlockAge,
+		"NodeHealthCheckInterval", NodeHealthCheckInterval,
+		"NodeHealthCheckStopWorkers", NodeHealthCheckStopWorkers,
+		"NodePrewarmConns", NodePrewarmConns,
+		"NodePrewarmInterval", NodePrewarmInterval,
+		"NodeAdaptiveWorkers", NodeAdaptiveWorkers,
+		"NodeAdaptiveWindow", NodeAdaptiveWindow,
+		"NodeAdaptiveDecreaseErrorRate", NodeAdaptiveDecreaseErrorRate,
+		"NodeAdaptiveIncreaseErrorRate", NodeAdaptiveIncreaseErrorRate,
+		"NodeBreakerThreshold", NodeBreakerThreshold,
+		"NodeBreakerCoolDown", NodeBreakerCoolDown,
+		"NodeTLSCertFile", NodeTLSCertFile,
+		"NodeTLSCAFile", NodeTLSCAFile,
+		"NodeTLSServerName", NodeTLSServerName,
+		"NodeGzipMinBytes", NodeGzipMinBytes,
+		"NodeHealthCheckPath", NodeHealthCheckPath,
+		"NodeHealthCheckMethod", NodeHealthCheckMethod,
+		"NodeHealthCheckSuccess", NodeHealthCheckSuccess,
+		"NodeHealthCheckResultRegex", NodeHealthCheckResultRegex,
+		"NodeHealthCheckContentType", NodeHealthCheckContentType,
+		"EventsQueueThreshold", EventsQueueThreshold,
+		"EventsStatsInterval", EventsStatsInterval,
+		"EventsBufferSize", EventsBufferSize,
 		"ProxyMaxIdleConns", ProxyMaxIdleConns,
 		"ProxyMaxConnsPerHost", ProxyMaxConnsPerHost,
 		"ProxyMaxIdleConnsPerHost", ProxyMaxIdleConnsPerHost,
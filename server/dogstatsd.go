@@ -0,0 +1,181 @@
+package server
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dogStatsDMaxPacketBytesUDP = 1432 // fits into an ethernet frame
+	dogStatsDMaxPacketBytesUDS = 8192
+	dogStatsDFlushInterval     = 100 * time.Millisecond
+)
+
+// DogStatsDOpts configures the DogStatsD sink
+type DogStatsDOpts struct {
+	Prefix         string        // prefix of the metric names, i.e. "prio_load_balancer."
+	Tags           []string      // tags of all metrics, i.e. "env:prod"
+	SampleRate     float64       // fraction of the counts and timings which are sent (0 or 1: all of them). Gauges are always sent.
+	MaxPacketBytes int           // metrics are buffered into datagrams of at most this size (default: 1432 for UDP, 8192 for UDS)
+	FlushInterval  time.Duration // how often the buffered metrics are sent (default: 100ms)
+}
+
+// DogStatsD is a MetricsSink which pushes the metrics to a DogStatsD agent (i.e. the Datadog agent), over UDP or a
+// unix domain socket. Metrics are buffered, and sent every FlushInterval or when a datagram is full.
+type DogStatsD struct {
+	opts     DogStatsDOpts
+	conn     net.Conn
+	tags     string // the common tags, formatted
+	stopC    chan struct{}
+	stopOnce sync.Once
+	doneC    chan struct{}
+
+	lock sync.Mutex
+	buf  []byte
+	rand *rand.Rand
+}
+
+// NewDogStatsD connects to the DogStatsD agent at addr: "host:port" for UDP, or "unix:///path/to/dsd.socket" for a
+// unix domain socket. Close flushes the buffered metrics.
+func NewDogStatsD(addr string, opts DogStatsDOpts) (*DogStatsD, error) {
+	network, maxPacketBytes := "udp", dogStatsDMaxPacketBytesUDP
+	if path, isUDS := strings.CutPrefix(addr, "unix://"); isUDS {
+		addr, network, maxPacketBytes = path, "unixgram", dogStatsDMaxPacketBytesUDS
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MaxPacketBytes <= 0 {
+		opts.MaxPacketBytes = maxPacketBytes
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = dogStatsDFlushInterval
+	}
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	d := &DogStatsD{
+		opts:  opts,
+		conn:  conn,
+		tags:  formatDogStatsDTags(opts.Tags),
+		stopC: make(chan struct{}),
+		doneC: make(chan struct{}),
+		buf:   make([]byte, 0, opts.MaxPacketBytes),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+	}
+	go d.flushLoop()
+	return d, nil
+}
+
+func (d *DogStatsD) Count(name string, value int64, tags ...string) {
+	d.send(name, strconv.FormatInt(value, 10), "c", true, tags)
+}
+
+func (d *DogStatsD) Gauge(name string, value float64, tags ...string) {
+	d.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", false, tags)
+}
+
+func (d *DogStatsD) Timing(name string, value time.Duration, tags ...string) {
+	d.send(name, strconv.FormatFloat(float64(value)/float64(time.Millisecond), 'f', -1, 64), "ms", true, tags)
+}
+
+// send adds the metric to the buffer, if it's sampled
+func (d *DogStatsD) send(name, value, metricType string, sampled bool, tags []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sampled = sampled && d.opts.SampleRate < 1
+	if sampled && d.rand.Float64() >= d.opts.SampleRate {
+		return
+	}
+
+	// i.e. "prio_load_balancer.requests:1|c|@0.5|#env:prod,priority:high-prio"
+	var line strings.Builder
+	line.WriteString(d.opts.Prefix)
+	line.WriteString(name)
+	line.WriteString(":")
+	line.WriteString(value)
+	line.WriteString("|")
+	line.WriteString(metricType)
+	if sampled {
+		line.WriteString("|@")
+		line.WriteString(strconv.FormatFloat(d.opts.SampleRate, 'f', -1, 64))
+	}
+	if tags := joinDogStatsDTags(d.tags, formatDogStatsDTags(tags)); tags != "" {
+		line.WriteString("|#")
+		line.WriteString(tags)
+	}
+
+	if len(d.buf) > 0 && len(d.buf)+1+line.Len() > d.opts.MaxPacketBytes {
+		d._flush()
+	}
+	if len(d.buf) > 0 {
+		d.buf = append(d.buf, '\n')
+	}
+	d.buf = append(d.buf, line.String()...)
+}
+
+// Flush sends the buffered metrics
+func (d *DogStatsD) Flush() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d._flush()
+}
+
+// _flush sends the buffer as one datagram. Errors are ignored: the agent may not be running, and metrics are best
+// effort anyway.
+func (d *DogStatsD) _flush() {
+	if len(d.buf) == 0 {
+		return
+	}
+	_, _ = d.conn.Write(d.buf)
+	d.buf = d.buf[:0]
+}
+
+func (d *DogStatsD) flushLoop() {
+	defer close(d.doneC)
+	ticker := time.NewTicker(d.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopC:
+			return
+		case <-ticker.C:
+			d.Flush()
+		}
+	}
+}
+
+// Close flushes the buffered metrics and closes the connection
+func (d *DogStatsD) Close() error {
+	d.stopOnce.Do(func() { close(d.stopC) })
+	<-d.doneC
+	d.Flush()
+	return d.conn.Close()
+}
+
+// formatDogStatsDTags joins the tags, replacing the characters which are not allowed in tags
+func formatDogStatsDTags(tags []string) string {
+	sanitized := make([]string, len(tags))
+	for i, tag := range tags {
+		sanitized[i] = strings.Map(func(r rune) rune {
+			if r == ',' || r == '|' || r == '#' || r == '\n' {
+				return '_'
+			}
+			return r
+		}, tag)
+	}
+	return strings.Join(sanitized, ",")
+}
+
+func joinDogStatsDTags(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "," + b
+}
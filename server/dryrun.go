@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+// DryRunStats are the counters of the dry runs, separate from the request and node stats (/stats/dryrun)
+type DryRunStats struct {
+	MaxConcurrent int   `json:"maxConcurrent"`
+	NumInFlight   int   `json:"numInFlight"`
+	NumRequests   int64 `json:"numRequests"` // proxied to a node
+	NumSuccess    int64 `json:"numSuccess"`
+	NumFailed     int64 `json:"numFailed"`
+	NumRejected   int64 `json:"numRejected"` // over the concurrency limit, or without a node
+}
+
+// DryRunner validates payloads end-to-end (i.e. of a new client integration) against a canary node (with the
+// `_canary=1` URI query param) or a node selected by its `_label` query param, bypassing the queue. The dry runs have
+// their own concurrency limit and counters, and are not part of the request and node stats, metrics and health.
+type DryRunner struct {
+	apiKeys []string
+	slots   chan struct{}
+
+	numRequests atomic.Int64
+	numSuccess  atomic.Int64
+	numFailed   atomic.Int64
+	numRejected atomic.Int64
+}
+
+func NewDryRunner(apiKeys []string, maxConcurrent int) *DryRunner {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &DryRunner{apiKeys: apiKeys, slots: make(chan struct{}, maxConcurrent)}
+}
+
+// authorized returns http.StatusOK if the API key is allowed to do dry runs, http.StatusUnauthorized without key, and
+// http.StatusForbidden for other keys
+func (d *DryRunner) authorized(apiKey string) int {
+	if apiKey == "" {
+		return http.StatusUnauthorized
+	}
+	for _, key := range d.apiKeys {
+		if secretEqual(apiKey, key) {
+			return http.StatusOK
+		}
+	}
+	return http.StatusForbidden
+}
+
+// acquire takes one of the concurrency slots, without waiting (false if all are taken)
+func (d *DryRunner) acquire() bool {
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *DryRunner) release() {
+	<-d.slots
+}
+
+func (d *DryRunner) Stats() DryRunStats {
+	return DryRunStats{
+		MaxConcurrent: cap(d.slots),
+		NumInFlight:   len(d.slots),
+		NumRequests:   d.numRequests.Load(),
+		NumSuccess:    d.numSuccess.Load(),
+		NumFailed:     d.numFailed.Load(),
+		NumRejected:   d.numRejected.Load(),
+	}
+}
+
+// label returns the `_label` query param of the node URI
+func (n *Node) label() string {
+	return n.healthQuery.Get("_label")
+}
+
+// isCanary returns whether the node URI has the `_canary=1` query param
+func (n *Node) isCanary() bool {
+	return n.healthQuery.Get("_canary") == "1"
+}
+
+// dryRunNode returns the first healthy node with the label, or the first healthy canary node without label (nil if
+// there is none)
+func (gp *NodePool) dryRunNode(label string) *Node {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+	for _, node := range gp.nodes {
+		if !node.IsHealthy() {
+			continue
+		} else if label != "" && node.label() == label || label == "" && node.isCanary() {
+			return node
+		}
+	}
+	return nil
+}
+
+// EnableDryRuns enables POST /sim/dryrun, see DryRunner
+func (s *Webserver) EnableDryRuns(dryRuns *DryRunner) {
+	s.dryRuns = dryRuns
+}
+
+// HandleDryRunRequest proxies the payload to the canary node (or the node with the label of the `node` query param)
+// directly, and returns its response with the `X-Dry-Run` header. Requires the `X-API-Key` header with one of the
+// DRYRUN_API_KEYS.
+func (s *Webserver) HandleDryRunRequest(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if s.dryRuns == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "dry runs are not enabled")
+		return
+	}
+	reqID := ensureRequestID(w, req)
+	log := s.log.With("reqID", reqID, "dryRun", true)
+	w.Header().Set("X-Dry-Run", "true")
+
+	switch s.dryRuns.authorized(req.Header.Get("X-API-Key")) {
+	case http.StatusUnauthorized:
+		writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "the X-API-Key header is required for dry runs")
+		return
+	case http.StatusForbidden:
+		writeError(w, http.StatusForbidden, ErrorCodeForbidden, "the API key is not allowed to do dry runs")
+		return
+	}
+
+	if !limitRequestBody(w, req, PayloadMaxBytes) {
+		writePayloadTooLarge(w)
+		return
+	}
+	payload, err := ReadPayload(req.Body, PayloadMaxBytes, PayloadSpoolThreshold, PayloadSpoolDir)
+	if errors.Is(err, ErrPayloadTooLarge) {
+		writePayloadTooLarge(w)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	defer payload.Close()
+
+	label := req.URL.Query().Get("node")
+	node := s.nodePool.dryRunNode(label)
+	if node == nil {
+		s.dryRuns.numRejected.Inc()
+		msg := "no healthy canary node"
+		if label != "" {
+			msg = "no healthy node with the label " + label
+		}
+		w.Header().Set("X-Error-Kind", ErrorKindNoNodesAvailable)
+		writeError(w, http.StatusServiceUnavailable, ErrorCodeNoNodesAvailable, msg)
+		return
+	}
+	if !s.dryRuns.acquire() {
+		log.Infow("Dry run rejected, too many concurrent dry runs")
+		s.dryRuns.numRejected.Inc()
+		w.Header().Set("X-Error-Kind", ErrorKindDryRunLimit)
+		writeError(w, http.StatusTooManyRequests, ErrorCodeDryRunLimit, ErrDryRunLimit.Error())
+		return
+	}
+	defer s.dryRuns.release()
+
+	// Directly to the node, not through its workers (and their stats and health)
+	s.dryRuns.numRequests.Inc()
+	ctx := ContextWithRequestID(req.Context(), reqID)
+	startTime := time.Now()
+	resp, contentType, statusCode, err := node.proxyRequest(ctx, payload, req.Header.Get("Content-Type"), nil, ProxyRequestTimeout)
+	duration := time.Since(startTime)
+	kind := "none"
+	if err != nil {
+		kind = errorKind(SimResponse{Error: err, StatusCode: statusCode})
+		s.dryRuns.numFailed.Inc()
+		w.Header().Set("X-Error-Kind", kind)
+	} else {
+		s.dryRuns.numSuccess.Inc()
+	}
+	s.metrics.Count(MetricDryRunRequests, 1, nodeMetricTag(node.URI), MetricTag(MetricTagErrorKind, kind))
+	s.metrics.Timing(MetricDryRunDuration, duration, nodeMetricTag(node.URI))
+	log.Infow("Dry run done", "uri", node.URI, "statusCode", statusCode, "durationMs", duration.Milliseconds(), "error", err)
+
+	if !HideNodeURIHeader {
+		w.Header().Set("X-Node-URI", node.URI)
+	}
+	w.Header().Set("X-Sim-Duration-Ms", fmt.Sprint(duration.Milliseconds()))
+	if err != nil && len(resp) == 0 {
+		if statusCode == 0 {
+			statusCode = http.StatusBadGateway
+		}
+		writeError(w, statusCode, errorCode(kind), strings.Trim(err.Error(), "\n"))
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	writePayload(w, req, statusCode, resp)
+}
+
+// HandleDryRunStatsRequest returns the dry run counters
+func (s *Webserver) HandleDryRunStatsRequest(w http.ResponseWriter, req *http.Request) {
+	if s.dryRuns == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "dry runs are not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.dryRuns.Stats()); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebserverDryRun(t *testing.T) {
+	prodNode := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer prodNode.Close()
+	canaryNode := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer canaryNode.Close()
+	labeledNode := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer labeledNode.Close()
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	nodePool := NewNodePool(testLog, nil, 1)
+	defer nodePool.Shutdown()
+	for _, uri := range []string{prodNode.URL, canaryNode.URL + "?_canary=1", labeledNode.URL + "?_label=integration"} {
+		require.Nil(t, nodePool.AddNode(uri))
+	}
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+	sink := &recordingMetricsSink{}
+	webserver.SetMetricsSink(sink)
+	handler := webserver.Handler()
+	prodNode.Reset()
+	canaryNode.Reset()
+	labeledNode.Reset()
+
+	payload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`
+	dryRun := func(apiKey, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/sim/dryrun"+query, bytes.NewBufferString(payload))
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	require.Equal(t, http.StatusNotFound, dryRun("key-1", "").Code)
+
+	webserver.EnableDryRuns(NewDryRunner([]string{"key-1", "key-2"}, 1))
+	require.Equal(t, http.StatusUnauthorized, dryRun("", "").Code)
+	require.Equal(t, http.StatusForbidden, dryRun("other", "").Code)
+
+	// The dry run is served by the canary node, returned with the X-Dry-Run header
+	rr := dryRun("key-1", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, "true", rr.Header().Get("X-Dry-Run"))
+	require.Contains(t, rr.Body.String(), `"result"`)
+	require.Equal(t, 1, canaryNode.NumRequests())
+	require.Equal(t, 0, prodNode.NumRequests())
+
+	// Or by the node with the label
+	require.Equal(t, http.StatusOK, dryRun("key-2", "?node=integration").Code)
+	require.Equal(t, 1, labeledNode.NumRequests())
+	require.Equal(t, http.StatusServiceUnavailable, dryRun("key-2", "?node=unknown").Code)
+
+	// A node error is returned as it is, and only counted for the dry runs
+	canaryNode.SetOpts(testutils.FakeNodeOpts{ErrorRate: 1})
+	rr = dryRun("key-1", "")
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	require.Equal(t, ErrorKindNodeError, rr.Header().Get("X-Error-Kind"))
+
+	// Concurrent dry runs over the limit are rejected
+	canaryNode.SetOpts(testutils.FakeNodeOpts{Latency: 200 * time.Millisecond})
+	done := make(chan int)
+	go func() { done <- dryRun("key-1", "").Code }()
+	require.Eventually(t, func() bool { return webserver.dryRuns.Stats().NumInFlight == 1 }, time.Second, time.Millisecond)
+	rr = dryRun("key-1", "")
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, ErrorCodeDryRunLimit, decodeErrorResponse(t, rr).Code)
+	require.Equal(t, http.StatusOK, <-done)
+
+	// Isolated from the queue, the request and node stats, and the request metrics
+	require.Equal(t, 0, prioQueue.NumRequests())
+	for _, stats := range nodePool.NodeStats() {
+		require.Equal(t, int64(0), stats.NumSuccess, stats.URI)
+		require.Equal(t, int64(0), stats.NumErrors, stats.URI)
+	}
+	require.Equal(t, int64(0), webserver.requests.completed.Load())
+	require.NotContains(t, sink.names, MetricRequests)
+	require.Contains(t, sink.names, MetricDryRunRequests)
+
+	// The separate dry run counters
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/dryrun", nil))
+	var stats DryRunStats
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&stats))
+	require.Equal(t, DryRunStats{MaxConcurrent: 1, NumRequests: 4, NumSuccess: 3, NumFailed: 1, NumRejected: 2}, stats)
+}
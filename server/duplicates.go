@@ -0,0 +1,119 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DuplicateLimiter rejects byte-identical payloads which a client submits more than maxSubmissions times within the
+// window (abuse protection, the responses are not shared). At most maxEntries (client ID, payload hash) pairs are
+// tracked, the least recently submitted ones are evicted first.
+type DuplicateLimiter struct {
+	lock            sync.Mutex
+	maxSubmissions  int
+	window          time.Duration
+	maxEntries      int
+	exemptFastTrack bool
+	entries         map[duplicateKey]*list.Element // values of the elements are *duplicateEntry
+	lru             *list.List                     // most recently submitted first
+	now             func() time.Time
+}
+
+type duplicateKey struct {
+	clientID    string
+	payloadHash string
+}
+
+type duplicateEntry struct {
+	key         duplicateKey
+	submissions []time.Time // the accepted submissions within the window, oldest first
+}
+
+func NewDuplicateLimiter(maxSubmissions int, window time.Duration, maxEntries int, exemptFastTrack bool) *DuplicateLimiter {
+	return &DuplicateLimiter{
+		maxSubmissions:  maxSubmissions,
+		window:          window,
+		maxEntries:      maxEntries,
+		exemptFastTrack: exemptFastTrack,
+		entries:         make(map[duplicateKey]*list.Element),
+		lru:             list.New(),
+		now:             time.Now,
+	}
+}
+
+// allow counts a submission of the payload (by its hash) by the client, and returns false without counting it if the
+// client submitted it maxSubmissions times within the window already
+func (l *DuplicateLimiter) allow(clientID, payloadHash string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.removeExpired(now)
+
+	key := duplicateKey{clientID: clientID, payloadHash: payloadHash}
+	elem, ok := l.entries[key]
+	if !ok {
+		elem = l.lru.PushFront(&duplicateEntry{key: key})
+		l.entries[key] = elem
+		for l.maxEntries > 0 && l.lru.Len() > l.maxEntries {
+			l.remove(l.lru.Back())
+		}
+	}
+	entry := elem.Value.(*duplicateEntry)
+	for len(entry.submissions) > 0 && now.Sub(entry.submissions[0]) >= l.window {
+		entry.submissions = entry.submissions[1:]
+	}
+	if len(entry.submissions) >= l.maxSubmissions {
+		return false
+	}
+	entry.submissions = append(entry.submissions, now)
+	l.lru.MoveToFront(elem)
+	return true
+}
+
+// removeExpired removes the entries without submissions within the window. The lock must be held.
+func (l *DuplicateLimiter) removeExpired(now time.Time) {
+	for elem := l.lru.Back(); elem != nil; elem = l.lru.Back() {
+		entry := elem.Value.(*duplicateEntry)
+		if len(entry.submissions) > 0 && now.Sub(entry.submissions[len(entry.submissions)-1]) < l.window {
+			return
+		}
+		l.remove(elem)
+	}
+}
+
+// remove removes an entry. The lock must be held.
+func (l *DuplicateLimiter) remove(elem *list.Element) {
+	l.lru.Remove(elem)
+	delete(l.entries, elem.Value.(*duplicateEntry).key)
+}
+
+// numEntries returns the number of tracked (client ID, payload hash) pairs
+func (l *DuplicateLimiter) numEntries() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lru.Len()
+}
+
+// EnableDuplicateLimiter rejects the duplicate submissions of clients with limiter
+func (s *Webserver) EnableDuplicateLimiter(limiter *DuplicateLimiter) {
+	s.duplicates = limiter
+}
+
+// allowSubmission checks the request against the duplicate limiter. Requests without a client ID are not limited.
+// Rejected requests are counted as such.
+func (s *Webserver) allowSubmission(r *SimRequest) bool {
+	if s.duplicates == nil || r.ClientID == "" || r.ClientID == unknownClientID {
+		return true
+	}
+	if r.IsFastTrack && s.duplicates.exemptFastTrack {
+		return true
+	}
+	if s.duplicates.allow(r.ClientID, payloadSHA256(r.Payload)) {
+		return true
+	}
+	s.clientStats.Rejected(r)
+	s.requests.rejected()
+	s.metricsRejected(r, ErrorKindDuplicateSubmission)
+	return false
+}
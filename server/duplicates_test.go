@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewDuplicateLimiter(3, 10*time.Second, 0, false)
+	l.now = func() time.Time { return now }
+
+	// Up to 3 submissions within the window
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow("a", "hash1"), i)
+		now = now.Add(time.Second)
+	}
+	require.False(t, l.allow("a", "hash1"))
+	require.False(t, l.allow("a", "hash1")) // rejections are not counted
+
+	// Other payloads and other clients are not affected
+	require.True(t, l.allow("a", "hash2"))
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow("b", "hash1"), i)
+	}
+	require.False(t, l.allow("b", "hash1"))
+
+	// Sliding window: the first submission of "a" expires 10s after it
+	now = now.Add(7*time.Second - time.Millisecond)
+	require.False(t, l.allow("a", "hash1"))
+	now = now.Add(time.Millisecond)
+	require.True(t, l.allow("a", "hash1"))
+	require.False(t, l.allow("a", "hash1"))
+
+	// Entries without submissions within the window are removed
+	require.Equal(t, 3, l.numEntries())
+	now = now.Add(10 * time.Second)
+	require.True(t, l.allow("c", "hash1"))
+	require.Equal(t, 1, l.numEntries())
+}
+
+func TestDuplicateLimiterMaxEntries(t *testing.T) {
+	l := NewDuplicateLimiter(1, time.Minute, 2, false)
+	require.True(t, l.allow("a", "hash"))
+	require.True(t, l.allow("b", "hash"))
+	require.False(t, l.allow("a", "hash"))
+	require.True(t, l.allow("c", "hash")) // evicts "a"
+	require.Equal(t, 2, l.numEntries())
+	require.True(t, l.allow("a", "hash"))
+	require.False(t, l.allow("c", "hash"))
+}
+
+func TestWebserverDuplicateSubmissions(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	webserver.EnableDuplicateLimiter(NewDuplicateLimiter(2, time.Minute, 0, true))
+	handler := webserver.Handler()
+	submit := func(clientID, payload string, isFastTrack bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(payload)))
+		if clientID != "" {
+			req.Header.Set("X-Client-ID", clientID)
+		}
+		if isFastTrack {
+			req.Header.Set("X-Fast-Track", "true")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	payload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":["0x1"],"id":1}`
+
+	require.Equal(t, http.StatusOK, submit("a", payload, false).Code)
+	require.Equal(t, http.StatusOK, submit("a", payload, false).Code)
+	rr := submit("a", payload, false)
+	require.Equal(t, http.StatusConflict, rr.Code)
+	require.Equal(t, ErrorKindDuplicateSubmission, rr.Header().Get("X-Error-Kind"))
+	errorDetails := decodeErrorResponse(t, rr)
+	require.Equal(t, ErrorCodeDuplicateSubmission, errorDetails.Code)
+	require.False(t, errorDetails.Retryable)
+
+	// Differing payloads, other clients, requests without a client ID and (exempt) fast-track requests are accepted
+	require.Equal(t, http.StatusOK, submit("a", `{"jsonrpc":"2.0","method":"eth_callBundle","params":["0x2"],"id":1}`, false).Code)
+	require.Equal(t, http.StatusOK, submit("b", payload, false).Code)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, submit("", payload, false).Code)
+		require.Equal(t, http.StatusOK, submit("a", payload, true).Code)
+	}
+}
@@ -1,9 +1,167 @@
 package server
 
-import "errors"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
 
 var (
 	ErrRequestTimeout   = errors.New("request timeout hit before processing")
 	ErrNodeTimeout      = errors.New("node timeout")
 	ErrNoNodesAvailable = errors.New("no nodes available")
+	ErrLoadShed         = errors.New("low-prio request shed because of the high-prio backlog")
+
+	ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+	ErrClientQueueLimit     = errors.New("too many queued requests of the client")
+	ErrMiddleware           = errors.New("proxy middleware failed")
+	ErrFaultInjected        = errors.New("injected fault")
+	ErrValidationFailed     = errors.New("node response failed validation")
+	ErrShuttingDown         = errors.New("shutting down")
+	ErrDuplicateSubmission  = errors.New("duplicate submission")
+	ErrFastTrackReserved    = errors.New("the fast-track capacity left is reserved")
+	ErrDryRunLimit          = errors.New("too many concurrent dry runs")
+	ErrRequestCancelled     = errors.New("request cancelled while queued")
+	ErrAsyncLimit           = errors.New("too many async requests pending or not fetched")
+	ErrPriorityNotAllowed   = errors.New("priority above the max. priority of the tenant")
+	ErrResponseTooLarge     = errors.New("node response too large")
+	ErrQueueFull            = errors.New("queue full") // of a coalesced request which couldn't be queued again
+)
+
+// Error kinds, as returned in the X-Error-Kind response header
+const (
+	ErrorKindQueueFull        = "queue_full"
+	ErrorKindRequestTimeout   = "request_timeout"
+	ErrorKindNodeTimeout      = "node_timeout"
+	ErrorKindNoNodesAvailable = "no_nodes_available"
+	ErrorKindProxyTimeout     = "proxy_timeout"
+	ErrorKindNodeError        = "node_error"
+	ErrorKindProxyError       = "proxy_error"
+	ErrorKindShuttingDown     = "shutting_down"
+	ErrorKindLoadShed         = "load_shed"
+
+	ErrorKindRetryBudgetExhausted = "retry_budget_exhausted"
+	ErrorKindClientQueueLimit     = "client_queue_limit"
+	ErrorKindMiddleware           = "middleware_error"
+	ErrorKindValidationFailed     = "validation_failed"
+	ErrorKindDuplicateSubmission  = "duplicate_submission"
+	ErrorKindFastTrackReserved    = "fasttrack_reserved"
+	ErrorKindDryRunLimit          = "dryrun_limit"
+	ErrorKindRequestCancelled     = "request_cancelled"
+	ErrorKindAsyncLimit           = "async_limit"
+	ErrorKindPriorityNotAllowed   = "priority_not_allowed"
+	ErrorKindResponseTooLarge     = "response_too_large"
+)
+
+// Error codes of the JSON error responses. Codes of failed sim requests are the upper-cased error kinds.
+const (
+	ErrorCodeInvalidRequest   = "INVALID_REQUEST"
+	ErrorCodePayloadTooLarge  = "PAYLOAD_TOO_LARGE"
+	ErrorCodeInvalidJSONRPC   = "INVALID_JSONRPC"
+	ErrorCodeUnauthorized     = "UNAUTHORIZED"
+	ErrorCodeForbidden        = "FORBIDDEN"
+	ErrorCodeNotFound         = "NOT_FOUND"
+	ErrorCodeInternal         = "INTERNAL_ERROR"
+	ErrorCodeQueueFull        = "QUEUE_FULL"
+	ErrorCodeShuttingDown     = "SHUTTING_DOWN"
+	ErrorCodeRequestTimeout   = "REQUEST_TIMEOUT"
+	ErrorCodeNodeTimeout      = "NODE_TIMEOUT"
+	ErrorCodeNoNodesAvailable = "NO_NODES_AVAILABLE"
+	ErrorCodeProxyTimeout     = "PROXY_TIMEOUT"
+	ErrorCodeNodeError        = "NODE_ERROR"
+	ErrorCodeProxyError       = "PROXY_ERROR"
+	ErrorCodeLoadShed         = "LOAD_SHED"
+
+	ErrorCodeRetryBudgetExhausted = "RETRY_BUDGET_EXHAUSTED"
+	ErrorCodeClientQueueLimit     = "CLIENT_QUEUE_LIMIT"
+	ErrorCodeMiddleware           = "MIDDLEWARE_ERROR"
+	ErrorCodeValidationFailed     = "VALIDATION_FAILED"
+	ErrorCodeDuplicateSubmission  = "DUPLICATE_SUBMISSION"
+	ErrorCodeFastTrackReserved    = "FASTTRACK_RESERVED"
+	ErrorCodeDryRunLimit          = "DRYRUN_LIMIT"
+	ErrorCodeRequestCancelled     = "REQUEST_CANCELLED"
+	ErrorCodeAlreadyProxied       = "ALREADY_PROXIED" // the request can't be cancelled anymore
+	ErrorCodeAsyncLimit           = "ASYNC_LIMIT"
+	ErrorCodePriorityNotAllowed   = "PRIORITY_NOT_ALLOWED"
+	ErrorCodeResponseTooLarge     = "RESPONSE_TOO_LARGE"
 )
+
+// retryableErrorCodes are the errors after which the request may succeed when sent again. Node errors are not
+// retryable, because the balancer already retried them.
+var retryableErrorCodes = map[string]bool{
+	ErrorCodeQueueFull:         true,
+	ErrorCodeShuttingDown:      true,
+	ErrorCodeRequestTimeout:    true,
+	ErrorCodeNodeTimeout:       true,
+	ErrorCodeNoNodesAvailable:  true,
+	ErrorCodeLoadShed:          true,
+	ErrorCodeClientQueueLimit:  true,
+	ErrorCodeFastTrackReserved: true,
+	ErrorCodeDryRunLimit:       true,
+	ErrorCodeAsyncLimit:        true,
+}
+
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+type ErrorDetails struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+// errorCode returns the error code for an error kind
+func errorCode(kind string) string {
+	return strings.ToUpper(kind)
+}
+
+// writeError writes a JSON error response, with the request ID from the response headers
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetails{
+		Code:      code,
+		Message:   message,
+		RequestID: w.Header().Get("X-Request-ID"),
+		Retryable: retryableErrorCodes[code],
+	}})
+}
+
+// errorKind classifies the error of a failed response
+func errorKind(resp SimResponse) string {
+	switch {
+	case errors.Is(resp.Error, ErrRetryBudgetExhausted):
+		return ErrorKindRetryBudgetExhausted
+	case errors.Is(resp.Error, ErrMiddleware):
+		return ErrorKindMiddleware
+	case errors.Is(resp.Error, ErrValidationFailed):
+		return ErrorKindValidationFailed
+	case errors.Is(resp.Error, ErrRequestTimeout):
+		return ErrorKindRequestTimeout
+	case errors.Is(resp.Error, ErrNodeTimeout):
+		return ErrorKindNodeTimeout
+	case errors.Is(resp.Error, ErrNoNodesAvailable):
+		return ErrorKindNoNodesAvailable
+	case errors.Is(resp.Error, ErrLoadShed):
+		return ErrorKindLoadShed
+	case errors.Is(resp.Error, ErrShuttingDown):
+		return ErrorKindShuttingDown
+	case errors.Is(resp.Error, ErrRequestCancelled):
+		return ErrorKindRequestCancelled
+	case errors.Is(resp.Error, ErrResponseTooLarge):
+		return ErrorKindResponseTooLarge
+	case errors.Is(resp.Error, ErrQueueFull):
+		return ErrorKindQueueFull
+	case errors.Is(resp.Error, context.DeadlineExceeded):
+		return ErrorKindProxyTimeout
+	case resp.StatusCode >= 400:
+		return ErrorKindNodeError
+	default:
+		return ErrorKindProxyError
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// decodeErrorResponse checks the shape of a JSON error response, and returns the details
+func decodeErrorResponse(t *testing.T, rr *httptest.ResponseRecorder) ErrorDetails {
+	t.Helper()
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	res := ErrorResponse{}
+	dec := json.NewDecoder(rr.Body)
+	dec.DisallowUnknownFields()
+	require.Nil(t, dec.Decode(&res))
+	require.NotEmpty(t, res.Error.Code)
+	require.NotEmpty(t, res.Error.Message)
+	return res.Error
+}
+
+func newSimTestRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+	req.Header.Set("X-Request-ID", "test-req")
+	return req
+}
+
+func TestWebserverErrorResponses(t *testing.T) {
+	validPayload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`
+
+	_RequestTimeout, _PayloadMaxBytes, _ValidateJSONRPC := RequestTimeout, PayloadMaxBytes, ValidateJSONRPC
+	defer func() {
+		RequestTimeout, PayloadMaxBytes, ValidateJSONRPC = _RequestTimeout, _PayloadMaxBytes, _ValidateJSONRPC
+	}()
+
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T) (http.HandlerFunc, *http.Request)
+		statusCode int
+		code       string
+		retryable  bool
+	}{
+		{
+			name: "payload too large",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				PayloadMaxBytes = 10
+				webserver, _ := newTestWebserver(t, 1)
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusRequestEntityTooLarge,
+			code:       ErrorCodePayloadTooLarge,
+		},
+		{
+			name: "invalid gzip body",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				webserver, _ := newTestWebserver(t, 1)
+				req := newSimTestRequest(validPayload)
+				req.Header.Set("Content-Encoding", "gzip")
+				return webserver.HandleQueueRequest, req
+			},
+			statusCode: http.StatusBadRequest,
+			code:       ErrorCodeInvalidRequest,
+		},
+		{
+			name: "invalid JSON-RPC request",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				ValidateJSONRPC = true
+				webserver, _ := newTestWebserver(t, 1)
+				return webserver.HandleQueueRequest, newSimTestRequest(`{"method":"eth_callBundle"}`)
+			},
+			statusCode: http.StatusBadRequest,
+			code:       ErrorCodeInvalidJSONRPC,
+		},
+		{
+			name: "unknown API key",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				tenantQueue, err := NewTenantQueue(testTenants, nil, 2, false, PriorityAging{})
+				require.Nil(t, err, err)
+				webserver := NewWebserver(testLog, ":12345", tenantQueue, NewNodePool(testLog, nil, 1))
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusUnauthorized,
+			code:       ErrorCodeUnauthorized,
+		},
+		{
+			name: "admin route without credential",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				setTestAdminAuth(t, "secret", "", "")
+				req := httptest.NewRequest("GET", "/nodes", nil)
+				req.Header.Set("X-Request-ID", "test-req")
+				return LoggingMiddleware(testLog, AdminAuthMiddleware(http.NotFoundHandler())).ServeHTTP, req
+			},
+			statusCode: http.StatusUnauthorized,
+			code:       ErrorCodeUnauthorized,
+		},
+		{
+			name: "queue full",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				prioQueue := NewPrioQueue(0, 0, 1, 2, false, PriorityAging{})
+				prioQueue.Push(NewSimRequest(newSimTestRequest("").Context(), "1", []byte("x"), false, false))
+				webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusInternalServerError,
+			code:       ErrorCodeQueueFull,
+			retryable:  true,
+		},
+		{
+			name: "load shed",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+				prioQueue.Push(NewSimRequest(newSimTestRequest("").Context(), "1", []byte("x"), true, false))
+				webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+				webserver.EnableLoadShedding(NewLoadShedder(1, 0, 0.5), false)
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusServiceUnavailable,
+			code:       ErrorCodeLoadShed,
+			retryable:  true,
+		},
+		{
+			name: "client queue limit",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false, PriorityAging{}), NewNodePool(testLog, nil, 1))
+				webserver.EnableClientQueueLimits(ClientQueueLimits{Total: 1})
+				require.True(t, webserver.clientQueue.acquire("a", PriorityLowPrio))
+				req := newSimTestRequest(validPayload)
+				req.Header.Set("X-Client-ID", "a")
+				return webserver.HandleQueueRequest, req
+			},
+			statusCode: http.StatusTooManyRequests,
+			code:       ErrorCodeClientQueueLimit,
+			retryable:  true,
+		},
+		{
+			name: "shutting down",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+				prioQueue.Close()
+				webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusServiceUnavailable,
+			code:       ErrorCodeShuttingDown,
+			retryable:  true,
+		},
+		{
+			name: "request timeout",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				RequestTimeout = 0
+				webserver, _ := newTestWebserver(t, 1)
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusInternalServerError,
+			code:       ErrorCodeRequestTimeout,
+			retryable:  true,
+		},
+		{
+			name: "node error",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				webserver, mockNodeBackend := newTestWebserver(t, 1)
+				mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+					w.WriteHeader(http.StatusBadGateway)
+				}
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusBadGateway,
+			code:       ErrorCodeNodeError,
+		},
+		{
+			name: "proxy error",
+			setup: func(t *testing.T) (http.HandlerFunc, *http.Request) {
+				nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+				prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+				t.Cleanup(prioQueue.Close)
+				nodePool := NewNodePool(testLog, nil, 1)
+				require.Nil(t, nodePool.AddNode(nodeServer.URL+"?_healthcheck_success=status"))
+				nodeServer.Close() // connection refused from now on
+				go func() {
+					for job := prioQueue.Pop(); job != nil; job = prioQueue.Pop() {
+						nodePool.JobC <- job
+					}
+				}()
+				webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+				return webserver.HandleQueueRequest, newSimTestRequest(validPayload)
+			},
+			statusCode: http.StatusInternalServerError,
+			code:       ErrorCodeProxyError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RequestTimeout, PayloadMaxBytes, ValidateJSONRPC = _RequestTimeout, _PayloadMaxBytes, _ValidateJSONRPC
+			handler, req := tt.setup(t)
+			rr := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				handler(rr, req)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("handler timed out")
+			}
+
+			require.Equal(t, tt.statusCode, rr.Code)
+			details := decodeErrorResponse(t, rr)
+			require.Equal(t, tt.code, details.Code)
+			require.Equal(t, tt.retryable, details.Retryable)
+			require.Equal(t, "test-req", details.RequestID)
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	require.Equal(t, ErrorCodeQueueFull, errorCode(ErrorKindQueueFull))
+	require.Equal(t, ErrorCodeShuttingDown, errorCode(ErrorKindShuttingDown))
+	require.Equal(t, ErrorCodeRequestTimeout, errorCode(ErrorKindRequestTimeout))
+	require.Equal(t, ErrorCodeNodeTimeout, errorCode(ErrorKindNodeTimeout))
+	require.Equal(t, ErrorCodeNoNodesAvailable, errorCode(ErrorKindNoNodesAvailable))
+	require.Equal(t, ErrorCodeProxyTimeout, errorCode(ErrorKindProxyTimeout))
+	require.Equal(t, ErrorCodeNodeError, errorCode(ErrorKindNodeError))
+	require.Equal(t, ErrorCodeProxyError, errorCode(ErrorKindProxyError))
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// Event types of the /events stream
+const (
+	EventTypeQueueThreshold = "queue_threshold"
+	EventTypeNodeHealth     = "node_health"
+	EventTypeNodeAdded      = "node_added"
+	EventTypeNodeRemoved    = "node_removed"
+	EventTypeRequestError   = "request_error"
+	EventTypeStats          = "stats"
+	EventTypeDropped        = "dropped"
+)
+
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type QueueThresholdEvent struct {
+	Above       bool `json:"above"` // true if the queue grew to the threshold, false if it shrunk below it again
+	Threshold   int  `json:"threshold"`
+	NumRequests int  `json:"numRequests"`
+}
+
+type NodeEvent struct {
+	URI     string `json:"uri"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type RequestErrorEvent struct {
+	ReqID     string `json:"reqID"`
+	ErrorKind string `json:"errorKind"`
+	Error     string `json:"error"`
+	NodeURI   string `json:"nodeURI,omitempty"`
+	Tries     int    `json:"tries"`
+}
+
+type StatsEvent struct {
+	QueueSizeFastTrack int   `json:"queueSizeFastTrack"`
+	QueueSizeHighPrio  int   `json:"queueSizeHighPrio"`
+	QueueSizeLowPrio   int   `json:"queueSizeLowPrio"`
+	QueueBytes         int64 `json:"queueBytes"`
+	NumNodes           int   `json:"numNodes"`
+	NumHealthyNodes    int   `json:"numHealthyNodes"`
+}
+
+type DroppedEvent struct {
+	Count int64 `json:"count"` // number of events dropped since the last event, because the consumer was too slow
+}
+
+// EventSubscriber receives events on C. Events which don't fit into the buffer of C are dropped and counted.
+type EventSubscriber struct {
+	C       chan Event
+	dropped atomic.Int64
+}
+
+// TakeDropped returns the number of dropped events since the last call
+func (sub *EventSubscriber) TakeDropped() int64 {
+	return sub.dropped.Swap(0)
+}
+
+// EventBroker fans out events to all subscribers, without ever blocking the publisher. A nil broker discards events.
+type EventBroker struct {
+	lock        sync.Mutex
+	subscribers map[*EventSubscriber]struct{}
+	closed      bool
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{
+		subscribers: make(map[*EventSubscriber]struct{}),
+	}
+}
+
+// Subscribe returns a new subscriber with a buffer of bufferSize events. C is closed when the broker is closed.
+func (b *EventBroker) Subscribe(bufferSize int) *EventSubscriber {
+	sub := &EventSubscriber{C: make(chan Event, bufferSize)}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		close(sub.C)
+	} else {
+		b.subscribers[sub] = struct{}{}
+	}
+	return sub
+}
+
+func (b *EventBroker) Unsubscribe(sub *EventSubscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// Publish sends an event to all subscribers
+func (b *EventBroker) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	event := Event{Type: eventType, Time: time.Now().UTC(), Data: data}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for sub := range b.subscribers {
+		select {
+		case sub.C <- event:
+		default:
+			sub.dropped.Inc()
+		}
+	}
+}
+
+// Close unsubscribes all subscribers (which closes their channels) and discards future events
+func (b *EventBroker) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.C)
+	}
+}
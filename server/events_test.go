@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := NewEventBroker()
+	sub1 := b.Subscribe(1)
+	sub2 := b.Subscribe(10)
+
+	// Slow subscribers don't block the publisher
+	for i := 0; i < 3; i++ {
+		b.Publish(EventTypeStats, i)
+	}
+	require.Equal(t, 0, (<-sub1.C).Data)
+	require.Equal(t, int64(2), sub1.TakeDropped())
+	require.Equal(t, int64(0), sub1.TakeDropped())
+	require.Equal(t, 3, len(sub2.C))
+	require.Equal(t, int64(0), sub2.TakeDropped())
+
+	b.Unsubscribe(sub1)
+	_, ok := <-sub1.C
+	require.False(t, ok)
+
+	// Close ends all subscriptions
+	b.Close()
+	require.Equal(t, 3, len(sub2.C))
+	require.Equal(t, 0, len(b.subscribers))
+	_, ok = <-b.Subscribe(1).C
+	require.False(t, ok)
+
+	// nil broker discards events
+	var nilBroker *EventBroker
+	nilBroker.Publish(EventTypeStats, nil)
+}
+
+// readTestEvents parses the server-sent events of resp into a channel
+func readTestEvents(t *testing.T, resp *http.Response) chan Event {
+	t.Helper()
+	eventC := make(chan Event, 100)
+	go func() {
+		defer close(eventC)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				return
+			}
+			eventC <- event
+		}
+	}()
+	return eventC
+}
+
+func nextTestEvent(t *testing.T, eventC chan Event) Event {
+	t.Helper()
+	select {
+	case event, ok := <-eventC:
+		require.True(t, ok, "event stream closed")
+		return event
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "timeout waiting for event")
+	}
+	return Event{}
+}
+
+func TestWebserverEvents(t *testing.T) {
+	defer func(interval time.Duration) { EventsStatsInterval = interval }(EventsStatsInterval)
+	EventsStatsInterval = 0
+
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	nodeURI := webserver.nodePool.NodeUris()[0]
+	eventServer := httptest.NewServer(http.HandlerFunc(webserver.HandleEventsRequest))
+	defer eventServer.Close()
+
+	resp, err := http.Get(eventServer.URL)
+	require.Nil(t, err, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	eventC := readTestEvents(t, resp)
+
+	// Wait until the client is subscribed
+	require.Eventually(t, func() bool {
+		webserver.events.lock.Lock()
+		defer webserver.events.lock.Unlock()
+		return len(webserver.events.subscribers) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Add a node
+	newNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	defer newNodeServer.Close()
+	err = webserver.nodePool.AddNode(newNodeServer.URL)
+	require.Nil(t, err, err)
+
+	// Health flap of the first node
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "node error", http.StatusServiceUnavailable)
+	}
+	webserver.nodePool.CheckNodesHealth()
+	webserver.nodePool.CheckNodesHealth() // no transition, no event
+	mockNodeBackend.HTTPHandlerOverride = nil
+	webserver.nodePool.CheckNodesHealth()
+
+	// Remove the new node
+	deleted, err := webserver.nodePool.DelNode(newNodeServer.URL)
+	require.Nil(t, err, err)
+	require.True(t, deleted)
+
+	expectedEvents := []struct {
+		eventType string
+		uri       string
+		healthy   bool
+	}{
+		{EventTypeNodeAdded, newNodeServer.URL, true},
+		{EventTypeNodeHealth, nodeURI, false},
+		{EventTypeNodeHealth, nodeURI, true},
+		{EventTypeNodeRemoved, newNodeServer.URL, true},
+	}
+	for _, expected := range expectedEvents {
+		event := nextTestEvent(t, eventC)
+		require.Equal(t, expected.eventType, event.Type)
+		data := event.Data.(map[string]interface{})
+		require.Equal(t, expected.uri, data["uri"])
+		require.Equal(t, expected.healthy, data["healthy"])
+	}
+
+	// Shutdown closes the stream
+	webserver.Shutdown(context.Background())
+	select {
+	case _, ok := <-eventC:
+		require.False(t, ok)
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "event stream not closed on shutdown")
+	}
+}
+
+func TestWebserverEventsStats(t *testing.T) {
+	defer func(interval time.Duration) { EventsStatsInterval = interval }(EventsStatsInterval)
+	EventsStatsInterval = 20 * time.Millisecond
+
+	webserver, _ := newTestWebserver(t, 1)
+	eventServer := httptest.NewServer(http.HandlerFunc(webserver.HandleEventsRequest))
+	defer eventServer.Close()
+
+	resp, err := http.Get(eventServer.URL)
+	require.Nil(t, err, err)
+	defer resp.Body.Close()
+	eventC := readTestEvents(t, resp)
+
+	event := nextTestEvent(t, eventC)
+	require.Equal(t, EventTypeStats, event.Type)
+	data := event.Data.(map[string]interface{})
+	require.Equal(t, float64(1), data["numNodes"])
+	require.Equal(t, float64(1), data["numHealthyNodes"])
+}
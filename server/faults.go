@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Faults which can be injected (see /admin/faults), as logged and in the X-Fault-Injected response header
+const (
+	FaultLatency   = "latency"    // the proxy call is delayed by LatencyMs
+	FaultError     = "error"      // a 500 is returned instead of calling the node (retried like a node error)
+	FaultDrop      = "drop"       // the node response is dropped, the request times out at its deadline
+	FaultQueueFull = "queue_full" // the request is rejected as if the queue was full
+)
+
+// FaultConfig are the probabilities (0 to 1) of the injected faults, for resilience testing of staging deployments
+type FaultConfig struct {
+	LatencyRate   float64 `json:"latencyRate"`
+	LatencyMs     int     `json:"latencyMs"`
+	ErrorRate     float64 `json:"errorRate"`
+	DropRate      float64 `json:"dropRate"`
+	QueueFullRate float64 `json:"queueFullRate"`
+}
+
+func (c FaultConfig) rate(fault string) float64 {
+	switch fault {
+	case FaultLatency:
+		return c.LatencyRate
+	case FaultError:
+		return c.ErrorRate
+	case FaultDrop:
+		return c.DropRate
+	case FaultQueueFull:
+		return c.QueueFullRate
+	}
+	return 0
+}
+
+func (c FaultConfig) validate() error {
+	for _, rate := range []float64{c.LatencyRate, c.ErrorRate, c.DropRate, c.QueueFullRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("rates must be between 0 and 1")
+		}
+	}
+	if c.LatencyMs < 0 {
+		return fmt.Errorf("latencyMs must not be negative")
+	}
+	return nil
+}
+
+type activeFaults struct {
+	config    FaultConfig
+	expiresAt time.Time
+}
+
+// faultInjector injects the faults of its config until it expires, and counts them. Shared by the webserver and all
+// nodes of a pool.
+type faultInjector struct {
+	active atomic.Pointer[activeFaults] // nil if disabled
+
+	lock     sync.Mutex
+	injected map[string]int64 // by fault
+}
+
+// enable injects the faults of config for duration, replacing the previous config
+func (f *faultInjector) enable(config FaultConfig, duration time.Duration) time.Time {
+	expiresAt := time.Now().UTC().Add(duration)
+	f.active.Store(&activeFaults{config: config, expiresAt: expiresAt})
+	return expiresAt
+}
+
+func (f *faultInjector) disable() {
+	f.active.Store(nil)
+}
+
+// current returns the config and expiry if fault injection is enabled
+func (f *faultInjector) current() (active *activeFaults) {
+	if f == nil {
+		return nil
+	}
+	active = f.active.Load()
+	if active == nil || time.Now().After(active.expiresAt) {
+		return nil
+	}
+	return active
+}
+
+// inject returns whether the fault is injected (with its probability), and counts it
+func (f *faultInjector) inject(fault string, metrics MetricsSink) bool {
+	active := f.current()
+	if active == nil || rand.Float64() >= active.config.rate(fault) { //nolint:gosec
+		return false
+	}
+
+	f.lock.Lock()
+	if f.injected == nil {
+		f.injected = make(map[string]int64)
+	}
+	f.injected[fault]++
+	f.lock.Unlock()
+	if metrics != nil {
+		metrics.Count(MetricFaultsInjected, 1, MetricTag(MetricTagFault, fault))
+	}
+	return true
+}
+
+// latency returns the injected proxy latency
+func (f *faultInjector) latency() time.Duration {
+	if active := f.current(); active != nil {
+		return time.Duration(active.config.LatencyMs) * time.Millisecond
+	}
+	return 0
+}
+
+func (f *faultInjector) numInjected() map[string]int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	injected := make(map[string]int64, len(f.injected))
+	for fault, n := range f.injected {
+		injected[fault] = n
+	}
+	return injected
+}
+
+type FaultInjectionRequest struct {
+	FaultConfig
+	DurationSec int `json:"durationSec"` // required, the faults are disabled again afterwards (at most FAULT_INJECTION_MAX_DURATION_SEC)
+}
+
+type FaultInjectionResponse struct {
+	Enabled   bool             `json:"enabled"`
+	Config    *FaultConfig     `json:"config,omitempty"`
+	ExpiresAt *time.Time       `json:"expiresAt,omitempty"`
+	Injected  map[string]int64 `json:"injected"` // since the start, by fault
+}
+
+// HandleFaultsRequest returns the fault injection state (GET), enables the faults of the request body for a while
+// (PUT), or disables them (DELETE)
+func (s *Webserver) HandleFaultsRequest(w http.ResponseWriter, req *http.Request) {
+	faults := &s.nodePool.faults
+	switch req.Method {
+	case http.MethodPut:
+		var faultsReq FaultInjectionRequest
+		if err := json.NewDecoder(req.Body).Decode(&faultsReq); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		duration := time.Duration(faultsReq.DurationSec) * time.Second
+		if err := faultsReq.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		} else if duration <= 0 || duration > FaultInjectionMaxDuration {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Sprintf("durationSec must be between 1 and %d", int(FaultInjectionMaxDuration.Seconds())))
+			return
+		}
+		expiresAt := faults.enable(faultsReq.FaultConfig, duration)
+		s.log.Warnw("Fault injection enabled", "config", faultsReq.FaultConfig, "expiresAt", expiresAt)
+	case http.MethodDelete:
+		faults.disable()
+		s.log.Warn("Fault injection disabled")
+	}
+
+	res := FaultInjectionResponse{Injected: faults.numInjected()}
+	if active := faults.current(); active != nil {
+		res.Enabled, res.Config, res.ExpiresAt = true, &active.config, &active.expiresAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjection(t *testing.T) {
+	_EnableFaultInjection, _RequestTimeout := EnableFaultInjection, RequestTimeout
+	defer func() { EnableFaultInjection, RequestTimeout = _EnableFaultInjection, _RequestTimeout }()
+	EnableFaultInjection = true
+	webserver, _ := newTestWebserver(t, 1)
+	metrics := &recordingMetricsSink{}
+	webserver.SetMetricsSink(metrics)
+	handler := webserver.Handler()
+
+	setFaults := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/admin/faults", bytes.NewBufferString(body)))
+		return rr
+	}
+	getFaults := func(method string) (res FaultInjectionResponse) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, "/admin/faults", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&res))
+		return res
+	}
+	send := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+		return rr
+	}
+
+	// An expiry is required
+	require.Equal(t, http.StatusBadRequest, setFaults(`{"errorRate":1}`).Code)
+	require.Equal(t, http.StatusBadRequest, setFaults(`{"errorRate":1,"durationSec":100000}`).Code)
+	require.Equal(t, http.StatusBadRequest, setFaults(`{"errorRate":2,"durationSec":60}`).Code)
+	require.False(t, getFaults(http.MethodGet).Enabled)
+
+	// Queue full, before the request is queued
+	require.Equal(t, http.StatusOK, setFaults(`{"queueFullRate":1,"durationSec":60}`).Code)
+	rr := send()
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, FaultQueueFull, rr.Header().Get("X-Fault-Injected"))
+	require.Equal(t, ErrorCodeQueueFull, decodeErrorResponse(t, rr).Code)
+	require.Contains(t, metrics.names, MetricFaultsInjected)
+
+	// Errors instead of the proxy call, which are retried like node errors
+	require.Equal(t, http.StatusOK, setFaults(`{"errorRate":1,"durationSec":60}`).Code)
+	rr = send()
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, FaultError, rr.Header().Get("X-Fault-Injected"))
+	require.Equal(t, ErrorKindNodeError, rr.Header().Get("X-Error-Kind"))
+	require.Equal(t, "3", rr.Header().Get("X-Tries"))
+
+	// Latency of the proxy call
+	require.Equal(t, http.StatusOK, setFaults(`{"latencyRate":1,"latencyMs":100,"durationSec":60}`).Code)
+	start := time.Now()
+	rr = send()
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, FaultLatency, rr.Header().Get("X-Fault-Injected"))
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// A dropped response times out at the deadline
+	RequestTimeout = 100 * time.Millisecond
+	require.Equal(t, http.StatusOK, setFaults(`{"dropRate":1,"durationSec":60}`).Code)
+	rr = send()
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, FaultDrop, rr.Header().Get("X-Fault-Injected"))
+	require.Equal(t, ErrorKindRequestTimeout, rr.Header().Get("X-Error-Kind"))
+
+	res := getFaults(http.MethodGet)
+	require.True(t, res.Enabled)
+	require.Equal(t, &FaultConfig{DropRate: 1}, res.Config)
+	require.Equal(t, map[string]int64{FaultQueueFull: 1, FaultError: 3, FaultLatency: 1, FaultDrop: 1}, res.Injected)
+
+	// Disabled again
+	require.False(t, getFaults(http.MethodDelete).Enabled)
+	rr = send()
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Empty(t, rr.Header().Get("X-Fault-Injected"))
+}
+
+func TestFaultInjectionExpiry(t *testing.T) {
+	f := &faultInjector{}
+	f.enable(FaultConfig{ErrorRate: 1}, 10*time.Millisecond)
+	require.True(t, f.inject(FaultError, nil))
+	require.False(t, f.inject(FaultDrop, nil))
+	time.Sleep(20 * time.Millisecond)
+	require.False(t, f.inject(FaultError, nil))
+	require.Nil(t, f.current())
+	require.Equal(t, map[string]int64{FaultError: 1}, f.numInjected())
+
+	// Without a pool
+	var nilInjector *faultInjector
+	require.False(t, nilInjector.inject(FaultError, nil))
+}
+
+func TestFaultInjectionRouteDisabled(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	rr := httptest.NewRecorder()
+	webserver.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/faults", nil))
+	require.NotEqual(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileState stores the state in a JSON file, for deployments without redis. The file is loaded at startup, and
+// replaced atomically on every change.
+type FileState struct {
+	path string
+	lock sync.Mutex
+	data fileStateData
+}
+
+type fileStateData struct {
+	Nodes   []NodeEntry    `json:"nodes"` // plain URIs of older files are loaded as entries too
+	Tenants []TenantConfig `json:"tenants"`
+}
+
+// StateFileFromNodeStore returns the state file of -state-file (or STATE_FILE), or of NODE_STORE=file:<path> which is
+// an alias of it. NODE_STORE=redis (or an empty one) doesn't change it.
+func StateFileFromNodeStore(nodeStore, stateFile string) (string, error) {
+	if nodeStore == "" || nodeStore == "redis" {
+		return stateFile, nil
+	} else if !strings.HasPrefix(nodeStore, "file:") || nodeStore == "file:" {
+		return "", errors.Errorf("invalid node store %s, expected redis or file:<path>", nodeStore)
+	}
+	path := strings.TrimPrefix(nodeStore, "file:")
+	if stateFile != "" && stateFile != path {
+		return "", errors.New("the node store and the state file are different files")
+	}
+	return path, nil
+}
+
+// NewFileState loads the state from the file at path, which is created on the first change if it doesn't exist
+func NewFileState(path string) (*FileState, error) {
+	s := &FileState{path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading state file failed")
+	}
+
+	if err := json.Unmarshal(content, &s.data); err != nil {
+		return nil, errors.Wrapf(err, "invalid state file %s", path)
+	}
+	return s, nil
+}
+
+// write replaces the file with data: written to a temporary file in the same directory, synced to disk and renamed
+// over the old file, so that the file is never partially written
+func (s *FileState) write(data fileStateData) error {
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary state file failed")
+	}
+	defer os.Remove(tmpFile.Name()) // no-op after the rename
+
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "writing state file failed")
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "syncing state file failed")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "writing state file failed")
+	}
+	if err := os.Rename(tmpFile.Name(), s.path); err != nil {
+		return errors.Wrap(err, "replacing state file failed")
+	}
+
+	// sync the directory, to persist the rename
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "syncing state directory failed")
+	}
+	defer dirFile.Close()
+	return errors.Wrap(dirFile.Sync(), "syncing state directory failed")
+}
+
+// update writes the state changed by f, and only applies it if writing succeeded
+func (s *FileState) update(f func(data *fileStateData)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data := s.data
+	f(&data)
+	if err := s.write(data); err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
+
+func (s *FileState) GetNodes() (nodes []NodeEntry, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copySlice(s.data.Nodes), nil
+}
+
+func (s *FileState) SaveNode(node NodeEntry) error {
+	return s.update(func(data *fileStateData) {
+		data.Nodes = saveNodeEntry(data.Nodes, node)
+	})
+}
+
+func (s *FileState) DeleteNode(uri string) error {
+	return s.update(func(data *fileStateData) {
+		data.Nodes = deleteNodeEntry(data.Nodes, uri)
+	})
+}
+
+func (s *FileState) GetTenants() (tenants []TenantConfig, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copySlice(s.data.Tenants), nil
+}
+
+func (s *FileState) SaveTenants(tenants []TenantConfig) error {
+	return s.update(func(data *fileStateData) {
+		data.Tenants = copySlice(tenants)
+	})
+}
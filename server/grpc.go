@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// grpcSimulateMethod is the method of the Simulator service in proto/simulator.proto
+const grpcSimulateMethod = "/priolb.v1.Simulator/Simulate"
+
+// grpcStatusCodes are the HTTP status codes of the gRPC status codes of failed calls, so that they're handled like the
+// HTTP responses of other nodes
+var grpcStatusCodes = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+}
+
+// grpcStatusCode returns the HTTP status code of a gRPC status code
+func grpcStatusCode(code codes.Code) int {
+	if code == codes.OK {
+		return http.StatusOK
+	} else if statusCode, found := grpcStatusCodes[code]; found {
+		return statusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// grpcTransport calls the Simulate method of the node over a single connection, which gRPC reconnects if it drops
+type grpcTransport struct {
+	conn *grpc.ClientConn
+}
+
+func newGRPCTransport(pURL *url.URL) (*grpcTransport, error) {
+	if pURL.Host == "" {
+		return nil, fmt.Errorf("missing host:port in gRPC node URI")
+	}
+	conn, err := grpc.Dial(pURL.Host,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32), grpc.MaxCallSendMsgSize(math.MaxInt32)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating gRPC connection failed")
+	}
+	return &grpcTransport{conn: conn}, nil
+}
+
+// Proxy calls Simulate with the payload, within the timeout. Failed calls return the HTTP status code of their gRPC
+// status code, with the errors wrapped like those of HTTP proxy requests.
+func (t *grpcTransport) Proxy(ctx context.Context, payload Payload, timeout time.Duration) (resp []byte, statusCode int, err error) {
+	ctxx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := payload.Bytes()
+	if err != nil {
+		return resp, statusCode, errors.Wrap(err, "opening payload failed")
+	}
+
+	for name, values := range nodeHeadersFromContext(ctx) {
+		for _, value := range values {
+			ctxx = metadata.AppendToOutgoingContext(ctxx, name, value)
+		}
+	}
+
+	out := new(wrapperspb.BytesValue)
+	err = t.conn.Invoke(ctxx, grpcSimulateMethod, wrapperspb.Bytes(body), out)
+	if err != nil && ctxx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return resp, statusCode, errors.Wrapf(err, "proxying request failed (timeout %s)", timeout)
+	} else if err != nil && ctx.Err() != nil {
+		return resp, statusCode, errors.Wrap(err, "proxying request failed")
+	} else if err != nil {
+		st := status.Convert(err)
+		statusCode = grpcStatusCode(st.Code())
+		return resp, statusCode, fmt.Errorf("error in response - statusCode: %d / %s: %s", statusCode, st.Code(), st.Message())
+	} else if err = checkResponseSize(out.GetValue()); err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return out.GetValue(), http.StatusOK, nil
+}
+
+// Close closes the connection
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+// GRPCSimulateFunc executes the payload of a Simulate call, errors should be gRPC status errors
+type GRPCSimulateFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+// RegisterGRPCSimulator serves the Simulator service of proto/simulator.proto with simulate, i.e. for simulators in Go
+// and mock nodes
+func RegisterGRPCSimulator(s grpc.ServiceRegistrar, simulate GRPCSimulateFunc) {
+	handler := func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := new(wrapperspb.BytesValue)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		call := func(ctx context.Context, req interface{}) (interface{}, error) {
+			resp, err := simulate(ctx, req.(*wrapperspb.BytesValue).GetValue())
+			if err != nil {
+				return nil, err
+			}
+			return wrapperspb.Bytes(resp), nil
+		}
+		if interceptor == nil {
+			return call(ctx, in)
+		}
+		return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: grpcSimulateMethod}, call)
+	}
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "priolb.v1.Simulator",
+		HandlerType: (*interface{})(nil),
+		Methods:     []grpc.MethodDesc{{MethodName: "Simulate", Handler: handler}},
+		Metadata:    "proto/simulator.proto",
+	}, nil)
+}
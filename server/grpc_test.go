@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewNodeTransport(t *testing.T) {
+	for uri, want := range map[string]interface{}{
+		"http://localhost:8545":  &httpTransport{},
+		"https://localhost:8545": &httpTransport{},
+		"ws://localhost:8546":    &wsTransport{},
+		"wss://localhost:8546":   &wsTransport{},
+		"grpc://localhost:9090":  &grpcTransport{},
+	} {
+		node, err := NewNode(testLog, uri, nil, 1)
+		require.Nil(t, err, err)
+		require.IsType(t, want, node.transport, uri)
+		node.StopWorkersAndWait()
+	}
+	_, err := NewNode(testLog, "grpc:///path", nil, 1)
+	require.NotNil(t, err)
+}
+
+func TestGRPCStatusCode(t *testing.T) {
+	require.Equal(t, http.StatusOK, grpcStatusCode(codes.OK))
+	require.Equal(t, http.StatusBadRequest, grpcStatusCode(codes.InvalidArgument))
+	require.Equal(t, http.StatusServiceUnavailable, grpcStatusCode(codes.Unavailable))
+	require.Equal(t, http.StatusGatewayTimeout, grpcStatusCode(codes.DeadlineExceeded))
+	require.Equal(t, http.StatusInternalServerError, grpcStatusCode(codes.Code(100)))
+}
+
+func TestNodeGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, err)
+	grpcServer := grpc.NewServer()
+	RegisterGRPCSimulator(grpcServer, func(ctx context.Context, payload []byte) ([]byte, error) {
+		switch {
+		case strings.Contains(string(payload), "overloaded"):
+			return nil, status.Error(codes.Unavailable, "overloaded")
+		case strings.Contains(string(payload), "slow"):
+			time.Sleep(200 * time.Millisecond)
+		}
+		return []byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`), nil
+	})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	uri := "grpc://" + listener.Addr().String() + "?_healthcheck_success=status"
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(uri)) // the health check probe is a Simulate call too
+	sim := func(method string) SimResponse {
+		r := NewSimRequest(context.Background(), "", []byte(`{"jsonrpc":"2.0","method":"`+method+`","params":[],"id":1}`), true, false)
+		gp.JobC <- r
+		return <-r.ResponseC
+	}
+
+	res := sim("eth_callBundle")
+	require.Nil(t, res.Error, res.Error)
+	require.Equal(t, `{"jsonrpc":"2.0","result":"0x1","id":1}`, string(res.Payload))
+	require.Equal(t, uri, res.NodeURI)
+
+	// Status errors are handled like HTTP error responses
+	res = sim("overloaded")
+	require.NotNil(t, res.Error)
+	require.True(t, res.ShouldRetry)
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	require.Contains(t, res.Error.Error(), "overloaded")
+
+	// The proxy timeout is the deadline of the call
+	node := gp.nodes[0]
+	_, statusCode, err := node.ProxyRequest(context.Background(), BytesPayload([]byte(`{"method":"slow"}`)), 50*time.Millisecond)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "proxying request failed (timeout 50ms)")
+	require.Equal(t, 0, statusCode)
+
+	// Responses larger than the limit fail, and are not retried
+	defer func(maxBytes int) { NodeResponseMaxBytes = maxBytes }(NodeResponseMaxBytes)
+	NodeResponseMaxBytes = 10
+	res = sim("eth_callBundle")
+	require.ErrorIs(t, res.Error, ErrResponseTooLarge)
+	require.False(t, res.ShouldRetry)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Success criteria of the health check probes (NODE_HEALTHCHECK_SUCCESS)
+const (
+	HealthCheckSuccessResult = "result" // a success status code and a JSON-RPC response with a result (which matches the result regex, if set), the default
+	HealthCheckSuccessStatus = "status" // only a success status code, for probes which are not JSON-RPC
+)
+
+// healthCheckProbe is the JSON-RPC health check probe of a node, and its success criterion
+type healthCheckProbe struct {
+	payload       []byte
+	id            json.RawMessage // of a JSON-RPC probe, which the response must have (nil for other payloads)
+	requireResult bool
+	resultRegex   *regexp.Regexp // (optional) the result must match
+	errorCodes    map[int]bool   // (optional) only JSON-RPC errors with these codes fail the check, instead of all errors
+	maxBlockAge   time.Duration  // (optional) the result is a block number, which must advance within this time
+}
+
+type healthCheckRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// healthCheckProbeArg returns the health check probe of a node: the server-wide settings, overridden by the
+// `_healthcheck_method`, `_healthcheck_params`, `_healthcheck_id`, `_healthcheck_success`,
+// `_healthcheck_result_regex`, `_healthcheck_error_codes` and `_healthcheck_max_block_age_sec` query params of its
+// URI. Without a method, NODE_HEALTHCHECK_PAYLOAD is posted.
+func healthCheckProbeArg(query url.Values) (probe healthCheckProbe, err error) {
+	arg := func(param, value string) string {
+		if query.Has(param) {
+			return query.Get(param)
+		}
+		return value
+	}
+
+	probe.payload = []byte(NodeHealthCheckPayload)
+	var payloadRequest healthCheckRequest
+	if json.Unmarshal(probe.payload, &payloadRequest) == nil && payloadRequest.JSONRPC == "2.0" && payloadRequest.Method != "" {
+		probe.id = payloadRequest.ID
+		if probe.id == nil {
+			probe.id = json.RawMessage("null")
+		}
+	}
+	if method := arg("_healthcheck_method", NodeHealthCheckMethod); method != "" {
+		params := json.RawMessage(arg("_healthcheck_params", NodeHealthCheckParams))
+		id := json.RawMessage(arg("_healthcheck_id", NodeHealthCheckID))
+		if !json.Valid(params) {
+			return probe, fmt.Errorf("invalid health check params: %s", params)
+		} else if !json.Valid(id) {
+			return probe, fmt.Errorf("invalid health check id: %s", id)
+		}
+		probe.payload, err = json.Marshal(healthCheckRequest{JSONRPC: "2.0", Method: method, Params: params, ID: id})
+		if err != nil {
+			return probe, err
+		}
+		probe.id = id
+	}
+
+	switch success := arg("_healthcheck_success", NodeHealthCheckSuccess); success {
+	case HealthCheckSuccessStatus:
+	case "", HealthCheckSuccessResult:
+		probe.requireResult = true
+	default:
+		return probe, fmt.Errorf("invalid health check success criterion: %s, must be status or result", success)
+	}
+	if codes := arg("_healthcheck_error_codes", NodeHealthCheckErrorCodes); codes != "" {
+		probe.errorCodes = make(map[int]bool)
+		for _, code := range strings.Split(codes, ",") {
+			errorCode, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				return probe, fmt.Errorf("invalid health check error code: %s", code)
+			}
+			probe.errorCodes[errorCode] = true
+		}
+	}
+	if maxAge := arg("_healthcheck_max_block_age_sec", strconv.Itoa(int(NodeHealthCheckMaxBlockAge/time.Second))); maxAge != "" && maxAge != "0" {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil || seconds < 0 {
+			return probe, fmt.Errorf("invalid health check max. block age: %s", maxAge)
+		}
+		probe.maxBlockAge = time.Duration(seconds) * time.Second
+		probe.requireResult = true
+	}
+	if pattern := arg("_healthcheck_result_regex", NodeHealthCheckResultRegex); pattern != "" {
+		if probe.resultRegex, err = regexp.Compile(pattern); err != nil {
+			return probe, errors.Wrap(err, "invalid health check result regex")
+		}
+		probe.requireResult = true
+	}
+	return probe, nil
+}
+
+// check checks the response of the node to the probe (with a success status code) against the success criterion
+func (p healthCheckProbe) check(resp []byte) error {
+	_, err := p.result(resp)
+	return err
+}
+
+// result checks the response of the node to the probe against the success criterion, and returns its JSON-RPC result
+// (nil if the status code is enough, or the error code of the response doesn't fail the check)
+func (p healthCheckProbe) result(resp []byte) (json.RawMessage, error) {
+	if !p.requireResult {
+		return nil, nil
+	}
+	var rpcResp struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result"`
+		Error   json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(resp, &rpcResp); err != nil {
+		return nil, errors.Wrap(err, "health check response is not a JSON-RPC response")
+	} else if rpcResp.JSONRPC != "2.0" {
+		return nil, fmt.Errorf("health check response is not a JSON-RPC 2.0 response")
+	} else if p.id != nil && !sameJSON(p.id, rpcResp.ID) {
+		return nil, fmt.Errorf("health check response id %s doesn't match the probe id %s", rpcResp.ID, p.id)
+	}
+	if len(rpcResp.Error) > 0 && string(rpcResp.Error) != "null" {
+		var rpcErr struct {
+			Code int `json:"code"`
+		}
+		if p.errorCodes != nil && json.Unmarshal(rpcResp.Error, &rpcErr) == nil && !p.errorCodes[rpcErr.Code] {
+			return nil, nil // a working node which answers the probe with another error
+		}
+		return nil, fmt.Errorf("health check response is a JSON-RPC error: %s", rpcResp.Error)
+	} else if len(rpcResp.Result) == 0 || string(rpcResp.Result) == "null" {
+		return nil, fmt.Errorf("health check response has no result")
+	}
+	if p.resultRegex == nil {
+		return rpcResp.Result, nil
+	}
+
+	// strings are matched without their quotes
+	result := string(rpcResp.Result)
+	var s string
+	if json.Unmarshal(rpcResp.Result, &s) == nil {
+		result = s
+	}
+	if !p.resultRegex.MatchString(result) {
+		if len(result) > 100 {
+			result = result[:100] + "..."
+		}
+		return nil, fmt.Errorf("health check result %s doesn't match %s", result, p.resultRegex)
+	}
+	return rpcResp.Result, nil
+}
+
+// sameJSON returns whether both JSON values are equal (i.e. 1 and 1.0)
+func sameJSON(a, b json.RawMessage) bool {
+	var aValue, bValue interface{}
+	if json.Unmarshal(a, &aValue) != nil || json.Unmarshal(b, &bValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// blockProgress is the block number of the health checks of a node, see NODE_HEALTHCHECK_MAX_BLOCK_AGE_SEC
+type blockProgress struct {
+	lock       sync.Mutex
+	number     uint64
+	advancedAt time.Time // when the block number last increased, zero before the first check
+}
+
+// check fails if the block number of the result (a hex quantity like of eth_blockNumber, or a number) didn't increase
+// within maxAge
+func (b *blockProgress) check(result json.RawMessage, maxAge time.Duration, now time.Time) error {
+	var value interface{}
+	if err := json.Unmarshal(result, &value); err != nil {
+		return errors.Wrap(err, "health check result is not a block number")
+	}
+	var number uint64
+	var err error
+	switch v := value.(type) {
+	case string:
+		number, err = strconv.ParseUint(strings.TrimPrefix(v, "0x"), 16, 64)
+	case float64:
+		number = uint64(v)
+	default:
+		err = fmt.Errorf("unexpected type")
+	}
+	if err != nil {
+		return fmt.Errorf("health check result %s is not a block number", result)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.advancedAt.IsZero() || number > b.number {
+		b.number, b.advancedAt = number, now
+		return nil
+	} else if age := now.Sub(b.advancedAt); age > maxAge {
+		return fmt.Errorf("health check block number %d didn't advance for %s", b.number, age.Round(time.Second))
+	}
+	return nil
+}
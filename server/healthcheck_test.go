@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckProbeArg(t *testing.T) {
+	_NodeHealthCheckMethod, _NodeHealthCheckParams := NodeHealthCheckMethod, NodeHealthCheckParams
+	defer func() { NodeHealthCheckMethod, NodeHealthCheckParams = _NodeHealthCheckMethod, _NodeHealthCheckParams }()
+
+	// By default the payload is posted, and the response must be a JSON-RPC response with a result
+	probe, err := healthCheckProbeArg(nil)
+	require.Nil(t, err, err)
+	require.Equal(t, NodeHealthCheckPayload, string(probe.payload))
+	require.True(t, probe.requireResult)
+	require.ErrorContains(t, probe.check([]byte("not json")), "not a JSON-RPC response")
+	probe, err = healthCheckProbeArg(url.Values{"_healthcheck_success": {HealthCheckSuccessStatus}})
+	require.Nil(t, err, err)
+	require.False(t, probe.requireResult)
+	require.Nil(t, probe.check([]byte("not json"))) // a success status code is enough
+
+	// Server-wide method, with per-node overrides
+	NodeHealthCheckMethod, NodeHealthCheckParams = "sim_status", `["latest"]`
+	probe, err = healthCheckProbeArg(nil)
+	require.Nil(t, err, err)
+	require.JSONEq(t, `{"jsonrpc":"2.0","method":"sim_status","params":["latest"],"id":123}`, string(probe.payload))
+	query, err := url.ParseQuery(`_healthcheck_method=sim_ping&_healthcheck_params={"a":1}&_healthcheck_id="hc"&_healthcheck_result_regex=^ok$`)
+	require.Nil(t, err, err)
+	probe, err = healthCheckProbeArg(query)
+	require.Nil(t, err, err)
+	require.JSONEq(t, `{"jsonrpc":"2.0","method":"sim_ping","params":{"a":1},"id":"hc"}`, string(probe.payload))
+	require.True(t, probe.requireResult)
+
+	// Success criteria
+	require.Nil(t, probe.check([]byte(`{"jsonrpc":"2.0","id":"hc","result":"ok"}`)))
+	require.ErrorContains(t, probe.check([]byte(`{"jsonrpc":"2.0","id":"hc","result":"syncing"}`)), "doesn't match")
+	require.ErrorContains(t, probe.check([]byte(`{"jsonrpc":"2.0","id":"hc","error":{"code":-32601,"message":"method not found"}}`)), "JSON-RPC error")
+	require.ErrorContains(t, probe.check([]byte(`{"jsonrpc":"2.0","id":"hc","result":null}`)), "no result")
+	probe, err = healthCheckProbeArg(url.Values{"_healthcheck_success": {HealthCheckSuccessResult}})
+	require.Nil(t, err, err)
+	require.Nil(t, probe.check([]byte(`{"jsonrpc":"2.0","id":123,"result":{"blockNumber":1}}`)))
+	require.ErrorContains(t, probe.check([]byte(`{"jsonrpc":"2.0","id":1,"result":{"blockNumber":1}}`)), "doesn't match the probe id")
+	require.ErrorContains(t, probe.check([]byte(`{"id":123,"result":{"blockNumber":1}}`)), "not a JSON-RPC 2.0 response")
+
+	for _, invalid := range []url.Values{
+		{"_healthcheck_params": {"[1,"}},
+		{"_healthcheck_id": {"abc"}},
+		{"_healthcheck_success": {"always"}},
+		{"_healthcheck_result_regex": {"("}},
+		{"_healthcheck_error_codes": {"-32601,x"}},
+		{"_healthcheck_max_block_age_sec": {"-1"}},
+	} {
+		_, err := healthCheckProbeArg(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
+
+func TestNodeHealthCheckMethod(t *testing.T) {
+	fakeNode := testutils.NewFakeNode(testutils.FakeNodeOpts{
+		Latency: 5 * time.Millisecond,
+		Responses: map[string]interface{}{
+			"net_version": testutils.JSONRPCError{Code: -32601, Message: "method not found"},
+			"sim_status":  "ok",
+		},
+	})
+	defer fakeNode.Close()
+
+	// net_version fails in the custom namespace of the node (with a success status code), only the custom method succeeds
+	node, err := NewNode(testLog, fakeNode.URL+"?_healthcheck_success=result", nil, 1)
+	require.Nil(t, err, err)
+	_, err = node.checkHealth()
+	require.ErrorContains(t, err, "method not found")
+	require.False(t, node.IsHealthy())
+	require.Contains(t, node.Stats().LastHealthCheckErr, "method not found")
+
+	node, err = NewNode(testLog, fakeNode.URL+"?_healthcheck_method=sim_status&_healthcheck_success=result", nil, 1)
+	require.Nil(t, err, err)
+	_, err = node.checkHealth()
+	require.Nil(t, err, err)
+	require.True(t, node.IsHealthy())
+	stats := node.Stats()
+	require.Empty(t, stats.LastHealthCheckErr)
+	require.GreaterOrEqual(t, stats.LastHealthCheckMs, float64(5)) // the latency of the check
+	var probe map[string]interface{}
+	lastRequest, _ := fakeNode.LastRequest()
+	require.Nil(t, json.Unmarshal(lastRequest.Body, &probe))
+	require.Equal(t, "sim_status", probe["method"])
+
+	// The result doesn't match the regex
+	node, err = NewNode(testLog, fakeNode.URL+"?_healthcheck_method=sim_status&_healthcheck_result_regex=^ready$", nil, 1)
+	require.Nil(t, err, err)
+	_, err = node.checkHealth()
+	require.ErrorContains(t, err, "doesn't match")
+	require.False(t, node.IsHealthy())
+
+	_, err = NewNode(testLog, fakeNode.URL+"?_healthcheck_result_regex=(", nil, 1)
+	require.NotNil(t, err)
+}
+
+func TestNodeHealthCheckResponse(t *testing.T) {
+	var response atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(response.Load().(string)))
+	}))
+	defer server.Close()
+	checkHealth := func(query, body string) error {
+		t.Helper()
+		node, err := NewNode(testLog, server.URL+"?"+query, nil, 1)
+		require.Nil(t, err, err)
+		response.Store(body)
+		return node.HealthCheck()
+	}
+
+	// The HTML error page of a reverse proxy in front of the node
+	html := "<html><body>502 Bad Gateway</body></html>"
+	require.ErrorContains(t, checkHealth("", html), "not a JSON-RPC response")
+	require.Nil(t, checkHealth("_healthcheck_success=status", html)) // a success status code is enough
+	require.Nil(t, checkHealth("", `{"jsonrpc":"2.0","id":123,"result":"1"}`))
+	require.ErrorContains(t, checkHealth("", `{"jsonrpc":"2.0","id":1,"result":"1"}`), "doesn't match the probe id")
+
+	// JSON-RPC errors fail the check, or only those with the configured codes
+	rpcError := `{"jsonrpc":"2.0","id":123,"error":{"code":-32000,"message":"header not found"}}`
+	require.ErrorContains(t, checkHealth("", rpcError), "JSON-RPC error")
+	require.Nil(t, checkHealth("_healthcheck_success=status", rpcError))
+	require.ErrorContains(t, checkHealth("_healthcheck_success=result&_healthcheck_error_codes=-32601,-32000", rpcError), "JSON-RPC error")
+	require.Nil(t, checkHealth("_healthcheck_success=result&_healthcheck_error_codes=-32601", rpcError))
+
+	// The block number must advance within the max. age
+	node, err := NewNode(testLog, server.URL+"?_healthcheck_method=eth_blockNumber&_healthcheck_id=1&_healthcheck_max_block_age_sec=60", nil, 1)
+	require.Nil(t, err, err)
+	blockNumber := func(number uint64) string {
+		return fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":"0x%x"}`, number)
+	}
+	response.Store(blockNumber(100))
+	require.Nil(t, node.HealthCheck())
+	response.Store(blockNumber(100))
+	require.Nil(t, node.HealthCheck()) // within the max. age
+	node.blockProgress.advancedAt = node.blockProgress.advancedAt.Add(-61 * time.Second)
+	require.ErrorContains(t, node.HealthCheck(), "block number 100 didn't advance for 1m1s")
+	response.Store(blockNumber(101))
+	require.Nil(t, node.HealthCheck())
+	response.Store(`{"jsonrpc":"2.0","id":1,"result":"latest"}`)
+	require.ErrorContains(t, node.HealthCheck(), "not a block number")
+}
@@ -1,11 +1,17 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -35,13 +41,98 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.wroteHeader = true
 }
 
-// LoggingMiddleware logs the incoming HTTP request & its duration.
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush is needed for streaming responses (server-sent events)
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// accessLogEntry collects details about a request from the handlers, which are added to the access log line
+type accessLogEntry struct {
+	isHighPrio    bool
+	isFastTrack   bool
+	payloadSize   int64
+	queueDuration time.Duration
+	tenant        string
+	peerHops      int    // of a request forwarded by a peer
+	forwardedTo   string // the peer which served the request
+}
+
+type accessLogCtxKey struct{}
+
+// accessLogEntryFromContext returns the access log entry of the request, or a dummy entry if there is none
+func accessLogEntryFromContext(ctx context.Context) *accessLogEntry {
+	if entry, ok := ctx.Value(accessLogCtxKey{}).(*accessLogEntry); ok {
+		return entry
+	}
+	return &accessLogEntry{}
+}
+
+// ParseAccessLogSampling parses a list of `path=N` entries (comma separated). Only every N-th request to
+// that path is logged, N=0 disables logging for the path.
+func ParseAccessLogSampling(s string) map[string]int {
+	res := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		path, n, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			continue
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || rate < 0 {
+			continue
+		}
+		res[strings.TrimSpace(path)] = rate
+	}
+	return res
+}
+
+// accessLogSampler decides whether a request should be logged, based on the per-path sampling rates
+type accessLogSampler struct {
+	rates    map[string]int
+	counters sync.Map // path -> *atomic.Uint64
+}
+
+func (s *accessLogSampler) shouldLog(path string) bool {
+	rate, found := s.rates[path]
+	if !found || rate == 1 {
+		return true
+	} else if rate == 0 {
+		return false
+	}
+
+	counter, _ := s.counters.LoadOrStore(path, atomic.NewUint64(0))
+	return counter.(*atomic.Uint64).Inc()%uint64(rate) == 1
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LoggingMiddleware logs one access log line per incoming HTTP request, including its duration and
+// (for sim requests) the priority, payload size and queue wait time. Paths can be sampled or excluded
+// with AccessLogSampling.
 func LoggingMiddleware(log *zap.SugaredLogger, next http.Handler) http.Handler {
+	sampler := &accessLogSampler{rates: AccessLogSampling}
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if err := recover(); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+					if err == http.ErrAbortHandler {
+						panic(err) // aborts the response, i.e. of a failed stream
+					}
+					writeError(w, http.StatusInternalServerError, ErrorCodeInternal, "internal error")
 					log.Errorw(fmt.Sprintf("http request panic: %s %s", r.Method, r.URL.EscapedPath()),
 						"err", err,
 						"trace", debug.Stack(),
@@ -49,13 +140,30 @@ func LoggingMiddleware(log *zap.SugaredLogger, next http.Handler) http.Handler {
 				}
 			}()
 			start := time.Now()
+			ensureRequestID(w, r)
+			entry := &accessLogEntry{}
 			wrapped := wrapResponseWriter(w)
-			next.ServeHTTP(wrapped, r)
-			log.Infow(fmt.Sprintf("http: %s %s %d", r.Method, r.URL.EscapedPath(), wrapped.status),
+			next.ServeHTTP(wrapped, r.WithContext(context.WithValue(r.Context(), accessLogCtxKey{}, entry)))
+
+			path := r.URL.EscapedPath()
+			if !sampler.shouldLog(path) {
+				return
+			}
+			log.Infow(fmt.Sprintf("http: %s %s %d", r.Method, path, wrapped.status),
 				"status", wrapped.status,
 				"method", r.Method,
-				"path", r.URL.EscapedPath(),
+				"path", path,
 				"duration", time.Since(start).Seconds(),
+				"reqID", r.Header.Get("X-Request-ID"),
+				"clientID", r.Header.Get("X-Client-ID"),
+				"clientIP", clientIP(r),
+				"requestIsHighPrio", entry.isHighPrio,
+				"requestIsFastTrack", entry.isFastTrack,
+				"payloadSize", entry.payloadSize,
+				"queueDurationUs", entry.queueDuration.Microseconds(),
+				"tenant", entry.tenant,
+				"peerHops", entry.peerHops,
+				"forwardedTo", entry.forwardedTo,
 			)
 		},
 	)
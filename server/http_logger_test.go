@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseAccessLogSampling(t *testing.T) {
+	require.Equal(t, map[string]int{}, ParseAccessLogSampling(""))
+	require.Equal(t, map[string]int{"/": 0, "/nodes": 10}, ParseAccessLogSampling("/=0, /nodes=10,/foo,/bar=x,/baz=-1"))
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	defer func(sampling map[string]int) { AccessLogSampling = sampling }(AccessLogSampling)
+	AccessLogSampling = map[string]int{"/": 0, "/nodes": 2}
+
+	core, logs := observer.New(zap.InfoLevel)
+	log := zap.New(core).Sugar()
+
+	webserver, _ := newTestWebserver(t, 1)
+
+	router := http.NewServeMux()
+	router.HandleFunc("/", webserver.HandleRootRequest)
+	router.HandleFunc("/sim", webserver.HandleQueueRequest)
+	router.HandleFunc("/nodes", webserver.HandleNodesRequest)
+	handler := LoggingMiddleware(log, router)
+
+	// Sim request
+	reqPayload := testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1")
+	reqPayloadBytes, err := json.Marshal(reqPayload)
+	require.Nil(t, err, err)
+	req := httptest.NewRequest("POST", "/sim", bytes.NewBuffer(reqPayloadBytes))
+	req.Header.Set("X-High-Priority", "true")
+	req.Header.Set("X-Request-ID", "foo")
+	req.Header.Set("X-Client-ID", "client1")
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	entries := logs.TakeAll()
+	require.Equal(t, 1, len(entries))
+	fields := entries[0].ContextMap()
+	require.Equal(t, "http: POST /sim 200", entries[0].Message)
+	require.Equal(t, int64(200), fields["status"])
+	require.Equal(t, "POST", fields["method"])
+	require.Equal(t, "/sim", fields["path"])
+	require.Equal(t, "foo", fields["reqID"])
+	require.Equal(t, "client1", fields["clientID"])
+	require.Equal(t, "10.0.0.1", fields["clientIP"])
+	require.Equal(t, true, fields["requestIsHighPrio"])
+	require.Equal(t, false, fields["requestIsFastTrack"])
+	require.Equal(t, int64(len(reqPayloadBytes)), fields["payloadSize"])
+	require.Greater(t, fields["queueDurationUs"], int64(0))
+	require.Greater(t, fields["duration"], float64(0))
+
+	// Disabled path
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, 0, logs.Len())
+
+	// Sampled path (every 2nd request), node management is logged too
+	for i := 0; i < 4; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nodes", nil))
+	}
+	entries = logs.TakeAll()
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, "http: GET /nodes 200", entries[0].Message)
+}
@@ -0,0 +1,37 @@
+package server
+
+// interleaving decides whether the fast-track or the high-prio queue is popped first, so that of the requests popped
+// while both have some, the ratio of fast-track to high-prio requests is fastTrackWeight:highPrioWeight. It's a deficit
+// counter: both queues get their weight as credit once the credits are used up, and a pop from a queue uses one. A
+// queue without requests loses its credit, so bursts of one priority don't accumulate credit for later.
+type interleaving struct {
+	fastTrackWeight int
+	highPrioWeight  int
+	fastTrackCredit int
+	highPrioCredit  int
+}
+
+func newInterleaving(fastTrackWeight, highPrioWeight int) interleaving {
+	return interleaving{fastTrackWeight: fastTrackWeight, highPrioWeight: highPrioWeight}
+}
+
+// fastTrackTurn returns whether the fast-track queue is popped first, and updates the credits
+func (i *interleaving) fastTrackTurn(hasFastTrack, hasHighPrio bool) bool {
+	if !hasFastTrack {
+		i.fastTrackCredit = 0
+		return false
+	} else if !hasHighPrio {
+		i.highPrioCredit = 0
+		return true
+	}
+
+	if i.fastTrackCredit <= 0 && i.highPrioCredit <= 0 {
+		i.fastTrackCredit, i.highPrioCredit = i.fastTrackWeight, i.highPrioWeight
+	}
+	if i.fastTrackCredit > 0 {
+		i.fastTrackCredit--
+		return true
+	}
+	i.highPrioCredit--
+	return false
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"go.uber.org/atomic"
+)
+
+// ParseCIDRs parses a comma separated list of CIDRs (single IPs are allowed too, i.e. "10.0.0.0/8,::1")
+func ParseCIDRs(s string) (prefixes []netip.Prefix, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var prefix netip.Prefix
+		if strings.Contains(entry, "/") {
+			prefix, err = netip.ParsePrefix(entry)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(entry)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFilter allows or rejects requests based on the source IP. Deny entries take precedence over allow entries,
+// and an empty allowlist allows all IPs. X-Forwarded-For is only used if the request comes from a trusted proxy.
+type IPFilter struct {
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	trustedProxies []netip.Prefix
+	numRejected    atomic.Int64
+}
+
+func NewIPFilter(allow, deny, trustedProxies []netip.Prefix) *IPFilter {
+	return &IPFilter{
+		allow:          allow,
+		deny:           deny,
+		trustedProxies: trustedProxies,
+	}
+}
+
+// NewIPFilterFromConfig parses comma separated lists of CIDRs. Returns nil if allow and deny are both empty.
+func NewIPFilterFromConfig(allow, deny, trustedProxies string) (*IPFilter, error) {
+	allowPrefixes, err := ParseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyPrefixes, err := ParseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	trustedPrefixes, err := ParseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allowPrefixes) == 0 && len(denyPrefixes) == 0 {
+		return nil, nil
+	}
+	return NewIPFilter(allowPrefixes, denyPrefixes, trustedPrefixes), nil
+}
+
+// Allowed returns whether requests from addr are allowed
+func (f *IPFilter) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, addr)
+}
+
+// ClientIP returns the source IP of the request. If the request comes from a trusted proxy, the X-Forwarded-For
+// header is walked from right to left, and the first address which is not a trusted proxy is used.
+func (f *IPFilter) ClientIP(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr = addr.Unmap()
+
+	if len(f.trustedProxies) == 0 || !containsAddr(f.trustedProxies, addr) {
+		return addr, nil
+	}
+
+	forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(forwardedFor[i])
+		if entry == "" {
+			continue
+		}
+		forwardedAddr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		addr = forwardedAddr.Unmap()
+		if !containsAddr(f.trustedProxies, addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+// NumRejected returns the number of rejected requests
+func (f *IPFilter) NumRejected() int64 {
+	return f.numRejected.Load()
+}
+
+// Middleware rejects requests from IPs which are not allowed with "403 Forbidden", before the body is read
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := f.ClientIP(r)
+		if err != nil || !f.Allowed(addr) {
+			f.numRejected.Inc()
+			writeError(w, http.StatusForbidden, ErrorCodeForbidden, "forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	prefixes, err := ParseCIDRs(" 10.0.0.0/8, 192.168.1.5,2001:db8::/32 ,::1,")
+	require.Nil(t, err, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.5/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("::1/128"),
+	}, prefixes)
+
+	_, err = ParseCIDRs("10.0.0.0/33")
+	require.NotNil(t, err)
+	_, err = ParseCIDRs("foo")
+	require.NotNil(t, err)
+
+	filter, err := NewIPFilterFromConfig("", "", "10.0.0.0/8")
+	require.Nil(t, err, err)
+	require.Nil(t, filter)
+}
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name           string
+		allow          string
+		deny           string
+		trustedProxies string
+		remoteAddr     string
+		forwardedFor   string
+		allowed        bool
+	}{
+		{"v4 allowed", "10.0.0.0/8", "", "", "10.1.2.3:1234", "", true},
+		{"v4 not in allowlist", "10.0.0.0/8", "", "", "11.1.2.3:1234", "", false},
+		{"v6 allowed", "2001:db8::/32", "", "", "[2001:db8::1]:1234", "", true},
+		{"v6 not in allowlist", "2001:db8::/32", "", "", "[2001:db9::1]:1234", "", false},
+		{"v4-mapped v6", "10.0.0.0/8", "", "", "[::ffff:10.1.2.3]:1234", "", true},
+		{"empty allowlist allows all", "", "10.0.0.0/8", "", "11.1.2.3:1234", "", true},
+		{"denied", "", "10.0.0.0/8", "", "10.1.2.3:1234", "", false},
+		{"deny takes precedence over allow", "10.0.0.0/8", "10.1.0.0/16", "", "10.1.2.3:1234", "", false},
+		{"deny v6", "::/0", "2001:db8::/32", "", "[2001:db8::1]:1234", "", false},
+		{"xff ignored without trusted proxies", "10.0.0.0/8", "", "", "11.1.2.3:1234", "10.1.2.3", false},
+		{"xff ignored from untrusted proxy", "10.0.0.0/8", "", "192.168.0.0/16", "11.1.2.3:1234", "10.1.2.3", false},
+		{"xff from trusted proxy", "10.0.0.0/8", "", "192.168.0.0/16", "192.168.1.1:1234", "10.1.2.3", true},
+		{"xff from trusted proxy denied", "", "10.0.0.0/8", "192.168.0.0/16", "192.168.1.1:1234", "10.1.2.3", false},
+		{"xff spoofed entry left of client", "10.0.0.0/8", "", "192.168.0.0/16", "192.168.1.1:1234", "10.1.2.3, 11.1.2.3", false},
+		{"xff chain of trusted proxies", "10.0.0.0/8", "", "192.168.0.0/16", "192.168.1.1:1234", "11.1.2.3, 10.1.2.3, 192.168.2.2", true},
+		{"xff v6", "2001:db8::/32", "", "::1", "[::1]:1234", "2001:db8::5", true},
+		{"xff invalid", "", "10.0.0.0/8", "192.168.0.0/16", "192.168.1.1:1234", "foo", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewIPFilterFromConfig(tt.allow, tt.deny, tt.trustedProxies)
+			require.Nil(t, err, err)
+
+			req := httptest.NewRequest("POST", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			rr := httptest.NewRecorder()
+			filter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+			if tt.allowed {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.Equal(t, int64(0), filter.NumRejected())
+			} else {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				require.Equal(t, int64(1), filter.NumRejected())
+			}
+		})
+	}
+}
+
+type failingReader struct {
+	t *testing.T
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	r.t.Error("body was read")
+	return 0, nil
+}
+
+func TestWebserverIPFilters(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	simIPFilter, err := NewIPFilterFromConfig("10.0.0.0/8", "", "")
+	require.Nil(t, err, err)
+	adminIPFilter, err := NewIPFilterFromConfig("127.0.0.1", "", "")
+	require.Nil(t, err, err)
+	webserver.SetIPFilters(simIPFilter, adminIPFilter)
+	handler, _ := webserver.Handlers()
+
+	serve := func(method, path, remoteAddr string) int {
+		req := httptest.NewRequest(method, path, failingReader{t})
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Rejected before the body is read
+	require.Equal(t, http.StatusForbidden, serve("POST", "/", "127.0.0.1:1234"))
+	require.Equal(t, http.StatusForbidden, serve("POST", "/sim", "127.0.0.1:1234"))
+	require.Equal(t, http.StatusForbidden, serve("GET", "/nodes", "10.1.2.3:1234"))
+	require.Equal(t, int64(2), simIPFilter.NumRejected())
+	require.Equal(t, int64(1), adminIPFilter.NumRejected())
+
+	require.Equal(t, http.StatusOK, serve("GET", "/nodes", "127.0.0.1:1234"))
+	require.Equal(t, http.StatusOK, serve("GET", "/", "127.0.0.1:1234"))
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrJSONRPCInvalidJSON      = errors.New("invalid JSON")
+	ErrJSONRPCNotAnObject      = errors.New("JSON-RPC request must be a single JSON object")
+	ErrJSONRPCInvalidVersion   = errors.New(`"jsonrpc" must be "2.0"`)
+	ErrJSONRPCInvalidMethod    = errors.New(`"method" must be a non-empty string`)
+	ErrJSONRPCInvalidID        = errors.New(`"id" must be a string or number`)
+	ErrJSONRPCInvalidParams    = errors.New(`"params" must be an array or object`)
+	ErrJSONRPCMethodNotAllowed = errors.New("method not allowed")
+)
+
+// jsonRPCRequestEnvelope is used to validate the structure of a JSON-RPC request, without looking at the params
+type jsonRPCRequestEnvelope struct {
+	Version json.RawMessage `json:"jsonrpc"`
+	Method  json.RawMessage `json:"method"`
+	ID      json.RawMessage `json:"id"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// ParseMethodAllowlist parses a comma separated list of JSON-RPC methods. Returns nil if the list is empty (all methods allowed).
+func ParseMethodAllowlist(s string) map[string]bool {
+	var res map[string]bool
+	for _, method := range strings.Split(s, ",") {
+		method = strings.TrimSpace(method)
+		if method == "" {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]bool)
+		}
+		res[method] = true
+	}
+	return res
+}
+
+// ValidateJSONRPCRequest checks that payload is a single JSON-RPC 2.0 request object with a method and an id.
+// If allowedMethods is not nil, the method must be part of it. Returns the method of the request.
+func ValidateJSONRPCRequest(payload []byte, allowedMethods map[string]bool) (method string, err error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 || !json.Valid(payload) {
+		return "", ErrJSONRPCInvalidJSON
+	}
+	if payload[0] != '{' {
+		return "", ErrJSONRPCNotAnObject
+	}
+
+	var envelope jsonRPCRequestEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return "", ErrJSONRPCInvalidJSON
+	}
+
+	var version string
+	if err := json.Unmarshal(envelope.Version, &version); err != nil || version != "2.0" {
+		return "", ErrJSONRPCInvalidVersion
+	}
+
+	if err := json.Unmarshal(envelope.Method, &method); err != nil || method == "" {
+		return "", ErrJSONRPCInvalidMethod
+	}
+
+	if len(envelope.ID) == 0 || (envelope.ID[0] != '"' && envelope.ID[0] != '-' && (envelope.ID[0] < '0' || envelope.ID[0] > '9')) {
+		return method, ErrJSONRPCInvalidID
+	}
+
+	if len(envelope.Params) > 0 && envelope.Params[0] != '[' && envelope.Params[0] != '{' {
+		return method, ErrJSONRPCInvalidParams
+	}
+
+	if allowedMethods != nil && !allowedMethods[method] {
+		return method, fmt.Errorf("%w: %s", ErrJSONRPCMethodNotAllowed, method)
+	}
+
+	return method, nil
+}
+
+// validateJSONRPCPayload validates an in-memory or spooled payload with ValidateJSONRPCRequest
+func validateJSONRPCPayload(payload Payload, allowedMethods map[string]bool) error {
+	body, err := payload.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = ValidateJSONRPCRequest(body, allowedMethods)
+	return err
+}
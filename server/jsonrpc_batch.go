@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// JSON-RPC error codes, as per the spec: https://www.jsonrpc.org/specification#error_object
+const (
+	JSONRPCErrorInvalidRequest = -32600
+	JSONRPCErrorInternal       = -32603
+)
+
+var ErrJSONRPCEmptyBatch = errors.New("JSON-RPC batch must not be empty")
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonRPCErrorResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   jsonRPCError    `json:"error"`
+}
+
+// newJSONRPCErrorResponse returns a JSON-RPC error response for the request (id is null if the request has none)
+func newJSONRPCErrorResponse(request json.RawMessage, code int, message string) json.RawMessage {
+	var envelope jsonRPCRequestEnvelope
+	_ = json.Unmarshal(request, &envelope)
+	id := envelope.ID
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+
+	res, _ := json.Marshal(jsonRPCErrorResponse{
+		Version: "2.0",
+		ID:      id,
+		Error:   jsonRPCError{Code: code, Message: message},
+	})
+	return res
+}
+
+// splitJSONRPCBatch returns the elements if the payload is a JSON-RPC batch (a JSON array), or nil otherwise
+func splitJSONRPCBatch(payload Payload) (elements []json.RawMessage, err error) {
+	body, err := payload.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		return nil, nil
+	}
+
+	if err := json.Unmarshal(body, &elements); err != nil {
+		return nil, ErrJSONRPCInvalidJSON
+	}
+	if len(elements) == 0 {
+		return nil, ErrJSONRPCEmptyBatch
+	}
+	return elements, nil
+}
+
+// handleBatchRequest dispatches each element of a JSON-RPC batch as individual SimRequest (with the priority of the
+// batch, or of the priority rules for each element if the client didn't set one), and responds with the batch of responses in the original order. Failed elements get a JSON-RPC error object.
+func (s *Webserver) handleBatchRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, log *zap.SugaredLogger, reqID, tenant, clientID string, elements []json.RawMessage, isHighPrio, isFastTrack bool, startTime time.Time) {
+	log = log.With(
+		"requestIsHighPrio", isHighPrio,
+		"requestIsFastTrack", isFastTrack,
+		"batchSize", len(elements),
+	)
+
+	responses := make([]json.RawMessage, len(elements))
+	var wg sync.WaitGroup
+	for i, element := range elements {
+		if ValidateJSONRPC {
+			if _, err := ValidateJSONRPCRequest(element, JSONRPCAllowedMethods); err != nil {
+				responses[i] = newJSONRPCErrorResponse(element, JSONRPCErrorInvalidRequest, "invalid JSON-RPC request: "+err.Error())
+				continue
+			}
+		}
+
+		elementID := fmt.Sprintf("%s-%d", reqID, i)
+		elementIsHighPrio, elementIsFastTrack := s.classifyPriority(req, element, isHighPrio, isFastTrack)
+		elementIsHighPrio, elementIsFastTrack, err := s.limitTenantPriority(tenant, elementIsHighPrio, elementIsFastTrack)
+		if err != nil {
+			responses[i] = newJSONRPCErrorResponse(element, JSONRPCErrorInvalidRequest, err.Error())
+			continue
+		}
+		simReq := NewSimRequest(ContextWithRequestID(ctx, elementID), elementID, element, elementIsHighPrio, elementIsFastTrack)
+		simReq.Tenant = tenant
+		simReq.ClientID = clientID
+		simReq.SizeClass = s.payloadStats.Classify(int64(len(element)))
+		// the headers are validated by handleQueueRequest
+		simReq.Timeout, _ = requestDeadlineHeader(req)
+		simReq.ProxyTimeout, _ = proxyTimeoutHeader(req)
+		simReq.PriorityLevel, _, _ = priorityLevelHeader(req, PriorityLevels)
+		if _, err := s.queueBatchElement(log, simReq); err != nil {
+			responses[i] = newJSONRPCErrorResponse(element, JSONRPCErrorInternal, err.Error())
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, element json.RawMessage, simReq *SimRequest) {
+			defer wg.Done()
+			resp, ok := s.waitForBatchElement(ctx, log.With("batchIndex", i), simReq, startTime)
+			if !ok {
+				return
+			}
+			payload := bytes.TrimSpace(resp.Payload)
+			if resp.Error != nil {
+				responses[i] = newJSONRPCErrorResponse(element, JSONRPCErrorInternal, resp.Error.Error())
+			} else if !json.Valid(payload) {
+				responses[i] = newJSONRPCErrorResponse(element, JSONRPCErrorInternal, "invalid JSON response from node")
+			} else {
+				responses[i] = payload
+			}
+		}(i, element, simReq)
+	}
+	log.Infow("Batch added to queue")
+	wg.Wait()
+
+	if ctx.Err() != nil { // client closed the connection
+		return
+	}
+
+	res, err := json.Marshal(responses)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writePayload(w, req, http.StatusOK, append(res, '\n'))
+	log.Infow("Batch completed", "durationMs", time.Since(startTime).Milliseconds())
+}
+
+// queueBatchElement queues a request of a batch. If it was rejected, returns the error kind and the error.
+func (s *Webserver) queueBatchElement(log *zap.SugaredLogger, simReq *SimRequest) (kind string, err error) {
+	if simReq.Priority() == PriorityLowPrio && s.shouldShed() {
+		log.Warn("Couldn't add batch element, shedding low-prio requests")
+		s.shedRequest(simReq)
+		return ErrorKindLoadShed, ErrLoadShed
+	}
+	if !s.acquireClientSlot(simReq) {
+		log.Infow("Couldn't add batch element, too many queued requests of the client", "clientID", simReq.ClientID)
+		return ErrorKindClientQueueLimit, ErrClientQueueLimit
+	}
+	injectedQueueFull := s.nodePool.faults.inject(FaultQueueFull, s.metrics)
+	if injectedQueueFull || !s.prioQueue.Push(simReq) {
+		s.releaseClientSlot(simReq)
+		if injectedQueueFull {
+			log.Warnw("Couldn't add batch element, injected fault", "fault", FaultQueueFull)
+		} else {
+			log.Error("Couldn't add batch element, queue is full")
+		}
+		s.clientStats.Rejected(simReq)
+		s.requests.rejected()
+		s.metricsRejected(simReq, ErrorKindQueueFull)
+		return ErrorKindQueueFull, errors.New("queue full")
+	}
+
+	s.clientStats.Queued(simReq)
+	s.requests.accepted()
+	s.payloadStats.ObserveRequest(simReq)
+	return "", nil
+}
+
+// waitForBatchElement waits for the response of a queued batch element (or async request), and records it in the
+// stats, the audit and the payload log. Returns false if the client closed the connection.
+func (s *Webserver) waitForBatchElement(ctx context.Context, log *zap.SugaredLogger, simReq *SimRequest, startTime time.Time) (resp SimResponse, ok bool) {
+	defer s.releaseClientSlot(simReq)
+	resp, ok = s.waitForResponse(ctx, log, simReq)
+	s.clientStats.Finished(simReq, resp, ok)
+	s.requests.finished(resp, ok)
+	s.metricsFinished(simReq, resp, ok, startTime)
+	if !ok {
+		return resp, false
+	}
+	s.payloadStats.ObserveResponse(simReq, resp)
+
+	s.recordTiming(simReq, resp, startTime)
+	s.audit.Record(simReq, resp, startTime)
+	s.payloadLog.Log(simReq, resp)
+	return resp, true
+}
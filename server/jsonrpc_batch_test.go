@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+type testBatchResponse struct {
+	ID     int           `json:"id"`
+	Result interface{}   `json:"result"`
+	Error  *jsonRPCError `json:"error"`
+}
+
+func sendTestBatch(t *testing.T, webserver *Webserver, ids ...int) []testBatchResponse {
+	t.Helper()
+	batch := make([]*testutils.JSONRPCRequest, len(ids))
+	for i, id := range ids {
+		batch[i] = testutils.NewJSONRPCRequest1(id, "eth_callBundle", id)
+	}
+	reqPayloadBytes, err := json.Marshal(batch)
+	require.Nil(t, err, err)
+
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, httptest.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes)))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	res := []testBatchResponse{}
+	err = json.Unmarshal(rr.Body.Bytes(), &res)
+	require.Nil(t, err, err)
+	require.Equal(t, len(ids), len(res))
+	return res
+}
+
+func TestSplitJSONRPCBatch(t *testing.T) {
+	elements, err := splitJSONRPCBatch(BytesPayload(`{"jsonrpc":"2.0","id":1,"method":"foo"}`))
+	require.Nil(t, err, err)
+	require.Nil(t, elements)
+
+	elements, err = splitJSONRPCBatch(BytesPayload(` [{"id":1}, {"id":2}] `))
+	require.Nil(t, err, err)
+	require.Equal(t, []json.RawMessage{json.RawMessage(`{"id":1}`), json.RawMessage(`{"id":2}`)}, elements)
+
+	_, err = splitJSONRPCBatch(BytesPayload(`[]`))
+	require.Equal(t, ErrJSONRPCEmptyBatch, err)
+	_, err = splitJSONRPCBatch(BytesPayload(`[{"id":1}`))
+	require.Equal(t, ErrJSONRPCInvalidJSON, err)
+}
+
+func TestWebserverJSONRPCBatch(t *testing.T) {
+	defer func(split bool) { SplitJSONRPCBatches = split }(SplitJSONRPCBatches)
+	SplitJSONRPCBatches = true
+
+	t.Run("responses are in request order", func(t *testing.T) {
+		webserver, mockNodeBackend := newTestWebserver(t, 3)
+
+		// Earlier elements take longer, so they complete last
+		mockNodeBackend.RPCHandlerOverride = func(req *testutils.JSONRPCRequest) (result interface{}, err error) {
+			time.Sleep(time.Duration(4-req.ID.(float64)) * 20 * time.Millisecond)
+			return req.ID, nil
+		}
+
+		res := sendTestBatch(t, webserver, 1, 2, 3)
+		for i, elementResp := range res {
+			require.Equal(t, i+1, elementResp.ID)
+			require.Equal(t, float64(i+1), elementResp.Result)
+			require.Nil(t, elementResp.Error)
+		}
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		webserver, mockNodeBackend := newTestWebserver(t, 1)
+
+		mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+			if strings.Contains(string(body), `"id":2`) {
+				http.Error(w, "node error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"cool"}`))
+		}
+
+		res := sendTestBatch(t, webserver, 1, 2)
+		require.Equal(t, "cool", res[0].Result)
+		require.Nil(t, res[0].Error)
+		require.Equal(t, 2, res[1].ID)
+		require.NotNil(t, res[1].Error)
+		require.Equal(t, JSONRPCErrorInternal, res[1].Error.Code)
+	})
+
+	t.Run("elements time out individually", func(t *testing.T) {
+		defer func(timeout time.Duration) { RequestTimeout = timeout }(RequestTimeout)
+		RequestTimeout = 100 * time.Millisecond
+
+		webserver, mockNodeBackend := newTestWebserver(t, 1)
+		mockNodeBackend.RPCHandlerOverride = func(req *testutils.JSONRPCRequest) (result interface{}, err error) {
+			time.Sleep(150 * time.Millisecond)
+			return "cool", nil
+		}
+
+		res := sendTestBatch(t, webserver, 1, 2, 3)
+		require.Equal(t, "cool", res[0].Result)
+		for _, elementResp := range res[1:] {
+			require.NotNil(t, elementResp.Error)
+			require.Contains(t, elementResp.Error.Message, "request timeout")
+		}
+	})
+
+	t.Run("invalid batches and elements", func(t *testing.T) {
+		defer func(validate bool) { ValidateJSONRPC = validate }(ValidateJSONRPC)
+		ValidateJSONRPC = true
+
+		webserver, _ := newTestWebserver(t, 1)
+
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, httptest.NewRequest("POST", "/", strings.NewReader("[]")))
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+
+		rr = httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, httptest.NewRequest("POST", "/", strings.NewReader(`[{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}, {"id":2}]`)))
+		require.Equal(t, http.StatusOK, rr.Code)
+		res := []testBatchResponse{}
+		err := json.Unmarshal(rr.Body.Bytes(), &res)
+		require.Nil(t, err, err)
+		require.Equal(t, 2, len(res))
+		require.Nil(t, res[0].Error)
+		require.Equal(t, 2, res[1].ID)
+		require.Equal(t, JSONRPCErrorInvalidRequest, res[1].Error.Code)
+	})
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateJSONRPCRequest(t *testing.T) {
+	allowlist := ParseMethodAllowlist("eth_callBundle, eth_call")
+
+	tests := []struct {
+		name           string
+		payload        string
+		allowedMethods map[string]bool
+		expectedErr    error
+	}{
+		{"valid", `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`, nil, nil},
+		{"valid string id", `{"jsonrpc":"2.0","method":"eth_callBundle","params":{},"id":"abc"}`, nil, nil},
+		{"valid without params", `{"jsonrpc":"2.0","method":"eth_callBundle","id":-1}`, nil, nil},
+		{"valid allowed method", `{"jsonrpc":"2.0","method":"eth_call","params":[],"id":1}`, allowlist, nil},
+		{"empty", ``, nil, ErrJSONRPCInvalidJSON},
+		{"invalid json", `{"jsonrpc":"2.0",`, nil, ErrJSONRPCInvalidJSON},
+		{"batch", `[{"jsonrpc":"2.0","method":"eth_call","params":[],"id":1}]`, nil, ErrJSONRPCNotAnObject},
+		{"string", `"foo"`, nil, ErrJSONRPCNotAnObject},
+		{"missing version", `{"method":"eth_callBundle","params":[],"id":1}`, nil, ErrJSONRPCInvalidVersion},
+		{"wrong version", `{"jsonrpc":"1.0","method":"eth_callBundle","params":[],"id":1}`, nil, ErrJSONRPCInvalidVersion},
+		{"numeric version", `{"jsonrpc":2.0,"method":"eth_callBundle","params":[],"id":1}`, nil, ErrJSONRPCInvalidVersion},
+		{"missing method", `{"jsonrpc":"2.0","params":[],"id":1}`, nil, ErrJSONRPCInvalidMethod},
+		{"empty method", `{"jsonrpc":"2.0","method":"","params":[],"id":1}`, nil, ErrJSONRPCInvalidMethod},
+		{"numeric method", `{"jsonrpc":"2.0","method":1,"params":[],"id":1}`, nil, ErrJSONRPCInvalidMethod},
+		{"missing id", `{"jsonrpc":"2.0","method":"eth_callBundle","params":[]}`, nil, ErrJSONRPCInvalidID},
+		{"null id", `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":null}`, nil, ErrJSONRPCInvalidID},
+		{"object id", `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":{}}`, nil, ErrJSONRPCInvalidID},
+		{"invalid params", `{"jsonrpc":"2.0","method":"eth_callBundle","params":"foo","id":1}`, nil, ErrJSONRPCInvalidParams},
+		{"disallowed method", `{"jsonrpc":"2.0","method":"eth_sendRawTransaction","params":[],"id":1}`, allowlist, ErrJSONRPCMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateJSONRPCRequest([]byte(tt.payload), tt.allowedMethods)
+			if tt.expectedErr == nil {
+				require.Nil(t, err, err)
+			} else {
+				require.ErrorIs(t, err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestParseMethodAllowlist(t *testing.T) {
+	require.Nil(t, ParseMethodAllowlist(""))
+	require.Nil(t, ParseMethodAllowlist(" , "))
+	require.Equal(t, map[string]bool{"eth_call": true, "eth_callBundle": true}, ParseMethodAllowlist("eth_call, eth_callBundle"))
+}
+
+func TestWebserverJSONRPCValidation(t *testing.T) {
+	defer func(validate bool, allowlist map[string]bool) {
+		ValidateJSONRPC, JSONRPCAllowedMethods = validate, allowlist
+	}(ValidateJSONRPC, JSONRPCAllowedMethods)
+	ValidateJSONRPC = true
+	JSONRPCAllowedMethods = ParseMethodAllowlist("eth_callBundle")
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+
+	// Invalid requests are rejected before being queued
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_call","params":[],"id":1}`)))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), "method not allowed: eth_call")
+	require.Equal(t, 0, prioQueue.NumRequests())
+
+	rr = httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"method":"eth_callBundle","params":[],"id":1}`)))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, decodeErrorResponse(t, rr).Message, `"jsonrpc" must be "2.0"`)
+	require.Equal(t, 0, prioQueue.NumRequests())
+}
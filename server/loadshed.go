@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// LoadShedStats are the state and counters of the load shedding (see /stats/queue)
+type LoadShedStats struct {
+	Shedding    bool      `json:"shedding"`
+	Since       time.Time `json:"since"`       // when the current shedding started (zero if not shedding)
+	NumRejected int64     `json:"numRejected"` // new low-prio requests rejected while shedding
+	NumFlushed  int64     `json:"numFlushed"`  // queued low-prio requests failed when shedding started
+}
+
+// LoadShedder decides when to shed low-prio requests: while the backlog of fast-track and high-prio requests reaches
+// maxDepth queued requests, or the oldest of them waited maxAge (a limit of 0 disables it). Shedding stops only once
+// both dropped below resumeFraction of the limits (hysteresis), so that it doesn't flap around the thresholds.
+type LoadShedder struct {
+	maxDepth       int
+	maxAge         time.Duration
+	resumeFraction float64
+
+	lock     sync.Mutex
+	shedding bool
+	since    time.Time
+
+	numRejected atomic.Int64
+	numFlushed  atomic.Int64
+}
+
+func NewLoadShedder(maxDepth int, maxAge time.Duration, resumeFraction float64) *LoadShedder {
+	return &LoadShedder{maxDepth: maxDepth, maxAge: maxAge, resumeFraction: resumeFraction}
+}
+
+// Update checks the backlog of q at now, and returns whether low-prio requests are shed, and whether the shedding
+// started or stopped with this update
+func (l *LoadShedder) Update(q Queue, now time.Time) (shedding, changed bool) {
+	lenFastTrack, lenHighPrio, _ := q.Len()
+	depth := lenFastTrack + lenHighPrio
+	var age time.Duration // of the oldest fast-track or high-prio request
+	oldestFastTrack, oldestHighPrio, _ := q.OldestQueuedAt()
+	for _, queuedAt := range []time.Time{oldestFastTrack, oldestHighPrio} {
+		if !queuedAt.IsZero() && now.Sub(queuedAt) > age {
+			age = now.Sub(queuedAt)
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.shedding {
+		over := (l.maxDepth > 0 && depth >= l.maxDepth) || (l.maxAge > 0 && age >= l.maxAge)
+		if over {
+			l.shedding, l.since = true, now
+			return true, true
+		}
+	} else {
+		under := (l.maxDepth <= 0 || float64(depth) < l.resumeFraction*float64(l.maxDepth)) &&
+			(l.maxAge <= 0 || float64(age) < l.resumeFraction*float64(l.maxAge))
+		if under {
+			l.shedding, l.since = false, time.Time{}
+			return false, true
+		}
+	}
+	return l.shedding, false
+}
+
+func (l *LoadShedder) Stats() LoadShedStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return LoadShedStats{
+		Shedding:    l.shedding,
+		Since:       l.since,
+		NumRejected: l.numRejected.Load(),
+		NumFlushed:  l.numFlushed.Load(),
+	}
+}
+
+// EnableLoadShedding rejects new low-prio requests with 503 while shedder is shedding. With flushLowPrio the queued
+// low-prio requests are failed as well when the shedding starts.
+func (s *Webserver) EnableLoadShedding(shedder *LoadShedder, flushLowPrio bool) {
+	s.shedder = shedder
+	s.shedFlushLowPrio = flushLowPrio
+}
+
+// shouldShed updates the load shedding state, and returns whether new low-prio requests are rejected
+func (s *Webserver) shouldShed() bool {
+	if s.shedder == nil {
+		return false
+	}
+	shedding, changed := s.shedder.Update(s.prioQueue, time.Now())
+	if !changed {
+		return shedding
+	}
+
+	lenFastTrack, lenHighPrio, lenLowPrio := s.prioQueue.Len()
+	if !shedding {
+		s.log.Infow("Load shedding stopped", "queueSizeFastTrack", lenFastTrack, "queueSizeHighPrio", lenHighPrio, "queueSizeLowPrio", lenLowPrio)
+		return false
+	}
+	s.log.Warnw("Load shedding started, rejecting low-prio requests", "queueSizeFastTrack", lenFastTrack, "queueSizeHighPrio", lenHighPrio, "queueSizeLowPrio", lenLowPrio)
+	if s.shedFlushLowPrio {
+		dropped := s.prioQueue.DropLowPrio()
+		for _, r := range dropped {
+			r.SendResponse(SimResponse{Error: ErrLoadShed, StatusCode: http.StatusServiceUnavailable})
+		}
+		s.shedder.numFlushed.Add(int64(len(dropped)))
+		s.log.Warnw("Load shedding: failed the queued low-prio requests", "numRequests", len(dropped))
+	}
+	return true
+}
+
+// shedRequest counts a low-prio request rejected by the load shedding
+func (s *Webserver) shedRequest(r *SimRequest) {
+	s.shedder.numRejected.Inc()
+	s.clientStats.Rejected(r)
+	s.requests.rejected()
+	s.metricsRejected(r, ErrorKindLoadShed)
+}
+
+// RunLoadShedding checks the high-prio backlog every interval until ctx is cancelled, so that the shedding also
+// starts (flushing the queued low-prio requests) and stops without new low-prio requests. A no-op without
+// EnableLoadShedding or an interval of 0.
+func (s *Webserver) RunLoadShedding(ctx context.Context, interval time.Duration) {
+	if s.shedder == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.shouldShed()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadShedderDepth(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	shedder := NewLoadShedder(4, 0, 0.5)
+	update := func() (bool, bool) { return shedder.Update(q, time.Now()) }
+
+	// Low-prio requests don't count
+	for i := 0; i < 10; i++ {
+		q.Push(NewSimRequest(context.Background(), "low", []byte("x"), false, false))
+	}
+	q.Push(NewSimRequest(context.Background(), "fast", []byte("x"), false, true))
+	for i := 0; i < 2; i++ {
+		q.Push(NewSimRequest(context.Background(), "high", []byte("x"), true, false))
+	}
+	shedding, changed := update()
+	require.False(t, shedding)
+	require.False(t, changed)
+
+	q.Push(NewSimRequest(context.Background(), "high", []byte("x"), true, false))
+	shedding, changed = update()
+	require.True(t, shedding)
+	require.True(t, changed)
+	require.True(t, shedder.Stats().Shedding)
+
+	// Hysteresis: shedding continues until the backlog is below 2
+	q.Pop()
+	q.Pop()
+	shedding, changed = update()
+	require.True(t, shedding)
+	require.False(t, changed)
+	q.Pop()
+	shedding, changed = update()
+	require.False(t, shedding)
+	require.True(t, changed)
+	require.Equal(t, LoadShedStats{}, shedder.Stats())
+}
+
+func TestLoadShedderAge(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	shedder := NewLoadShedder(0, 100*time.Millisecond, 0.5)
+	r := NewSimRequest(context.Background(), "high", []byte("x"), true, false)
+	q.Push(r)
+
+	shedding, _ := shedder.Update(q, r.QueuedAt.Add(99*time.Millisecond))
+	require.False(t, shedding)
+	shedding, changed := shedder.Update(q, r.QueuedAt.Add(100*time.Millisecond))
+	require.True(t, shedding)
+	require.True(t, changed)
+	require.Equal(t, r.QueuedAt.Add(100*time.Millisecond), shedder.Stats().Since)
+
+	// A newer request behind the old one doesn't stop it, the age of the oldest one counts
+	q.Pop()
+	r = NewSimRequest(context.Background(), "high", []byte("x"), true, false)
+	q.Push(r)
+	shedding, _ = shedder.Update(q, r.QueuedAt.Add(60*time.Millisecond))
+	require.True(t, shedding)
+	shedding, changed = shedder.Update(q, r.QueuedAt.Add(40*time.Millisecond))
+	require.False(t, shedding)
+	require.True(t, changed)
+}
+
+func TestWebserverLoadShedding(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	webserver.EnableLoadShedding(NewLoadShedder(2, 0, 0.5), true)
+	handler := webserver.Handler()
+
+	// send returns the response of a low-prio request once it completes (there is no main loop)
+	send := func(ctx context.Context) <-chan *httptest.ResponseRecorder {
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, newSimTestRequest(`{"id":1}`).WithContext(ctx))
+			res <- rr
+		}()
+		return res
+	}
+	waitForLowPrio := func(n int) {
+		require.Eventually(t, func() bool {
+			_, _, lenLowPrio := prioQueue.Len()
+			return lenLowPrio == n
+		}, time.Second, 5*time.Millisecond)
+	}
+
+	// Below the threshold, low-prio requests are queued
+	queued := send(context.Background())
+	waitForLowPrio(1)
+	prioQueue.Push(NewSimRequest(context.Background(), "fast", []byte("x"), false, true))
+	prioQueue.Push(NewSimRequest(context.Background(), "high", []byte("x"), true, false))
+
+	// Over the threshold, new ones are rejected and the queued one is failed
+	rr := <-send(context.Background())
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, ErrorKindLoadShed, rr.Header().Get("X-Error-Kind"))
+	require.Equal(t, ErrorCodeLoadShed, decodeErrorResponse(t, rr).Code)
+	rr = <-queued
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, ErrorCodeLoadShed, decodeErrorResponse(t, rr).Code)
+	waitForLowPrio(0)
+
+	// Still shedding with the backlog at 1, until it's below 1
+	prioQueue.Pop()
+	rr = <-send(context.Background())
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	prioQueue.Pop()
+	ctx, cancel := context.WithCancel(context.Background())
+	queued = send(ctx)
+	waitForLowPrio(1)
+	cancel()
+	<-queued
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/queue", nil))
+	var stats QueueStatsResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&stats))
+	require.Equal(t, &LoadShedStats{NumRejected: 2, NumFlushed: 1}, stats.LoadShed)
+}
+
+func TestRunLoadShedding(t *testing.T) {
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	webserver := NewWebserver(testLog, ":12345", prioQueue, NewNodePool(testLog, nil, 1))
+	shedder := NewLoadShedder(1, 0, 0.5)
+	webserver.EnableLoadShedding(shedder, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go webserver.RunLoadShedding(ctx, 5*time.Millisecond)
+
+	// The queued low-prio requests are failed without new low-prio requests
+	low := NewSimRequest(context.Background(), "low", []byte("x"), false, false)
+	prioQueue.Push(low)
+	prioQueue.Push(NewSimRequest(context.Background(), "high", []byte("x"), true, false))
+	select {
+	case resp := <-low.ResponseC:
+		require.ErrorIs(t, resp.Error, ErrLoadShed)
+	case <-time.After(time.Second):
+		t.Fatal("the low-prio request was not failed")
+	}
+
+	prioQueue.Pop()
+	require.Eventually(t, func() bool { return !shedder.Stats().Shedding }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogLevelController changes the level of the shared zap.AtomicLevel at runtime, optionally reverting it after a while
+type LogLevelController struct {
+	log   *zap.SugaredLogger
+	level zap.AtomicLevel
+
+	lock        sync.Mutex
+	revertTimer *time.Timer
+	revertAt    time.Time
+}
+
+func NewLogLevelController(log *zap.SugaredLogger, level zap.AtomicLevel) *LogLevelController {
+	return &LogLevelController{
+		log:   log,
+		level: level,
+	}
+}
+
+// SetLevel sets the new level and returns the previous one. If revertAfter > 0, the previous level is restored
+// after that duration. Any pending revert is cancelled.
+func (c *LogLevelController) SetLevel(level zapcore.Level, revertAfter time.Duration) (previous zapcore.Level) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.revertTimer != nil {
+		c.revertTimer.Stop()
+		c.revertTimer = nil
+		c.revertAt = time.Time{}
+	}
+
+	previous = c.level.Level()
+	c.changeLevel(previous, level, "Log level changed")
+
+	if revertAfter > 0 {
+		c.revertAt = time.Now().UTC().Add(revertAfter)
+		var timer *time.Timer
+		timer = time.AfterFunc(revertAfter, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			if c.revertTimer != timer { // replaced by a later change
+				return
+			}
+			c.revertTimer = nil
+			c.revertAt = time.Time{}
+			c.changeLevel(level, previous, "Log level reverted")
+		})
+		c.revertTimer = timer
+	}
+	return previous
+}
+
+// changeLevel sets the level and logs the change at warn level, while the more verbose of both levels is active (so
+// the change is still logged when switching to error)
+func (c *LogLevelController) changeLevel(from, to zapcore.Level, msg string) {
+	if to > from {
+		c.log.Warnw(msg, "previous", from.String(), "level", to.String())
+		c.level.SetLevel(to)
+	} else {
+		c.level.SetLevel(to)
+		c.log.Warnw(msg, "previous", from.String(), "level", to.String())
+	}
+}
+
+// Level returns the current level, and when it will be reverted (zero if no revert is pending)
+func (c *LogLevelController) Level() (level zapcore.Level, revertAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.level.Level(), c.revertAt
+}
+
+type LogLevelRequest struct {
+	Level              string `json:"level"`                        // debug, info, warn or error
+	RevertAfterMinutes int    `json:"revertAfterMinutes,omitempty"` // (optional) restore the previous level afterwards
+}
+
+type LogLevelResponse struct {
+	Previous string     `json:"previous,omitempty"`
+	Level    string     `json:"level"`
+	RevertAt *time.Time `json:"revertAt,omitempty"`
+}
+
+// parseLogLevel only accepts the levels which make sense to switch to at runtime
+func parseLogLevel(s string) (level zapcore.Level, ok bool) {
+	switch s {
+	case "debug", "info", "warn", "error":
+		err := level.UnmarshalText([]byte(s))
+		return level, err == nil
+	}
+	return level, false
+}
+
+// HandleLogLevelRequest returns the current log level (GET), or changes it (PUT)
+func (s *Webserver) HandleLogLevelRequest(w http.ResponseWriter, req *http.Request) {
+	if s.logLevel == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "log level adjustment is not enabled")
+		return
+	}
+
+	res := LogLevelResponse{}
+	if req.Method == http.MethodPut {
+		var levelReq LogLevelRequest
+		if err := json.NewDecoder(req.Body).Decode(&levelReq); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		level, ok := parseLogLevel(levelReq.Level)
+		if !ok {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid level, must be one of debug, info, warn, error")
+			return
+		} else if levelReq.RevertAfterMinutes < 0 {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "revertAfterMinutes must not be negative")
+			return
+		}
+		res.Previous = s.logLevel.SetLevel(level, time.Duration(levelReq.RevertAfterMinutes)*time.Minute).String()
+	}
+
+	level, revertAt := s.logLevel.Level()
+	res.Level = level.String()
+	if !revertAt.IsZero() {
+		res.RevertAt = &revertAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func newObservedLogger(level zap.AtomicLevel) (*zap.SugaredLogger, *observer.ObservedLogs) {
+	core, logs := observer.New(level)
+	return zap.New(core).Sugar(), logs
+}
+
+func TestLogLevelController(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	log, logs := newObservedLogger(level)
+	c := NewLogLevelController(log, level)
+
+	log.Debug("hidden")
+	require.Equal(t, 0, logs.FilterMessage("hidden").Len())
+
+	previous := c.SetLevel(zapcore.DebugLevel, 0)
+	require.Equal(t, zapcore.InfoLevel, previous)
+	log.Debug("visible")
+	require.Equal(t, 1, logs.FilterMessage("visible").Len())
+	require.Equal(t, zapcore.WarnLevel, logs.FilterMessage("Log level changed").All()[0].Level)
+
+	// The change to error is still logged
+	c.SetLevel(zapcore.ErrorLevel, 0)
+	require.Equal(t, 2, logs.FilterMessage("Log level changed").Len())
+	log.Warn("hidden")
+	require.Equal(t, 0, logs.FilterMessage("hidden").Len())
+
+	// Auto-revert
+	c.SetLevel(zapcore.DebugLevel, 50*time.Millisecond)
+	_, revertAt := c.Level()
+	require.False(t, revertAt.IsZero())
+	require.Eventually(t, func() bool { return level.Level() == zapcore.ErrorLevel }, time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, logs.FilterMessage("Log level reverted").Len())
+	_, revertAt = c.Level()
+	require.True(t, revertAt.IsZero())
+
+	// A later change cancels the pending revert
+	c.SetLevel(zapcore.DebugLevel, 50*time.Millisecond)
+	c.SetLevel(zapcore.InfoLevel, 0)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, zapcore.InfoLevel, level.Level())
+}
+
+func TestWebserverLogLevel(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	log, logs := newObservedLogger(level)
+	webserver := NewWebserver(log, ":12345", NewPrioQueue(0, 0, 0, 2, false, PriorityAging{}), NewNodePool(log, nil, 1))
+
+	rr := httptest.NewRecorder()
+	webserver.HandleLogLevelRequest(rr, httptest.NewRequest("GET", "/admin/loglevel", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	webserver.EnableLogLevelAdjustment(level)
+	setLevel := func(body string) (int, LogLevelResponse) {
+		rr := httptest.NewRecorder()
+		webserver.HandleLogLevelRequest(rr, httptest.NewRequest("PUT", "/admin/loglevel", bytes.NewBufferString(body)))
+		res := LogLevelResponse{}
+		if rr.Code == http.StatusOK {
+			require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		}
+		return rr.Code, res
+	}
+
+	code, res := setLevel(`{"level":"debug","revertAfterMinutes":10}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "info", res.Previous)
+	require.Equal(t, "debug", res.Level)
+	require.NotNil(t, res.RevertAt)
+	log.Debug("visible")
+	require.Equal(t, 1, logs.FilterMessage("visible").Len())
+
+	code, res = setLevel(`{"level":"info"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "debug", res.Previous)
+	require.Nil(t, res.RevertAt)
+	log.Debug("hidden")
+	require.Equal(t, 0, logs.FilterMessage("hidden").Len())
+
+	code, _ = setLevel(`{"level":"fatal"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = setLevel(`{"level":"debug","revertAfterMinutes":-1}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, zapcore.InfoLevel, level.Level())
+}
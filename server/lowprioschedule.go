@@ -0,0 +1,318 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// lowPrioScheduleMaxSleep is the longest time the scheduler sleeps between checks of the windows, so that clock
+// changes are noticed
+var lowPrioScheduleMaxSleep = time.Minute
+
+// LowPrioSettings are the scheduling parameters of the low-prio queue (see PrioQueue.SetLowPrioScheduling)
+type LowPrioSettings struct {
+	Paused bool `json:"paused"`           // low-prio requests stay queued
+	EveryN int  `json:"everyN,omitempty"` // a low-prio request is popped after every n other ones (0: only when the others are empty)
+}
+
+func (s LowPrioSettings) validate() error {
+	if s.EveryN < 0 {
+		return fmt.Errorf("everyN must not be negative")
+	}
+	return nil
+}
+
+// LowPrioWindow applies its settings every day from Start to End ("HH:MM" in the schedule timezone, End may be on the
+// next day)
+type LowPrioWindow struct {
+	Name  string `json:"name"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+	LowPrioSettings
+
+	start, end int // minutes since midnight
+}
+
+// contains returns whether the window includes the minute of the day
+func (w LowPrioWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// ParseLowPrioSchedule parses a JSON list of daily windows (an empty string returns no windows), i.e.
+// `[{"name":"peak","start":"13:30","end":"20:00","paused":true},{"name":"night","start":"22:00","end":"06:00","everyN":1}]`
+func ParseLowPrioSchedule(s string) (windows []LowPrioWindow, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(s), &windows); err != nil {
+		return nil, err
+	}
+	for i, w := range windows {
+		if w.Name == "" {
+			return nil, fmt.Errorf("window %d: name is required", i)
+		}
+		if windows[i].start, err = parseTimeOfDay(w.Start); err != nil {
+			return nil, errors.Wrapf(err, "window %s: invalid start", w.Name)
+		}
+		if windows[i].end, err = parseTimeOfDay(w.End); err != nil {
+			return nil, errors.Wrapf(err, "window %s: invalid end", w.Name)
+		}
+		if windows[i].start == windows[i].end {
+			return nil, fmt.Errorf("window %s: start and end must differ", w.Name)
+		}
+		if err := w.validate(); err != nil {
+			return nil, errors.Wrapf(err, "window %s", w.Name)
+		}
+	}
+	return windows, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// LowPrioScheduleStatus is the state of the low-prio schedule, as returned by /admin/scheduler and /stats/queue
+type LowPrioScheduleStatus struct {
+	Window           string           `json:"window"`   // name of the active window, empty outside of all windows
+	Settings         LowPrioSettings  `json:"settings"` // the effective settings (of the override, the window or the defaults)
+	Defaults         LowPrioSettings  `json:"defaults"` // the settings outside of all windows
+	Override         *LowPrioSettings `json:"override,omitempty"`
+	Timezone         string           `json:"timezone"`
+	Windows          []LowPrioWindow  `json:"windows"`
+	NextTransitionAt *time.Time       `json:"nextTransitionAt,omitempty"` // the next window boundary
+}
+
+// LowPrioScheduler applies the settings of the daily window which contains the current time to the low-prio queue
+// (the first one if they overlap, otherwise the defaults). A manual override takes precedence until it's cleared.
+type LowPrioScheduler struct {
+	log      *zap.SugaredLogger
+	queue    *PrioQueue
+	windows  []LowPrioWindow
+	location *time.Location
+	defaults LowPrioSettings
+	now      func() time.Time
+
+	lock     sync.Mutex
+	window   *LowPrioWindow // the active window
+	override *LowPrioSettings
+	applied  *LowPrioSettings // the settings applied to the queue
+}
+
+func NewLowPrioScheduler(log *zap.SugaredLogger, queue *PrioQueue, windows []LowPrioWindow, location *time.Location, defaults LowPrioSettings) *LowPrioScheduler {
+	if location == nil {
+		location = time.UTC
+	}
+	return &LowPrioScheduler{
+		log:      log,
+		queue:    queue,
+		windows:  windows,
+		location: location,
+		defaults: defaults,
+		now:      time.Now,
+	}
+}
+
+// newLowPrioSchedulerFromEnv returns the scheduler of LOWPRIO_SCHEDULE, with ITEMS_LOWPRIO_EVERY_N outside of its windows
+func newLowPrioSchedulerFromEnv(log *zap.SugaredLogger, queue *PrioQueue) (*LowPrioScheduler, error) {
+	windows, err := ParseLowPrioSchedule(LowPrioSchedule)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LOWPRIO_SCHEDULE")
+	}
+	location, err := time.LoadLocation(LowPrioScheduleTimezone)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LOWPRIO_SCHEDULE_TIMEZONE")
+	}
+	defaults := LowPrioSettings{EveryN: LowPrioEveryN}
+	if err := defaults.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid ITEMS_LOWPRIO_EVERY_N")
+	}
+	if len(windows) > 0 {
+		log.Infow("Low-prio schedule enabled", "numWindows", len(windows), "timezone", location.String())
+	}
+	scheduler := NewLowPrioScheduler(log, queue, windows, location, defaults)
+	scheduler.Update()
+	return scheduler, nil
+}
+
+// windowAt returns the window which contains t (nil if none)
+func (s *LowPrioScheduler) windowAt(t time.Time) *LowPrioWindow {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	for i := range s.windows {
+		if s.windows[i].contains(minute) {
+			return &s.windows[i]
+		}
+	}
+	return nil
+}
+
+// nextTransition returns the next start or end of a window after t (zero without windows)
+func (s *LowPrioScheduler) nextTransition(t time.Time) (next time.Time) {
+	t = t.In(s.location)
+	for _, w := range s.windows {
+		for _, minute := range []int{w.start, w.end} {
+			boundary := time.Date(t.Year(), t.Month(), t.Day(), minute/60, minute%60, 0, 0, s.location)
+			if !boundary.After(t) {
+				boundary = time.Date(t.Year(), t.Month(), t.Day()+1, minute/60, minute%60, 0, 0, s.location)
+			}
+			if next.IsZero() || boundary.Before(next) {
+				next = boundary
+			}
+		}
+	}
+	return next
+}
+
+// Update applies the settings of the current window (or of the override), and logs the transitions between windows
+func (s *LowPrioScheduler) Update() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.update()
+}
+
+// update is Update with the lock held
+func (s *LowPrioScheduler) update() {
+	if window := s.windowAt(s.now()); window != s.window {
+		previous, current := "", ""
+		if s.window != nil {
+			previous = s.window.Name
+		}
+		if window != nil {
+			current = window.Name
+		}
+		s.window = window
+		s.log.Infow("Low-prio schedule window changed", "window", current, "previous", previous, "overridden", s.override != nil)
+	}
+	s.apply()
+}
+
+// apply sets the effective settings on the queue, if they changed. The lock must be held.
+func (s *LowPrioScheduler) apply() {
+	settings := s.effective()
+	if s.applied != nil && *s.applied == settings {
+		return
+	}
+	s.applied = &settings
+	s.queue.SetLowPrioScheduling(settings.Paused, settings.EveryN)
+	s.log.Infow("Low-prio scheduling applied", "paused", settings.Paused, "everyN", settings.EveryN, "overridden", s.override != nil)
+}
+
+// effective returns the settings of the override, the active window or the defaults. The lock must be held.
+func (s *LowPrioScheduler) effective() LowPrioSettings {
+	if s.override != nil {
+		return *s.override
+	} else if s.window != nil {
+		return s.window.LowPrioSettings
+	}
+	return s.defaults
+}
+
+// Run applies the windows at their boundaries, until ctx is done
+func (s *LowPrioScheduler) Run(ctx context.Context) {
+	for {
+		s.Update()
+		sleep := lowPrioScheduleMaxSleep
+		if next := s.nextTransition(s.now()); !next.IsZero() && next.Sub(s.now()) < sleep {
+			sleep = next.Sub(s.now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// SetOverride applies settings regardless of the windows, until ClearOverride is called
+func (s *LowPrioScheduler) SetOverride(settings LowPrioSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.override = &settings
+	s.log.Infow("Low-prio schedule overridden", "paused", settings.Paused, "everyN", settings.EveryN)
+	s.apply()
+	return nil
+}
+
+// ClearOverride applies the windows again
+func (s *LowPrioScheduler) ClearOverride() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.override != nil {
+		s.override = nil
+		s.log.Info("Low-prio schedule override cleared")
+	}
+	s.update()
+}
+
+func (s *LowPrioScheduler) Status() LowPrioScheduleStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := LowPrioScheduleStatus{
+		Settings: s.effective(),
+		Defaults: s.defaults,
+		Timezone: s.location.String(),
+		Windows:  append([]LowPrioWindow{}, s.windows...),
+	}
+	if s.window != nil {
+		status.Window = s.window.Name
+	}
+	if s.override != nil {
+		override := *s.override
+		status.Override = &override
+	}
+	if next := s.nextTransition(s.now()); !next.IsZero() {
+		status.NextTransitionAt = &next
+	}
+	return status
+}
+
+// EnableLowPrioScheduler exposes the schedule of the low-prio queue on /admin/scheduler and /stats/queue
+func (s *Webserver) EnableLowPrioScheduler(scheduler *LowPrioScheduler) {
+	s.lowPrioScheduler = scheduler
+}
+
+// HandleSchedulerRequest returns the low-prio schedule (GET), overrides its settings with the ones of the request body
+// until cleared (PUT), or clears the override (DELETE)
+func (s *Webserver) HandleSchedulerRequest(w http.ResponseWriter, req *http.Request) {
+	if s.lowPrioScheduler == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "the low-prio scheduler is not enabled")
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		var settings LowPrioSettings
+		if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if err := s.lowPrioScheduler.SetOverride(settings); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+	case http.MethodDelete:
+		s.lowPrioScheduler.ClearOverride()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.lowPrioScheduler.Status()); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLowPrioSchedule(t *testing.T) {
+	windows, err := ParseLowPrioSchedule(`[{"name":"peak","start":"13:30","end":"20:00","paused":true},{"name":"night","start":"22:00","end":"06:00","everyN":1}]`)
+	require.Nil(t, err, err)
+	require.Len(t, windows, 2)
+	require.True(t, windows[0].Paused)
+	require.Equal(t, 13*60+30, windows[0].start)
+	require.Equal(t, 1, windows[1].EveryN)
+	require.True(t, windows[1].contains(23*60))
+	require.True(t, windows[1].contains(5*60+59))
+	require.False(t, windows[1].contains(6*60))
+
+	windows, err = ParseLowPrioSchedule("")
+	require.Nil(t, err, err)
+	require.Nil(t, windows)
+
+	for _, invalid := range []string{
+		`{}`,
+		`[{"start":"13:30","end":"20:00"}]`,
+		`[{"name":"a","start":"25:00","end":"20:00"}]`,
+		`[{"name":"a","start":"13:30","end":"1pm"}]`,
+		`[{"name":"a","start":"13:30","end":"13:30"}]`,
+		`[{"name":"a","start":"13:30","end":"20:00","everyN":-1}]`,
+	} {
+		_, err := ParseLowPrioSchedule(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
+
+func TestLowPrioScheduler(t *testing.T) {
+	windows, err := ParseLowPrioSchedule(`[{"name":"peak","start":"13:30","end":"20:00","paused":true},{"name":"night","start":"22:00","end":"06:00","everyN":1}]`)
+	require.Nil(t, err, err)
+	location := time.FixedZone("EST", -5*60*60)
+	now := time.Date(2026, 3, 2, 13, 29, 0, 0, location)
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer q.Close()
+	s := NewLowPrioScheduler(testLog, q, windows, location, LowPrioSettings{})
+	s.now = func() time.Time { return now }
+
+	push := func(ids ...string) {
+		for _, id := range ids {
+			require.True(t, q.Push(NewSimRequest(context.Background(), id, []byte(id), id[0] == 'h', false)))
+		}
+	}
+	popOrder := func(n int) (ids []string) {
+		for i := 0; i < n; i++ {
+			ids = append(ids, q.Pop().ID)
+		}
+		return ids
+	}
+
+	// Before the peak window: low-prio requests are popped once the high-prio ones are done
+	s.Update()
+	require.Equal(t, "", s.Status().Window)
+	require.Equal(t, time.Date(2026, 3, 2, 13, 30, 0, 0, location), *s.Status().NextTransitionAt)
+	push("l1", "h1", "h2")
+	require.Equal(t, []string{"h1", "h2", "l1"}, popOrder(3))
+
+	// Crossing into the peak window pauses the low-prio queue
+	now = now.Add(time.Minute)
+	s.Update()
+	require.Equal(t, "peak", s.Status().Window)
+	require.True(t, s.Status().Settings.Paused)
+	push("l1", "h1")
+	require.Equal(t, []string{"h1"}, popOrder(1))
+	popped := make(chan *SimRequest, 1)
+	go func() { popped <- q.Pop() }()
+	select {
+	case r := <-popped:
+		t.Fatalf("low-prio request %s popped while paused", r.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A manual override takes precedence over the windows until cleared
+	require.NotNil(t, s.SetOverride(LowPrioSettings{EveryN: -1}))
+	require.Nil(t, s.SetOverride(LowPrioSettings{EveryN: 1}))
+	require.Equal(t, "l1", (<-popped).ID)
+	now = time.Date(2026, 3, 2, 22, 0, 0, 0, location)
+	s.Update()
+	now = time.Date(2026, 3, 3, 14, 0, 0, 0, location) // peak again
+	s.Update()
+	status := s.Status()
+	require.Equal(t, "peak", status.Window)
+	require.Equal(t, LowPrioSettings{EveryN: 1}, status.Settings)
+	require.Equal(t, &LowPrioSettings{EveryN: 1}, status.Override)
+	push("l1", "h1", "h2", "h3")
+	require.Equal(t, []string{"h1", "l1", "h2", "h3"}, popOrder(4))
+	s.ClearOverride()
+	require.Nil(t, s.Status().Override)
+	require.True(t, s.Status().Settings.Paused)
+
+	// The night window pops a low-prio request after every other one (the last one was popped two requests ago)
+	now = time.Date(2026, 3, 3, 21, 59, 59, 0, location)
+	s.Update()
+	require.Equal(t, "", s.Status().Window)
+	now = now.Add(time.Second)
+	s.Update()
+	require.Equal(t, "night", s.Status().Window)
+	push("l1", "l2", "h1", "h2", "h3")
+	require.Equal(t, []string{"l1", "h1", "l2", "h2", "h3"}, popOrder(5))
+}
+
+func TestLowPrioSchedulerClosedQueue(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	q.SetLowPrioScheduling(true, 0)
+	require.True(t, q.Push(NewSimRequest(context.Background(), "l1", []byte("l1"), false, false)))
+	popped := make(chan *SimRequest, 1)
+	go func() { popped <- q.Pop() }()
+	time.Sleep(20 * time.Millisecond)
+
+	// The paused requests are returned once the queue is closed
+	q.Close()
+	select {
+	case r := <-popped:
+		require.Equal(t, "l1", r.ID)
+	case <-time.After(time.Second):
+		t.Fatal("Pop did not return after Close")
+	}
+	require.Nil(t, q.Pop())
+}
+
+func TestWebserverSchedulerRequest(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	handler := webserver.Handler()
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/admin/scheduler", "").Code)
+
+	windows, err := ParseLowPrioSchedule(`[{"name":"always","start":"00:00","end":"23:59","everyN":3}]`)
+	require.Nil(t, err, err)
+	scheduler := NewLowPrioScheduler(testLog, webserver.prioQueue.(*PrioQueue), windows, time.UTC, LowPrioSettings{})
+	scheduler.now = func() time.Time { return time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC) }
+	scheduler.Update()
+	webserver.EnableLowPrioScheduler(scheduler)
+
+	decode := func(rr *httptest.ResponseRecorder) (status LowPrioScheduleStatus) {
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&status))
+		return status
+	}
+	status := decode(serve(http.MethodGet, "/admin/scheduler", ""))
+	require.Equal(t, "always", status.Window)
+	require.Equal(t, LowPrioSettings{EveryN: 3}, status.Settings)
+	require.Equal(t, "UTC", status.Timezone)
+
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/admin/scheduler", `{"everyN":-1}`).Code)
+	status = decode(serve(http.MethodPut, "/admin/scheduler", `{"paused":true}`))
+	require.Equal(t, LowPrioSettings{Paused: true}, status.Settings)
+	require.Equal(t, &LowPrioSettings{Paused: true}, status.Override)
+
+	// The active window is also part of the queue stats
+	var queueStats QueueStatsResponse
+	rr := serve(http.MethodGet, "/stats/queue", "")
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&queueStats))
+	require.Equal(t, "always", queueStats.LowPrioSchedule.Window)
+	require.True(t, queueStats.LowPrioSchedule.Settings.Paused)
+
+	status = decode(serve(http.MethodDelete, "/admin/scheduler", ""))
+	require.Nil(t, status.Override)
+	require.Equal(t, LowPrioSettings{EveryN: 3}, status.Settings)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// Names of the metrics (DogStatsD prefixes them with MetricsStatsDPrefix)
+const (
+	MetricRequests          = "requests"            // count of completed requests, by priority and error kind
+	MetricRequestDuration   = "request.duration"    // timing of the full request, by priority
+	MetricQueueWait         = "queue.wait"          // timing of the queue wait, by priority
+	MetricQueueSize         = "queue.size"          // gauge of the queued requests, by priority
+	MetricQueueBytes        = "queue.bytes"         // gauge of the size of the queued payloads
+	MetricRequestsInFlight  = "requests.in_flight"  // gauge of the accepted and not completed requests
+	MetricNodes             = "nodes"               // gauge of the nodes in the pool
+	MetricNodesHealthy      = "nodes.healthy"       // gauge of the healthy nodes
+	MetricNodeRequests      = "node.requests"       // count of the requests proxied to a node, by node and error kind
+	MetricNodeLatency       = "node.latency"        // timing of the requests proxied to a node, by node
+	MetricNodeHealthy       = "node.healthy"        // gauge of the health of a node (1 healthy, 0 unhealthy), by node
+	MetricNodeUtilization   = "node.utilization"    // gauge of the busy fraction of the workers of a node, by node
+	MetricNodeActiveWorkers = "node.workers.active" // gauge of the workers of a node which take requests, by node
+	MetricNodeStuckRequests = "node.requests.stuck" // count of the proxy calls force-completed by the watchdog, by node
+
+	MetricRetryBudgetTokens    = "retry_budget.tokens"    // gauge of the retries which are currently allowed
+	MetricRetryBudgetExhausted = "retry_budget.exhausted" // count of the retryable errors which were not retried, by priority
+	MetricFaultsInjected       = "faults.injected"        // count of the injected faults, by fault
+	MetricRequestsForwarded    = "requests.forwarded"     // count of the rejected requests served by a peer, by priority, peer and the error kind of the rejection
+	MetricDryRunRequests       = "dryrun.requests"        // count of the dry runs, by node and error kind (not part of the requests metrics)
+	MetricDryRunDuration       = "dryrun.duration"        // timing of the dry runs, by node
+)
+
+// Tags of the metrics
+const (
+	MetricTagPriority  = "priority"
+	MetricTagErrorKind = "error_kind"
+	MetricTagNode      = "node"
+	MetricTagFault     = "fault"
+	MetricTagPeer      = "peer"
+
+	MetricErrorKindNone = "none" // error kind of successful requests
+)
+
+// MetricsSink receives the counters, gauges and timings of the load balancer. Tags are "key:value" strings. Must be
+// safe for concurrent use.
+type MetricsSink interface {
+	Count(name string, value int64, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+	Timing(name string, value time.Duration, tags ...string)
+}
+
+// NoopMetricsSink discards all metrics
+type NoopMetricsSink struct{}
+
+func (NoopMetricsSink) Count(name string, value int64, tags ...string)          {}
+func (NoopMetricsSink) Gauge(name string, value float64, tags ...string)        {}
+func (NoopMetricsSink) Timing(name string, value time.Duration, tags ...string) {}
+
+// MultiMetricsSink sends the metrics to all of its sinks, i.e. DogStatsD and a custom one
+type MultiMetricsSink []MetricsSink
+
+func (m MultiMetricsSink) Count(name string, value int64, tags ...string) {
+	for _, sink := range m {
+		sink.Count(name, value, tags...)
+	}
+}
+
+func (m MultiMetricsSink) Gauge(name string, value float64, tags ...string) {
+	for _, sink := range m {
+		sink.Gauge(name, value, tags...)
+	}
+}
+
+func (m MultiMetricsSink) Timing(name string, value time.Duration, tags ...string) {
+	for _, sink := range m {
+		sink.Timing(name, value, tags...)
+	}
+}
+
+// NewMetricsSink combines the sinks which are not nil. Returns NoopMetricsSink if there are none.
+func NewMetricsSink(sinks ...MetricsSink) MetricsSink {
+	res := MultiMetricsSink{}
+	for _, sink := range sinks {
+		if sink != nil {
+			res = append(res, sink)
+		}
+	}
+	if len(res) == 0 {
+		return NoopMetricsSink{}
+	} else if len(res) == 1 {
+		return res[0]
+	}
+	return res
+}
+
+// MetricTag returns the "key:value" tag
+func MetricTag(key, value string) string {
+	return key + ":" + value
+}
+
+// nodeMetricTag returns the node tag: the URI without credentials and query params
+func nodeMetricTag(uri string) string {
+	return MetricTag(MetricTagNode, nodeMetricName(uri))
+}
+
+// nodeMetricName returns the URI without credentials and query params
+func nodeMetricName(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+	}
+	return uri
+}
+
+// metricsRejected counts a request which wasn't added to the queue
+func (s *Webserver) metricsRejected(r *SimRequest, kind string) {
+	s.metrics.Count(MetricRequests, 1, MetricTag(MetricTagPriority, r.Priority()), MetricTag(MetricTagErrorKind, kind))
+}
+
+// metricsFinished counts the response of an accepted request, with the request duration. Requests of clients which
+// closed the connection are not counted.
+func (s *Webserver) metricsFinished(r *SimRequest, resp SimResponse, ok bool, startTime time.Time) {
+	if !ok {
+		return
+	}
+	kind := MetricErrorKindNone
+	if resp.Error != nil {
+		kind = errorKind(resp)
+	}
+	priority := MetricTag(MetricTagPriority, r.Priority())
+	s.metrics.Count(MetricRequests, 1, priority, MetricTag(MetricTagErrorKind, kind))
+	s.metrics.Timing(MetricRequestDuration, time.Since(startTime), priority)
+}
+
+// RunMetricsGauges sends the queue and node gauges every interval, until ctx is cancelled. An interval of 0 disables
+// it.
+func (s *Webserver) RunMetricsGauges(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendMetricsGauges()
+		}
+	}
+}
+
+func (s *Webserver) sendMetricsGauges() {
+	lenFastTrack, lenHighPrio, lenLowPrio := s.prioQueue.Len()
+	s.metrics.Gauge(MetricQueueSize, float64(lenFastTrack), MetricTag(MetricTagPriority, PriorityFastTrack))
+	s.metrics.Gauge(MetricQueueSize, float64(lenHighPrio), MetricTag(MetricTagPriority, PriorityHighPrio))
+	s.metrics.Gauge(MetricQueueSize, float64(lenLowPrio), MetricTag(MetricTagPriority, PriorityLowPrio))
+	s.metrics.Gauge(MetricQueueBytes, float64(s.prioQueue.NumBytes()))
+	s.metrics.Gauge(MetricRequestsInFlight, float64(s.requests.inFlight.Load()))
+	if s.retryBudget != nil {
+		s.metrics.Gauge(MetricRetryBudgetTokens, s.retryBudget.Stats(time.Now()).Tokens)
+	}
+
+	nodeStats := s.nodePool.NodeStats()
+	numHealthy := 0
+	for _, stats := range nodeStats {
+		node := nodeMetricTag(stats.URI)
+		s.metrics.Gauge(MetricNodeHealthy, stats.Health, node)
+		s.metrics.Gauge(MetricNodeUtilization, stats.WorkerUtilization, node)
+		s.metrics.Gauge(MetricNodeActiveWorkers, float64(stats.ActiveWorkers), node)
+		if stats.Healthy {
+			numHealthy++
+		}
+	}
+	s.metrics.Gauge(MetricNodes, float64(len(nodeStats)))
+	s.metrics.Gauge(MetricNodesHealthy, float64(numHealthy))
+}
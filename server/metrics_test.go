@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetricsSink records the names of the metrics
+type recordingMetricsSink struct {
+	names []string
+}
+
+func (r *recordingMetricsSink) Count(name string, value int64, tags ...string) {
+	r.names = append(r.names, name)
+}
+
+func (r *recordingMetricsSink) Gauge(name string, value float64, tags ...string) {
+	r.names = append(r.names, name)
+}
+
+func (r *recordingMetricsSink) Timing(name string, value time.Duration, tags ...string) {
+	r.names = append(r.names, name)
+}
+
+func TestNewMetricsSink(t *testing.T) {
+	require.Equal(t, NoopMetricsSink{}, NewMetricsSink())
+	require.Equal(t, NoopMetricsSink{}, NewMetricsSink(nil))
+
+	sink1, sink2 := &recordingMetricsSink{}, &recordingMetricsSink{}
+	require.Equal(t, sink1, NewMetricsSink(nil, sink1))
+
+	sink := NewMetricsSink(sink1, nil, sink2)
+	sink.Count("count", 1)
+	sink.Gauge("gauge", 1)
+	sink.Timing("timing", time.Second)
+	require.Equal(t, []string{"count", "gauge", "timing"}, sink1.names)
+	require.Equal(t, []string{"count", "gauge", "timing"}, sink2.names)
+}
+
+func TestWebserverMetrics(t *testing.T) {
+	conn, read := listenDogStatsD(t, "udp", "127.0.0.1:0")
+	d, err := NewDogStatsD(conn.LocalAddr().String(), DogStatsDOpts{Prefix: "plb.", MaxPacketBytes: 65000, FlushInterval: time.Hour})
+	require.Nil(t, err, err)
+	defer d.Close()
+
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	webserver.SetMetricsSink(d)
+	webserver.nodePool.nodes[0].metrics = d
+	node := nodeMetricTag(webserver.nodePool.nodes[0].URI)
+
+	// One successful request, and one with a node error
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, newSimTestRequest(`{"id":1}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "error", http.StatusBadGateway)
+	}
+	req := newSimTestRequest(`{"id":2}`)
+	req.Header.Set("X-High-Priority", "true")
+	rr = httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, req)
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	webserver.sendMetricsGauges()
+	d.Flush()
+
+	// Metric names and tags, without the values of the timings
+	lines := []string{}
+	for _, line := range strings.Split(read(), "\n") {
+		name, rest, _ := strings.Cut(line, ":")
+		if _, typeAndTags, _ := strings.Cut(rest, "|"); strings.HasPrefix(typeAndTags, "ms") {
+			line = name + ":_|" + typeAndTags
+		}
+		lines = append(lines, line)
+	}
+	require.Contains(t, lines, "plb.queue.wait:_|ms|#priority:low-prio")
+	require.Contains(t, lines, "plb.queue.wait:_|ms|#priority:high-prio")
+	require.Contains(t, lines, "plb.requests:1|c|#priority:low-prio,error_kind:none")
+	require.Contains(t, lines, "plb.requests:1|c|#priority:high-prio,error_kind:node_error")
+	require.Contains(t, lines, "plb.request.duration:_|ms|#priority:low-prio")
+	require.Contains(t, lines, "plb.node.requests:1|c|#"+node+",error_kind:none")
+	numNodeErrors := 0
+	for _, line := range lines {
+		if line == "plb.node.requests:1|c|#"+node+",error_kind:node_error" {
+			numNodeErrors++
+		}
+	}
+	require.Equal(t, RequestMaxTries, numNodeErrors) // every try
+	require.Contains(t, lines, "plb.node.latency:_|ms|#"+node)
+	require.Contains(t, lines, "plb.queue.size:0|g|#priority:fast-track")
+	require.Contains(t, lines, "plb.queue.bytes:0|g")
+	require.Contains(t, lines, "plb.requests.in_flight:0|g")
+	require.Contains(t, lines, "plb.nodes:1|g")
+	require.Contains(t, lines, "plb.nodes.healthy:1|g")
+	require.Contains(t, lines, "plb.node.healthy:1|g|#"+node)
+}
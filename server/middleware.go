@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ProxyMiddleware adds deployment-specific processing to the proxy calls of the node workers, i.e. rewriting the
+// payload before it's sent to a node, or stripping fields from large responses. ProcessRequest is called before every
+// try of a request, ProcessResponse with every successful node response. A returned error (or a panic) fails the
+// request with ErrMiddleware, without calling the remaining middlewares. The request is not retried.
+type ProxyMiddleware interface {
+	ProcessRequest(r *SimRequest) error
+	ProcessResponse(r *SimRequest, resp *SimResponse) error
+}
+
+// proxyMiddlewares are the registered middlewares, shared by all nodes of a pool
+type proxyMiddlewares struct {
+	lock        sync.RWMutex
+	middlewares []ProxyMiddleware
+}
+
+func (m *proxyMiddlewares) add(middlewares ...ProxyMiddleware) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.middlewares = append(m.middlewares, middlewares...)
+}
+
+func (m *proxyMiddlewares) list() []ProxyMiddleware {
+	if m == nil {
+		return nil
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.middlewares
+}
+
+// processRequest runs ProcessRequest of the middlewares in registration order, until one fails
+func (m *proxyMiddlewares) processRequest(r *SimRequest) error {
+	for _, middleware := range m.list() {
+		if err := runMiddleware(func() error { return middleware.ProcessRequest(r) }); err != nil {
+			return fmt.Errorf("%w: %w", ErrMiddleware, err)
+		}
+	}
+	return nil
+}
+
+// processResponse runs ProcessResponse of the middlewares in registration order, until one fails
+func (m *proxyMiddlewares) processResponse(r *SimRequest, resp *SimResponse) error {
+	for _, middleware := range m.list() {
+		if err := runMiddleware(func() error { return middleware.ProcessResponse(r, resp) }); err != nil {
+			return fmt.Errorf("%w: %w", ErrMiddleware, err)
+		}
+	}
+	return nil
+}
+
+// runMiddleware calls fn, and returns a panic as error
+func runMiddleware(fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn()
+}
+
+// UseProxyMiddleware registers middlewares around the proxy calls of the nodes, which run after the ones registered
+// before
+func (gp *NodePool) UseProxyMiddleware(middlewares ...ProxyMiddleware) {
+	gp.middlewares.add(middlewares...)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// testMiddleware records its calls, and can fail or panic
+type testMiddleware struct {
+	name        string
+	calls       *[]string
+	rewriteReq  func(payload []byte) []byte
+	rewriteResp func(payload []byte) []byte
+	requestErr  error
+	responseErr error
+	panics      bool
+}
+
+func (m *testMiddleware) ProcessRequest(r *SimRequest) error {
+	*m.calls = append(*m.calls, m.name+".request")
+	if m.panics {
+		panic("boom")
+	}
+	if m.rewriteReq != nil {
+		payload, err := r.Payload.Bytes()
+		if err != nil {
+			return err
+		}
+		r.Payload = BytesPayload(m.rewriteReq(payload))
+	}
+	return m.requestErr
+}
+
+func (m *testMiddleware) ProcessResponse(r *SimRequest, resp *SimResponse) error {
+	*m.calls = append(*m.calls, m.name+".response")
+	if m.rewriteResp != nil {
+		resp.Payload = m.rewriteResp(resp.Payload)
+	}
+	return m.responseErr
+}
+
+func TestProxyMiddleware(t *testing.T) {
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node.Close()
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(node.URL))
+
+	calls := []string{}
+	first := &testMiddleware{name: "first", calls: &calls, rewriteReq: func(payload []byte) []byte {
+		return bytes.ReplaceAll(payload, []byte("eth_call"), []byte("eth_callBundle"))
+	}}
+	second := &testMiddleware{name: "second", calls: &calls, rewriteResp: func(payload []byte) []byte {
+		return append(payload, []byte(" second")...)
+	}}
+	gp.UseProxyMiddleware(first, second)
+	proxy := func() SimResponse {
+		r := NewSimRequest(context.Background(), "1", []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`), true, false)
+		gp.JobC <- r
+		return <-r.ResponseC
+	}
+
+	// In registration order, mutating the request and the response
+	resp := proxy()
+	require.Nil(t, resp.Error, resp.Error)
+	require.Equal(t, []string{"first.request", "second.request", "first.response", "second.response"}, calls)
+	lastRequest, _ := node.LastRequest()
+	require.Equal(t, []string{"eth_callBundle"}, lastRequest.Methods)
+	require.True(t, bytes.HasSuffix(resp.Payload, []byte(" second")))
+
+	// A failing request middleware short-circuits the others and the node
+	calls = calls[:0]
+	numRequests := node.NumRequests()
+	first.requestErr = errors.New("invalid payload")
+	resp = proxy()
+	require.ErrorIs(t, resp.Error, ErrMiddleware)
+	require.ErrorContains(t, resp.Error, "invalid payload")
+	require.Equal(t, []string{"first.request"}, calls)
+	require.Equal(t, numRequests, node.NumRequests())
+
+	// And so does a failing response middleware
+	calls = calls[:0]
+	first.requestErr, first.responseErr = nil, errors.New("response too large")
+	resp = proxy()
+	require.ErrorIs(t, resp.Error, ErrMiddleware)
+	require.Nil(t, resp.Payload)
+	require.Equal(t, node.URL, resp.NodeURI)
+	require.Equal(t, []string{"first.request", "second.request", "first.response"}, calls)
+
+	// Panics are recovered
+	calls = calls[:0]
+	second.panics = true
+	resp = proxy()
+	require.ErrorIs(t, resp.Error, ErrMiddleware)
+	require.ErrorContains(t, resp.Error, "panic: boom")
+	require.Equal(t, ErrorKindMiddleware, errorKind(resp))
+}
+
+func TestProxyMiddlewareResponse(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	calls := []string{}
+	webserver.nodePool.UseProxyMiddleware(&testMiddleware{name: "fail", calls: &calls, requestErr: errors.New("not allowed")})
+
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, ErrorKindMiddleware, rr.Header().Get("X-Error-Kind"))
+	details := decodeErrorResponse(t, rr)
+	require.Equal(t, ErrorCodeMiddleware, details.Code)
+	require.False(t, details.Retryable)
+	require.Equal(t, []string{"fail.request"}, calls) // not retried
+}
@@ -1,12 +1,14 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,132 +21,694 @@ type Node struct {
 	URI           string
 	AddedAt       time.Time
 	jobC          chan *SimRequest
-	numWorkers    int32
-	curWorkers    int32
+	numWorkers    int32          // atomic, the target number of workers
+	curWorkers    int32          // atomic, the running workers (including the stopping ones)
+	workersWg     sync.WaitGroup // of the running workers, see StopWorkersAndWaitCtx
 	cancelContext context.Context
 	cancelFunc    context.CancelFunc
+	workersLock   sync.Mutex
+	workers       map[int32]*proxyWorker // the running workers, by id (including the stopping ones)
+	healthStopped bool                   // the workers were stopped by the health checks, while the node is unhealthy
 	client        *http.Client
+	healthy       atomic.Bool  // result of the last health check
+	passthrough   bool         // preserve the content type of requests and responses, without JSON assumptions
+	reverseProxy  bool         // reconstruct the method, path, query and headers of reverse proxy requests
+	prewarmConns  int          // idle connections which are kept established with health check probes (0 disables)
+	healthQuery   url.Values   // the query params of the URI, with the health check probe overrides
+	lastProxyAt   atomic.Int64 // unix nanoseconds of the last proxy request of a worker
+	counters      nodeCounters
+	health        nodeHealth
+	blockProgress blockProgress // of the health checks, with NODE_HEALTHCHECK_MAX_BLOCK_AGE_SEC
+	utilization   workerUtilization
+	inFlight      inFlightRequests
+	numInFlight   atomic.Int32                      // requests taken by or handed to the workers, which are not finished yet
+	transport     NodeTransport                     // sends the payloads, selected by the scheme of the URI
+	headers       atomic.Pointer[http.Header]       // set on every request to the node, see SetHeaders
+	savedWorkers  int32                             // the workers of the saved entry, 0 for the pool default
+	dispatchC     chan *SimRequest                  // (optional) the requests handed to this node by the pool, see SetNodeSelector
+	metrics       MetricsSink                       // (optional) receives the request count and latency metrics
+	prometheus    *PrometheusMetrics                // (optional) counts the queue timeouts, proxy errors and sim durations
+	middlewares   *proxyMiddlewares                 // (optional) run around the proxy calls
+	faults        *faultInjector                    // (optional) injects faults around the proxy calls
+	validation    *responseValidation               // (optional) checks the successful responses
+	handBack      func(r *SimRequest)               // (optional) puts a job taken after the workers were stopped back into the queue, or dispatches it to the other nodes
+	passRetry     func(n *Node, r *SimRequest) bool // (optional) passes on a retry which failed on this node already
+	loadChanged   func()                            // (optional) called when the workers finished a request
+	adaptive      *adaptiveWorkers                  // (optional) reduces the active workers while the node fails
+	breaker       *circuitBreaker                   // (optional) stops the workers after consecutive failures
 }
 
+// proxyWorker is a running proxy worker of a node
+type proxyWorker struct {
+	stop     context.CancelFunc // lets the worker exit after its current request
+	stopping bool
+}
+
+// nodeHealth are the health check results of a node
+type nodeHealth struct {
+	lock               sync.Mutex
+	numBecameHealthy   int64
+	numBecameUnhealthy int64
+	lastCheckAt        time.Time
+	lastCheckDuration  time.Duration
+	lastCheckError     string
+}
+
+// inFlightRequests are the requests taken by the proxy workers of a node, by worker id
+type inFlightRequests struct {
+	lock     sync.Mutex
+	requests map[int32]inFlightRequest
+}
+
+type inFlightRequest struct {
+	req     *SimRequest
+	nodeURI string
+	since   time.Time
+}
+
+func (f *inFlightRequests) add(workerID int32, r inFlightRequest) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.requests == nil {
+		f.requests = make(map[int32]inFlightRequest)
+	}
+	f.requests[workerID] = r
+}
+
+func (f *inFlightRequests) remove(workerID int32) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.requests, workerID)
+}
+
+func (f *inFlightRequests) list() []inFlightRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	requests := make([]inFlightRequest, 0, len(f.requests))
+	for _, r := range f.requests {
+		requests = append(requests, r)
+	}
+	return requests
+}
+
+// nodeCounters count the results of the requests proxied to a node, with the error kinds of the responses
+type nodeCounters struct {
+	numSuccess  atomic.Int64
+	numStuck    atomic.Int64 // proxy calls force-completed by the watchdog
+	lock        sync.Mutex
+	errors      map[string]int64 // by error kind
+	statusCodes map[int]int64    // of node errors
+}
+
+// NodeStats are the request counters of a node
+type NodeStats struct {
+	URI              string           `json:"uri"`
+	Healthy          bool             `json:"healthy"`
+	NumWorkers       int32            `json:"numWorkers"`
+	ActiveWorkers    int32            `json:"activeWorkers"` // the workers taking requests, fewer than numWorkers while adaptive workers reduced them
+	AddedAt          time.Time        `json:"addedAt"`
+	NumSuccess       int64            `json:"numSuccess"`
+	NumErrors        int64            `json:"numErrors"`
+	Errors           map[string]int64 `json:"errors"`           // by error kind, as in the X-Error-Kind response header
+	ErrorStatusCodes map[string]int64 `json:"errorStatusCodes"` // status codes of the node errors (i.e. 429 or 5xx)
+	NumStuck         int64            `json:"numStuckRequests"` // proxy calls which didn't return after their timeout, force-completed by the watchdog
+
+	Health             float64   `json:"health"` // 1 if healthy, 0 if unhealthy
+	NumBecameHealthy   int64     `json:"numBecameHealthy"`
+	NumBecameUnhealthy int64     `json:"numBecameUnhealthy"`
+	LastHealthCheckAt  time.Time `json:"lastHealthCheckAt"`
+	LastHealthCheckMs  float64   `json:"lastHealthCheckMs"`
+	LastHealthCheckErr string    `json:"lastHealthCheckError,omitempty"`
+
+	WorkerUtilization float64 `json:"workerUtilization"` // busy fraction of the workers over the last minute
+	WorkerBusySec     float64 `json:"workerBusySec"`     // of all workers since the start
+	WorkerIdleSec     float64 `json:"workerIdleSec"`
+
+	NumWorkerDecreases int64 `json:"numWorkerDecreases"` // of the adaptive workers, since the node was added
+	NumWorkerIncreases int64 `json:"numWorkerIncreases"`
+
+	CircuitState     string `json:"circuitState,omitempty"` // of the circuit breaker (closed, open or half-open), if enabled
+	NumCircuitOpened int64  `json:"numCircuitOpened"`
+
+	WorkersStopped bool `json:"workersStopped"` // while the node is unhealthy (see NODE_HEALTHCHECK_STOP_WORKERS)
+}
+
+// recordResult counts the response of a proxied request, as success or by its error kind
+func (n *Node) recordResult(resp SimResponse) {
+	if n.metrics != nil {
+		kind := MetricErrorKindNone
+		if resp.Error != nil {
+			kind = errorKind(resp)
+		}
+		n.metrics.Count(MetricNodeRequests, 1, nodeMetricTag(n.URI), MetricTag(MetricTagErrorKind, kind))
+	}
+	if resp.Error == nil {
+		n.counters.numSuccess.Add(1)
+		return
+	}
+
+	kind := errorKind(resp)
+	n.counters.lock.Lock()
+	defer n.counters.lock.Unlock()
+	if n.counters.errors == nil {
+		n.counters.errors = make(map[string]int64)
+		n.counters.statusCodes = make(map[int]int64)
+	}
+	n.counters.errors[kind]++
+	if kind == ErrorKindNodeError {
+		n.counters.statusCodes[resp.StatusCode]++
+	}
+}
+
+// Stats returns the request counters of the node
+func (n *Node) Stats() NodeStats {
+	stats := NodeStats{
+		URI:              n.URI,
+		Healthy:          n.IsHealthy(),
+		NumWorkers:       atomic.LoadInt32(&n.numWorkers),
+		AddedAt:          n.AddedAt,
+		NumSuccess:       n.counters.numSuccess.Load(),
+		NumStuck:         n.counters.numStuck.Load(),
+		Errors:           make(map[string]int64),
+		ErrorStatusCodes: make(map[string]int64),
+	}
+
+	stats.ActiveWorkers = n.adaptive.active(stats.NumWorkers)
+	stats.NumWorkerDecreases, stats.NumWorkerIncreases = n.adaptive.counts()
+	stats.CircuitState, stats.NumCircuitOpened = n.breaker.stats()
+	stats.WorkersStopped = n.workersStoppedUnhealthy()
+	if stats.Healthy {
+		stats.Health = 1
+	}
+	n.health.lock.Lock()
+	stats.NumBecameHealthy, stats.NumBecameUnhealthy = n.health.numBecameHealthy, n.health.numBecameUnhealthy
+	stats.LastHealthCheckAt = n.health.lastCheckAt
+	stats.LastHealthCheckMs = float64(n.health.lastCheckDuration) / float64(time.Millisecond)
+	stats.LastHealthCheckErr = n.health.lastCheckError
+	n.health.lock.Unlock()
+
+	utilization, busy, idle := n.utilization.stats(time.Now(), stats.NumWorkers)
+	stats.WorkerUtilization, stats.WorkerBusySec, stats.WorkerIdleSec = utilization, busy.Seconds(), idle.Seconds()
+
+	n.counters.lock.Lock()
+	defer n.counters.lock.Unlock()
+	for kind, count := range n.counters.errors {
+		stats.Errors[kind] = count
+		stats.NumErrors += count
+	}
+	for statusCode, count := range n.counters.statusCodes {
+		stats.ErrorStatusCodes[strconv.Itoa(statusCode)] = count
+	}
+	return stats
+}
+
+// HealthCheck sends the configured probe to the node: a GET request to NodeHealthCheckPath if set, otherwise the
+// JSON-RPC probe of the node (by default a net_version request), whose response is checked against the success
+// criterion, and optionally whether its block number advances.
 func (n *Node) HealthCheck() error {
-	payload := `{"jsonrpc":"2.0","method":"net_version","params":[],"id":123}`
-	_, _, err := n.ProxyRequest(context.Background(), []byte(payload), 5*time.Second)
-	return err
+	if _, isHTTP := n.transport.(*httpTransport); NodeHealthCheckPath != "" && isHTTP {
+		return n.healthCheckGet(NodeHealthCheckPath)
+	}
+	probe, err := healthCheckProbeArg(n.healthQuery)
+	if err != nil {
+		return err
+	}
+	resp, _, _, err := n.proxyRequest(context.Background(), BytesPayload(probe.payload), NodeHealthCheckContentType, nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	result, err := probe.result(resp)
+	if err != nil || result == nil || probe.maxBlockAge == 0 {
+		return err
+	}
+	return n.blockProgress.check(result, probe.maxBlockAge, time.Now())
 }
 
-func (n *Node) startProxyWorker(id int32, cancelContext context.Context) {
+func (n *Node) healthCheckGet(path string) error {
+	nodeURL, err := url.Parse(n.URI)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", nodeURL.ResolveReference(&url.URL{Path: path}).String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "creating health check request failed")
+	}
+	for name, values := range n.header() {
+		httpReq.Header[name] = append([]string{}, values...)
+	}
+
+	httpResp, err := n.client.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "health check request failed")
+	}
+	defer httpResp.Body.Close()
+	_, _ = io.Copy(io.Discard, httpResp.Body)
+
+	if httpResp.StatusCode >= 400 {
+		return fmt.Errorf("error in health check response - statusCode: %d", httpResp.StatusCode)
+	}
+	return nil
+}
+
+// checkHealth runs the health check, and records its duration and the health transition. Returns whether the node
+// became healthy or unhealthy.
+func (n *Node) checkHealth() (changed bool, err error) {
+	start := time.Now()
+	err = n.HealthCheck()
+	duration := time.Since(start)
+	healthy := err == nil
+	changed = n.healthy.Swap(healthy) != healthy
+
+	n.health.lock.Lock()
+	defer n.health.lock.Unlock()
+	if changed && !n.health.lastCheckAt.IsZero() { // not the initial health check
+		if healthy {
+			n.health.numBecameHealthy++
+		} else {
+			n.health.numBecameUnhealthy++
+		}
+	}
+	n.health.lastCheckAt = start.UTC()
+	n.health.lastCheckDuration = duration
+	n.health.lastCheckError = ""
+	if err != nil {
+		n.health.lastCheckError = err.Error()
+	}
+	return changed, err
+}
+
+// IsHealthy returns the result of the last health check
+func (n *Node) IsHealthy() bool {
+	return n.healthy.Load()
+}
+
+// startProxyWorker processes jobs until cancelContext (of all workers of the node) or stopContext (of this worker) is
+// done
+func (n *Node) startProxyWorker(id int32, worker *proxyWorker, cancelContext, stopContext context.Context) {
 	log := n.log.With(
 		"uri", n.URI,
 		"id", id,
 	)
 	log.Infow("starting proxy node worker")
-	atomic.AddInt32(&n.curWorkers, 1)
+	defer n.workersWg.Done()
+	defer n.removeWorker(id, worker)
 	defer atomic.AddInt32(&n.curWorkers, -1)
+	defer n.breaker.release(id)
 
 	for {
 		select {
-		case req := <-n.jobC:
-			_log := log.With("reqID", req.ID)
-			_log.Debug("processing request")
-
-			if req.Cancelled {
-				_log.Info("request was cancelled before processing")
-				continue
-			}
+		case <-stopContext.Done():
+			log.Infow("node worker stopped (scaled down)")
+			return
+		default:
+		}
 
-			if time.Since(req.CreatedAt) > RequestTimeout {
-				_log.Info("request timed out before processing")
-				req.SendResponse(SimResponse{Error: ErrRequestTimeout})
+		paused := n.adaptive.paused(id, atomic.LoadInt32(&n.numWorkers))
+		breakerPaused, breakerChanged := n.breaker.paused(id)
+		if paused == nil && breakerPaused {
+			paused = breakerChanged
+		}
+		if paused != nil {
+			// not active while the node fails
+			select {
+			case <-paused:
 				continue
+			case <-cancelContext.Done():
+				log.Infow("node worker stopped")
+				return
+			case <-stopContext.Done():
+				log.Infow("node worker stopped (scaled down)")
+				return
 			}
+		}
 
-			req.Tries += 1
-			timeBeforeProxy := time.Now().UTC()
-			payload, statusCode, err := n.ProxyRequest(req.Context, req.Payload, ProxyRequestTimeout)
-			requestDuration := time.Since(timeBeforeProxy)
-			_log = _log.With("requestDurationUS", requestDuration.Microseconds())
-			if err != nil {
-				// if not context deadline exceeded
-				if errors.Is(err, context.DeadlineExceeded) {
-					_log.Infow("node proxyRequest error: context deatline exeeded", "uri", n.URI, "error", err)
-				} else {
-					_log.Errorw("node proxyRequest error", "uri", n.URI, "error", err)
-				}
-				response := SimResponse{StatusCode: statusCode, Payload: payload, Error: err, ShouldRetry: true, NodeURI: n.URI}
-				req.SendResponse(response)
-				continue
+		select {
+		case req := <-n.jobC:
+			n.numInFlight.Add(1)
+			if !n.handleJob(id, log, req, cancelContext) {
+				return
 			}
-
-			// Send response
-			_log.Debug("request processed, sending response")
-			sent := req.SendResponse(SimResponse{Payload: payload, NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy})
-			if !sent {
-				_log.Errorw("couldn't send node response to client (SendResponse returned false)", "secSinceRequestCreated", time.Since(req.CreatedAt).Seconds())
+		case req := <-n.dispatchC:
+			if !n.handleJob(id, log, req, cancelContext) {
+				return
 			}
+		case <-breakerChanged: // i.e. the circuit opened while waiting for a job
 
 		case <-cancelContext.Done():
 			log.Infow("node worker stopped")
 			return
+		case <-stopContext.Done():
+			log.Infow("node worker stopped (scaled down)")
+			return
 		}
 	}
 }
 
-// StartWorkers spawns the proxy workers in goroutines. Workers that are already running will be cancelled.
+// handleJob processes a job taken by the worker with the id, and returns false if the worker has to exit
+func (n *Node) handleJob(id int32, log *zap.SugaredLogger, req *SimRequest, cancelContext context.Context) bool {
+	defer n.finished()
+	if cancelContext.Err() != nil && n.handBack != nil {
+		// the node was removed after the job was sent
+		log.Infow("node worker stopped, handing back the job", "reqID", req.ID)
+		n.handBack(req)
+		return false
+	}
+	if n.passRetry != nil && n.passRetry(n, req) {
+		log.Debugw("passing on the retry to another node", "reqID", req.ID, "try", req.Tries)
+		return true
+	}
+	n.utilization.busy(id, time.Now())
+	n.inFlight.add(id, inFlightRequest{req: req, nodeURI: n.URI, since: time.Now()})
+	n.processRequest(log, req)
+	n.inFlight.remove(id)
+	n.utilization.idle(id, time.Now())
+	return true
+}
+
+// finished updates the in-flight count after a job
+func (n *Node) finished() {
+	n.numInFlight.Add(-1)
+	if n.loadChanged != nil {
+		n.loadChanged()
+	}
+}
+
+// processRequest proxies the request to the node, and sends the response
+func (n *Node) processRequest(log *zap.SugaredLogger, req *SimRequest) {
+	_log := log.With("reqID", req.ID)
+	_log.Debug("processing request")
+
+	if req.IsCancelled() {
+		_log.Info("request was cancelled before processing")
+		req.skip()
+		return
+	}
+
+	if !req.take() {
+		_log.Info("request expired in the queue before processing")
+		req.skip()
+		return
+	}
+
+	if time.Now().After(req.Deadline()) {
+		_log.Infow("request timed out before processing", "timeout", req.RequestTimeout())
+		response := SimResponse{Error: req.timeoutError()}
+		n.recordResult(response)
+		n.prometheus.queueTimedOut(req)
+		req.SendResponse(response)
+		return
+	}
+
+	if err := n.middlewares.processRequest(req); err != nil {
+		_log.Warnw("proxy middleware failed the request", "error", err)
+		req.SendResponse(SimResponse{Error: err})
+		return
+	}
+
+	req.Tries += 1
+	timeBeforeProxy := time.Now().UTC()
+	n.lastProxyAt.Store(timeBeforeProxy.UnixNano())
+	contentType := "application/json"
+	var target *HTTPRequest // reconstructed by nodes in reverse proxy mode, with its own headers
+	if n.reverseProxy && req.HTTP != nil {
+		contentType, target = "", req.HTTP
+	} else if n.passthrough {
+		contentType = req.ContentType
+	}
+	fault := "" // the injected latency, which is part of the response of the node
+	if n.faults.inject(FaultLatency, n.metrics) {
+		fault = FaultLatency
+		_log.Warnw("injected fault: delaying the proxy call", "fault", FaultLatency, "latency", n.faults.latency())
+		select {
+		case <-time.After(n.faults.latency()):
+		case <-req.Context.Done():
+		}
+	}
+	if n.faults.inject(FaultError, n.metrics) {
+		_log.Warnw("injected fault: failing the proxy call", "fault", FaultError)
+		n.observeResult(true)
+		req.SendResponse(SimResponse{StatusCode: http.StatusInternalServerError, Error: fmt.Errorf("%w: status code 500", ErrFaultInjected), ShouldRetry: true, NodeURI: n.URI, SimDuration: time.Since(timeBeforeProxy), SimAt: timeBeforeProxy, Fault: FaultError})
+		return
+	}
+	proxyCtx, span := startProxySpan(req.Context, n.URI, req.Tries)
+	var body *streamedBody // the unread body of a streamed response
+	var payload []byte
+	var respContentType string
+	var statusCode int
+	var err error
+	if n.canStream(req) {
+		body, payload, respContentType, statusCode, err = n.streamProxyRequest(proxyCtx, req, contentType, target)
+	} else {
+		payload, respContentType, statusCode, err = n.watchedProxyRequest(_log, req, proxyCtx, contentType, target)
+	}
+	requestDuration := time.Since(timeBeforeProxy)
+	proxyErrorKind := ""
+	if err != nil {
+		proxyErrorKind = errorKind(SimResponse{StatusCode: statusCode, Error: err})
+	}
+	endSpan(span, statusCode, err, proxyErrorKind)
+	if n.metrics != nil {
+		n.metrics.Timing(MetricNodeLatency, requestDuration, nodeMetricTag(n.URI))
+	}
+	n.prometheus.proxied(n.URI, req, requestDuration, proxyErrorKind)
+	if !n.passthrough && target == nil {
+		respContentType = ""
+	}
+	_log = _log.With("requestDurationUS", requestDuration.Microseconds())
+	if err != nil && req.IsCancelled() {
+		// the client is gone, which says nothing about the node (the proxy request was cancelled with its context)
+		_log.Infow("request was cancelled while proxying", "uri", n.URI, "error", err)
+		req.SendResponse(SimResponse{Error: err})
+		return
+	}
+	if err != nil {
+		// if not context deadline exceeded
+		if errors.Is(err, context.DeadlineExceeded) {
+			_log.Infow("node proxyRequest error: context deatline exeeded", "uri", n.URI, "error", err)
+		} else {
+			_log.Errorw("node proxyRequest error", "uri", n.URI, "error", err)
+		}
+		// too large responses are not retried, the other nodes would most likely return the same
+		response := SimResponse{StatusCode: statusCode, Payload: payload, ContentType: respContentType, Error: err, ShouldRetry: !errors.Is(err, ErrResponseTooLarge), NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy, Fault: fault}
+		n.recordResult(response)
+		n.observeResult(true)
+		req.SendResponse(response)
+		return
+	}
+
+	if body != nil {
+		n.sendStream(_log, req, SimResponse{StatusCode: statusCode, ContentType: respContentType, NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy, Fault: fault}, body)
+		return
+	}
+
+	if err := n.validation.validate(req, payload); err != nil {
+		// retried like a node error, the last invalid response is returned with a 502
+		_log.Warnw("node response failed validation", "uri", n.URI, "error", err, "responseSize", len(payload))
+		response := SimResponse{StatusCode: http.StatusBadGateway, Payload: payload, ContentType: respContentType, Error: err, ShouldRetry: true, NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy, Fault: fault}
+		n.recordResult(response)
+		n.observeResult(true)
+		req.SendResponse(response)
+		return
+	}
+
+	// Send response
+	_log.Debug("request processed, sending response")
+	response := SimResponse{Payload: payload, ContentType: respContentType, NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy, Fault: fault}
+	n.recordResult(response)
+	n.observeResult(false)
+	if err := n.middlewares.processResponse(req, &response); err != nil {
+		_log.Warnw("proxy middleware failed the response", "error", err)
+		response = SimResponse{Error: err, NodeURI: n.URI, SimDuration: requestDuration, SimAt: timeBeforeProxy, Fault: fault}
+	}
+	if n.faults.inject(FaultDrop, n.metrics) {
+		// the client gets a timeout at the deadline, without blocking the worker until then
+		_log.Warnw("injected fault: dropping the response", "fault", FaultDrop)
+		time.AfterFunc(time.Until(req.Deadline()), func() {
+			req.SendResponse(SimResponse{Error: req.timeoutError(), NodeURI: n.URI, SimAt: timeBeforeProxy, Fault: FaultDrop})
+		})
+		return
+	}
+	sent := req.SendResponse(response)
+	if !sent && !req.IsCancelled() {
+		_log.Errorw("couldn't send node response to client (SendResponse returned false)", "secSinceRequestCreated", time.Since(req.CreatedAt).Seconds())
+	}
+}
+
+// StartWorkers spawns the proxy workers in goroutines. Workers that are already running will be cancelled. To change
+// the number of running workers without interrupting them, use SetNumWorkers.
 func (n *Node) StartWorkers() {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	n._startWorkers()
+}
+
+// _startWorkers is StartWorkers with workersLock held
+func (n *Node) _startWorkers() {
 	if n.cancelFunc != nil {
 		n.cancelFunc()
 	}
 
+	n.healthStopped = false
 	n.cancelContext, n.cancelFunc = context.WithCancel(context.Background())
-	for i := int32(0); i < n.numWorkers; i++ {
-		go n.startProxyWorker(i+1, n.cancelContext)
+	n.workers = make(map[int32]*proxyWorker)
+	n.utilization.start(time.Now())
+	n.scaleWorkers(atomic.LoadInt32(&n.numWorkers))
+	if n.prewarmConns > 0 {
+		go n.keepWarm(n.cancelContext, NodePrewarmInterval)
+	}
+}
+
+// SetNumWorkers scales the running workers up or down to numWorkers. Scaling up only spawns the additional workers,
+// scaling down lets the surplus workers (with the highest ids) exit after their current request. If the workers are
+// not running, only the number for the next start is set.
+func (n *Node) SetNumWorkers(numWorkers int32) {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	atomic.StoreInt32(&n.numWorkers, numWorkers)
+	if n.cancelContext == nil || n.cancelContext.Err() != nil {
+		return
+	}
+	n.scaleWorkers(numWorkers)
+	n.log.Infow("scaled node workers", "uri", n.URI, "numWorkers", numWorkers)
+}
+
+// scaleWorkers spawns or stops workers until numWorkers are running (not stopping). New workers get the lowest ids
+// which are not in use, also by a stopping worker which is still finishing its request. Called with workersLock held.
+func (n *Node) scaleWorkers(numWorkers int32) {
+	running := make([]int32, 0, len(n.workers))
+	for id, worker := range n.workers {
+		if !worker.stopping {
+			running = append(running, id)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i] > running[j] })
+
+	for i := 0; i < len(running)-int(numWorkers); i++ {
+		worker := n.workers[running[i]]
+		worker.stopping = true
+		worker.stop()
+	}
+	for id, numRunning := int32(1), int32(len(running)); numRunning < numWorkers; id++ {
+		if _, inUse := n.workers[id]; inUse {
+			continue
+		}
+		stopContext, stop := context.WithCancel(context.Background())
+		worker := &proxyWorker{stop: stop}
+		n.workers[id] = worker
+		atomic.AddInt32(&n.curWorkers, 1)
+		n.workersWg.Add(1)
+		go n.startProxyWorker(id, worker, n.cancelContext, stopContext)
+		numRunning++
+	}
+}
+
+// removeWorker removes the exited worker, unless it was replaced by a restart in the meantime
+func (n *Node) removeWorker(id int32, worker *proxyWorker) {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	worker.stop()
+	if n.workers[id] == worker {
+		delete(n.workers, id)
 	}
 }
 
 func (n *Node) StopWorkers() {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	n.healthStopped = false // i.e. removed, not restarted by the health checks
 	if n.cancelFunc != nil {
 		n.cancelFunc()
 	}
 }
 
-func (n *Node) StopWorkersAndWait() {
-	n.StopWorkers()
-	for {
-		if n.curWorkers == 0 {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
+// stopUnhealthyWorkers stops the running workers of the node which became unhealthy, like StopWorkers, until
+// restartHealthyWorkers. Returns false if the workers were not running.
+func (n *Node) stopUnhealthyWorkers() bool {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	if n.cancelContext == nil || n.cancelContext.Err() != nil {
+		return false
 	}
+	n.cancelFunc()
+	n.healthStopped = true
+	return true
 }
 
-func (n *Node) ProxyRequest(ctx context.Context, payload []byte, timeout time.Duration) (resp []byte, statusCode int, err error) {
-	ctxx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	httpReq, err := http.NewRequestWithContext(ctxx, "POST", n.URI, bytes.NewBuffer(payload))
-	if err != nil {
-		return resp, statusCode, errors.Wrap(err, "creating proxy request failed")
+// restartHealthyWorkers starts the workers again which were stopped by stopUnhealthyWorkers, unless they were stopped
+// or started otherwise in the meantime. Returns whether they were restarted.
+func (n *Node) restartHealthyWorkers() bool {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	if !n.healthStopped {
+		return false
 	}
+	n._startWorkers()
+	return true
+}
 
-	httpReq.Header.Set("Accept", "application/json")
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Content-Length", strconv.Itoa(len(payload)))
+// workersStoppedUnhealthy returns whether the workers are stopped because the node is unhealthy
+func (n *Node) workersStoppedUnhealthy() bool {
+	n.workersLock.Lock()
+	defer n.workersLock.Unlock()
+	return n.healthStopped
+}
 
-	httpResp, err := n.client.Do(httpReq)
-	if err != nil {
-		return resp, statusCode, errors.Wrap(err, "proxying request failed")
-	}
+// StopWorkersAndWait stops the workers, waits until they finished their current requests, and closes the
+// connections of the transport
+func (n *Node) StopWorkersAndWait() {
+	_ = n.StopWorkersAndWaitCtx(context.Background())
+}
 
-	statusCode = httpResp.StatusCode
+// StopWorkersAndWaitCtx is StopWorkersAndWait, but returns an error if the workers didn't exit before ctx is done
+// (i.e. stuck in a proxy request). The transport is closed once the last worker exited, also after the timeout.
+func (n *Node) StopWorkersAndWaitCtx(ctx context.Context) error {
+	n.StopWorkers()
 
-	defer httpResp.Body.Close()
-	httpRespBody, err := io.ReadAll(httpResp.Body)
-	if err != nil {
-		return resp, statusCode, errors.Wrap(err, "decoding proxying response failed")
+	done := make(chan struct{})
+	go func() {
+		n.workersWg.Wait()
+		n.closeTransport() // not under a worker which is still proxying
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "%d node workers still running", atomic.LoadInt32(&n.curWorkers))
 	}
+}
 
-	if statusCode >= 400 {
-		return httpRespBody, statusCode, fmt.Errorf("error in response - statusCode: %d / %s", statusCode, httpRespBody)
+// closeTransport closes the connections of the transport, if it has a Close method
+func (n *Node) closeTransport() {
+	if closer, ok := n.transport.(io.Closer); ok {
+		_ = closer.Close()
 	}
+}
+
+// ProxyRequest sends the JSON payload to the node, and counts the result in the node stats. File-backed payloads are
+// streamed from disk.
+func (n *Node) ProxyRequest(ctx context.Context, payload Payload, timeout time.Duration) (resp []byte, statusCode int, err error) {
+	resp, _, statusCode, err = n.proxyRequest(ctx, payload, "application/json", nil, timeout)
+	n.recordResult(SimResponse{StatusCode: statusCode, Error: err})
+	return resp, statusCode, err
+}
 
-	return httpRespBody, statusCode, nil
+// proxyRequest sends the payload with the given content type (omitted if empty) to the node, and returns the response
+// with its content type. The content type and reverse proxy target only apply to the HTTP transport, the other
+// transports return JSON responses.
+func (n *Node) proxyRequest(ctx context.Context, payload Payload, contentType string, target *HTTPRequest, timeout time.Duration) (resp []byte, respContentType string, statusCode int, err error) {
+	if header := n.header(); len(header) > 0 {
+		ctx = withNodeHeaders(ctx, header)
+	}
+	if t, ok := n.transport.(*httpTransport); ok {
+		return t.proxy(ctx, payload, contentType, target, timeout)
+	}
+	resp, statusCode, err = n.transport.Proxy(ctx, payload, timeout)
+	if err != nil {
+		return resp, respContentType, statusCode, err
+	}
+	return resp, "application/json", statusCode, nil
 }
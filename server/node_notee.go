@@ -30,14 +30,37 @@ func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorke
 		}
 	}
 
+	// passthrough mode can be enabled server-wide, or per node with the `_passthrough=1` query param
+	passthrough := PassthroughMode || pURL.Query().Get("_passthrough") == "1"
+	if passthrough {
+		log.Infow("Using passthrough mode", "uri", uri)
+	}
+
+	prewarmConns := prewarmConnsArg(log, pURL, uri)
+
+	if _, err := healthCheckProbeArg(pURL.Query()); err != nil {
+		return nil, err
+	}
+
+	// reverse proxy requests are reconstructed against the node URI with the `_proxy=1` query param, instead of
+	// posting the payload to it
+	reverseProxy := pURL.Query().Get("_proxy") == "1"
+	if reverseProxy {
+		log.Infow("Using reverse proxy mode", "uri", uri)
+	}
+
 	node := &Node{
-		log:        log,
-		URI:        uri,
-		AddedAt:    time.Now(),
-		jobC:       jobC,
-		numWorkers: numWorkers,
+		log:          log,
+		URI:          uri,
+		AddedAt:      time.Now(),
+		jobC:         jobC,
+		numWorkers:   numWorkers,
+		passthrough:  passthrough,
+		prewarmConns: prewarmConns,
+		healthQuery:  pURL.Query(),
+		reverseProxy: reverseProxy,
 		client: &http.Client{
-			Timeout: ProxyRequestTimeout,
+			Timeout: maxProxyRequestTimeout(),
 			Transport: &http.Transport{
 				MaxIdleConns:        ProxyMaxIdleConns,
 				MaxConnsPerHost:     ProxyMaxConnsPerHost,
@@ -46,5 +69,8 @@ func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorke
 			},
 		},
 	}
+	if node.transport, err = newNodeTransport(log, pURL, uri, node.client, passthrough); err != nil {
+		return nil, err
+	}
 	return node, nil
 }
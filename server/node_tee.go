@@ -109,7 +109,7 @@ func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorke
 			return nil, err
 		}
 		client = http.Client{
-			Timeout: ProxyRequestTimeout,
+			Timeout: maxProxyRequestTimeout(),
 			Transport: &http.Transport{
 				TLSClientConfig:     tlsConfig,
 				MaxIdleConns:        ProxyMaxIdleConns,
@@ -120,13 +120,39 @@ func NewNode(log *zap.SugaredLogger, uri string, jobC chan *SimRequest, numWorke
 		}
 	}
 
+	// passthrough mode can be enabled server-wide, or per node with the `_passthrough=1` query param
+	passthrough := PassthroughMode || pURL.Query().Get("_passthrough") == "1"
+	if passthrough {
+		log.Infow("Using passthrough mode", "uri", uri)
+	}
+
+	prewarmConns := prewarmConnsArg(log, pURL, uri)
+
+	if _, err := healthCheckProbeArg(pURL.Query()); err != nil {
+		return nil, err
+	}
+
+	// reverse proxy requests are reconstructed against the node URI with the `_proxy=1` query param, instead of
+	// posting the payload to it
+	reverseProxy := pURL.Query().Get("_proxy") == "1"
+	if reverseProxy {
+		log.Infow("Using reverse proxy mode", "uri", uri)
+	}
+
 	node := &Node{
-		log:        log,
-		URI:        uri,
-		AddedAt:    time.Now(),
-		jobC:       jobC,
-		numWorkers: numWorkers,
-		client:     &client,
+		log:          log,
+		URI:          uri,
+		AddedAt:      time.Now(),
+		jobC:         jobC,
+		numWorkers:   numWorkers,
+		passthrough:  passthrough,
+		prewarmConns: prewarmConns,
+		healthQuery:  pURL.Query(),
+		reverseProxy: reverseProxy,
+		client:       &client,
+	}
+	if node.transport, err = newNodeTransport(log, pURL, uri, node.client, passthrough); err != nil {
+		return nil, err
 	}
 	return node, nil
 }
@@ -2,8 +2,12 @@ package server
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -56,7 +60,7 @@ func TestNodeError(t *testing.T) {
 	require.Contains(t, err.Error(), "479")
 
 	// Check failing ProxyRequest
-	_, statusCode, err := node.ProxyRequest(context.Background(), []byte("net_version"), 3*time.Second)
+	_, statusCode, err := node.ProxyRequest(context.Background(), BytesPayload("net_version"), 3*time.Second)
 	require.NotNil(t, err, err)
 	require.Equal(t, 479, statusCode)
 
@@ -91,3 +95,373 @@ func TestWorkersArg(t *testing.T) {
 	require.Nil(t, err, err)
 	require.Equal(t, int32(6), node.numWorkers)
 }
+
+func TestNodeHealthCheckProbe(t *testing.T) {
+	var probeContentType, probeBody, probePath string
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		probeContentType, probeBody, probePath = req.Header.Get("Content-Type"), string(body), req.URL.Path
+		if req.URL.Path == "/unhealthy" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	_NodeHealthCheckPayload, _NodeHealthCheckContentType, _NodeHealthCheckPath := NodeHealthCheckPayload, NodeHealthCheckContentType, NodeHealthCheckPath
+	defer func() {
+		NodeHealthCheckPayload, NodeHealthCheckContentType, NodeHealthCheckPath = _NodeHealthCheckPayload, _NodeHealthCheckContentType, _NodeHealthCheckPath
+	}()
+
+	node, err := NewNode(testLog, nodeServer.URL+"?_passthrough=1&_healthcheck_success=status", nil, 1) // the probes are not JSON-RPC
+	require.Nil(t, err, err)
+	require.True(t, node.passthrough)
+
+	// Posting a custom probe payload
+	NodeHealthCheckPayload, NodeHealthCheckContentType = "\x08\x01", "application/x-protobuf"
+	require.Nil(t, node.HealthCheck())
+	require.Equal(t, "application/x-protobuf", probeContentType)
+	require.Equal(t, "\x08\x01", probeBody)
+
+	// GET request to a health check path
+	NodeHealthCheckPath = "/health"
+	require.Nil(t, node.HealthCheck())
+	require.Equal(t, "/health", probePath)
+	NodeHealthCheckPath = "/unhealthy"
+	err = node.HealthCheck()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "503")
+}
+
+func TestNodeStats(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		switch string(body) {
+		case "429":
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+		case "500":
+			http.Error(w, "error", http.StatusInternalServerError)
+		case "slow":
+			time.Sleep(500 * time.Millisecond)
+		default:
+			w.Write([]byte(`{"result":"ok"}`)) //nolint:errcheck
+		}
+	}
+
+	proxyRequestTimeout := ProxyRequestTimeout
+	ProxyRequestTimeout = 100 * time.Millisecond
+	defer func() { ProxyRequestTimeout = proxyRequestTimeout }()
+
+	jobC := make(chan *SimRequest)
+	node, err := NewNode(testLog, mockNodeServer.URL, jobC, 1)
+	require.Nil(t, err, err)
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+
+	send := func(request *SimRequest) SimResponse {
+		jobC <- request
+		return <-request.ResponseC
+	}
+	for _, payload := range []string{"ok", "ok", "429", "500", "500", "slow"} {
+		send(NewSimRequest(context.Background(), "1", []byte(payload), true, false))
+	}
+	request := NewSimRequest(context.Background(), "1", []byte("ok"), true, false)
+	request.CreatedAt = time.Now().Add(-RequestTimeout - time.Second)
+	res := send(request)
+	require.ErrorIs(t, res.Error, ErrRequestTimeout)
+
+	// ProxyRequest is counted as well
+	_, _, err = node.ProxyRequest(context.Background(), BytesPayload("429"), time.Second)
+	require.NotNil(t, err)
+
+	stats := node.Stats()
+	require.Equal(t, mockNodeServer.URL, stats.URI)
+	require.Equal(t, int64(2), stats.NumSuccess)
+	require.Equal(t, int64(6), stats.NumErrors)
+	require.Equal(t, map[string]int64{
+		ErrorKindNodeError:      4,
+		ErrorKindProxyTimeout:   1,
+		ErrorKindRequestTimeout: 1,
+	}, stats.Errors)
+	require.Equal(t, map[string]int64{"429": 2, "500": 2}, stats.ErrorStatusCodes)
+
+	// Unreachable node
+	mockNodeServer2 := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	mockNodeServer2.Close()
+	node2, err := NewNode(testLog, mockNodeServer2.URL, nil, 1)
+	require.Nil(t, err, err)
+	_, _, err = node2.ProxyRequest(context.Background(), BytesPayload("ok"), time.Second)
+	require.NotNil(t, err)
+	stats = node2.Stats()
+	require.Equal(t, int64(0), stats.NumSuccess)
+	require.Equal(t, map[string]int64{ErrorKindProxyError: 1}, stats.Errors)
+	require.Empty(t, stats.ErrorStatusCodes)
+}
+
+func TestNodeSetNumWorkers(t *testing.T) {
+	fakeNode := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 50 * time.Millisecond})
+	defer fakeNode.Close()
+
+	jobC := make(chan *SimRequest)
+	node, err := NewNode(testLog, fakeNode.URL, jobC, 4)
+	require.Nil(t, err, err)
+	node.SetNumWorkers(4) // not started yet
+	require.Equal(t, int32(0), node.curWorkers)
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+
+	workerIDs := func() []int32 {
+		node.workersLock.Lock()
+		defer node.workersLock.Unlock()
+		ids := []int32{}
+		for id, worker := range node.workers {
+			if !worker.stopping {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	waitForWorkers := func(numWorkers int32) {
+		require.Eventually(t, func() bool {
+			node.workersLock.Lock()
+			defer node.workersLock.Unlock()
+			return atomic.LoadInt32(&node.curWorkers) == numWorkers && len(node.workers) == int(numWorkers)
+		}, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// Traffic while rescaling, every request gets its response
+	var wg sync.WaitGroup
+	var numFailed atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				request := NewSimRequest(context.Background(), "1", []byte(`{"jsonrpc":"2.0","method":"net_version","id":1}`), true, false)
+				jobC <- request
+				if res := <-request.ResponseC; res.Error != nil {
+					numFailed.Add(1)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	node.SetNumWorkers(2)
+	require.ElementsMatch(t, []int32{1, 2}, workerIDs())
+	waitForWorkers(2)
+	require.Equal(t, int32(2), node.Stats().NumWorkers)
+
+	node.SetNumWorkers(6)
+	node.SetNumWorkers(6) // repeated calls don't spawn more
+	require.ElementsMatch(t, []int32{1, 2, 3, 4, 5, 6}, workerIDs())
+	waitForWorkers(6)
+
+	wg.Wait()
+	require.Equal(t, int32(0), numFailed.Load())
+	require.Equal(t, 80, fakeNode.NumRequests())
+	require.Equal(t, int64(80), node.Stats().NumSuccess)
+}
+
+func TestNodeStopWorkersAndWaitCtx(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{}, 1)
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if strings.Contains(string(body), "eth_callBundle") {
+			received <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"1"}`))
+	}))
+	defer nodeServer.Close()
+
+	jobC := make(chan *SimRequest)
+	node, err := NewNode(testLog, nodeServer.URL, jobC, 2)
+	require.Nil(t, err, err)
+	node.StartWorkers()
+	node.StartWorkers() // the workers of the first start exit, and are not waited for twice
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.curWorkers) == 2 }, time.Second, 5*time.Millisecond)
+
+	// A worker is stuck in a slow request: the wait times out instead of blocking
+	request := NewSimRequest(context.Background(), "1", []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`), true, false)
+	jobC <- request
+	<-received
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = node.StopWorkersAndWaitCtx(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int32(1), atomic.LoadInt32(&node.curWorkers))
+
+	// Once the request completed, the worker exits
+	close(release)
+	res := <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+	require.Nil(t, node.StopWorkersAndWaitCtx(context.Background()))
+	require.Equal(t, int32(0), atomic.LoadInt32(&node.curWorkers))
+}
+
+// TestNodeStopWorkersWhileJobArrives stops the worker while a job arrives: the job is either proxied, handed back, or
+// stays in the channel for the other workers, but never dropped
+func TestNodeStopWorkersWhileJobArrives(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+
+	jobC := make(chan *SimRequest)
+	node, err := NewNode(testLog, mockNodeServer.URL, jobC, 1)
+	require.Nil(t, err, err)
+	handedBack := make(chan *SimRequest, 1)
+	node.handBack = func(r *SimRequest) { handedBack <- r }
+
+	for i := 0; i < 200; i++ {
+		node.StartWorkers()
+		request := NewSimRequest(context.Background(), "1", []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`), true, false)
+		go func() { jobC <- request }()
+		node.StopWorkers()
+		node.workersWg.Wait()
+
+		select {
+		case res := <-request.ResponseC:
+			require.Nil(t, res.Error, res.Error)
+		case r := <-handedBack:
+			require.Equal(t, request, r)
+			require.Equal(t, 0, r.Tries) // not proxied
+		case r := <-jobC:
+			require.Equal(t, request, r)
+		case <-time.After(time.Second):
+			t.Fatalf("the job of try %d was dropped", i)
+		}
+		require.Empty(t, handedBack)
+		require.Empty(t, request.ResponseC)
+	}
+}
+
+// TestNodeTimeoutsByPriority queues requests of all priorities behind a slow request on the only worker: each one
+// expires with the timeout of its priority
+func TestNodeTimeoutsByPriority(t *testing.T) {
+	defer func(fastTrack, highPrio, lowPrio, proxyFastTrack time.Duration) {
+		RequestTimeoutFastTrack, RequestTimeoutHighPrio, RequestTimeoutLowPrio, ProxyRequestTimeoutFastTrack = fastTrack, highPrio, lowPrio, proxyFastTrack
+	}(RequestTimeoutFastTrack, RequestTimeoutHighPrio, RequestTimeoutLowPrio, ProxyRequestTimeoutFastTrack)
+	RequestTimeoutFastTrack = 100 * time.Millisecond
+	RequestTimeoutHighPrio = 2 * time.Second
+	RequestTimeoutLowPrio = 300 * time.Millisecond
+
+	fakeNode := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 200 * time.Millisecond})
+	defer fakeNode.Close()
+	jobC := make(chan *SimRequest, 10)
+	node, err := NewNode(testLog, fakeNode.URL, jobC, 1)
+	require.Nil(t, err, err)
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+	payload := []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+
+	// The requests are taken in order: the fast-track request expires while the blocker is processed, the high-prio
+	// request is processed next, and the low-prio request expires meanwhile
+	blocker := NewSimRequest(context.Background(), "blocker", payload, false, false)
+	blocker.Timeout = 2 * time.Second
+	fastTrack := NewSimRequest(context.Background(), "ft", payload, false, true)
+	highPrio := NewSimRequest(context.Background(), "hp", payload, true, false)
+	lowPrio := NewSimRequest(context.Background(), "lp", payload, false, false)
+	for _, r := range []*SimRequest{blocker, fastTrack, highPrio, lowPrio} {
+		jobC <- r
+	}
+
+	require.Nil(t, (<-blocker.ResponseC).Error)
+	res := <-fastTrack.ResponseC
+	require.ErrorIs(t, res.Error, ErrRequestTimeout)
+	require.Contains(t, res.Error.Error(), "fast-track timeout 100ms")
+	require.Nil(t, (<-highPrio.ResponseC).Error)
+	res = <-lowPrio.ResponseC
+	require.ErrorIs(t, res.Error, ErrRequestTimeout)
+	require.Contains(t, res.Error.Error(), "low-prio timeout 300ms")
+
+	// The proxy timeout of the priority
+	ProxyRequestTimeoutFastTrack = 50 * time.Millisecond
+	fastTrack = NewSimRequest(context.Background(), "ft", payload, false, true)
+	fastTrack.Timeout = 2 * time.Second
+	jobC <- fastTrack
+	res = <-fastTrack.ResponseC
+	require.NotNil(t, res.Error)
+	require.Contains(t, res.Error.Error(), "timeout 50ms")
+	highPrio = NewSimRequest(context.Background(), "hp", payload, true, false)
+	jobC <- highPrio
+	require.Nil(t, (<-highPrio.ResponseC).Error)
+}
+
+func TestSimRequestTimeouts(t *testing.T) {
+	defer func(highPrio, proxyLowPrio, proxyMax time.Duration) {
+		RequestTimeoutHighPrio, ProxyRequestTimeoutLowPrio, ProxyRequestTimeoutMax = highPrio, proxyLowPrio, proxyMax
+	}(RequestTimeoutHighPrio, ProxyRequestTimeoutLowPrio, ProxyRequestTimeoutMax)
+	RequestTimeoutHighPrio = time.Second
+	ProxyRequestTimeoutLowPrio = 10 * time.Second
+	ProxyRequestTimeoutMax = 5 * time.Second
+
+	highPrio := NewSimRequest(context.Background(), "", nil, true, false)
+	require.Equal(t, time.Second, highPrio.RequestTimeout())
+	require.Equal(t, ProxyRequestTimeout, highPrio.ProxyRequestTimeout())
+	require.Equal(t, highPrio.CreatedAt.Add(time.Second), highPrio.Deadline())
+	highPrio.Timeout = 3 * time.Second
+	require.Equal(t, 3*time.Second, highPrio.RequestTimeout())
+
+	lowPrio := NewSimRequest(context.Background(), "", nil, false, false)
+	require.Equal(t, RequestTimeout, lowPrio.RequestTimeout())
+	require.Equal(t, 10*time.Second, lowPrio.ProxyRequestTimeout())
+	require.Equal(t, 10*time.Second, maxProxyRequestTimeout())
+	ProxyRequestTimeoutMax = 20 * time.Second // the timeouts the requests can set
+	require.Equal(t, 20*time.Second, maxProxyRequestTimeout())
+	lowPrio.ProxyTimeout = 15 * time.Second
+	require.Equal(t, 15*time.Second, lowPrio.ProxyRequestTimeout())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	withDeadline := NewSimRequest(ctx, "", nil, false, false)
+	require.Contains(t, withDeadline.timeoutError().Error(), "deadline of the client request")
+}
+
+// streamedPayload is a payload which doesn't know its length in advance
+type streamedPayload struct{ BytesPayload }
+
+func (p streamedPayload) Len() int64 { return -1 }
+
+func TestNodeProxyRequestBody(t *testing.T) {
+	fakeNode := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer fakeNode.Close()
+	node, err := NewNode(testLog, fakeNode.URL, nil, 1)
+	require.Nil(t, err, err)
+
+	// A payload larger than the in-memory threshold is streamed from its spool file, with its length
+	body := `{"jsonrpc":"2.0","method":"eth_callBundle","params":["` + strings.Repeat("ab", 64*1024) + `"],"id":1}`
+	payload, err := ReadPayload(strings.NewReader(body), 1024*1024, 16*1024, t.TempDir())
+	require.Nil(t, err, err)
+	defer payload.Close()
+	require.IsType(t, &FilePayload{}, payload)
+	_, _, statusCode, err := node.proxyRequest(context.Background(), payload, "application/json", nil, time.Second)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, statusCode)
+	captured, ok := fakeNode.LastRequest()
+	require.True(t, ok)
+	require.Equal(t, int64(len(body)), captured.ContentLength)
+	require.Empty(t, captured.TransferEncoding)
+	require.Equal(t, body, string(captured.Body))
+
+	// A payload of unknown length is sent with chunked transfer encoding, without a Content-Length header
+	_, _, _, err = node.proxyRequest(context.Background(), streamedPayload{BytesPayload(body)}, "application/json", nil, time.Second)
+	require.Nil(t, err, err)
+	captured, _ = fakeNode.LastRequest()
+	require.Equal(t, int64(-1), captured.ContentLength)
+	require.Equal(t, []string{"chunked"}, captured.TransferEncoding)
+	require.Empty(t, captured.Header.Get("Content-Length"))
+	require.Equal(t, body, string(captured.Body))
+
+	// Empty payloads have no body (the fake node rejects them as invalid JSON-RPC)
+	_, _, statusCode, _ = node.proxyRequest(context.Background(), BytesPayload(nil), "", nil, time.Second)
+	require.Equal(t, http.StatusBadRequest, statusCode)
+	captured, _ = fakeNode.LastRequest()
+	require.Empty(t, captured.Body)
+	require.Equal(t, int64(0), captured.ContentLength)
+	require.Empty(t, captured.TransferEncoding)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// nodeGzipMinBytesArg returns the size from which payloads are sent gzip compressed to the node, of the
+// `_gzip_min_bytes` URI query param (NodeGzipMinBytes by default, 0 disables the compression)
+func nodeGzipMinBytesArg(log *zap.SugaredLogger, pURL *url.URL, uri string) int {
+	gzipArg := pURL.Query().Get("_gzip_min_bytes")
+	if gzipArg == "" {
+		return NodeGzipMinBytes
+	}
+	minBytes, err := strconv.Atoi(gzipArg)
+	if err != nil || minBytes < 0 {
+		log.Errorw("Error parsing gzip_min_bytes query param", "err", err, "uri", uri)
+		return NodeGzipMinBytes
+	}
+	log.Infow("Using gzip compressed requests", "gzipMinBytes", minBytes, "uri", uri)
+	return minBytes
+}
+
+// gzipRequestBody returns the gzip compressed payload, and its length. In-memory payloads are compressed upfront, so
+// that the Content-Length is known. Spooled payloads are compressed while they're sent, with chunked transfer encoding.
+func gzipRequestBody(payload Payload) (body io.ReadCloser, contentLength int64, err error) {
+	if p, ok := payload.(BytesPayload); ok {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(p)
+		gz.Close()
+		return io.NopCloser(&buf), int64(buf.Len()), nil
+	}
+
+	src, err := payload.Open()
+	if err != nil {
+		return nil, 0, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, src)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, -1, nil
+}
+
+// decodeResponseBody returns the decompressed body of a response with `Content-Encoding: gzip`, otherwise the body
+func decodeResponseBody(httpResp *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(strings.TrimSpace(httpResp.Header.Get("Content-Encoding")), "gzip") {
+		return httpResp.Body, nil
+	}
+	gz, err := gzip.NewReader(httpResp.Body)
+	if err == io.EOF { // empty body
+		return httpResp.Body, nil
+	} else if err != nil {
+		httpResp.Body.Close()
+		return nil, err
+	}
+	return &gzipBody{Reader: gz, body: httpResp.Body}, nil
+}
+
+// gzipBody decompresses a response body, and closes it
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeGzip(t *testing.T) {
+	defer func(minBytes int) { NodeGzipMinBytes = minBytes }(NodeGzipMinBytes)
+	NodeGzipMinBytes = 100
+
+	payload := []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":["` + strings.Repeat("ab", 500) + `"],"id":1}`)
+	respPayload := []byte(`{"jsonrpc":"2.0","result":"` + strings.Repeat("cd", 500) + `","id":1}`)
+	type nodeRequest struct {
+		contentEncoding string
+		contentLength   int64
+		numBytes        int
+		body            []byte
+	}
+	requests := make(chan nodeRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "gzip", req.Header.Get("Accept-Encoding"))
+		raw, err := io.ReadAll(req.Body)
+		require.Nil(t, err, err)
+		nodeReq := nodeRequest{contentEncoding: req.Header.Get("Content-Encoding"), contentLength: req.ContentLength, numBytes: len(raw), body: raw}
+		if nodeReq.contentEncoding == "gzip" {
+			gz, err := gzip.NewReader(bytes.NewReader(raw))
+			require.Nil(t, err, err)
+			nodeReq.body, err = io.ReadAll(gz)
+			require.Nil(t, err, err)
+		}
+		requests <- nodeReq
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(respPayload)
+		gz.Close()
+	}))
+	defer server.Close()
+	proxy := func(uri string, payload Payload) nodeRequest {
+		node, err := NewNode(testLog, uri, nil, 1)
+		require.Nil(t, err, err)
+		resp, statusCode, err := node.ProxyRequest(context.Background(), payload, time.Second)
+		require.Nil(t, err, err)
+		require.Equal(t, http.StatusOK, statusCode)
+		require.Equal(t, respPayload, resp) // decompressed
+		return <-requests
+	}
+
+	// The Content-Length is the compressed size
+	req := proxy(server.URL, BytesPayload(payload))
+	require.Equal(t, "gzip", req.contentEncoding)
+	require.Equal(t, int64(req.numBytes), req.contentLength)
+	require.Less(t, req.numBytes, len(payload)/5)
+	require.Equal(t, payload, req.body)
+
+	// Spooled payloads are compressed while they're sent
+	spooled, err := ReadPayload(bytes.NewReader(payload), len(payload), 10, t.TempDir())
+	require.Nil(t, err, err)
+	defer spooled.Close()
+	req = proxy(server.URL, spooled)
+	require.Equal(t, "gzip", req.contentEncoding)
+	require.Equal(t, int64(-1), req.contentLength)
+	require.Equal(t, payload, req.body)
+
+	// Smaller payloads, and nodes which disabled it, are not compressed
+	req = proxy(server.URL, BytesPayload(payload[:50]))
+	require.Equal(t, "", req.contentEncoding)
+	require.Equal(t, int64(50), req.contentLength)
+	req = proxy(server.URL+"?_gzip_min_bytes=0", BytesPayload(payload))
+	require.Equal(t, "", req.contentEncoding)
+	require.Equal(t, payload, req.body)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// maskedHeaderValue replaces the values of the node headers in the listings
+const maskedHeaderValue = "****"
+
+// validateNodeHeaders checks the names and values of node headers
+func validateNodeHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name: %q", name)
+		} else if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid value of header %s", name)
+		}
+	}
+	return nil
+}
+
+// maskNodeHeaders returns the headers with masked values, nil if there are none
+func maskNodeHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	masked := make(map[string]string, len(headers))
+	for name := range headers {
+		masked[name] = maskedHeaderValue
+	}
+	return masked
+}
+
+// SetHeaders replaces the headers which are set on every request to the node (i.e. for authentication), including
+// the health checks. WebSocket connections are opened with them, gRPC calls send them as metadata.
+func (n *Node) SetHeaders(headers map[string]string) {
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	n.headers.Store(&header)
+	if ws, ok := n.transport.(*wsTransport); ok {
+		_ = ws.Close() // the next requests open connections with the new headers
+	}
+}
+
+// Headers returns the headers of the node, nil if there are none
+func (n *Node) Headers() map[string]string {
+	header := n.header()
+	if len(header) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(header))
+	for name := range header {
+		headers[name] = header.Get(name)
+	}
+	return headers
+}
+
+func (n *Node) header() http.Header {
+	if header := n.headers.Load(); header != nil {
+		return *header
+	}
+	return nil
+}
+
+type nodeHeadersKey struct{}
+
+// withNodeHeaders returns a context carrying the headers of the node, which the transports set on the proxy requests
+func withNodeHeaders(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, nodeHeadersKey{}, header)
+}
+
+// nodeHeadersFromContext returns the headers of the node carried by ctx, nil if none
+func nodeHeadersFromContext(ctx context.Context) http.Header {
+	header, _ := ctx.Value(nodeHeadersKey{}).(http.Header)
+	return header
+}
+
+// AddNodeWithHeaders adds a node like AddNode, whose requests have the headers. The headers are saved to the state with
+// the node.
+func (gp *NodePool) AddNodeWithHeaders(uri string, headers map[string]string) error {
+	if err := validateNodeHeaders(headers); err != nil {
+		return err
+	}
+	return gp.addNodeEntry(NodeEntry{URI: uri, Headers: headers})
+}
+
+// SetNodeHeaders replaces the headers of the node with the (normalized) URI, and saves them to the state. Returns false
+// if the node is not in the pool.
+func (gp *NodePool) SetNodeHeaders(uri string, headers map[string]string) (found bool, err error) {
+	if err := validateNodeHeaders(headers); err != nil {
+		return false, err
+	}
+	gp.nodesLock.Lock()
+	var node *Node
+	for _, n := range gp.nodes {
+		if NormalizeNodeURI(n.URI) == NormalizeNodeURI(uri) {
+			node = n
+			break
+		}
+	}
+	gp.nodesLock.Unlock()
+	if node == nil {
+		return false, nil
+	}
+
+	node.SetHeaders(headers)
+	gp.log.Infow("NodePool: node headers updated", "URI", node.URI, "headers", maskNodeHeaders(headers))
+	if gp.state != nil {
+		entry := NodeEntry{URI: node.URI, Workers: node.savedWorkers, AddedAt: node.AddedAt, Headers: node.Headers()}
+		if err := gp.state.SaveNode(entry); err != nil {
+			gp.log.Errorw("NodePool SetNodeHeaders: updated but failed saving to state", "URI", node.URI, "error", err)
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// NodeEntries returns the entries of the nodes, with masked header values
+func (gp *NodePool) NodeEntries() []NodeEntry {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	entries := []NodeEntry{}
+	for _, node := range gp.nodes {
+		entries = append(entries, NodeEntry{URI: node.URI, Workers: node.savedWorkers, AddedAt: node.AddedAt, Headers: maskNodeHeaders(node.Headers())})
+	}
+	return entries
+}
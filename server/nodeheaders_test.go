@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateNodeHeaders(t *testing.T) {
+	require.Nil(t, validateNodeHeaders(nil))
+	require.Nil(t, validateNodeHeaders(map[string]string{"Authorization": "Bearer xyz", "X-Api-Key": "k"}))
+	require.NotNil(t, validateNodeHeaders(map[string]string{"X Api Key": "k"}))
+	require.NotNil(t, validateNodeHeaders(map[string]string{"X-Api-Key": "k\r\nX-Other: v"}))
+	require.Equal(t, map[string]string{"Authorization": maskedHeaderValue}, maskNodeHeaders(map[string]string{"Authorization": "Bearer xyz"}))
+	require.Nil(t, maskNodeHeaders(nil))
+}
+
+func TestNodeHeaders(t *testing.T) {
+	resetTestRedis()
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node.Close()
+	nodePool := NewNodePool(testLog, redisTestState, 1)
+	defer nodePool.Shutdown()
+	webserver := NewWebserver(testLog, ":12345", NewPrioQueue(0, 0, 0, 2, false, PriorityAging{}), nodePool)
+	handler := http.HandlerFunc(webserver.HandleNodesRequest)
+	nodesRequest := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+	lastHeader := func(name string) string {
+		req, found := node.LastRequest()
+		require.True(t, found)
+		return req.Header.Get(name)
+	}
+
+	// The health check of the added node has the headers already
+	rr := nodesRequest("POST", "/nodes", `{"uri":"`+node.URL+`","headers":{"Authorization":"Bearer xyz","x-api-key":"secret"}}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, "Bearer xyz", lastHeader("Authorization"))
+	require.Equal(t, "secret", lastHeader("X-Api-Key"))
+	r := NewSimRequest(context.Background(), "", []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`), true, false)
+	nodePool.JobC <- r
+	res := <-r.ResponseC
+	require.Nil(t, res.Error, res.Error)
+	require.Equal(t, "Bearer xyz", lastHeader("Authorization"))
+
+	// The listing masks the values
+	rr = nodesRequest("GET", "/nodes?details=1", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NotContains(t, rr.Body.String(), "xyz")
+	require.NotContains(t, rr.Body.String(), "secret")
+	var entries []NodeEntry
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, node.URL, entries[0].URI)
+	require.Equal(t, map[string]string{"Authorization": maskedHeaderValue, "X-Api-Key": maskedHeaderValue}, entries[0].Headers)
+	rr = nodesRequest("GET", "/nodes", "")
+	require.Equal(t, "[\""+node.URL+"\"]\n", rr.Body.String())
+
+	// The headers are updated in place, and saved to the state
+	rr = nodesRequest("PATCH", "/nodes", `{"uri":"`+node.URL+`","headers":{"Authorization":"Bearer abc"}}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Nil(t, nodePool.nodes[0].HealthCheck())
+	require.Equal(t, "Bearer abc", lastHeader("Authorization"))
+	require.Equal(t, "", lastHeader("X-Api-Key"))
+	nodes, err := redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, map[string]string{"Authorization": "Bearer abc"}, nodes[0].Headers)
+
+	rr = nodesRequest("PATCH", "/nodes", `{"uri":"http://localhost:8545X","headers":{}}`)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	rr = nodesRequest("PATCH", "/nodes", `{"uri":"`+node.URL+`","headers":{"X Api Key":"k"}}`)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The nodes loaded from the state have their headers
+	nodePool2 := NewNodePool(testLog, redisTestState, 1)
+	defer nodePool2.Shutdown()
+	require.Nil(t, nodePool2.LoadNodes())
+	require.Equal(t, map[string]string{"Authorization": "Bearer abc"}, nodePool2.nodes[0].Headers())
+
+	// Clearing them
+	rr = nodesRequest("PATCH", "/nodes", `{"uri":"`+node.URL+`"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	nodes, err = redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Nil(t, nodes[0].Headers)
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -11,132 +15,286 @@ type NodePool struct {
 	log               *zap.SugaredLogger
 	nodes             []*Node
 	nodesLock         sync.Mutex
-	redisState        *RedisState
+	state             State // (optional) the node list is saved on changes
 	numWorkersPerNode int32
 	JobC              chan *SimRequest
+	events            *EventBroker       // (optional) receives node add/remove and health events
+	metrics           MetricsSink        // (optional) receives the metrics of the nodes
+	prometheus        *PrometheusMetrics // (optional) see SetPrometheusMetrics
+	middlewares       proxyMiddlewares
+	faults            faultInjector // (see /admin/faults)
+	validation        responseValidation
+	retryRouting      atomic.String          // see SetRetryRouting
+	adaptiveWorkers   *AdaptiveWorkersConfig // (optional) see SetAdaptiveWorkers
+	dispatcher        nodeDispatcher         // (optional) see SetNodeSelector
+	circuitBreaker    *CircuitBreakerConfig  // (optional) see SetCircuitBreaker
+	stopUnhealthy     atomic.Bool            // see SetStopUnhealthyWorkers
+	nodeTLS           *NodeTLSConfig         // (optional) see SetNodeTLS
+	nodeCertsLock     sync.Mutex
+	nodeCerts         map[string]*CertLoader   // the client certificates of the nodes, by their files
+	requeue           func(r *SimRequest) bool // (optional) see SetRequeue
 }
 
-func NewNodePool(log *zap.SugaredLogger, redisState *RedisState, numWorkersPerNode int32) *NodePool {
+func NewNodePool(log *zap.SugaredLogger, state State, numWorkersPerNode int32) *NodePool {
 	return &NodePool{
 		log:               log,
-		redisState:        redisState,
+		state:             state,
 		numWorkersPerNode: numWorkersPerNode,
 		JobC:              make(chan *SimRequest, JobChannelBuffer),
 	}
 }
 
-func (gp *NodePool) LoadNodesFromRedis() error {
-	if gp.redisState == nil {
+// SetEventBroker makes the pool publish node add/remove and health transition events
+func (gp *NodePool) SetEventBroker(events *EventBroker) {
+	gp.events = events
+}
+
+// SetMetricsSink makes the nodes send their request count and latency metrics to sink. Must be called before nodes are
+// added.
+func (gp *NodePool) SetMetricsSink(sink MetricsSink) {
+	gp.metrics = sink
+}
+
+// SetPrometheusMetrics makes the node workers count their proxy errors and sim durations in metrics, and reports the
+// running workers of the nodes. Must be called before nodes are added.
+func (gp *NodePool) SetPrometheusMetrics(metrics *PrometheusMetrics) {
+	gp.prometheus = metrics
+	metrics.registerNodePool(gp)
+}
+
+// LoadNodes adds the nodes saved in the state
+func (gp *NodePool) LoadNodes() error {
+	if gp.state == nil {
 		return nil
 	}
-	nodeUris, err := gp.redisState.GetNodes()
+	entries, err := gp.state.GetNodes()
 	if err != nil {
-		return errors.Wrap(err, "loading nodes from redis failed")
+		return errors.Wrap(err, "loading nodes from state failed")
 	}
-	gp.log.Infow("NodePool: loaded nodes from redis", "numNodes", len(nodeUris))
+	gp.log.Infow("NodePool: loaded nodes from state", "numNodes", len(entries))
 
 	// Create the nodes now
-	for _, uri := range nodeUris {
-		_, _, err = gp._addNode(uri)
+	for _, entry := range entries {
+		_, _, err = gp._addNode(entry)
 		if err != nil {
-			return errors.Wrap(err, "adding node from redis failed")
+			return errors.Wrap(err, "adding node from state failed")
 		}
 	}
 	return nil
 }
 
-// HasNode returns true if a node with the URI is already in the pool
+// HasNode returns true if a node with the (normalized) URI is already in the pool
 func (gp *NodePool) HasNode(uri string) bool {
 	for _, node := range gp.nodes {
-		if node.URI == uri {
+		if NormalizeNodeURI(node.URI) == NormalizeNodeURI(uri) {
 			return true
 		}
 	}
 	return false
 }
 
-// AddNode adds a node to the pool and starts the workers. If a new node is added, the list of nodes is saved to redis.
+// AddNode adds a node to the pool and starts the workers. If a new node is added, its entry is saved to the state.
 func (gp *NodePool) AddNode(uri string) error {
-	added, nodeUris, err := gp._addNode(uri)
+	return gp.addNodeEntry(NodeEntry{URI: uri})
+}
+
+// addNodeEntry adds a node with the metadata of entry like AddNode
+func (gp *NodePool) addNodeEntry(entry NodeEntry) error {
+	uri := entry.URI
+	added, saved, err := gp._addNode(entry)
 	if err != nil {
 		return errors.Wrap(err, "AddNode failed")
 	}
 
-	if added {
-		err = gp._saveNodeListToRedis(nodeUris)
+	if added && gp.state != nil {
+		err = gp.state.SaveNode(saved)
 		if err != nil {
-			gp.log.Errorw("NodePool AddNode: added but failed saving to redis", "URI", uri, "error", err)
+			gp.log.Errorw("NodePool AddNode: added but failed saving to state", "URI", uri, "error", err)
 		} else {
-			gp.log.Debugw("NodePool AddNode: added and saved to redis", "URI", uri, "numNodes", len(gp.nodes))
+			gp.log.Debugw("NodePool AddNode: added and saved to state", "URI", uri, "numNodes", len(gp.nodes))
 		}
 	}
 
 	return err
 }
 
-// _addNode adds a node to the pool and starts the workers. If a new node is added, it also returns nodeUris to be saved to redis.
-func (gp *NodePool) _addNode(uri string) (added bool, nodeUris []string, err error) {
+// _addNode adds a node with the metadata of entry to the pool and starts the workers. If a new node is added, it also
+// returns the entry to be saved to the state.
+func (gp *NodePool) _addNode(entry NodeEntry) (added bool, saved NodeEntry, err error) {
 	gp.nodesLock.Lock()
 	defer gp.nodesLock.Unlock()
 
+	uri := entry.URI
 	if gp.HasNode(uri) {
-		return false, nil, nil
+		return false, saved, nil
 	}
 
-	node, err := NewNode(gp.log, uri, gp.JobC, gp.numWorkersPerNode)
+	numWorkers := gp.numWorkersPerNode
+	if entry.Workers > 0 {
+		numWorkers = entry.Workers
+	}
+	node, err := NewNode(gp.log, uri, gp.JobC, numWorkers)
 	if err != nil {
-		return false, nil, err
+		return false, saved, err
+	}
+	if pURL, err := url.ParseRequestURI(uri); err != nil {
+		return false, saved, err
+	} else if err := gp.applyNodeTLS(node, pURL); err != nil {
+		node.closeTransport()
+		return false, saved, err
+	}
+	if !entry.AddedAt.IsZero() {
+		node.AddedAt = entry.AddedAt
+	}
+	node.savedWorkers = entry.Workers
+	node.SetHeaders(entry.Headers)
+	node.metrics = gp.metrics
+	node.prometheus = gp.prometheus
+	node.middlewares = &gp.middlewares
+	node.faults = &gp.faults
+	node.validation = &gp.validation
+	node.handBack = gp.handBackStopped
+	node.passRetry = gp.passRetry
+	node.dispatchC = make(chan *SimRequest)
+	node.loadChanged = gp.dispatcher.loadChanged
+	if gp.adaptiveWorkers != nil {
+		node.adaptive = newAdaptiveWorkers(*gp.adaptiveWorkers)
+	}
+	if config := circuitBreakerArg(gp.log, uri, gp.circuitBreaker); config != nil {
+		node.breaker = newCircuitBreaker(*config, node.breakerHalfOpened)
 	}
 
-	err = node.HealthCheck()
+	_, err = node.checkHealth()
 	if err != nil {
-		return false, nil, errors.Wrap(err, "_addNode healthcheck failed")
+		node.closeTransport()
+		return false, saved, errors.Wrap(err, "_addNode healthcheck failed")
 	}
 
 	// Add now
 	gp.nodes = append(gp.nodes, node)
-	nodeUris = []string{}
-	for _, node := range gp.nodes {
-		nodeUris = append(nodeUris, node.URI)
-	}
 
 	// Start node workers
 	node.StartWorkers()
 	gp.log.Infow("NodePool: added node", "URI", uri, "numNodes", len(gp.nodes))
-	return true, nodeUris, nil
-}
-
-func (gp *NodePool) _saveNodeListToRedis(nodeUris []string) error {
-	if gp.redisState == nil {
-		return nil
-	}
-
-	return gp.redisState.SaveNodes(nodeUris)
+	gp.events.Publish(EventTypeNodeAdded, NodeEvent{URI: uri, Healthy: true})
+	return true, NodeEntry{URI: uri, Workers: entry.Workers, AddedAt: node.AddedAt, Headers: node.Headers()}, nil
 }
 
 func (gp *NodePool) DelNode(uri string) (deleted bool, err error) {
 	for idx, node := range gp.nodes {
-		if node.URI == uri {
+		if NormalizeNodeURI(node.URI) == NormalizeNodeURI(uri) {
 			node.StopWorkers()
+			go func(node *Node) { // the workers finish their current requests, then the transport is closed
+				ctx, cancel := context.WithTimeout(context.Background(), NodeStopTimeout)
+				defer cancel()
+				if err := node.StopWorkersAndWaitCtx(ctx); err != nil {
+					gp.log.Warnw("NodePool: workers of the removed node didn't stop in time", "uri", node.URI, "error", err)
+				}
+			}(node)
 
 			gp.nodesLock.Lock()
-			defer gp.nodesLock.Unlock()
-
 			// Remove node
 			gp.nodes = append(gp.nodes[:idx], gp.nodes[idx+1:]...)
+			numNodes := len(gp.nodes)
+			gp.nodesLock.Unlock()
+			gp.dispatcher.loadChanged()
 
-			// Save new list of nodes to redis
-			nodeUris := []string{}
-			for _, node := range gp.nodes {
-				nodeUris = append(nodeUris, node.URI)
+			// The jobs which were sent but not taken by a worker are taken by the other nodes, or failed if there is none
+			if numNodes == 0 {
+				gp.failPendingJobs()
 			}
-			err = gp._saveNodeListToRedis(nodeUris)
+
+			// Delete the entry from the state
+			if gp.state != nil {
+				err = gp.state.DeleteNode(uri)
+			}
+			gp.events.Publish(EventTypeNodeRemoved, NodeEvent{URI: node.URI, Healthy: node.IsHealthy()})
 			return true, err
 		}
 	}
 	return false, nil
 }
 
+// Dispatch hands r to the workers of the nodes (with a NodeSelector to the workers of the selected node). It fails
+// with ErrNoNodesAvailable if there is no node, and with ErrNodeTimeout if no worker took r within timeout. If the last
+// node is removed before a worker took r, r gets the ErrNoNodesAvailable response.
+func (gp *NodePool) Dispatch(r *SimRequest, timeout time.Duration) error {
+	if gp.numNodes() == 0 {
+		return ErrNoNodesAvailable
+	}
+	if gp.hasNodeSelector() {
+		return gp.dispatchToNode(r, timeout)
+	}
+
+	select {
+	case gp.JobC <- r:
+	case <-time.After(timeout):
+		return ErrNodeTimeout
+	}
+
+	// DelNode fails the pending jobs before or after this
+	if gp.numNodes() == 0 {
+		gp.failPendingJobs()
+	}
+	return nil
+}
+
+// handBack dispatches a job which was taken by a worker of a removed node to the other nodes
+func (gp *NodePool) handBack(r *SimRequest) {
+	if err := gp.Dispatch(r, ServerJobSendTimeout); err != nil {
+		r.SendResponse(SimResponse{Error: err})
+	}
+}
+
+// SetRequeue makes the pool put the jobs which were taken by the workers of a stopped or removed node back into the
+// queue with requeue (i.e. Queue.Push), instead of dispatching them to the other nodes right away. If requeue returns
+// false (i.e. the queue is full or closed), they are dispatched. Must be called before nodes are added.
+func (gp *NodePool) SetRequeue(requeue func(r *SimRequest) bool) {
+	gp.requeue = requeue
+}
+
+// handBackStopped puts a job which was taken by a worker after its node was stopped or removed back into the queue
+// (see SetRequeue), or dispatches it to the other nodes
+func (gp *NodePool) handBackStopped(r *SimRequest) {
+	if gp.requeue != nil && gp.requeue(r) {
+		return
+	}
+	gp.handBack(r)
+}
+
+// failPendingJobs sends ErrNoNodesAvailable to the jobs which were not taken by a worker, while there is no node
+func (gp *NodePool) failPendingJobs() {
+	for gp.numNodes() == 0 {
+		select {
+		case r := <-gp.JobC:
+			gp.log.Warnw("NodePool: no node left for a pending job", "reqID", r.ID)
+			r.SendResponse(SimResponse{Error: ErrNoNodesAvailable})
+		default:
+			return
+		}
+	}
+}
+
+// SetNodeWorkers scales the workers of the node with the (normalized) URI to numWorkers, without interrupting the
+// requests in flight. Returns false if the node is not in the pool.
+func (gp *NodePool) SetNodeWorkers(uri string, numWorkers int32) bool {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+	for _, node := range gp.nodes {
+		if NormalizeNodeURI(node.URI) == NormalizeNodeURI(uri) {
+			node.SetNumWorkers(numWorkers)
+			return true
+		}
+	}
+	return false
+}
+
+func (gp *NodePool) numNodes() int {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+	return len(gp.nodes)
+}
+
 func (gp *NodePool) NodeUris() []string {
 	gp.nodesLock.Lock()
 	defer gp.nodesLock.Unlock()
@@ -148,9 +306,102 @@ func (gp *NodePool) NodeUris() []string {
 	return nodeUris
 }
 
-// Shutdown will stop all node workers, but let's them finish the ongoing connections
+// NodeStats returns the request counters of all nodes
+func (gp *NodePool) NodeStats() []NodeStats {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	stats := []NodeStats{}
+	for _, node := range gp.nodes {
+		stats = append(stats, node.Stats())
+	}
+	return stats
+}
+
+// inFlightRequests returns the requests taken by the proxy workers of all nodes
+func (gp *NodePool) inFlightRequests() (requests []inFlightRequest) {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+
+	for _, node := range gp.nodes {
+		requests = append(requests, node.inFlight.list()...)
+	}
+	return requests
+}
+
+// SetStopUnhealthyWorkers makes the health checks stop the workers of the nodes which became unhealthy, so that they
+// don't take requests from the queue, and restart them once the node is healthy again
+func (gp *NodePool) SetStopUnhealthyWorkers(stop bool) {
+	gp.stopUnhealthy.Store(stop)
+}
+
+// CheckNodesHealth runs the health check of all nodes, and logs and publishes health transitions. Depending on
+// SetStopUnhealthyWorkers, the workers of the nodes which became unhealthy are stopped, and restarted once they are
+// healthy again (also if it was disabled in the meantime).
+func (gp *NodePool) CheckNodesHealth() {
+	gp.nodesLock.Lock()
+	nodes := make([]*Node, len(gp.nodes))
+	copy(nodes, gp.nodes)
+	gp.nodesLock.Unlock()
+
+	for _, node := range nodes {
+		changed, err := node.checkHealth()
+		if err == nil && node.restartHealthyWorkers() {
+			gp.log.Infow("NodePool: restarted the workers of the healthy node", "URI", node.URI)
+			gp.dispatcher.loadChanged()
+		} else if err != nil && gp.stopUnhealthy.Load() && node.stopUnhealthyWorkers() {
+			// a removed node is not restarted, its workers were stopped already
+			gp.log.Warnw("NodePool: stopped the workers of the unhealthy node", "URI", node.URI)
+		}
+		if !changed {
+			continue
+		}
+
+		event := NodeEvent{URI: node.URI, Healthy: err == nil}
+		if err != nil {
+			event.Error = err.Error()
+			gp.log.Warnw("NodePool: node became unhealthy", "URI", node.URI, "error", err)
+		} else {
+			gp.log.Infow("NodePool: node became healthy", "URI", node.URI)
+		}
+		gp.events.Publish(EventTypeNodeHealth, event)
+	}
+}
+
+// RunHealthChecks calls CheckNodesHealth every interval, until ctx is cancelled
+func (gp *NodePool) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			gp.CheckNodesHealth()
+		}
+	}
+}
+
+// NumHealthyNodes returns the number of nodes which passed their last health check
+func (gp *NodePool) NumHealthyNodes() (numHealthy int) {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+	for _, node := range gp.nodes {
+		if node.IsHealthy() {
+			numHealthy++
+		}
+	}
+	return numHealthy
+}
+
+// Shutdown will stop all node workers, but let's them finish the ongoing connections. It waits at most
+// NodeStopTimeout for them.
 func (gp *NodePool) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), NodeStopTimeout)
+	defer cancel()
 	for _, node := range gp.nodes {
-		node.StopWorkersAndWait()
+		if err := node.StopWorkersAndWaitCtx(ctx); err != nil {
+			gp.log.Warnw("NodePool: node workers didn't stop in time", "uri", node.URI, "error", err)
+		}
 	}
 }
@@ -5,7 +5,10 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/flashbots/prio-load-balancer/testutils"
 	"github.com/stretchr/testify/require"
@@ -31,13 +34,27 @@ func TestNodePool(t *testing.T) {
 	require.Equal(t, 2, len(nodes))
 
 	gp2 := NewNodePool(testLog, redisTestState, 1)
-	err = gp2.LoadNodesFromRedis()
+	err = gp2.LoadNodes()
 	require.Nil(t, err, err)
 	require.Equal(t, 2, len(gp2.nodes))
 
+	require.Equal(t, nodes[0].AddedAt, gp2.nodes[0].AddedAt) // metadata is restored
+
 	wasDeleted, err := gp2.DelNode(mockNodeServer1.URL)
 	require.Nil(t, err, err)
 	require.True(t, wasDeleted)
+	nodes, err = redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, []string{mockNodeServer2.URL}, nodeEntryURIs(nodes))
+
+	// The saved number of workers is used, and URIs are compared normalized
+	require.Nil(t, redisTestState.SaveNode(NodeEntry{URI: mockNodeServer1.URL, Workers: 3}))
+	gp3 := NewNodePool(testLog, redisTestState, 1)
+	require.Nil(t, gp3.LoadNodes())
+	require.Equal(t, 2, len(gp3.nodes))
+	require.Equal(t, int32(3), gp3.nodes[0].numWorkers) // without AddedAt, so loaded first
+	require.True(t, gp3.HasNode(strings.ToUpper(mockNodeServer1.URL)+"/"))
+	gp3.Shutdown()
 }
 
 func TestNodePoolWithoutREDIS(t *testing.T) {
@@ -91,3 +108,116 @@ func TestNodePoolWithError(t *testing.T) {
 	require.NotNil(t, res)
 	require.NotNil(t, res.Error, res.Error)
 }
+
+func TestNodePoolHealthStats(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+	stats := gp.NodeStats()
+	require.Equal(t, 1, len(stats))
+	require.Equal(t, 1.0, stats[0].Health)
+	require.Equal(t, int64(0), stats[0].NumBecameHealthy) // the initial health check is no transition
+	require.False(t, stats[0].LastHealthCheckAt.IsZero())
+	require.Greater(t, stats[0].LastHealthCheckMs, 0.0)
+
+	// Flap the node
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "node error", http.StatusServiceUnavailable)
+	}
+	gp.CheckNodesHealth()
+	gp.CheckNodesHealth() // no transition
+	stats = gp.NodeStats()
+	require.Equal(t, 0.0, stats[0].Health)
+	require.False(t, stats[0].Healthy)
+	require.Equal(t, int64(0), stats[0].NumBecameHealthy)
+	require.Equal(t, int64(1), stats[0].NumBecameUnhealthy)
+
+	lastHealthCheckAt := stats[0].LastHealthCheckAt
+	mockNodeBackend.HTTPHandlerOverride = nil
+	gp.CheckNodesHealth()
+	stats = gp.NodeStats()
+	require.Equal(t, 1.0, stats[0].Health)
+	require.Equal(t, int64(1), stats[0].NumBecameHealthy)
+	require.Equal(t, int64(1), stats[0].NumBecameUnhealthy)
+	require.False(t, stats[0].LastHealthCheckAt.Before(lastHealthCheckAt))
+
+	// Removed nodes have no stats
+	deleted, err := gp.DelNode(mockNodeServer.URL)
+	require.Nil(t, err, err)
+	require.True(t, deleted)
+	require.Empty(t, gp.NodeStats())
+}
+
+func TestNodePoolStopUnhealthyWorkers(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+
+	gp := NewNodePool(testLog, nil, 2)
+	defer gp.Shutdown()
+	gp.SetStopUnhealthyWorkers(true)
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+	node := gp.nodes[0]
+
+	// The workers of the unhealthy node stop, and don't take requests
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "node error", http.StatusServiceUnavailable)
+	}
+	gp.CheckNodesHealth()
+	require.True(t, gp.NodeStats()[0].WorkersStopped)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&node.curWorkers) == 0 }, time.Second, 5*time.Millisecond)
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	gp.JobC <- request
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, len(gp.JobC))
+
+	// They are restarted once the node is healthy again
+	mockNodeBackend.HTTPHandlerOverride = nil
+	gp.CheckNodesHealth()
+	require.False(t, gp.NodeStats()[0].WorkersStopped)
+	res := <-request.ResponseC
+	require.Nil(t, res.Error, res.Error)
+	require.Equal(t, int32(2), atomic.LoadInt32(&node.curWorkers))
+
+	// A removed node isn't restarted
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "node error", http.StatusServiceUnavailable)
+	}
+	gp.CheckNodesHealth()
+	deleted, err := gp.DelNode(mockNodeServer.URL)
+	require.Nil(t, err, err)
+	require.True(t, deleted)
+	require.False(t, node.restartHealthyWorkers())
+	require.False(t, node.workersStoppedUnhealthy())
+}
+
+func TestNodePoolRequeue(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+
+	q := NewPrioQueue(0, 0, 1, 2, false, PriorityAging{})
+	defer q.Close()
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	gp.SetRequeue(q.Push)
+	require.Nil(t, gp.AddNode(mockNodeServer.URL))
+	node := gp.nodes[0]
+	node.StopWorkers()
+	node.workersWg.Wait()
+
+	// A job taken by a worker of the stopped node goes back into the queue
+	request := NewSimRequest(context.Background(), "1", []byte("foo"), false, false)
+	node.handBack(request)
+	require.Equal(t, request, q.Pop())
+
+	// If the queue is full, it's dispatched to the other nodes
+	require.True(t, q.Push(NewSimRequest(context.Background(), "2", []byte("bar"), false, false)))
+	node.handBack(request)
+	require.Equal(t, 1, q.NumRequests())
+	require.Equal(t, request, <-gp.JobC)
+}
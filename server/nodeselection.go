@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Node selection modes (NODE_SELECTION)
+const (
+	NodeSelectionShared      = "shared"       // the workers of all nodes take the requests from the shared JobC
+	NodeSelectionLeastLoaded = "least-loaded" // the pool hands every request to the node with the lowest in-flight/capacity ratio
+)
+
+// NodeLoad is the load of a node, for the NodeSelector
+type NodeLoad struct {
+	URI      string
+	Healthy  bool
+	InFlight int  // requests handed to the node which it didn't finish yet
+	Capacity int  // the active workers of the node (0 while its circuit breaker is open, or its workers are stopped)
+	FailedOn bool // the request failed on the node already (on an earlier try)
+}
+
+// NodeSelector picks the node which gets the next request, when the pool dispatches the requests to the nodes (see
+// NodePool.SetNodeSelector). Select returns the index of the node in nodes, or -1 to wait until the load of a node
+// changes. A selector may also return a node with InFlight >= Capacity, the request then waits for a free worker of
+// that node (LeastLoadedSelector only selects nodes with a free worker).
+type NodeSelector interface {
+	Select(r *SimRequest, nodes []NodeLoad) int
+}
+
+// ParseNodeSelection returns the NodeSelector of a node selection mode, nil for the shared JobC ("" means least-loaded)
+func ParseNodeSelection(mode string) (NodeSelector, error) {
+	switch mode {
+	case NodeSelectionShared:
+		return nil, nil
+	case NodeSelectionLeastLoaded, "":
+		return LeastLoadedSelector{}, nil
+	}
+	return nil, fmt.Errorf("invalid node selection: %s (%s or %s)", mode, NodeSelectionLeastLoaded, NodeSelectionShared)
+}
+
+// LeastLoadedSelector selects the node with a free worker and the lowest in-flight/capacity ratio, so that nodes get
+// requests in proportion to their workers, and slow nodes less than fast ones. Only healthy nodes are used (all nodes if
+// none is healthy), and nodes on which the request failed already only if no other node has a free worker.
+type LeastLoadedSelector struct{}
+
+func (LeastLoadedSelector) Select(r *SimRequest, nodes []NodeLoad) int {
+	hasHealthy := false
+	for _, node := range nodes {
+		hasHealthy = hasHealthy || node.Healthy
+	}
+
+	selected := -1
+	for i, node := range nodes {
+		if (hasHealthy && !node.Healthy) || node.InFlight >= node.Capacity {
+			continue
+		}
+		if selected < 0 {
+			selected = i
+			continue
+		}
+		best := nodes[selected]
+		if node.FailedOn != best.FailedOn {
+			if best.FailedOn {
+				selected = i
+			}
+			continue
+		}
+		if node.InFlight*best.Capacity < best.InFlight*node.Capacity {
+			selected = i
+		}
+	}
+	return selected
+}
+
+// nodeDispatcher hands the requests to the nodes picked by its selector
+type nodeDispatcher struct {
+	lock     sync.Mutex
+	selector NodeSelector
+	changed  chan struct{} // closed when the load of a node changed, or the nodes changed
+}
+
+// SetNodeSelector makes the pool hand every request to the node picked by selector, instead of the workers of all
+// nodes taking them from the shared JobC (nil)
+func (gp *NodePool) SetNodeSelector(selector NodeSelector) {
+	gp.dispatcher.lock.Lock()
+	defer gp.dispatcher.lock.Unlock()
+	gp.dispatcher.selector = selector
+}
+
+func (gp *NodePool) hasNodeSelector() bool {
+	gp.dispatcher.lock.Lock()
+	defer gp.dispatcher.lock.Unlock()
+	return gp.dispatcher.selector != nil
+}
+
+// loadChanged wakes the dispatches which wait for a node
+func (d *nodeDispatcher) loadChanged() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+// selectNode returns the node which gets r, with its in-flight count incremented, and a channel which is closed
+// when the load changes (for waiting if no node was selected)
+func (gp *NodePool) selectNode(r *SimRequest) (*Node, <-chan struct{}) {
+	gp.dispatcher.lock.Lock()
+	defer gp.dispatcher.lock.Unlock()
+	if gp.dispatcher.changed == nil {
+		gp.dispatcher.changed = make(chan struct{})
+	}
+
+	gp.nodesLock.Lock()
+	nodes := make([]*Node, len(gp.nodes))
+	copy(nodes, gp.nodes)
+	gp.nodesLock.Unlock()
+	loads := make([]NodeLoad, len(nodes))
+	for i, node := range nodes {
+		loads[i] = NodeLoad{
+			URI:      node.URI,
+			Healthy:  node.IsHealthy(),
+			InFlight: int(node.numInFlight.Load()),
+			Capacity: int(node.breaker.capacity(node.adaptive.active(atomic.LoadInt32(&node.numWorkers)))),
+			FailedOn: r.failedOn(node.URI),
+		}
+		if node.workersStoppedUnhealthy() {
+			loads[i].Capacity = 0
+		}
+	}
+	idx := gp.dispatcher.selector.Select(r, loads)
+	if idx < 0 || idx >= len(nodes) {
+		return nil, gp.dispatcher.changed
+	}
+	nodes[idx].numInFlight.Add(1)
+	return nodes[idx], gp.dispatcher.changed
+}
+
+// dispatchToNode hands r to a worker of the node picked by the selector, see Dispatch
+func (gp *NodePool) dispatchToNode(r *SimRequest, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		if gp.numNodes() == 0 {
+			return ErrNoNodesAvailable
+		}
+		node, changed := gp.selectNode(r)
+		if node == nil {
+			select {
+			case <-changed:
+				continue
+			case <-timer.C:
+				return ErrNodeTimeout
+			}
+		}
+
+		select {
+		case node.dispatchC <- r:
+			return nil
+		case <-changed: // i.e. the node was removed, or another one has a free worker now
+			node.finished()
+		case <-timer.C:
+			node.finished()
+			return ErrNodeTimeout
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNodeSelection(t *testing.T) {
+	selector, err := ParseNodeSelection(NodeSelectionShared)
+	require.Nil(t, err, err)
+	require.Nil(t, selector)
+	selector, err = ParseNodeSelection(NodeSelectionLeastLoaded)
+	require.Nil(t, err, err)
+	require.Equal(t, LeastLoadedSelector{}, selector)
+	selector, err = ParseNodeSelection("")
+	require.Nil(t, err, err)
+	require.Equal(t, LeastLoadedSelector{}, selector)
+	_, err = ParseNodeSelection("random")
+	require.NotNil(t, err)
+}
+
+func TestLeastLoadedSelector(t *testing.T) {
+	r := NewSimRequest(context.Background(), "1", []byte("foo"), true, false)
+	tests := []struct {
+		name  string
+		nodes []NodeLoad
+		want  int
+	}{
+		{"no nodes", nil, -1},
+		{"lowest ratio", []NodeLoad{{Healthy: true, InFlight: 2, Capacity: 4}, {Healthy: true, InFlight: 1, Capacity: 4}}, 1},
+		{"ratio, not count", []NodeLoad{{Healthy: true, InFlight: 1, Capacity: 2}, {Healthy: true, InFlight: 2, Capacity: 8}}, 1},
+		{"first on ties", []NodeLoad{{Healthy: true, InFlight: 1, Capacity: 2}, {Healthy: true, InFlight: 2, Capacity: 4}}, 0},
+		{"all full", []NodeLoad{{Healthy: true, InFlight: 2, Capacity: 2}, {Healthy: true, InFlight: 1, Capacity: 0}}, -1},
+		{"healthy ones", []NodeLoad{{InFlight: 0, Capacity: 4}, {Healthy: true, InFlight: 3, Capacity: 4}}, 1},
+		{"healthy one full", []NodeLoad{{InFlight: 0, Capacity: 4}, {Healthy: true, InFlight: 4, Capacity: 4}}, -1},
+		{"none healthy", []NodeLoad{{InFlight: 2, Capacity: 4}, {InFlight: 1, Capacity: 4}}, 1},
+		{"not failed on", []NodeLoad{{Healthy: true, InFlight: 0, Capacity: 4, FailedOn: true}, {Healthy: true, InFlight: 3, Capacity: 4}}, 1},
+		{"failed on if the only free one", []NodeLoad{{Healthy: true, InFlight: 0, Capacity: 4, FailedOn: true}, {Healthy: true, InFlight: 4, Capacity: 4}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, LeastLoadedSelector{}.Select(r, tt.nodes))
+		})
+	}
+}
+
+func TestNodePoolLeastLoaded(t *testing.T) {
+	newNode := func(simDuration time.Duration) *httptest.Server {
+		mockNodeBackend := testutils.NewMockNodeBackend()
+		server := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+		mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+			if body, _ := io.ReadAll(req.Body); strings.Contains(string(body), "net_version") { // the health check
+				w.Write([]byte(`{"jsonrpc":"2.0","result":"1","id":123}`))
+				return
+			}
+			time.Sleep(simDuration)
+			w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+		}
+		t.Cleanup(server.Close)
+		return server
+	}
+	slowNode := newNode(100 * time.Millisecond)
+	fastNode := newNode(10 * time.Millisecond)
+
+	gp := NewNodePool(testLog, nil, 2)
+	defer gp.Shutdown()
+	gp.SetNodeSelector(LeastLoadedSelector{})
+	require.Nil(t, gp.AddNode(slowNode.URL))
+	require.Nil(t, gp.AddNode(fastNode.URL))
+
+	// Dispatched one after another like by the main loop, every node gets requests while it has a free worker
+	numRequests := 40
+	requests := make([]*SimRequest, numRequests)
+	for i := range requests {
+		requests[i] = NewSimRequest(context.Background(), fmt.Sprintf("%d", i), []byte("foo"), true, false)
+		require.Nil(t, gp.Dispatch(requests[i], time.Second))
+	}
+	numByNode := make(map[string]int)
+	for _, r := range requests {
+		res := <-r.ResponseC
+		require.Nil(t, res.Error, res.Error)
+		numByNode[res.NodeURI]++
+	}
+	require.Equal(t, numRequests, numByNode[slowNode.URL]+numByNode[fastNode.URL])
+	require.Greater(t, numByNode[slowNode.URL], 0)
+	require.Less(t, numByNode[slowNode.URL]*3, numByNode[fastNode.URL], numByNode)
+}
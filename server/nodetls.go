@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NodeTLSConfig configures the TLS connections to the nodes (https:// and wss:// URIs), i.e. for mutual TLS. Nodes
+// override the fields with the `_tls_cert`, `_tls_key`, `_tls_ca` and `_tls_server_name` URI query params.
+type NodeTLSConfig struct {
+	CertFile   string // client certificate, together with KeyFile (reloaded when the files changed)
+	KeyFile    string
+	CAFile     string // CA certificate(s) to verify the nodes (default: system roots)
+	ServerName string // the node certificates are verified against, i.e. for nodes addressed by IP
+}
+
+func (c NodeTLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("node TLS client certificate and key must be set together")
+	}
+	return nil
+}
+
+func (c NodeTLSConfig) isZero() bool {
+	return c == NodeTLSConfig{}
+}
+
+// nodeTLSArg returns the TLS config of a node, the pool config with the overrides of the URI query params. Returns nil
+// if there is none.
+func nodeTLSArg(pURL *url.URL, config *NodeTLSConfig) *NodeTLSConfig {
+	var nodeConfig NodeTLSConfig
+	if config != nil {
+		nodeConfig = *config
+	}
+	query := pURL.Query()
+	for param, field := range map[string]*string{
+		"_tls_cert":        &nodeConfig.CertFile,
+		"_tls_key":         &nodeConfig.KeyFile,
+		"_tls_ca":          &nodeConfig.CAFile,
+		"_tls_server_name": &nodeConfig.ServerName,
+	} {
+		if value := query.Get(param); value != "" {
+			*field = value
+		}
+	}
+	if nodeConfig.isZero() {
+		return nil
+	}
+	return &nodeConfig
+}
+
+// SetNodeTLS sets the TLS config of the connections to all nodes (nil for the defaults, nodes can override it with
+// the `_tls_*` URI query params). Must be called before nodes are added.
+func (gp *NodePool) SetNodeTLS(config *NodeTLSConfig) error {
+	if config != nil {
+		if err := config.validate(); err != nil {
+			return err
+		}
+	}
+	gp.nodeTLS = config
+	return nil
+}
+
+// nodeCertLoader returns the loader of the client certificate, which is shared by the nodes with the same files
+func (gp *NodePool) nodeCertLoader(certFile, keyFile string) (*CertLoader, error) {
+	gp.nodeCertsLock.Lock()
+	defer gp.nodeCertsLock.Unlock()
+	key := certFile + "\x00" + keyFile
+	if loader, found := gp.nodeCerts[key]; found {
+		return loader, nil
+	}
+	loader, err := NewCertLoader(gp.log, certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading node TLS client certificate failed")
+	}
+	if gp.nodeCerts == nil {
+		gp.nodeCerts = make(map[string]*CertLoader)
+	}
+	gp.nodeCerts[key] = loader
+	return loader, nil
+}
+
+// applyNodeTLS configures the TLS of the HTTP and WebSocket connections of the node, on top of the TLS config of its
+// client (i.e. for attestation)
+func (gp *NodePool) applyNodeTLS(node *Node, pURL *url.URL) error {
+	config := nodeTLSArg(pURL, gp.nodeTLS)
+	if config == nil {
+		return nil
+	} else if err := config.validate(); err != nil {
+		return err
+	}
+
+	httpTransport, ok := node.client.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("node TLS config not supported by the HTTP client of the node")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if httpTransport.TLSClientConfig != nil {
+		tlsConfig = httpTransport.TLSClientConfig.Clone()
+	}
+	if config.CAFile != "" {
+		caCerts, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read node TLS CA file")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return errors.Errorf("no certificates found in node TLS CA file %s", config.CAFile)
+		}
+	}
+	if config.CertFile != "" {
+		loader, err := gp.nodeCertLoader(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetClientCertificate = loader.GetClientCertificate
+	}
+	if config.ServerName != "" {
+		tlsConfig.ServerName = config.ServerName
+	}
+
+	httpTransport.TLSClientConfig = tlsConfig
+	if ws, ok := node.transport.(*wsTransport); ok {
+		ws.tlsConfig = tlsConfig
+	}
+	gp.log.Infow("Using node TLS config", "uri", node.URI, "certFile", config.CertFile, "caFile", config.CAFile, "serverName", config.ServerName)
+	return nil
+}
+
+// ReloadNodeCertificates reads the client certificates of the nodes from disk again (i.e. on SIGHUP). On error, the
+// previous certificate stays in use.
+func (gp *NodePool) ReloadNodeCertificates() (err error) {
+	gp.nodeCertsLock.Lock()
+	defer gp.nodeCertsLock.Unlock()
+	for _, loader := range gp.nodeCerts {
+		if reloadErr := loader.Reload(); reloadErr != nil && err == nil {
+			err = reloadErr
+		}
+	}
+	return err
+}
+
+// WatchNodeCertificates checks the client certificate files of the nodes for changes every interval, and reloads
+// them. Blocks until ctx is done.
+func (gp *NodePool) WatchNodeCertificates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			gp.nodeCertsLock.Lock()
+			for _, loader := range gp.nodeCerts {
+				if !loader.filesChanged() {
+					continue
+				}
+				if err := loader.Reload(); err != nil {
+					gp.log.Errorw("Node TLS client certificate reload failed, keeping the previous certificate", "certFile", loader.certFile, "error", err)
+				} else {
+					gp.log.Infow("Node TLS client certificate reloaded", "certFile", loader.certFile)
+				}
+			}
+			gp.nodeCertsLock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeTLSArg(t *testing.T) {
+	config := &NodeTLSConfig{CertFile: "client.pem", KeyFile: "client.key", CAFile: "ca.pem"}
+	pURL, _ := url.Parse("https://10.0.0.1:8545")
+	require.Nil(t, nodeTLSArg(pURL, nil))
+	require.Equal(t, config, nodeTLSArg(pURL, config))
+	pURL, _ = url.Parse("https://10.0.0.1:8545?_tls_server_name=node1&_tls_ca=node1-ca.pem")
+	require.Equal(t, &NodeTLSConfig{CertFile: "client.pem", KeyFile: "client.key", CAFile: "node1-ca.pem", ServerName: "node1"}, nodeTLSArg(pURL, config))
+	require.Equal(t, &NodeTLSConfig{CAFile: "node1-ca.pem", ServerName: "node1"}, nodeTLSArg(pURL, nil))
+
+	require.NotNil(t, NewNodePool(testLog, nil, 1).SetNodeTLS(&NodeTLSConfig{CertFile: "client.pem"}))
+}
+
+func TestNodeMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writeSelfSignedCert(t, serverCert, serverKey, "node")
+	writeSelfSignedCert(t, clientCert, clientKey, "client-1")
+
+	// The node requires a client certificate, and records its common name
+	clientNames := make(chan string, 100)
+	node := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientNames <- req.TLS.PeerCertificates[0].Subject.CommonName
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}))
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	require.Nil(t, err, err)
+	node.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAnyClientCert}
+	node.StartTLS()
+	defer node.Close()
+	uri := node.URL + "?_tls_server_name=localhost&_healthcheck_success=status" // the node certificate is for localhost, not the IP
+
+	// Without a client certificate, or without the CA and server name, the connection fails
+	gp := NewNodePool(testLog, nil, 1)
+	require.Nil(t, gp.SetNodeTLS(&NodeTLSConfig{CAFile: serverCert}))
+	require.NotNil(t, gp.AddNode(uri))
+	gp = NewNodePool(testLog, nil, 1)
+	require.Nil(t, gp.SetNodeTLS(&NodeTLSConfig{CertFile: clientCert, KeyFile: clientKey}))
+	require.NotNil(t, gp.AddNode(uri))
+
+	gp = NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.SetNodeTLS(&NodeTLSConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: serverCert}))
+	require.Nil(t, gp.AddNode(uri))
+	require.Equal(t, "client-1", <-clientNames) // the health check
+	r := NewSimRequest(context.Background(), "", []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`), true, false)
+	gp.JobC <- r
+	res := <-r.ResponseC
+	require.Nil(t, res.Error, res.Error)
+	require.Equal(t, "client-1", <-clientNames)
+
+	// A rotated certificate is used by the new connections once reloaded
+	writeSelfSignedCert(t, clientCert, clientKey, "client-2")
+	require.Nil(t, gp.ReloadNodeCertificates())
+	gp.nodes[0].client.CloseIdleConnections()
+	require.Nil(t, gp.nodes[0].HealthCheck())
+	require.Equal(t, "client-2", <-clientNames)
+}
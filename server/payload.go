@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// Payload is the body of a SimRequest. It is either held in memory (BytesPayload), or for very large
+// bodies spooled to a temporary file on disk (FilePayload).
+type Payload interface {
+	// Len returns the size of the payload in bytes, negative if it's not known in advance (proxied with chunked
+	// transfer encoding then)
+	Len() int64
+
+	// Open returns a new reader over the full payload. Can be called multiple times (i.e. for retries).
+	Open() (io.ReadCloser, error)
+
+	// Bytes returns the full payload, reading it into memory if necessary
+	Bytes() ([]byte, error)
+
+	// Close releases all resources held by the payload (i.e. removes the spool file). Safe to call multiple times.
+	Close() error
+}
+
+// BytesPayload is a payload held in memory
+type BytesPayload []byte
+
+func (p BytesPayload) Len() int64 {
+	return int64(len(p))
+}
+
+func (p BytesPayload) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(p)), nil
+}
+
+func (p BytesPayload) Bytes() ([]byte, error) {
+	return p, nil
+}
+
+func (p BytesPayload) Close() error {
+	return nil
+}
+
+// FilePayload is a payload which was spooled to a temporary file on disk
+type FilePayload struct {
+	path string
+	size int64
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (p *FilePayload) Len() int64 {
+	return p.size
+}
+
+func (p *FilePayload) Path() string {
+	return p.path
+}
+
+func (p *FilePayload) Open() (io.ReadCloser, error) {
+	return os.Open(p.path)
+}
+
+func (p *FilePayload) Bytes() ([]byte, error) {
+	return os.ReadFile(p.path)
+}
+
+func (p *FilePayload) Close() error {
+	p.closeOnce.Do(func() {
+		p.closeErr = os.Remove(p.path)
+	})
+	return p.closeErr
+}
+
+// requestBody returns the body of an outgoing request with the payload, and its content length: http.NoBody for empty
+// payloads, and -1 (sent with chunked transfer encoding) if the payload doesn't know its length (negative Len)
+func requestBody(payload Payload) (body io.ReadCloser, contentLength int64, err error) {
+	contentLength = payload.Len()
+	if contentLength == 0 {
+		return http.NoBody, 0, nil
+	} else if contentLength < 0 {
+		contentLength = -1
+	}
+	body, err = payload.Open()
+	return body, contentLength, err
+}
+
+// limitRequestBody returns false if the Content-Length of the request is larger than maxBytes, so that it's rejected
+// without reading the body. Otherwise the body is limited with http.MaxBytesReader to one byte over maxBytes (for
+// ReadPayload to detect it), and the connection is closed after the response instead of reading the rest of a larger
+// body. Compressed bodies are only limited after decompression.
+func limitRequestBody(w http.ResponseWriter, req *http.Request, maxBytes int) bool {
+	if isGzipEncoded(req) {
+		return true
+	} else if req.ContentLength > int64(maxBytes) {
+		return false
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, int64(maxBytes)+1)
+	return true
+}
+
+// writePayloadTooLarge writes the error response for a body larger than PayloadMaxBytes
+func writePayloadTooLarge(w http.ResponseWriter) {
+	writeError(w, http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge, "Payload too large")
+}
+
+// ReadPayload reads a payload of at most maxBytes from r. Payloads larger than spoolThreshold are
+// written to a temporary file in spoolDir instead of being held in memory (spoolThreshold 0 disables
+// spooling). Returns ErrPayloadTooLarge if the payload exceeds maxBytes.
+func ReadPayload(r io.Reader, maxBytes, spoolThreshold int, spoolDir string) (Payload, error) {
+	limit := int64(maxBytes) + 1
+	if spoolThreshold <= 0 || spoolThreshold >= maxBytes {
+		body, err := io.ReadAll(io.LimitReader(r, limit))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxBytes {
+			return nil, ErrPayloadTooLarge
+		}
+		return BytesPayload(body), nil
+	}
+
+	// Read up to the spool threshold into memory, and keep it there if the payload is small enough
+	head, err := io.ReadAll(io.LimitReader(r, int64(spoolThreshold)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(head) <= spoolThreshold {
+		return BytesPayload(head), nil
+	}
+
+	// Spool the rest of the payload to disk
+	f, err := os.CreateTemp(spoolDir, "prio-lb-payload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	payload := &FilePayload{path: f.Name()}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), io.LimitReader(r, limit-int64(len(head)))))
+	if err == nil && n > int64(maxBytes) {
+		err = ErrPayloadTooLarge
+	}
+	if err != nil {
+		payload.Close()
+		return nil, err
+	}
+
+	payload.size = n
+	return payload, nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPayload(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small payload stays in memory
+	p, err := ReadPayload(bytes.NewBufferString("foo"), 100, 10, dir)
+	require.Nil(t, err, err)
+	require.IsType(t, BytesPayload{}, p)
+	require.Equal(t, int64(3), p.Len())
+
+	// Large payload gets spooled to disk
+	data := bytes.Repeat([]byte("x"), 50)
+	p, err = ReadPayload(bytes.NewBuffer(data), 100, 10, dir)
+	require.Nil(t, err, err)
+	fp, ok := p.(*FilePayload)
+	require.True(t, ok)
+	require.Equal(t, int64(50), p.Len())
+	require.FileExists(t, fp.Path())
+
+	// Payload can be read multiple times
+	for i := 0; i < 2; i++ {
+		r, err := p.Open()
+		require.Nil(t, err, err)
+		b, err := io.ReadAll(r)
+		require.Nil(t, err, err)
+		require.Nil(t, r.Close())
+		require.Equal(t, data, b)
+	}
+
+	// Close removes the spool file, and is idempotent
+	require.Nil(t, p.Close())
+	require.Nil(t, p.Close())
+	require.NoFileExists(t, fp.Path())
+
+	// Too large payloads are rejected, and no spool file is left behind
+	_, err = ReadPayload(bytes.NewBuffer(bytes.Repeat([]byte("x"), 101)), 100, 10, dir)
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+	_, err = ReadPayload(bytes.NewBuffer(bytes.Repeat([]byte("x"), 101)), 100, 0, dir)
+	require.ErrorIs(t, err, ErrPayloadTooLarge)
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err, err)
+	require.Equal(t, 0, len(entries))
+}
+
+func TestQueueNumBytes(t *testing.T) {
+	dir := t.TempDir()
+	filePayload, err := ReadPayload(bytes.NewBuffer(bytes.Repeat([]byte("x"), 50)), 100, 10, dir)
+	require.Nil(t, err, err)
+	defer filePayload.Close()
+
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	q.Push(NewSimRequest(context.Background(), "1", []byte("foo"), false, false))
+	q.Push(NewSimRequestWithPayload(context.Background(), "2", filePayload, true, false))
+	require.Equal(t, int64(53), q.NumBytes())
+
+	q.Pop()
+	require.Equal(t, int64(3), q.NumBytes())
+	q.Pop()
+	require.Equal(t, int64(0), q.NumBytes())
+}
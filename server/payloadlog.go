@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// RedactedValue replaces the redacted parts of logged payloads
+const RedactedValue = "[REDACTED]"
+
+// PayloadSampling selects the requests whose payloads are logged
+type PayloadSampling struct {
+	EveryN  int  // log 1 in N requests (0: none)
+	OnError bool // log all failed requests
+}
+
+// Enabled returns whether any payloads are logged
+func (s PayloadSampling) Enabled() bool {
+	return s.EveryN > 0 || s.OnError
+}
+
+// ParsePayloadLogSampling parses a comma separated list of N (log 1 in N requests) and "errors" (log all failed
+// requests), i.e. "100,errors". Invalid entries are ignored.
+func ParsePayloadLogSampling(s string) PayloadSampling {
+	res := PayloadSampling{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "errors" {
+			res.OnError = true
+		} else if n, err := strconv.Atoi(entry); err == nil && n > 0 {
+			res.EveryN = n
+		}
+	}
+	return res
+}
+
+// PayloadRedactor removes sensitive data from a payload before it is logged. It must not modify payload.
+type PayloadRedactor func(payload []byte) []byte
+
+// RegexRedactor replaces all matches of pattern with RedactedValue
+func RegexRedactor(pattern *regexp.Regexp) PayloadRedactor {
+	return func(payload []byte) []byte {
+		return pattern.ReplaceAll(payload, []byte(RedactedValue))
+	}
+}
+
+// JSONPathRedactor replaces the values at the JSON paths with RedactedValue. Paths are dot separated object keys and
+// array indexes, with "*" matching any key or index (i.e. "params.0.signature" or "*.params" for batches). Payloads
+// which are not valid JSON are returned unchanged.
+func JSONPathRedactor(paths []string) PayloadRedactor {
+	splitPaths := make([][]string, 0, len(paths))
+	for _, path := range paths {
+		splitPaths = append(splitPaths, strings.Split(path, "."))
+	}
+
+	return func(payload []byte) []byte {
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber() // keep numbers unchanged
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return payload
+		}
+		for _, path := range splitPaths {
+			value = redactJSONPath(value, path)
+		}
+
+		buf := new(bytes.Buffer)
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(value); err != nil {
+			return payload
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+}
+
+// redactJSONPath replaces the values at path in the decoded JSON value
+func redactJSONPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return RedactedValue
+	}
+
+	switch node := value.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if path[0] == "*" || path[0] == key {
+				node[key] = redactJSONPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				node[i] = redactJSONPath(child, path[1:])
+			}
+		}
+	}
+	return value
+}
+
+// ChainRedactors applies the redactors in order (nil redactors are skipped)
+func ChainRedactors(redactors ...PayloadRedactor) PayloadRedactor {
+	return func(payload []byte) []byte {
+		for _, redact := range redactors {
+			if redact != nil {
+				payload = redact(payload)
+			}
+		}
+		return payload
+	}
+}
+
+// NewPayloadRedactorFromConfig returns the redactor of the JSON paths (comma separated, see JSONPathRedactor) and
+// the regex (see RegexRedactor). Both are optional.
+func NewPayloadRedactorFromConfig(paths, pattern string) (PayloadRedactor, error) {
+	redactors := []PayloadRedactor{}
+	if paths := splitCommaList(paths); len(paths) > 0 {
+		redactors = append(redactors, JSONPathRedactor(paths))
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid PAYLOAD_LOG_REDACT_REGEX")
+		}
+		redactors = append(redactors, RegexRedactor(re))
+	}
+	return ChainRedactors(redactors...), nil
+}
+
+// splitCommaList returns the trimmed, non-empty entries of a comma separated list
+func splitCommaList(s string) []string {
+	res := []string{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// PayloadLogger logs the redacted and truncated request and response payloads of a sample of requests, to debug bad
+// node responses. The request and its response are logged together, in one line.
+type PayloadLogger struct {
+	log      *zap.SugaredLogger
+	sampling PayloadSampling
+	maxBytes int // payloads are truncated to this size (after redaction), 0 means no limit
+	redact   PayloadRedactor
+}
+
+// NewPayloadLogger creates a PayloadLogger. redact is optional.
+func NewPayloadLogger(log *zap.SugaredLogger, sampling PayloadSampling, maxBytes int, redact PayloadRedactor) *PayloadLogger {
+	if redact == nil {
+		redact = ChainRedactors()
+	}
+	return &PayloadLogger{log: log, sampling: sampling, maxBytes: maxBytes, redact: redact}
+}
+
+// IsSampled returns whether the payloads of a request are logged regardless of the outcome. The decision is derived
+// from the request ID, so it's the same for every try of the request.
+func (l *PayloadLogger) IsSampled(reqID string) bool {
+	if l.sampling.EveryN <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(reqID))
+	return h.Sum32()%uint32(l.sampling.EveryN) == 0
+}
+
+// Log logs the payloads of the completed request, if it's sampled (or failed, with OnError)
+func (l *PayloadLogger) Log(r *SimRequest, resp SimResponse) {
+	if l == nil || !(l.IsSampled(r.ID) || (l.sampling.OnError && resp.Error != nil)) {
+		return
+	}
+
+	request, err := r.Payload.Bytes()
+	if err != nil {
+		l.log.Errorw("Reading the payload for logging failed", "reqID", r.ID, "error", err)
+		return
+	}
+
+	fields := []interface{}{
+		"reqID", r.ID,
+		"nodeURI", resp.NodeURI,
+		"statusCode", resp.StatusCode,
+		"tries", r.Tries,
+		"requestSize", len(request),
+		"request", l.format(request),
+		"responseSize", len(resp.Payload),
+		"response", l.format(resp.Payload),
+	}
+	if resp.Error != nil {
+		fields = append(fields, "errorKind", errorKind(resp), "error", resp.Error.Error())
+	}
+	l.log.Infow("Payload sample", fields...)
+}
+
+// format redacts and truncates a payload for logging
+func (l *PayloadLogger) format(payload []byte) string {
+	payload = l.redact(payload)
+	if l.maxBytes > 0 && len(payload) > l.maxBytes {
+		return fmt.Sprintf("%s...(truncated, %d bytes)", payload[:l.maxBytes], len(payload))
+	}
+	return string(payload)
+}
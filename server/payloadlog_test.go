@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParsePayloadLogSampling(t *testing.T) {
+	require.Equal(t, PayloadSampling{}, ParsePayloadLogSampling(""))
+	require.False(t, ParsePayloadLogSampling("0").Enabled())
+	require.Equal(t, PayloadSampling{EveryN: 100}, ParsePayloadLogSampling("100"))
+	require.Equal(t, PayloadSampling{OnError: true}, ParsePayloadLogSampling("errors"))
+	require.Equal(t, PayloadSampling{EveryN: 10, OnError: true}, ParsePayloadLogSampling(" 10, errors,x,-1"))
+}
+
+func TestPayloadLogSamplingRate(t *testing.T) {
+	l := NewPayloadLogger(testLog, PayloadSampling{EveryN: 10}, 0, nil)
+	numSampled := 0
+	for i := 0; i < 10_000; i++ {
+		reqID := fmt.Sprintf("req-%d", i)
+		sampled := l.IsSampled(reqID)
+		require.Equal(t, sampled, l.IsSampled(reqID)) // stable per request
+		if sampled {
+			numSampled++
+		}
+	}
+	require.InDelta(t, 1000, numSampled, 150)
+
+	l = NewPayloadLogger(testLog, PayloadSampling{EveryN: 1}, 0, nil)
+	require.True(t, l.IsSampled("foo"))
+	l = NewPayloadLogger(testLog, PayloadSampling{OnError: true}, 0, nil)
+	require.False(t, l.IsSampled("foo"))
+}
+
+func TestPayloadRedactors(t *testing.T) {
+	payload := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_sendBundle","params":[{"txs":["0xaa","0xbb"],"signature":"0x123","blockNumber":12345678901234567890}]}`)
+
+	// JSON paths, with wildcards
+	redact := JSONPathRedactor([]string{"params.0.signature", "params.*.txs.1", "unknown.path"})
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"method":"eth_sendBundle","params":[{"txs":["0xaa","[REDACTED]"],"signature":"[REDACTED]","blockNumber":12345678901234567890}]}`, string(redact(payload)))
+	require.Contains(t, string(redact(payload)), "12345678901234567890") // numbers are kept unchanged
+	redact = JSONPathRedactor([]string{"params"})
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"method":"eth_sendBundle","params":"[REDACTED]"}`, string(redact(payload)))
+
+	// Batches
+	batch := []byte(`[{"id":1,"params":["0x1"]},{"id":2,"params":["0x2"]}]`)
+	redact = JSONPathRedactor([]string{"*.params"})
+	require.JSONEq(t, `[{"id":1,"params":"[REDACTED]"},{"id":2,"params":"[REDACTED]"}]`, string(redact(batch)))
+
+	// Invalid JSON is not changed
+	require.Equal(t, "not json", string(redact([]byte("not json"))))
+
+	// Regex
+	redact = RegexRedactor(regexp.MustCompile(`0x[0-9a-f]{2}\b`))
+	require.Equal(t, `["[REDACTED]","0x123","[REDACTED]"]`, string(redact([]byte(`["0xaa","0x123","0xbb"]`))))
+
+	// Config, with the JSON paths applied before the regex
+	redact, err := NewPayloadRedactorFromConfig("params.0.signature, ", `0x[0-9a-f]+`)
+	require.Nil(t, err, err)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"method":"eth_sendBundle","params":[{"txs":["[REDACTED]","[REDACTED]"],"signature":"[REDACTED]","blockNumber":12345678901234567890}]}`, string(redact(payload)))
+	redact, err = NewPayloadRedactorFromConfig("", "")
+	require.Nil(t, err, err)
+	require.Equal(t, payload, redact(payload))
+	_, err = NewPayloadRedactorFromConfig("", "(")
+	require.NotNil(t, err)
+
+	// Custom redactors are chained
+	redact = ChainRedactors(redact, nil, func(payload []byte) []byte { return []byte("custom") })
+	require.Equal(t, "custom", string(redact(payload)))
+}
+
+func TestPayloadLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	redact := RegexRedactor(regexp.MustCompile(`secret`))
+	l := NewPayloadLogger(zap.New(core).Sugar(), PayloadSampling{OnError: true}, 20, redact)
+
+	// Not sampled, and successful
+	request := NewSimRequest(context.Background(), "1", []byte(`{"key":"secret"}`), false, false)
+	l.Log(request, SimResponse{Payload: []byte(`{"result":"ok"}`)})
+	require.Equal(t, 0, logs.Len())
+
+	// Failed requests are logged, with the redacted and truncated payloads of both request and response
+	request.Tries = 2
+	l.Log(request, SimResponse{StatusCode: 500, Payload: []byte(`{"error":"secret error with a long message"}`), Error: errors.New("error in response"), NodeURI: "http://node1"})
+	entries := logs.TakeAll()
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "Payload sample", entries[0].Message)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "1", fields["reqID"])
+	require.Equal(t, "http://node1", fields["nodeURI"])
+	require.Equal(t, int64(500), fields["statusCode"])
+	require.Equal(t, int64(2), fields["tries"])
+	require.Equal(t, `{"key":"[REDACTED]"}`, fields["request"])
+	require.Equal(t, int64(16), fields["requestSize"])
+	require.Equal(t, `{"error":"[REDACTED]...(truncated, 48 bytes)`, fields["response"])
+	require.Equal(t, ErrorKindNodeError, fields["errorKind"])
+	require.Equal(t, "error in response", fields["error"])
+
+	// A nil logger is disabled
+	var nilLogger *PayloadLogger
+	nilLogger.Log(request, SimResponse{Error: errors.New("error")})
+}
+
+func TestWebserverPayloadLogging(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	webserver.EnablePayloadLogging(NewPayloadLogger(zap.New(core).Sugar(), PayloadSampling{EveryN: 1}, 0, nil))
+	numRequests := 0
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		numRequests++
+		if numRequests == 1 {
+			http.Error(w, "error", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"result":"ok"}`)) //nolint:errcheck
+	}
+
+	// Logged once with the final response, after retrying the failed try
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, newSimTestRequest(`{"id":1}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	entries := logs.FilterMessage("Payload sample").AllUntimed()
+	require.Equal(t, 1, len(entries))
+	fields := entries[0].ContextMap()
+	require.Equal(t, "test-req", fields["reqID"])
+	require.Equal(t, int64(2), fields["tries"])
+	require.Equal(t, `{"id":1}`, fields["request"])
+	require.Equal(t, `{"result":"ok"}`, fields["response"])
+}
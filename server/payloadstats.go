@@ -0,0 +1,203 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size classes of request payloads
+const (
+	SizeClassSmall  = "small"
+	SizeClassMedium = "medium"
+	SizeClassLarge  = "large"
+)
+
+// SizeClassBounds are the boundaries of the size classes: payloads of at most SmallMaxBytes are small, of at most
+// MediumMaxBytes medium, and larger ones large
+type SizeClassBounds struct {
+	SmallMaxBytes  int64 `json:"smallMaxBytes"`
+	MediumMaxBytes int64 `json:"mediumMaxBytes"`
+}
+
+// DefaultPayloadSizeClasses are the size classes if PAYLOAD_SIZE_CLASSES_KB is not set
+var DefaultPayloadSizeClasses = SizeClassBounds{SmallMaxBytes: 16 * 1024, MediumMaxBytes: 256 * 1024}
+
+// payloadSizeBuckets are the upper bounds (in bytes) of the request and response size histograms
+var payloadSizeBuckets = []int64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// ParsePayloadSizeClasses parses the two boundaries of the size classes in KB, i.e. "16,256". Returns
+// DefaultPayloadSizeClasses if s is not two increasing positive numbers.
+func ParsePayloadSizeClasses(s string) SizeClassBounds {
+	small, medium, found := strings.Cut(s, ",")
+	if !found {
+		return DefaultPayloadSizeClasses
+	}
+	smallKB, err1 := strconv.ParseInt(strings.TrimSpace(small), 10, 64)
+	mediumKB, err2 := strconv.ParseInt(strings.TrimSpace(medium), 10, 64)
+	if err1 != nil || err2 != nil || smallKB <= 0 || mediumKB <= smallKB {
+		return DefaultPayloadSizeClasses
+	}
+	return SizeClassBounds{SmallMaxBytes: smallKB * 1024, MediumMaxBytes: mediumKB * 1024}
+}
+
+// Classify returns the size class of a payload of size bytes
+func (c SizeClassBounds) Classify(size int64) string {
+	if size <= c.SmallMaxBytes {
+		return SizeClassSmall
+	} else if size <= c.MediumMaxBytes {
+		return SizeClassMedium
+	}
+	return SizeClassLarge
+}
+
+// SizeHistogramBucket is the number of payloads of at most LeBytes (cumulative)
+type SizeHistogramBucket struct {
+	LeBytes int64  `json:"leBytes"`
+	Count   uint64 `json:"count"`
+}
+
+type SizeHistogram struct {
+	Buckets  []SizeHistogramBucket `json:"buckets"`
+	Count    uint64                `json:"count"` // all observations, including those above the largest bucket
+	SumBytes int64                 `json:"sumBytes"`
+}
+
+// PayloadStatsResponse are the payload size histograms, and the proxy latency by size class of the request
+type PayloadStatsResponse struct {
+	SizeClasses             SizeClassBounds             `json:"sizeClasses"`
+	RequestsBySizeClass     map[string]uint64           `json:"requestsBySizeClass"`
+	RequestSizes            SizeHistogram               `json:"requestSizes"`
+	ResponseSizes           SizeHistogram               `json:"responseSizes"`
+	ProxyLatencyBySizeClass map[string]LatencyHistogram `json:"proxyLatencyBySizeClass"`
+}
+
+// int64Histogram counts observations in buckets (not cumulative), the last one for observations above the largest
+// bound
+type int64Histogram struct {
+	bounds []int64
+	counts []uint64
+	sum    int64
+}
+
+func newInt64Histogram(bounds []int64) *int64Histogram {
+	return &int64Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *int64Histogram) observe(value int64) {
+	h.counts[sort.Search(len(h.bounds), func(i int) bool { return value <= h.bounds[i] })]++
+	h.sum += value
+}
+
+// cumulative returns the cumulative count of every bucket, and the count of all observations
+func (h *int64Histogram) cumulative() (counts []uint64, total uint64) {
+	counts = make([]uint64, len(h.bounds))
+	for i := range h.bounds {
+		total += h.counts[i]
+		counts[i] = total
+	}
+	return counts, total + h.counts[len(h.bounds)]
+}
+
+// PayloadStats records the sizes of request and response payloads, and the proxy latency by size class, to see
+// whether large payloads are slower
+type PayloadStats struct {
+	classes        SizeClassBounds
+	latencyBuckets []time.Duration
+
+	lock                sync.Mutex
+	requestsBySizeClass map[string]uint64
+	requestSizes        *int64Histogram
+	responseSizes       *int64Histogram
+	proxyLatency        map[string]*int64Histogram // by size class, in microseconds
+}
+
+func NewPayloadStats(classes SizeClassBounds, latencyBuckets []time.Duration) *PayloadStats {
+	s := &PayloadStats{
+		classes:             classes,
+		latencyBuckets:      latencyBuckets,
+		requestsBySizeClass: make(map[string]uint64),
+		requestSizes:        newInt64Histogram(payloadSizeBuckets),
+		responseSizes:       newInt64Histogram(payloadSizeBuckets),
+		proxyLatency:        make(map[string]*int64Histogram),
+	}
+	latencyBoundsUs := make([]int64, len(latencyBuckets))
+	for i, bound := range latencyBuckets {
+		latencyBoundsUs[i] = bound.Microseconds()
+	}
+	for _, class := range []string{SizeClassSmall, SizeClassMedium, SizeClassLarge} {
+		s.requestsBySizeClass[class] = 0
+		s.proxyLatency[class] = newInt64Histogram(latencyBoundsUs)
+	}
+	return s
+}
+
+// Classify returns the size class of a payload of size bytes
+func (s *PayloadStats) Classify(size int64) string {
+	return s.classes.Classify(size)
+}
+
+// ObserveRequest records the size of an accepted request, classified at ingest (SimRequest.SizeClass)
+func (s *PayloadStats) ObserveRequest(r *SimRequest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requestSizes.observe(r.Payload.Len())
+	s.requestsBySizeClass[r.SizeClass]++
+}
+
+// ObserveResponse records the size of the response, and the proxy latency by the size class of the request. Responses
+// of requests which were never proxied (i.e. timed out in the queue) are not recorded.
+func (s *PayloadStats) ObserveResponse(r *SimRequest, resp SimResponse) {
+	s.observeResponse(r, resp, int64(len(resp.Payload)))
+}
+
+// observeResponse records the response like ObserveResponse, with the size of a streamed body
+func (s *PayloadStats) observeResponse(r *SimRequest, resp SimResponse, size int64) {
+	if resp.SimAt.IsZero() {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.responseSizes.observe(size)
+	if latency, found := s.proxyLatency[r.SizeClass]; found {
+		latency.observe(resp.SimDuration.Microseconds())
+	}
+}
+
+// Stats returns the histograms since the start
+func (s *PayloadStats) Stats() PayloadStatsResponse {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := PayloadStatsResponse{
+		SizeClasses:             s.classes,
+		RequestsBySizeClass:     make(map[string]uint64, len(s.requestsBySizeClass)),
+		RequestSizes:            sizeHistogram(s.requestSizes),
+		ResponseSizes:           sizeHistogram(s.responseSizes),
+		ProxyLatencyBySizeClass: make(map[string]LatencyHistogram, len(s.proxyLatency)),
+	}
+	for class, count := range s.requestsBySizeClass {
+		res.RequestsBySizeClass[class] = count
+	}
+	for class, latency := range s.proxyLatency {
+		counts, total := latency.cumulative()
+		histogram := LatencyHistogram{Buckets: make([]HistogramBucket, len(counts)), Count: total, SumMs: float64(latency.sum) / 1000}
+		for i, bound := range s.latencyBuckets {
+			histogram.Buckets[i] = HistogramBucket{LeMs: float64(bound) / float64(time.Millisecond), Count: counts[i]}
+		}
+		res.ProxyLatencyBySizeClass[class] = histogram
+	}
+	return res
+}
+
+func sizeHistogram(h *int64Histogram) SizeHistogram {
+	counts, total := h.cumulative()
+	histogram := SizeHistogram{Buckets: make([]SizeHistogramBucket, len(counts)), Count: total, SumBytes: h.sum}
+	for i, bound := range h.bounds {
+		histogram.Buckets[i] = SizeHistogramBucket{LeBytes: bound, Count: counts[i]}
+	}
+	return histogram
+}
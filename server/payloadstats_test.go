@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePayloadSizeClasses(t *testing.T) {
+	require.Equal(t, DefaultPayloadSizeClasses, ParsePayloadSizeClasses(""))
+	require.Equal(t, DefaultPayloadSizeClasses, ParsePayloadSizeClasses("16"))
+	require.Equal(t, DefaultPayloadSizeClasses, ParsePayloadSizeClasses("100,10"))
+	require.Equal(t, DefaultPayloadSizeClasses, ParsePayloadSizeClasses("0,10"))
+	require.Equal(t, DefaultPayloadSizeClasses, ParsePayloadSizeClasses("x,10"))
+	require.Equal(t, SizeClassBounds{SmallMaxBytes: 1024, MediumMaxBytes: 64 * 1024}, ParsePayloadSizeClasses(" 1, 64"))
+}
+
+func TestPayloadSizeClassify(t *testing.T) {
+	classes := DefaultPayloadSizeClasses
+	require.Equal(t, SizeClassSmall, classes.Classify(0))
+	require.Equal(t, SizeClassSmall, classes.Classify(16*1024)) // bounds are inclusive
+	require.Equal(t, SizeClassMedium, classes.Classify(16*1024+1))
+	require.Equal(t, SizeClassMedium, classes.Classify(256*1024))
+	require.Equal(t, SizeClassLarge, classes.Classify(256*1024+1))
+}
+
+func TestPayloadStats(t *testing.T) {
+	stats := NewPayloadStats(SizeClassBounds{SmallMaxBytes: 1024, MediumMaxBytes: 4096}, []time.Duration{10 * time.Millisecond, 100 * time.Millisecond})
+	observe := func(size int, latency time.Duration, respSize int) {
+		r := &SimRequest{Payload: BytesPayload(make([]byte, size))}
+		r.SizeClass = stats.Classify(int64(size))
+		stats.ObserveRequest(r)
+		stats.ObserveResponse(r, SimResponse{Payload: make([]byte, respSize), SimAt: time.Now(), SimDuration: latency})
+	}
+	observe(100, 5*time.Millisecond, 100)
+	observe(2000, 50*time.Millisecond, 2000)
+	observe(5000, 500*time.Millisecond, 20_000_000) // above the largest size bucket
+
+	// Not proxied: only the request is recorded
+	r := &SimRequest{Payload: BytesPayload(make([]byte, 10)), SizeClass: SizeClassSmall}
+	stats.ObserveRequest(r)
+	stats.ObserveResponse(r, SimResponse{Error: ErrRequestTimeout})
+
+	res := stats.Stats()
+	require.Equal(t, map[string]uint64{SizeClassSmall: 2, SizeClassMedium: 1, SizeClassLarge: 1}, res.RequestsBySizeClass)
+	require.Equal(t, uint64(4), res.RequestSizes.Count)
+	require.Equal(t, int64(7110), res.RequestSizes.SumBytes)
+	require.Equal(t, SizeHistogramBucket{LeBytes: 1024, Count: 2}, res.RequestSizes.Buckets[0])
+	require.Equal(t, SizeHistogramBucket{LeBytes: 4096, Count: 3}, res.RequestSizes.Buckets[1])
+	require.Equal(t, uint64(4), res.RequestSizes.Buckets[len(res.RequestSizes.Buckets)-1].Count)
+	require.Equal(t, uint64(3), res.ResponseSizes.Count)
+	require.Equal(t, uint64(2), res.ResponseSizes.Buckets[len(res.ResponseSizes.Buckets)-1].Count)
+
+	require.Equal(t, LatencyHistogram{Buckets: []HistogramBucket{{LeMs: 10, Count: 1}, {LeMs: 100, Count: 1}}, Count: 1, SumMs: 5}, res.ProxyLatencyBySizeClass[SizeClassSmall])
+	require.Equal(t, LatencyHistogram{Buckets: []HistogramBucket{{LeMs: 10, Count: 0}, {LeMs: 100, Count: 1}}, Count: 1, SumMs: 50}, res.ProxyLatencyBySizeClass[SizeClassMedium])
+	require.Equal(t, LatencyHistogram{Buckets: []HistogramBucket{{LeMs: 10, Count: 0}, {LeMs: 100, Count: 0}}, Count: 1, SumMs: 500}, res.ProxyLatencyBySizeClass[SizeClassLarge])
+}
+
+func TestWebserverPayloadStats(t *testing.T) {
+	defer func(classes SizeClassBounds) { PayloadSizeClasses = classes }(PayloadSizeClasses)
+	PayloadSizeClasses = SizeClassBounds{SmallMaxBytes: 1024, MediumMaxBytes: 2048}
+
+	webserver, _ := newTestWebserver(t, 1)
+	sizeClasses := make(chan string, 10)
+	webserver.prioQueue.OnPop(func(r *SimRequest, wait time.Duration) {
+		sizeClasses <- r.SizeClass
+	})
+
+	// Payloads straddling the boundaries
+	for _, size := range []int{1024, 1025, 2048, 2049} {
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, newSimTestRequest(string(bytes.Repeat([]byte("x"), size))))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	require.Equal(t, SizeClassSmall, <-sizeClasses)
+	require.Equal(t, SizeClassMedium, <-sizeClasses)
+	require.Equal(t, SizeClassMedium, <-sizeClasses)
+	require.Equal(t, SizeClassLarge, <-sizeClasses)
+
+	rr := httptest.NewRecorder()
+	webserver.HandlePayloadStatsRequest(rr, httptest.NewRequest("GET", "/stats/payloads", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	res := PayloadStatsResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	require.Equal(t, PayloadSizeClasses, res.SizeClasses)
+	require.Equal(t, map[string]uint64{SizeClassSmall: 1, SizeClassMedium: 2, SizeClassLarge: 1}, res.RequestsBySizeClass)
+	require.Equal(t, uint64(1), res.ProxyLatencyBySizeClass[SizeClassSmall].Count)
+	require.Equal(t, uint64(2), res.ProxyLatencyBySizeClass[SizeClassMedium].Count)
+	require.Equal(t, uint64(1), res.ProxyLatencyBySizeClass[SizeClassLarge].Count)
+	require.Equal(t, uint64(4), res.RequestSizes.Count)
+	require.Equal(t, int64(1024+1025+2048+2049), res.RequestSizes.SumBytes)
+	require.Equal(t, uint64(4), res.ResponseSizes.Count)
+}
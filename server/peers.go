@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// HeaderPeerHops counts how often a request was forwarded between balancer instances
+const HeaderPeerHops = "X-Peer-Hops"
+
+// peerForwardedHeaders are the request headers which are forwarded to a peer, besides the priority headers
+var peerForwardedHeaders = []string{"Content-Type", "X-Request-ID", "X-Client-ID", "X-API-Key"}
+
+// PeerForwardingStats are the counters of the peer forwarding, in /stats/queue
+type PeerForwardingStats struct {
+	Peers        []string `json:"peers"`
+	NumForwarded int64    `json:"numForwarded"` // rejected requests which were served by a peer
+	NumNoPeer    int64    `json:"numNoPeer"`    // rejected requests without a peer which accepts them
+	NumFailed    int64    `json:"numFailed"`    // forwards which failed without a response of the peer
+}
+
+// PeerForwarder forwards requests which the local queue rejects (full or shedding) to the least-loaded peer: the
+// one with the fewest requests queued ahead which accepts the priority, according to the /admission endpoint of the
+// peers (cached for cacheTTL). The hops header limits how often a request is forwarded, so that requests don't loop
+// between saturated peers.
+type PeerForwarder struct {
+	peers    []string // base URLs of the other instances
+	maxHops  int
+	cacheTTL time.Duration
+	client   *http.Client
+
+	lock   sync.Mutex
+	status map[string]peerStatus // by peer, priority and API key
+
+	numForwarded atomic.Int64
+	numNoPeer    atomic.Int64
+	numFailed    atomic.Int64
+}
+
+type peerStatus struct {
+	admission AdmissionResponse
+	err       error
+	at        time.Time
+}
+
+func NewPeerForwarder(peers []string, maxHops int, cacheTTL, timeout time.Duration) *PeerForwarder {
+	for i, peer := range peers {
+		peers[i] = strings.TrimSuffix(peer, "/")
+	}
+	return &PeerForwarder{
+		peers:    peers,
+		maxHops:  maxHops,
+		cacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: timeout},
+		status:   make(map[string]peerStatus),
+	}
+}
+
+// ParsePeers parses a comma-separated list of peer base URLs (PEERS)
+func ParsePeers(s string) ([]string, error) {
+	peers := splitCommaList(s)
+	for _, peer := range peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL: %s", peer)
+		}
+	}
+	return peers, nil
+}
+
+// peerHops returns the hops header of the request (0 if not forwarded)
+func peerHops(req *http.Request) int {
+	hops, err := strconv.Atoi(req.Header.Get(HeaderPeerHops))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// admission returns the admission status of a request of the priority on the peer, cached for cacheTTL
+func (f *PeerForwarder) admission(ctx context.Context, peer, priority, apiKey string, now time.Time) (AdmissionResponse, error) {
+	key := peer + "|" + priority + "|" + apiKey
+	f.lock.Lock()
+	status, found := f.status[key]
+	f.lock.Unlock()
+	if found && now.Sub(status.at) < f.cacheTTL {
+		return status.admission, status.err
+	}
+
+	status = peerStatus{at: now}
+	status.admission, status.err = f.fetchAdmission(ctx, peer, priority, apiKey)
+	f.lock.Lock()
+	f.status[key] = status
+	f.lock.Unlock()
+	return status.admission, status.err
+}
+
+func (f *PeerForwarder) fetchAdmission(ctx context.Context, peer, priority, apiKey string) (res AdmissionResponse, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/admission?priority="+url.QueryEscape(priority), nil)
+	if err != nil {
+		return res, err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("admission status code %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// pick returns the peer which accepts a request of the priority with the fewest requests queued ahead (false if none)
+func (f *PeerForwarder) pick(ctx context.Context, priority, apiKey string) (peer string, ok bool) {
+	best := -1
+	now := time.Now()
+	for _, candidate := range f.peers {
+		admission, err := f.admission(ctx, candidate, priority, apiKey, now)
+		if err != nil || !admission.Accepted {
+			continue
+		}
+		if best < 0 || admission.QueuedAhead < best {
+			peer, best = candidate, admission.QueuedAhead
+		}
+	}
+	return peer, best >= 0
+}
+
+// forward posts the request to the peer, with the priority of r and the incremented hops header
+func (f *PeerForwarder) forward(ctx context.Context, peer string, req *http.Request, r *SimRequest, hops int) (*http.Response, error) {
+	body, contentLength, err := requestBody(r.Payload)
+	if err != nil {
+		return nil, err
+	}
+	peerReq, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	peerReq.ContentLength = contentLength
+	for _, header := range peerForwardedHeaders {
+		if value := req.Header.Get(header); value != "" {
+			peerReq.Header.Set(header, value)
+		}
+	}
+	// the priority as classified here (i.e. by the priority rules)
+	if r.IsFastTrack {
+		peerReq.Header.Set("X-Fast-Track", "true")
+	} else if r.IsHighPrio {
+		peerReq.Header.Set("X-High-Priority", "true")
+		if r.PriorityLevel > 1 {
+			peerReq.Header.Set("X-Priority", strconv.Itoa(r.PriorityLevel))
+		}
+	}
+	peerReq.Header.Set(HeaderPeerHops, strconv.Itoa(hops))
+	return f.client.Do(peerReq)
+}
+
+func (f *PeerForwarder) Stats() PeerForwardingStats {
+	return PeerForwardingStats{
+		Peers:        f.peers,
+		NumForwarded: f.numForwarded.Load(),
+		NumNoPeer:    f.numNoPeer.Load(),
+		NumFailed:    f.numFailed.Load(),
+	}
+}
+
+// EnablePeerForwarding forwards the requests which the local queue rejects to a peer, see PeerForwarder
+func (s *Webserver) EnablePeerForwarding(peers *PeerForwarder) {
+	s.peers = peers
+}
+
+// forwardToPeer serves a request which the local queue rejected for reason (the error kind) by the least-loaded peer,
+// and returns whether the response of the peer was written. Reverse proxy requests and requests which were forwarded
+// the max. number of hops already are not forwarded.
+func (s *Webserver) forwardToPeer(w http.ResponseWriter, req *http.Request, r *SimRequest, reason string) bool {
+	if s.peers == nil || r.HTTP != nil {
+		return false
+	}
+	hops := peerHops(req)
+	if hops >= s.peers.maxHops {
+		return false
+	}
+	peer, ok := s.peers.pick(req.Context(), r.Priority(), req.Header.Get("X-API-Key"))
+	if !ok {
+		s.peers.numNoPeer.Inc()
+		return false
+	}
+
+	log := s.log.With("reqID", r.ID, "peer", peer, "reason", reason, "hops", hops+1)
+	resp, err := s.peers.forward(req.Context(), peer, req, r, hops+1)
+	if err != nil {
+		s.peers.numFailed.Inc()
+		log.Warnw("Forwarding the request to the peer failed", "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	log.Infow("Forwarded the request to a peer", "statusCode", resp.StatusCode)
+	s.peers.numForwarded.Inc()
+	s.metrics.Count(MetricRequestsForwarded, 1, MetricTag(MetricTagPriority, r.Priority()), MetricTag(MetricTagPeer, peer), MetricTag(MetricTagErrorKind, reason))
+	accessLogEntryFromContext(req.Context()).forwardedTo = peer
+	for header, values := range resp.Header {
+		if header != "Connection" && header != "Transfer-Encoding" {
+			w.Header()[header] = values
+		}
+	}
+	w.Header().Set("X-Forwarded-To-Peer", peer)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Warnw("Copying the response of the peer failed", "error", err)
+	}
+	return true
+}
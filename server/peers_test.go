@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers("http://10.0.0.2:8080, https://lb-2.internal/prefix")
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"http://10.0.0.2:8080", "https://lb-2.internal/prefix"}, peers)
+
+	for _, invalid := range []string{"10.0.0.2:8080", "ftp://10.0.0.2", "http://"} {
+		_, err := ParsePeers(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
+
+func TestPeerForwarding(t *testing.T) {
+	// Instance B serves the overflow, its requests and admission checks are captured
+	webserverB, _ := newTestWebserver(t, 1)
+	var lock sync.Mutex
+	var hopsB []string
+	numAdmissionB := 0
+	handlerB := webserverB.Handler()
+	serverB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		if req.URL.Path == "/admission" {
+			numAdmissionB++
+		} else {
+			hopsB = append(hopsB, req.Header.Get(HeaderPeerHops))
+		}
+		lock.Unlock()
+		handlerB.ServeHTTP(w, req)
+	}))
+	defer serverB.Close()
+
+	// Instance A has a full low-prio queue, and B as peer
+	queueA := NewPrioQueue(0, 0, 1, 2, false, PriorityAging{})
+	defer queueA.Close()
+	require.True(t, queueA.Push(NewSimRequest(context.Background(), "queued", []byte("queued"), false, false)))
+	nodePoolA := NewNodePool(testLog, nil, 1)
+	defer nodePoolA.Shutdown()
+	webserverA := NewWebserver(testLog, ":12345", queueA, nodePoolA)
+	webserverA.EnablePeerForwarding(NewPeerForwarder([]string{serverB.URL + "/"}, 1, time.Minute, 5*time.Second))
+	handlerA := webserverA.Handler()
+
+	payload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`
+	sim := func(hops string) *httptest.ResponseRecorder {
+		req := newSimTestRequest(payload)
+		if hops != "" {
+			req.Header.Set(HeaderPeerHops, hops)
+		}
+		rr := httptest.NewRecorder()
+		handlerA.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The overflow is served by B, with the response of its node
+	for i := 0; i < 2; i++ {
+		rr := sim("")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Equal(t, serverB.URL, rr.Header().Get("X-Forwarded-To-Peer"))
+		require.Contains(t, rr.Body.String(), `"result"`)
+	}
+	lock.Lock()
+	require.Equal(t, []string{"1", "1"}, hopsB)
+	require.Equal(t, 1, numAdmissionB) // cached
+	lock.Unlock()
+	_, _, numLowPrio := queueA.Len()
+	require.Equal(t, 1, numLowPrio)
+
+	// A request which was forwarded the max. number of hops already is rejected
+	rr := sim("1")
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, ErrorCodeQueueFull, decodeErrorResponse(t, rr).Code)
+	lock.Lock()
+	require.Len(t, hopsB, 2)
+	lock.Unlock()
+
+	// Without a peer which accepts the priority, the local rejection is returned
+	webserverA.EnablePeerForwarding(NewPeerForwarder([]string{"http://127.0.0.1:1"}, 1, time.Minute, time.Second))
+	rr = sim("")
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Empty(t, rr.Header().Get("X-Forwarded-To-Peer"))
+
+	// The forwarding counters are part of the queue stats
+	webserverA.EnablePeerForwarding(NewPeerForwarder([]string{serverB.URL}, 1, time.Minute, 5*time.Second))
+	require.Equal(t, http.StatusOK, sim("").Code)
+	rr = httptest.NewRecorder()
+	handlerA.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/queue", bytes.NewBufferString("")))
+	var queueStats QueueStatsResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&queueStats))
+	require.Equal(t, int64(1), queueStats.PeerForwarding.NumForwarded)
+	require.Equal(t, []string{serverB.URL}, queueStats.PeerForwarding.Peers)
+}
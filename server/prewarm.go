@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// prewarmConnsArg returns the number of pre-warmed connections of a node, from the `_prewarm` query param of its URI
+// or NodePrewarmConns
+func prewarmConnsArg(log *zap.SugaredLogger, pURL *url.URL, uri string) int {
+	prewarmArg := pURL.Query().Get("_prewarm")
+	if prewarmArg == "" {
+		return NodePrewarmConns
+	}
+	prewarmConns, err := strconv.Atoi(prewarmArg)
+	if err != nil || prewarmConns < 0 {
+		log.Errorw("Error parsing prewarm query param", "err", err, "uri", uri)
+		return NodePrewarmConns
+	}
+	log.Infow("Using pre-warmed connections", "prewarmConns", prewarmConns, "uri", uri)
+	return prewarmConns
+}
+
+// prewarm establishes the pre-warmed connections with concurrent health check probes, which stay in the idle pool of
+// the transport for the next proxy requests. Idle connections are reused by the probes, which keeps them alive.
+func (n *Node) prewarm() (numFailed int) {
+	numConns := n.prewarmConns
+	if numConns > ProxyMaxIdleConnsPerHost {
+		numConns = ProxyMaxIdleConnsPerHost // more would be closed right away
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for i := 0; i < numConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.HealthCheck(); err != nil {
+				lock.Lock()
+				numFailed++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	n.log.Debugw("pre-warmed node connections", "uri", n.URI, "numConns", numConns, "numFailed", numFailed)
+	return numFailed
+}
+
+// keepWarm pre-warms the connections when the workers are started and whenever the node becomes healthy, and keeps
+// them alive while the node had no proxy requests for interval (if > 0), until ctx is done
+func (n *Node) keepWarm(ctx context.Context, interval time.Duration) {
+	wasHealthy := n.IsHealthy()
+	if wasHealthy {
+		n.prewarm()
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			healthy := n.IsHealthy()
+			idle := time.Since(time.Unix(0, n.lastProxyAt.Load())) >= interval
+			if healthy && (!wasHealthy || idle) {
+				n.prewarm()
+			}
+			wasHealthy = healthy
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func newPrewarmTestNode(t *testing.T, uri string, jobC chan *SimRequest) *Node {
+	t.Helper()
+	node, err := NewNode(testLog, uri, jobC, 2)
+	require.Nil(t, err, err)
+	node.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	_, err = node.checkHealth()
+	require.Nil(t, err, err)
+	node.StartWorkers()
+	t.Cleanup(node.StopWorkersAndWait)
+	return node
+}
+
+func TestNodePrewarm(t *testing.T) {
+	_NodePrewarmInterval := NodePrewarmInterval
+	defer func() { NodePrewarmInterval = _NodePrewarmInterval }()
+	NodePrewarmInterval = 100 * time.Millisecond
+
+	fakeNode := testutils.NewTLSFakeNode(testutils.FakeNodeOpts{Latency: 20 * time.Millisecond})
+	defer fakeNode.Close()
+	jobC := make(chan *SimRequest)
+	node := newPrewarmTestNode(t, fakeNode.URL+"?_prewarm=3", jobC)
+	require.Equal(t, 3, node.prewarmConns)
+
+	// The initial health check and the 3 probes
+	require.Eventually(t, func() bool { return fakeNode.NumRequests() == 4 }, time.Second, 5*time.Millisecond)
+	time.Sleep(40 * time.Millisecond) // until the probes are done
+	numConns := fakeNode.NumConns()
+	require.GreaterOrEqual(t, numConns, 3)
+
+	// The first real requests reuse the connections, without a handshake
+	send := func() SimResponse {
+		request := NewSimRequest(context.Background(), "1", []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`), true, false)
+		jobC <- request
+		return <-request.ResponseC
+	}
+	require.Nil(t, send().Error)
+	require.Equal(t, numConns, fakeNode.NumConns())
+	res := make(chan SimResponse, 2)
+	for i := 0; i < 2; i++ {
+		go func() { res <- send() }()
+	}
+	require.Nil(t, (<-res).Error)
+	require.Nil(t, (<-res).Error)
+	require.Equal(t, numConns, fakeNode.NumConns())
+
+	// While idle, the connections are kept alive with probes
+	numRequests := fakeNode.NumRequests()
+	require.Eventually(t, func() bool { return fakeNode.NumRequests() >= numRequests+3 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, numConns, fakeNode.NumConns())
+}
+
+func TestNodePrewarmDisabled(t *testing.T) {
+	fakeNode := testutils.NewTLSFakeNode(testutils.FakeNodeOpts{})
+	defer fakeNode.Close()
+	node := newPrewarmTestNode(t, fakeNode.URL, make(chan *SimRequest))
+	require.Equal(t, 0, node.prewarmConns)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, fakeNode.NumRequests())
+	require.Equal(t, 1, fakeNode.NumConns())
+}
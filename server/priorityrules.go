@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrPriorityRuleInvalidPriority = errors.New("priority must be one of fast-track, high-prio, low-prio")
+	ErrPriorityRuleInvalidMatch    = errors.New("priority rule must have either a method or a pattern")
+)
+
+// PriorityRule assigns Priority to requests with the JSON-RPC Method, or whose payload matches the Pattern regex
+type PriorityRule struct {
+	Method   string `json:"method,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+	Priority string `json:"priority"` // fast-track, high-prio or low-prio
+
+	pattern *regexp.Regexp
+}
+
+func (r PriorityRule) matches(method string, payload []byte) bool {
+	if r.pattern != nil {
+		return r.pattern.Match(payload)
+	}
+	return r.Method == method
+}
+
+// ParsePriorityRules parses a JSON list of priority rules (an empty string returns no rules)
+func ParsePriorityRules(s string) (rules []PriorityRule, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, err
+	}
+	return rules, compilePriorityRules(rules)
+}
+
+// compilePriorityRules validates the rules, and compiles their patterns
+func compilePriorityRules(rules []PriorityRule) error {
+	for i, rule := range rules {
+		if rule.Priority != PriorityFastTrack && rule.Priority != PriorityHighPrio && rule.Priority != PriorityLowPrio {
+			return errors.Wrapf(ErrPriorityRuleInvalidPriority, "rule %d", i)
+		} else if (rule.Method == "") == (rule.Pattern == "") {
+			return errors.Wrapf(ErrPriorityRuleInvalidMatch, "rule %d", i)
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return errors.Wrapf(err, "rule %d", i)
+			}
+			rules[i].pattern = pattern
+		}
+	}
+	return nil
+}
+
+// PriorityClassifier assigns the priority of requests which don't set one, with an ordered list of rules. The first
+// matching rule wins, and requests which match no rule are low-prio.
+type PriorityClassifier struct {
+	lock           sync.RWMutex
+	rules          []PriorityRule
+	hasMethodRules bool // whether the JSON-RPC method needs to be parsed
+}
+
+func NewPriorityClassifier(rules []PriorityRule) (*PriorityClassifier, error) {
+	c := &PriorityClassifier{}
+	return c, c.SetRules(rules)
+}
+
+// SetRules replaces the rules (i.e. at runtime). The previous rules are kept if the new ones are invalid.
+func (c *PriorityClassifier) SetRules(rules []PriorityRule) error {
+	rules = append([]PriorityRule{}, rules...)
+	if err := compilePriorityRules(rules); err != nil {
+		return err
+	}
+
+	hasMethodRules := false
+	for _, rule := range rules {
+		hasMethodRules = hasMethodRules || rule.Method != ""
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rules, c.hasMethodRules = rules, hasMethodRules
+	return nil
+}
+
+// Rules returns a copy of the rules
+func (c *PriorityClassifier) Rules() []PriorityRule {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]PriorityRule{}, c.rules...)
+}
+
+// HasRules returns whether there are any rules
+func (c *PriorityClassifier) HasRules() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.rules) > 0
+}
+
+// Classify returns the priority of the first rule matching the payload (PriorityLowPrio if none matches)
+func (c *PriorityClassifier) Classify(payload []byte) (priority string, matched bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.rules) == 0 {
+		return PriorityLowPrio, false
+	}
+
+	method := ""
+	if c.hasMethodRules {
+		var envelope struct {
+			Method string `json:"method"`
+		}
+		if err := json.Unmarshal(payload, &envelope); err == nil {
+			method = envelope.Method
+		}
+	}
+	for _, rule := range c.rules {
+		if rule.matches(method, payload) {
+			return rule.Priority, true
+		}
+	}
+	return PriorityLowPrio, false
+}
+
+// hasPriorityHeaders returns whether the client explicitly set the priority of the request (even if to false)
+func hasPriorityHeaders(req *http.Request) bool {
+	for _, header := range []string{"X-Priority", "X-Fast-Track", "X-High-Priority", "high_prio"} {
+		if _, found := req.Header[http.CanonicalHeaderKey(header)]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyPriority returns the priority flags of the payload by the priority rules, unless the client set the
+// priority explicitly (then isHighPrio and isFastTrack are returned unchanged)
+func (s *Webserver) classifyPriority(req *http.Request, payload []byte, isHighPrio, isFastTrack bool) (bool, bool) {
+	if hasPriorityHeaders(req) {
+		return isHighPrio, isFastTrack
+	}
+	priority, _ := s.priorityRules.Classify(payload)
+	return priority == PriorityHighPrio, priority == PriorityFastTrack
+}
+
+// HandlePriorityRulesRequest returns the priority rules (GET), or replaces them (PUT)
+func (s *Webserver) HandlePriorityRulesRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPut {
+		var rules []PriorityRule
+		if err := json.NewDecoder(req.Body).Decode(&rules); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if err := s.priorityRules.SetRules(rules); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		s.log.Infow("Priority rules updated", "numRules", len(rules))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.priorityRules.Rules()); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testPriorityRules = []PriorityRule{
+	{Method: "eth_callBundle", Priority: PriorityFastTrack},
+	{Method: "eth_call", Priority: PriorityHighPrio},
+	{Pattern: `"urgent":\s*true`, Priority: PriorityFastTrack},
+	{Pattern: `eth_`, Priority: PriorityLowPrio},
+	{Pattern: `eth_sendBundle`, Priority: PriorityHighPrio}, // never matches, eth_ comes first
+}
+
+func TestParsePriorityRules(t *testing.T) {
+	rules, err := ParsePriorityRules("")
+	require.Nil(t, err, err)
+	require.Nil(t, rules)
+
+	rules, err = ParsePriorityRules(`[{"method":"eth_callBundle","priority":"fast-track"},{"pattern":"eth_.*","priority":"high-prio"}]`)
+	require.Nil(t, err, err)
+	require.Equal(t, 2, len(rules))
+	require.Equal(t, "eth_callBundle", rules[0].Method)
+	require.NotNil(t, rules[1].pattern)
+
+	for _, s := range []string{
+		`{}`,
+		`[{"method":"eth_call","priority":"urgent"}]`,
+		`[{"priority":"high-prio"}]`,
+		`[{"method":"eth_call","pattern":"eth_call","priority":"high-prio"}]`,
+		`[{"pattern":"(","priority":"high-prio"}]`,
+	} {
+		_, err := ParsePriorityRules(s)
+		require.NotNil(t, err, s)
+	}
+}
+
+func TestPriorityClassifier(t *testing.T) {
+	classifier, err := NewPriorityClassifier(testPriorityRules)
+	require.Nil(t, err, err)
+
+	tests := []struct {
+		name     string
+		payload  string
+		priority string
+		matched  bool
+	}{
+		{"method rule", `{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`, PriorityFastTrack, true},
+		{"exact method", `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`, PriorityHighPrio, true},
+		{"first matching rule", `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"urgent":true}]}`, PriorityHighPrio, true},
+		{"pattern", `{"jsonrpc":"2.0","id":1,"method":"custom","params":[{"urgent": true}]}`, PriorityFastTrack, true},
+		{"earlier pattern wins", `{"jsonrpc":"2.0","id":1,"method":"eth_sendBundle","params":[]}`, PriorityLowPrio, true},
+		{"no match", `{"jsonrpc":"2.0","id":1,"method":"net_version","params":[]}`, PriorityLowPrio, false},
+		{"not JSON", `eth_callBundle`, PriorityLowPrio, true}, // only the pattern rules apply
+		{"empty", ``, PriorityLowPrio, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			priority, matched := classifier.Classify([]byte(test.payload))
+			require.Equal(t, test.priority, priority)
+			require.Equal(t, test.matched, matched)
+		})
+	}
+
+	// Invalid rules keep the previous ones
+	require.NotNil(t, classifier.SetRules([]PriorityRule{{Method: "eth_call", Priority: "invalid"}}))
+	require.Equal(t, len(testPriorityRules), len(classifier.Rules()))
+
+	// No rules
+	require.Nil(t, classifier.SetRules(nil))
+	require.False(t, classifier.HasRules())
+	priority, matched := classifier.Classify([]byte(`{"method":"eth_callBundle"}`))
+	require.Equal(t, PriorityLowPrio, priority)
+	require.False(t, matched)
+}
+
+func TestWebserverPriorityRules(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	require.Nil(t, webserver.SetPriorityRules(testPriorityRules))
+	priorities := make(chan string, 10)
+	webserver.prioQueue.OnPop(func(r *SimRequest, wait time.Duration) {
+		priorities <- r.Priority()
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		priority string
+	}{
+		{"classified fast-track", "eth_callBundle", nil, PriorityFastTrack},
+		{"classified high-prio", "eth_call", nil, PriorityHighPrio},
+		{"no match", "net_version", nil, PriorityLowPrio},
+		{"explicit fast-track", "eth_call", map[string]string{"X-Fast-Track": "true"}, PriorityFastTrack},
+		{"explicit high-prio", "eth_callBundle", map[string]string{"X-High-Priority": "true"}, PriorityHighPrio},
+		{"explicit legacy high-prio", "net_version", map[string]string{"high_prio": "true"}, PriorityHighPrio},
+		{"explicit low-prio", "eth_callBundle", map[string]string{"X-High-Priority": "false"}, PriorityLowPrio},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := newSimTestRequest(`{"jsonrpc":"2.0","id":1,"method":"` + test.method + `","params":[]}`)
+			for key, value := range test.headers {
+				req.Header.Set(key, value)
+			}
+			rr := httptest.NewRecorder()
+			webserver.HandleQueueRequest(rr, req)
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.Equal(t, test.priority, <-priorities)
+		})
+	}
+}
+
+func TestWebserverPriorityRulesBatch(t *testing.T) {
+	defer func(split bool) { SplitJSONRPCBatches = split }(SplitJSONRPCBatches)
+	SplitJSONRPCBatches = true
+
+	webserver, _ := newTestWebserver(t, 1)
+	require.Nil(t, webserver.SetPriorityRules(testPriorityRules))
+	priorities := make(chan string, 10)
+	webserver.prioQueue.OnPop(func(r *SimRequest, wait time.Duration) {
+		priorities <- r.Priority()
+	})
+
+	// Each element is classified
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, newSimTestRequest(`[{"jsonrpc":"2.0","id":1,"method":"eth_callBundle"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	received := []string{<-priorities, <-priorities}
+	require.ElementsMatch(t, []string{PriorityFastTrack, PriorityLowPrio}, received)
+}
+
+func TestWebserverPriorityRulesAdmin(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	handler := webserver.Handler()
+
+	request := func(method, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, "/admin/priority-rules", bytes.NewBufferString(body)))
+		return rr
+	}
+
+	rr := request(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `[]`, rr.Body.String())
+
+	// Replaced at runtime
+	rr = request(http.MethodPut, `[{"method":"eth_call","priority":"high-prio"},{"pattern":"bundle","priority":"fast-track"}]`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `[{"method":"eth_call","priority":"high-prio"},{"pattern":"bundle","priority":"fast-track"}]`, rr.Body.String())
+	priority, _ := webserver.priorityRules.Classify([]byte(`{"method":"eth_call"}`))
+	require.Equal(t, PriorityHighPrio, priority)
+
+	// Invalid rules are rejected, and the previous ones kept
+	for _, body := range []string{`{`, `[{"method":"eth_call","priority":"urgent"}]`, `[{"pattern":"(","priority":"high-prio"}]`} {
+		rr = request(http.MethodPut, body)
+		require.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+	rules := []PriorityRule{}
+	rr = request(http.MethodGet, "")
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &rules))
+	require.Equal(t, 2, len(rules))
+}
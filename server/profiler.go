@@ -0,0 +1,171 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// RequestTiming is the timing breakdown of a single completed request
+type RequestTiming struct {
+	ReqID           string    `json:"reqID"`
+	NodeURI         string    `json:"nodeURI"`
+	IsHighPrio      bool      `json:"isHighPrio"`
+	IsFastTrack     bool      `json:"isFastTrack"`
+	SizeClass       string    `json:"sizeClass"`
+	Error           string    `json:"error,omitempty"`
+	QueueDurationUs int64     `json:"queueDurationUs"`
+	ProxyDurationUs int64     `json:"proxyDurationUs"`
+	TotalDurationUs int64     `json:"totalDurationUs"`
+	CompletedAt     time.Time `json:"completedAt"`
+}
+
+// LatencyPercentiles are the percentiles of a duration (in microseconds)
+type LatencyPercentiles struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
+
+type LatencyReport struct {
+	Recording   bool               `json:"recording"`
+	StartedAt   time.Time          `json:"startedAt"`
+	NumRequests int                `json:"numRequests"`
+	QueueUs     LatencyPercentiles `json:"queueUs"`
+	ProxyUs     LatencyPercentiles `json:"proxyUs"`
+	TotalUs     LatencyPercentiles `json:"totalUs"`
+	Slowest     []RequestTiming    `json:"slowest"`
+}
+
+// LatencyProfiler records request timings into a bounded ring buffer during a profiling window
+// (limited by duration and/or number of requests). When no window is active, Record is a single atomic load.
+type LatencyProfiler struct {
+	active atomic.Bool
+
+	lock        sync.Mutex
+	timings     []RequestTiming // ring buffer
+	next        int             // next write position in the ring buffer
+	numRecorded int             // number of requests recorded in the current window
+	maxRequests int             // stop recording after this many requests (0: no limit)
+	startedAt   time.Time
+	until       time.Time // stop recording after this time (zero: no limit)
+}
+
+func NewLatencyProfiler() *LatencyProfiler {
+	return &LatencyProfiler{}
+}
+
+// Start begins a new profiling window. Recording stops after duration (if > 0) or after maxRequests
+// (if > 0), whatever comes first. At most bufferSize timings are kept (the most recent ones).
+func (p *LatencyProfiler) Start(duration time.Duration, maxRequests, bufferSize int) {
+	if maxRequests > 0 && maxRequests < bufferSize {
+		bufferSize = maxRequests
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.timings = make([]RequestTiming, 0, bufferSize)
+	p.next = 0
+	p.numRecorded = 0
+	p.maxRequests = maxRequests
+	p.startedAt = time.Now().UTC()
+	p.until = time.Time{}
+	if duration > 0 {
+		p.until = p.startedAt.Add(duration)
+	}
+	p.active.Store(true)
+}
+
+// Stop ends the current profiling window
+func (p *LatencyProfiler) Stop() {
+	p.active.Store(false)
+}
+
+func (p *LatencyProfiler) IsRecording() bool {
+	return p.active.Load()
+}
+
+// Record adds a request timing to the current profiling window, if one is active
+func (p *LatencyProfiler) Record(timing RequestTiming) {
+	if !p.active.Load() {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.until.IsZero() && timing.CompletedAt.After(p.until) {
+		p.active.Store(false)
+		return
+	}
+
+	if len(p.timings) < cap(p.timings) {
+		p.timings = append(p.timings, timing)
+	} else {
+		p.timings[p.next] = timing
+	}
+	p.next = (p.next + 1) % cap(p.timings)
+	p.numRecorded++
+
+	if p.maxRequests > 0 && p.numRecorded >= p.maxRequests {
+		p.active.Store(false)
+	}
+}
+
+// Report returns the percentiles and the numSlowest slowest requests (by total duration) of the last profiling window
+func (p *LatencyProfiler) Report(numSlowest int) LatencyReport {
+	p.lock.Lock()
+	if p.active.Load() && !p.until.IsZero() && time.Now().After(p.until) {
+		p.active.Store(false)
+	}
+	timings := make([]RequestTiming, len(p.timings))
+	copy(timings, p.timings)
+	report := LatencyReport{
+		Recording:   p.active.Load(),
+		StartedAt:   p.startedAt,
+		NumRequests: p.numRecorded,
+	}
+	p.lock.Unlock()
+
+	queue := make([]int64, len(timings))
+	proxy := make([]int64, len(timings))
+	total := make([]int64, len(timings))
+	for i, timing := range timings {
+		queue[i], proxy[i], total[i] = timing.QueueDurationUs, timing.ProxyDurationUs, timing.TotalDurationUs
+	}
+	report.QueueUs = Percentiles(queue)
+	report.ProxyUs = Percentiles(proxy)
+	report.TotalUs = Percentiles(total)
+
+	sort.Slice(timings, func(i, j int) bool { return timings[i].TotalDurationUs > timings[j].TotalDurationUs })
+	if numSlowest < len(timings) {
+		timings = timings[:numSlowest]
+	}
+	report.Slowest = timings
+	return report
+}
+
+// Percentiles calculates the percentiles using the nearest-rank method (sorts values in place)
+func Percentiles(values []int64) LatencyPercentiles {
+	if len(values) == 0 {
+		return LatencyPercentiles{}
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	rank := func(p int) int64 {
+		idx := (p*len(values)+99)/100 - 1 // ceil(p/100 * n) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		return values[idx]
+	}
+
+	return LatencyPercentiles{
+		P50: rank(50),
+		P90: rank(90),
+		P99: rank(99),
+		Max: values[len(values)-1],
+	}
+}
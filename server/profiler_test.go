@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentiles(t *testing.T) {
+	require.Equal(t, LatencyPercentiles{}, Percentiles(nil))
+	require.Equal(t, LatencyPercentiles{P50: 7, P90: 7, P99: 7, Max: 7}, Percentiles([]int64{7}))
+
+	values := []int64{}
+	for i := 100; i > 0; i-- {
+		values = append(values, int64(i))
+	}
+	require.Equal(t, LatencyPercentiles{P50: 50, P90: 90, P99: 99, Max: 100}, Percentiles(values))
+
+	values = []int64{}
+	for i := 1; i <= 10; i++ {
+		values = append(values, int64(i*10))
+	}
+	require.Equal(t, LatencyPercentiles{P50: 50, P90: 90, P99: 100, Max: 100}, Percentiles(values))
+}
+
+func TestLatencyProfiler(t *testing.T) {
+	p := NewLatencyProfiler()
+
+	// Not recording when idle
+	p.Record(RequestTiming{TotalDurationUs: 1, CompletedAt: time.Now()})
+	require.Equal(t, 0, p.Report(10).NumRequests)
+
+	// Stops after maxRequests
+	p.Start(0, 3, 100)
+	for i := 1; i <= 5; i++ {
+		p.Record(RequestTiming{ReqID: fmt.Sprint(i), TotalDurationUs: int64(i), CompletedAt: time.Now()})
+	}
+	report := p.Report(2)
+	require.False(t, report.Recording)
+	require.Equal(t, 3, report.NumRequests)
+	require.Equal(t, int64(3), report.TotalUs.Max)
+	require.Equal(t, 2, len(report.Slowest))
+	require.Equal(t, "3", report.Slowest[0].ReqID)
+	require.Equal(t, "2", report.Slowest[1].ReqID)
+
+	// Ring buffer keeps only the most recent timings
+	p.Start(time.Minute, 0, 2)
+	for i := 1; i <= 5; i++ {
+		p.Record(RequestTiming{ReqID: fmt.Sprint(i), TotalDurationUs: int64(i), CompletedAt: time.Now()})
+	}
+	report = p.Report(10)
+	require.True(t, report.Recording)
+	require.Equal(t, 5, report.NumRequests)
+	require.Equal(t, 2, len(report.Slowest))
+	require.Equal(t, LatencyPercentiles{P50: 4, P90: 5, P99: 5, Max: 5}, report.TotalUs)
+
+	// Stops after the duration
+	p.Start(50*time.Millisecond, 0, 100)
+	require.True(t, p.IsRecording())
+	time.Sleep(60 * time.Millisecond)
+	p.Record(RequestTiming{TotalDurationUs: 1, CompletedAt: time.Now()})
+	require.False(t, p.IsRecording())
+	require.Equal(t, 0, p.Report(10).NumRequests)
+}
+
+func TestWebserverLatencyProfile(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+
+	// The node sleeps for the number of milliseconds given as first param
+	mockNodeBackend.RPCHandlerOverride = func(req *testutils.JSONRPCRequest) (result interface{}, err error) {
+		time.Sleep(time.Duration(req.Params[0].(float64)) * time.Millisecond)
+		return "cool", nil
+	}
+
+	// Start recording
+	rr := httptest.NewRecorder()
+	webserver.HandleProfileRequest(rr, httptest.NewRequest("POST", "/admin/profile?requests=10", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// 12 requests with 10ms, 20ms, ..., 120ms delay (the last 2 are not recorded)
+	for i := 1; i <= 12; i++ {
+		reqPayloadBytes, err := json.Marshal(testutils.NewJSONRPCRequest1(i, "eth_callBundle", i*10))
+		require.Nil(t, err, err)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+		req.Header.Set("X-Request-ID", fmt.Sprint(i))
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	webserver.HandleProfileRequest(rr, httptest.NewRequest("GET", "/admin/profile?slowest=3", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	report := LatencyReport{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &report))
+
+	requireBetween := func(expectedMs, actualUs int64) {
+		require.GreaterOrEqual(t, actualUs, expectedMs*1000)
+		require.Less(t, actualUs, (expectedMs+30)*1000)
+	}
+	require.False(t, report.Recording)
+	require.Equal(t, 10, report.NumRequests)
+	requireBetween(50, report.ProxyUs.P50)
+	requireBetween(90, report.ProxyUs.P90)
+	requireBetween(100, report.ProxyUs.P99)
+	requireBetween(100, report.TotalUs.Max)
+	require.Equal(t, 3, len(report.Slowest))
+	require.Equal(t, "10", report.Slowest[0].ReqID)
+	require.Equal(t, "9", report.Slowest[1].ReqID)
+	require.Equal(t, webserver.nodePool.NodeUris()[0], report.Slowest[0].NodeURI)
+
+	// Invalid arguments
+	rr = httptest.NewRecorder()
+	webserver.HandleProfileRequest(rr, httptest.NewRequest("POST", "/admin/profile", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = httptest.NewRecorder()
+	webserver.HandleProfileRequest(rr, httptest.NewRequest("POST", "/admin/profile?seconds=x", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusNamespace prefixes the names of the Prometheus metrics
+const PrometheusNamespace = "prio_load_balancer"
+
+// PrometheusMetrics are the metrics of the /metrics endpoint, in their own registry. The counters are incremented by
+// the queue and the node workers (see PrioQueue.SetPrometheusMetrics and NodePool.SetPrometheusMetrics), the gauges
+// are read on every scrape. All methods are no-ops on a nil *PrometheusMetrics, so that library users which don't
+// enable it don't register anything.
+type PrometheusMetrics struct {
+	registry      *prometheus.Registry
+	handler       http.Handler
+	queuePushes   *prometheus.CounterVec   // by priority
+	queuePops     *prometheus.CounterVec   // by priority
+	queueTimeouts *prometheus.CounterVec   // requests whose deadline passed in the queue, by priority
+	proxyErrors   *prometheus.CounterVec   // by node and error kind
+	simDuration   *prometheus.HistogramVec // of the proxy calls, by node and priority
+}
+
+// NewPrometheusMetrics registers the counters and the sim duration histogram (with the upper bounds of simBuckets,
+// the client defaults if empty)
+func NewPrometheusMetrics(simBuckets []time.Duration) *PrometheusMetrics {
+	buckets := prometheus.DefBuckets
+	if len(simBuckets) > 0 {
+		buckets = make([]float64, len(simBuckets))
+		for i, bound := range simBuckets {
+			buckets[i] = bound.Seconds()
+		}
+	}
+
+	m := &PrometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		queuePushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PrometheusNamespace, Name: "queue_pushes_total", Help: "Requests added to the queue, by priority.",
+		}, []string{MetricTagPriority}),
+		queuePops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PrometheusNamespace, Name: "queue_pops_total", Help: "Requests taken from the queue, by priority.",
+		}, []string{MetricTagPriority}),
+		queueTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PrometheusNamespace, Name: "queue_timeouts_total", Help: "Requests whose deadline passed before a node worker took them, by priority.",
+		}, []string{MetricTagPriority}),
+		proxyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PrometheusNamespace, Name: "node_proxy_errors_total", Help: "Failed proxy calls, by node and error kind.",
+		}, []string{MetricTagNode, MetricTagErrorKind}),
+		simDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace, Name: "node_sim_duration_seconds", Help: "Duration of the proxy calls, by node and priority.", Buckets: buckets,
+		}, []string{MetricTagNode, MetricTagPriority}),
+	}
+	m.registry.MustRegister(m.queuePushes, m.queuePops, m.queueTimeouts, m.proxyErrors, m.simDuration)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *PrometheusMetrics) Handler() http.Handler {
+	return m.handler
+}
+
+// registerQueue adds the gauges of the current queue depth by priority
+func (m *PrometheusMetrics) registerQueue(queue Queue) {
+	if m == nil {
+		return
+	}
+	depth := func(priority string) prometheus.GaugeFunc {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace, Name: "queue_depth", Help: "Queued requests, by priority.",
+			ConstLabels: prometheus.Labels{MetricTagPriority: priority},
+		}, func() float64 {
+			lenFastTrack, lenHighPrio, lenLowPrio := queue.Len()
+			switch priority {
+			case PriorityFastTrack:
+				return float64(lenFastTrack)
+			case PriorityHighPrio:
+				return float64(lenHighPrio)
+			}
+			return float64(lenLowPrio)
+		})
+	}
+	m.registry.MustRegister(depth(PriorityFastTrack), depth(PriorityHighPrio), depth(PriorityLowPrio))
+}
+
+// registerNodePool adds the gauges of the running workers by node
+func (m *PrometheusMetrics) registerNodePool(nodePool *NodePool) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(&nodeWorkersCollector{
+		nodePool: nodePool,
+		desc:     prometheus.NewDesc(PrometheusNamespace+"_node_workers", "Running proxy workers, by node.", []string{MetricTagNode}, nil),
+	})
+}
+
+func (m *PrometheusMetrics) queuePushed(r *SimRequest) {
+	if m != nil {
+		m.queuePushes.WithLabelValues(r.Priority()).Inc()
+	}
+}
+
+func (m *PrometheusMetrics) queuePopped(r *SimRequest) {
+	if m != nil {
+		m.queuePops.WithLabelValues(r.Priority()).Inc()
+	}
+}
+
+func (m *PrometheusMetrics) queueTimedOut(r *SimRequest) {
+	if m != nil {
+		m.queueTimeouts.WithLabelValues(r.Priority()).Inc()
+	}
+}
+
+// proxied observes the duration of a proxy call to the node, and counts it if it failed (with an error kind)
+func (m *PrometheusMetrics) proxied(uri string, r *SimRequest, duration time.Duration, errorKind string) {
+	if m == nil {
+		return
+	}
+	node := nodeMetricName(uri)
+	m.simDuration.WithLabelValues(node, r.Priority()).Observe(duration.Seconds())
+	if errorKind != "" {
+		m.proxyErrors.WithLabelValues(node, errorKind).Inc()
+	}
+}
+
+// nodeWorkersCollector reports the running workers of the current nodes of the pool
+type nodeWorkersCollector struct {
+	nodePool *NodePool
+	desc     *prometheus.Desc
+}
+
+func (c *nodeWorkersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *nodeWorkersCollector) Collect(ch chan<- prometheus.Metric) {
+	c.nodePool.nodesLock.Lock()
+	workers := make(map[string]int32) // URIs which only differ by their query params are one node label
+	for _, node := range c.nodePool.nodes {
+		workers[nodeMetricName(node.URI)] += atomic.LoadInt32(&node.curWorkers)
+	}
+	c.nodePool.nodesLock.Unlock()
+	for node, numWorkers := range workers {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(numWorkers), node)
+	}
+}
+
+// EnablePrometheus serves the metrics on /metrics, with the depth of the queue. The queue counts its pushes and pops,
+// the webserver the requests whose deadline passed in the queue. The node metrics are counted by the node pool
+// (NodePool.SetPrometheusMetrics).
+func (s *Webserver) EnablePrometheus(metrics *PrometheusMetrics) {
+	s.prometheus = metrics
+	metrics.registerQueue(s.prioQueue)
+	if q, ok := s.prioQueue.(interface{ SetPrometheusMetrics(*PrometheusMetrics) }); ok {
+		q.SetPrometheusMetrics(metrics)
+	}
+}
+
+// HandlePrometheusRequest serves the Prometheus metrics
+func (s *Webserver) HandlePrometheusRequest(w http.ResponseWriter, req *http.Request) {
+	if s.prometheus == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "the Prometheus metrics are not enabled")
+		return
+	}
+	s.prometheus.Handler().ServeHTTP(w, req)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestWebserverPrometheus(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+	numFailed := atomic.NewInt32(0)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("X-Request-ID") {
+		case "fail":
+			if numFailed.Inc() == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}
+
+	metrics := NewPrometheusMetrics(nil)
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	nodePool := NewNodePool(testLog, nil, 1)
+	nodePool.SetPrometheusMetrics(metrics)
+	require.Nil(t, nodePool.AddNode(mockNodeServer.URL+"?_healthcheck_success=status"))
+	defer nodePool.Shutdown()
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+	go func() {
+		for job := prioQueue.Pop(); job != nil; job = prioQueue.Pop() {
+			nodePool.JobC <- job
+		}
+	}()
+
+	handler := webserver.Handler()
+	scrape := func() (int, string) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rr.Code, rr.Body.String()
+	}
+	sim := func(reqID, deadline string, isHighPrio bool) *httptest.ResponseRecorder {
+		req := newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+		req.Header.Set("X-Request-ID", reqID)
+		if deadline != "" {
+			req.Header.Set("X-Request-Deadline-Ms", deadline)
+		}
+		if isHighPrio {
+			req.Header.Set("X-High-Priority", "true")
+		}
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		return rr
+	}
+
+	status, _ := scrape()
+	require.Equal(t, http.StatusNotFound, status)
+	webserver.EnablePrometheus(metrics)
+
+	// A successful request, one which is retried after a node error, and one whose deadline passes in the queue
+	require.Equal(t, http.StatusOK, sim("ok", "", false).Code)
+	require.Equal(t, http.StatusOK, sim("fail", "", false).Code)
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- sim("slow", "", false) }()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, ErrorKindRequestTimeout, sim("expired", "50", true).Header().Get("X-Error-Kind"))
+	require.Equal(t, http.StatusOK, (<-slow).Code)
+
+	status, body := scrape()
+	require.Equal(t, http.StatusOK, status)
+	node := fmt.Sprintf(`node="%s"`, mockNodeServer.URL)
+	for _, line := range []string{
+		`prio_load_balancer_queue_pushes_total{priority="low-prio"} 4`,
+		`prio_load_balancer_queue_pushes_total{priority="high-prio"} 1`,
+		`prio_load_balancer_queue_pops_total{priority="low-prio"} 4`,
+		`prio_load_balancer_queue_timeouts_total{priority="high-prio"} 1`,
+		`prio_load_balancer_queue_depth{priority="fast-track"} 0`,
+		`prio_load_balancer_node_proxy_errors_total{error_kind="node_error",` + node + `} 1`,
+		`prio_load_balancer_node_sim_duration_seconds_count{` + node + `,priority="low-prio"} 4`,
+		`prio_load_balancer_node_workers{` + node + `} 1`,
+	} {
+		require.Contains(t, body, line)
+	}
+}
@@ -1,150 +1,484 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"go.uber.org/atomic"
 )
 
+// Queue is the request queue between the webserver and the node workers (PrioQueue, or TenantQueue for multi-tenancy)
+type Queue interface {
+	Push(r *SimRequest) bool
+	CanPush(r *SimRequest) bool
+	Pop() *SimRequest
+	PopCtx(ctx context.Context) *SimRequest
+	Len() (lenFastTrack, lenHighPrio, lenLowPrio int)
+	NumRequests() int
+	NumBytes() int64
+	OldestQueuedAt() (fastTrack, highPrio, lowPrio time.Time)
+	OnThresholdCrossed(threshold int, cb func(above bool, numRequests int))
+	OnPop(cb func(r *SimRequest, wait time.Duration))
+	DropLowPrio() []*SimRequest
+	Remove(r *SimRequest) bool
+	Snapshot() []*SimRequest
+	Close()
+	CloseAndWait()
+	IsClosed() bool
+}
+
 // PrioQueue has 3 queues: fastTrack, highPrio and lowPrio
 // - items will be popped 1:1 from fastTrack and highPrio, until both are empty
+// - then items from the levels between high-prio and low-prio are used, if any (see SetPriorityLevels)
 // - then items from lowPrio queue are used
 //
 // maybe we should configure that every n-th item is used from low-prio?
 type PrioQueue struct {
 	fastTrack []*SimRequest
 	highPrio  []*SimRequest
+	midPrio   [][]*SimRequest // the levels 2 to numLevels-2 of high-prio requests, see SetPriorityLevels
 	lowPrio   []*SimRequest
 
-	cond       *sync.Cond
-	closed     atomic.Bool
-	nFastTrack atomic.Int32
+	cond     *sync.Cond
+	closed   atomic.Bool
+	numBytes atomic.Int64 // total payload bytes of all queued items (in-memory and spooled)
 
 	maxFastTrack int // max items for fast-track queue. 0 means no limit.
 	maxHighPrio  int // max items for high prio queue. 0 means no limit.
 	maxLowPrio   int // max items for low prio queue. 0 means no limit.
 
-	numFastTrackForHighPrio int
-	fastTrackDrainFirst     bool
+	interleave          interleaving // of the fast-track and high-prio queues, see SetInterleaveWeights
+	fastTrackDrainFirst bool
+	order               SmallestFirstOrder
+	aging               PriorityAging
+
+	lowPrioPaused bool // low-prio requests stay queued (until the queue is closed)
+	lowPrioEveryN int  // a low-prio request is popped after every n other ones (0: only when the others are empty)
+	nSinceLowPrio int  // requests popped since the last low-prio one
+
+	reservedSlots     map[string]int // fast-track slots reserved by client ID (see SetFastTrackReservations)
+	numReservedSlots  int
+	reservedQueued    map[string]int // queued fast-track requests in the reserved slots, by client ID
+	numReservedQueued int
+
+	coalescing atomic.Bool                     // identical requests share a node call, see SetCoalescing
+	coalesced  map[coalesceKey]*coalescedGroup // the groups of the queued or in-flight leaders
+
+	threshold          int                               // number of queued requests which triggers onThresholdCrossed (0: disabled)
+	onThresholdCrossed func(above bool, numRequests int) // called with the queue lock held, must not block
+	onPop              func(r *SimRequest, wait time.Duration)
+	prometheus         *PrometheusMetrics // (optional) counts the pushes and pops
 }
 
-func NewPrioQueue(maxFastTrack, maxHighPrio, maxLowPrio, numFastTrackForHighPrio int, fastTrackDrainFirst bool) *PrioQueue {
+func NewPrioQueue(maxFastTrack, maxHighPrio, maxLowPrio, numFastTrackForHighPrio int, fastTrackDrainFirst bool, aging PriorityAging) *PrioQueue {
 	return &PrioQueue{
 		cond:         sync.NewCond(&sync.Mutex{}),
 		maxFastTrack: maxFastTrack,
 		maxHighPrio:  maxHighPrio,
 		maxLowPrio:   maxLowPrio,
 
-		numFastTrackForHighPrio: numFastTrackForHighPrio,
-		fastTrackDrainFirst:     fastTrackDrainFirst,
+		interleave:          newInterleaving(numFastTrackForHighPrio, 1),
+		fastTrackDrainFirst: fastTrackDrainFirst,
+		aging:               aging,
 	}
 }
 
+// Len returns the number of queued requests by priority (high-prio including the levels below it, see
+// SetPriorityLevels)
 func (q *PrioQueue) Len() (lenFastTrack, lenHighPrio, lenLowPrio int) {
-	return len(q.fastTrack), len(q.highPrio), len(q.lowPrio)
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.fastTrack), q.lenHighPrio(), len(q.lowPrio)
 }
 
+// NumRequests returns the number of queued requests
 func (q *PrioQueue) NumRequests() int {
-	return len(q.fastTrack) + len(q.highPrio) + len(q.lowPrio)
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.numRequests()
+}
+
+// numRequests returns the number of queued requests. The lock must be held.
+func (q *PrioQueue) numRequests() int {
+	return len(q.fastTrack) + q.lenHighPrio() + len(q.lowPrio)
+}
+
+// lenHighPrio returns the number of queued high-prio requests, of all levels. The lock must be held.
+func (q *PrioQueue) lenHighPrio() int {
+	n := len(q.highPrio)
+	for _, lane := range q.midPrio {
+		n += len(lane)
+	}
+	return n
+}
+
+// NumBytes returns the total payload size of all queued requests, including payloads spooled to disk
+func (q *PrioQueue) NumBytes() int64 {
+	return q.numBytes.Load()
+}
+
+// OldestQueuedAt returns when the oldest request of every priority was queued (zero if there is none)
+func (q *PrioQueue) OldestQueuedAt() (fastTrack, highPrio, lowPrio time.Time) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if len(q.fastTrack) > 0 {
+		fastTrack = q.fastTrack[0].QueuedAt
+	}
+	if len(q.highPrio) > 0 {
+		highPrio = q.highPrio[0].QueuedAt
+	}
+	for _, lane := range q.midPrio {
+		if len(lane) > 0 && (highPrio.IsZero() || lane[0].QueuedAt.Before(highPrio)) {
+			highPrio = lane[0].QueuedAt
+		}
+	}
+	if len(q.lowPrio) > 0 {
+		lowPrio = q.lowPrio[0].QueuedAt
+	}
+	return fastTrack, highPrio, lowPrio
+}
+
+// IsClosed returns true after Close() was called
+func (q *PrioQueue) IsClosed() bool {
+	return q.closed.Load()
 }
 
 func (q *PrioQueue) String() string {
-	return fmt.Sprintf("PrioQueue: fastTrack: %d / highPrio: %d / lowPrio: %d", len(q.fastTrack), len(q.highPrio), len(q.lowPrio))
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return fmt.Sprintf("PrioQueue: fastTrack: %d / highPrio: %d / lowPrio: %d", len(q.fastTrack), q.lenHighPrio(), len(q.lowPrio))
 }
 
-// Push adds a new item to the end of the queue. Returns true if added, false if queue is closed or at max capacity
-func (q *PrioQueue) Push(r *SimRequest) bool {
-	if q.closed.Load() || r == nil {
-		return false
+// SetLimits updates the max number of items per queue (0 means no limit). Already queued items are not removed.
+func (q *PrioQueue) SetLimits(maxFastTrack, maxHighPrio, maxLowPrio int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.maxFastTrack, q.maxHighPrio, q.maxLowPrio = maxFastTrack, maxHighPrio, maxLowPrio
+}
+
+// FastTrackLimit returns the max items of the fast-track queue (0 means no limit)
+func (q *PrioQueue) FastTrackLimit() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.maxFastTrack
+}
+
+// SetFastTrackPerHighPrio changes how many fast-track requests are popped for each high-prio request, see
+// SetInterleaveWeights
+func (q *PrioQueue) SetFastTrackPerHighPrio(numFastTrackForHighPrio int) {
+	q.SetInterleaveWeights(numFastTrackForHighPrio, 1)
+}
+
+// SetInterleaveWeights changes the ratio of the fast-track to the high-prio requests which are popped while both are
+// queued, i.e. 3:2 (unless the fast-track queue is drained first). A weight of 0 pops the other queue first.
+func (q *PrioQueue) SetInterleaveWeights(fastTrackWeight, highPrioWeight int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.interleave = newInterleaving(fastTrackWeight, highPrioWeight)
+}
+
+// InterleaveWeights returns the weights of the fast-track and high-prio requests, see SetInterleaveWeights
+func (q *PrioQueue) InterleaveWeights() (fastTrackWeight, highPrioWeight int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.interleave.fastTrackWeight, q.interleave.highPrioWeight
+}
+
+// SetSmallestFirst changes the order within the priorities, see SmallestFirstOrder
+func (q *PrioQueue) SetSmallestFirst(order SmallestFirstOrder) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.order = order
+}
+
+// SetPriorityLevels changes the number of priority levels (at least 3, the default): level 0 is fast-track, 1
+// high-prio and the last one low-prio. The levels in between are high-prio requests with their PriorityLevel, which
+// are popped after the fast-track and high-prio ones, lower levels first. They count against the high-prio limit, and
+// are not promoted by the PriorityAging. Queued requests of removed levels move into the last level left.
+func (q *PrioQueue) SetPriorityLevels(numLevels int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	numMidPrio := 0
+	if numLevels > 3 {
+		numMidPrio = numLevels - 3
+	}
+	midPrio := make([][]*SimRequest, numMidPrio)
+	for i, lane := range q.midPrio {
+		if i < numMidPrio {
+			midPrio[i] = lane
+			continue
+		}
+		for _, r := range lane {
+			if numMidPrio > 0 {
+				midPrio[numMidPrio-1] = insertByCreatedAt(midPrio[numMidPrio-1], r)
+			} else {
+				q.highPrio = insertByCreatedAt(q.highPrio, r)
+			}
+		}
 	}
+	q.midPrio = midPrio
+}
 
-	// If queue limits are set and reached, return false now
-	if r.IsFastTrack && q.maxFastTrack > 0 && len(q.fastTrack) >= q.maxFastTrack {
-		return false
-	} else if r.IsHighPrio && q.maxHighPrio > 0 && len(q.highPrio) >= q.maxHighPrio {
-		return false
-	} else if !r.IsHighPrio && q.maxLowPrio > 0 && len(q.lowPrio) >= q.maxLowPrio {
+// lane returns the queue of the priority level of r (see SetPriorityLevels). The lock must be held.
+func (q *PrioQueue) lane(r *SimRequest) *[]*SimRequest {
+	switch {
+	case r.IsFastTrack:
+		return &q.fastTrack
+	case !r.IsHighPrio:
+		return &q.lowPrio
+	case r.PriorityLevel < 2 || len(q.midPrio) == 0:
+		return &q.highPrio
+	case r.PriorityLevel-2 >= len(q.midPrio):
+		return &q.midPrio[len(q.midPrio)-1]
+	}
+	return &q.midPrio[r.PriorityLevel-2]
+}
+
+// SetLowPrioScheduling pauses the low-prio queue (its requests stay queued until resumed, or the queue is closed), or
+// changes after how many other requests a low-prio one is popped (0: only when the others are empty)
+func (q *PrioQueue) SetLowPrioScheduling(paused bool, everyN int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.lowPrioPaused, q.lowPrioEveryN = paused, everyN
+	if !paused {
+		q.cond.Broadcast() // Pop may wait with only low-prio requests queued
+	}
+}
+
+// SetFastTrackReservations reserves fast-track slots for the requests with the client ID as Reservation: the other
+// fast-track requests are rejected once the unreserved part of the fast-track limit is full. Requests of a client
+// beyond its reserved slots use the unreserved part. Already queued requests are not removed.
+func (q *PrioQueue) SetFastTrackReservations(slots map[string]int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.reservedSlots, q.numReservedSlots = make(map[string]int, len(slots)), 0
+	for clientID, n := range slots {
+		q.reservedSlots[clientID] = n
+		q.numReservedSlots += n
+	}
+
+	// queued requests of removed (or reduced) reservations count as unreserved
+	for clientID, n := range q.reservedQueued {
+		if n > q.reservedSlots[clientID] {
+			q.numReservedQueued -= n - q.reservedSlots[clientID]
+			q.reservedQueued[clientID] = q.reservedSlots[clientID]
+		}
+		if q.reservedQueued[clientID] <= 0 {
+			delete(q.reservedQueued, clientID)
+		}
+	}
+}
+
+// FastTrackReservedFull returns whether the fast-track request r is rejected because the capacity left is reserved
+// for other clients
+func (q *PrioQueue) FastTrackReservedFull(r *SimRequest) bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.fastTrackReservedFull(r)
+}
+
+// takesReservedSlot returns whether r would be queued in a slot of its reservation. The lock must be held.
+func (q *PrioQueue) takesReservedSlot(r *SimRequest) bool {
+	return r.IsFastTrack && r.Reservation != "" && q.reservedQueued[r.Reservation] < q.reservedSlots[r.Reservation]
+}
+
+// fastTrackReservedFull returns whether the fast-track capacity left is reserved for other clients than the one of r.
+// The lock must be held.
+func (q *PrioQueue) fastTrackReservedFull(r *SimRequest) bool {
+	if !r.IsFastTrack || q.maxFastTrack <= 0 || q.numReservedSlots == 0 || len(q.fastTrack) >= q.maxFastTrack {
+		return false // the whole limit is reached (see isFull)
+	} else if q.takesReservedSlot(r) {
 		return false
 	}
+	return len(q.fastTrack)-q.numReservedQueued >= q.maxFastTrack-q.numReservedSlots
+}
+
+// lowPrioPoppable returns whether low-prio requests may be popped. The lock must be held.
+func (q *PrioQueue) lowPrioPoppable() bool {
+	return !q.lowPrioPaused || q.closed.Load()
+}
+
+// canPop returns whether a queued request may be popped. The lock must be held.
+func (q *PrioQueue) canPop() bool {
+	return len(q.fastTrack) > 0 || q.lenHighPrio() > 0 || (len(q.lowPrio) > 0 && q.lowPrioPoppable())
+}
+
+// OnThresholdCrossed sets a callback for when the total number of queued requests reaches threshold (above=true),
+// and when it drops below threshold again (above=false). The callback is called with the queue lock held, and must not block.
+func (q *PrioQueue) OnThresholdCrossed(threshold int, cb func(above bool, numRequests int)) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.threshold = threshold
+	q.onThresholdCrossed = cb
+}
+
+// OnPop sets a callback for every popped request, with the time it waited in the queue. The callback is called with
+// the queue lock held, and must not block.
+func (q *PrioQueue) OnPop(cb func(r *SimRequest, wait time.Duration)) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.onPop = cb
+}
+
+// SetPrometheusMetrics counts the pushed and popped requests in metrics (nil disables it)
+func (q *PrioQueue) SetPrometheusMetrics(metrics *PrometheusMetrics) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.prometheus = metrics
+}
+
+// Push adds a new item to the end of the queue. Returns true if added, false if queue is closed or at max capacity.
+// With coalescing, an identical request waits for the response of the queued or in-flight one instead (see
+// SetCoalescing).
+func (q *PrioQueue) Push(r *SimRequest) bool {
+	added, _ := q.push(r, q)
+	return added
+}
+
+// push adds r like Push, joined is true if it was coalesced with an identical request instead. owner is the queue
+// the waiters of r are queued in again if r drops out (see coalescedGroup).
+func (q *PrioQueue) push(r *SimRequest, owner Queue) (added, joined bool) {
+	if q.closed.Load() || r == nil {
+		return false, false
+	}
+	key, coalesce := q.coalesceKey(r) // hashed before the lock
 
 	// Wait for the lock
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 
-	// Check if closed in the meantime
+	// Check if closed in the meantime, the queue limits (coalesced requests don't need room), and the reserved
+	// fast-track slots
 	if q.closed.Load() {
-		return false
+		return false, false
+	} else if coalesce && q.join(key, r) {
+		return true, true
+	} else if q.isFull(r) || q.fastTrackReservedFull(r) {
+		return false, false
 	}
 
 	// Add to the queue
+	r.QueuedAt = time.Now()
+	r.numPassed = 0
 	if r.IsFastTrack {
-		q.fastTrack = append(q.fastTrack, r)
-	} else if r.IsHighPrio {
-		q.highPrio = append(q.highPrio, r)
-	} else {
-		q.lowPrio = append(q.lowPrio, r)
+		if r.reservedSlot = q.takesReservedSlot(r); r.reservedSlot {
+			if q.reservedQueued == nil {
+				q.reservedQueued = make(map[string]int)
+			}
+			q.reservedQueued[r.Reservation]++
+			q.numReservedQueued++
+		}
+	}
+	lane := q.lane(r)
+	*lane = append(*lane, r)
+	q.numBytes.Add(r.Payload.Len())
+	q.prometheus.queuePushed(r)
+	if coalesce {
+		q.lead(key, r, owner)
+	}
+	if q.threshold > 0 && q.onThresholdCrossed != nil && q.numRequests() == q.threshold {
+		q.onThresholdCrossed(true, q.threshold)
 	}
 
 	// Unlock and send signal to a listener
 	q.cond.Signal()
-	return true
+	return true, false
+}
+
+// CanPush returns whether Push would add r now: the queue isn't closed, and the limit of its priority isn't reached
+// (for fast-track requests also the unreserved part of the limit, or the slots of its reservation)
+func (q *PrioQueue) CanPush(r *SimRequest) bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return !q.closed.Load() && !q.isFull(r) && !q.fastTrackReservedFull(r)
+}
+
+// isFull returns whether a queue limit which applies to r is reached. The lock must be held.
+func (q *PrioQueue) isFull(r *SimRequest) bool {
+	return (r.IsFastTrack && q.maxFastTrack > 0 && len(q.fastTrack) >= q.maxFastTrack) ||
+		(r.IsHighPrio && q.maxHighPrio > 0 && q.lenHighPrio() >= q.maxHighPrio) ||
+		(!r.IsHighPrio && q.maxLowPrio > 0 && len(q.lowPrio) >= q.maxLowPrio)
 }
 
 // Pop returns the next Bid. If no task in queue, blocks until there is one again. First drains the high-prio queue,
-// then the low-prio one. Will return nil only after calling Close() when the queue is empty
+// then the levels below it (see SetPriorityLevels), then the low-prio one (or every n-th request from it, see SetLowPrioScheduling). Will return nil only after calling
+// Close() when the queue is empty
 func (q *PrioQueue) Pop() (nextReq *SimRequest) {
+	return q.PopCtx(context.Background())
+}
+
+// PopCtx is Pop, but also returns nil once ctx is done. A request which is available when ctx is done may still be
+// returned, but it's never dropped: it's either returned, or stays queued.
+func (q *PrioQueue) PopCtx(ctx context.Context) (nextReq *SimRequest) {
 	// Return nil immediately if queue is closed and empty
-	if q.closed.Load() && len(q.fastTrack) == 0 && len(q.highPrio) == 0 && len(q.lowPrio) == 0 {
+	if q.closed.Load() && q.NumRequests() == 0 {
 		return nil
 	}
 
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 
-	if len(q.fastTrack) == 0 && len(q.highPrio) == 0 && len(q.lowPrio) == 0 {
-		if q.closed.Load() {
+	if !q.canPop() {
+		defer wakeOnDone(ctx, q.cond)()
+	}
+	for !q.canPop() {
+		if q.closed.Load() || ctx.Err() != nil {
 			return nil
 		}
 
 		q.cond.Wait()
 	}
 
-	// decide whether to start with fast-track or high-prio queue
-	processFastTrack := len(q.fastTrack) > 0
-	if !q.fastTrackDrainFirst {
-		if processFastTrack {
-			// only fast-track every so often
-			if q.nFastTrack.Inc() > int32(q.numFastTrackForHighPrio) {
-				q.nFastTrack.Store(0)
-				processFastTrack = false
+	now := time.Now()
+	q.promoteAged(now)
+	if q.lowPrioEveryN > 0 && q.nSinceLowPrio >= q.lowPrioEveryN && len(q.lowPrio) > 0 && q.lowPrioPoppable() {
+		// the low-prio request which is due
+		nextReq, q.lowPrio = q.order.pop(q.lowPrio, q.order.LowPrio, now)
+	} else {
+		// decide whether to start with fast-track or high-prio queue
+		processFastTrack := len(q.fastTrack) > 0
+		if !q.fastTrackDrainFirst {
+			processFastTrack = q.interleave.fastTrackTurn(len(q.fastTrack) > 0, len(q.highPrio) > 0)
+		}
+
+		if processFastTrack { // check fast-track queue first
+			if len(q.fastTrack) > 0 {
+				nextReq, q.fastTrack = q.order.pop(q.fastTrack, q.order.FastTrack, now)
+			} else if len(q.highPrio) > 0 {
+				nextReq, q.highPrio = q.order.pop(q.highPrio, q.order.HighPrio, now)
+			}
+		} else { // check high-prio queue first
+			if len(q.highPrio) > 0 {
+				nextReq, q.highPrio = q.order.pop(q.highPrio, q.order.HighPrio, now)
+			} else if len(q.fastTrack) > 0 {
+				nextReq, q.fastTrack = q.order.pop(q.fastTrack, q.order.FastTrack, now)
+			}
+		}
+		for i := 0; nextReq == nil && i < len(q.midPrio); i++ {
+			if len(q.midPrio[i]) > 0 {
+				nextReq, q.midPrio[i] = q.order.pop(q.midPrio[i], q.order.HighPrio, now)
 			}
-		} else {
-			q.nFastTrack.Store(0)
+		}
+		if nextReq == nil && len(q.lowPrio) > 0 && q.lowPrioPoppable() {
+			nextReq, q.lowPrio = q.order.pop(q.lowPrio, q.order.LowPrio, now)
 		}
 	}
 
-	if processFastTrack { // check fast-track queue first
-		if len(q.fastTrack) > 0 {
-			nextReq = q.fastTrack[0]
-			q.fastTrack = q.fastTrack[1:]
-		} else if len(q.highPrio) > 0 {
-			nextReq = q.highPrio[0]
-			q.highPrio = q.highPrio[1:]
-		} else if len(q.lowPrio) > 0 {
-			nextReq = q.lowPrio[0]
-			q.lowPrio = q.lowPrio[1:]
+	if nextReq != nil {
+		if nextReq.Priority() == PriorityLowPrio {
+			q.nSinceLowPrio = 0
+		} else {
+			q.nSinceLowPrio++
+		}
+		q.dequeued(nextReq)
+		q.prometheus.queuePopped(nextReq)
+		if q.onPop != nil {
+			q.onPop(nextReq, time.Since(nextReq.QueuedAt))
 		}
-	} else { // check high-prio queue first
-		if len(q.highPrio) > 0 {
-			nextReq = q.highPrio[0]
-			q.highPrio = q.highPrio[1:]
-		} else if len(q.fastTrack) > 0 {
-			nextReq = q.fastTrack[0]
-			q.fastTrack = q.fastTrack[1:]
-		} else if len(q.lowPrio) > 0 {
-			nextReq = q.lowPrio[0]
-			q.lowPrio = q.lowPrio[1:]
+		if q.threshold > 0 && q.onThresholdCrossed != nil && q.numRequests() == q.threshold-1 {
+			q.onThresholdCrossed(false, q.threshold-1)
 		}
 	}
 
@@ -156,11 +490,181 @@ func (q *PrioQueue) Pop() (nextReq *SimRequest) {
 	return nextReq
 }
 
+// dequeued updates the reserved slots and the queued bytes for a request which left the queue. The lock must be held.
+func (q *PrioQueue) dequeued(r *SimRequest) {
+	if r.reservedSlot && q.reservedQueued[r.Reservation] > 0 {
+		q.reservedQueued[r.Reservation]--
+		q.numReservedQueued--
+		if q.reservedQueued[r.Reservation] == 0 {
+			delete(q.reservedQueued, r.Reservation)
+		}
+	}
+	r.reservedSlot = false
+	q.numBytes.Sub(r.Payload.Len())
+}
+
+// wakeOnDone wakes the waiters of cond once ctx is done, until the returned stop func is called. The lock of cond must
+// be held (so that the wake-up can't happen between the check of ctx and the Wait).
+func wakeOnDone(ctx context.Context, cond *sync.Cond) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopC := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		case <-stopC:
+		}
+	}()
+	return func() { close(stopC) }
+}
+
+// Position returns the number of queued requests which are popped before r, following the interleaving of Pop
+// (ignoring the smallest-first order, a paused low-prio queue counts as resumed after the others). ok is false if r
+// is not queued.
+func (q *PrioQueue) Position(r *SimRequest) (ahead int, ok bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	queues := append(append([][]*SimRequest{q.fastTrack, q.highPrio}, q.midPrio...), q.lowPrio)
+	lowPrio := len(queues) - 1
+	target, targetIdx := -1, -1
+	for i, queue := range queues {
+		for j, queued := range queue {
+			if queued == r {
+				target, targetIdx = i, j
+			}
+		}
+	}
+	if target < 0 {
+		return 0, false
+	}
+
+	// Simulate the pops until r is popped
+	popped := make([]int, len(queues))
+	interleave := q.interleave
+	nSinceLowPrio := q.nSinceLowPrio
+	highPrioFirst, fastTrackFirst := make([]int, len(queues)), make([]int, len(queues))
+	for i := range queues {
+		highPrioFirst[i], fastTrackFirst[i] = i, i
+	}
+	highPrioFirst[0], highPrioFirst[1] = 1, 0
+	for {
+		remaining := func(i int) bool { return popped[i] < len(queues[i]) }
+		order := highPrioFirst
+		if q.lowPrioEveryN > 0 && nSinceLowPrio >= q.lowPrioEveryN && remaining(lowPrio) && q.lowPrioPoppable() {
+			order = []int{lowPrio}
+		} else {
+			processFastTrack := remaining(0)
+			if !q.fastTrackDrainFirst {
+				processFastTrack = interleave.fastTrackTurn(remaining(0), remaining(1))
+			}
+			if processFastTrack {
+				order = fastTrackFirst
+			}
+		}
+
+		for _, i := range order {
+			if !remaining(i) {
+				continue
+			}
+			if i == target && popped[i] == targetIdx {
+				return ahead, true
+			}
+			popped[i]++
+			ahead++
+			if i == lowPrio {
+				nSinceLowPrio = 0
+			} else {
+				nSinceLowPrio++
+			}
+			break
+		}
+	}
+}
+
+// DropLowPrio removes all queued low-prio requests (i.e. for load shedding), and returns them oldest first. The caller
+// has to respond to them.
+func (q *PrioQueue) DropLowPrio() []*SimRequest {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	dropped := q.lowPrio
+	if len(dropped) == 0 {
+		return nil
+	}
+	numBefore := q.numRequests()
+	q.lowPrio = nil
+	for _, r := range dropped {
+		q.numBytes.Sub(r.Payload.Len())
+	}
+	if q.threshold > 0 && q.onThresholdCrossed != nil && numBefore >= q.threshold && q.numRequests() < q.threshold {
+		q.onThresholdCrossed(false, q.numRequests())
+	}
+	if q.closed.Load() && q.numRequests() == 0 {
+		q.cond.Broadcast()
+	}
+	return dropped
+}
+
+// Remove removes r from the queue (i.e. when it was cancelled). Returns false if it's not queued.
+func (q *PrioQueue) Remove(r *SimRequest) bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	numBefore := q.numRequests()
+	for _, queue := range q.lanes() {
+		for i, queued := range *queue {
+			if queued != r {
+				continue
+			}
+			*queue = append((*queue)[:i], (*queue)[i+1:]...)
+			q.dequeued(r)
+			if q.threshold > 0 && q.onThresholdCrossed != nil && numBefore == q.threshold {
+				q.onThresholdCrossed(false, q.threshold-1)
+			}
+			if q.closed.Load() && q.numRequests() == 0 {
+				q.cond.Broadcast()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// lanes returns the queues of all priority levels, highest first. The lock must be held.
+func (q *PrioQueue) lanes() []*[]*SimRequest {
+	lanes := []*[]*SimRequest{&q.fastTrack, &q.highPrio}
+	for i := range q.midPrio {
+		lanes = append(lanes, &q.midPrio[i])
+	}
+	return append(lanes, &q.lowPrio)
+}
+
+// Snapshot returns the queued requests by priority (fast-track, high-prio by level, then low-prio), each oldest
+// first. Only the slices are copied with the lock held.
+func (q *PrioQueue) Snapshot() []*SimRequest {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	requests := make([]*SimRequest, 0, q.numRequests())
+	requests = append(requests, q.fastTrack...)
+	requests = append(requests, q.highPrio...)
+	for _, lane := range q.midPrio {
+		requests = append(requests, lane...)
+	}
+	return append(requests, q.lowPrio...)
+}
+
 // Close disallows adding any new items with Push(), and lets readers using Pop() return nil if queue is empty
 func (q *PrioQueue) Close() {
 	q.closed.Store(true)
-	if q.NumRequests() == 0 {
-		q.cond.Broadcast()
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.numRequests() == 0 || q.lowPrioPaused {
+		q.cond.Broadcast() // also wakes Pop waiting for a paused low-prio queue
 	}
 }
 
@@ -170,7 +674,7 @@ func (q *PrioQueue) CloseAndWait() {
 
 	// Wait until queue is empty
 	q.cond.L.Lock()
-	if q.NumRequests() > 0 {
+	for q.numRequests() > 0 {
 		q.cond.Wait()
 	}
 	q.cond.L.Unlock()
@@ -4,6 +4,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"sync"
 	"testing"
 	"time"
@@ -12,7 +13,7 @@ import (
 )
 
 func cloneRequest(req *SimRequest) *SimRequest {
-	return NewSimRequest(context.Background(), "1", req.Payload, req.IsHighPrio, req.IsFastTrack)
+	return NewSimRequestWithPayload(context.Background(), "1", req.Payload, req.IsHighPrio, req.IsFastTrack)
 }
 
 func fillQueue(t *testing.T, q *PrioQueue) {
@@ -46,7 +47,7 @@ func fillQueue(t *testing.T, q *PrioQueue) {
 }
 
 func TestQueueBlockingPop(t *testing.T) {
-	q := NewPrioQueue(0, 0, 0, 2, false)
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
 	taskLowPrio := NewSimRequest(context.Background(), "1", []byte("taskLowPrio"), false, false)
 
 	// Ensure queue.Pop is blocking
@@ -58,9 +59,61 @@ func TestQueueBlockingPop(t *testing.T) {
 	require.True(t, tX >= 100*time.Millisecond)
 }
 
+func TestPrioQueuePopCtx(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer q.Close()
+
+	// The priority order is the one of Pop
+	fillQueue(t, q)
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, isFastTrack := range []bool{true, true, false, true, true, false} {
+		require.Equal(t, isFastTrack, q.PopCtx(ctx).IsFastTrack)
+	}
+
+	// Unblocked by cancelling the context, while the queue is empty
+	for q.NumRequests() > 0 {
+		q.Pop()
+	}
+	popped := make(chan *SimRequest, 1)
+	go func() { popped <- q.PopCtx(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case r := <-popped:
+		require.Nil(t, r)
+	case <-time.After(time.Second):
+		t.Fatal("PopCtx did not return after the context was cancelled")
+	}
+	require.False(t, q.IsClosed())
+
+	// A queued request is returned with a done context, and a later one is popped by the other consumers
+	r := NewSimRequest(context.Background(), "1", []byte("1"), false, false)
+	q.Push(r)
+	require.Equal(t, r, q.PopCtx(ctx))
+	require.Nil(t, q.PopCtx(ctx))
+	q.Push(r)
+	require.Equal(t, r, q.Pop())
+
+	// A request which is pushed while the context is cancelled is never dropped: it's either popped, or stays queued
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() { popped <- q.PopCtx(ctx) }()
+		r := NewSimRequest(context.Background(), fmt.Sprint(i), []byte("1"), false, false)
+		go cancel()
+		q.Push(r)
+		if got := <-popped; got != nil {
+			require.Equal(t, r, got)
+			require.Equal(t, 0, q.NumRequests())
+		} else {
+			require.Equal(t, 1, q.NumRequests())
+			require.Equal(t, r, q.Pop())
+		}
+	}
+}
+
 func TestQueuePopping(t *testing.T) {
 	// Test 1 - expected: fastTrack -> highPrio -> fastTrack -> highPrio
-	q := NewPrioQueue(0, 0, 0, 1, false)
+	q := NewPrioQueue(0, 0, 0, 1, false, PriorityAging{})
 	fillQueue(t, q)
 	for i := 0; i < 5; i++ {
 		x := q.Pop()
@@ -80,7 +133,7 @@ func TestQueuePopping(t *testing.T) {
 	require.Equal(t, 0, len(q.highPrio))
 
 	// Test 2 - expected: 2x fastTrack -> 1x highPrio
-	q = NewPrioQueue(0, 0, 0, 2, false)
+	q = NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
 	fillQueue(t, q)
 	require.Equal(t, true, q.Pop().IsFastTrack)
 	require.Equal(t, true, q.Pop().IsFastTrack)
@@ -91,7 +144,7 @@ func TestQueuePopping(t *testing.T) {
 	require.Equal(t, true, q.Pop().IsFastTrack)
 
 	// Test 3 - expected: all fastTrack -> all highPrio
-	q = NewPrioQueue(0, 0, 0, 2, true)
+	q = NewPrioQueue(0, 0, 0, 2, true, PriorityAging{})
 	fillQueue(t, q)
 	for i := 0; i < 5; i++ {
 		require.Equal(t, true, q.Pop().IsFastTrack)
@@ -102,7 +155,7 @@ func TestQueuePopping(t *testing.T) {
 }
 
 func TestPrioQueueMultipleReaders(t *testing.T) {
-	q := NewPrioQueue(0, 0, 0, 2, false)
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
 	taskLowPrio := NewSimRequest(context.Background(), "1", []byte("taskLowPrio"), false, false)
 
 	counts := make(map[int]int)
@@ -145,7 +198,7 @@ func TestPrioQueueMultipleReaders(t *testing.T) {
 }
 
 func TestPrioQueueVarious(t *testing.T) {
-	q := NewPrioQueue(0, 0, 0, 2, false)
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
 	q.Push(nil)
 	require.Equal(t, 0, len(q.highPrio))
 	require.Equal(t, 0, len(q.lowPrio))
@@ -155,7 +208,7 @@ func TestPrioQueueVarious(t *testing.T) {
 
 // Test used for benchmark: single reader
 func _testPrioQueue1(numWorkers, numItems int) *PrioQueue {
-	q := NewPrioQueue(0, 0, 0, 2, false)
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
 	taskLowPrio := NewSimRequest(context.Background(), "1", []byte("taskLowPrio"), false, false)
 
 	var wg sync.WaitGroup
@@ -202,3 +255,194 @@ func BenchmarkPrioQueueMultiReader(b *testing.B) {
 		_testPrioQueue1(5, 10_000)
 	}
 }
+
+func TestQueueThresholdCrossed(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	crossings := []string{}
+	q.OnThresholdCrossed(2, func(above bool, numRequests int) {
+		crossings = append(crossings, fmt.Sprint(above, numRequests))
+	})
+
+	for i := 0; i < 3; i++ {
+		q.Push(NewSimRequest(context.Background(), "", []byte("foo"), false, false))
+	}
+	require.Equal(t, []string{"true 2"}, crossings)
+	for i := 0; i < 3; i++ {
+		q.Pop()
+	}
+	require.Equal(t, []string{"true 2", "false 1"}, crossings)
+
+	// Crossing again
+	q.Push(NewSimRequest(context.Background(), "", []byte("foo"), false, false))
+	q.Push(NewSimRequest(context.Background(), "", []byte("foo"), true, false))
+	require.Equal(t, []string{"true 2", "false 1", "true 2"}, crossings)
+}
+
+func TestPrioQueuePosition(t *testing.T) {
+	for _, drainFirst := range []bool{false, true} {
+		q := NewPrioQueue(0, 0, 0, 2, drainFirst, PriorityAging{})
+		requests := make(map[string]*SimRequest)
+		for _, id := range []string{"l1", "h1", "f1", "h2", "f2", "l2", "h3", "f3"} {
+			r := NewSimRequest(context.Background(), id, []byte(id), id[0] == 'h', id[0] == 'f')
+			requests[id] = r
+			require.True(t, q.Push(r))
+		}
+
+		// 2 fast-track requests per high-prio request, then low-prio
+		expected := []string{"f1", "f2", "h1", "f3", "h2", "h3", "l1", "l2"}
+		if drainFirst {
+			expected = []string{"f1", "f2", "f3", "h1", "h2", "h3", "l1", "l2"}
+		}
+		for i, id := range expected {
+			ahead, ok := q.Position(requests[id])
+			require.True(t, ok, id)
+			require.Equal(t, i, ahead, id)
+		}
+
+		// The positions follow the pops, also within the interleaving
+		for i, id := range expected {
+			for j, laterID := range expected[i:] {
+				ahead, _ := q.Position(requests[laterID])
+				require.Equal(t, j, ahead, laterID)
+			}
+			require.Equal(t, id, q.Pop().ID)
+		}
+		_, ok := q.Position(requests["f1"])
+		require.False(t, ok)
+	}
+}
+
+func TestPrioQueueRemove(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer q.Close()
+	f1 := NewSimRequest(context.Background(), "f1", []byte("f1"), false, true)
+	h1 := NewSimRequest(context.Background(), "h1", []byte("h1"), true, false)
+	l1 := NewSimRequest(context.Background(), "l1", []byte("l1"), false, false)
+	l2 := NewSimRequest(context.Background(), "l2", []byte("l2"), false, false)
+	for _, r := range []*SimRequest{f1, h1, l1, l2} {
+		require.True(t, q.Push(r))
+	}
+
+	require.False(t, q.Remove(NewSimRequest(context.Background(), "h1", []byte("h1"), true, false))) // not queued
+	require.True(t, q.Remove(h1))
+	require.False(t, q.Remove(h1))
+	require.True(t, q.Remove(l1))
+	require.Equal(t, 2, q.NumRequests())
+	require.Equal(t, int64(4), q.NumBytes())
+
+	// Popped requests can't be removed anymore
+	require.Equal(t, "f1", q.Pop().ID)
+	require.False(t, q.Remove(f1))
+	require.Equal(t, "l2", q.Pop().ID)
+	require.Equal(t, 0, q.NumRequests())
+}
+
+func TestPrioQueuePriorityLevels(t *testing.T) {
+	q := NewPrioQueue(0, 3, 0, 2, false, PriorityAging{})
+	defer q.Close()
+	q.SetPriorityLevels(5)
+	newRequest := func(id string, level int) *SimRequest {
+		isHighPrio, isFastTrack := priorityOfLevel(level, 5)
+		r := NewSimRequest(context.Background(), id, []byte(id), isHighPrio, isFastTrack)
+		r.PriorityLevel = level
+		return r
+	}
+	popOrder := func(n int) (ids []string) {
+		for i := 0; i < n; i++ {
+			ids = append(ids, q.Pop().ID)
+		}
+		return ids
+	}
+
+	var m3 *SimRequest
+	for _, r := range []*SimRequest{
+		newRequest("l", 4),
+		newRequest("m3", 3),
+		newRequest("m2", 2),
+		newRequest("h", 1),
+		newRequest("f1", 0),
+		newRequest("f2", 0),
+		newRequest("f3", 0),
+	} {
+		require.True(t, q.Push(r))
+		if r.ID == "m3" {
+			m3 = r
+		}
+	}
+
+	// The levels in between count as high-prio, against its limit
+	lenFastTrack, lenHighPrio, lenLowPrio := q.Len()
+	require.Equal(t, []int{3, 3, 1}, []int{lenFastTrack, lenHighPrio, lenLowPrio})
+	require.False(t, q.Push(newRequest("m2", 2)))
+	ahead, ok := q.Position(m3)
+	require.True(t, ok)
+	require.Equal(t, 5, ahead)
+	var snapshot []string
+	for _, r := range q.Snapshot() {
+		snapshot = append(snapshot, r.ID)
+	}
+	require.Equal(t, []string{"f1", "f2", "f3", "h", "m2", "m3", "l"}, snapshot)
+
+	// Fast-track and high-prio are interleaved, then the lower levels follow in order
+	require.Equal(t, []string{"f1", "f2", "h", "f3", "m2", "m3", "l"}, popOrder(7))
+
+	// Requests of removed levels move into the last level left, by their age
+	h := newRequest("h", 1)
+	require.True(t, q.Push(h))
+	m3 = newRequest("m3", 3)
+	m3.CreatedAt = h.CreatedAt.Add(-time.Second)
+	require.True(t, q.Push(m3))
+	q.SetPriorityLevels(3)
+	require.Equal(t, []string{"m3", "h"}, popOrder(2))
+}
+
+func TestPrioQueueInterleaveWeights(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer q.Close()
+	q.SetInterleaveWeights(3, 2)
+	fastTrackWeight, highPrioWeight := q.InterleaveWeights()
+	require.Equal(t, []int{3, 2}, []int{fastTrackWeight, highPrioWeight})
+
+	// Bursts of one priority at a time, the ratio applies to the pops while both are queued
+	rnd := rand.New(rand.NewSource(1))
+	popMixed := func(numPops int) (numFastTrack, numHighPrio int) {
+		for numFastTrack+numHighPrio < numPops {
+			for i, n := 0, rnd.Intn(20); i < n; i++ {
+				require.True(t, q.Push(NewSimRequest(context.Background(), "f", []byte("f"), false, true)))
+			}
+			for i, n := 0, rnd.Intn(20); i < n; i++ {
+				require.True(t, q.Push(NewSimRequest(context.Background(), "h", []byte("h"), true, false)))
+			}
+			for i := rnd.Intn(20); i > 0; i-- {
+				lenFastTrack, lenHighPrio, _ := q.Len()
+				if lenFastTrack == 0 || lenHighPrio == 0 {
+					break
+				}
+				if q.Pop().IsFastTrack {
+					numFastTrack++
+				} else {
+					numHighPrio++
+				}
+			}
+		}
+		return numFastTrack, numHighPrio
+	}
+	numFastTrack, numHighPrio := popMixed(500)
+	require.InDelta(t, 3.0/5, float64(numFastTrack)/float64(numFastTrack+numHighPrio), 0.01)
+
+	// Popping only fast-track requests for a while doesn't accumulate credit
+	for q.NumRequests() > 0 {
+		q.Pop()
+	}
+	for i := 0; i < 50; i++ {
+		require.True(t, q.Push(NewSimRequest(context.Background(), "f", []byte("f"), false, true)))
+		q.Pop()
+	}
+	numFastTrack, numHighPrio = popMixed(500)
+	require.InDelta(t, 3.0/5, float64(numFastTrack)/float64(numFastTrack+numHighPrio), 0.01)
+
+	// Changed at runtime
+	q.SetInterleaveWeights(1, 4)
+	numFastTrack, numHighPrio = popMixed(500)
+	require.InDelta(t, 1.0/5, float64(numFastTrack)/float64(numFastTrack+numHighPrio), 0.01)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PersistedRequest is a queued async or callback request in the QueueStore, from which it's queued again after a
+// restart. Requests with a client connection are not persisted, the connection is gone after a restart anyway.
+type PersistedRequest struct {
+	ID             string    `json:"id"`
+	Tenant         string    `json:"tenant,omitempty"`
+	ClientID       string    `json:"clientID,omitempty"`
+	Payload        []byte    `json:"payload"`
+	ContentType    string    `json:"contentType,omitempty"`
+	IsHighPrio     bool      `json:"isHighPrio,omitempty"`
+	IsFastTrack    bool      `json:"isFastTrack,omitempty"`
+	PriorityLevel  int       `json:"priorityLevel,omitempty"`
+	TimeoutMs      int64     `json:"timeoutMs"` // the deadline in the queue, since CreatedAt
+	ProxyTimeoutMs int64     `json:"proxyTimeoutMs,omitempty"`
+	CallbackURL    string    `json:"callbackURL,omitempty"` // empty for async requests, whose result is fetched with GET /sim/{id}
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// QueueStore persists the queued async and callback requests. Implemented by RedisState.
+type QueueStore interface {
+	SaveQueuedRequest(r PersistedRequest) error
+	DeleteQueuedRequest(tenant, id string) error
+	GetQueuedRequests() (requests []PersistedRequest, err error)
+}
+
+var _ QueueStore = (*RedisState)(nil)
+
+// QueuePersistence writes the queued async and callback requests to a QueueStore in the background, and deletes them
+// once they completed, so that the queue doesn't wait for the store. Writes are dropped (and logged) if the buffer
+// is full.
+type QueuePersistence struct {
+	log   *zap.SugaredLogger
+	store QueueStore
+	ops   chan queuePersistenceOp
+	wg    sync.WaitGroup
+
+	lock   sync.RWMutex // protects closing the ops channel
+	closed bool
+}
+
+type queuePersistenceOp struct {
+	save       *PersistedRequest // nil to delete the request
+	tenant, id string
+}
+
+func NewQueuePersistence(log *zap.SugaredLogger, store QueueStore, bufferSize int) *QueuePersistence {
+	p := &QueuePersistence{
+		log:   log,
+		store: store,
+		ops:   make(chan queuePersistenceOp, bufferSize),
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+func (p *QueuePersistence) run() {
+	defer p.wg.Done()
+	for op := range p.ops {
+		var err error
+		if op.save != nil {
+			err = p.store.SaveQueuedRequest(*op.save)
+		} else {
+			err = p.store.DeleteQueuedRequest(op.tenant, op.id)
+		}
+		if err != nil {
+			p.log.Errorw("Persisting the queued request failed", "reqID", op.id, "tenant", op.tenant, "save", op.save != nil, "error", err)
+		}
+	}
+}
+
+func (p *QueuePersistence) queue(op queuePersistenceOp) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.ops <- op:
+	default:
+		p.log.Warnw("Persisting the queued request dropped, the buffer is full", "reqID", op.id, "tenant", op.tenant, "save", op.save != nil)
+	}
+}
+
+// Save persists the queued async request (with the callback URL of a callback request)
+func (p *QueuePersistence) Save(r *SimRequest, callbackURL string) {
+	if p == nil {
+		return
+	}
+	payload, err := r.Payload.Bytes() // read now, the (spooled) payload is removed once the request completed
+	if err != nil {
+		p.log.Errorw("Persisting the queued request failed, reading the payload failed", "reqID", r.ID, "error", err)
+		return
+	}
+	p.queue(queuePersistenceOp{tenant: r.Tenant, id: r.ID, save: &PersistedRequest{
+		ID:             r.ID,
+		Tenant:         r.Tenant,
+		ClientID:       r.ClientID,
+		Payload:        payload,
+		ContentType:    r.ContentType,
+		IsHighPrio:     r.IsHighPrio,
+		IsFastTrack:    r.IsFastTrack,
+		PriorityLevel:  r.PriorityLevel,
+		TimeoutMs:      r.RequestTimeout().Milliseconds(),
+		ProxyTimeoutMs: r.ProxyTimeout.Milliseconds(),
+		CallbackURL:    callbackURL,
+		CreatedAt:      r.CreatedAt,
+	}})
+}
+
+// Delete removes the completed request
+func (p *QueuePersistence) Delete(r *SimRequest) {
+	if p == nil {
+		return
+	}
+	p.queue(queuePersistenceOp{tenant: r.Tenant, id: r.ID})
+}
+
+// Close writes the buffered changes and stops the writer. Changes afterwards are dropped.
+func (p *QueuePersistence) Close() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.ops)
+	}
+	p.lock.Unlock()
+	p.wg.Wait()
+}
+
+// simRequest returns the request to queue again, with its original CreatedAt (and deadline)
+func (r PersistedRequest) simRequest() *SimRequest {
+	simReq := NewSimRequest(ContextWithRequestID(context.Background(), r.ID), r.ID, r.Payload, r.IsHighPrio, r.IsFastTrack)
+	simReq.Tenant = r.Tenant
+	simReq.ClientID = r.ClientID
+	simReq.ContentType = r.ContentType
+	simReq.PriorityLevel = r.PriorityLevel
+	simReq.Timeout = time.Duration(r.TimeoutMs) * time.Millisecond
+	simReq.ProxyTimeout = time.Duration(r.ProxyTimeoutMs) * time.Millisecond
+	simReq.CreatedAt = r.CreatedAt
+	return simReq
+}
+
+// EnableQueuePersistence persists the queued async and callback requests, see RestoreQueue
+func (s *Webserver) EnableQueuePersistence(p *QueuePersistence) {
+	s.queuePersistence = p
+}
+
+// RestoreQueue queues the async and callback requests of the store again, which a previous instance didn't complete,
+// unless their deadline passed in the meantime. Requests which can't be queued are completed with the error, the
+// expired ones are deleted. Returns the number of queued requests.
+func (s *Webserver) RestoreQueue() (restored int, err error) {
+	requests, err := s.queuePersistence.store.GetQueuedRequests()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, r := range requests {
+		simReq := r.simRequest()
+		log := s.log.With("reqID", r.ID, "tenant", r.Tenant)
+		if !now.Before(simReq.Deadline()) {
+			log.Infow("Discarding the persisted request, its deadline passed", "createdAt", r.CreatedAt)
+			s.queuePersistence.Delete(simReq)
+			continue
+		} else if (r.CallbackURL == "" && s.asyncResults == nil) || (r.CallbackURL != "" && s.callbacks == nil) {
+			log.Warnw("Discarding the persisted request, the async mode or callbacks are disabled", "callbackURL", r.CallbackURL)
+			s.queuePersistence.Delete(simReq)
+			continue
+		}
+		if r.CallbackURL == "" {
+			if err := s.asyncResults.add(simReq, now); err != nil {
+				log.Warnw("Discarding the persisted request, it can't be added to the async results", "err", err)
+				s.queuePersistence.Delete(simReq)
+				continue
+			}
+		}
+
+		simReq.SizeClass = s.payloadStats.Classify(simReq.Payload.Len())
+		if kind, err := s.queueBatchElement(log, simReq); err != nil {
+			result := newSimsErrorEntry(simReq.ID, http.StatusServiceUnavailable, kind, errorCode(kind), fmt.Sprintf("restoring the queued request failed: %s", err))
+			s.finishAsync(simReq, result, r.CallbackURL)
+			continue
+		}
+		restored++
+		go s.completeAsync(log, simReq, simReq.Payload, simReq.CreatedAt, r.CallbackURL)
+	}
+	return restored, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisQueuedRequests(t *testing.T) {
+	resetTestRedis()
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.Nil(t, redisTestState.SaveQueuedRequest(PersistedRequest{ID: "b", Tenant: "acme", Payload: []byte("{}"), CreatedAt: createdAt.Add(time.Second)}))
+	require.Nil(t, redisTestState.SaveQueuedRequest(PersistedRequest{ID: "a", Payload: []byte("{}"), TimeoutMs: 100, CallbackURL: "http://hooks", CreatedAt: createdAt}))
+	requests, err := redisTestState.GetQueuedRequests()
+	require.Nil(t, err, err)
+	require.Equal(t, []PersistedRequest{
+		{ID: "a", Payload: []byte("{}"), TimeoutMs: 100, CallbackURL: "http://hooks", CreatedAt: createdAt},
+		{ID: "b", Tenant: "acme", Payload: []byte("{}"), CreatedAt: createdAt.Add(time.Second)},
+	}, requests)
+
+	require.Nil(t, redisTestState.DeleteQueuedRequest("", "b")) // of another tenant
+	require.Nil(t, redisTestState.DeleteQueuedRequest("", "a"))
+	requests, err = redisTestState.GetQueuedRequests()
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(requests))
+	require.Equal(t, "b", requests[0].ID)
+}
+
+func TestQueuePersistence(t *testing.T) {
+	resetTestRedis()
+	persistedRequests := func() []PersistedRequest {
+		requests, err := redisTestState.GetQueuedRequests()
+		require.Nil(t, err, err)
+		return requests
+	}
+	submit := func(handler http.Handler, reqID string) {
+		req := httptest.NewRequest(http.MethodPost, "/sim?async=1", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+		req.Header.Set("X-Request-ID", reqID)
+		req.Header.Set("X-High-Priority", "true")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+
+	// Without main loop, the request stays queued
+	webserver := newAdmissionTestWebserver(t, NewPrioQueue(0, 0, 0, 2, false, PriorityAging{}))
+	webserver.EnableQueuePersistence(NewQueuePersistence(testLog, redisTestState, 10))
+	submit(webserver.Handler(), "persisted")
+	require.Eventually(t, func() bool { return len(persistedRequests()) == 1 }, time.Second, 5*time.Millisecond)
+	persisted := persistedRequests()[0]
+	require.Equal(t, "persisted", persisted.ID)
+	require.True(t, persisted.IsHighPrio)
+	require.Equal(t, `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`, string(persisted.Payload))
+	require.Equal(t, NewSimRequest(context.Background(), "", nil, true, false).RequestTimeout().Milliseconds(), persisted.TimeoutMs)
+	require.Nil(t, redisTestState.SaveQueuedRequest(PersistedRequest{ID: "expired", Payload: []byte("{}"), TimeoutMs: 100, CreatedAt: time.Now().Add(-time.Second)}))
+
+	// The next instance queues it again, and discards the expired one
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	webserver2 := newAdmissionTestWebserver(t, prioQueue)
+	webserver2.EnableQueuePersistence(NewQueuePersistence(testLog, redisTestState, 10))
+	restored, err := webserver2.RestoreQueue()
+	require.Nil(t, err, err)
+	require.Equal(t, 1, restored)
+	require.Equal(t, 1, prioQueue.NumRequests())
+	r := prioQueue.Pop()
+	require.Equal(t, "persisted", r.ID)
+	require.Equal(t, persisted.CreatedAt, r.CreatedAt.UTC())
+	require.Eventually(t, func() bool { return len(persistedRequests()) == 1 }, time.Second, 5*time.Millisecond)
+
+	// Its result can be fetched, and it's deleted once it completed
+	rr := httptest.NewRecorder()
+	webserver2.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sim/persisted", nil))
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	r.SendResponse(SimResponse{StatusCode: http.StatusOK, Payload: []byte(`{"result":1}`)})
+	require.Eventually(t, func() bool { return len(persistedRequests()) == 0 }, time.Second, 5*time.Millisecond)
+	rr = httptest.NewRecorder()
+	webserver2.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sim/persisted", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"payload":{"result":1}`)
+
+	// Not deleted if the shutdown flushes it, the next instance queues it again
+	webserver3 := newAdmissionTestWebserver(t, prioQueue)
+	webserver3.EnableQueuePersistence(NewQueuePersistence(testLog, redisTestState, 10))
+	submit(webserver3.Handler(), "flushed")
+	r = prioQueue.Pop()
+	r.SendResponse(SimResponse{Error: ErrShuttingDown, StatusCode: http.StatusServiceUnavailable})
+	require.Eventually(t, func() bool { return webserver3.requests.inFlight.Load() == 0 }, time.Second, 5*time.Millisecond)
+	webserver3.queuePersistence.Close()
+	require.Equal(t, "flushed", persistedRequests()[0].ID)
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultQueueWaitBuckets are the histogram buckets if QUEUE_WAIT_BUCKETS_MS is not set
+var DefaultQueueWaitBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+const (
+	queueWaitSummaryWindow = time.Minute // the rolling summary covers this duration
+	queueWaitMaxSamples    = 10_000      // max samples per priority in the summary window, the oldest are dropped first
+)
+
+// ParseQueueWaitBuckets parses comma separated bucket bounds in milliseconds, i.e. "10,100,1000". Invalid entries are
+// ignored, and the result is sorted. Returns DefaultQueueWaitBuckets if there are no valid entries.
+func ParseQueueWaitBuckets(s string) []time.Duration {
+	res := []time.Duration{}
+	for _, entry := range strings.Split(s, ",") {
+		ms, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+		if err != nil || ms <= 0 {
+			continue
+		}
+		res = append(res, time.Duration(ms*float64(time.Millisecond)))
+	}
+	if len(res) == 0 {
+		return DefaultQueueWaitBuckets
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	deduped := res[:1]
+	for _, bound := range res[1:] {
+		if bound != deduped[len(deduped)-1] {
+			deduped = append(deduped, bound)
+		}
+	}
+	return deduped
+}
+
+// HistogramBucket is the number of observations less than or equal to LeMs (cumulative, like Prometheus buckets)
+type HistogramBucket struct {
+	LeMs  float64 `json:"leMs"`
+	Count uint64  `json:"count"`
+}
+
+// LatencyHistogram is a histogram of durations in milliseconds
+type LatencyHistogram struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"` // all observations, including those above the largest bucket
+	SumMs   float64           `json:"sumMs"`
+}
+
+// QueueWaitSummary are the percentiles of the queue wait times of the last minute
+type QueueWaitSummary struct {
+	Window      string             `json:"window"`
+	NumRequests int                `json:"numRequests"`
+	Us          LatencyPercentiles `json:"us"`
+}
+
+type QueueWaitPriorityStats struct {
+	Histogram LatencyHistogram `json:"histogram"` // since the start
+	Summary   QueueWaitSummary `json:"summary"`   // of the last minute
+}
+
+type queueWaitSample struct {
+	at   time.Time
+	wait time.Duration
+}
+
+// queueWaitSeries are the observations of one priority class
+type queueWaitSeries struct {
+	counts  []uint64 // per bucket (not cumulative), the last one for observations above the largest bucket
+	sum     time.Duration
+	samples []queueWaitSample // ring buffer
+	next    int               // next write position in the ring buffer
+}
+
+// QueueWaitStats records how long requests waited in the queue (from Push to Pop), by priority class
+type QueueWaitStats struct {
+	buckets []time.Duration
+
+	lock   sync.Mutex
+	series map[string]*queueWaitSeries
+}
+
+func NewQueueWaitStats(buckets []time.Duration) *QueueWaitStats {
+	s := &QueueWaitStats{
+		buckets: buckets,
+		series:  make(map[string]*queueWaitSeries),
+	}
+	for _, priority := range []string{PriorityFastTrack, PriorityHighPrio, PriorityLowPrio} {
+		s.series[priority] = &queueWaitSeries{counts: make([]uint64, len(buckets)+1)}
+	}
+	return s
+}
+
+// Observe records the queue wait time of a request
+func (s *QueueWaitStats) Observe(priority string, wait time.Duration) {
+	s.observeAt(priority, wait, time.Now())
+}
+
+func (s *QueueWaitStats) observeAt(priority string, wait time.Duration, now time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	series, found := s.series[priority]
+	if !found {
+		return
+	}
+
+	bucket := sort.Search(len(s.buckets), func(i int) bool { return wait <= s.buckets[i] })
+	series.counts[bucket]++
+	series.sum += wait
+
+	sample := queueWaitSample{at: now, wait: wait}
+	if len(series.samples) < queueWaitMaxSamples {
+		series.samples = append(series.samples, sample)
+	} else {
+		series.samples[series.next] = sample
+	}
+	series.next = (series.next + 1) % queueWaitMaxSamples
+}
+
+// Stats returns the histogram and summary of every priority class
+func (s *QueueWaitStats) Stats() map[string]QueueWaitPriorityStats {
+	return s.statsAt(time.Now())
+}
+
+func (s *QueueWaitStats) statsAt(now time.Time) map[string]QueueWaitPriorityStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := make(map[string]QueueWaitPriorityStats, len(s.series))
+	for priority, series := range s.series {
+		histogram := LatencyHistogram{
+			Buckets: make([]HistogramBucket, len(s.buckets)),
+			SumMs:   float64(series.sum) / float64(time.Millisecond),
+		}
+		for i, bound := range s.buckets {
+			histogram.Count += series.counts[i]
+			histogram.Buckets[i] = HistogramBucket{LeMs: float64(bound) / float64(time.Millisecond), Count: histogram.Count}
+		}
+		histogram.Count += series.counts[len(s.buckets)]
+
+		waitsUs := []int64{}
+		for _, sample := range series.samples {
+			if now.Sub(sample.at) <= queueWaitSummaryWindow {
+				waitsUs = append(waitsUs, sample.wait.Microseconds())
+			}
+		}
+		summary := QueueWaitSummary{
+			Window:      queueWaitSummaryWindow.String(),
+			NumRequests: len(waitsUs),
+			Us:          Percentiles(waitsUs),
+		}
+
+		res[priority] = QueueWaitPriorityStats{Histogram: histogram, Summary: summary}
+	}
+	return res
+}
+
+// drainRate returns the number of requests of all priorities which were popped per second in the summary window
+func (s *QueueWaitStats) drainRate(now time.Time) (perSec float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, series := range s.series {
+		numPopped, oldest := 0, now
+		for _, sample := range series.samples {
+			if now.Sub(sample.at) <= queueWaitSummaryWindow {
+				numPopped++
+				if sample.at.Before(oldest) {
+					oldest = sample.at
+				}
+			}
+		}
+		span := queueWaitSummaryWindow
+		if len(series.samples) == queueWaitMaxSamples && now.Sub(oldest) < span {
+			span = now.Sub(oldest) // the older samples of the window were dropped
+		}
+		if numPopped > 0 && span > 0 {
+			perSec += float64(numPopped) / span.Seconds()
+		}
+	}
+	return perSec
+}
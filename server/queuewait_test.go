@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueueWaitBuckets(t *testing.T) {
+	require.Equal(t, DefaultQueueWaitBuckets, ParseQueueWaitBuckets(""))
+	require.Equal(t, DefaultQueueWaitBuckets, ParseQueueWaitBuckets("foo,-1"))
+	require.Equal(t, []time.Duration{500 * time.Microsecond, 10 * time.Millisecond, time.Second}, ParseQueueWaitBuckets(" 1000, 10,0.5,x,10"))
+}
+
+func TestQueueWaitStats(t *testing.T) {
+	stats := NewQueueWaitStats([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second})
+	now := time.Now()
+
+	stats.observeAt(PriorityFastTrack, 5*time.Millisecond, now)
+	stats.observeAt(PriorityFastTrack, 10*time.Millisecond, now) // bounds are inclusive
+	stats.observeAt(PriorityHighPrio, 50*time.Millisecond, now)
+	stats.observeAt(PriorityLowPrio, 500*time.Millisecond, now)
+	stats.observeAt(PriorityLowPrio, 2*time.Second, now) // above the largest bucket
+	stats.observeAt(PriorityLowPrio, 3*time.Second, now.Add(-2*time.Minute))
+	stats.observeAt("unknown", time.Second, now)
+
+	res := stats.statsAt(now)
+	require.Equal(t, 3, len(res))
+	bucketCounts := func(priority string) []uint64 {
+		counts := []uint64{}
+		for _, bucket := range res[priority].Histogram.Buckets {
+			counts = append(counts, bucket.Count)
+		}
+		return counts
+	}
+	require.Equal(t, []uint64{2, 2, 2}, bucketCounts(PriorityFastTrack))
+	require.Equal(t, []uint64{0, 1, 1}, bucketCounts(PriorityHighPrio))
+	require.Equal(t, []uint64{0, 0, 1}, bucketCounts(PriorityLowPrio))
+	require.Equal(t, []float64{10, 100, 1000}, []float64{
+		res[PriorityLowPrio].Histogram.Buckets[0].LeMs, res[PriorityLowPrio].Histogram.Buckets[1].LeMs, res[PriorityLowPrio].Histogram.Buckets[2].LeMs,
+	})
+	require.Equal(t, uint64(3), res[PriorityLowPrio].Histogram.Count)
+	require.Equal(t, 5500.0, res[PriorityLowPrio].Histogram.SumMs)
+	require.Equal(t, 15.0, res[PriorityFastTrack].Histogram.SumMs)
+
+	// The summary only covers the last minute
+	lowPrio := res[PriorityLowPrio].Summary
+	require.Equal(t, "1m0s", lowPrio.Window)
+	require.Equal(t, 2, lowPrio.NumRequests)
+	require.Equal(t, LatencyPercentiles{P50: 500_000, P90: 2_000_000, P99: 2_000_000, Max: 2_000_000}, lowPrio.Us)
+	require.Equal(t, int64(5_000), res[PriorityFastTrack].Summary.Us.P50)
+
+	res = stats.statsAt(now.Add(time.Hour))
+	require.Equal(t, 0, res[PriorityLowPrio].Summary.NumRequests)
+	require.Equal(t, uint64(3), res[PriorityLowPrio].Histogram.Count)
+}
+
+func TestQueueWaitStatsMaxSamples(t *testing.T) {
+	stats := NewQueueWaitStats(DefaultQueueWaitBuckets)
+	now := time.Now()
+	for i := 0; i < queueWaitMaxSamples+10; i++ {
+		stats.observeAt(PriorityHighPrio, time.Duration(i)*time.Microsecond, now)
+	}
+	res := stats.statsAt(now)[PriorityHighPrio]
+	require.Equal(t, uint64(queueWaitMaxSamples+10), res.Histogram.Count)
+	require.Equal(t, queueWaitMaxSamples, res.Summary.NumRequests)
+	require.Equal(t, int64(queueWaitMaxSamples+9), res.Summary.Us.Max)
+}
+
+func TestQueueWaitObservedOnPop(t *testing.T) {
+	buckets := []time.Duration{10 * time.Millisecond, 10 * time.Second}
+	newRequest := func(isHighPrio, isFastTrack bool) *SimRequest {
+		req := NewSimRequest(httptest.NewRequest("POST", "/", nil).Context(), "1", []byte("x"), isHighPrio, isFastTrack)
+		req.Tenant = "a"
+		return req
+	}
+
+	tenantQueue, err := NewTenantQueue(testTenants, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	for name, q := range map[string]Queue{"PrioQueue": NewPrioQueue(0, 0, 0, 2, false, PriorityAging{}), "TenantQueue": tenantQueue} {
+		t.Run(name, func(t *testing.T) {
+			stats := NewQueueWaitStats(buckets)
+			q.OnPop(func(r *SimRequest, wait time.Duration) { stats.Observe(r.Priority(), wait) })
+
+			require.True(t, q.Push(newRequest(false, true)))
+			q.Pop()
+			require.True(t, q.Push(newRequest(false, false)))
+			time.Sleep(50 * time.Millisecond)
+			q.Pop()
+
+			res := stats.Stats()
+			require.Equal(t, uint64(1), res[PriorityFastTrack].Histogram.Buckets[0].Count)
+			require.Equal(t, uint64(0), res[PriorityLowPrio].Histogram.Buckets[0].Count)
+			require.Equal(t, uint64(1), res[PriorityLowPrio].Histogram.Buckets[1].Count)
+			require.GreaterOrEqual(t, res[PriorityLowPrio].Summary.Us.P50, int64(50_000))
+			require.Equal(t, uint64(0), res[PriorityHighPrio].Histogram.Count)
+		})
+	}
+}
+
+func TestWebserverQueueStats(t *testing.T) {
+	webserver, _ := newTestWebserver(t, 1)
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	webserver.HandleQueueStatsRequest(rr, httptest.NewRequest("GET", "/stats/queue", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	res := QueueStatsResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	require.Equal(t, 0, res.NumLowPrio)
+	require.Equal(t, uint64(1), res.WaitTimes[PriorityLowPrio].Histogram.Count)
+	require.Equal(t, 1, res.WaitTimes[PriorityLowPrio].Summary.NumRequests)
+	require.Equal(t, len(QueueWaitBuckets), len(res.WaitTimes[PriorityFastTrack].Histogram.Buckets))
+}
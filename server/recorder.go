@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// RecordedRequest is a submitted sim request, recorded to replay the traffic later (i.e. after an incident, against
+// staging nodes)
+type RecordedRequest struct {
+	Timestamp   time.Time       `json:"timestamp"`
+	ReqID       string          `json:"reqID"`
+	Priority    string          `json:"priority"`           // fast-track, high-prio or low-prio
+	ClientID    string          `json:"clientID,omitempty"` // the X-Client-ID header
+	Tenant      string          `json:"tenant,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`    // JSON payloads
+	PayloadRaw  []byte          `json:"payloadRaw,omitempty"` // other payloads (base64 encoded), i.e. in passthrough mode
+}
+
+// Body returns the payload of the request
+func (r RecordedRequest) Body() []byte {
+	if r.PayloadRaw != nil {
+		return r.PayloadRaw
+	}
+	return r.Payload
+}
+
+// RecordingStore persists recorded requests. Implemented by FileRecordingStore and RedisState.
+type RecordingStore interface {
+	SaveRecordedRequest(record RecordedRequest) error
+}
+
+var _ RecordingStore = (*RedisState)(nil)
+
+// FileRecordingStore appends the recorded requests to a file, as newline-delimited JSON
+type FileRecordingStore struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewFileRecordingStore(path string) (*FileRecordingStore, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileRecordingStore{file: file}, nil
+}
+
+func (s *FileRecordingStore) SaveRecordedRequest(record RecordedRequest) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileRecordingStore) Close() error {
+	return s.file.Close()
+}
+
+// ReadRecordedRequests reads the requests of a recording (newline-delimited JSON, as written by FileRecordingStore)
+func ReadRecordedRequests(r io.Reader) (records []RecordedRequest, err error) {
+	decoder := json.NewDecoder(r)
+	for decoder.More() {
+		var record RecordedRequest
+		if err := decoder.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// RecorderStats are the counters of a RequestRecorder
+type RecorderStats struct {
+	NumWritten int64 `json:"numWritten"`
+	NumDropped int64 `json:"numDropped"` // dropped because the buffer was full
+	NumFailed  int64 `json:"numFailed"`  // failed writes to the store
+}
+
+// RequestRecorder writes the submitted requests to a RecordingStore in the background. Requests are dropped (and
+// counted) if the buffer is full, so that recording never delays the request.
+type RequestRecorder struct {
+	log     *zap.SugaredLogger
+	store   RecordingStore
+	records chan RecordedRequest
+	wg      sync.WaitGroup
+
+	lock       sync.RWMutex // protects closing the records channel
+	closed     bool
+	numWritten atomic.Int64
+	numDropped atomic.Int64
+	numFailed  atomic.Int64
+}
+
+func NewRequestRecorder(log *zap.SugaredLogger, store RecordingStore, bufferSize int) *RequestRecorder {
+	recorder := &RequestRecorder{
+		log:     log,
+		store:   store,
+		records: make(chan RecordedRequest, bufferSize),
+	}
+	recorder.wg.Add(1)
+	go recorder.run()
+	return recorder
+}
+
+func (recorder *RequestRecorder) run() {
+	defer recorder.wg.Done()
+	for record := range recorder.records {
+		if err := recorder.store.SaveRecordedRequest(record); err != nil {
+			recorder.numFailed.Inc()
+			recorder.log.Debugw("Saving recorded request failed", "reqID", record.ReqID, "error", err)
+			continue
+		}
+		recorder.numWritten.Inc()
+	}
+}
+
+// Record queues a submitted request (with the payload), timestamped now. Batches are recorded as one request.
+func (recorder *RequestRecorder) Record(record RecordedRequest, payload Payload) {
+	if recorder == nil {
+		return
+	}
+
+	record.Timestamp = time.Now().UTC()
+	body, err := payload.Bytes()
+	if err != nil {
+		recorder.numFailed.Inc()
+		return
+	}
+	if json.Valid(body) {
+		record.Payload = body
+	} else {
+		record.PayloadRaw = body
+	}
+
+	recorder.lock.RLock()
+	defer recorder.lock.RUnlock()
+	if recorder.closed {
+		recorder.numDropped.Inc()
+		return
+	}
+	select {
+	case recorder.records <- record:
+	default:
+		recorder.numDropped.Inc()
+	}
+}
+
+func (recorder *RequestRecorder) Stats() RecorderStats {
+	return RecorderStats{
+		NumWritten: recorder.numWritten.Load(),
+		NumDropped: recorder.numDropped.Load(),
+		NumFailed:  recorder.numFailed.Load(),
+	}
+}
+
+// Close writes the buffered requests, stops the recorder and closes the store (if it is an io.Closer). Requests
+// recorded afterwards are dropped.
+func (recorder *RequestRecorder) Close() {
+	if recorder == nil {
+		return
+	}
+	recorder.lock.Lock()
+	wasClosed := recorder.closed
+	if !wasClosed {
+		recorder.closed = true
+		close(recorder.records)
+	}
+	recorder.lock.Unlock()
+	recorder.wg.Wait()
+
+	if closer, ok := recorder.store.(io.Closer); ok && !wasClosed {
+		if err := closer.Close(); err != nil {
+			recorder.log.Errorw("Closing the recording store failed", "error", err)
+		}
+	}
+}
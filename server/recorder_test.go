@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type failingRecordingStore struct{}
+
+func (failingRecordingStore) SaveRecordedRequest(record RecordedRequest) error {
+	return errors.New("failed")
+}
+
+func TestWebserverRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	store, err := NewFileRecordingStore(path)
+	require.Nil(t, err, err)
+	recorder := NewRequestRecorder(testLog, store, 10)
+	webserver, _ := newTestWebserver(t, 1)
+	webserver.EnableRecording(recorder)
+
+	send := func(body string, headers map[string]string) {
+		req := newSimTestRequest(body)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	send(`{"id":1}`, nil)
+	send(`{"id":2}`, map[string]string{"X-High-Priority": "true", "X-Client-ID": "alice"})
+	send(`{"id":3}`, map[string]string{"X-Fast-Track": "true", "Content-Type": "application/json"})
+	send(`not json`, nil)
+	recorder.Close()
+	recorder.Close() // closing twice is fine
+	require.Equal(t, RecorderStats{NumWritten: 4}, recorder.Stats())
+
+	content, err := os.ReadFile(path)
+	require.Nil(t, err, err)
+	require.Equal(t, 4, strings.Count(string(content), "\n"))
+	records, err := ReadRecordedRequests(bytes.NewReader(content))
+	require.Nil(t, err, err)
+	require.Equal(t, 4, len(records))
+
+	require.Equal(t, "test-req", records[0].ReqID)
+	require.Equal(t, PriorityLowPrio, records[0].Priority)
+	require.Equal(t, `{"id":1}`, string(records[0].Body()))
+	require.Equal(t, PriorityHighPrio, records[1].Priority)
+	require.Equal(t, "alice", records[1].ClientID)
+	require.Equal(t, PriorityFastTrack, records[2].Priority)
+	require.Equal(t, "application/json", records[2].ContentType)
+	require.Nil(t, records[3].Payload)
+	require.Equal(t, "not json", string(records[3].Body()))
+	for i := 1; i < len(records); i++ {
+		require.False(t, records[i].Timestamp.Before(records[i-1].Timestamp))
+	}
+
+	// Appended to an existing file
+	store, err = NewFileRecordingStore(path)
+	require.Nil(t, err, err)
+	require.Nil(t, store.SaveRecordedRequest(RecordedRequest{ReqID: "another"}))
+	require.Nil(t, store.Close())
+	file, err := os.Open(path)
+	require.Nil(t, err, err)
+	defer file.Close()
+	records, err = ReadRecordedRequests(file)
+	require.Nil(t, err, err)
+	require.Equal(t, 5, len(records))
+	require.Equal(t, "another", records[4].ReqID)
+
+	_, err = ReadRecordedRequests(strings.NewReader(`{"reqID":"1"}` + "\n{"))
+	require.NotNil(t, err)
+}
+
+func TestRequestRecorderFailures(t *testing.T) {
+	recorder := NewRequestRecorder(testLog, failingRecordingStore{}, 10)
+	recorder.Record(RecordedRequest{ReqID: "1"}, BytesPayload("{}"))
+	recorder.Close()
+	recorder.Record(RecordedRequest{ReqID: "2"}, BytesPayload("{}")) // after closing
+	require.Equal(t, RecorderStats{NumDropped: 1, NumFailed: 1}, recorder.Stats())
+
+	// A nil recorder is disabled
+	var nilRecorder *RequestRecorder
+	nilRecorder.Record(RecordedRequest{ReqID: "1"}, BytesPayload("{}"))
+	nilRecorder.Close()
+}
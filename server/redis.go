@@ -1,51 +1,830 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
-var RedisKeyNodes = RedisPrefix + "prio-load-balancer:nodes"
+// DefaultRedisPrefix is the default key prefix (REDIS_PREFIX)
+const DefaultRedisPrefix = "prio-load-balancer:"
 
+// Names of the keys, which are prefixed with the key prefix of the RedisState
+const (
+	RedisKeySchemaVersion      = "prio-load-balancer:schema-version" // see Migrate, missing before version 2
+	RedisKeyMigrationLock      = "prio-load-balancer:migration-lock" // held while running the migrations
+	RedisKeyNodes              = "prio-load-balancer:nodes"          // JSON list of node URIs of schema version 1
+	RedisKeyNodeIndex          = "prio-load-balancer:node-index"     // set of the normalized URIs of the nodes
+	RedisKeyNodePrefix         = "prio-load-balancer:node:"          // followed by the normalized URI, hash with the fields of a NodeEntry
+	RedisKeyTenants            = "prio-load-balancer:tenants"
+	RedisKeyAuditPrefix        = "prio-load-balancer:audit:"         // followed by the request ID
+	RedisKeyReservationPrefix  = "prio-load-balancer:reservation:"   // followed by the client ID, JSON of a FastTrackReservation
+	RedisKeyRecording          = "prio-load-balancer:recording"      // stream of the recorded requests, with the JSON of a RecordedRequest in the "record" field
+	RedisKeyQueuedRequests     = "prio-load-balancer:queued"         // hash of the persisted queued requests (JSON of a PersistedRequest) by tenant and ID
+	RedisKeyAsyncResultPrefix  = "prio-load-balancer:async-result:"  // followed by the tenant and request ID (see queuedRequestField), the result of an async request
+	RedisKeyAsyncPendingPrefix = "prio-load-balancer:async-pending:" // followed by the tenant and request ID, set while an async request is pending
+)
+
+// redisKeys are the string keys of the state, which are copied by MigrateKeys together with the node hashes (not the
+// audit records, which expire)
+var redisKeys = []string{RedisKeySchemaVersion, RedisKeyNodes, RedisKeyTenants}
+
+// ErrRedisDegraded is returned for reads which are not possible while redis is unavailable
+var ErrRedisDegraded = errors.New("redis unavailable (degraded mode)")
+
+// RedisState stores the node list and tenants in redis. If redis is unavailable (after retries), it switches to
+// degraded mode: writes are queued and replayed when redis is available again (see RunReplay), so that the server
+// can keep serving with its in-memory state.
 type RedisState struct {
-	RedisClient *redis.Client
+	RedisClient redis.UniversalClient
+	log         *zap.SugaredLogger
+	keyPrefix   string
+
+	lock          sync.Mutex
+	degraded      bool
+	pendingWrites map[string][]byte     // latest value of the keys which couldn't be written while degraded
+	pendingNodes  map[string]*NodeEntry // same for the nodes (by normalized URI), nil to delete the node
+	onRecovered   []func()
+}
+
+// RedisConnConfig are the credentials and TLS options, applied on top of the redis URI
+type RedisConnConfig struct {
+	Username string // (optional) ACL username, overrides the one of the URI
+	Password string // (optional) overrides the password of the URI
+	DB       int    // (optional) overrides the DB of the URI if not 0 (clusters only have DB 0)
+
+	SentinelPassword string // (optional) password for the sentinels, overrides the sentinelPassword of the URI
+
+	TLS                   bool   // use TLS (implied by rediss:// URIs and the other TLS options)
+	TLSCAFile             string // (optional) CA certificate(s) to verify the server, instead of the system roots
+	TLSCertFile           string // (optional) client certificate, together with TLSKeyFile
+	TLSKeyFile            string // (optional) client key, together with TLSCertFile
+	TLSInsecureSkipVerify bool   // don't verify the server certificate (only for development)
+
+	KeyPrefix string // all keys are prefixed with this, to share a redis instance between multiple load balancers
+
+	AllowDegradedStart bool // if redis is unreachable at startup, start in degraded mode instead of failing
+}
+
+// RedisConnConfigFromEnv returns the RedisConnConfig of the REDIS_USERNAME, REDIS_PASSWORD, REDIS_DB,
+// REDIS_SENTINEL_PASSWORD, REDIS_TLS* and REDIS_PREFIX env vars
+func RedisConnConfigFromEnv() RedisConnConfig {
+	return RedisConnConfig{
+		Username:              RedisUsername,
+		Password:              RedisPassword,
+		DB:                    RedisDB,
+		SentinelPassword:      RedisSentinelPassword,
+		TLS:                   RedisTLS,
+		TLSCAFile:             RedisTLSCAFile,
+		TLSCertFile:           RedisTLSCertFile,
+		TLSKeyFile:            RedisTLSKeyFile,
+		TLSInsecureSkipVerify: RedisTLSInsecureSkipVerify,
+		KeyPrefix:             RedisPrefix,
+	}
+}
+
+// apply sets the credentials, and loads the TLS files so that a misconfiguration is detected at startup
+func (c RedisConnConfig) apply(opts *redis.UniversalOptions) error {
+	if c.Username != "" {
+		opts.Username = c.Username
+	}
+	if c.Password != "" {
+		opts.Password = c.Password
+	}
+	if c.SentinelPassword != "" {
+		opts.SentinelPassword = c.SentinelPassword
+	}
+	if c.DB != 0 {
+		if opts.MasterName == "" && len(opts.Addrs) > 1 {
+			return errors.New("redis clusters don't support databases other than 0")
+		}
+		opts.DB = c.DB
+	}
+
+	useTLS := c.TLS || c.TLSCAFile != "" || c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSInsecureSkipVerify
+	if !useTLS && opts.TLSConfig == nil {
+		return nil
+	}
+	if opts.TLSConfig == nil {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	opts.TLSConfig.InsecureSkipVerify = c.TLSInsecureSkipVerify //nolint:gosec
+
+	if c.TLSCAFile != "" {
+		caCerts, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read redis TLS CA file")
+		}
+		opts.TLSConfig.RootCAs = x509.NewCertPool()
+		if !opts.TLSConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return errors.Errorf("no certificates found in redis TLS CA file %s", c.TLSCAFile)
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("redis TLS client certificate and key must be set together")
+	} else if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to load redis TLS client certificate")
+		}
+		opts.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	return nil
 }
 
-func NewRedisState(redisURI string) (*RedisState, error) {
-	redisClient := redis.NewClient(&redis.Options{Addr: redisURI})
-	if err := redisClient.Get(context.Background(), "somekey").Err(); err != nil && err != redis.Nil {
+// NewRedisState connects to a single redis instance, a sentinel-managed master or a cluster, depending on the URI
+// (see ParseRedisURI). Fails if redis is not reachable with the given credentials and TLS config, unless
+// cfg.AllowDegradedStart is set and redis just isn't reachable.
+func NewRedisState(log *zap.SugaredLogger, redisURI string, cfg RedisConnConfig) (*RedisState, error) {
+	opts, err := ParseRedisURI(redisURI)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.apply(opts); err != nil {
+		return nil, err
+	}
+	state := &RedisState{
+		RedisClient:   redis.NewUniversalClient(opts),
+		log:           log,
+		keyPrefix:     cfg.KeyPrefix,
+		pendingWrites: make(map[string][]byte),
+		pendingNodes:  make(map[string]*NodeEntry),
+	}
+
+	err = state.RedisClient.Get(context.Background(), "somekey").Err()
+	if err == nil || err == redis.Nil {
+		return state, nil
+	}
+
+	// Errors returned by redis (i.e. wrong credentials) are misconfigurations, not unavailability
+	var redisErr redis.Error
+	if !cfg.AllowDegradedStart || errors.As(err, &redisErr) {
+		state.RedisClient.Close()
 		return nil, errors.Wrap(err, "redis init error")
 	}
-	return &RedisState{
-		RedisClient: redisClient,
-	}, nil
+	log.Warnw("Redis unavailable, starting in degraded mode", "error", err)
+	state.degraded = true
+	return state, nil
+}
+
+// key returns the full name of a key, with the key prefix
+func (s *RedisState) key(name string) string {
+	return s.keyPrefix + name
+}
+
+// MigrateKeys copies the keys of the state with fromPrefix to the key prefix of this state, unless they already
+// exist (so it only has an effect on the first start with a new prefix). Returns the names of the copied keys.
+func (s *RedisState) MigrateKeys(fromPrefix string) (migrated []string, err error) {
+	if fromPrefix == s.keyPrefix {
+		return nil, nil
+	}
+
+	for _, name := range redisKeys {
+		value, err := s.get(fromPrefix + name)
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return migrated, err
+		}
+
+		var isSet bool
+		err = s.withRetry(func(ctx context.Context) (err error) {
+			isSet, err = s.RedisClient.SetNX(ctx, s.key(name), value, 0).Result()
+			return err
+		})
+		if err != nil {
+			return migrated, err
+		} else if isSet {
+			migrated = append(migrated, s.key(name))
+		}
+	}
+
+	var nodeURIs []string
+	err = s.withRetry(func(ctx context.Context) (err error) {
+		nodeURIs, err = s.RedisClient.SMembers(ctx, fromPrefix+RedisKeyNodeIndex).Result()
+		return err
+	})
+	if err != nil {
+		return migrated, err
+	}
+	sort.Strings(nodeURIs)
+	for _, uri := range nodeURIs {
+		key := s.key(RedisKeyNodePrefix + uri)
+		err = s.withRetry(func(ctx context.Context) error {
+			if n, err := s.RedisClient.Exists(ctx, key).Result(); err != nil || n > 0 {
+				return err
+			}
+			fields, err := s.RedisClient.HGetAll(ctx, fromPrefix+RedisKeyNodePrefix+uri).Result()
+			if err != nil || len(fields) == 0 {
+				return err
+			}
+			if err := s.RedisClient.HMSet(ctx, key, fields).Err(); err != nil {
+				return err
+			}
+			migrated = append(migrated, key)
+			return s.RedisClient.SAdd(ctx, s.key(RedisKeyNodeIndex), uri).Err()
+		})
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
 }
 
-func (s *RedisState) SaveNodes(nodeUris []string) error {
-	msg, err := json.Marshal(nodeUris)
+// ParseRedisURI returns the client options for a redis URI:
+//
+//   - "host:port" or "redis://[user:password@]host:port[/db]" for a single instance
+//   - "redis-sentinel://[user:password@]host1:port,host2:port/masterName[?db=N&sentinelPassword=...]" for a
+//     sentinel-managed master (the credentials are used for the master)
+//   - "redis-cluster://[user:password@]host1:port,host2:port" for a cluster
+//
+// The schemes rediss://, rediss-sentinel:// and rediss-cluster:// use TLS.
+func ParseRedisURI(redisURI string) (*redis.UniversalOptions, error) {
+	scheme, _, found := strings.Cut(redisURI, "://")
+	if !found {
+		return &redis.UniversalOptions{Addrs: []string{redisURI}}, nil
+	}
+
+	if scheme == "redis" || scheme == "rediss" {
+		opts, err := redis.ParseURL(redisURI)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid redis URI")
+		}
+		return &redis.UniversalOptions{
+			Addrs:     []string{opts.Addr},
+			Username:  opts.Username,
+			Password:  opts.Password,
+			DB:        opts.DB,
+			TLSConfig: opts.TLSConfig,
+		}, nil
+	}
+
+	u, err := url.Parse(redisURI)
 	if err != nil {
+		return nil, errors.Wrap(err, "invalid redis URI")
+	}
+	if u.Host == "" {
+		return nil, errors.New("invalid redis URI: no addresses")
+	}
+
+	opts := &redis.UniversalOptions{Addrs: strings.Split(u.Host, ",")}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	query := u.Query()
+
+	if strings.HasPrefix(scheme, "rediss-") {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		scheme = "redis-" + strings.TrimPrefix(scheme, "rediss-")
+	}
+
+	switch scheme {
+	case "redis-sentinel":
+		opts.MasterName = strings.Trim(u.Path, "/")
+		if opts.MasterName == "" {
+			return nil, errors.New("invalid redis URI: no sentinel master name")
+		}
+		opts.SentinelPassword = query.Get("sentinelPassword")
+		if db := query.Get("db"); db != "" {
+			opts.DB, err = strconv.Atoi(db)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid redis URI db")
+			}
+		}
+	case "redis-cluster":
+		if len(opts.Addrs) == 1 {
+			// NewUniversalClient only creates a cluster client for multiple addresses
+			opts.Addrs = append(opts.Addrs, opts.Addrs[0])
+		}
+	default:
+		return nil, errors.Errorf("invalid redis URI scheme: %s", scheme)
+	}
+	return opts, nil
+}
+
+// RedactRedisURI removes the password from the URI, for logging
+func RedactRedisURI(redisURI string) string {
+	u, err := url.Parse(redisURI)
+	if err != nil || u.User == nil {
+		return redisURI
+	}
+	return u.Redacted()
+}
+
+// withRetry runs op, retrying errors with a linear backoff (i.e. while a failover is in progress). redis.Nil is
+// returned without retrying.
+func (s *RedisState) withRetry(op func(ctx context.Context) error) (err error) {
+	for i := 0; ; i++ {
+		err = op(context.Background())
+		if err == nil || err == redis.Nil || i >= RedisMaxRetries {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * RedisRetryBackoff)
+	}
+}
+
+// set writes the key, or queues the write for replay if redis is unavailable (entering degraded mode)
+func (s *RedisState) set(key string, value []byte) error {
+	return s.writeOrQueue(key, func(ctx context.Context) error {
+		return s.RedisClient.Set(ctx, key, value, 0).Err()
+	}, func() {
+		s.pendingWrites[key] = value
+	})
+}
+
+// writeOrQueue runs write (with retries), or calls queue (with the lock held) if redis is unavailable, entering
+// degraded mode
+func (s *RedisState) writeOrQueue(key string, write func(ctx context.Context) error, queue func()) error {
+	s.lock.Lock()
+	if s.degraded {
+		queue()
+		s.lock.Unlock()
+		return nil
+	}
+	s.lock.Unlock()
+
+	err := s.withRetry(write)
+	if err == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	s.degraded = true
+	queue()
+	s.lock.Unlock()
+	s.log.Warnw("Redis unavailable, entering degraded mode. The write is replayed when redis is available again.", "key", key, "error", err)
+	return nil
+}
+
+// get reads the key. While degraded, only keys with a pending write can be read.
+func (s *RedisState) get(key string) (res string, err error) {
+	s.lock.Lock()
+	if value, found := s.pendingWrites[key]; found {
+		s.lock.Unlock()
+		return string(value), nil
+	} else if s.degraded {
+		s.lock.Unlock()
+		return "", ErrRedisDegraded
+	}
+	s.lock.Unlock()
+
+	err = s.withRetry(func(ctx context.Context) error {
+		res, err = s.RedisClient.Get(ctx, key).Result()
 		return err
+	})
+	return res, err
+}
+
+// Status returns whether redis is unavailable, and the number of writes waiting for replay
+func (s *RedisState) Status() (degraded bool, numPendingWrites int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.degraded, len(s.pendingWrites) + len(s.pendingNodes)
+}
+
+// IsDegraded returns true if redis is unavailable
+func (s *RedisState) IsDegraded() bool {
+	degraded, _ := s.Status()
+	return degraded
+}
+
+// OnRecovered registers f to be called once, after leaving degraded mode
+func (s *RedisState) OnRecovered(f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onRecovered = append(s.onRecovered, f)
+}
+
+// replay writes the pending writes if redis is available again, and leaves degraded mode once all are written.
+// Writes always contain the full value of a key, so writing one again (i.e. after a partial replay) is harmless.
+func (s *RedisState) replay() (recovered bool) {
+	s.lock.Lock()
+	if !s.degraded {
+		s.lock.Unlock()
+		return false
+	}
+	pending := make(map[string][]byte, len(s.pendingWrites))
+	keys := make([]string, 0, len(s.pendingWrites))
+	for key, value := range s.pendingWrites {
+		pending[key] = value
+		keys = append(keys, key)
+	}
+	pendingNodes := make(map[string]*NodeEntry, len(s.pendingNodes))
+	nodeURIs := make([]string, 0, len(s.pendingNodes))
+	for uri, node := range s.pendingNodes {
+		pendingNodes[uri] = node
+		nodeURIs = append(nodeURIs, uri)
+	}
+	s.lock.Unlock()
+	sort.Strings(keys)
+	sort.Strings(nodeURIs)
+
+	ctx := context.Background()
+	if err := s.RedisClient.Ping(ctx).Err(); err != nil {
+		s.log.Debugw("Redis still unavailable", "error", err)
+		return false
+	}
+	for _, key := range keys {
+		if err := s.RedisClient.Set(ctx, key, pending[key], 0).Err(); err != nil {
+			s.log.Debugw("Redis replay failed", "key", key, "error", err)
+			return false
+		}
+		s.lock.Lock()
+		if bytes.Equal(s.pendingWrites[key], pending[key]) { // unless written again in the meantime
+			delete(s.pendingWrites, key)
+		}
+		s.lock.Unlock()
+	}
+	for _, uri := range nodeURIs {
+		if err := s.writeNode(ctx, uri, pendingNodes[uri]); err != nil {
+			s.log.Debugw("Redis replay failed", "node", uri, "error", err)
+			return false
+		}
+		s.lock.Lock()
+		if s.pendingNodes[uri] == pendingNodes[uri] { // unless written again in the meantime
+			delete(s.pendingNodes, uri)
+		}
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	if len(s.pendingWrites) > 0 || len(s.pendingNodes) > 0 { // new writes during the replay, which are written in the next round
+		s.lock.Unlock()
+		return false
 	}
-	err = s.RedisClient.Set(context.Background(), RedisKeyNodes, msg, 0).Err()
-	return err
+	s.degraded = false
+	callbacks := s.onRecovered
+	s.onRecovered = nil
+	s.lock.Unlock()
+
+	s.log.Infow("Redis available again, leaving degraded mode", "numReplayedWrites", len(keys)+len(nodeURIs))
+	for _, f := range callbacks {
+		f()
+	}
+	return true
+}
+
+// RunReplay tries to replay the pending writes every interval while degraded, until ctx is cancelled
+func (s *RedisState) RunReplay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.replay()
+		}
+	}
+}
+
+// writeNode writes the hash of the node and adds it to the index, or deletes both if node is nil
+func (s *RedisState) writeNode(ctx context.Context, uri string, node *NodeEntry) error {
+	if node == nil {
+		if err := s.RedisClient.Del(ctx, s.key(RedisKeyNodePrefix+uri)).Err(); err != nil {
+			return err
+		}
+		return s.RedisClient.SRem(ctx, s.key(RedisKeyNodeIndex), uri).Err()
+	}
+
+	headers := "" // JSON, empty without headers (which overwrites the headers of an updated node)
+	if len(node.Headers) > 0 {
+		data, err := json.Marshal(node.Headers)
+		if err != nil {
+			return err
+		}
+		headers = string(data)
+	}
+	fields := map[string]interface{}{
+		"uri":     node.URI,
+		"workers": node.Workers,
+		"addedAt": node.AddedAt.UTC().Format(time.RFC3339Nano),
+		"headers": headers,
+	}
+	if err := s.RedisClient.HMSet(ctx, s.key(RedisKeyNodePrefix+uri), fields).Err(); err != nil {
+		return err
+	}
+	return s.RedisClient.SAdd(ctx, s.key(RedisKeyNodeIndex), uri).Err()
+}
+
+// nodeEntryFromHash returns the entry of the fields of a node hash
+func nodeEntryFromHash(fields map[string]string) (node NodeEntry, err error) {
+	node.URI = fields["uri"]
+	if workers := fields["workers"]; workers != "" {
+		n, err := strconv.ParseInt(workers, 10, 32)
+		if err != nil {
+			return node, errors.Wrapf(err, "invalid workers of node %s", node.URI)
+		}
+		node.Workers = int32(n)
+	}
+	if addedAt := fields["addedAt"]; addedAt != "" {
+		node.AddedAt, err = time.Parse(time.RFC3339Nano, addedAt)
+		if err != nil {
+			return node, errors.Wrapf(err, "invalid addedAt of node %s", node.URI)
+		}
+	}
+	if headers := fields["headers"]; headers != "" {
+		if err := json.Unmarshal([]byte(headers), &node.Headers); err != nil {
+			return node, errors.Wrapf(err, "invalid headers of node %s", node.URI)
+		}
+	}
+	return node, nil
+}
+
+// SaveNode writes the hash of the node, or queues it for replay if redis is unavailable
+func (s *RedisState) SaveNode(node NodeEntry) error {
+	uri := NormalizeNodeURI(node.URI)
+	return s.writeOrQueue(s.key(RedisKeyNodePrefix+uri), func(ctx context.Context) error {
+		return s.writeNode(ctx, uri, &node)
+	}, func() {
+		s.pendingNodes[uri] = &node
+	})
+}
+
+// DeleteNode deletes the hash of the node, or queues it for replay if redis is unavailable
+func (s *RedisState) DeleteNode(uri string) error {
+	uri = NormalizeNodeURI(uri)
+	return s.writeOrQueue(s.key(RedisKeyNodePrefix+uri), func(ctx context.Context) error {
+		return s.writeNode(ctx, uri, nil)
+	}, func() {
+		s.pendingNodes[uri] = nil
+	})
 }
 
-func (s *RedisState) GetNodes() (nodeUris []string, err error) {
-	res, err := s.RedisClient.Get(context.Background(), RedisKeyNodes).Result()
+// GetNodes returns the nodes in the order they were added. Not possible while degraded, because the pending writes
+// only contain the changed nodes.
+func (s *RedisState) GetNodes() (nodes []NodeEntry, err error) {
+	if s.IsDegraded() {
+		return nil, ErrRedisDegraded
+	}
+
+	var hashes []map[string]string
+	err = s.withRetry(func(ctx context.Context) error {
+		hashes = nil
+		nodeURIs, err := s.RedisClient.SMembers(ctx, s.key(RedisKeyNodeIndex)).Result()
+		if err != nil {
+			return err
+		}
+		for _, uri := range nodeURIs {
+			fields, err := s.RedisClient.HGetAll(ctx, s.key(RedisKeyNodePrefix+uri)).Result()
+			if err != nil {
+				return err
+			} else if len(fields) > 0 { // unless deleted in the meantime
+				hashes = append(hashes, fields)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fields := range hashes {
+		node, err := nodeEntryFromHash(fields)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if !nodes[i].AddedAt.Equal(nodes[j].AddedAt) {
+			return nodes[i].AddedAt.Before(nodes[j].AddedAt)
+		}
+		return nodes[i].URI < nodes[j].URI
+	})
+	return nodes, nil
+}
+
+func (s *RedisState) SaveTenants(tenants []TenantConfig) error {
+	msg, err := json.Marshal(tenants)
+	if err != nil {
+		return err
+	}
+	return s.set(s.key(RedisKeyTenants), msg)
+}
+
+// GetTenants returns the tenant configs, or nil if none were saved
+func (s *RedisState) GetTenants() (tenants []TenantConfig, err error) {
+	res, err := s.get(s.key(RedisKeyTenants))
 	if err != nil {
 		if err == redis.Nil {
-			return nodeUris, nil
+			return nil, nil
 		}
 		return nil, err
 	}
 
-	err = json.Unmarshal([]byte(res), &nodeUris)
+	err = json.Unmarshal([]byte(res), &tenants)
+	return tenants, err
+}
+
+// SaveAuditRecord saves the audit record, which expires after ttl. Not queued for replay in degraded mode.
+func (s *RedisState) SaveAuditRecord(record AuditRecord, ttl time.Duration) error {
+	msg, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.RedisClient.Set(context.Background(), s.key(RedisKeyAuditPrefix+record.ReqID), msg, ttl).Err()
+}
+
+// SaveRecordedRequest appends the request to the recording stream, which is capped at about RecordRedisMaxLen
+// entries. Not queued for replay in degraded mode.
+func (s *RedisState) SaveRecordedRequest(record RecordedRequest) error {
+	msg, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.RedisClient.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: s.key(RedisKeyRecording),
+		MaxLen: int64(RecordRedisMaxLen),
+		Approx: true,
+		Values: map[string]interface{}{"record": msg},
+	}).Err()
+}
+
+// GetAuditRecord returns the audit record of the request, or nil if there is none (or it expired)
+func (s *RedisState) GetAuditRecord(reqID string) (record *AuditRecord, err error) {
+	res, err := s.RedisClient.Get(context.Background(), s.key(RedisKeyAuditPrefix+reqID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	record = &AuditRecord{}
+	err = json.Unmarshal([]byte(res), record)
+	return record, err
+}
+
+// SaveReservation saves the fast-track reservation of its client, which expires at its ExpiresAt. Not queued for
+// replay in degraded mode.
+func (s *RedisState) SaveReservation(reservation FastTrackReservation) error {
+	msg, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+	return s.withRetry(func(ctx context.Context) error {
+		return s.RedisClient.Set(ctx, s.key(RedisKeyReservationPrefix+reservation.ClientID), msg, time.Until(reservation.ExpiresAt)).Err()
+	})
+}
+
+// DeleteReservation deletes the fast-track reservation of the client (no-op if there is none)
+func (s *RedisState) DeleteReservation(clientID string) error {
+	return s.withRetry(func(ctx context.Context) error {
+		return s.RedisClient.Del(ctx, s.key(RedisKeyReservationPrefix+clientID)).Err()
+	})
+}
+
+// GetReservations returns the fast-track reservations which didn't expire yet
+func (s *RedisState) GetReservations() (reservations []FastTrackReservation, err error) {
+	var values []interface{}
+	err = s.withRetry(func(ctx context.Context) error {
+		var keys []string
+		iter := s.RedisClient.Scan(ctx, 0, s.key(RedisKeyReservationPrefix)+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil || len(keys) == 0 {
+			return err
+		}
+		values, err = s.RedisClient.MGet(ctx, keys...).Result()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return nodeUris, nil
+	for _, value := range values {
+		msg, ok := value.(string)
+		if !ok { // expired since the scan
+			continue
+		}
+		var reservation FastTrackReservation
+		if err := json.Unmarshal([]byte(msg), &reservation); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+	return reservations, nil
+}
+
+// queuedRequestField is the field of a persisted request in the hash, unique per tenant
+func queuedRequestField(tenant, id string) string {
+	return tenant + "\x00" + id
+}
+
+// SaveQueuedRequest persists the queued request. Not queued for replay in degraded mode.
+func (s *RedisState) SaveQueuedRequest(r PersistedRequest) error {
+	msg, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.withRetry(func(ctx context.Context) error {
+		return s.RedisClient.HSet(ctx, s.key(RedisKeyQueuedRequests), queuedRequestField(r.Tenant, r.ID), msg).Err()
+	})
+}
+
+// DeleteQueuedRequest deletes the persisted request (no-op if there is none)
+func (s *RedisState) DeleteQueuedRequest(tenant, id string) error {
+	return s.withRetry(func(ctx context.Context) error {
+		return s.RedisClient.HDel(ctx, s.key(RedisKeyQueuedRequests), queuedRequestField(tenant, id)).Err()
+	})
+}
+
+// GetQueuedRequests returns the persisted requests, in the order they were created
+func (s *RedisState) GetQueuedRequests() (requests []PersistedRequest, err error) {
+	var values map[string]string
+	err = s.withRetry(func(ctx context.Context) error {
+		values, err = s.RedisClient.HGetAll(ctx, s.key(RedisKeyQueuedRequests)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for field, value := range values {
+		var r PersistedRequest
+		if err := json.Unmarshal([]byte(value), &r); err != nil {
+			return nil, errors.Wrapf(err, "invalid persisted request %q", field)
+		}
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].CreatedAt.Before(requests[j].CreatedAt) })
+	return requests, nil
+}
+
+// SaveAsyncPending marks the async request as pending until its result is saved, or ttl passed. Not queued for replay
+// in degraded mode, like the results.
+func (s *RedisState) SaveAsyncPending(tenant, id string, ttl time.Duration) error {
+	return s.withRetry(func(ctx context.Context) error {
+		return s.RedisClient.Set(ctx, s.key(RedisKeyAsyncPendingPrefix+queuedRequestField(tenant, id)), "1", ttl).Err()
+	})
+}
+
+// DeleteAsyncPending removes the pending marker of the async request
+func (s *RedisState) DeleteAsyncPending(tenant, id string) error {
+	return s.withRetry(func(ctx context.Context) error {
+		return s.RedisClient.Del(ctx, s.key(RedisKeyAsyncPendingPrefix+queuedRequestField(tenant, id))).Err()
+	})
+}
+
+// SaveAsyncResult saves the result of the async request, which expires after ttl, and removes its pending marker. Not
+// queued for replay in degraded mode.
+func (s *RedisState) SaveAsyncResult(tenant, id string, result SimsResponseEntry, ttl time.Duration) error {
+	msg, err := json.Marshal(storedAsyncResult{SimsResponseEntry: result, Payload: result.Payload})
+	if err != nil {
+		return err
+	}
+	return s.withRetry(func(ctx context.Context) error {
+		_, err := s.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.key(RedisKeyAsyncResultPrefix+queuedRequestField(tenant, id)), msg, ttl)
+			pipe.Del(ctx, s.key(RedisKeyAsyncPendingPrefix+queuedRequestField(tenant, id)))
+			return nil
+		})
+		return err
+	})
+}
+
+// TakeAsyncResult returns the result of the async request and deletes it, or nil if there is none (or it expired).
+// Without result, pending is true while the request is marked as pending.
+func (s *RedisState) TakeAsyncResult(tenant, id string) (result *SimsResponseEntry, pending bool, err error) {
+	key := s.key(RedisKeyAsyncResultPrefix + queuedRequestField(tenant, id))
+	var get *redis.StringCmd
+	var exists *redis.IntCmd
+	err = s.withRetry(func(ctx context.Context) error {
+		_, err := s.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			get = pipe.Get(ctx, key)
+			pipe.Del(ctx, key)
+			exists = pipe.Exists(ctx, s.key(RedisKeyAsyncPendingPrefix+queuedRequestField(tenant, id)))
+			return nil
+		})
+		return err
+	})
+	if err == redis.Nil {
+		return nil, exists.Val() > 0, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var stored storedAsyncResult
+	if err := json.Unmarshal([]byte(get.Val()), &stored); err != nil {
+		return nil, false, err
+	}
+	stored.SimsResponseEntry.Payload = stored.Payload
+	return &stored.SimsResponseEntry, false, nil
 }
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// RedisMigration changes the layout of the keys from Version-1 to Version. Migrations run once, in order, and must be
+// safe to run again after a failure (the version is only updated after a migration succeeded).
+type RedisMigration struct {
+	Version int
+	Name    string
+	Migrate func(s *RedisState) error
+}
+
+// redisMigrations are all migrations, ordered by version. Version 1 is the layout before schema versions existed.
+var redisMigrations = []RedisMigration{
+	{Version: 2, Name: "node hashes", Migrate: migrateNodeHashes},
+}
+
+// RedisSchemaVersion is the latest schema version, which this binary understands
+var RedisSchemaVersion = redisMigrations[len(redisMigrations)-1].Version
+
+// ErrUnsupportedSchemaVersion is returned if redis was migrated by a newer binary
+var ErrUnsupportedSchemaVersion = errors.New("unsupported redis schema version")
+
+var (
+	redisMigrationLockTTL           = time.Minute     // expiry of the lock, in case an instance dies while migrating
+	redisMigrationLockTimeout       = 2 * time.Minute // how long to wait for another instance to finish migrating
+	redisMigrationLockRetryInterval = 100 * time.Millisecond
+)
+
+// unlockScript deletes the lock only if it's still held with the token (i.e. it didn't expire and was taken by
+// another instance in the meantime)
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Migrate runs the migrations which are newer than the schema version saved in redis, holding a lock so that
+// concurrently starting instances don't run them twice. Fails if the saved version is newer than RedisSchemaVersion.
+// Returns the names of the migrations which were run.
+func (s *RedisState) Migrate() (applied []string, err error) {
+	return s.migrate(redisMigrations)
+}
+
+func (s *RedisState) migrate(migrations []RedisMigration) (applied []string, err error) {
+	unlock, err := s.lockMigrations()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if version > latest {
+		return nil, errors.Wrapf(ErrUnsupportedSchemaVersion, "version %d is newer than %d", version, latest)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		s.log.Infow("Running redis migration", "version", m.Version, "name", m.Name)
+		if err := m.Migrate(s); err != nil {
+			return applied, errors.Wrapf(err, "redis migration %d (%s) failed", m.Version, m.Name)
+		}
+		err = s.withRetry(func(ctx context.Context) error {
+			return s.RedisClient.Set(ctx, s.key(RedisKeySchemaVersion), strconv.Itoa(m.Version), 0).Err()
+		})
+		if err != nil {
+			return applied, errors.Wrap(err, "saving the redis schema version failed")
+		}
+		applied = append(applied, m.Name)
+	}
+	return applied, nil
+}
+
+// SchemaVersion returns the schema version saved in redis, which is 1 if none is saved
+func (s *RedisState) SchemaVersion() (version int, err error) {
+	var res string
+	err = s.withRetry(func(ctx context.Context) (err error) {
+		res, err = s.RedisClient.Get(ctx, s.key(RedisKeySchemaVersion)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	version, err = strconv.Atoi(res)
+	return version, errors.Wrapf(err, "invalid redis schema version %q", res)
+}
+
+// lockMigrations takes the migration lock, waiting while another instance holds it
+func (s *RedisState) lockMigrations() (unlock func(), err error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	key := s.key(RedisKeyMigrationLock)
+
+	deadline := time.Now().Add(redisMigrationLockTimeout)
+	for {
+		var isSet bool
+		err = s.withRetry(func(ctx context.Context) (err error) {
+			isSet, err = s.RedisClient.SetNX(ctx, key, token, redisMigrationLockTTL).Result()
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "taking the redis migration lock failed")
+		} else if isSet {
+			break
+		} else if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for the redis migration lock, which is held by another instance")
+		}
+		time.Sleep(redisMigrationLockRetryInterval)
+	}
+
+	return func() {
+		if err := unlockScript.Run(context.Background(), s.RedisClient, []string{key}, token).Err(); err != nil {
+			s.log.Warnw("Releasing the redis migration lock failed, it expires", "error", err)
+		}
+	}, nil
+}
+
+// migrateNodeHashes converts the node list of RedisKeyNodes to node hashes. Nodes which already have a hash are kept.
+// The old list is left in place (but not updated anymore) for a rollback.
+func migrateNodeHashes(s *RedisState) error {
+	var res string
+	err := s.withRetry(func(ctx context.Context) (err error) {
+		res, err = s.RedisClient.Get(ctx, s.key(RedisKeyNodes)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var nodeUris []string
+	if err := json.Unmarshal([]byte(res), &nodeUris); err != nil {
+		return errors.Wrap(err, "invalid node list")
+	}
+	nodes, err := s.GetNodes()
+	if err != nil {
+		return err
+	}
+	numMigrated := 0
+	for _, uri := range nodeUris {
+		if len(deleteNodeEntry(nodes, uri)) < len(nodes) {
+			continue // already saved as hash
+		}
+		node := NodeEntry{URI: uri, AddedAt: time.Now().UTC()}
+		err := s.withRetry(func(ctx context.Context) error {
+			return s.writeNode(ctx, NormalizeNodeURI(uri), &node)
+		})
+		if err != nil {
+			return err
+		}
+		numMigrated++
+	}
+	s.log.Infow("Converted the node list to node hashes", "numNodes", numMigrated)
+	return nil
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestRedisMigrations(t *testing.T) {
+	// Ordered by version, without gaps
+	for i, m := range redisMigrations {
+		require.Equal(t, i+2, m.Version, m.Name)
+		require.NotEmpty(t, m.Name)
+	}
+	require.Equal(t, redisMigrations[len(redisMigrations)-1].Version, RedisSchemaVersion)
+}
+
+func TestRedisMigrate(t *testing.T) {
+	resetTestRedis()
+	ran := []int{}
+	newMigration := func(version int, err error) RedisMigration {
+		return RedisMigration{Version: version, Name: "test", Migrate: func(s *RedisState) error {
+			ran = append(ran, version)
+			return err
+		}}
+	}
+
+	version, err := redisTestState.SchemaVersion()
+	require.Nil(t, err, err)
+	require.Equal(t, 1, version)
+
+	// Runs the migrations in order, once
+	migrations := []RedisMigration{newMigration(2, nil), newMigration(3, nil)}
+	applied, err := redisTestState.migrate(migrations)
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"test", "test"}, applied)
+	require.Equal(t, []int{2, 3}, ran)
+	applied, err = redisTestState.migrate(migrations)
+	require.Nil(t, err, err)
+	require.Empty(t, applied)
+	require.Equal(t, []int{2, 3}, ran)
+
+	// A failed migration keeps the version of the last successful one, and is run again on the next start
+	ran = nil
+	migrations = append(migrations, newMigration(4, nil), newMigration(5, errors.New("failed")))
+	_, err = redisTestState.migrate(migrations)
+	require.NotNil(t, err)
+	require.Equal(t, []int{4, 5}, ran)
+	version, err = redisTestState.SchemaVersion()
+	require.Nil(t, err, err)
+	require.Equal(t, 4, version)
+	require.False(t, redisTestServer.Exists(redisTestState.key(RedisKeyMigrationLock))) // released
+
+	// Refuses a version which is newer than the binary understands
+	ran = nil
+	_, err = redisTestState.migrate(migrations[:2])
+	require.ErrorIs(t, err, ErrUnsupportedSchemaVersion)
+	require.Empty(t, ran)
+
+	// Refuses to start the server too
+	require.Nil(t, redisTestServer.Set(redisTestState.key(RedisKeySchemaVersion), "100"))
+	_, err = NewServer(ServerOpts{Log: testLog, RedisURI: redisTestServer.Addr(), WorkersPerNode: 1})
+	require.ErrorIs(t, err, ErrUnsupportedSchemaVersion)
+
+	require.Nil(t, redisTestServer.Set(redisTestState.key(RedisKeySchemaVersion), "two"))
+	_, err = redisTestState.SchemaVersion()
+	require.NotNil(t, err)
+}
+
+func TestRedisMigrateLock(t *testing.T) {
+	resetTestRedis()
+	_redisMigrationLockRetryInterval := redisMigrationLockRetryInterval
+	defer func() { redisMigrationLockRetryInterval = _redisMigrationLockRetryInterval }()
+	redisMigrationLockRetryInterval = 10 * time.Millisecond
+
+	numRuns := atomic.NewInt32(0)
+	migrations := []RedisMigration{{Version: 2, Name: "slow", Migrate: func(s *RedisState) error {
+		numRuns.Inc()
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}}}
+
+	// Two instances starting at the same time: one runs the migration, the other waits and then finds it done
+	var wg sync.WaitGroup
+	numApplied := atomic.NewInt32(0)
+	errC := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		state, err := NewRedisState(testLog, redisTestServer.Addr(), RedisConnConfig{KeyPrefix: RedisPrefix})
+		require.Nil(t, err, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied, err := state.migrate(migrations)
+			numApplied.Add(int32(len(applied)))
+			errC <- err
+		}()
+	}
+	wg.Wait()
+	require.Nil(t, <-errC)
+	require.Nil(t, <-errC)
+	require.Equal(t, int32(1), numRuns.Load())
+	require.Equal(t, int32(1), numApplied.Load())
+
+	// Waiting for the lock times out, i.e. if another instance is stuck
+	_redisMigrationLockTimeout := redisMigrationLockTimeout
+	defer func() { redisMigrationLockTimeout = _redisMigrationLockTimeout }()
+	redisMigrationLockTimeout = 50 * time.Millisecond
+	require.Nil(t, redisTestServer.Set(redisTestState.key(RedisKeyMigrationLock), "other-instance"))
+	_, err := redisTestState.migrate(migrations)
+	require.NotNil(t, err)
+	require.Equal(t, "other-instance", getTestRedisKey(t, RedisKeyMigrationLock)) // not released by this instance
+
+	// The lock expires if the holder died
+	redisTestServer.SetTTL(redisTestState.key(RedisKeyMigrationLock), redisMigrationLockTTL)
+	redisTestServer.FastForward(redisMigrationLockTTL)
+	_, err = redisTestState.migrate(migrations)
+	require.Nil(t, err, err)
+}
+
+func getTestRedisKey(t *testing.T, name string) string {
+	t.Helper()
+	value, err := redisTestServer.Get(redisTestState.key(name))
+	require.Nil(t, err, err)
+	return value
+}
+
+func TestRedisMigrationNodeHashes(t *testing.T) {
+	resetTestRedis()
+	require.Nil(t, redisTestServer.Set(redisTestState.key(RedisKeyNodes), `["http://node1","http://node2?_workers=2"]`))
+	require.Nil(t, redisTestState.SaveNode(NodeEntry{URI: "http://node2?_workers=2", Workers: 5})) // already converted
+
+	require.Nil(t, migrateNodeHashes(redisTestState))
+	nodes, err := redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"http://node2?_workers=2", "http://node1"}, nodeEntryURIs(nodes))
+	require.Equal(t, int32(5), nodes[0].Workers)
+	require.WithinDuration(t, time.Now(), nodes[1].AddedAt, time.Minute)
+
+	// Running it again keeps the entries. The old list isn't changed.
+	require.Nil(t, migrateNodeHashes(redisTestState))
+	nodesAgain, err := redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, nodes, nodesAgain)
+	require.Equal(t, `["http://node1","http://node2?_workers=2"]`, getTestRedisKey(t, RedisKeyNodes))
+
+	// Through Migrate, only on the first start: later changes of the old list are ignored
+	applied, err := redisTestState.Migrate()
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"node hashes"}, applied)
+	require.Nil(t, redisTestState.DeleteNode("http://node1"))
+	applied, err = redisTestState.Migrate()
+	require.Nil(t, err, err)
+	require.Empty(t, applied)
+	nodes, err = redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"http://node2?_workers=2"}, nodeEntryURIs(nodes))
+
+	// Nothing to convert
+	resetTestRedis()
+	require.Nil(t, migrateNodeHashes(redisTestState))
+	nodes, err = redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Empty(t, nodes)
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const MaxRequestIDLength = 128
+
+type requestIDCtxKey struct{}
+
+// ContextWithRequestID returns a context carrying the request ID, which is forwarded to the node by ProxyRequest
+func ContextWithRequestID(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey{}, reqID)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	reqID, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return reqID
+}
+
+// SanitizeRequestID removes all characters except [A-Za-z0-9._:/-] and truncates to MaxRequestIDLength
+func SanitizeRequestID(reqID string) string {
+	res := make([]byte, 0, len(reqID))
+	for i := 0; i < len(reqID) && len(res) < MaxRequestIDLength; i++ {
+		c := reqID[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '_' || c == ':' || c == '/' || c == '-' {
+			res = append(res, c)
+		}
+	}
+	return string(res)
+}
+
+// ensureRequestID sanitizes the X-Request-ID header of the request (or generates a UUID if there's none), and
+// sets it on both the request and the response headers. Returns the request ID.
+func ensureRequestID(w http.ResponseWriter, req *http.Request) string {
+	reqID := req.Header.Get("X-Request-ID")
+	if w.Header().Get("X-Request-ID") == reqID && reqID != "" { // already done
+		return reqID
+	}
+
+	reqID = SanitizeRequestID(reqID)
+	if reqID == "" {
+		reqID = uuid.NewString()
+	}
+	req.Header.Set("X-Request-ID", reqID)
+	w.Header().Set("X-Request-ID", reqID)
+	return reqID
+}
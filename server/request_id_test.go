@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSanitizeRequestID(t *testing.T) {
+	require.Equal(t, "abc-123_x.y:z/1", SanitizeRequestID("abc-123_x.y:z/1"))
+	require.Equal(t, "foobar", SanitizeRequestID("foo\nbar\" "))
+	require.Equal(t, "", SanitizeRequestID("ä<>"))
+	require.Equal(t, MaxRequestIDLength, len(SanitizeRequestID(strings.Repeat("a", 200))))
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	log := zap.New(core).Sugar()
+
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node.Close()
+	nodeRequestID := func() string {
+		req, _ := node.LastRequest()
+		return req.Header.Get("X-Request-ID")
+	}
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	nodePool := NewNodePool(log, nil, 1)
+	err := nodePool.AddNode(node.URL)
+	require.Nil(t, err, err)
+	webserver := NewWebserver(log, ":12345", prioQueue, nodePool)
+	go func() {
+		for {
+			job := prioQueue.Pop()
+			if job == nil {
+				return
+			}
+			nodePool.JobC <- job
+		}
+	}()
+	handler, _ := webserver.Handlers()
+	events := webserver.events.Subscribe(10)
+
+	reqPayloadBytes, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+	sendRequest := func(reqID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+		if reqID != "" {
+			req.Header.Set("X-Request-ID", reqID)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	requireLoggedEverywhere := func(reqID, accessLogMessage string) {
+		t.Helper()
+		messages := map[string]bool{}
+		for _, entry := range logs.FilterField(zap.String("reqID", reqID)).All() {
+			messages[entry.Message] = true
+		}
+		require.True(t, messages["Request added to queue"], "webserver log")
+		require.True(t, messages["processing request"], "node worker log")
+		require.True(t, messages[accessLogMessage], "access log")
+	}
+
+	// Incoming (sanitized) request ID
+	rr := sendRequest("trace\n-123")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "trace-123", rr.Header().Get("X-Request-ID"))
+	require.Equal(t, "trace-123", nodeRequestID())
+	requireLoggedEverywhere("trace-123", "http: POST / 200")
+
+	// Generated request ID
+	rr = sendRequest("")
+	require.Equal(t, http.StatusOK, rr.Code)
+	reqID := rr.Header().Get("X-Request-ID")
+	_, err = uuid.Parse(reqID)
+	require.Nil(t, err, err)
+	require.Equal(t, reqID, nodeRequestID())
+	requireLoggedEverywhere(reqID, "http: POST / 200")
+
+	// Failed requests are published to the event stream
+	node.SetOpts(testutils.FakeNodeOpts{ErrorRate: 1, ErrorStatusCode: http.StatusInternalServerError})
+	rr = sendRequest("failing-1")
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, "failing-1", rr.Header().Get("X-Request-ID"))
+	requireLoggedEverywhere("failing-1", "http: POST / 500")
+	event := <-events.C
+	require.Equal(t, EventTypeRequestError, event.Type)
+	require.Equal(t, "failing-1", event.Data.(RequestErrorEvent).ReqID)
+	require.Equal(t, ErrorKindNodeError, event.Data.(RequestErrorEvent).ErrorKind)
+}
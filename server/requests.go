@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Page size of /requests: the default, and the maximum of the `limit` query arg
+const (
+	requestsListDefaultLimit = 100
+	requestsListMaxLimit     = 1000
+)
+
+// QueuedRequestInfo is a queued request in /requests. The payload is only described by its size and hash.
+type QueuedRequestInfo struct {
+	ID            string    `json:"id"`
+	ClientID      string    `json:"clientId"`
+	Tenant        string    `json:"tenant,omitempty"`
+	Priority      string    `json:"priority"`
+	Position      int       `json:"position"` // in the queue of its priority, 1 is popped next
+	QueuedAt      time.Time `json:"queuedAt"`
+	AgeMs         int64     `json:"ageMs"`
+	PayloadSize   int64     `json:"payloadSize"`
+	PayloadSHA256 string    `json:"payloadSha256"`
+	Tries         int       `json:"tries"`               // previous tries (of re-queued requests)
+	Cancelled     bool      `json:"cancelled,omitempty"` // the client is gone, the request is discarded when popped
+}
+
+// InFlightRequestInfo is a request taken by a proxy worker in /requests
+type InFlightRequestInfo struct {
+	ID            string `json:"id"`
+	ClientID      string `json:"clientId"`
+	Tenant        string `json:"tenant,omitempty"`
+	Priority      string `json:"priority"`
+	NodeURI       string `json:"nodeUri"`
+	ElapsedMs     int64  `json:"elapsedMs"` // since the worker took the request
+	PayloadSize   int64  `json:"payloadSize"`
+	PayloadSHA256 string `json:"payloadSha256"`
+	Try           int    `json:"try"`
+}
+
+// RequestsResponse is the response of /requests: a page of the queued requests (in priority order, see
+// Queue.Snapshot), and all requests currently proxied (oldest first)
+type RequestsResponse struct {
+	NumQueued int                   `json:"numQueued"` // all queued requests, not only the listed ones
+	Offset    int                   `json:"offset"`
+	Limit     int                   `json:"limit"`
+	Queued    []QueuedRequestInfo   `json:"queued"`
+	InFlight  []InFlightRequestInfo `json:"inFlight"`
+}
+
+// HandleRequestsRequest lists the queued and in-flight requests (query args: `offset`, and `limit` up to
+// requestsListMaxLimit). The queue lock is only held to copy the queue.
+func (s *Webserver) HandleRequestsRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	queryInt := func(key string, defaultValue int) (int, error) {
+		if query.Get(key) == "" {
+			return defaultValue, nil
+		}
+		val, err := strconv.Atoi(query.Get(key))
+		if err == nil && val < 0 {
+			err = fmt.Errorf("invalid %s: %d", key, val)
+		}
+		return val, err
+	}
+	offset, err := queryInt("offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	limit, err := queryInt("limit", requestsListDefaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	if limit > requestsListMaxLimit {
+		limit = requestsListMaxLimit
+	}
+
+	now := time.Now()
+	queued := s.prioQueue.Snapshot()
+	res := RequestsResponse{
+		NumQueued: len(queued),
+		Offset:    offset,
+		Limit:     limit,
+		Queued:    []QueuedRequestInfo{},
+		InFlight:  []InFlightRequestInfo{},
+	}
+	positions := make(map[string]int) // by priority
+	for i, r := range queued {
+		priority := r.Priority()
+		positions[priority]++
+		if i < offset || i >= offset+limit {
+			continue
+		}
+		res.Queued = append(res.Queued, QueuedRequestInfo{
+			ID:            r.ID,
+			ClientID:      r.ClientID,
+			Tenant:        r.Tenant,
+			Priority:      priority,
+			Position:      positions[priority],
+			QueuedAt:      r.QueuedAt,
+			AgeMs:         now.Sub(r.QueuedAt).Milliseconds(),
+			PayloadSize:   r.Payload.Len(),
+			PayloadSHA256: payloadSHA256(r.Payload),
+			Tries:         r.Tries,
+			Cancelled:     r.IsCancelled(),
+		})
+	}
+
+	inFlight := s.nodePool.inFlightRequests()
+	sort.Slice(inFlight, func(i, j int) bool { return inFlight[i].since.Before(inFlight[j].since) })
+	for _, f := range inFlight {
+		res.InFlight = append(res.InFlight, InFlightRequestInfo{
+			ID:            f.req.ID,
+			ClientID:      f.req.ClientID,
+			Tenant:        f.req.Tenant,
+			Priority:      f.req.Priority(),
+			NodeURI:       f.nodeURI,
+			ElapsedMs:     now.Sub(f.since).Milliseconds(),
+			PayloadSize:   f.req.Payload.Len(),
+			PayloadSHA256: payloadSHA256(f.req.Payload),
+			Try:           f.req.Tries,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRequestsRequest(t *testing.T) {
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 500 * time.Millisecond})
+	defer node.Close()
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	nodePool := NewNodePool(testLog, nil, 1)
+	require.Nil(t, nodePool.AddNode(node.URL))
+	defer nodePool.Shutdown()
+	handler := NewWebserver(testLog, ":12345", prioQueue, nodePool).Handler()
+
+	newRequest := func(id, clientID string, isHighPrio, isFastTrack bool) *SimRequest {
+		r := NewSimRequest(context.Background(), id, []byte(`{"id":"`+id+`"}`), isHighPrio, isFastTrack)
+		r.ClientID = clientID
+		return r
+	}
+	sha256Hex := func(payload string) string {
+		hash := sha256.Sum256([]byte(payload))
+		return hex.EncodeToString(hash[:])
+	}
+	list := func(query string) (res RequestsResponse) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/requests"+query, nil))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&res))
+		return res
+	}
+
+	// One request is proxied on the slow node, the others are queued
+	proxied := newRequest("proxied", "c0", true, false)
+	nodePool.JobC <- proxied
+	require.Eventually(t, func() bool { return node.NumRequests() > 0 && len(list("").InFlight) == 1 }, time.Second, 5*time.Millisecond)
+	prioQueue.Push(newRequest("low1", "c1", false, false))
+	prioQueue.Push(newRequest("high1", "c2", true, false))
+	prioQueue.Push(newRequest("fast1", "c1", false, true))
+	prioQueue.Push(newRequest("high2", "c3", true, false))
+
+	res := list("")
+	require.Equal(t, 4, res.NumQueued)
+	require.Equal(t, requestsListDefaultLimit, res.Limit)
+	ids, positions := []string{}, []int{}
+	for _, r := range res.Queued {
+		ids, positions = append(ids, r.ID), append(positions, r.Position)
+	}
+	require.Equal(t, []string{"fast1", "high1", "high2", "low1"}, ids)
+	require.Equal(t, []int{1, 1, 2, 1}, positions)
+	high1 := res.Queued[1]
+	require.Equal(t, "c2", high1.ClientID)
+	require.Equal(t, PriorityHighPrio, high1.Priority)
+	require.Equal(t, int64(len(`{"id":"high1"}`)), high1.PayloadSize)
+	require.Equal(t, sha256Hex(`{"id":"high1"}`), high1.PayloadSHA256)
+	require.GreaterOrEqual(t, high1.AgeMs, int64(0))
+
+	require.Len(t, res.InFlight, 1)
+	inFlight := res.InFlight[0]
+	require.Equal(t, "proxied", inFlight.ID)
+	require.Equal(t, "c0", inFlight.ClientID)
+	require.Equal(t, node.URL, inFlight.NodeURI)
+	require.Equal(t, 1, inFlight.Try)
+	require.Equal(t, sha256Hex(`{"id":"proxied"}`), inFlight.PayloadSHA256)
+	require.Less(t, inFlight.ElapsedMs, int64(500))
+
+	// The payloads are not listed
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/requests", nil))
+	require.NotContains(t, rr.Body.String(), `{\"id\"`)
+
+	// Pagination, with the positions of the whole queue
+	res = list("?offset=1&limit=2")
+	require.Equal(t, 4, res.NumQueued)
+	require.Len(t, res.Queued, 2)
+	require.Equal(t, "high2", res.Queued[1].ID)
+	require.Equal(t, 2, res.Queued[1].Position)
+	require.Empty(t, list("?offset=10").Queued)
+	require.Equal(t, requestsListMaxLimit, list("?limit=100000").Limit)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/requests?limit=-1", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Once the response was sent, the request is no longer in flight
+	<-proxied.ResponseC
+	require.Eventually(t, func() bool { return len(list("").InFlight) == 0 }, time.Second, 5*time.Millisecond)
+}
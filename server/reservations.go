@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ErrReservationCapacity is returned when the reserved slots of all clients would exceed the fast-track limit
+var ErrReservationCapacity = errors.New("the reserved slots would exceed the fast-track limit")
+
+// FastTrackReservation reserves Slots of the fast-track queue for the fast-track requests of ClientID which present
+// the Token (X-Reservation-Token header), until ExpiresAt
+type FastTrackReservation struct {
+	ClientID  string    `json:"clientID"`
+	Slots     int       `json:"slots"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ReservationStore persists the fast-track reservations, so that all instances apply them. Implemented by RedisState.
+type ReservationStore interface {
+	SaveReservation(reservation FastTrackReservation) error // replaces the reservation of the client, expires at its ExpiresAt
+	DeleteReservation(clientID string) error
+	GetReservations() (reservations []FastTrackReservation, err error) // without the expired ones
+}
+
+var _ ReservationStore = (*RedisState)(nil)
+
+// FastTrackReservations grants the fast-track reservations and applies them to the queue (see
+// PrioQueue.SetFastTrackReservations). Without a store they are only kept in memory, with one Run reloads them
+// periodically, to apply the ones granted or revoked by other instances.
+type FastTrackReservations struct {
+	log   *zap.SugaredLogger
+	queue *PrioQueue
+	store ReservationStore // (optional)
+	now   func() time.Time
+
+	lock         sync.Mutex
+	reservations map[string]FastTrackReservation // by client ID
+	applied      map[string]int                  // the reserved slots applied to the queue
+}
+
+func NewFastTrackReservations(log *zap.SugaredLogger, queue *PrioQueue, store ReservationStore) *FastTrackReservations {
+	return &FastTrackReservations{
+		log:          log,
+		queue:        queue,
+		store:        store,
+		now:          time.Now,
+		reservations: make(map[string]FastTrackReservation),
+	}
+}
+
+// Grant reserves slots for the client until ttl elapsed, replacing its previous reservation (and token). Returns
+// ErrReservationCapacity if the reserved slots of all clients would exceed the fast-track limit.
+func (r *FastTrackReservations) Grant(clientID string, slots int, ttl time.Duration) (reservation FastTrackReservation, err error) {
+	if err := validateReservation(clientID, slots, ttl); err != nil {
+		return reservation, err
+	}
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return reservation, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	numReserved := slots
+	for _, other := range r.active() {
+		if other.ClientID != clientID {
+			numReserved += other.Slots
+		}
+	}
+	if limit := r.queue.FastTrackLimit(); limit <= 0 || numReserved > limit {
+		return reservation, fmt.Errorf("%w (%d reserved, limit: %d)", ErrReservationCapacity, numReserved, limit)
+	}
+
+	now := r.now().UTC()
+	reservation = FastTrackReservation{
+		ClientID:  clientID,
+		Slots:     slots,
+		Token:     hex.EncodeToString(tokenBytes),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if r.store != nil {
+		if err := r.store.SaveReservation(reservation); err != nil {
+			return FastTrackReservation{}, err
+		}
+	}
+	r.reservations[clientID] = reservation
+	r.log.Infow("Fast-track reservation granted", "clientID", clientID, "slots", slots, "expiresAt", reservation.ExpiresAt)
+	r.apply()
+	return reservation, nil
+}
+
+func validateReservation(clientID string, slots int, ttl time.Duration) error {
+	if clientID == "" {
+		return fmt.Errorf("clientID is required")
+	} else if slots < 1 {
+		return fmt.Errorf("slots must be at least 1")
+	} else if ttl <= 0 {
+		return fmt.Errorf("ttlSec must be positive")
+	}
+	return nil
+}
+
+// Revoke removes the reservation of the client. Returns false if it has none.
+func (r *FastTrackReservations) Revoke(clientID string) (found bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.store != nil {
+		if err := r.store.DeleteReservation(clientID); err != nil {
+			return false, err
+		}
+	}
+	_, found = r.reservations[clientID]
+	delete(r.reservations, clientID)
+	if found {
+		r.log.Infow("Fast-track reservation revoked", "clientID", clientID)
+	}
+	r.apply()
+	return found, nil
+}
+
+// Lookup returns the client ID of the reservation with the token (false if there is none, or it expired)
+func (r *FastTrackReservations) Lookup(token string) (clientID string, ok bool) {
+	if r == nil || token == "" {
+		return "", false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, reservation := range r.active() {
+		if subtle.ConstantTimeCompare([]byte(reservation.Token), []byte(token)) == 1 {
+			return reservation.ClientID, true
+		}
+	}
+	return "", false
+}
+
+// rejects returns whether a fast-track request would be rejected because the capacity left is reserved for others
+func (r *FastTrackReservations) rejects(req *SimRequest) bool {
+	return r != nil && req.IsFastTrack && r.queue.FastTrackReservedFull(req)
+}
+
+// List returns the reservations which didn't expire yet, by client ID
+func (r *FastTrackReservations) List() []FastTrackReservation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.active()
+}
+
+// active returns the reservations which didn't expire yet, by client ID. The lock must be held.
+func (r *FastTrackReservations) active() []FastTrackReservation {
+	now := r.now()
+	res := make([]FastTrackReservation, 0, len(r.reservations))
+	for _, reservation := range r.reservations {
+		if reservation.ExpiresAt.After(now) {
+			res = append(res, reservation)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ClientID < res[j].ClientID })
+	return res
+}
+
+// apply removes the expired reservations, and sets the reserved slots on the queue if they changed. The lock must be
+// held.
+func (r *FastTrackReservations) apply() {
+	slots := make(map[string]int)
+	for _, reservation := range r.active() {
+		slots[reservation.ClientID] = reservation.Slots
+	}
+	for clientID := range r.reservations {
+		if _, found := slots[clientID]; !found {
+			delete(r.reservations, clientID)
+			r.log.Infow("Fast-track reservation expired or removed", "clientID", clientID)
+		}
+	}
+	if r.applied != nil && mapsEqual(r.applied, slots) {
+		return
+	}
+	r.applied = slots
+	r.queue.SetFastTrackReservations(slots)
+}
+
+// Sync reloads the reservations from the store (if any), and removes the expired ones
+func (r *FastTrackReservations) Sync() error {
+	var reservations []FastTrackReservation
+	var err error
+	if r.store != nil {
+		if reservations, err = r.store.GetReservations(); err != nil {
+			return err
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.store != nil {
+		r.reservations = make(map[string]FastTrackReservation, len(reservations))
+		for _, reservation := range reservations {
+			r.reservations[reservation.ClientID] = reservation
+		}
+	}
+	r.apply()
+	return nil
+}
+
+// Run syncs the reservations every interval, until ctx is done
+func (r *FastTrackReservations) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Sync(); err != nil {
+				r.log.Warnw("Syncing the fast-track reservations failed, keeping the current ones", "error", err)
+			}
+		}
+	}
+}
+
+// mapsEqual returns whether both maps have the same entries
+func mapsEqual(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, found := b[k]; !found || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ReservationRequest is the body of POST /admin/reservations
+type ReservationRequest struct {
+	ClientID string `json:"clientID"`
+	Slots    int    `json:"slots"`
+	TTLSec   int    `json:"ttlSec"`
+}
+
+type ReservationsResponse struct {
+	Reservations     []FastTrackReservation `json:"reservations"` // tokens are masked
+	NumReservedSlots int                    `json:"numReservedSlots"`
+	FastTrackLimit   int                    `json:"fastTrackLimit"`
+}
+
+// EnableFastTrackReservations accepts the X-Reservation-Token header of fast-track requests, and exposes the
+// reservations on /admin/reservations
+func (s *Webserver) EnableFastTrackReservations(reservations *FastTrackReservations) {
+	s.reservations = reservations
+}
+
+// HandleReservationsRequest returns the reservations (GET), grants a reservation and returns it with its token (POST),
+// or revokes the reservation of a client (DELETE /admin/reservations/{clientID})
+func (s *Webserver) HandleReservationsRequest(w http.ResponseWriter, req *http.Request) {
+	if s.reservations == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "fast-track reservations are not enabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch req.Method {
+	case http.MethodPost:
+		var body ReservationRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		ttl := time.Duration(body.TTLSec) * time.Second
+		if err := validateReservation(body.ClientID, body.Slots, ttl); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		reservation, err := s.reservations.Grant(body.ClientID, body.Slots, ttl)
+		if errors.Is(err, ErrReservationCapacity) {
+			writeError(w, http.StatusConflict, ErrorCodeInvalidRequest, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(reservation); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		}
+		return
+	case http.MethodDelete:
+		found, err := s.reservations.Revoke(mux.Vars(req)["clientID"])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		} else if !found {
+			writeError(w, http.StatusNotFound, ErrorCodeNotFound, "the client has no reservation")
+			return
+		}
+	}
+
+	res := ReservationsResponse{Reservations: s.reservations.List(), FastTrackLimit: s.reservations.queue.FastTrackLimit()}
+	for i := range res.Reservations {
+		res.NumReservedSlots += res.Reservations[i].Slots
+		res.Reservations[i].Token = maskSecret(res.Reservations[i].Token)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrioQueueFastTrackReservations(t *testing.T) {
+	q := NewPrioQueue(4, 0, 0, 2, false, PriorityAging{})
+	defer q.Close()
+	q.SetFastTrackReservations(map[string]int{"mm": 2})
+	fastTrack := func(id, reservation string) *SimRequest {
+		r := NewSimRequest(context.Background(), id, []byte(id), false, true)
+		r.Reservation = reservation
+		return r
+	}
+
+	// The unreserved part of the limit is full after 2 requests
+	require.True(t, q.Push(fastTrack("u1", "")))
+	require.True(t, q.Push(fastTrack("u2", "other")))
+	require.False(t, q.CanPush(fastTrack("u3", "")))
+	require.True(t, q.FastTrackReservedFull(fastTrack("u3", "")))
+	require.False(t, q.Push(fastTrack("u3", "")))
+	require.True(t, q.Push(NewSimRequest(context.Background(), "h1", []byte("h1"), true, false))) // other priorities are not affected
+
+	// The reserved slots, then the whole limit is full
+	require.True(t, q.Push(fastTrack("m1", "mm")))
+	require.True(t, q.Push(fastTrack("m2", "mm")))
+	require.False(t, q.Push(fastTrack("m3", "mm")))
+
+	// A popped reserved request frees its slot, but not the unreserved part
+	require.Equal(t, "u1", q.Pop().ID)
+	require.Equal(t, "u2", q.Pop().ID)
+	require.Equal(t, "h1", q.Pop().ID)
+	require.Equal(t, "m1", q.Pop().ID)
+	require.True(t, q.Push(fastTrack("m3", "mm")))
+	require.True(t, q.Push(fastTrack("m4", "mm"))) // in the unreserved part
+	require.True(t, q.Push(fastTrack("u3", "")))
+	require.False(t, q.Push(fastTrack("u4", "")))
+
+	// Without reservations the whole limit is shared again
+	q.SetFastTrackReservations(nil)
+	require.False(t, q.FastTrackReservedFull(fastTrack("u4", "")))
+	require.Equal(t, 0, q.numReservedQueued)
+}
+
+func TestFastTrackReservations(t *testing.T) {
+	resetTestRedis()
+	q := NewPrioQueue(4, 0, 0, 2, false, PriorityAging{})
+	defer q.Close()
+	now := time.Now().UTC().Truncate(time.Second)
+	r := NewFastTrackReservations(testLog, q, redisTestState)
+	r.now = func() time.Time { return now }
+
+	reservation, err := r.Grant("mm", 3, time.Hour)
+	require.Nil(t, err, err)
+	require.Equal(t, now.Add(time.Hour), reservation.ExpiresAt)
+	require.Len(t, reservation.Token, 32)
+	_, err = r.Grant("other", 2, time.Hour)
+	require.ErrorIs(t, err, ErrReservationCapacity)
+	_, err = r.Grant("mm", 0, time.Hour)
+	require.NotNil(t, err)
+
+	clientID, ok := r.Lookup(reservation.Token)
+	require.True(t, ok)
+	require.Equal(t, "mm", clientID)
+	_, ok = r.Lookup("invalid")
+	require.False(t, ok)
+
+	// Another instance applies the reservations of redis
+	q2 := NewPrioQueue(4, 0, 0, 2, false, PriorityAging{})
+	defer q2.Close()
+	r2 := NewFastTrackReservations(testLog, q2, redisTestState)
+	r2.now = r.now
+	require.Nil(t, r2.Sync())
+	require.Equal(t, []FastTrackReservation{reservation}, r2.List())
+	require.Equal(t, 3, q2.numReservedSlots)
+	_, ok = r2.Lookup(reservation.Token)
+	require.True(t, ok)
+
+	// Granting again replaces the reservation and its token
+	reservation2, err := r.Grant("mm", 2, time.Hour)
+	require.Nil(t, err, err)
+	require.NotEqual(t, reservation.Token, reservation2.Token)
+	_, ok = r.Lookup(reservation.Token)
+	require.False(t, ok)
+	require.Nil(t, r2.Sync())
+	require.Equal(t, 2, q2.numReservedSlots)
+
+	// Expiry, locally and in redis
+	now = now.Add(time.Hour)
+	_, ok = r.Lookup(reservation2.Token)
+	require.False(t, ok)
+	require.Nil(t, r.Sync())
+	require.Empty(t, r.List())
+	require.Equal(t, 0, q.numReservedSlots)
+	redisTestServer.FastForward(time.Hour)
+	require.Nil(t, r2.Sync())
+	require.Empty(t, r2.List())
+	require.Equal(t, 0, q2.numReservedSlots)
+
+	// Revoke
+	_, err = r.Grant("mm", 1, time.Hour)
+	require.Nil(t, err, err)
+	found, err := r.Revoke("mm")
+	require.Nil(t, err, err)
+	require.True(t, found)
+	require.Nil(t, r2.Sync())
+	require.Empty(t, r2.List())
+	found, err = r.Revoke("mm")
+	require.Nil(t, err, err)
+	require.False(t, found)
+
+	// Without a limit nothing can be reserved
+	unlimited := NewFastTrackReservations(testLog, NewPrioQueue(0, 0, 0, 2, false, PriorityAging{}), nil)
+	_, err = unlimited.Grant("mm", 1, time.Hour)
+	require.ErrorIs(t, err, ErrReservationCapacity)
+}
+
+func TestWebserverFastTrackReservations(t *testing.T) {
+	prioQueue := NewPrioQueue(3, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node.Close()
+	nodePool := NewNodePool(testLog, nil, 1)
+	defer nodePool.Shutdown()
+	require.Nil(t, nodePool.AddNode(node.URL))
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+	handler := webserver.Handler()
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+	admission := func(token string) (res AdmissionResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/admission?priority=fast-track", nil)
+		req.Header.Set("X-Reservation-Token", token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&res))
+		return res
+	}
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/admin/reservations", "").Code)
+	webserver.EnableFastTrackReservations(NewFastTrackReservations(testLog, prioQueue, nil))
+
+	// Grant a reservation of 2 slots, the token is only returned once
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/admin/reservations", `{"clientID":"mm","slots":2}`).Code)
+	require.Equal(t, http.StatusConflict, serve(http.MethodPost, "/admin/reservations", `{"clientID":"mm","slots":4,"ttlSec":60}`).Code)
+	rr := serve(http.MethodPost, "/admin/reservations", `{"clientID":"mm","slots":2,"ttlSec":60}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var reservation FastTrackReservation
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&reservation))
+	var list ReservationsResponse
+	rr = serve(http.MethodGet, "/admin/reservations", "")
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&list))
+	require.Len(t, list.Reservations, 1)
+	require.Equal(t, reservation.Token[:4]+"****", list.Reservations[0].Token)
+	require.Equal(t, 2, list.NumReservedSlots)
+	require.Equal(t, 3, list.FastTrackLimit)
+
+	// send returns the response once the request completes (there is no main loop)
+	send := func(clientID, token string) <-chan *httptest.ResponseRecorder {
+		req := newSimTestRequest(`{"id":1}`)
+		req.Header.Set("X-Fast-Track", "true")
+		req.Header.Set("X-Client-ID", clientID)
+		if token != "" {
+			req.Header.Set("X-Reservation-Token", token)
+		}
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			res <- rr
+		}()
+		return res
+	}
+	waitForQueued := func(n int) {
+		t.Helper()
+		require.Eventually(t, func() bool { return prioQueue.NumRequests() == n }, time.Second, 5*time.Millisecond)
+	}
+	requireRejected := func(rr *httptest.ResponseRecorder) {
+		t.Helper()
+		require.Equal(t, http.StatusTooManyRequests, rr.Code)
+		require.Equal(t, ErrorKindFastTrackReserved, rr.Header().Get("X-Error-Kind"))
+		errorResponse := decodeErrorResponse(t, rr)
+		require.Equal(t, ErrorCodeFastTrackReserved, errorResponse.Code)
+		require.True(t, errorResponse.Retryable)
+	}
+
+	// Fill the unreserved capacity, other clients get 429 while the reserved client still gets in
+	queued := []<-chan *httptest.ResponseRecorder{send("other", "")}
+	waitForQueued(1)
+	requireRejected(<-send("other", ""))
+	requireRejected(<-send("mm", "")) // without the token
+	require.Equal(t, ErrorKindFastTrackReserved, admission("").Reason)
+	require.True(t, admission(reservation.Token).Accepted)
+	for i := 0; i < 2; i++ {
+		queued = append(queued, send("mm", reservation.Token))
+		waitForQueued(2 + i)
+	}
+	require.Equal(t, ErrorKindQueueFull, (<-send("mm", reservation.Token)).Header().Get("X-Error-Kind"))
+	rr = <-send("mm", "invalid")
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	for range queued {
+		prioQueue.Pop().SendResponse(SimResponse{Payload: []byte(`{"result":1}`)})
+	}
+	for _, res := range queued {
+		require.Equal(t, http.StatusOK, (<-res).Code)
+	}
+
+	// Revoked reservations free the capacity for everyone
+	require.Equal(t, http.StatusOK, serve(http.MethodDelete, "/admin/reservations/mm", "").Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/admin/reservations/mm", "").Code)
+	require.False(t, prioQueue.FastTrackReservedFull(NewSimRequest(context.Background(), "", nil, false, true)))
+}
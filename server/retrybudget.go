@@ -0,0 +1,117 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudgetStats are the settings and counters of the retry budget (see /stats/queue)
+type RetryBudgetStats struct {
+	Ratio        float64 `json:"ratio"`
+	MinPerSec    float64 `json:"minPerSec"`
+	Burst        float64 `json:"burst"`
+	Tokens       float64 `json:"tokens"`       // retries which are currently allowed
+	NumRetries   int64   `json:"numRetries"`   // retries which were allowed
+	NumExhausted int64   `json:"numExhausted"` // retryable errors which were returned, because the budget was exhausted
+}
+
+// RetryBudget is a token bucket which limits the retries of failed requests to a fraction of the requests, so that
+// retries can't multiply the load when all nodes fail (i.e. because of a shared upstream dependency). Every request
+// adds ratio tokens, and minPerSec tokens are added per second (for low request rates), up to burst tokens. Every
+// retry takes a token. A ratio of 0 disables the budget.
+type RetryBudget struct {
+	lock       sync.Mutex
+	ratio      float64
+	minPerSec  float64
+	burst      float64
+	tokens     float64
+	refilledAt time.Time
+
+	numRetries   int64
+	numExhausted int64
+}
+
+// NewRetryBudget returns a full budget
+func NewRetryBudget(ratio, minPerSec, burst float64) *RetryBudget {
+	return &RetryBudget{ratio: ratio, minPerSec: minPerSec, burst: burst, tokens: burst}
+}
+
+// SetLimits changes the settings at runtime, the current tokens are kept (up to burst)
+func (b *RetryBudget) SetLimits(ratio, minPerSec, burst float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ratio, b.minPerSec, b.burst = ratio, minPerSec, burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// refill adds the minPerSec tokens since the last refill, with the lock held
+func (b *RetryBudget) refill(now time.Time) {
+	if !b.refilledAt.IsZero() && now.After(b.refilledAt) {
+		b.tokens += b.minPerSec * now.Sub(b.refilledAt).Seconds()
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.refilledAt = now
+}
+
+// Deposit adds the tokens of a new request. A no-op on a nil budget.
+func (b *RetryBudget) Deposit(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += b.ratio
+	b.refill(now)
+}
+
+// Withdraw returns whether a retry is allowed, and takes its token. Always true on a nil or disabled budget.
+func (b *RetryBudget) Withdraw(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ratio <= 0 {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		b.numExhausted++
+		return false
+	}
+	b.tokens--
+	b.numRetries++
+	return true
+}
+
+func (b *RetryBudget) Stats(now time.Time) RetryBudgetStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	return RetryBudgetStats{
+		Ratio:        b.ratio,
+		MinPerSec:    b.minPerSec,
+		Burst:        b.burst,
+		Tokens:       b.tokens,
+		NumRetries:   b.numRetries,
+		NumExhausted: b.numExhausted,
+	}
+}
+
+// EnableRetryBudget limits the retries of failed requests with budget
+func (s *Webserver) EnableRetryBudget(budget *RetryBudget) {
+	s.retryBudget = budget
+}
+
+// allowRetry returns whether a failed request may be retried, and counts the decision in the metrics
+func (s *Webserver) allowRetry(r *SimRequest) bool {
+	if s.retryBudget.Withdraw(time.Now()) {
+		return true
+	}
+	s.metrics.Count(MetricRetryBudgetExhausted, 1, MetricTag(MetricTagPriority, r.Priority()))
+	return false
+}
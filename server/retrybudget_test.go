@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	budget := NewRetryBudget(0.2, 0, 2)
+
+	// The budget starts full
+	require.True(t, budget.Withdraw(now))
+	require.True(t, budget.Withdraw(now))
+	require.False(t, budget.Withdraw(now))
+
+	// 5 requests allow one retry
+	for i := 0; i < 5; i++ {
+		budget.Deposit(now)
+	}
+	require.True(t, budget.Withdraw(now))
+	require.False(t, budget.Withdraw(now))
+	stats := budget.Stats(now)
+	require.Equal(t, int64(3), stats.NumRetries)
+	require.Equal(t, int64(2), stats.NumExhausted)
+	require.InDelta(t, 0, stats.Tokens, 0.001)
+
+	// The minimum per second, up to the burst
+	budget.SetLimits(0.2, 2, 3)
+	require.False(t, budget.Withdraw(now.Add(400*time.Millisecond)))
+	require.True(t, budget.Withdraw(now.Add(500*time.Millisecond)))
+	require.InDelta(t, 3, budget.Stats(now.Add(time.Hour)).Tokens, 0.001)
+
+	// Disabled, and nil
+	budget.SetLimits(0, 0, 0)
+	require.True(t, budget.Withdraw(now.Add(time.Hour)))
+	var nilBudget *RetryBudget
+	nilBudget.Deposit(now)
+	require.True(t, nilBudget.Withdraw(now))
+}
+
+// TestWebserverRetryBudget simulates an outage of all nodes: only the budget of retries is sent to them
+func TestWebserverRetryBudget(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	numNodeRequests := atomic.NewInt64(0)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		numNodeRequests.Inc()
+		http.Error(w, "upstream unavailable", http.StatusInternalServerError)
+	}
+	sink := &recordingMetricsSink{}
+	webserver.SetMetricsSink(sink)
+	webserver.EnableRetryBudget(NewRetryBudget(0.2, 0, 2))
+
+	numRequests := 50
+	kinds := map[string]int{}
+	for i := 0; i < numRequests; i++ {
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, newSimTestRequest(`{"id":1}`))
+		require.Equal(t, http.StatusInternalServerError, rr.Code)
+		kinds[rr.Header().Get("X-Error-Kind")]++
+	}
+
+	// Without the budget there would be RequestMaxTries node requests per request
+	maxRetries := 2 + int(0.2*float64(numRequests))
+	numRetries := numNodeRequests.Load() - int64(numRequests)
+	require.LessOrEqual(t, numRetries, int64(maxRetries))
+	require.GreaterOrEqual(t, numRetries, int64(maxRetries-1)) // the tokens are floats
+	require.LessOrEqual(t, kinds[ErrorKindNodeError], maxRetries)
+	require.Equal(t, numRequests, kinds[ErrorKindNodeError]+kinds[ErrorKindRetryBudgetExhausted])
+	require.Greater(t, kinds[ErrorKindRetryBudgetExhausted], numRequests/2)
+	require.Contains(t, sink.names, MetricRetryBudgetExhausted)
+
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueStatsRequest(rr, httptest.NewRequest(http.MethodGet, "/stats/queue", nil))
+	var stats QueueStatsResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&stats))
+	require.Equal(t, numRetries, stats.RetryBudget.NumRetries)
+	require.Equal(t, int64(kinds[ErrorKindRetryBudgetExhausted]), stats.RetryBudget.NumExhausted)
+}
+
+func TestReloadRetryBudget(t *testing.T) {
+	path := useConfigFile(t, "")
+	srv, err := NewServer(ServerOpts{Log: testLog})
+	require.Nil(t, err, err)
+	defer srv.Shutdown()
+	require.True(t, srv.webserver.retryBudget.Withdraw(time.Now())) // disabled by default
+
+	require.Nil(t, os.WriteFile(path, []byte("RETRY_BUDGET_RATIO=0.1\nRETRY_BUDGET_MIN_PER_SEC=0\nRETRY_BUDGET_BURST=1\n"), 0o600))
+	_, err = srv.ReloadConfig()
+	require.Nil(t, err, err)
+	stats := srv.webserver.retryBudget.Stats(time.Now())
+	require.Equal(t, RetryBudgetStats{Ratio: 0.1, MinPerSec: 0, Burst: 1, Tokens: 1}, stats)
+	require.True(t, srv.webserver.retryBudget.Withdraw(time.Now()))
+	require.False(t, srv.webserver.retryBudget.Withdraw(time.Now()))
+}
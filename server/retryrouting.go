@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Retry routing modes (RETRY_ROUTING): whether a retried request is passed on by the nodes which failed it already
+const (
+	RetryRoutingOff    = "off"    // any node may take the retry
+	RetryRoutingPrefer = "prefer" // passed on a few times, then processed by whichever node takes it
+	RetryRoutingStrict = "strict" // passed on as long as another healthy node exists
+)
+
+// retryPassDelay is the delay before a passed on retry is dispatched again, so that the workers of the failed node
+// don't take it right back while the other nodes are busy
+var retryPassDelay = 5 * time.Millisecond
+
+// NodeAttempt is a failed try of a request
+type NodeAttempt struct {
+	NodeURI   string
+	ErrorKind string
+}
+
+// ParseRetryRouting validates a retry routing mode ("" means prefer)
+func ParseRetryRouting(s string) (string, error) {
+	switch s {
+	case "":
+		return RetryRoutingPrefer, nil
+	case RetryRoutingOff, RetryRoutingPrefer, RetryRoutingStrict:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid retry routing: %s, must be one of off, prefer, strict", s)
+}
+
+// recordAttempt adds a failed response of a node to the attempts of the request
+func (r *SimRequest) recordAttempt(resp SimResponse) {
+	if resp.NodeURI != "" {
+		r.Attempts = append(r.Attempts, NodeAttempt{NodeURI: resp.NodeURI, ErrorKind: errorKind(resp)})
+	}
+}
+
+// failedOn returns whether a try of the request failed on the node
+func (r *SimRequest) failedOn(uri string) bool {
+	for _, attempt := range r.Attempts {
+		if attempt.NodeURI == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// attemptsError adds the failed tries to the final error, if there were several
+func (r *SimRequest) attemptsError(err error) error {
+	if len(r.Attempts) < 2 {
+		return err
+	}
+	attempts := make([]string, len(r.Attempts))
+	for i, attempt := range r.Attempts {
+		attempts[i] = fmt.Sprintf("%d. %s: %s", i+1, attempt.NodeURI, attempt.ErrorKind)
+	}
+	return fmt.Errorf("%w (tries: %s)", err, strings.Join(attempts, ", "))
+}
+
+// retryBackoff returns the delay before the retry of a request which failed tries times: RetryBackoff, doubled with
+// every further try, at most RetryBackoffMax (0 if disabled)
+func retryBackoff(tries int) time.Duration {
+	if RetryBackoff <= 0 || tries < 1 {
+		return 0
+	}
+	backoff := RetryBackoff
+	for i := 1; i < tries && backoff < RetryBackoffMax; i++ {
+		backoff *= 2
+	}
+	if RetryBackoffMax > 0 && backoff > RetryBackoffMax {
+		return RetryBackoffMax
+	}
+	return backoff
+}
+
+// SetRetryRouting changes whether nodes pass on the retries of requests which they failed already (see
+// RetryRoutingOff, RetryRoutingPrefer and RetryRoutingStrict)
+func (gp *NodePool) SetRetryRouting(mode string) error {
+	mode, err := ParseRetryRouting(mode)
+	if err != nil {
+		return err
+	}
+	gp.retryRouting.Store(mode)
+	return nil
+}
+
+// hasNodeOutside returns whether a healthy node with workers exists which the request didn't fail on
+func (gp *NodePool) hasNodeOutside(r *SimRequest) bool {
+	gp.nodesLock.Lock()
+	defer gp.nodesLock.Unlock()
+	for _, node := range gp.nodes {
+		if node.IsHealthy() && atomic.LoadInt32(&node.numWorkers) > 0 && !r.failedOn(node.URI) {
+			return true
+		}
+	}
+	return false
+}
+
+// passRetry passes a retried request on to the other nodes if it failed on the node already (depending on the retry
+// routing mode), and returns whether it did. In prefer mode it's passed on at most as many times as there are nodes.
+// Cancelled and expired requests are not passed on, the node answers them.
+func (gp *NodePool) passRetry(n *Node, r *SimRequest) bool {
+	if !r.failedOn(n.URI) || r.IsCancelled() || time.Now().After(r.Deadline()) {
+		return false
+	}
+	switch gp.retryRouting.Load() {
+	case RetryRoutingOff:
+		return false
+	case RetryRoutingPrefer, "":
+		if r.numRetryPasses >= gp.numNodes() {
+			return false
+		}
+	}
+	if !gp.hasNodeOutside(r) {
+		return false
+	}
+	r.numRetryPasses++
+	time.AfterFunc(retryPassDelay, func() { gp.handBack(r) })
+	return true
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func newRetryRoutingTestHandler(t *testing.T, nodes ...*testutils.FakeNode) (*NodePool, http.Handler) {
+	t.Helper()
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	t.Cleanup(prioQueue.Close)
+	nodePool := NewNodePool(testLog, nil, 1)
+	t.Cleanup(nodePool.Shutdown)
+	for _, node := range nodes {
+		require.Nil(t, nodePool.AddNode(node.URL))
+	}
+	go func() {
+		for job := prioQueue.Pop(); job != nil; job = prioQueue.Pop() {
+			nodePool.JobC <- job
+		}
+	}()
+	return nodePool, NewWebserver(testLog, ":12345", prioQueue, nodePool).Handler()
+}
+
+func TestRetryRouting(t *testing.T) {
+	broken := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer broken.Close()
+	healthy := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer healthy.Close()
+	nodePool, handler := newRetryRoutingTestHandler(t, broken, healthy)
+	broken.SetOpts(testutils.FakeNodeOpts{ErrorRate: 1}) // after the health check of AddNode
+	payload := []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+
+	for _, mode := range []string{RetryRoutingPrefer, RetryRoutingStrict} {
+		require.Nil(t, nodePool.SetRetryRouting(mode))
+		broken.Reset()
+		numRetried := 0
+		for i := 0; i < 20; i++ {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload)))
+			require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+			require.Equal(t, healthy.URL, rr.Header().Get("X-Node-URI"))
+			tries, err := strconv.Atoi(rr.Header().Get("X-Tries"))
+			require.Nil(t, err, err)
+			require.LessOrEqual(t, tries, 2, mode) // the retry of a failed first try succeeds on the healthy node
+			if tries == 2 {
+				numRetried++
+			}
+		}
+		require.Greater(t, numRetried, 0, mode)
+		require.Equal(t, numRetried, broken.NumRequests(), mode) // every request failed at most once on the broken node
+	}
+
+	require.Nil(t, nodePool.SetRetryRouting(""))
+	require.Equal(t, RetryRoutingPrefer, nodePool.retryRouting.Load())
+	require.NotNil(t, nodePool.SetRetryRouting("always"))
+}
+
+func TestRetryRoutingAttemptsError(t *testing.T) {
+	node1 := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node1.Close()
+	node2 := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node2.Close()
+	nodePool, handler := newRetryRoutingTestHandler(t, node1, node2)
+	require.Nil(t, nodePool.SetRetryRouting(RetryRoutingStrict))
+	node1.SetOpts(testutils.FakeNodeOpts{ErrorRate: 1, ErrorStatusCode: http.StatusServiceUnavailable})
+	node2.SetOpts(testutils.FakeNodeOpts{ErrorRate: 1, ErrorStatusCode: http.StatusServiceUnavailable})
+	node1.Reset() // the health checks of AddNode
+	node2.Reset()
+
+	// Both nodes are tried, then one of them again
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))))
+	require.Equal(t, strconv.Itoa(RequestMaxTries), rr.Header().Get("X-Tries"))
+	require.Equal(t, RequestMaxTries, node1.NumRequests()+node2.NumRequests())
+	require.GreaterOrEqual(t, node1.NumRequests(), 1)
+	require.GreaterOrEqual(t, node2.NumRequests(), 1)
+
+	// The error lists the tries (error responses of the nodes are returned unchanged, so check the SimRequest)
+	r := NewSimRequest(context.Background(), "", nil, false, false)
+	r.recordAttempt(SimResponse{NodeURI: node1.URL, StatusCode: http.StatusServiceUnavailable, Error: errors.New("503")})
+	require.Equal(t, "503", r.attemptsError(errors.New("503")).Error())
+	r.recordAttempt(SimResponse{NodeURI: node2.URL, Error: ErrNodeTimeout})
+	err := r.attemptsError(ErrNodeTimeout)
+	require.ErrorIs(t, err, ErrNodeTimeout)
+	require.Equal(t, "node timeout (tries: 1. "+node1.URL+": node_error, 2. "+node2.URL+": node_timeout)", err.Error())
+	require.True(t, r.failedOn(node2.URL))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(backoff, backoffMax time.Duration) { RetryBackoff, RetryBackoffMax = backoff, backoffMax }(RetryBackoff, RetryBackoffMax)
+	RetryBackoff, RetryBackoffMax = 50*time.Millisecond, 300*time.Millisecond
+	for tries, expected := range []time.Duration{0, 50, 100, 200, 300, 300} {
+		require.Equal(t, expected*time.Millisecond, retryBackoff(tries), tries)
+	}
+	RetryBackoff = 0
+	require.Equal(t, time.Duration(0), retryBackoff(2))
+
+	// The retries are queued after the backoff
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{})
+	defer node.Close()
+	_, handler := newRetryRoutingTestHandler(t, node)
+	node.SetOpts(testutils.FakeNodeOpts{ErrorRate: 1})
+	RetryBackoff, RetryBackoffMax = 40*time.Millisecond, 60*time.Millisecond
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))))
+	require.Equal(t, strconv.Itoa(RequestMaxTries), rr.Header().Get("X-Tries"))
+	require.Equal(t, ErrorKindNodeError, rr.Header().Get("X-Error-Kind"))
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond) // 40ms + 60ms (capped)
+}
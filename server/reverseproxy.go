@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPRequest is the client request of the reverse proxy route (REVERSE_PROXY_PATH), which nodes in reverse proxy
+// mode (`_proxy=1`) reconstruct against their base URI
+type HTTPRequest struct {
+	Method   string
+	Path     string      // below the reverse proxy path, starting with "/"
+	RawQuery string      // the query string, without "?"
+	Header   http.Header // only the REVERSE_PROXY_HEADERS
+}
+
+// ParseHeaderAllowlist parses a comma separated list of header names
+func ParseHeaderAllowlist(s string) []string {
+	headers := []string{}
+	for _, header := range strings.Split(s, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, http.CanonicalHeaderKey(header))
+		}
+	}
+	return headers
+}
+
+// captureHTTPRequest returns the method, the path below prefix, the query string and the allowlisted headers of req
+func captureHTTPRequest(req *http.Request, prefix string, headers []string) *HTTPRequest {
+	path := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(prefix, "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	captured := &HTTPRequest{
+		Method:   req.Method,
+		Path:     path,
+		RawQuery: req.URL.RawQuery,
+		Header:   make(http.Header),
+	}
+	for _, header := range headers {
+		if values := req.Header.Values(header); len(values) > 0 {
+			captured.Header[header] = append([]string{}, values...)
+		}
+	}
+	return captured
+}
+
+// reverseProxyURL returns the URL of the request at the node: the path is appended to the path of the base URI, and
+// the query string to its query params (without the `_` params of the balancer)
+func reverseProxyURL(baseURI string, r *HTTPRequest) (string, error) {
+	u, err := url.Parse(baseURI)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.Path
+	u.RawPath = ""
+
+	query := u.Query()
+	for key := range query {
+		if strings.HasPrefix(key, "_") {
+			query.Del(key)
+		}
+	}
+	u.RawQuery = query.Encode()
+	if r.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += r.RawQuery
+	}
+	return u.String(), nil
+}
+
+// HandleReverseProxyRequest queues a request of any method below REVERSE_PROXY_PATH like a sim request, with its
+// method, path, query string and allowlisted headers for the nodes in reverse proxy mode
+func (s *Webserver) HandleReverseProxyRequest(w http.ResponseWriter, req *http.Request) {
+	s.handleQueueRequest(w, req, captureHTTPRequest(req, s.pathPrefix+ReverseProxyPath, ReverseProxyHeaders))
+}
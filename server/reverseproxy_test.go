@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseProxyURL(t *testing.T) {
+	uri, err := reverseProxyURL("http://node:8545/base/?_workers=2&key=1", &HTTPRequest{Path: "/v1/items", RawQuery: "a=1&b=x%20y"})
+	require.Nil(t, err)
+	require.Equal(t, "http://node:8545/base/v1/items?key=1&a=1&b=x%20y", uri)
+
+	uri, err = reverseProxyURL("http://node:8545?_proxy=1", &HTTPRequest{Path: "/"})
+	require.Nil(t, err)
+	require.Equal(t, "http://node:8545/", uri)
+}
+
+func TestParseHeaderAllowlist(t *testing.T) {
+	require.Equal(t, []string{}, ParseHeaderAllowlist(""))
+	require.Equal(t, []string{"Accept", "X-Api-Version"}, ParseHeaderAllowlist("accept, x-api-version,"))
+}
+
+func TestReverseProxy(t *testing.T) {
+	_ReverseProxyPath, _ReverseProxyHeaders := ReverseProxyPath, ReverseProxyHeaders
+	defer func() { ReverseProxyPath, ReverseProxyHeaders = _ReverseProxyPath, _ReverseProxyHeaders }()
+	ReverseProxyPath, ReverseProxyHeaders = "/api", ParseHeaderAllowlist("Accept,Content-Type,X-Api-Version")
+
+	// The requests received by the node (except health checks)
+	type nodeRequest struct {
+		method, path, query string
+		header              http.Header
+		body                string
+	}
+	var lock sync.Mutex
+	var received []nodeRequest
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if strings.Contains(string(body), "net_version") {
+			w.Write([]byte(`{"jsonrpc":"2.0","result":"1","id":123}`)) //nolint:errcheck
+			return
+		}
+		lock.Lock()
+		received = append(received, nodeRequest{req.Method, req.URL.Path, req.URL.RawQuery, req.Header.Clone(), string(body)})
+		lock.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok " + req.Method)) //nolint:errcheck
+	}))
+	defer nodeServer.Close()
+	lastRequest := func() nodeRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		require.NotEmpty(t, received)
+		return received[len(received)-1]
+	}
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	defer prioQueue.Close()
+	nodePool := NewNodePool(testLog, nil, 1)
+	defer nodePool.Shutdown()
+	require.Nil(t, nodePool.AddNode(nodeServer.URL+"/base?_proxy=1"))
+	go func() {
+		for job := prioQueue.Pop(); job != nil; job = prioQueue.Pop() {
+			nodePool.JobC <- job
+		}
+	}()
+	handler := NewWebserver(testLog, ":12345", prioQueue, nodePool).Handler()
+
+	// GET with query params, only the allowlisted headers are forwarded
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/items?status=open&limit=10", nil)
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("X-Api-Version", "2")
+	req.Header.Set("Cookie", "secret=1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "ok GET", rr.Body.String())
+	require.Equal(t, "text/plain", rr.Header().Get("Content-Type"))
+	res := lastRequest()
+	require.Equal(t, http.MethodGet, res.method)
+	require.Equal(t, "/base/v1/items", res.path)
+	require.Equal(t, "status=open&limit=10", res.query)
+	require.Equal(t, "text/plain", res.header.Get("Accept"))
+	require.Equal(t, "2", res.header.Get("X-Api-Version"))
+	require.Empty(t, res.header.Get("Cookie"))
+	require.NotEmpty(t, res.header.Get("X-Request-ID"))
+	require.Empty(t, res.body)
+
+	// PUT with a body, which doesn't need to be JSON
+	req = httptest.NewRequest(http.MethodPut, "/api/v1/items/7", bytes.NewBufferString("name=foo"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-High-Priority", "true")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "ok PUT", rr.Body.String())
+	res = lastRequest()
+	require.Equal(t, http.MethodPut, res.method)
+	require.Equal(t, "/base/v1/items/7", res.path)
+	require.Empty(t, res.query)
+	require.Equal(t, "application/x-www-form-urlencoded", res.header.Get("Content-Type"))
+	require.Equal(t, "name=foo", res.body)
+
+	// Sim requests are still posted to the node URI
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	res = lastRequest()
+	require.Equal(t, http.MethodPost, res.method)
+	require.Equal(t, "/base", res.path)
+	require.Equal(t, "_proxy=1", res.query)
+	require.Equal(t, "application/json", res.header.Get("Accept"))
+}
@@ -2,112 +2,585 @@ package server
 
 import (
 	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 type ServerOpts struct {
 	Log            *zap.SugaredLogger
 	HTTPAddrPtr    string // listen address for the webserver
-	RedisURI       string // (optional) URI for the redis instance. If empty then don't use Redis.
+	RedisURI       string // (optional) URI for the redis instance, sentinel or cluster (see ParseRedisURI). If empty then don't use Redis.
+	StateFile      string // (optional) JSON file to store the nodes and tenants in, instead of Redis
+	State          State  // (optional) custom state implementation, instead of RedisURI or StateFile
 	WorkersPerNode int32  // Number of concurrent workers per execution node
+
+	HTTPSAddr   string // (optional) listen address for the TLS webserver. Can be used together with HTTPAddrPtr.
+	TLSCertFile string // certificate for the TLS webserver (reloaded automatically when changed)
+	TLSKeyFile  string // key for the TLS webserver (reloaded automatically when changed)
+
+	AdminAddr string // (optional) separate listen address for the admin routes. If set, they are not served on HTTPAddrPtr and HTTPSAddr.
+
+	LogLevel *zap.AtomicLevel // (optional) level of Log, enables changing it at runtime with /admin/loglevel
+
+	PathPrefix string // (optional) serve all routes under this prefix, i.e. "/simulation"
+
+	MetricsSink MetricsSink // (optional) custom metrics sink, used together with DogStatsD (METRICS_STATSD_ADDR) if that is enabled
+
+	PayloadRedactor PayloadRedactor // (optional) custom redaction of the payloads logged with PAYLOAD_LOG_SAMPLING, applied after PAYLOAD_LOG_REDACT_PATHS and PAYLOAD_LOG_REDACT_REGEX
 }
 
 // Server is the overall load balancer server
 type Server struct {
-	log       *zap.SugaredLogger
-	opts      ServerOpts
-	redis     *RedisState
-	prioQueue *PrioQueue
-	nodePool  *NodePool
-	webserver *Webserver
+	log        *zap.SugaredLogger
+	opts       ServerOpts
+	state      State       // nil if neither Redis nor a state file is used
+	redis      *RedisState // set if the state is in redis
+	prioQueue  Queue
+	nodePool   *NodePool
+	webserver  *Webserver
+	certLoader *CertLoader
+
+	lowPrioScheduler *LowPrioScheduler      // nil with multi-tenancy
+	reservations     *FastTrackReservations // nil with multi-tenancy
+
+	simIPFilter   *IPFilter
+	adminIPFilter *IPFilter
+
+	shutdownTracing func(context.Context) error // set if tracing is enabled
+	dogStatsD       *DogStatsD                  // set if METRICS_STATSD_ADDR is set
+	metrics         MetricsSink                 // nil if no metrics sink is used
+	prometheus      *PrometheusMetrics          // set if METRICS_PROMETHEUS=1
+
+	configReloadLock  sync.Mutex         // one ReloadConfig at a time
+	healthCheckLock   sync.Mutex         // guards healthCheckCancel
+	healthCheckCancel context.CancelFunc // stops the health checks, set once Run started them
+
+	shutdownOnce sync.Once
+	done         chan struct{} // closed when Shutdown completed
+
+	cancelContext context.Context
+	cancelFunc    context.CancelFunc
 }
 
-// NewServer creates a new Server instance, loads the nodes from Redis and starts the node workers
+// NewServer creates a new Server instance, loads the nodes from the state (Redis, a state file or opts.State) and
+// starts the node workers
 func NewServer(opts ServerOpts) (*Server, error) {
 	var err error
 	s := Server{
-		opts:      opts,
-		log:       opts.Log,
-		prioQueue: NewPrioQueue(MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio, FastTrackPerHighPrio, FastTrackDrainFirst),
+		opts: opts,
+		log:  opts.Log,
+		done: make(chan struct{}),
+	}
+	if _, _, err := configValues.get(); err != nil {
+		return nil, errors.Wrap(err, "loading CONFIG_FILE failed")
 	}
 
-	if s.opts.RedisURI == "" {
+	numStates := 0
+	for _, isSet := range []bool{s.opts.RedisURI != "", s.opts.StateFile != "", s.opts.State != nil} {
+		if isSet {
+			numStates++
+		}
+	}
+	if numStates > 1 {
+		return nil, errors.New("only one of RedisURI, StateFile and State can be used")
+	} else if s.opts.State != nil {
+		s.state = s.opts.State
+	} else if s.opts.StateFile != "" {
+		s.log.Infow("Using state file", "path", s.opts.StateFile)
+		s.state, err = NewFileState(s.opts.StateFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if s.opts.RedisURI == "" {
 		s.log.Info("Not using Redis because no RedisURI provided")
 	} else {
-		s.log.Infow("Connecting to Redis", "URI", s.opts.RedisURI)
-		s.redis, err = NewRedisState(s.opts.RedisURI)
+		s.log.Infow("Connecting to Redis", "URI", RedactRedisURI(s.opts.RedisURI))
+		redisConfig := RedisConnConfigFromEnv()
+		redisConfig.AllowDegradedStart = true
+		s.redis, err = NewRedisState(s.log, s.opts.RedisURI, redisConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		if !s.redis.IsDegraded() {
+			if err := s.migrateRedis(); err != nil {
+				return nil, err
+			}
+		} else {
+			// before loading the nodes (callbacks are called in order)
+			s.redis.OnRecovered(func() {
+				if err := s.migrateRedis(); err != nil {
+					s.log.Errorw("Redis migration failed", "error", err)
+				}
+			})
+		}
+		s.state = s.redis
+	}
+
+	if TracingEnabled {
+		s.log.Info("Exporting traces with OTLP")
+		s.shutdownTracing, err = EnableTracing(context.Background())
+		if err != nil {
+			return nil, errors.Wrap(err, "enabling tracing failed")
+		}
+	}
+
+	s.prioQueue, err = s.newQueue()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.opts.HTTPSAddr != "" {
+		s.certLoader, err = NewCertLoader(s.log, s.opts.TLSCertFile, s.opts.TLSKeyFile)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	s.simIPFilter, err = NewIPFilterFromConfig(SimAllowCIDRs, SimDenyCIDRs, TrustedProxyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	s.adminIPFilter, err = NewIPFilterFromConfig(AdminAllowCIDRs, AdminDenyCIDRs, TrustedProxyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
 	if opts.WorkersPerNode == 0 {
 		s.log.Warn("WorkersPerNode is 0! This is not recommended. Use at least 1.")
 	}
 
-	s.nodePool = NewNodePool(s.log, s.redis, s.opts.WorkersPerNode)
-	err = s.nodePool.LoadNodesFromRedis()
+	if MetricsStatsDAddr != "" {
+		s.log.Infow("Sending metrics to DogStatsD", "addr", MetricsStatsDAddr)
+		s.dogStatsD, err = NewDogStatsD(MetricsStatsDAddr, DogStatsDOpts{
+			Prefix:         MetricsStatsDPrefix,
+			Tags:           splitCommaList(MetricsStatsDTags),
+			SampleRate:     MetricsStatsDSampleRate,
+			MaxPacketBytes: MetricsStatsDMaxPacketBytes,
+			FlushInterval:  MetricsStatsDFlushInterval,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to DogStatsD failed")
+		}
+		s.metrics = NewMetricsSink(s.dogStatsD, s.opts.MetricsSink)
+	} else if s.opts.MetricsSink != nil {
+		s.metrics = s.opts.MetricsSink
+	}
+
+	if _, err := healthCheckProbeArg(nil); err != nil {
+		return nil, errors.Wrap(err, "invalid NODE_HEALTHCHECK_* settings")
+	}
+	s.nodePool = NewNodePool(s.log, s.state, s.opts.WorkersPerNode)
+	s.nodePool.SetMetricsSink(s.metrics)
+	if MetricsPrometheus {
+		s.prometheus = NewPrometheusMetrics(ProxyLatencyBuckets)
+		s.nodePool.SetPrometheusMetrics(s.prometheus)
+	}
+	if NodeAdaptiveWorkers {
+		config := &AdaptiveWorkersConfig{Window: NodeAdaptiveWindow, DecreaseErrorRate: NodeAdaptiveDecreaseErrorRate, IncreaseErrorRate: NodeAdaptiveIncreaseErrorRate}
+		if err := s.nodePool.SetAdaptiveWorkers(config); err != nil {
+			return nil, errors.Wrap(err, "invalid NODE_ADAPTIVE_*")
+		}
+		s.log.Infow("Adaptive node workers enabled", "window", config.Window, "decreaseErrorRate", config.DecreaseErrorRate, "increaseErrorRate", config.IncreaseErrorRate)
+	}
+	if NodeBreakerThreshold > 0 {
+		config := &CircuitBreakerConfig{Threshold: NodeBreakerThreshold, CoolDown: NodeBreakerCoolDown}
+		if err := s.nodePool.SetCircuitBreaker(config); err != nil {
+			return nil, errors.Wrap(err, "invalid NODE_BREAKER_*")
+		}
+		s.log.Infow("Node circuit breakers enabled", "threshold", config.Threshold, "coolDown", config.CoolDown)
+	}
+	if nodeTLS := (NodeTLSConfig{CertFile: NodeTLSCertFile, KeyFile: NodeTLSKeyFile, CAFile: NodeTLSCAFile, ServerName: NodeTLSServerName}); !nodeTLS.isZero() {
+		if err := s.nodePool.SetNodeTLS(&nodeTLS); err != nil {
+			return nil, errors.Wrap(err, "invalid NODE_TLS_*")
+		}
+		s.log.Infow("Node TLS config set", "certFile", nodeTLS.CertFile, "caFile", nodeTLS.CAFile, "serverName", nodeTLS.ServerName)
+	}
+	err = s.nodePool.LoadNodes()
+	if errors.Is(err, ErrRedisDegraded) {
+		// Serve with the nodes added at runtime, and add the saved ones once redis is available
+		s.log.Warn("Starting without the nodes saved in redis, they are loaded when redis is available again")
+		s.redis.OnRecovered(func() {
+			if err := s.nodePool.LoadNodes(); err != nil {
+				s.log.Errorw("Loading nodes from redis failed", "error", err)
+			}
+		})
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.webserver = NewWebserver(s.log, s.opts.HTTPAddrPtr, s.prioQueue, s.nodePool)
+	s.webserver.SetIPFilters(s.simIPFilter, s.adminIPFilter)
+	s.webserver.SetPathPrefix(s.opts.PathPrefix)
+	if s.opts.LogLevel != nil {
+		s.webserver.EnableLogLevelAdjustment(*s.opts.LogLevel)
+	}
+	if s.metrics != nil {
+		s.webserver.SetMetricsSink(s.metrics)
+	}
+	if s.prometheus != nil {
+		s.log.Info("Serving Prometheus metrics on /metrics")
+		s.webserver.EnablePrometheus(s.prometheus)
+	}
+	priorityRules, err := ParsePriorityRules(PriorityRulesConfig)
 	if err != nil {
+		return nil, errors.Wrap(err, "invalid PRIORITY_RULES")
+	}
+	if err := s.webserver.SetPriorityRules(priorityRules); err != nil {
 		return nil, err
 	}
+	responseRules, err := ParseResponseRules(ResponseValidation)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid RESPONSE_VALIDATION")
+	}
+	if responseRules.Enabled() {
+		s.nodePool.SetResponseValidator(responseRules.Validator())
+	}
+	if err := s.nodePool.SetRetryRouting(RetryRouting); err != nil {
+		return nil, errors.Wrap(err, "invalid RETRY_ROUTING")
+	}
+	nodeSelector, err := ParseNodeSelection(NodeSelection)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid NODE_SELECTION")
+	}
+	s.nodePool.SetNodeSelector(nodeSelector)
+	s.nodePool.SetStopUnhealthyWorkers(NodeHealthCheckStopWorkers)
+	s.nodePool.SetRequeue(s.prioQueue.Push)
+	s.webserver.EnableConfigReload(s.ReloadConfig)
+	s.webserver.EnableShutdown(s.StartShutdown)
+	if s.opts.AdminAddr != "" {
+		s.webserver.EnableAdminListener(s.opts.AdminAddr)
+	}
+	if s.certLoader != nil {
+		s.webserver.EnableTLS(s.opts.HTTPSAddr, s.certLoader)
+	}
+	if PayloadLogSampling.Enabled() {
+		redactor, err := NewPayloadRedactorFromConfig(PayloadLogRedactPaths, PayloadLogRedactRegex)
+		if err != nil {
+			return nil, err
+		}
+		redactor = ChainRedactors(redactor, s.opts.PayloadRedactor)
+		s.webserver.EnablePayloadLogging(NewPayloadLogger(s.log, PayloadLogSampling, PayloadLogMaxBytes, redactor))
+	}
+	if RecordFile != "" && RecordRedis {
+		return nil, errors.New("only one of RECORD_FILE and RECORD_REDIS can be used")
+	} else if RecordFile != "" {
+		s.log.Infow("Recording the submitted requests", "path", RecordFile)
+		store, err := NewFileRecordingStore(RecordFile)
+		if err != nil {
+			return nil, err
+		}
+		s.webserver.EnableRecording(NewRequestRecorder(s.log, store, RecordBufferSize))
+	} else if RecordRedis {
+		if s.redis == nil {
+			s.log.Warn("Recording to a redis stream requires redis, not recording the requests")
+		} else {
+			s.log.Info("Recording the submitted requests to redis")
+			s.webserver.EnableRecording(NewRequestRecorder(s.log, s.redis, RecordBufferSize))
+		}
+	}
+	if signer := NewResponseSigner(ResponseSigningKey, ResponseSigningKeySecondary); signer != nil {
+		s.log.Info("Signing the sim responses")
+		s.webserver.EnableResponseSigning(signer)
+	}
+	if limits := (ClientQueueLimits{Total: ClientMaxQueued, FastTrack: ClientMaxQueuedFastTrack, HighPrio: ClientMaxQueuedHighPrio, LowPrio: ClientMaxQueuedLowPrio}); limits != (ClientQueueLimits{}) {
+		s.log.Infow("Limiting the queued requests per client", "limits", limits)
+		s.webserver.EnableClientQueueLimits(limits)
+	}
+	if DuplicateMaxSubmissions > 0 {
+		s.log.Infow("Rejecting duplicate submissions", "maxSubmissions", DuplicateMaxSubmissions, "window", DuplicateWindow, "exemptFastTrack", DuplicateExemptFastTrack)
+		s.webserver.EnableDuplicateLimiter(NewDuplicateLimiter(DuplicateMaxSubmissions, DuplicateWindow, DuplicateMaxEntries, DuplicateExemptFastTrack))
+	}
+	if q, ok := s.prioQueue.(*PrioQueue); ok {
+		scheduler, err := newLowPrioSchedulerFromEnv(s.log, q)
+		if err != nil {
+			return nil, err
+		}
+		s.lowPrioScheduler = scheduler
+		s.webserver.EnableLowPrioScheduler(scheduler)
+
+		var store ReservationStore
+		if s.redis != nil {
+			store = s.redis
+		}
+		s.reservations = NewFastTrackReservations(s.log, q, store)
+		if err := s.reservations.Sync(); err != nil {
+			s.log.Warnw("Loading the fast-track reservations from redis failed, retrying periodically", "error", err)
+		}
+		s.webserver.EnableFastTrackReservations(s.reservations)
+	} else if LowPrioSchedule != "" {
+		return nil, errors.New("LOWPRIO_SCHEDULE is not supported with multi-tenancy")
+	}
+	if Peers != "" {
+		peers, err := ParsePeers(Peers)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid PEERS")
+		}
+		s.log.Infow("Forwarding the rejected requests to peers", "peers", peers, "maxHops", PeerMaxHops)
+		s.webserver.EnablePeerForwarding(NewPeerForwarder(peers, PeerMaxHops, PeerStatusCacheTTL, PeerForwardTimeout))
+	}
+	if apiKeys := splitCommaList(DryRunAPIKeys); len(apiKeys) > 0 {
+		s.log.Infow("Dry runs enabled", "numAPIKeys", len(apiKeys), "maxConcurrent", DryRunMaxConcurrent)
+		s.webserver.EnableDryRuns(NewDryRunner(apiKeys, DryRunMaxConcurrent))
+	}
+	// The retry budget is always created, so that it can be enabled by a config reload
+	s.webserver.EnableRetryBudget(NewRetryBudget(RetryBudgetRatio, RetryBudgetMinPerSec, RetryBudgetBurst))
+	if ShedHighPrioDepth > 0 || ShedHighPrioAge > 0 {
+		s.log.Infow("Load shedding enabled", "highPrioDepth", ShedHighPrioDepth, "highPrioAge", ShedHighPrioAge, "flushLowPrio", ShedFlushLowPrio)
+		s.webserver.EnableLoadShedding(NewLoadShedder(ShedHighPrioDepth, ShedHighPrioAge, ShedResumeFraction), ShedFlushLowPrio)
+	}
+	if CallbackWorkers > 0 {
+		s.log.Infow("Callbacks enabled", "workers", CallbackWorkers, "allowedHosts", CallbackAllowedHosts)
+		s.webserver.EnableCallbacks(NewCallbackSender(s.log, CallbackOpts{
+			Workers:      CallbackWorkers,
+			QueueSize:    CallbackQueueSize,
+			MaxTries:     CallbackMaxTries,
+			RetryBackoff: CallbackRetryBackoff,
+			Timeout:      CallbackTimeout,
+			AllowedHosts: splitCommaList(CallbackAllowedHosts),
+		}))
+	}
+	if AuditTTL > 0 {
+		if s.redis == nil {
+			s.log.Warn("Audit records require redis, not recording them")
+		} else {
+			s.webserver.EnableAudit(NewAuditSink(s.log, s.redis, AuditTTL, AuditBufferSize))
+		}
+	}
+	if s.redis != nil {
+		s.webserver.SetAsyncResultStore(s.redis)
+	}
+	if QueuePersistenceRedisURI != "" {
+		store, err := NewRedisState(s.log, QueuePersistenceRedisURI, RedisConnConfigFromEnv())
+		if err != nil {
+			return nil, errors.Wrap(err, "queue persistence redis")
+		}
+		s.webserver.EnableQueuePersistence(NewQueuePersistence(s.log, store, QueuePersistenceBufferSize))
+		restored, err := s.webserver.RestoreQueue()
+		if err != nil {
+			s.log.Errorw("Restoring the persisted queue failed", "error", err)
+		} else {
+			s.log.Infow("Queue persistence enabled", "redisURI", RedactRedisURI(QueuePersistenceRedisURI), "numRestored", restored)
+		}
+	}
 
+	s.cancelContext, s.cancelFunc = context.WithCancel(context.Background())
 	return &s, nil
 }
 
+// migrateRedis copies the keys of the default prefix to RedisPrefix if it differs, and runs the schema migrations.
+// Fails if redis was migrated by a newer version of the load balancer.
+func (s *Server) migrateRedis() error {
+	if RedisPrefix != DefaultRedisPrefix {
+		migrated, err := s.redis.MigrateKeys(DefaultRedisPrefix)
+		if err != nil {
+			return errors.Wrap(err, "redis key migration failed")
+		}
+		if len(migrated) > 0 {
+			s.log.Infow("Copied redis keys to the new prefix", "prefix", RedisPrefix, "keys", migrated)
+		}
+	}
+
+	applied, err := s.redis.Migrate()
+	if err != nil {
+		return errors.Wrap(err, "redis schema migration failed")
+	}
+	if len(applied) > 0 {
+		s.log.Infow("Migrated redis to the latest schema", "schemaVersion", RedisSchemaVersion, "migrations", applied)
+	}
+	return nil
+}
+
+// newQueue returns a TenantQueue if tenants are configured (in the state, or with TENANTS), otherwise a PrioQueue
+func (s *Server) newQueue() (Queue, error) {
+	tenants, err := ParseTenants(TenantsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid TENANTS")
+	}
+
+	if s.state != nil {
+		savedTenants, err := s.state.GetTenants()
+		if errors.Is(err, ErrRedisDegraded) {
+			// don't save, to not overwrite the saved tenants when redis is available again
+			s.log.Warn("Redis unavailable, using the tenants of TENANTS instead of the ones saved in redis")
+		} else if err != nil {
+			return nil, err
+		} else if savedTenants != nil {
+			tenants = savedTenants
+		} else if len(tenants) > 0 {
+			if err := s.state.SaveTenants(tenants); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	order := SmallestFirstOrder{
+		FastTrack: SmallestFirstFastTrack,
+		HighPrio:  SmallestFirstHighPrio,
+		LowPrio:   SmallestFirstLowPrio,
+		MaxSkips:  SmallestFirstMaxSkips,
+		MaxWait:   SmallestFirstMaxWait,
+	}
+	aging := PriorityAging{LowPrioAfter: PromoteLowPrioAfter, HighPrioAfter: PromoteHighPrioAfter}
+	if len(tenants) == 0 {
+		q := NewPrioQueue(MaxQueueItemsFastTrack, MaxQueueItemsHighPrio, MaxQueueItemsLowPrio, FastTrackPerHighPrio, FastTrackDrainFirst, aging)
+		q.SetSmallestFirst(order)
+		q.SetPriorityLevels(PriorityLevels)
+		q.SetInterleaveWeights(FastTrackPerHighPrio, HighPrioWeight)
+		q.SetCoalescing(CoalesceRequests)
+		return q, nil
+	}
+	s.log.Infow("Multi-tenancy enabled", "numTenants", len(tenants))
+	q, err := NewTenantQueue(tenants, s.state, FastTrackPerHighPrio, FastTrackDrainFirst, aging)
+	if err != nil {
+		return nil, err
+	}
+	q.SetSmallestFirst(order)
+	q.SetPriorityLevels(PriorityLevels)
+	q.SetInterleaveWeights(FastTrackPerHighPrio, HighPrioWeight)
+	q.SetCoalescing(CoalesceRequests)
+	return q, nil
+}
+
+// Handler returns the HTTP handler with all routes, for mounting the load balancer into an existing server (i.e.
+// `mux.Handle("/simulation/", s.Handler())` with PathPrefix "/simulation"). Use it together with Run instead of Start.
+func (s *Server) Handler() http.Handler {
+	return s.webserver.Handler()
+}
+
 // Start starts the webserver and the main loop (pumping jobs from the queue to the workers)
 func (s *Server) Start() {
-	// Setup and start the webserver
 	s.log.Infow("Starting webserver", "listenAddr", s.opts.HTTPAddrPtr)
-	s.webserver = NewWebserver(s.log, s.opts.HTTPAddrPtr, s.prioQueue, s.nodePool)
+	if s.certLoader != nil {
+		go s.certLoader.Watch(s.cancelContext, TLSCertReloadInterval)
+	}
+	go s.nodePool.WatchNodeCertificates(s.cancelContext, TLSCertReloadInterval)
 	s.webserver.Start()
+	s.Run()
+}
+
+// Run runs the node health checks and the main loop (pumping jobs from the queue to the workers), without starting
+// the webserver. Blocks until Shutdown is called.
+func (s *Server) Run() {
+	if s.redis != nil {
+		go s.redis.RunReplay(s.cancelContext, RedisReplayInterval)
+	}
+	s.startHealthChecks()
+	go s.webserver.RunStatsLog(s.cancelContext, StatsLogInterval)
+	go s.webserver.RunLoadShedding(s.cancelContext, ShedCheckInterval)
+	if s.lowPrioScheduler != nil {
+		go s.lowPrioScheduler.Run(s.cancelContext)
+	}
+	if s.reservations != nil {
+		go s.reservations.Run(s.cancelContext, ReservationSyncInterval)
+	}
+	if s.metrics != nil {
+		go s.webserver.RunMetricsGauges(s.cancelContext, MetricsGaugeInterval)
+	}
 
 	// Main loop: send simqueue jobs to node pool
 	s.log.Info("Starting main loop")
 	for {
-		r := s.prioQueue.Pop()
-		if r == nil { // Shutdown (queue.Close() was called)
+		r := s.prioQueue.PopCtx(s.cancelContext)
+		if r == nil { // Shutdown (queue.Close() was called, or the server was stopped)
 			s.log.Info("Shutting down main loop (request is nil)")
 			return
 		}
 
-		if r.Cancelled {
+		if r.IsCancelled() {
+			r.skip()
 			continue
 		}
 
-		if time.Since(r.CreatedAt) > RequestTimeout {
-			s.log.Info("request timed out before processing")
-			r.SendResponse(SimResponse{Error: ErrRequestTimeout})
+		if s.webserver.shutdown.isFlushing() { // the shutdown grace period passed
+			s.webserver.shutdown.numFlushed.Inc()
+			r.SendResponse(SimResponse{Error: ErrShuttingDown, StatusCode: http.StatusServiceUnavailable})
 			continue
 		}
 
-		// Return an error if no nodes are available
-		if len(s.nodePool.nodes) == 0 {
-			s.log.Error("no execution nodes available")
-			r.SendResponse(SimResponse{Error: ErrNoNodesAvailable})
+		if time.Now().After(r.Deadline()) {
+			s.log.Info("request timed out before processing")
+			r.SendResponse(SimResponse{Error: r.timeoutError()})
 			continue
 		}
 
 		// Forward to a node for processing
-		select {
-		case s.nodePool.JobC <- r:
+		err := s.nodePool.Dispatch(r, ServerJobSendTimeout)
+		switch {
+		case err == nil:
 			// Job was taken by a node
-		case <-time.After(ServerJobSendTimeout):
+			continue
+		case errors.Is(err, ErrNoNodesAvailable):
+			s.log.Error("no execution nodes available")
+		default:
 			// Job was NOT taken by a node - cancel request
 			s.log.Warnw("job was not taken by a node", "requestsInQueue", s.prioQueue.NumRequests())
-			r.SendResponse(SimResponse{Error: ErrNodeTimeout})
 		}
+		r.SendResponse(SimResponse{Error: err})
+	}
+}
+
+// startHealthChecks starts the node health checks every NodeHealthCheckInterval (if it is above 0), and stops the
+// previous ones
+func (s *Server) startHealthChecks() {
+	s.healthCheckLock.Lock()
+	defer s.healthCheckLock.Unlock()
+	if s.healthCheckCancel != nil {
+		s.healthCheckCancel()
+	}
+	var ctx context.Context
+	ctx, s.healthCheckCancel = context.WithCancel(s.cancelContext)
+	if NodeHealthCheckInterval > 0 {
+		go s.nodePool.RunHealthChecks(ctx, NodeHealthCheckInterval)
+	}
+}
+
+// restartHealthChecks applies a changed NodeHealthCheckInterval, if Run started the health checks already
+func (s *Server) restartHealthChecks() {
+	s.healthCheckLock.Lock()
+	started := s.healthCheckCancel != nil
+	s.healthCheckLock.Unlock()
+	if started {
+		s.startHealthChecks()
 	}
 }
 
 // Shutdown gracefully shuts down the server. Allows ongoing requests to complete, but no
-// further requests will be accepted or those from the queue processed.
+// further requests will be accepted or those from the queue processed. See StartShutdown to drain the queue first.
 func (s *Server) Shutdown() {
-	s.log.Info("Shutting down server")
-	s.prioQueue.Close()
-	s.webserver.srv.Shutdown(context.Background()) // stop incoming requests
-	s.nodePool.Shutdown()                          // stop the execution workers
+	s.shutdownOnce.Do(func() {
+		s.log.Info("Shutting down server")
+		s.cancelFunc()
+		s.prioQueue.Close()
+		s.webserver.Shutdown(context.Background()) // stop incoming requests
+		s.nodePool.Shutdown()                      // stop the execution workers
+		if s.dogStatsD != nil {
+			s.dogStatsD.Close() // flush the buffered metrics
+		}
+		if s.shutdownTracing != nil {
+			if err := s.shutdownTracing(context.Background()); err != nil { // flush the pending spans
+				s.log.Errorw("Flushing traces failed", "error", err)
+			}
+		}
+		s.webserver.shutdown.setState(ShutdownStateStopped)
+		close(s.done)
+	})
+}
+
+// ReloadCertificate reloads the TLS certificate and the client certificates of the nodes from disk (i.e. on SIGHUP)
+func (s *Server) ReloadCertificate() error {
+	if err := s.nodePool.ReloadNodeCertificates(); err != nil {
+		return err
+	}
+	if s.certLoader == nil {
+		return nil
+	}
+	return s.certLoader.Reload()
 }
 
 // AddNode adds a new execution node to the pool and starts the workers. If a new node is added,
@@ -120,7 +593,7 @@ func (s *Server) AddNode(uri string) error {
 func (s *Server) NumNodeWorkersAlive() int {
 	res := 0
 	for _, n := range s.nodePool.nodes {
-		res += int(n.curWorkers)
+		res += int(atomic.LoadInt32(&n.curWorkers))
 	}
 	return res
 }
@@ -128,3 +601,20 @@ func (s *Server) NumNodeWorkersAlive() int {
 func (s *Server) QueueSize() (lenFastTrack, lenHighPrio, lenLowPrio int) {
 	return s.prioQueue.Len()
 }
+
+// UseProxyMiddleware registers middlewares around the proxy calls of the node workers, in the order they run (see
+// ProxyMiddleware)
+func (s *Server) UseProxyMiddleware(middlewares ...ProxyMiddleware) {
+	s.nodePool.UseProxyMiddleware(middlewares...)
+}
+
+// SetResponseValidator sets the validator of the successful node responses (see ResponseValidator), replacing the
+// RESPONSE_VALIDATION rules. Use ResponseRules.Validator to combine it with built-in rules.
+func (s *Server) SetResponseValidator(validator ResponseValidator) {
+	s.nodePool.SetResponseValidator(validator)
+}
+
+// OnQueuePop adds a callback for every request popped from the queue (see Webserver.OnQueuePop)
+func (s *Server) OnQueuePop(cb func(r *SimRequest, wait time.Duration)) {
+	s.webserver.OnQueuePop(cb)
+}
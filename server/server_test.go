@@ -2,10 +2,13 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
@@ -21,7 +24,7 @@ var (
 )
 
 func TestServerWithoutRedis(t *testing.T) {
-	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, "", 1})
+	s, err := NewServer(ServerOpts{Log: testLog, HTTPAddrPtr: testServerListenAddr, WorkersPerNode: 1})
 	require.Nil(t, err, err)
 
 	mockNodeBackend := testutils.NewMockNodeBackend()
@@ -45,7 +48,7 @@ func TestServerWithoutRedis(t *testing.T) {
 func TestServerWithRedis(t *testing.T) {
 	resetTestRedis()
 
-	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, redisTestServer.Addr(), 1})
+	s, err := NewServer(ServerOpts{Log: testLog, HTTPAddrPtr: testServerListenAddr, RedisURI: redisTestServer.Addr(), WorkersPerNode: 1})
 	require.Nil(t, err, err)
 
 	mockNodeBackend := testutils.NewMockNodeBackend()
@@ -61,8 +64,28 @@ func TestServerWithRedis(t *testing.T) {
 	require.Equal(t, 200, resp.StatusCode)
 }
 
+// TestServerMigratesNodeSchema starts the server with the node list of schema version 1
+func TestServerMigratesNodeSchema(t *testing.T) {
+	resetTestRedis()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	defer mockNodeServer.Close()
+	require.Nil(t, redisTestServer.Set(redisTestState.key(RedisKeyNodes), fmt.Sprintf(`["%s"]`, mockNodeServer.URL)))
+
+	s, err := NewServer(ServerOpts{Log: testLog, RedisURI: redisTestServer.Addr(), WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	defer s.Shutdown()
+	require.Equal(t, []string{mockNodeServer.URL}, s.nodePool.NodeUris())
+
+	nodes, err := redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, []string{mockNodeServer.URL}, nodeEntryURIs(nodes))
+	version, err := redisTestServer.Get(redisTestState.key(RedisKeySchemaVersion))
+	require.Nil(t, err, err)
+	require.Equal(t, strconv.Itoa(RedisSchemaVersion), version)
+}
+
 func TestServerNoNodes(t *testing.T) {
-	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, "", 1})
+	s, err := NewServer(ServerOpts{Log: testLog, HTTPAddrPtr: testServerListenAddr, WorkersPerNode: 1})
 	require.Nil(t, err, err)
 	go s.Start()
 	defer s.Shutdown()
@@ -79,7 +102,7 @@ func TestServerNoNodes(t *testing.T) {
 
 // TestServerShutdown tests the graceful shutdown of the server
 func TestServerShutdown(t *testing.T) {
-	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, "", 1})
+	s, err := NewServer(ServerOpts{Log: testLog, HTTPAddrPtr: testServerListenAddr, WorkersPerNode: 1})
 	require.Nil(t, err, err)
 
 	done := make(chan bool)
@@ -96,7 +119,7 @@ func TestServerShutdown(t *testing.T) {
 
 // TestServerJobTimeout ensures that the server will timeout a job if it takes too long
 func TestServerJobTimeout(t *testing.T) {
-	s, err := NewServer(ServerOpts{testLog, testServerListenAddr, "", 0}) // 0 workers per node -> no jobs can be picked up
+	s, err := NewServer(ServerOpts{Log: testLog, HTTPAddrPtr: testServerListenAddr, WorkersPerNode: 0}) // 0 workers per node -> no jobs can be picked up
 	require.Nil(t, err, err)
 	s.nodePool.JobC = make(chan *SimRequest) // disable buffer on job queue
 
@@ -117,3 +140,284 @@ func TestServerJobTimeout(t *testing.T) {
 	lenFT, lenHP, lenLP := s.prioQueue.Len()
 	require.Equal(t, 0, lenFT+lenHP+lenLP)
 }
+
+// TestServerHandlerWithPrefix mounts the handler into another mux under a path prefix, wrapped with a custom middleware
+func TestServerHandlerWithPrefix(t *testing.T) {
+	s, err := NewServer(ServerOpts{Log: testLog, WorkersPerNode: 1, PathPrefix: "/simulation"})
+	require.Nil(t, err, err)
+	go s.Run()
+	defer s.Shutdown()
+
+	numWrapped := 0
+	handler := s.Handler()
+	mux := http.NewServeMux()
+	mux.Handle("/simulation/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		numWrapped++
+		handler.ServeHTTP(w, req)
+	}))
+	mux.HandleFunc("/other", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+
+	// Add a node through the prefixed admin route
+	nodePayload, err := json.Marshal(NodeURIPayload{URI: mockNodeServer.URL})
+	require.Nil(t, err, err)
+	resp, err := http.Post(srv.URL+"/simulation/nodes", "application/json", bytes.NewBuffer(nodePayload))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/simulation/nodes")
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	nodeUris := []string{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&nodeUris))
+	require.Equal(t, []string{mockNodeServer.URL}, nodeUris)
+
+	// Send a sim request through the prefixed sim routes
+	reqPayloadBytes, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+	for _, path := range []string{"/simulation/", "/simulation/sim"} {
+		resp, err = http.Post(srv.URL+path, "application/json", bytes.NewBuffer(reqPayloadBytes))
+		require.Nil(t, err, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+		require.NotEmpty(t, resp.Header.Get("X-Request-ID"))
+	}
+	require.Equal(t, 4, numWrapped)
+
+	// Routes without the prefix are not served by the load balancer
+	resp, err = http.Get(srv.URL + "/other")
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+	resp, err = http.Get(srv.URL + "/nodes")
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// TestServerRedisUnavailable stops redis while the server is running: requests are still served, node changes are
+// saved once redis is back
+func TestServerRedisUnavailable(t *testing.T) {
+	resetTestRedis()
+	_RedisMaxRetries, _RedisRetryBackoff, _RedisReplayInterval := RedisMaxRetries, RedisRetryBackoff, RedisReplayInterval
+	defer func() {
+		RedisMaxRetries, RedisRetryBackoff, RedisReplayInterval = _RedisMaxRetries, _RedisRetryBackoff, _RedisReplayInterval
+	}()
+	RedisMaxRetries, RedisRetryBackoff, RedisReplayInterval = 1, time.Millisecond, 20*time.Millisecond
+
+	s, err := NewServer(ServerOpts{Log: testLog, RedisURI: redisTestServer.Addr(), WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	go s.Run()
+	defer s.Shutdown()
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	mockNodeServer1 := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	defer mockNodeServer1.Close()
+	mockNodeServer2 := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	defer mockNodeServer2.Close()
+	require.Nil(t, s.AddNode(mockNodeServer1.URL))
+
+	reqPayloadBytes, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+	requireSimOK := func() {
+		resp, err := http.Post(srv.URL, "application/json", bytes.NewBuffer(reqPayloadBytes))
+		require.Nil(t, err, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	readiness := func() ReadinessResponse {
+		resp, err := http.Get(srv.URL + "/readyz")
+		require.Nil(t, err, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		res := ReadinessResponse{}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		return res
+	}
+	require.Equal(t, ReadinessResponse{Status: "ok", Redis: "ok", NumNodes: 1, NumHealthyNodes: 1}, readiness())
+
+	redisTestServer.Close()
+	requireSimOK()
+	nodePayload, err := json.Marshal(NodeURIPayload{URI: mockNodeServer2.URL})
+	require.Nil(t, err, err)
+	resp, err := http.Post(srv.URL+"/nodes", "application/json", bytes.NewBuffer(nodePayload))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireSimOK()
+	require.Equal(t, ReadinessResponse{Status: "degraded", Redis: "unavailable", NumPendingRedisWrites: 1, NumNodes: 2, NumHealthyNodes: 2}, readiness())
+
+	require.Nil(t, redisTestServer.Restart())
+	require.Eventually(t, func() bool { return !s.redis.IsDegraded() }, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, "ok", readiness().Status)
+	nodes, err := redisTestState.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, []string{mockNodeServer1.URL, mockNodeServer2.URL}, nodeEntryURIs(nodes))
+	requireSimOK()
+}
+
+// TestServerRedisUnavailableAtStartup starts the server while redis is down, and loads the saved nodes once it's back
+func TestServerRedisUnavailableAtStartup(t *testing.T) {
+	resetTestRedis()
+	_RedisReplayInterval := RedisReplayInterval
+	defer func() { RedisReplayInterval = _RedisReplayInterval }()
+	RedisReplayInterval = 20 * time.Millisecond
+
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	defer mockNodeServer.Close()
+	require.Nil(t, redisTestState.SaveNode(NodeEntry{URI: mockNodeServer.URL}))
+	redisAddr := redisTestServer.Addr()
+	redisTestServer.Close()
+
+	s, err := NewServer(ServerOpts{Log: testLog, RedisURI: redisAddr, WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	go s.Run()
+	defer s.Shutdown()
+	require.True(t, s.redis.IsDegraded())
+	require.Empty(t, s.nodePool.NodeUris())
+
+	require.Nil(t, redisTestServer.Restart())
+	require.Eventually(t, func() bool { return len(s.nodePool.NodeUris()) == 1 }, 3*time.Second, 10*time.Millisecond)
+	require.False(t, s.redis.IsDegraded())
+}
+
+// TestServerCancelledRequest ensures that requests whose client is gone never reach a node
+func TestServerCancelledRequest(t *testing.T) {
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 200 * time.Millisecond})
+	defer node.Close()
+	s, err := NewServer(ServerOpts{Log: testLog, WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	require.Nil(t, s.AddNode(node.URL))
+	go s.Run()
+	defer s.Shutdown()
+	handler := s.Handler()
+
+	popped := make(chan string, 10)
+	s.OnQueuePop(func(r *SimRequest, wait time.Duration) { popped <- r.ID })
+	send := func(ctx context.Context, reqID string) <-chan *httptest.ResponseRecorder {
+		req := newSimTestRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`).WithContext(ctx)
+		req.Header.Set("X-Request-ID", reqID)
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			res <- rr
+		}()
+		return res
+	}
+	requireNotProxied := func(reqID string) {
+		t.Helper()
+		for _, r := range node.Requests() {
+			require.NotEqual(t, reqID, r.Header.Get("X-Request-ID"))
+		}
+	}
+
+	// The first request blocks the only worker, the second one is cancelled while it waits
+	skipped, dropped := cancelledCounters.skipped.Load(), cancelledCounters.droppedResponses.Load()
+	blocking := send(context.Background(), "blocking")
+	require.Equal(t, "blocking", <-popped)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := send(ctx, "cancelled")
+	require.Equal(t, "cancelled", <-popped)
+	cancel()
+	<-cancelled
+	require.Equal(t, http.StatusOK, (<-blocking).Code)
+	require.Eventually(t, func() bool { return cancelledCounters.skipped.Load() == skipped+1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, dropped, cancelledCounters.droppedResponses.Load())
+	requireNotProxied("cancelled")
+
+	// The deadline of the client applies if it's earlier than RequestTimeout
+	blocking = send(context.Background(), "blocking2")
+	require.Equal(t, "blocking2", <-popped)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rr := <-send(ctx, "deadline")
+	require.Equal(t, ErrorKindRequestTimeout, rr.Header().Get("X-Error-Kind"))
+	require.Equal(t, ErrorCodeRequestTimeout, decodeErrorResponse(t, rr).Code)
+	<-blocking
+	require.Eventually(t, func() bool { return cancelledCounters.skipped.Load() == skipped+2 }, time.Second, 5*time.Millisecond)
+	requireNotProxied("deadline")
+}
+
+func TestSimRequestCancellation(t *testing.T) {
+	r := NewSimRequest(context.Background(), "1", []byte("x"), false, false)
+	require.Equal(t, r.CreatedAt.Add(RequestTimeout), r.Deadline())
+
+	// The earliest deadline wins
+	ctx, cancel := context.WithDeadline(context.Background(), r.CreatedAt.Add(time.Millisecond))
+	defer cancel()
+	r.Context = ctx
+	require.Equal(t, r.CreatedAt.Add(time.Millisecond), r.Deadline())
+	ctx, cancel = context.WithDeadline(context.Background(), r.CreatedAt.Add(RequestTimeout+time.Second))
+	r.Context = ctx
+	require.Equal(t, r.CreatedAt.Add(RequestTimeout), r.Deadline())
+
+	// A response to a cancelled request is dropped and counted
+	require.False(t, r.IsCancelled())
+	cancel()
+	require.True(t, r.IsCancelled())
+	dropped := cancelledCounters.droppedResponses.Load()
+	require.False(t, r.SendResponse(SimResponse{}))
+	require.Equal(t, dropped+1, cancelledCounters.droppedResponses.Load())
+	require.Empty(t, r.ResponseC)
+}
+
+// TestServerDelNodeWithPendingRequests removes nodes while requests wait for a worker
+func TestServerDelNodeWithPendingRequests(t *testing.T) {
+	node1 := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 100 * time.Millisecond})
+	defer node1.Close()
+	node2 := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 100 * time.Millisecond})
+	defer node2.Close()
+	s, err := NewServer(ServerOpts{Log: testLog, WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	require.Nil(t, s.AddNode(node1.URL))
+	require.Nil(t, s.AddNode(node2.URL))
+	go s.Run()
+	defer s.Shutdown()
+	handler := s.Handler()
+
+	send := func(n int) []<-chan *httptest.ResponseRecorder {
+		responses := make([]<-chan *httptest.ResponseRecorder, n)
+		for i := range responses {
+			res := make(chan *httptest.ResponseRecorder, 1)
+			go func() {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, newSimTestRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`))
+				res <- rr
+			}()
+			responses[i] = res
+		}
+		return responses
+	}
+	waitForInFlight := func(n int) {
+		require.Eventually(t, func() bool { return len(s.nodePool.inFlightRequests()) == n }, time.Second, 5*time.Millisecond)
+	}
+
+	// The jobs of the removed node are taken by the other one
+	responses := send(6)
+	waitForInFlight(2)
+	_, err = s.nodePool.DelNode(node1.URL)
+	require.Nil(t, err, err)
+	for _, res := range responses {
+		rr := <-res
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// Without a node left, the pending jobs are failed instead of waiting for the timeout
+	responses = send(4)
+	waitForInFlight(1)
+	_, err = s.nodePool.DelNode(node2.URL)
+	require.Nil(t, err, err)
+	numOK := 0
+	for _, res := range responses {
+		rr := <-res
+		if rr.Code == http.StatusOK {
+			numOK++
+			continue
+		}
+		require.Equal(t, ErrorKindNoNodesAvailable, rr.Header().Get("X-Error-Kind"))
+	}
+	require.Equal(t, 1, numOK) // the in-flight request
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// States of a graceful shutdown
+const (
+	ShutdownStateDraining = "draining" // new requests are rejected, the queued and in-flight ones are processed
+	ShutdownStateFlushing = "flushing" // the grace period passed, the queued requests are answered with ErrShuttingDown and the in-flight ones complete
+	ShutdownStateStopped  = "stopped"  // the listeners and node workers are stopped
+)
+
+var shutdownPollInterval = 10 * time.Millisecond
+
+// ShutdownOpts are the options of a graceful shutdown
+type ShutdownOpts struct {
+	GracePeriod time.Duration // how long the queued and in-flight requests may drain
+	Exit        bool          // whether the process should exit when the server stopped (up to the caller of Server.Done)
+	ExitCode    int
+}
+
+// ShutdownStatus is the progress of a graceful shutdown, in /admin/shutdown and /readyz
+type ShutdownStatus struct {
+	ID            string    `json:"id"`
+	State         string    `json:"state"`
+	StartedAt     time.Time `json:"startedAt"`
+	GracePeriodMs int64     `json:"gracePeriodMs"`
+	Exit          bool      `json:"exit"`
+	ExitCode      int       `json:"exitCode"`
+	NumQueued     int       `json:"numQueued"`  // still in the queue
+	NumPending    int64     `json:"numPending"` // accepted and not answered yet, including the queued ones
+	NumFlushed    int64     `json:"numFlushed"` // answered with ErrShuttingDown after the grace period
+}
+
+// shutdownProgress is the state of the graceful shutdown, shared by the server and its webserver
+type shutdownProgress struct {
+	lock       sync.Mutex
+	status     *ShutdownStatus // nil until a shutdown started
+	numFlushed atomic.Int64
+}
+
+// start records a new shutdown, returns false if one was started already
+func (p *shutdownProgress) start(opts ShutdownOpts) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status != nil {
+		return false
+	}
+	p.status = &ShutdownStatus{
+		ID:            uuid.NewString(),
+		State:         ShutdownStateDraining,
+		StartedAt:     time.Now().UTC(),
+		GracePeriodMs: opts.GracePeriod.Milliseconds(),
+		Exit:          opts.Exit,
+		ExitCode:      opts.ExitCode,
+	}
+	return true
+}
+
+// setState changes the state of the started shutdown (if any)
+func (p *shutdownProgress) setState(state string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status != nil {
+		p.status.State = state
+	}
+}
+
+// isFlushing returns whether the queued requests should be answered with ErrShuttingDown
+func (p *shutdownProgress) isFlushing() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status != nil && p.status.State != ShutdownStateDraining
+}
+
+// get returns a copy of the status, or nil if no shutdown was started
+func (p *shutdownProgress) get() *ShutdownStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status == nil {
+		return nil
+	}
+	status := *p.status
+	status.NumFlushed = p.numFlushed.Load()
+	return &status
+}
+
+// shutdownStatus returns the progress of the graceful shutdown, or nil if none was started
+func (s *Webserver) shutdownStatus() *ShutdownStatus {
+	status := s.shutdown.get()
+	if status != nil {
+		status.NumQueued = s.prioQueue.NumRequests()
+		status.NumPending = s.requests.inFlight.Load()
+	}
+	return status
+}
+
+// EnableShutdown enables the graceful shutdown with /admin/shutdown
+func (s *Webserver) EnableShutdown(start func(opts ShutdownOpts) (status ShutdownStatus, started bool)) {
+	s.startShutdown = start
+}
+
+// HandleShutdownRequest starts a graceful shutdown on POST and returns right away with its status (query args:
+// `exit`, default true, and `code`, default SHUTDOWN_EXIT_CODE), and returns the status of the shutdown on GET
+func (s *Webserver) HandleShutdownRequest(w http.ResponseWriter, req *http.Request) {
+	if s.startShutdown == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "shutdown is not enabled")
+		return
+	}
+
+	statusCode := http.StatusOK
+	var status *ShutdownStatus
+	if req.Method == http.MethodGet {
+		if status = s.shutdownStatus(); status == nil {
+			writeError(w, http.StatusNotFound, ErrorCodeNotFound, "no shutdown in progress")
+			return
+		}
+	} else {
+		opts := ShutdownOpts{GracePeriod: ShutdownGracePeriod, Exit: true, ExitCode: ShutdownExitCode}
+		query := req.URL.Query()
+		if exitArg := query.Get("exit"); exitArg != "" {
+			exit, err := strconv.ParseBool(exitArg)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid exit: "+exitArg)
+				return
+			}
+			opts.Exit = exit
+		}
+		if codeArg := query.Get("code"); codeArg != "" {
+			code, err := strconv.Atoi(codeArg)
+			if err != nil || code < 0 || code > 255 {
+				writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid code: "+codeArg)
+				return
+			}
+			opts.ExitCode = code
+		}
+
+		started, ok := s.startShutdown(opts)
+		status = &started
+		if ok {
+			statusCode = http.StatusAccepted
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.log.Errorw("Encoding the shutdown status failed", "err", err)
+	}
+}
+
+// StartShutdown starts a graceful shutdown in the background, like on SIGTERM: readiness reports not ready, new
+// requests are rejected, and the queued and in-flight requests may drain for the grace period. Then the remaining
+// queued requests are answered with ErrShuttingDown, and the server is shut down (see Shutdown and Done). Returns
+// the status of the shutdown which was started already, with started=false.
+func (s *Server) StartShutdown(opts ShutdownOpts) (status ShutdownStatus, started bool) {
+	if !s.webserver.shutdown.start(opts) {
+		return *s.webserver.shutdownStatus(), false
+	}
+	status = *s.webserver.shutdownStatus()
+	s.log.Infow("Starting graceful shutdown", "id", status.ID, "gracePeriod", opts.GracePeriod, "exit", opts.Exit, "exitCode", opts.ExitCode, "numPending", status.NumPending)
+	s.prioQueue.Close() // rejects the new requests
+	go s.drain(status.ID, opts.GracePeriod)
+	return status, true
+}
+
+// drain waits until the accepted requests are answered or the grace period passed, flushes the queue, waits for the
+// requests which were taken by the workers already, and shuts down
+func (s *Server) drain(id string, gracePeriod time.Duration) {
+	waitUntil := func(deadline time.Time) {
+		for s.webserver.requests.inFlight.Load() > 0 && time.Now().Before(deadline) {
+			time.Sleep(shutdownPollInterval)
+		}
+	}
+	deadline := time.Now().Add(gracePeriod)
+	waitUntil(deadline)
+
+	if numQueued := s.prioQueue.NumRequests(); numQueued > 0 {
+		s.log.Warnw("Shutdown grace period passed, flushing the queue", "id", id, "numQueued", numQueued)
+	}
+	s.webserver.shutdown.setState(ShutdownStateFlushing) // the main loop answers the queued requests
+	waitUntil(deadline.Add(ServerJobSendTimeout + maxProxyRequestTimeout()))
+	s.Shutdown()
+	s.log.Infow("Graceful shutdown completed", "id", id, "numFlushed", s.webserver.shutdown.numFlushed.Load())
+}
+
+// ShutdownStatus returns the progress of the graceful shutdown, or nil if none was started
+func (s *Server) ShutdownStatus() *ShutdownStatus {
+	return s.webserver.shutdownStatus()
+}
+
+// Done returns a channel which is closed when Shutdown completed (also after a graceful shutdown). Whether the
+// process should exit then is in ShutdownStatus.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// ShutdownWithDeadline runs shutdown, which blocks until the server stopped (i.e. StartShutdown and Done). If it didn't
+// return within deadline (0: no deadline), i.e. because draining hangs on a node which doesn't respond within the
+// proxy timeout, or on a signal from interrupt (i.e. a second SIGTERM), exit is called with code 1. Returns once
+// shutdown returned or exit was called.
+func ShutdownWithDeadline(log *zap.SugaredLogger, shutdown func(), deadline time.Duration, interrupt <-chan os.Signal, exit func(code int)) {
+	done := make(chan struct{})
+	go func() {
+		shutdown()
+		close(done)
+	}()
+
+	var hardDeadline <-chan time.Time
+	if deadline > 0 {
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		hardDeadline = timer.C
+	}
+	select {
+	case <-done:
+		return
+	case <-hardDeadline:
+		log.Errorw("Shutdown did not complete in time, exiting", "hardTimeout", deadline)
+	case <-interrupt:
+		log.Warn("Second signal received, exiting without waiting for the shutdown")
+	}
+	exit(1)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerStartShutdown(t *testing.T) {
+	node := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: 300 * time.Millisecond})
+	defer node.Close()
+	s, err := NewServer(ServerOpts{Log: testLog, WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	require.Nil(t, s.AddNode(node.URL))
+	go s.Run()
+	defer s.Shutdown()
+	handler := s.Handler()
+
+	serve := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(body)))
+		return rr
+	}
+
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/admin/shutdown", nil).Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/admin/shutdown?exit=maybe", nil).Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/admin/shutdown?code=256", nil).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/readyz", nil).Code)
+
+	// One request on the worker, one held by the main loop and two queued
+	payload := []byte(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+	responses := make(chan *httptest.ResponseRecorder, 4)
+	for i := 0; i < 4; i++ {
+		go func() { responses <- serve(http.MethodPost, "/", payload) }()
+	}
+	require.Eventually(t, func() bool { return s.webserver.requests.inFlight.Load() == 4 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	defer func(gracePeriod time.Duration) { ShutdownGracePeriod = gracePeriod }(ShutdownGracePeriod)
+	ShutdownGracePeriod = 400 * time.Millisecond
+	rr := serve(http.MethodPost, "/admin/shutdown?exit=false&code=3", nil)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var started ShutdownStatus
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&started))
+	require.NotEmpty(t, started.ID)
+	require.Equal(t, ShutdownStateDraining, started.State)
+	require.False(t, started.Exit)
+	require.Equal(t, 3, started.ExitCode)
+	require.Equal(t, int64(400), started.GracePeriodMs)
+	require.Equal(t, int64(4), started.NumPending)
+
+	// Draining: not ready, new requests are rejected, a second call returns the same shutdown
+	rr = serve(http.MethodGet, "/readyz", nil)
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	var readiness ReadinessResponse
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&readiness))
+	require.Equal(t, ErrorKindShuttingDown, readiness.Status)
+	require.Equal(t, started.ID, readiness.Shutdown.ID)
+	require.Equal(t, ShutdownStateDraining, readiness.Shutdown.State)
+	rr = serve(http.MethodPost, "/", payload)
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, ErrorCodeShuttingDown, decodeErrorResponse(t, rr).Code)
+	rr = serve(http.MethodPost, "/admin/shutdown", nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), started.ID)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, ShutdownStateDraining, s.ShutdownStatus().State)
+
+	// After the grace period, the request which is still queued is flushed, the others complete
+	select {
+	case <-s.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+	numOK, numFlushed := 0, 0
+	for i := 0; i < 4; i++ {
+		rr := <-responses
+		switch rr.Code {
+		case http.StatusOK:
+			numOK++
+		case http.StatusServiceUnavailable:
+			require.Equal(t, ErrorKindShuttingDown, rr.Header().Get("X-Error-Kind"))
+			require.True(t, decodeErrorResponse(t, rr).Retryable)
+			numFlushed++
+		default:
+			t.Fatalf("unexpected response: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	require.Equal(t, 3, numOK)
+	require.Equal(t, 1, numFlushed)
+
+	status := s.ShutdownStatus()
+	require.Equal(t, started.ID, status.ID)
+	require.Equal(t, ShutdownStateStopped, status.State)
+	require.Equal(t, int64(1), status.NumFlushed)
+	require.Equal(t, int64(0), status.NumPending)
+	require.Equal(t, 0, status.NumQueued)
+	rr = serve(http.MethodGet, "/admin/shutdown", nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"state":"stopped"`)
+}
+
+func TestShutdownWithDeadline(t *testing.T) {
+	exitCodes := make(chan int, 1)
+	exit := func(code int) { exitCodes <- code }
+	interrupt := make(chan os.Signal, 1)
+
+	// A completed shutdown doesn't exit
+	ShutdownWithDeadline(testLog, func() {}, time.Second, interrupt, exit)
+	require.Empty(t, exitCodes)
+
+	// A hung shutdown exits after the deadline
+	hung := make(chan struct{})
+	defer close(hung)
+	start := time.Now()
+	ShutdownWithDeadline(testLog, func() { <-hung }, 50*time.Millisecond, interrupt, exit)
+	require.Equal(t, 1, <-exitCodes)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// Or on a second signal, also without a deadline
+	interrupt <- syscall.SIGTERM
+	ShutdownWithDeadline(testLog, func() { <-hung }, 0, interrupt, exit)
+	require.Equal(t, 1, <-exitCodes)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseSigner(t *testing.T) {
+	require.Nil(t, NewResponseSigner("", ""))
+
+	ts := time.Unix(1700000000, 0)
+	signer := NewResponseSigner("primary", "", "secondary")
+	sig := signer.Sign(ts, "req1", []byte("body"))
+	require.Equal(t, "t=1700000000,v1="+ResponseSignature([]byte("primary"), "1700000000", "req1", []byte("body"))+
+		",v1="+ResponseSignature([]byte("secondary"), "1700000000", "req1", []byte("body")), sig)
+
+	// The signature covers the body, the request ID and the timestamp
+	expected := ResponseSignature([]byte("primary"), "1700000000", "req1", []byte("body"))
+	require.Len(t, expected, 64)
+	require.NotEqual(t, expected, ResponseSignature([]byte("primary"), "1700000000", "req1", []byte("bodx")))
+	require.NotEqual(t, expected, ResponseSignature([]byte("primary"), "1700000000", "req2", []byte("body")))
+	require.NotEqual(t, expected, ResponseSignature([]byte("primary"), "1700000001", "req1", []byte("body")))
+	require.NotEqual(t, expected, ResponseSignature([]byte("other"), "1700000000", "req1", []byte("body")))
+}
+
+func TestResponseSignerMiddleware(t *testing.T) {
+	body := strings.Repeat(`{"result":"0x0"}`, 100)
+	signer := NewResponseSigner("primary")
+	handler := signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writePayload(w, req, http.StatusTeapot, []byte(body))
+	}))
+
+	// verify checks the signature of the primary key against the uncompressed body
+	verify := func(rr *httptest.ResponseRecorder, body string) {
+		t.Helper()
+		sig := rr.Header().Get("X-Response-Signature")
+		parts := strings.Split(sig, ",")
+		require.Len(t, parts, 2, sig)
+		timestamp := strings.TrimPrefix(parts[0], "t=")
+		require.Equal(t, "v1="+ResponseSignature([]byte("primary"), timestamp, rr.Header().Get("X-Request-ID"), []byte(body)), parts[1])
+	}
+
+	req := newSimTestRequest("")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusTeapot, rr.Code)
+	require.Equal(t, "test-req", rr.Header().Get("X-Request-ID"))
+	require.Equal(t, body, rr.Body.String())
+	verify(rr, body)
+
+	// The body is signed before it's compressed
+	req = newSimTestRequest("")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, []string{"Accept-Encoding"}, rr.Header().Values("Vary"))
+	zr, err := gzip.NewReader(rr.Body)
+	require.Nil(t, err, err)
+	uncompressed, err := io.ReadAll(zr)
+	require.Nil(t, err, err)
+	require.Equal(t, body, string(uncompressed))
+	verify(rr, body)
+
+	// A generated request ID is signed as well
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.NotEmpty(t, rr.Header().Get("X-Request-ID"))
+	verify(rr, body)
+
+	// Without a signer, the responses are unchanged
+	rr = httptest.NewRecorder()
+	(*ResponseSigner)(nil).Middleware(http.NotFoundHandler()).ServeHTTP(rr, newSimTestRequest(""))
+	require.Empty(t, rr.Header().Get("X-Response-Signature"))
+}
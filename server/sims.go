@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SimsRequestEntry is a payload of a POST /sims request, with its priority
+type SimsRequestEntry struct {
+	Payload   json.RawMessage `json:"payload"`
+	HighPrio  bool            `json:"highPrio,omitempty"`
+	FastTrack bool            `json:"fastTrack,omitempty"`
+}
+
+// SimsResponseEntry is the result of a payload of a POST /sims request, with the fields of the response headers of
+// single sims. Failed payloads have an error (the payload of node errors is included if it's JSON).
+type SimsResponseEntry struct {
+	RequestID       string          `json:"requestId"`
+	StatusCode      int             `json:"statusCode"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
+	NodeURI         string          `json:"nodeURI,omitempty"`
+	SimDurationMs   int64           `json:"simDurationMs"`
+	QueueDurationMs int64           `json:"queueDurationMs"`
+	Tries           int             `json:"tries"`
+	ErrorKind       string          `json:"errorKind,omitempty"`
+	Error           *ErrorDetails   `json:"error,omitempty"`
+}
+
+// newSimsErrorEntry returns the entry of a payload which failed, or was rejected
+func newSimsErrorEntry(reqID string, statusCode int, kind, code, message string) SimsResponseEntry {
+	return SimsResponseEntry{
+		RequestID:  reqID,
+		StatusCode: statusCode,
+		ErrorKind:  kind,
+		Error:      &ErrorDetails{Code: code, Message: message, RequestID: reqID, Retryable: retryableErrorCodes[code]},
+	}
+}
+
+// newSimsResponseEntry returns the entry of the response to a queued payload
+func newSimsResponseEntry(simReq *SimRequest, resp SimResponse, startTime time.Time) SimsResponseEntry {
+	entry := SimsResponseEntry{RequestID: simReq.ID, StatusCode: resp.StatusCode, Tries: simReq.Tries}
+	payload := bytes.TrimSpace(resp.Payload)
+	if resp.Error != nil {
+		kind := errorKind(resp)
+		if entry.StatusCode == 0 {
+			entry.StatusCode = http.StatusInternalServerError
+		}
+		entry = newSimsErrorEntry(simReq.ID, entry.StatusCode, kind, errorCode(kind), resp.Error.Error())
+		entry.Tries = simReq.Tries
+		if len(payload) > 0 && json.Valid(payload) {
+			entry.Payload = payload
+		}
+	} else if !json.Valid(payload) {
+		entry = newSimsErrorEntry(simReq.ID, http.StatusBadGateway, ErrorKindProxyError, ErrorCodeProxyError, "invalid JSON response from node")
+		entry.Tries = simReq.Tries
+	} else {
+		entry.Payload = payload
+		if entry.StatusCode == 0 {
+			entry.StatusCode = http.StatusOK
+		}
+	}
+
+	if !HideNodeURIHeader {
+		entry.NodeURI = resp.NodeURI
+	}
+	entry.SimDurationMs = resp.SimDuration.Milliseconds()
+	entry.QueueDurationMs = time.Since(startTime).Milliseconds() // requests which were never proxied spent all the time in the queue
+	if !resp.SimAt.IsZero() {
+		entry.QueueDurationMs = resp.SimAt.Sub(startTime).Milliseconds()
+	}
+	return entry
+}
+
+// HandleSimsRequest queues a JSON array of payloads (see SimsRequestEntry) as individual requests, and responds with
+// the results in the original order once all are done (see SimsResponseEntry). A failed payload doesn't fail the
+// others. The X-Request-Deadline-Ms and X-Proxy-Timeout-Ms headers apply to all payloads.
+func (s *Webserver) HandleSimsRequest(w http.ResponseWriter, req *http.Request) {
+	startTime := time.Now().UTC()
+	defer req.Body.Close()
+	reqID := ensureRequestID(w, req)
+	log := s.log.With("reqID", reqID)
+
+	tenant := ""
+	if s.tenants != nil {
+		var found bool
+		tenant, found = s.tenants.TenantForAPIKey(req.Header.Get("X-API-Key"))
+		if !found {
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "unknown API key")
+			return
+		}
+		log = log.With("tenant", tenant)
+	}
+	timeout, err := requestDeadlineHeader(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	proxyTimeout, err := proxyTimeoutHeader(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// The size limit of payloads applies to the whole batch
+	if !limitRequestBody(w, req, PayloadMaxBytes) {
+		writePayloadTooLarge(w)
+		return
+	}
+	body, err := ReadPayload(req.Body, PayloadMaxBytes, 0, "")
+	if errors.Is(err, ErrPayloadTooLarge) {
+		writePayloadTooLarge(w)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	raw, err := body.Bytes()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	var entries []SimsRequestEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid JSON array of payloads: "+err.Error())
+		return
+	} else if len(entries) == 0 {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "no payloads")
+		return
+	} else if len(entries) > SimsMaxBatchSize {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Sprintf("too many payloads: %d (max. %d)", len(entries), SimsMaxBatchSize))
+		return
+	}
+
+	ctx := ContextWithRequestID(req.Context(), reqID)
+	clientID := clientIDForStats(req, tenant)
+	log = log.With("batchSize", len(entries))
+	results := make([]SimsResponseEntry, len(entries))
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		elementID := fmt.Sprintf("%s-%d", reqID, i)
+		payload := bytes.TrimSpace(entry.Payload)
+		if len(payload) == 0 {
+			results[i] = newSimsErrorEntry(elementID, http.StatusBadRequest, "", ErrorCodeInvalidRequest, "missing payload")
+			continue
+		}
+		if ValidateJSONRPC {
+			if _, err := ValidateJSONRPCRequest(payload, JSONRPCAllowedMethods); err != nil {
+				results[i] = newSimsErrorEntry(elementID, http.StatusBadRequest, "", ErrorCodeInvalidJSONRPC, "invalid JSON-RPC request: "+err.Error())
+				continue
+			}
+		}
+
+		// Entries without priority flags get the priority of the rules
+		isHighPrio, isFastTrack := entry.HighPrio, entry.FastTrack
+		if !isHighPrio && !isFastTrack && s.priorityRules.HasRules() {
+			priority, _ := s.priorityRules.Classify(payload)
+			isHighPrio, isFastTrack = priority == PriorityHighPrio, priority == PriorityFastTrack
+		}
+		isHighPrio, isFastTrack, err = s.limitTenantPriority(tenant, isHighPrio, isFastTrack)
+		if err != nil {
+			results[i] = newSimsErrorEntry(elementID, http.StatusForbidden, ErrorKindPriorityNotAllowed, ErrorCodePriorityNotAllowed, err.Error())
+			continue
+		}
+		simReq := NewSimRequest(ContextWithRequestID(ctx, elementID), elementID, payload, isHighPrio, isFastTrack)
+		simReq.Tenant = tenant
+		simReq.ClientID = clientID
+		simReq.ContentType = "application/json"
+		simReq.SizeClass = s.payloadStats.Classify(int64(len(payload)))
+		simReq.Timeout = timeout
+		simReq.ProxyTimeout = proxyTimeout
+		if !s.allowSubmission(simReq) {
+			results[i] = newSimsErrorEntry(elementID, http.StatusConflict, ErrorKindDuplicateSubmission, ErrorCodeDuplicateSubmission, ErrDuplicateSubmission.Error())
+			continue
+		}
+		s.recorder.Record(RecordedRequest{
+			ReqID:       elementID,
+			Priority:    simReq.Priority(),
+			ClientID:    req.Header.Get("X-Client-ID"),
+			Tenant:      tenant,
+			ContentType: simReq.ContentType,
+		}, simReq.Payload)
+		if kind, err := s.queueBatchElement(log, simReq); err != nil {
+			statusCode := http.StatusServiceUnavailable
+			if kind == ErrorKindClientQueueLimit {
+				statusCode = http.StatusTooManyRequests
+			} else if kind == ErrorKindQueueFull {
+				statusCode = http.StatusInternalServerError
+			}
+			results[i] = newSimsErrorEntry(elementID, statusCode, kind, errorCode(kind), err.Error())
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, simReq *SimRequest) {
+			defer wg.Done()
+			resp, ok := s.waitForBatchElement(ctx, log.With("batchIndex", i), simReq, startTime)
+			if ok {
+				results[i] = newSimsResponseEntry(simReq, resp, startTime)
+			}
+		}(i, simReq)
+	}
+	log.Infow("Sims added to queue")
+	wg.Wait()
+
+	if ctx.Err() != nil { // client closed the connection
+		return
+	}
+
+	res, err := json.Marshal(results)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writePayload(w, req, http.StatusOK, append(res, '\n'))
+	log.Infow("Sims completed", "durationMs", time.Since(startTime).Milliseconds())
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebserverSims(t *testing.T) {
+	defer func(timeout time.Duration, maxBatchSize int) {
+		ProxyRequestTimeout, SimsMaxBatchSize = timeout, maxBatchSize
+	}(ProxyRequestTimeout, SimsMaxBatchSize)
+	ProxyRequestTimeout, SimsMaxBatchSize = 100*time.Millisecond, 5
+
+	webserver, mockNodeBackend := newTestWebserver(t, 2)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var envelope jsonRPCRequestEnvelope
+		_ = json.Unmarshal(body, &envelope)
+		if string(envelope.Method) == `"slow"` {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","result":%s,"id":%s}`, envelope.Method, envelope.ID)))
+	}
+	sims := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		webserver.HandleSimsRequest(rr, newSimTestRequest(body))
+		return rr
+	}
+
+	for _, invalid := range []string{`[]`, `{"payload":{}}`, `[{"payload":1},{"payload":2},{"payload":3},{"payload":4},{"payload":5},{"payload":6}]`} {
+		rr := sims(invalid)
+		require.Equal(t, http.StatusBadRequest, rr.Code, invalid)
+		require.Equal(t, ErrorCodeInvalidRequest, decodeErrorResponse(t, rr).Code)
+	}
+
+	// One payload times out, the others succeed, and the results are in the original order
+	rr := sims(`[
+		{"payload":{"jsonrpc":"2.0","method":"first","params":[],"id":1},"fastTrack":true},
+		{"payload":{"jsonrpc":"2.0","method":"slow","params":[],"id":2}},
+		{},
+		{"payload":{"jsonrpc":"2.0","method":"last","params":[],"id":3},"highPrio":true}
+	]`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var results []SimsResponseEntry
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	require.Equal(t, 4, len(results))
+
+	require.Equal(t, "test-req-0", results[0].RequestID)
+	require.Equal(t, http.StatusOK, results[0].StatusCode)
+	require.Equal(t, `{"jsonrpc":"2.0","result":"first","id":1}`, string(results[0].Payload))
+	require.NotEmpty(t, results[0].NodeURI)
+	require.Equal(t, 1, results[0].Tries)
+	require.Nil(t, results[0].Error)
+
+	require.Equal(t, http.StatusInternalServerError, results[1].StatusCode)
+	require.Equal(t, ErrorKindProxyTimeout, results[1].ErrorKind)
+	require.Equal(t, ErrorCodeProxyTimeout, results[1].Error.Code)
+	require.Equal(t, "test-req-1", results[1].Error.RequestID)
+	require.Equal(t, RequestMaxTries, results[1].Tries)
+	require.Nil(t, results[1].Payload)
+
+	require.Equal(t, http.StatusBadRequest, results[2].StatusCode)
+	require.Equal(t, ErrorCodeInvalidRequest, results[2].Error.Code)
+
+	require.Equal(t, `{"jsonrpc":"2.0","result":"last","id":3}`, string(results[3].Payload))
+	require.GreaterOrEqual(t, results[3].SimDurationMs, int64(0))
+	require.False(t, strings.Contains(rr.Body.String(), `"errorKind":""`))
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"time"
+)
+
+// SmallestFirstOrder pops the request with the smallest payload of a priority first, instead of the oldest one (the
+// payload size is a proxy for the simulation cost, so that small requests don't wait behind large ones). It is enabled
+// per priority. Against starvation, a request is passed by at most MaxSkips smaller requests, and is not passed anymore
+// once it waited MaxWait (0 disables the bound).
+type SmallestFirstOrder struct {
+	FastTrack bool
+	HighPrio  bool
+	LowPrio   bool
+	MaxSkips  int
+	MaxWait   time.Duration
+}
+
+// pop removes the next request from a non-empty queue (oldest first), the smallest one with smallestFirst
+func (o SmallestFirstOrder) pop(queue []*SimRequest, smallestFirst bool, now time.Time) (*SimRequest, []*SimRequest) {
+	idx := 0
+	if smallestFirst {
+		idx = o.next(queue, now)
+	}
+	if idx == 0 {
+		return queue[0], queue[1:]
+	}
+
+	r := queue[idx]
+	for _, passed := range queue[:idx] {
+		passed.numPassed++
+	}
+	return r, append(queue[:idx], queue[idx+1:]...)
+}
+
+// next returns the index of the smallest request, or 0 if the oldest one reached a starvation bound. The oldest
+// request was passed most often and waited longest, so only it has to be checked.
+func (o SmallestFirstOrder) next(queue []*SimRequest, now time.Time) int {
+	oldest := queue[0]
+	if (o.MaxSkips > 0 && oldest.numPassed >= o.MaxSkips) || (o.MaxWait > 0 && now.Sub(oldest.QueuedAt) >= o.MaxWait) {
+		return 0
+	}
+
+	smallest := 0
+	for i, r := range queue {
+		if r.Payload.Len() < queue[smallest].Payload.Len() {
+			smallest = i
+		}
+	}
+	return smallest
+}
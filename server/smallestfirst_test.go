@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pushSized pushes a low-prio request with a payload of size bytes, with the ID "<size>"
+func pushSized(t *testing.T, q Queue, sizes ...int) {
+	t.Helper()
+	for _, size := range sizes {
+		id := strings.Repeat("x", size)
+		require.True(t, q.Push(NewSimRequest(context.Background(), id, []byte(id), false, false)))
+	}
+}
+
+func popSizes(q Queue, n int) (sizes []int) {
+	for i := 0; i < n; i++ {
+		sizes = append(sizes, len(q.Pop().ID))
+	}
+	return sizes
+}
+
+func TestSmallestFirstOrder(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+
+	// FIFO by default
+	pushSized(t, q, 5, 1, 3)
+	require.Equal(t, []int{5, 1, 3}, popSizes(q, 3))
+
+	// Only for the enabled priority
+	q.SetSmallestFirst(SmallestFirstOrder{LowPrio: true})
+	pushSized(t, q, 5, 1, 3, 1)
+	high := NewSimRequest(context.Background(), "xxxxx", []byte("xxxxx"), true, false)
+	require.True(t, q.Push(high))
+	require.True(t, q.Push(NewSimRequest(context.Background(), "x", []byte("x"), true, false)))
+	require.Equal(t, high, q.Pop())
+	require.Equal(t, []int{1, 1, 1, 3, 5}, popSizes(q, 5)) // the same size stays in order
+	require.Equal(t, 0, q.NumRequests())
+	require.Equal(t, int64(0), q.NumBytes())
+}
+
+func TestSmallestFirstMaxSkips(t *testing.T) {
+	q := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	q.SetSmallestFirst(SmallestFirstOrder{LowPrio: true, MaxSkips: 2})
+
+	// The large one is passed twice, then it's next even though smaller ones are queued
+	pushSized(t, q, 9, 1, 2, 8, 1)
+	require.Equal(t, []int{1, 1, 9, 2, 8}, popSizes(q, 5))
+
+	// Smaller ones which arrive later pass it as well, up to the bound
+	pushSized(t, q, 9, 1)
+	require.Equal(t, []int{1}, popSizes(q, 1))
+	pushSized(t, q, 1, 1)
+	require.Equal(t, []int{1, 9, 1}, popSizes(q, 3))
+
+	// The passes are reset when a request is queued again (i.e. for a retry)
+	pushSized(t, q, 9, 1, 1)
+	r := q.Pop()
+	require.Equal(t, 1, len(r.ID))
+	require.True(t, q.Push(r))
+	require.Equal(t, []int{1, 9, 1}, popSizes(q, 3))
+}
+
+func TestSmallestFirstMaxWait(t *testing.T) {
+	order := SmallestFirstOrder{LowPrio: true, MaxWait: time.Second}
+	large := &SimRequest{Payload: BytesPayload("xxxxx")}
+	small := &SimRequest{Payload: BytesPayload("x")}
+	now := time.Now()
+	large.QueuedAt, small.QueuedAt = now.Add(-999*time.Millisecond), now
+
+	r, queue := order.pop([]*SimRequest{large, small}, true, now)
+	require.Equal(t, small, r)
+	require.Equal(t, []*SimRequest{large}, queue)
+
+	// Not passed anymore after it waited MaxWait
+	queue = append(queue, small)
+	r, _ = order.pop(queue, true, now.Add(time.Millisecond))
+	require.Equal(t, large, r)
+}
+
+func TestTenantQueueSmallestFirst(t *testing.T) {
+	q, err := NewTenantQueue([]TenantConfig{{Name: "a", APIKey: "key-a", Weight: 1}}, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	q.SetSmallestFirst(SmallestFirstOrder{LowPrio: true})
+	push := func(sizes ...int) {
+		for _, size := range sizes {
+			r := NewSimRequest(context.Background(), strings.Repeat("x", size), []byte(strings.Repeat("x", size)), false, false)
+			r.Tenant = "a"
+			require.True(t, q.Push(r))
+		}
+	}
+	push(3, 1, 2)
+	require.Equal(t, []int{1, 2, 3}, popSizes(q, 3))
+
+	// New tenants use the order as well
+	require.Nil(t, q.UpdateTenants([]TenantConfig{{Name: "a", APIKey: "key-a", Weight: 1}, {Name: "b", APIKey: "key-b", Weight: 1}}))
+	r := NewSimRequest(context.Background(), "xx", []byte("xx"), false, false)
+	r.Tenant = "b"
+	require.True(t, q.Push(r))
+	r = NewSimRequest(context.Background(), "x", []byte("x"), false, false)
+	r.Tenant = "b"
+	require.True(t, q.Push(r))
+	require.Equal(t, []int{1, 2}, popSizes(q, 2))
+}
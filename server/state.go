@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State persists the nodes and tenants across restarts. Implementations: RedisState, FileState and MemoryState.
+type State interface {
+	GetNodes() (nodes []NodeEntry, err error)
+	SaveNode(node NodeEntry) error                   // adds the node, or replaces the entry with the same normalized URI
+	DeleteNode(uri string) error                     // no-op if there is no entry with the normalized URI
+	GetTenants() (tenants []TenantConfig, err error) // nil if none were saved
+	SaveTenants(tenants []TenantConfig) error
+}
+
+var (
+	_ State = (*RedisState)(nil)
+	_ State = (*FileState)(nil)
+	_ State = (*MemoryState)(nil)
+)
+
+// NodeEntry is the saved metadata of a node
+type NodeEntry struct {
+	URI     string            `json:"uri"`
+	Workers int32             `json:"workers,omitempty"` // number of workers, 0 for the pool default (a `_workers` URI query param takes precedence)
+	AddedAt time.Time         `json:"addedAt"`
+	Headers map[string]string `json:"headers,omitempty"` // set on every request to the node, i.e. for authentication
+}
+
+// UnmarshalJSON also accepts a plain URI, which is how nodes were saved before entries had metadata
+func (e *NodeEntry) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*e = NodeEntry{}
+		return json.Unmarshal(data, &e.URI)
+	}
+	type nodeEntry NodeEntry // without the UnmarshalJSON method
+	return json.Unmarshal(data, (*nodeEntry)(e))
+}
+
+// NormalizeNodeURI returns the URI with a lowercase scheme and host, and without a trailing slash. Node entries are
+// identified by their normalized URI.
+func NormalizeNodeURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	return u.String()
+}
+
+// saveNodeEntry returns nodes with node added, or replacing the entry with the same normalized URI
+func saveNodeEntry(nodes []NodeEntry, node NodeEntry) []NodeEntry {
+	res := copySlice(nodes)
+	for i, entry := range res {
+		if NormalizeNodeURI(entry.URI) == NormalizeNodeURI(node.URI) {
+			res[i] = node
+			return res
+		}
+	}
+	return append(res, node)
+}
+
+// deleteNodeEntry returns nodes without the entry with the normalized URI
+func deleteNodeEntry(nodes []NodeEntry, uri string) []NodeEntry {
+	res := make([]NodeEntry, 0, len(nodes))
+	for _, entry := range nodes {
+		if NormalizeNodeURI(entry.URI) != NormalizeNodeURI(uri) {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// MemoryState keeps the state in memory only, i.e. for tests
+type MemoryState struct {
+	lock    sync.Mutex
+	nodes   []NodeEntry
+	tenants []TenantConfig
+}
+
+func NewMemoryState() *MemoryState {
+	return &MemoryState{}
+}
+
+// copySlice returns a copy of s, which is nil if s is nil
+func copySlice[T any](s []T) []T {
+	if s == nil {
+		return nil
+	}
+	return append(make([]T, 0, len(s)), s...)
+}
+
+func (s *MemoryState) GetNodes() (nodes []NodeEntry, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copySlice(s.nodes), nil
+}
+
+func (s *MemoryState) SaveNode(node NodeEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nodes = saveNodeEntry(s.nodes, node)
+	return nil
+}
+
+func (s *MemoryState) DeleteNode(uri string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nodes = deleteNodeEntry(s.nodes, uri)
+	return nil
+}
+
+func (s *MemoryState) GetTenants() (tenants []TenantConfig, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copySlice(s.tenants), nil
+}
+
+func (s *MemoryState) SaveTenants(tenants []TenantConfig) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tenants = copySlice(tenants)
+	return nil
+}
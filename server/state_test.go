@@ -0,0 +1,191 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// testStateConformance checks the behaviour all State implementations share. newState returns an empty state, and
+// reopen a state with the same storage (i.e. after a restart).
+func testStateConformance(t *testing.T, newState func(t *testing.T) (state State, reopen func() State)) {
+	t.Run("empty", func(t *testing.T) {
+		state, _ := newState(t)
+		nodes, err := state.GetNodes()
+		require.Nil(t, err, err)
+		require.Empty(t, nodes)
+		tenants, err := state.GetTenants()
+		require.Nil(t, err, err)
+		require.Nil(t, tenants)
+	})
+
+	t.Run("nodes", func(t *testing.T) {
+		state, reopen := newState(t)
+		addedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		node1 := NodeEntry{URI: "http://node1", Workers: 2, AddedAt: addedAt}
+		node2 := NodeEntry{URI: "http://node2", AddedAt: addedAt.Add(time.Second)}
+		require.Nil(t, state.SaveNode(node1))
+		require.Nil(t, state.SaveNode(node2))
+		nodes, err := state.GetNodes()
+		require.Nil(t, err, err)
+		require.Equal(t, []NodeEntry{node1, node2}, nodes)
+
+		nodes[0].URI = "http://modified" // the returned list is a copy
+
+		require.Nil(t, state.SaveNode(NodeEntry{URI: "HTTP://Node1/", Workers: 4, AddedAt: addedAt})) // same normalized URI
+		require.Nil(t, state.DeleteNode("http://node2"))
+		require.Nil(t, state.DeleteNode("http://unknown"))
+		nodes, err = reopen().GetNodes()
+		require.Nil(t, err, err)
+		require.Equal(t, []NodeEntry{{URI: "HTTP://Node1/", Workers: 4, AddedAt: addedAt}}, nodes)
+
+		require.Nil(t, state.DeleteNode("http://node1"))
+		nodes, err = reopen().GetNodes()
+		require.Nil(t, err, err)
+		require.Empty(t, nodes)
+	})
+
+	t.Run("tenants", func(t *testing.T) {
+		state, reopen := newState(t)
+		require.Nil(t, state.SaveNode(NodeEntry{URI: "http://node1"}))
+		require.Nil(t, state.SaveTenants(testTenants))
+		tenants, err := reopen().GetTenants()
+		require.Nil(t, err, err)
+		require.Equal(t, testTenants, tenants)
+
+		// An empty list of tenants is different from no saved tenants
+		require.Nil(t, state.SaveTenants([]TenantConfig{}))
+		tenants, err = reopen().GetTenants()
+		require.Nil(t, err, err)
+		require.NotNil(t, tenants)
+		require.Empty(t, tenants)
+
+		// Nodes and tenants are independent
+		nodes, err := reopen().GetNodes()
+		require.Nil(t, err, err)
+		require.Equal(t, []string{"http://node1"}, nodeEntryURIs(nodes))
+	})
+}
+
+// nodeEntryURIs returns the URIs of the entries
+func nodeEntryURIs(nodes []NodeEntry) []string {
+	uris := []string{}
+	for _, node := range nodes {
+		uris = append(uris, node.URI)
+	}
+	return uris
+}
+
+func TestMemoryState(t *testing.T) {
+	testStateConformance(t, func(t *testing.T) (State, func() State) {
+		state := NewMemoryState()
+		return state, func() State { return state }
+	})
+}
+
+func TestRedisStateConformance(t *testing.T) {
+	testStateConformance(t, func(t *testing.T) (State, func() State) {
+		resetTestRedis()
+		return redisTestState, func() State {
+			state, err := NewRedisState(testLog, redisTestServer.Addr(), RedisConnConfig{KeyPrefix: RedisPrefix})
+			require.Nil(t, err, err)
+			return state
+		}
+	})
+}
+
+func TestFileState(t *testing.T) {
+	testStateConformance(t, func(t *testing.T) (State, func() State) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		state, err := NewFileState(path)
+		require.Nil(t, err, err)
+		return state, func() State {
+			state, err := NewFileState(path)
+			require.Nil(t, err, err)
+			return state
+		}
+	})
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	state, err := NewFileState(path)
+	require.Nil(t, err, err)
+	require.Nil(t, state.SaveNode(NodeEntry{URI: "http://node1"}))
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(entries))
+
+	// A failed write doesn't change the state
+	require.Nil(t, os.Chmod(dir, 0o500))
+	defer os.Chmod(dir, 0o700) //nolint:errcheck
+	// root can write anyway
+	if os.Getuid() != 0 {
+		require.NotNil(t, state.SaveNode(NodeEntry{URI: "http://node2"}))
+		nodes, err := state.GetNodes()
+		require.Nil(t, err, err)
+		require.Equal(t, []string{"http://node1"}, nodeEntryURIs(nodes))
+	}
+
+	// Files with plain URIs are loaded as entries
+	legacyPath := filepath.Join(t.TempDir(), "state.json")
+	require.Nil(t, os.WriteFile(legacyPath, []byte(`{"nodes":["http://node1"],"tenants":null}`), 0o600))
+	state, err = NewFileState(legacyPath)
+	require.Nil(t, err, err)
+	nodes, err := state.GetNodes()
+	require.Nil(t, err, err)
+	require.Equal(t, []NodeEntry{{URI: "http://node1"}}, nodes)
+
+	// A corrupt file fails at startup
+	corruptPath := filepath.Join(t.TempDir(), "state.json")
+	require.Nil(t, os.WriteFile(corruptPath, []byte(`{"nodes":`), 0o600))
+	_, err = NewFileState(corruptPath)
+	require.NotNil(t, err)
+}
+
+func TestStateFileFromNodeStore(t *testing.T) {
+	for _, tc := range []struct {
+		nodeStore, stateFile string
+		expected             string
+		err                  bool
+	}{
+		{"", "", "", false},
+		{"redis", "", "", false},
+		{"", "state.json", "state.json", false},
+		{"file:/data/nodes.json", "", "/data/nodes.json", false},
+		{"file:/data/nodes.json", "/data/nodes.json", "/data/nodes.json", false},
+		{"file:/data/nodes.json", "state.json", "", true},
+		{"file:", "", "", true},
+		{"etcd://localhost", "", "", true},
+	} {
+		stateFile, err := StateFileFromNodeStore(tc.nodeStore, tc.stateFile)
+		require.Equal(t, tc.err, err != nil, tc)
+		require.Equal(t, tc.expected, stateFile, tc)
+	}
+}
+
+func TestServerWithStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewServer(ServerOpts{Log: testLog, StateFile: path, WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	defer mockNodeServer.Close()
+	require.Nil(t, s.AddNode(mockNodeServer.URL))
+	s.Shutdown()
+
+	// The node is loaded on the next start
+	s, err = NewServer(ServerOpts{Log: testLog, StateFile: path, WorkersPerNode: 1})
+	require.Nil(t, err, err)
+	defer s.Shutdown()
+	require.Equal(t, []string{mockNodeServer.URL}, s.nodePool.NodeUris())
+
+	_, err = NewServer(ServerOpts{Log: testLog, StateFile: path, RedisURI: "localhost:6379"})
+	require.NotNil(t, err)
+}
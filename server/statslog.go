@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// requestCounters count the sim requests of the webserver, for the stats log
+type requestCounters struct {
+	inFlight  atomic.Int64 // accepted, and not completed yet
+	completed atomic.Int64 // including failed ones and those rejected by the queue
+	failed    atomic.Int64
+}
+
+// accepted counts a request which was added to the queue
+func (c *requestCounters) accepted() {
+	c.inFlight.Inc()
+}
+
+// rejected counts a request which wasn't added to the queue (i.e. because it's full) as failed
+func (c *requestCounters) rejected() {
+	c.completed.Inc()
+	c.failed.Inc()
+}
+
+// finished counts the response of an accepted request. ok is false if the client closed the connection, which is
+// not counted as failed.
+func (c *requestCounters) finished(resp SimResponse, ok bool) {
+	c.inFlight.Dec()
+	c.completed.Inc()
+	if ok && resp.Error != nil {
+		c.failed.Inc()
+	}
+}
+
+// statsLogSnapshot are the counters at the last stats log line, for the rates since then
+type statsLogSnapshot struct {
+	at        time.Time
+	completed int64
+	failed    int64
+}
+
+// RunStatsLog logs a one-line summary of the queue, the request rates and the nodes every interval, until ctx is
+// cancelled. An interval of 0 disables it.
+func (s *Webserver) RunStatsLog(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	snapshot := s.statsLogSnapshot(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			snapshot = s.logStats(snapshot, now)
+		}
+	}
+}
+
+func (s *Webserver) statsLogSnapshot(now time.Time) statsLogSnapshot {
+	return statsLogSnapshot{at: now, completed: s.requests.completed.Load(), failed: s.requests.failed.Load()}
+}
+
+// logStats logs the stats line, with the request rate and error rate since prev. Returns the snapshot for the next
+// line.
+func (s *Webserver) logStats(prev statsLogSnapshot, now time.Time) statsLogSnapshot {
+	cur := s.statsLogSnapshot(now)
+	numCompleted := cur.completed - prev.completed
+	requestsPerSec, errorRate := 0.0, 0.0
+	if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+		requestsPerSec = float64(numCompleted) / elapsed
+	}
+	if numCompleted > 0 {
+		errorRate = float64(cur.failed-prev.failed) / float64(numCompleted)
+	}
+
+	// ages of the oldest queued requests in milliseconds, 0 if there are none
+	ageMs := func(queuedAt time.Time) int64 {
+		if queuedAt.IsZero() {
+			return 0
+		}
+		return now.Sub(queuedAt).Milliseconds()
+	}
+	lenFastTrack, lenHighPrio, lenLowPrio := s.prioQueue.Len()
+	oldestFastTrack, oldestHighPrio, oldestLowPrio := s.prioQueue.OldestQueuedAt()
+
+	s.log.Infow("Stats",
+		"queueSizeFastTrack", lenFastTrack,
+		"queueSizeHighPrio", lenHighPrio,
+		"queueSizeLowPrio", lenLowPrio,
+		"queueBytes", s.prioQueue.NumBytes(),
+		"oldestFastTrackMs", ageMs(oldestFastTrack),
+		"oldestHighPrioMs", ageMs(oldestHighPrio),
+		"oldestLowPrioMs", ageMs(oldestLowPrio),
+		"requestsPerSec", requestsPerSec,
+		"errorRate", errorRate,
+		"inFlight", s.requests.inFlight.Load(),
+		"numNodes", len(s.nodePool.NodeUris()),
+		"numHealthyNodes", s.nodePool.NumHealthyNodes(),
+	)
+	return cur
+}
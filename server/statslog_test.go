@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newStatsLogTestWebserver returns a webserver logging to the observer, with a node and a queue which isn't processed
+func newStatsLogTestWebserver(t *testing.T) (*Webserver, *PrioQueue, *observer.ObservedLogs) {
+	t.Helper()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(testutils.NewMockNodeBackend().Handler))
+	t.Cleanup(mockNodeServer.Close)
+	nodePool := NewNodePool(testLog, nil, 1)
+	t.Cleanup(nodePool.Shutdown)
+	require.Nil(t, nodePool.AddNode(mockNodeServer.URL))
+
+	core, logs := observer.New(zap.InfoLevel)
+	queue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	return NewWebserver(zap.New(core).Sugar(), ":12345", queue, nodePool), queue, logs
+}
+
+func TestStatsLog(t *testing.T) {
+	webserver, queue, logs := newStatsLogTestWebserver(t)
+	start := time.Now()
+	prev := webserver.statsLogSnapshot(start)
+
+	// Queued requests
+	require.True(t, queue.Push(NewSimRequest(context.Background(), "1", []byte("foo"), false, true)))
+	require.True(t, queue.Push(NewSimRequest(context.Background(), "2", []byte("foo"), false, false)))
+	require.True(t, queue.Push(NewSimRequest(context.Background(), "3", []byte("foo"), false, false)))
+
+	// 4 completed requests (one failed, one rejected), and one in flight
+	for i := 0; i < 4; i++ {
+		webserver.requests.accepted()
+	}
+	webserver.requests.finished(SimResponse{}, true)
+	webserver.requests.finished(SimResponse{Error: errors.New("error")}, true)
+	webserver.requests.finished(SimResponse{}, false) // client closed the connection
+	webserver.requests.rejected()
+
+	prev = webserver.logStats(prev, start.Add(2*time.Second))
+	entries := logs.TakeAll()
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "Stats", entries[0].Message)
+	require.Equal(t, zap.InfoLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	require.Equal(t, int64(1), fields["queueSizeFastTrack"])
+	require.Equal(t, int64(0), fields["queueSizeHighPrio"])
+	require.Equal(t, int64(2), fields["queueSizeLowPrio"])
+	require.Equal(t, int64(9), fields["queueBytes"])
+	require.GreaterOrEqual(t, fields["oldestFastTrackMs"], int64(1900))
+	require.Equal(t, int64(0), fields["oldestHighPrioMs"])
+	require.GreaterOrEqual(t, fields["oldestLowPrioMs"], int64(1900))
+	require.Equal(t, 2.0, fields["requestsPerSec"])
+	require.Equal(t, 0.5, fields["errorRate"])
+	require.Equal(t, int64(1), fields["inFlight"])
+	require.Equal(t, int64(1), fields["numNodes"])
+	require.Equal(t, int64(1), fields["numHealthyNodes"])
+
+	// The rates are since the last line
+	webserver.logStats(prev, start.Add(3*time.Second))
+	fields = logs.TakeAll()[0].ContextMap()
+	require.Equal(t, 0.0, fields["requestsPerSec"])
+	require.Equal(t, 0.0, fields["errorRate"])
+}
+
+func TestRunStatsLog(t *testing.T) {
+	webserver, _, logs := newStatsLogTestWebserver(t)
+
+	// Disabled
+	webserver.RunStatsLog(context.Background(), 0) // returns immediately
+	require.Equal(t, 0, logs.FilterMessage("Stats").Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		webserver.RunStatsLog(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return logs.FilterMessage("Stats").Len() >= 2 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
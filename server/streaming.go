@@ -0,0 +1,147 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// streamedBody is the body of a node response which is streamed to the client. The worker waits until it's closed.
+type streamedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func newStreamedBody(body io.ReadCloser) *streamedBody {
+	return &streamedBody{ReadCloser: body, done: make(chan struct{})}
+}
+
+// Close closes the response body, and can be called more than once
+func (b *streamedBody) Close() (err error) {
+	b.once.Do(func() {
+		err = b.ReadCloser.Close()
+		close(b.done)
+	})
+	return err
+}
+
+// canStream returns whether the response to the request can be streamed: the client asked for it, and the response
+// is neither checked by a validator nor by middlewares, which need the whole payload. Only HTTP nodes stream responses.
+func (n *Node) canStream(req *SimRequest) bool {
+	if !req.Stream || n.validation.enabled() || len(n.middlewares.list()) > 0 {
+		return false
+	}
+	_, ok := n.transport.(*httpTransport)
+	return ok
+}
+
+// streamProxyRequest sends the payload to the node like proxyRequest, and returns the body of a successful response
+// unread. The proxy timeout applies until it's closed. Streamed calls are not covered by the proxy watchdog.
+func (n *Node) streamProxyRequest(ctx context.Context, req *SimRequest, contentType string, target *HTTPRequest) (body *streamedBody, resp []byte, respContentType string, statusCode int, err error) {
+	if header := n.header(); len(header) > 0 {
+		ctx = withNodeHeaders(ctx, header)
+	}
+	respBody, resp, respContentType, statusCode, err := n.transport.(*httpTransport).proxyStream(ctx, req.Payload, contentType, target, req.ProxyRequestTimeout())
+	if err != nil {
+		return nil, resp, respContentType, statusCode, err
+	}
+	return newStreamedBody(respBody), nil, respContentType, statusCode, nil
+}
+
+// sendStream sends the successful response with the streamed body, and waits until the receiver closed the body, or
+// the request was cancelled. The body is closed unread if the response couldn't be sent.
+func (n *Node) sendStream(log *zap.SugaredLogger, req *SimRequest, response SimResponse, body *streamedBody) {
+	defer body.Close()
+	n.recordResult(response)
+	n.observeResult(false)
+	if n.faults.inject(FaultDrop, n.metrics) {
+		log.Warnw("injected fault: dropping the response", "fault", FaultDrop)
+		time.AfterFunc(time.Until(req.Deadline()), func() {
+			req.SendResponse(SimResponse{Error: req.timeoutError(), NodeURI: n.URI, SimAt: response.SimAt, Fault: FaultDrop})
+		})
+		return
+	}
+
+	log.Debug("request processed, streaming response")
+	response.Body = body
+	if !req.SendResponse(response) {
+		if !req.IsCancelled() {
+			log.Errorw("couldn't send node response to client (SendResponse returned false)", "secSinceRequestCreated", time.Since(req.CreatedAt).Seconds())
+		}
+		return
+	}
+	var done <-chan struct{}
+	if req.Context != nil {
+		done = req.Context.Done()
+	}
+	select {
+	case <-body.done:
+	case <-done:
+	}
+}
+
+// writeStreamedPayload copies the streamed body of a node response to the client with the status code, gzip
+// compressed if the client accepts it and compression is enabled (see ResponseGzipMinBytes, the size is not known in
+// advance). Returns the number of bytes of the body, and the error if reading it failed mid-stream. Write errors are
+// ignored like in writePayload, the client is gone.
+func writeStreamedPayload(w http.ResponseWriter, req *http.Request, statusCode int, body io.Reader) (n int64, err error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+	dst := flushWriter{w: w}
+	if ResponseGzipMinBytes > 0 && acceptsGzip(req) {
+		w.Header().Set("Content-Encoding", "gzip")
+		dst.gz = gzip.NewWriter(w)
+	}
+	w.WriteHeader(statusCode)
+
+	src := &readErrorTracker{r: body}
+	n, _ = io.Copy(dst, src)
+	if src.err != nil {
+		return n, src.err
+	}
+	if dst.gz != nil {
+		dst.gz.Close()
+	}
+	return n, nil
+}
+
+// flushWriter flushes every write to the client (through the gzip writer, if any), so that the chunks of the node
+// response are passed on right away
+type flushWriter struct {
+	w  http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (f flushWriter) Write(p []byte) (n int, err error) {
+	if f.gz != nil {
+		if n, err = f.gz.Write(p); err == nil {
+			err = f.gz.Flush()
+		}
+	} else {
+		n, err = f.w.Write(p)
+	}
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// readErrorTracker keeps the read error of a copy, to tell it from the write errors
+type readErrorTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *readErrorTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestWebserverStreamResponses(t *testing.T) {
+	defer func(streamResponses bool) { StreamResponses = streamResponses }(StreamResponses)
+	StreamResponses = true
+
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+	var mode atomic.String
+	var numFailed atomic.Int32
+	firstChunkRead := make(chan struct{}, 1)
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if !strings.Contains(string(body), "eth_callBundle") { // health check
+			w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+			return
+		}
+		switch mode.Load() {
+		case "error-once":
+			if numFailed.Inc() == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("unavailable"))
+				return
+			}
+		case "fail-mid-stream":
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(chunk)
+		w.(http.Flusher).Flush()
+		select { // the first chunk reaches the client before the node response is complete
+		case <-firstChunkRead:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write(chunk)
+	}))
+	defer nodeServer.Close()
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	t.Cleanup(prioQueue.Close)
+	nodePool := NewNodePool(testLog, nil, 1)
+	defer nodePool.Shutdown()
+	require.Nil(t, nodePool.AddNode(nodeServer.URL+"?_healthcheck_success=status"))
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+	go func() {
+		for job := prioQueue.Pop(); job != nil; job = prioQueue.Pop() {
+			nodePool.JobC <- job
+		}
+	}()
+	server := httptest.NewServer(LoggingMiddleware(testLog, http.HandlerFunc(webserver.HandleQueueRequest)))
+	defer server.Close()
+	sim := func() *http.Response {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+		require.Nil(t, err, err)
+		return resp
+	}
+
+	// The status code and content type of the node response are forwarded, the body is passed on while the node
+	// sends it
+	for i, m := range []string{"", "error-once"} {
+		mode.Store(m)
+		resp := sim()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		require.Equal(t, fmt.Sprint(i+1), resp.Header.Get("X-Tries")) // the error response was retried, not streamed
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		first := make([]byte, len(chunk))
+		_, err := io.ReadFull(resp.Body, first)
+		require.Nil(t, err, err)
+		firstChunkRead <- struct{}{}
+		rest, err := io.ReadAll(resp.Body)
+		require.Nil(t, err, err)
+		require.Equal(t, len(chunk), len(rest))
+		resp.Body.Close()
+	}
+
+	// A failure mid-stream aborts the client response, and frees the worker
+	mode.Store("fail-mid-stream")
+	resp := sim()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err := io.ReadAll(resp.Body)
+	require.NotNil(t, err)
+	resp.Body.Close()
+
+	mode.Store("")
+	resp = sim()
+	firstChunkRead <- struct{}{}
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err, err)
+	require.Equal(t, 2*len(chunk), len(body))
+	resp.Body.Close()
+}
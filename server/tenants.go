@@ -0,0 +1,514 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTenantInvalidName   = errors.New("tenant name must not be empty")
+	ErrTenantInvalidAPIKey = errors.New("tenant API key must not be empty")
+	ErrTenantInvalidWeight = errors.New("tenant weight must be positive")
+	ErrTenantDuplicate     = errors.New("duplicate tenant name or API key")
+	ErrTenantInvalidPrio   = errors.New("tenant max. priority must be fast-track, high-prio or low-prio")
+)
+
+// TenantConfig configures the queue of a tenant. Limits of 0 mean no limit.
+type TenantConfig struct {
+	Name         string `json:"name"`
+	APIKey       string `json:"apiKey"`
+	Weight       int    `json:"weight"` // share of the node capacity, relative to the other tenants with queued requests
+	MaxFastTrack int    `json:"maxFastTrack"`
+	MaxHighPrio  int    `json:"maxHighPrio"`
+	MaxLowPrio   int    `json:"maxLowPrio"`
+	MaxPriority  string `json:"maxPriority,omitempty"` // the highest priority the tenant may submit (fast-track, high-prio or low-prio), empty for any
+}
+
+// ParseTenants parses a JSON list of tenant configs (an empty string returns no tenants)
+func ParseTenants(s string) (tenants []TenantConfig, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(s), &tenants); err != nil {
+		return nil, err
+	}
+	return tenants, ValidateTenants(tenants)
+}
+
+func ValidateTenants(tenants []TenantConfig) error {
+	names := make(map[string]bool)
+	apiKeys := make(map[string]bool)
+	for _, tenant := range tenants {
+		if tenant.Name == "" {
+			return ErrTenantInvalidName
+		} else if tenant.APIKey == "" {
+			return errors.Wrap(ErrTenantInvalidAPIKey, tenant.Name)
+		} else if tenant.Weight <= 0 {
+			return errors.Wrap(ErrTenantInvalidWeight, tenant.Name)
+		} else if tenant.MaxPriority != "" && tenant.MaxPriority != PriorityFastTrack && tenant.MaxPriority != PriorityHighPrio && tenant.MaxPriority != PriorityLowPrio {
+			return errors.Wrap(ErrTenantInvalidPrio, tenant.Name)
+		} else if names[tenant.Name] || apiKeys[tenant.APIKey] {
+			return errors.Wrap(ErrTenantDuplicate, tenant.Name)
+		}
+		names[tenant.Name] = true
+		apiKeys[tenant.APIKey] = true
+	}
+	return nil
+}
+
+// TenantStats are the queue sizes of a tenant
+type TenantStats struct {
+	Weight             int   `json:"weight"`
+	QueueSizeFastTrack int   `json:"queueSizeFastTrack"`
+	QueueSizeHighPrio  int   `json:"queueSizeHighPrio"`
+	QueueSizeLowPrio   int   `json:"queueSizeLowPrio"`
+	QueueBytes         int64 `json:"queueBytes"`
+	NumPopped          int64 `json:"numPopped"` // number of requests which were sent to the nodes
+}
+
+type tenantQueue struct {
+	config        TenantConfig
+	queue         *PrioQueue
+	currentWeight int   // for smooth weighted round-robin
+	numPopped     int64 // guarded by the TenantQueue lock
+	removed       bool  // removed tenants don't accept new requests, and are deleted when empty
+}
+
+// TenantQueue has a PrioQueue per tenant (with its own limits), and shares the node capacity between the tenants
+// with a smooth weighted round-robin. Tenants without queued requests are skipped. Requests are assigned to
+// tenants by SimRequest.Tenant.
+type TenantQueue struct {
+	state       State // (optional) tenant configs are saved on updates
+	cond        *sync.Cond
+	tenants     map[string]*tenantQueue // by name
+	apiKeys     map[string]string       // API key -> tenant name
+	closed      bool
+	numRequests int
+
+	numFastTrackForHighPrio int
+	highPrioWeight          int // see SetInterleaveWeights
+	fastTrackDrainFirst     bool
+	order                   SmallestFirstOrder
+	aging                   PriorityAging
+	numLevels               int // see SetPriorityLevels
+	coalescing              bool
+	prometheus              *PrometheusMetrics
+
+	threshold          int
+	onThresholdCrossed func(above bool, numRequests int)
+	onPop              func(r *SimRequest, wait time.Duration)
+}
+
+func NewTenantQueue(tenants []TenantConfig, state State, numFastTrackForHighPrio int, fastTrackDrainFirst bool, aging PriorityAging) (*TenantQueue, error) {
+	q := &TenantQueue{
+		state:                   state,
+		cond:                    sync.NewCond(&sync.Mutex{}),
+		tenants:                 make(map[string]*tenantQueue),
+		apiKeys:                 make(map[string]string),
+		numFastTrackForHighPrio: numFastTrackForHighPrio,
+		highPrioWeight:          1,
+		fastTrackDrainFirst:     fastTrackDrainFirst,
+		aging:                   aging,
+	}
+	return q, q.setTenants(tenants)
+}
+
+// UpdateTenants applies a new tenant config at runtime, and saves it to the state. Queued requests of removed tenants
+// are still processed.
+func (q *TenantQueue) UpdateTenants(tenants []TenantConfig) error {
+	if err := q.setTenants(tenants); err != nil {
+		return err
+	}
+	if q.state == nil {
+		return nil
+	}
+	return errors.Wrap(q.state.SaveTenants(tenants), "saving tenants failed")
+}
+
+func (q *TenantQueue) setTenants(tenants []TenantConfig) error {
+	if err := ValidateTenants(tenants); err != nil {
+		return err
+	}
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.apiKeys = make(map[string]string)
+	updated := make(map[string]bool)
+	for _, config := range tenants {
+		q.apiKeys[config.APIKey] = config.Name
+		updated[config.Name] = true
+		if t, ok := q.tenants[config.Name]; ok {
+			t.config = config
+			t.removed = false
+			t.queue.SetLimits(config.MaxFastTrack, config.MaxHighPrio, config.MaxLowPrio)
+		} else {
+			queue := NewPrioQueue(config.MaxFastTrack, config.MaxHighPrio, config.MaxLowPrio, q.numFastTrackForHighPrio, q.fastTrackDrainFirst, q.aging)
+			queue.SetSmallestFirst(q.order)
+			queue.SetPriorityLevels(q.numLevels)
+			queue.SetInterleaveWeights(q.numFastTrackForHighPrio, q.highPrioWeight)
+			queue.SetPrometheusMetrics(q.prometheus)
+			queue.SetCoalescing(q.coalescing)
+			q.tenants[config.Name] = &tenantQueue{config: config, queue: queue}
+		}
+	}
+
+	for name, t := range q.tenants {
+		if !updated[name] {
+			t.removed = true
+			if t.queue.NumRequests() == 0 {
+				delete(q.tenants, name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetPriorityLevels changes the number of priority levels of all tenants, see PrioQueue.SetPriorityLevels
+func (q *TenantQueue) SetPriorityLevels(numLevels int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.numLevels = numLevels
+	for _, t := range q.tenants {
+		t.queue.SetPriorityLevels(numLevels)
+	}
+}
+
+// SetInterleaveWeights changes the ratio of fast-track to high-prio requests of all tenants, see
+// PrioQueue.SetInterleaveWeights
+func (q *TenantQueue) SetInterleaveWeights(fastTrackWeight, highPrioWeight int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.numFastTrackForHighPrio, q.highPrioWeight = fastTrackWeight, highPrioWeight
+	for _, t := range q.tenants {
+		t.queue.SetInterleaveWeights(fastTrackWeight, highPrioWeight)
+	}
+}
+
+// SetSmallestFirst changes the order within the priorities of all tenants, see SmallestFirstOrder
+func (q *TenantQueue) SetSmallestFirst(order SmallestFirstOrder) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.order = order
+	for _, t := range q.tenants {
+		t.queue.SetSmallestFirst(order)
+	}
+}
+
+// SetCoalescing enables the coalescing of identical requests within each tenant, see PrioQueue.SetCoalescing
+func (q *TenantQueue) SetCoalescing(enabled bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.coalescing = enabled
+	for _, t := range q.tenants {
+		t.queue.SetCoalescing(enabled)
+	}
+}
+
+// SetPrometheusMetrics counts the pushed and popped requests of all tenants in metrics (nil disables it)
+func (q *TenantQueue) SetPrometheusMetrics(metrics *PrometheusMetrics) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.prometheus = metrics
+	for _, t := range q.tenants {
+		t.queue.SetPrometheusMetrics(metrics)
+	}
+}
+
+// Tenants returns the current tenant configs, sorted by name
+func (q *TenantQueue) Tenants() []TenantConfig {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	res := []TenantConfig{}
+	for _, t := range q.tenants {
+		if !t.removed {
+			res = append(res, t.config)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// TenantForAPIKey returns the name of the tenant with the API key
+func (q *TenantQueue) TenantForAPIKey(apiKey string) (name string, found bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	name, found = q.apiKeys[apiKey]
+	return name, found
+}
+
+// MaxPriority returns the max. priority of the tenant (see TenantConfig), empty if there is none
+func (q *TenantQueue) MaxPriority(name string) string {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if tq, found := q.tenants[name]; found {
+		return tq.config.MaxPriority
+	}
+	return ""
+}
+
+// Stats returns the stats per tenant
+func (q *TenantQueue) Stats() map[string]TenantStats {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	res := make(map[string]TenantStats)
+	for name, t := range q.tenants {
+		lenFastTrack, lenHighPrio, lenLowPrio := t.queue.Len()
+		res[name] = TenantStats{
+			Weight:             t.config.Weight,
+			QueueSizeFastTrack: lenFastTrack,
+			QueueSizeHighPrio:  lenHighPrio,
+			QueueSizeLowPrio:   lenLowPrio,
+			QueueBytes:         t.queue.NumBytes(),
+			NumPopped:          t.numPopped,
+		}
+	}
+	return res
+}
+
+func (q *TenantQueue) Len() (lenFastTrack, lenHighPrio, lenLowPrio int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for _, t := range q.tenants {
+		f, h, l := t.queue.Len()
+		lenFastTrack, lenHighPrio, lenLowPrio = lenFastTrack+f, lenHighPrio+h, lenLowPrio+l
+	}
+	return lenFastTrack, lenHighPrio, lenLowPrio
+}
+
+func (q *TenantQueue) NumRequests() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.numRequests
+}
+
+// OldestQueuedAt returns when the oldest request of every priority was queued, over all tenants (zero if there is none)
+func (q *TenantQueue) OldestQueuedAt() (fastTrack, highPrio, lowPrio time.Time) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	older := func(a, b time.Time) time.Time {
+		if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+			return b
+		}
+		return a
+	}
+	for _, t := range q.tenants {
+		f, h, l := t.queue.OldestQueuedAt()
+		fastTrack, highPrio, lowPrio = older(fastTrack, f), older(highPrio, h), older(lowPrio, l)
+	}
+	return fastTrack, highPrio, lowPrio
+}
+
+func (q *TenantQueue) NumBytes() (numBytes int64) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for _, t := range q.tenants {
+		numBytes += t.queue.NumBytes()
+	}
+	return numBytes
+}
+
+func (q *TenantQueue) OnThresholdCrossed(threshold int, cb func(above bool, numRequests int)) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.threshold = threshold
+	q.onThresholdCrossed = cb
+}
+
+func (q *TenantQueue) OnPop(cb func(r *SimRequest, wait time.Duration)) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.onPop = cb
+}
+
+// Push adds the request to the queue of its tenant. Returns false if the tenant is unknown, or its queue is full.
+func (q *TenantQueue) Push(r *SimRequest) bool {
+	if r == nil {
+		return false
+	}
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	t, ok := q.tenants[r.Tenant]
+	if q.closed || !ok || t.removed {
+		return false
+	}
+	if added, joined := t.queue.push(r, q); !added {
+		return false
+	} else if joined { // waits for the identical request, which is counted already
+		return true
+	}
+
+	q.numRequests++
+	if q.threshold > 0 && q.onThresholdCrossed != nil && q.numRequests == q.threshold {
+		q.onThresholdCrossed(true, q.threshold)
+	}
+	q.cond.Signal()
+	return true
+}
+
+// CanPush returns whether Push would add r now: its tenant exists, and the limit of its priority isn't reached
+func (q *TenantQueue) CanPush(r *SimRequest) bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	t, ok := q.tenants[r.Tenant]
+	return !q.closed && ok && !t.removed && t.queue.CanPush(r)
+}
+
+// Pop returns the next request of the tenant which is next in the weighted round-robin. Blocks until there is a
+// request, will return nil only after calling Close() when the queue is empty.
+func (q *TenantQueue) Pop() *SimRequest {
+	return q.PopCtx(context.Background())
+}
+
+// PopCtx is Pop, but also returns nil once ctx is done (see PrioQueue.PopCtx)
+func (q *TenantQueue) PopCtx(ctx context.Context) *SimRequest {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.numRequests == 0 {
+		defer wakeOnDone(ctx, q.cond)()
+	}
+	for q.numRequests == 0 {
+		if q.closed || ctx.Err() != nil {
+			return nil
+		}
+		q.cond.Wait()
+	}
+
+	// Smooth weighted round-robin between the tenants with queued requests
+	var next *tenantQueue
+	totalWeight := 0
+	for _, t := range q.tenants {
+		if t.queue.NumRequests() == 0 {
+			continue
+		}
+		t.currentWeight += t.config.Weight
+		totalWeight += t.config.Weight
+		if next == nil || t.currentWeight > next.currentWeight || (t.currentWeight == next.currentWeight && t.config.Name < next.config.Name) {
+			next = t
+		}
+	}
+	next.currentWeight -= totalWeight
+	next.numPopped++
+
+	r := next.queue.Pop() // doesn't block, the queue is not empty
+	q.numRequests--
+	if q.onPop != nil {
+		q.onPop(r, time.Since(r.QueuedAt))
+	}
+	if next.removed && next.queue.NumRequests() == 0 {
+		delete(q.tenants, next.config.Name)
+	}
+	if q.threshold > 0 && q.onThresholdCrossed != nil && q.numRequests == q.threshold-1 {
+		q.onThresholdCrossed(false, q.threshold-1)
+	}
+	if q.closed && q.numRequests == 0 {
+		q.cond.Broadcast()
+	}
+	return r
+}
+
+// DropLowPrio removes the queued low-prio requests of all tenants, and returns them oldest first
+func (q *TenantQueue) DropLowPrio() []*SimRequest {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	var dropped []*SimRequest
+	for name, t := range q.tenants {
+		dropped = append(dropped, t.queue.DropLowPrio()...)
+		if t.removed && t.queue.NumRequests() == 0 {
+			delete(q.tenants, name)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	sort.SliceStable(dropped, func(i, j int) bool { return dropped[i].QueuedAt.Before(dropped[j].QueuedAt) })
+
+	numBefore := q.numRequests
+	q.numRequests -= len(dropped)
+	if q.threshold > 0 && q.onThresholdCrossed != nil && numBefore >= q.threshold && q.numRequests < q.threshold {
+		q.onThresholdCrossed(false, q.numRequests)
+	}
+	if q.closed && q.numRequests == 0 {
+		q.cond.Broadcast()
+	}
+	return dropped
+}
+
+// Remove removes r from the queue of its tenant (see PrioQueue.Remove)
+func (q *TenantQueue) Remove(r *SimRequest) bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	t, ok := q.tenants[r.Tenant]
+	if !ok || !t.queue.Remove(r) {
+		return false
+	}
+	q.numRequests--
+	if t.removed && t.queue.NumRequests() == 0 {
+		delete(q.tenants, r.Tenant)
+	}
+	if q.threshold > 0 && q.onThresholdCrossed != nil && q.numRequests == q.threshold-1 {
+		q.onThresholdCrossed(false, q.threshold-1)
+	}
+	if q.closed && q.numRequests == 0 {
+		q.cond.Broadcast()
+	}
+	return true
+}
+
+// Snapshot returns the queued requests of all tenants by priority (fast-track, high-prio, then low-prio), each
+// oldest first
+func (q *TenantQueue) Snapshot() []*SimRequest {
+	q.cond.L.Lock()
+	var requests []*SimRequest
+	for _, t := range q.tenants {
+		requests = append(requests, t.queue.Snapshot()...)
+	}
+	q.cond.L.Unlock()
+
+	rank := map[string]int{PriorityFastTrack: 0, PriorityHighPrio: 1, PriorityLowPrio: 2}
+	sort.SliceStable(requests, func(i, j int) bool {
+		if ri, rj := rank[requests[i].Priority()], rank[requests[j].Priority()]; ri != rj {
+			return ri < rj
+		}
+		return requests[i].QueuedAt.Before(requests[j].QueuedAt)
+	})
+	return requests
+}
+
+// Close disallows adding any new items with Push(), and lets readers using Pop() return nil if queue is empty
+func (q *TenantQueue) Close() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// IsClosed returns true after Close() was called
+func (q *TenantQueue) IsClosed() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.closed
+}
+
+// CloseAndWait closes the queue and waits until the queue is empty
+func (q *TenantQueue) CloseAndWait() {
+	q.Close()
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for q.numRequests > 0 {
+		q.cond.Wait()
+	}
+}
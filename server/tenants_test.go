@@ -0,0 +1,338 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func newTenantRequest(tenant string, isHighPrio bool) *SimRequest {
+	r := NewSimRequest(context.Background(), "1", []byte("tenantTask"), isHighPrio, false)
+	r.Tenant = tenant
+	return r
+}
+
+var testTenants = []TenantConfig{
+	{Name: "a", APIKey: "key-a", Weight: 3},
+	{Name: "b", APIKey: "key-b", Weight: 1, MaxLowPrio: 5},
+}
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := ParseTenants("")
+	require.Nil(t, err, err)
+	require.Nil(t, tenants)
+
+	tenants, err = ParseTenants(`[{"name":"a","apiKey":"key-a","weight":2,"maxLowPrio":10}]`)
+	require.Nil(t, err, err)
+	require.Equal(t, []TenantConfig{{Name: "a", APIKey: "key-a", Weight: 2, MaxLowPrio: 10}}, tenants)
+
+	_, err = ParseTenants(`[{"name":"a","apiKey":"key-a"}]`)
+	require.ErrorIs(t, err, ErrTenantInvalidWeight)
+
+	_, err = ParseTenants(`[{"name":"a","apiKey":"key-a","weight":1},{"name":"b","apiKey":"key-a","weight":1}]`)
+	require.ErrorIs(t, err, ErrTenantDuplicate)
+
+	_, err = ParseTenants(`[{"name":"a","apiKey":"key-a","weight":1,"maxPriority":"urgent"}]`)
+	require.ErrorIs(t, err, ErrTenantInvalidPrio)
+
+	_, err = ParseTenants(`{}`)
+	require.NotNil(t, err)
+}
+
+func TestTenantQueueWeightedRoundRobin(t *testing.T) {
+	q, err := NewTenantQueue(testTenants, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+
+	for i := 0; i < 40; i++ {
+		require.True(t, q.Push(newTenantRequest("a", false)))
+	}
+	for i := 0; i < 5; i++ {
+		require.True(t, q.Push(newTenantRequest("b", false)))
+	}
+	require.False(t, q.Push(newTenantRequest("b", false)), "tenant b low-prio queue should be full")
+	require.False(t, q.Push(newTenantRequest("unknown", false)), "unknown tenant should be rejected")
+	require.True(t, q.Push(newTenantRequest("b", true)), "tenant b high-prio queue has no limit")
+	require.Equal(t, 46, q.NumRequests())
+
+	// While both tenants have queued requests, the capacity is shared 3:1
+	popped := make(map[string]int)
+	for i := 0; i < 24; i++ {
+		popped[q.Pop().Tenant]++
+	}
+	require.Equal(t, 18, popped["a"])
+	require.Equal(t, 6, popped["b"])
+
+	// Tenant b is drained, so tenant a gets the full capacity
+	for i := 0; i < 22; i++ {
+		require.Equal(t, "a", q.Pop().Tenant)
+	}
+	require.Equal(t, 0, q.NumRequests())
+
+	stats := q.Stats()
+	require.Equal(t, int64(40), stats["a"].NumPopped)
+	require.Equal(t, int64(6), stats["b"].NumPopped)
+}
+
+func TestTenantQueuePopCtx(t *testing.T) {
+	q, err := NewTenantQueue(testTenants, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	popped := make(chan *SimRequest, 1)
+	go func() { popped <- q.PopCtx(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	require.Nil(t, <-popped)
+
+	r := newTenantRequest("a", false)
+	require.True(t, q.Push(r))
+	require.Equal(t, r, q.PopCtx(context.Background()))
+}
+
+func TestTenantQueueOldestQueuedAt(t *testing.T) {
+	q, err := NewTenantQueue(testTenants, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	fastTrack, highPrio, lowPrio := q.OldestQueuedAt()
+	require.True(t, fastTrack.IsZero() && highPrio.IsZero() && lowPrio.IsZero())
+
+	first := newTenantRequest("b", false)
+	require.True(t, q.Push(first))
+	require.True(t, q.Push(newTenantRequest("a", false)))
+	require.True(t, q.Push(newTenantRequest("a", true)))
+	fastTrack, highPrio, lowPrio = q.OldestQueuedAt()
+	require.True(t, fastTrack.IsZero())
+	require.False(t, highPrio.IsZero())
+	require.Equal(t, first.QueuedAt, lowPrio) // the oldest over all tenants
+}
+
+func TestTenantQueueSnapshot(t *testing.T) {
+	q, err := NewTenantQueue(testTenants, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	lowB, lowA, highA, highB := newTenantRequest("b", false), newTenantRequest("a", false), newTenantRequest("a", true), newTenantRequest("b", true)
+	for _, r := range []*SimRequest{lowB, lowA, highA, highB} {
+		require.True(t, q.Push(r))
+	}
+
+	// By priority over all tenants, oldest first
+	require.Equal(t, []*SimRequest{highA, highB, lowB, lowA}, q.Snapshot())
+	require.Equal(t, 4, q.NumRequests())
+}
+
+func TestTenantQueueUpdate(t *testing.T) {
+	resetTestRedis()
+
+	q, err := NewTenantQueue(testTenants, redisTestState, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	require.True(t, q.Push(newTenantRequest("b", false)))
+	require.True(t, q.Push(newTenantRequest("b", false)))
+
+	// Remove tenant b and add tenant c
+	err = q.UpdateTenants([]TenantConfig{testTenants[0], {Name: "c", APIKey: "key-c", Weight: 1}})
+	require.Nil(t, err, err)
+	_, found := q.TenantForAPIKey("key-b")
+	require.False(t, found)
+	name, found := q.TenantForAPIKey("key-c")
+	require.True(t, found)
+	require.Equal(t, "c", name)
+	require.Equal(t, []string{"a", "c"}, []string{q.Tenants()[0].Name, q.Tenants()[1].Name})
+
+	// Queued requests of tenant b are still processed, but new ones are rejected
+	require.False(t, q.Push(newTenantRequest("b", false)))
+	require.Equal(t, "b", q.Pop().Tenant)
+	require.Equal(t, "b", q.Pop().Tenant)
+	_, found = q.Stats()["b"]
+	require.False(t, found, "removed tenant should be deleted once empty")
+
+	// The update was saved to redis
+	tenants, err := redisTestState.GetTenants()
+	require.Nil(t, err, err)
+	require.Equal(t, q.Tenants(), tenants)
+
+	// Invalid updates are rejected
+	err = q.UpdateTenants([]TenantConfig{{Name: "d", APIKey: "key-d"}})
+	require.ErrorIs(t, err, ErrTenantInvalidWeight)
+	require.Equal(t, 2, len(q.Tenants()))
+}
+
+func TestServerTenantsFromRedis(t *testing.T) {
+	resetTestRedis()
+
+	_TenantsConfig := TenantsConfig
+	defer func() { TenantsConfig = _TenantsConfig }()
+	TenantsConfig = `[{"name":"a","apiKey":"key-a","weight":1}]`
+
+	// Tenants from the env are saved to redis on the first start
+	s, err := NewServer(ServerOpts{Log: testLog, RedisURI: redisTestServer.Addr()})
+	require.Nil(t, err, err)
+	require.IsType(t, &TenantQueue{}, s.prioQueue)
+	tenants, err := redisTestState.GetTenants()
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(tenants))
+
+	// Afterwards, the tenants saved in redis take precedence
+	err = redisTestState.SaveTenants(testTenants)
+	require.Nil(t, err, err)
+	s, err = NewServer(ServerOpts{Log: testLog, RedisURI: redisTestServer.Addr()})
+	require.Nil(t, err, err)
+	require.Equal(t, testTenants, s.prioQueue.(*TenantQueue).Tenants())
+}
+
+func TestWebserverTenants(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	tenantQueue, err := NewTenantQueue(testTenants, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	t.Cleanup(tenantQueue.Close)
+	nodePool := NewNodePool(testLog, nil, 1)
+	err = nodePool.AddNode(mockNodeServer.URL)
+	require.Nil(t, err, err)
+	webserver := NewWebserver(testLog, ":12345", tenantQueue, nodePool)
+
+	// Pump jobs from the tenant queue to nodepool
+	go func() {
+		for {
+			job := tenantQueue.Pop()
+			if job == nil {
+				return
+			}
+			nodePool.JobC <- job
+		}
+	}()
+
+	reqPayloadBytes, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+
+	// Requests without a known API key are rejected
+	for _, apiKey := range []string{"", "key-x"} {
+		req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+		req.Header.Set("X-API-Key", apiKey)
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		require.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+	req.Header.Set("X-API-Key", "key-b")
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, int64(1), tenantQueue.Stats()["b"].NumPopped)
+
+	// GET /admin/tenants masks the API keys
+	rr = httptest.NewRecorder()
+	webserver.HandleTenantsRequest(rr, httptest.NewRequest("GET", "/admin/tenants", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	res := TenantsResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	require.Equal(t, 2, len(res.Tenants))
+	require.Equal(t, "key-****", res.Tenants[0].APIKey)
+	require.Equal(t, int64(1), res.Stats["b"].NumPopped)
+
+	// POST /admin/tenants replaces the tenants
+	rr = httptest.NewRecorder()
+	webserver.HandleTenantsRequest(rr, httptest.NewRequest("POST", "/admin/tenants", bytes.NewBufferString(`[{"name":"c","apiKey":"key-c","weight":1}]`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	_, found := tenantQueue.TenantForAPIKey("key-c")
+	require.True(t, found)
+
+	rr = httptest.NewRecorder()
+	webserver.HandleTenantsRequest(rr, httptest.NewRequest("POST", "/admin/tenants", bytes.NewBufferString(`[{"name":"c"}]`)))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestWebserverTenantMaxPriority(t *testing.T) {
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+	defer mockNodeServer.Close()
+
+	tenants := []TenantConfig{
+		{Name: "a", APIKey: "key-a", Weight: 1},
+		{Name: "b", APIKey: "key-b", Weight: 1, MaxPriority: PriorityHighPrio},
+		{Name: "c", APIKey: "key-c", Weight: 1, MaxPriority: PriorityLowPrio},
+	}
+	tenantQueue, err := NewTenantQueue(tenants, nil, 2, false, PriorityAging{})
+	require.Nil(t, err, err)
+	t.Cleanup(tenantQueue.Close)
+	nodePool := NewNodePool(testLog, nil, 1)
+	require.Nil(t, nodePool.AddNode(mockNodeServer.URL))
+	defer nodePool.Shutdown()
+	webserver := NewWebserver(testLog, ":12345", tenantQueue, nodePool)
+
+	// Pump jobs from the tenant queue to nodepool, with the priority they were queued with
+	priorities := make(chan string, 10)
+	go func() {
+		for {
+			job := tenantQueue.Pop()
+			if job == nil {
+				return
+			}
+			priorities <- job.Priority()
+			nodePool.JobC <- job
+		}
+	}()
+
+	reqPayloadBytes, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+	submit := func(apiKey string, header string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+		req.Header.Set("X-API-Key", apiKey)
+		if header != "" {
+			req.Header.Set(header, "true")
+		}
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		return rr
+	}
+
+	// Requests above the max. priority are downgraded
+	for _, tt := range []struct {
+		apiKey   string
+		header   string
+		priority string
+	}{
+		{"key-a", "X-Fast-Track", PriorityFastTrack},
+		{"key-b", "X-Fast-Track", PriorityHighPrio},
+		{"key-b", "X-High-Priority", PriorityHighPrio},
+		{"key-c", "X-Fast-Track", PriorityLowPrio},
+		{"key-c", "X-High-Priority", PriorityLowPrio},
+		{"key-c", "", PriorityLowPrio},
+	} {
+		rr := submit(tt.apiKey, tt.header)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Equal(t, tt.priority, <-priorities, tt)
+	}
+
+	// Or rejected, without being queued
+	defer func(reject bool) { TenantPriorityCapReject = reject }(TenantPriorityCapReject)
+	TenantPriorityCapReject = true
+	rr := submit("key-b", "X-Fast-Track")
+	require.Equal(t, http.StatusForbidden, rr.Code)
+	require.Equal(t, ErrorKindPriorityNotAllowed, rr.Header().Get("X-Error-Kind"))
+	require.Equal(t, ErrorCodePriorityNotAllowed, decodeErrorResponse(t, rr).Code)
+	rr = submit("key-b", "X-High-Priority")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, PriorityHighPrio, <-priorities)
+	require.Equal(t, 0, len(priorities))
+
+	// Batch submissions reject the payloads individually
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/sims", bytes.NewBufferString(`[{"payload":`+string(reqPayloadBytes)+`,"highPrio":true},{"payload":`+string(reqPayloadBytes)+`}]`))
+	req.Header.Set("X-API-Key", "key-c")
+	webserver.HandleSimsRequest(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var results []SimsResponseEntry
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	require.Equal(t, http.StatusForbidden, results[0].StatusCode)
+	require.Equal(t, ErrorCodePriorityNotAllowed, results[0].Error.Code)
+	require.Equal(t, http.StatusOK, results[1].StatusCode)
+	require.Equal(t, PriorityLowPrio, <-priorities)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// CertLoader holds a TLS certificate loaded from disk, and reloads it when the files change.
+// Use GetCertificate in a tls.Config to always serve the current certificate.
+type CertLoader struct {
+	log      *zap.SugaredLogger
+	certFile string
+	keyFile  string
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	certStat fileStat
+	keyStat  fileStat
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func (s fileStat) equal(other fileStat) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size
+}
+
+func statFile(path string) (fileStat, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// NewCertLoader loads the certificate and key. Fails if they can't be loaded.
+func NewCertLoader(log *zap.SugaredLogger, certFile, keyFile string) (*CertLoader, error) {
+	l := &CertLoader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reads the certificate and key from disk. On error, the previous certificate stays in use.
+func (l *CertLoader) Reload() error {
+	certStat, err := statFile(l.certFile)
+	if err != nil {
+		return errors.Wrap(err, "reading TLS certificate failed")
+	}
+	keyStat, err := statFile(l.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "reading TLS key failed")
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.certStat, l.keyStat = certStat, keyStat
+	if err != nil {
+		return errors.Wrap(err, "loading TLS certificate failed")
+	}
+	l.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the current certificate (for use in tls.Config)
+func (l *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.cert, nil
+}
+
+// GetClientCertificate returns the current certificate (for use as client certificate in tls.Config)
+func (l *CertLoader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return l.GetCertificate(nil)
+}
+
+// filesChanged returns true if the certificate or key file changed since the last (attempted) reload
+func (l *CertLoader) filesChanged() bool {
+	certStat, err1 := statFile(l.certFile)
+	keyStat, err2 := statFile(l.keyFile)
+	if err1 != nil || err2 != nil { // files can be missing temporarily while being replaced
+		return false
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return !certStat.equal(l.certStat) || !keyStat.equal(l.keyStat)
+}
+
+// Watch checks the files for changes every interval and reloads the certificate. Blocks until ctx is done.
+func (l *CertLoader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !l.filesChanged() {
+				continue
+			}
+			if err := l.Reload(); err != nil {
+				l.log.Errorw("TLS certificate reload failed, keeping the previous certificate", "certFile", l.certFile, "error", err)
+			} else {
+				l.log.Infow("TLS certificate reloaded", "certFile", l.certFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSignedCert writes a new self-signed certificate for localhost with the given common name
+func writeSelfSignedCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, // also as client certificate
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.Nil(t, err, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err, err)
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0o600)
+	require.Nil(t, err, err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	require.Nil(t, err, err)
+
+	// ensure the change is detected even on filesystems with coarse timestamps
+	modTime := time.Now().Add(time.Duration(template.SerialNumber.Int64()%1000) * time.Millisecond)
+	require.Nil(t, os.Chtimes(certFile, modTime, modTime))
+	require.Nil(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+// peerCommonName connects to addr and returns the common name of the presented certificate
+func peerCommonName(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec
+	require.Nil(t, err, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertLoader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	_, err := NewCertLoader(testLog, certFile, keyFile)
+	require.NotNil(t, err, err)
+
+	writeSelfSignedCert(t, certFile, keyFile, "cert1")
+	l, err := NewCertLoader(testLog, certFile, keyFile)
+	require.Nil(t, err, err)
+	require.False(t, l.filesChanged())
+
+	cert, err := l.GetCertificate(nil)
+	require.Nil(t, err, err)
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err, err)
+	require.Equal(t, "cert1", x509Cert.Subject.CommonName)
+
+	writeSelfSignedCert(t, certFile, keyFile, "cert2")
+	require.True(t, l.filesChanged())
+	require.Nil(t, l.Reload())
+	cert, err = l.GetCertificate(nil)
+	require.Nil(t, err, err)
+	x509Cert, err = x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err, err)
+	require.Equal(t, "cert2", x509Cert.Subject.CommonName)
+
+	// An invalid certificate keeps the previous one in use
+	require.Nil(t, os.WriteFile(certFile, []byte("invalid"), 0o600))
+	require.NotNil(t, l.Reload())
+	cert2, err := l.GetCertificate(nil)
+	require.Nil(t, err, err)
+	require.Equal(t, cert, cert2)
+}
+
+func TestServerTLS(t *testing.T) {
+	defer func(interval time.Duration) { TLSCertReloadInterval = interval }(TLSCertReloadInterval)
+	TLSCertReloadInterval = 50 * time.Millisecond
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile, "cert1")
+
+	tlsListenAddr := "localhost:9499"
+	s, err := NewServer(ServerOpts{Log: testLog, HTTPAddrPtr: testServerListenAddr, WorkersPerNode: 1, HTTPSAddr: tlsListenAddr, TLSCertFile: certFile, TLSKeyFile: keyFile})
+	require.Nil(t, err, err)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(100 * time.Millisecond) // give Github CI time to start the webserver
+
+	// Both HTTP and HTTPS are served
+	resp, err := http.Get("http://" + testServerListenAddr)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}} //nolint:gosec
+	resp, err = client.Get("https://" + tlsListenAddr)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "cert1", peerCommonName(t, tlsListenAddr))
+
+	// Swap the certificate files, new connections should present the new certificate
+	writeSelfSignedCert(t, certFile, keyFile, "cert2")
+	require.Eventually(t, func() bool {
+		return peerCommonName(t, tlsListenAddr) == "cert2"
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// Reload (i.e. via SIGHUP)
+	writeSelfSignedCert(t, certFile, keyFile, "cert3")
+	require.Nil(t, s.ReloadCertificate())
+	require.Equal(t, "cert3", peerCommonName(t, tlsListenAddr))
+}
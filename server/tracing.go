@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/flashbots/prio-load-balancer/server"
+
+// Span attributes of the simulation traces
+var (
+	AttrRequestID  = attribute.Key("prio.request_id")
+	AttrPriority   = attribute.Key("prio.priority")
+	AttrTenant     = attribute.Key("prio.tenant")
+	AttrTries      = attribute.Key("prio.tries")
+	AttrErrorKind  = attribute.Key("prio.error_kind")
+	AttrNodeURI    = attribute.Key("prio.node_uri")
+	AttrStatusCode = semconv.HTTPStatusCodeKey
+)
+
+// tracer returns the tracer of the global tracer provider, which is a no-op unless tracing was enabled with
+// EnableTracing (or by setting a tracer provider with otel.SetTracerProvider)
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// EnableTracing exports the traces of all simulations with OTLP over HTTP, configured with the standard
+// OTEL_EXPORTER_OTLP_* environment variables (i.e. OTEL_EXPORTER_OTLP_ENDPOINT). The traceparent header of incoming
+// requests is continued, and propagated to the nodes. Call the returned shutdown function to flush the pending spans.
+func EnableTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("prio-load-balancer")))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// startServerSpan starts the span of a sim request, continuing the trace of the traceparent header
+func startServerSpan(req *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return tracer().Start(ctx, "sim request", trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// recordQueueSpan adds the span of the time a request waited in the queue, from the Push until now (the Pop)
+func recordQueueSpan(r *SimRequest) {
+	_, span := tracer().Start(r.Context, "queue", trace.WithTimestamp(r.QueuedAt), trace.WithAttributes(AttrPriority.String(r.Priority())))
+	span.End()
+}
+
+// startProxySpan starts the span of proxying a request to the node. The returned context propagates the trace to the
+// node.
+func startProxySpan(ctx context.Context, nodeURI string, tries int) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "proxy request", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(AttrNodeURI.String(nodeURI), AttrTries.Int(tries)))
+}
+
+// requestSpan is the span of a sim request, with the error and error kind of its response (see endSpan)
+type requestSpan struct {
+	trace.Span
+	err       error
+	errorKind string
+}
+
+// endSpan sets the status code and error (with its kind, see errorKind) of the response, and ends the span. Responses
+// with a status code of 500 or above are errors too.
+func endSpan(span trace.Span, statusCode int, err error, errorKind string) {
+	if statusCode != 0 {
+		span.SetAttributes(AttrStatusCode.Int(statusCode))
+	}
+	if errorKind != "" {
+		span.SetAttributes(AttrErrorKind.String(errorKind))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	span.End()
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// enableTestTracing records the spans with an in-memory exporter, until the end of the test
+func enableTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevTracerProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTracerProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return exporter
+}
+
+// spansByName returns the recorded spans with name, in the order they ended
+func spansByName(exporter *tracetest.InMemoryExporter, name string) []tracetest.SpanStub {
+	spans := []tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// spanAttributes returns the attributes of the span as a map
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range span.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestTracingDisabled(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	traceparentC := make(chan string, 1)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		traceparentC <- req.Header.Get("traceparent")
+		w.Write([]byte(`{"result":"ok"}`)) //nolint:errcheck
+	}
+
+	// Without a tracer provider, no trace is propagated to the node
+	req := newSimTestRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	req.Header.Set("traceparent", testTraceparent)
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Empty(t, <-traceparentC)
+}
+
+func TestTracing(t *testing.T) {
+	exporter := enableTestTracing(t)
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	traceparentC := make(chan string, 1)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		traceparentC <- req.Header.Get("traceparent")
+		w.Write([]byte(`{"result":"ok"}`)) //nolint:errcheck
+	}
+
+	req := newSimTestRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	req.Header.Set("traceparent", testTraceparent)
+	req.Header.Set("X-High-Priority", "true")
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// The server span continues the incoming trace
+	serverSpans := spansByName(exporter, "sim request")
+	require.Equal(t, 1, len(serverSpans))
+	serverSpan := serverSpans[0]
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", serverSpan.SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", serverSpan.Parent.SpanID().String())
+	require.Equal(t, trace.SpanKindServer, serverSpan.SpanKind)
+	attrs := spanAttributes(serverSpan)
+	require.Equal(t, "test-req", attrs[AttrRequestID].AsString())
+	require.Equal(t, PriorityHighPrio, attrs[AttrPriority].AsString())
+	require.Equal(t, int64(1), attrs[AttrTries].AsInt64())
+	require.Equal(t, int64(http.StatusOK), attrs[AttrStatusCode].AsInt64())
+	require.Equal(t, codes.Unset, serverSpan.Status.Code)
+
+	// The queue and proxy spans are children of the server span
+	queueSpans := spansByName(exporter, "queue")
+	require.Equal(t, 1, len(queueSpans))
+	require.Equal(t, serverSpan.SpanContext.SpanID(), queueSpans[0].Parent.SpanID())
+	require.Equal(t, PriorityHighPrio, spanAttributes(queueSpans[0])[AttrPriority].AsString())
+	require.False(t, queueSpans[0].EndTime.Before(queueSpans[0].StartTime))
+
+	proxySpans := spansByName(exporter, "proxy request")
+	require.Equal(t, 1, len(proxySpans))
+	proxySpan := proxySpans[0]
+	require.Equal(t, serverSpan.SpanContext.SpanID(), proxySpan.Parent.SpanID())
+	require.Equal(t, trace.SpanKindClient, proxySpan.SpanKind)
+	attrs = spanAttributes(proxySpan)
+	require.Equal(t, webserver.nodePool.NodeUris()[0], attrs[AttrNodeURI].AsString())
+	require.Equal(t, int64(1), attrs[AttrTries].AsInt64())
+	require.Equal(t, int64(http.StatusOK), attrs[AttrStatusCode].AsInt64())
+	require.False(t, proxySpan.StartTime.Before(queueSpans[0].EndTime))
+
+	// The trace is propagated to the node, with the proxy span as parent
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+proxySpan.SpanContext.SpanID().String()+"-01", <-traceparentC)
+}
+
+func TestTracingNodeError(t *testing.T) {
+	exporter := enableTestTracing(t)
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "error", http.StatusServiceUnavailable)
+	}
+
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, newSimTestRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	// A new trace without traceparent, with a queue and proxy span for every try
+	serverSpans := spansByName(exporter, "sim request")
+	require.Equal(t, 1, len(serverSpans))
+	serverSpan := serverSpans[0]
+	require.False(t, serverSpan.Parent.IsValid())
+	require.Equal(t, codes.Error, serverSpan.Status.Code)
+	attrs := spanAttributes(serverSpan)
+	require.Equal(t, ErrorKindNodeError, attrs[AttrErrorKind].AsString())
+	require.Equal(t, int64(RequestMaxTries), attrs[AttrTries].AsInt64())
+	require.Equal(t, int64(http.StatusServiceUnavailable), attrs[AttrStatusCode].AsInt64())
+
+	require.Equal(t, RequestMaxTries, len(spansByName(exporter, "queue")))
+	proxySpans := spansByName(exporter, "proxy request")
+	require.Equal(t, RequestMaxTries, len(proxySpans))
+	for i, span := range proxySpans {
+		require.Equal(t, serverSpan.SpanContext.SpanID(), span.Parent.SpanID())
+		require.Equal(t, codes.Error, span.Status.Code)
+		attrs := spanAttributes(span)
+		require.Equal(t, int64(i+1), attrs[AttrTries].AsInt64())
+		require.Equal(t, ErrorKindNodeError, attrs[AttrErrorKind].AsString())
+		require.Equal(t, int64(http.StatusServiceUnavailable), attrs[AttrStatusCode].AsInt64())
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// NodeTransport sends the payloads to a node. It's selected by the scheme of the node URI: HTTP posts by default,
+// WebSocket connections for ws:// and wss://, and gRPC calls for grpc://.
+type NodeTransport interface {
+	// Proxy sends the JSON payload to the node within the timeout, and returns its response with the (HTTP) status
+	// code. Errors are proxy errors, which the workers retry on other nodes.
+	Proxy(ctx context.Context, payload Payload, timeout time.Duration) (resp []byte, statusCode int, err error)
+}
+
+// newNodeTransport returns the transport of the node URI, HTTP requests are sent with client
+func newNodeTransport(log *zap.SugaredLogger, pURL *url.URL, uri string, client *http.Client, passthrough bool) (NodeTransport, error) {
+	switch pURL.Scheme {
+	case "ws", "wss":
+		var tlsConfig *tls.Config
+		if transport, ok := client.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone() // i.e. for attestation
+		}
+		log.Infow("Using WebSocket connections", "uri", uri)
+		return newWSTransport(log, pURL, tlsConfig), nil
+	case "grpc":
+		log.Infow("Using gRPC calls", "uri", uri)
+		return newGRPCTransport(pURL)
+	}
+	return &httpTransport{uri: uri, client: client, passthrough: passthrough, gzipMinBytes: nodeGzipMinBytesArg(log, pURL, uri)}, nil
+}
+
+// httpTransport posts the payloads to the node URI
+type httpTransport struct {
+	uri          string
+	client       *http.Client
+	passthrough  bool // preserve the content type of requests and responses, without JSON assumptions
+	gzipMinBytes int  // payloads at least this large are sent gzip compressed (0 disables it)
+}
+
+func (t *httpTransport) Proxy(ctx context.Context, payload Payload, timeout time.Duration) (resp []byte, statusCode int, err error) {
+	resp, _, statusCode, err = t.proxy(ctx, payload, "application/json", nil, timeout)
+	return resp, statusCode, err
+}
+
+// proxy sends the payload with the given content type (omitted if empty) to the node, and returns the response with
+// its content type. JSON responses are only requested from nodes which are not in passthrough mode. Payloads are
+// posted to the node URI, unless the method, path, query and headers of a reverse proxy request are given as target.
+func (t *httpTransport) proxy(ctx context.Context, payload Payload, contentType string, target *HTTPRequest, timeout time.Duration) (resp []byte, respContentType string, statusCode int, err error) {
+	body, resp, respContentType, statusCode, err := t.proxyStream(ctx, payload, contentType, target, timeout)
+	if err != nil {
+		return resp, respContentType, statusCode, err
+	}
+
+	defer body.Close()
+	resp, err = readResponseBody(body)
+	if errors.Is(err, ErrResponseTooLarge) {
+		return nil, respContentType, http.StatusBadGateway, err
+	} else if err != nil {
+		return nil, respContentType, statusCode, errors.Wrap(err, "decoding proxying response failed")
+	}
+	return resp, respContentType, statusCode, nil
+}
+
+// readResponseBody reads a node response of at most NodeResponseMaxBytes (0: any size), and returns
+// ErrResponseTooLarge for larger ones
+func readResponseBody(body io.Reader) ([]byte, error) {
+	maxBytes := int64(NodeResponseMaxBytes)
+	if maxBytes <= 0 {
+		return io.ReadAll(body)
+	}
+	resp, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	return resp, checkResponseSize(resp)
+}
+
+// checkResponseSize returns ErrResponseTooLarge if the node response is larger than NodeResponseMaxBytes (0: any
+// size), for the transports which receive the responses as a whole (WebSocket messages and gRPC calls)
+func checkResponseSize(resp []byte) error {
+	if maxBytes := NodeResponseMaxBytes; maxBytes > 0 && len(resp) > maxBytes {
+		return fmt.Errorf("%w (more than %d bytes)", ErrResponseTooLarge, maxBytes)
+	}
+	return nil
+}
+
+// proxyStream sends the payload like proxy, but returns the body of a successful response unread. It must be closed,
+// the timeout applies until then. Error responses are read, and returned as resp.
+func (t *httpTransport) proxyStream(ctx context.Context, payload Payload, contentType string, target *HTTPRequest, timeout time.Duration) (body io.ReadCloser, resp []byte, respContentType string, statusCode int, err error) {
+	ctxx, cancel := context.WithTimeout(ctx, timeout)
+	defer func() {
+		if body == nil {
+			cancel()
+		}
+	}()
+
+	method, uri := "POST", t.uri
+	if target != nil {
+		method = target.Method
+		if uri, err = reverseProxyURL(t.uri, target); err != nil {
+			return nil, resp, respContentType, statusCode, errors.Wrap(err, "creating proxy request failed")
+		}
+	}
+
+	// Spooled payloads are streamed from their file, the transport sets the Content-Length header (or chunked
+	// transfer encoding for payloads of unknown length). Payloads from gzipMinBytes are compressed (of the
+	// compressed length).
+	compress := t.gzipMinBytes > 0 && payload.Len() >= int64(t.gzipMinBytes) && (target == nil || target.Header.Get("Content-Encoding") == "")
+	reqBody, contentLength, err := requestBody(payload)
+	if err == nil && compress {
+		reqBody.Close()
+		reqBody, contentLength, err = gzipRequestBody(payload)
+	}
+	if err != nil {
+		return nil, resp, respContentType, statusCode, errors.Wrap(err, "opening payload failed")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctxx, method, uri, reqBody)
+	if err != nil {
+		reqBody.Close()
+		return nil, resp, respContentType, statusCode, errors.Wrap(err, "creating proxy request failed")
+	}
+
+	httpReq.ContentLength = contentLength
+	if target != nil {
+		for header, values := range target.Header {
+			httpReq.Header[header] = append([]string{}, values...)
+		}
+	} else if !t.passthrough {
+		httpReq.Header.Set("Accept", "application/json")
+	}
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if compress {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	httpReq.Header.Set("Accept-Encoding", "gzip") // decompressed by decodeResponseBody
+
+	for name, values := range nodeHeadersFromContext(ctx) { // after the headers of the target, i.e. for authentication
+		httpReq.Header[name] = append([]string{}, values...)
+	}
+	if reqID := RequestIDFromContext(ctx); reqID != "" {
+		httpReq.Header.Set("X-Request-ID", reqID)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(httpReq.Header)) // traceparent, if tracing is enabled
+
+	httpResp, err := t.client.Do(httpReq)
+	if err != nil && ctxx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, resp, respContentType, statusCode, errors.Wrapf(err, "proxying request failed (timeout %s)", timeout)
+	} else if err != nil {
+		return nil, resp, respContentType, statusCode, errors.Wrap(err, "proxying request failed")
+	}
+
+	statusCode = httpResp.StatusCode
+	respContentType = httpResp.Header.Get("Content-Type")
+	respBody, err := decodeResponseBody(httpResp)
+	if err != nil {
+		return nil, resp, respContentType, statusCode, errors.Wrap(err, "decoding proxying response failed")
+	}
+
+	if statusCode >= 400 {
+		defer respBody.Close()
+		httpRespBody, err := readResponseBody(respBody)
+		if errors.Is(err, ErrResponseTooLarge) {
+			return nil, resp, respContentType, http.StatusBadGateway, err
+		} else if err != nil {
+			return nil, resp, respContentType, statusCode, errors.Wrap(err, "decoding proxying response failed")
+		}
+		return nil, httpRespBody, respContentType, statusCode, fmt.Errorf("error in response - statusCode: %d / %s", statusCode, httpRespBody)
+	}
+
+	return &cancelOnClose{ReadCloser: respBody, cancel: cancel}, nil, respContentType, statusCode, nil
+}
+
+// cancelOnClose cancels the context of a response when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
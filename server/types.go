@@ -2,24 +2,74 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"time"
+
+	"go.uber.org/atomic"
 )
 
+// cancelledCounters count the work skipped for requests whose context is done (the client closed the connection, or
+// its deadline passed), see /stats/queue
+var cancelledCounters struct {
+	skipped          atomic.Int64 // discarded by the main loop or a node worker without proxying
+	droppedResponses atomic.Int64 // responses which were not sent, because the request was cancelled
+}
+
 type SimRequest struct {
 	// can be none of, or one of high-prio / fast-track
 	ID          string
 	IsHighPrio  bool
 	IsFastTrack bool
+	// (optional) level of a high-prio request which is neither fast-track nor low-prio, of the X-Priority header (see
+	// PrioQueue.SetPriorityLevels). 0 and 1 are the high-prio level.
+	PriorityLevel int
+	Tenant        string // only used with multi-tenancy (TenantQueue)
+	ClientID      string // for the per-client usage stats
+	Reservation   string // (optional) the client ID of the fast-track reservation presented with the request
+
+	Payload     Payload
+	ContentType string       // Content-Type of the client request, forwarded to nodes in passthrough mode
+	SizeClass   string       // size class of the payload (small, medium or large), set at ingest
+	HTTP        *HTTPRequest // (only reverse proxy requests) the method, path, query and headers for the node
+	ResponseC   chan SimResponse
+	Cancelled   bool
+	CreatedAt   time.Time
+	QueuedAt    time.Time // set on every Push, for the queue wait time
+	Tries       int
+	Context     context.Context
+
+	Timeout      time.Duration // (optional) instead of the RequestTimeout of the priority, i.e. of the X-Request-Deadline-Ms header
+	ProxyTimeout time.Duration // (optional) instead of the ProxyRequestTimeout of the priority, i.e. of the X-Proxy-Timeout-Ms header
+
+	Attempts []NodeAttempt // the failed tries, the nodes pass on the retries (see RETRY_ROUTING)
+
+	Stream bool // (optional) a successful response of an HTTP node may be streamed, see SimResponse.Body
 
-	Payload   []byte
-	ResponseC chan SimResponse
-	Cancelled bool
-	CreatedAt time.Time
-	Tries     int
-	Context   context.Context
+	numPassed      int  // how often a smaller request was popped before it since the last Push (SmallestFirstOrder)
+	numRetryPasses int  // how often the retry was passed on by nodes which failed it already
+	reservedSlot   bool // queued in a slot of its fast-track reservation
+
+	payloadHash string          // (only with coalescing) set on the first Push
+	coalesced   *coalescedGroup // (only with coalescing) the group it leads, or waits in
+
+	queueState atomic.Int32 // whether the current try was taken by a node worker or expired in the queue, see take
 }
 
+// States of a try of a SimRequest
+const (
+	requestQueued    int32 = iota // waiting for a node worker
+	requestTaken                  // taken by a node worker, which sends the response
+	requestExpired                // answered with the request timeout while queued
+	requestWithdrawn              // cancelled by the client while queued (DELETE /sim/{id}), see withdraw
+)
+
 func NewSimRequest(ctx context.Context, id string, payload []byte, isHighPrio, IsFastTrack bool) *SimRequest {
+	return NewSimRequestWithPayload(ctx, id, BytesPayload(payload), isHighPrio, IsFastTrack)
+}
+
+// NewSimRequestWithPayload creates a SimRequest from an in-memory or file-backed payload
+func NewSimRequestWithPayload(ctx context.Context, id string, payload Payload, isHighPrio, IsFastTrack bool) *SimRequest {
 	return &SimRequest{
 		ID:          id,
 		Payload:     payload,
@@ -31,8 +81,130 @@ func NewSimRequest(ctx context.Context, id string, payload []byte, isHighPrio, I
 	}
 }
 
-// SendResponse sends the response to ResponseC. If noone is listening on the channel, it is dropped.
+// Priority classes of requests
+const (
+	PriorityFastTrack = "fast-track"
+	PriorityHighPrio  = "high-prio"
+	PriorityLowPrio   = "low-prio"
+)
+
+// Priority returns the priority class of the request
+func (r *SimRequest) Priority() string {
+	return priorityClass(r.IsHighPrio, r.IsFastTrack)
+}
+
+func priorityClass(isHighPrio, isFastTrack bool) string {
+	if isFastTrack {
+		return PriorityFastTrack
+	} else if isHighPrio {
+		return PriorityHighPrio
+	}
+	return PriorityLowPrio
+}
+
+// IsCancelled returns whether the request was cancelled: its context (derived from the client request) is done,
+// Cancelled was set, or it was withdrawn
+func (r *SimRequest) IsCancelled() bool {
+	return r.Cancelled || r.queueState.Load() == requestWithdrawn || (r.Context != nil && r.Context.Err() != nil)
+}
+
+// timeoutOfPriority returns the timeout of the priority, or defaultTimeout if it's not set
+func timeoutOfPriority(priority string, fastTrack, highPrio, lowPrio, defaultTimeout time.Duration) time.Duration {
+	timeout := lowPrio
+	switch priority {
+	case PriorityFastTrack:
+		timeout = fastTrack
+	case PriorityHighPrio:
+		timeout = highPrio
+	}
+	if timeout <= 0 {
+		return defaultTimeout
+	}
+	return timeout
+}
+
+// RequestTimeout returns the time between creation and receive in a node worker: Timeout if set, otherwise the
+// default of its priority
+func (r *SimRequest) RequestTimeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return timeoutOfPriority(r.Priority(), RequestTimeoutFastTrack, RequestTimeoutHighPrio, RequestTimeoutLowPrio, RequestTimeout)
+}
+
+// ProxyRequestTimeout returns the timeout of the proxy requests to the nodes: ProxyTimeout if set, otherwise the
+// default of its priority
+func (r *SimRequest) ProxyRequestTimeout() time.Duration {
+	if r.ProxyTimeout > 0 {
+		return r.ProxyTimeout
+	}
+	return timeoutOfPriority(r.Priority(), ProxyRequestTimeoutFastTrack, ProxyRequestTimeoutHighPrio, ProxyRequestTimeoutLowPrio, ProxyRequestTimeout)
+}
+
+// maxProxyRequestTimeout is the longest proxy timeout of all priorities and of the requests (see ProxyRequestTimeoutMax),
+// the timeout of the HTTP clients of the nodes
+func maxProxyRequestTimeout() time.Duration {
+	timeout := ProxyRequestTimeout
+	for _, t := range []time.Duration{ProxyRequestTimeoutFastTrack, ProxyRequestTimeoutHighPrio, ProxyRequestTimeoutLowPrio, ProxyRequestTimeoutMax} {
+		if t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// Deadline returns the time until which the request must be taken by a node worker: RequestTimeout after its
+// creation, or the deadline of its context if that is earlier
+func (r *SimRequest) Deadline() time.Time {
+	deadline := r.CreatedAt.Add(r.RequestTimeout())
+	if r.Context != nil {
+		if ctxDeadline, ok := r.Context.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+	}
+	return deadline
+}
+
+// timeoutError returns ErrRequestTimeout with the timeout which was hit
+func (r *SimRequest) timeoutError() error {
+	timeout := r.RequestTimeout()
+	if r.Deadline().Before(r.CreatedAt.Add(timeout)) {
+		return fmt.Errorf("%w (deadline of the client request)", ErrRequestTimeout)
+	} else if r.Timeout > 0 {
+		return fmt.Errorf("%w (request deadline %s)", ErrRequestTimeout, timeout)
+	}
+	return fmt.Errorf("%w (%s timeout %s)", ErrRequestTimeout, r.Priority(), timeout)
+}
+
+// take marks the current try as taken by a node worker. Returns false if it expired in the queue already.
+func (r *SimRequest) take() bool {
+	return r.queueState.CompareAndSwap(requestQueued, requestTaken) || r.queueState.Load() == requestTaken
+}
+
+// expire marks the current try as expired in the queue. Returns false if it was taken by a node worker already.
+func (r *SimRequest) expire() bool {
+	return r.queueState.CompareAndSwap(requestQueued, requestExpired) || r.queueState.Load() == requestExpired
+}
+
+// requeue resets the state for the next try
+func (r *SimRequest) requeue() {
+	r.queueState.Store(requestQueued)
+}
+
+// skip counts a cancelled request which is discarded without proxying. Its coalesced requests are queued again.
+func (r *SimRequest) skip() {
+	cancelledCounters.skipped.Inc()
+	r.releaseWaiters(nil)
+}
+
+// SendResponse sends the response to ResponseC. If noone is listening on the channel, it is dropped. The response to
+// a cancelled request is not sent, only counted. The coalesced requests get it as well (see PrioQueue.SetCoalescing).
 func (r *SimRequest) SendResponse(resp SimResponse) (wasSent bool) {
+	r.releaseWaiters(&resp)
+	if r.IsCancelled() {
+		cancelledCounters.droppedResponses.Inc()
+		return false
+	}
 	select {
 	case r.ResponseC <- resp:
 		return true
@@ -44,9 +216,15 @@ func (r *SimRequest) SendResponse(resp SimResponse) (wasSent bool) {
 type SimResponse struct {
 	StatusCode  int
 	Payload     []byte
+	ContentType string // Content-Type of the node response (only set in passthrough mode)
 	Error       error
 	ShouldRetry bool // When response has an error, whether it should be retried
 	NodeURI     string
 	SimDuration time.Duration
 	SimAt       time.Time // time when proxying started
+	Fault       string    // the injected fault (see /admin/faults), empty for real responses
+
+	// (only streamed responses, see SimRequest.Stream) the unread body of the node response instead of Payload, with
+	// its StatusCode. The receiver must close it, the node worker waits for it.
+	Body io.ReadCloser
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// utilizationWindow is the window of the busy fraction of the workers of a node
+const utilizationWindow = 60 * time.Second
+
+// workerUtilization accumulates the busy time of the proxy workers of a node (from receiving a request until its
+// response is sent), in one-second buckets over the last utilizationWindow. The idle time is the rest.
+type workerUtilization struct {
+	lock      sync.Mutex
+	startedAt time.Time           // when the workers were first started
+	busySince map[int32]time.Time // requests in progress, by worker id
+	buckets   [60]time.Duration   // busy time per second, indexed by unix second modulo 60
+	bucketSec [60]int64           // the unix second of each bucket
+	totalBusy time.Duration       // of the completed requests, since the start
+}
+
+// start records that the workers were started, if they weren't before
+func (u *workerUtilization) start(now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.startedAt.IsZero() {
+		u.startedAt = now
+	}
+}
+
+// busy records that a worker received a request
+func (u *workerUtilization) busy(workerID int32, now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.busySince == nil {
+		u.busySince = make(map[int32]time.Time)
+	}
+	u.busySince[workerID] = now
+}
+
+// idle records that a worker is done with its request, and adds the busy time to the buckets
+func (u *workerUtilization) idle(workerID int32, now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	since, found := u.busySince[workerID]
+	if !found {
+		return
+	}
+	delete(u.busySince, workerID)
+	u.totalBusy += now.Sub(since)
+
+	// Only the part within the window is relevant for the buckets
+	if windowStart := now.Add(-utilizationWindow); since.Before(windowStart) {
+		since = windowStart
+	}
+	for sec := since.Unix(); sec <= now.Unix(); sec++ {
+		from, to := time.Unix(sec, 0), time.Unix(sec+1, 0)
+		if from.Before(since) {
+			from = since
+		}
+		if to.After(now) {
+			to = now
+		}
+		if !to.After(from) {
+			continue
+		}
+		i := sec % int64(len(u.buckets))
+		if u.bucketSec[i] != sec {
+			u.bucketSec[i], u.buckets[i] = sec, 0
+		}
+		u.buckets[i] += to.Sub(from)
+	}
+}
+
+// stats returns the busy fraction of numWorkers workers over the last utilizationWindow (or since the start, if that
+// is shorter), and the total busy and idle time of all workers since the start. Requests in progress count as busy.
+func (u *workerUtilization) stats(now time.Time, numWorkers int32) (utilization float64, busy, idle time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.startedAt.IsZero() || numWorkers <= 0 {
+		return 0, 0, 0
+	}
+
+	window := now.Sub(u.startedAt)
+	if window > utilizationWindow {
+		window = utilizationWindow
+	}
+	windowStart := now.Add(-window)
+
+	var busyInWindow time.Duration
+	for i, sec := range u.bucketSec {
+		if sec >= windowStart.Unix() && sec <= now.Unix() {
+			busyInWindow += u.buckets[i]
+		}
+	}
+	busy = u.totalBusy
+	for _, since := range u.busySince {
+		busy += now.Sub(since)
+		if since.Before(windowStart) {
+			since = windowStart
+		}
+		busyInWindow += now.Sub(since)
+	}
+
+	if total := time.Duration(numWorkers) * now.Sub(u.startedAt); total > busy {
+		idle = total - busy
+	}
+	if window > 0 {
+		utilization = float64(busyInWindow) / float64(time.Duration(numWorkers)*window)
+	}
+	if utilization > 1 {
+		utilization = 1
+	}
+	return utilization, busy, idle
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerUtilization(t *testing.T) {
+	u := workerUtilization{}
+	start := time.Unix(1_000_000, 0)
+	utilization, busy, idle := u.stats(start, 2)
+	require.Equal(t, 0.0, utilization) // not started
+	require.Equal(t, time.Duration(0), busy)
+	require.Equal(t, time.Duration(0), idle)
+
+	// Worker 1 busy for the first 30s, worker 2 from 10s to 20s
+	u.start(start)
+	u.busy(1, start)
+	u.busy(2, start.Add(10*time.Second))
+	u.idle(2, start.Add(20*time.Second))
+	u.idle(1, start.Add(30*time.Second))
+	u.idle(3, start.Add(30*time.Second)) // not busy
+
+	// Shorter window than a minute since the start
+	utilization, busy, idle = u.stats(start.Add(40*time.Second), 2)
+	require.InDelta(t, 40.0/80, utilization, 0.001)
+	require.Equal(t, 40*time.Second, busy)
+	require.Equal(t, 40*time.Second, idle)
+
+	utilization, _, _ = u.stats(start.Add(60*time.Second), 2)
+	require.InDelta(t, 40.0/120, utilization, 0.001)
+
+	// Worker 2 busy since 70s, still in progress
+	u.busy(2, start.Add(70*time.Second))
+	utilization, busy, idle = u.stats(start.Add(90*time.Second), 2)
+	require.InDelta(t, 20.0/120, utilization, 0.001) // worker 1 went idle at the start of the window
+	require.Equal(t, 60*time.Second, busy)
+	require.Equal(t, 120*time.Second, idle)
+
+	// Only the last minute of a long request was within the window
+	u.idle(2, start.Add(200*time.Second))
+	utilization, _, _ = u.stats(start.Add(200*time.Second), 2)
+	require.InDelta(t, 0.5, utilization, 0.02)
+}
+
+func TestNodeWorkerUtilization(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	const interval = 40 * time.Millisecond
+	nodeServer := testutils.NewFakeNode(testutils.FakeNodeOpts{Latency: latency})
+	defer nodeServer.Close()
+
+	// 2 workers, with one request every 40ms which takes 20ms: each of the workers is busy a quarter of the time
+	node, err := NewNode(testLog, nodeServer.URL, make(chan *SimRequest), 2)
+	require.Nil(t, err, err)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+	for i := 0; i < 15; i++ {
+		<-ticker.C
+		request := NewSimRequest(context.Background(), "1", []byte(`{"id":1}`), false, false)
+		node.jobC <- request
+		res := <-request.ResponseC
+		require.Nil(t, res.Error, res.Error)
+	}
+	<-ticker.C
+
+	stats := node.Stats()
+	require.InDelta(t, 0.25, stats.WorkerUtilization, 0.1)
+	require.InDelta(t, 15*latency.Seconds(), stats.WorkerBusySec, 0.15)
+	require.InDelta(t, 2*16*interval.Seconds()-stats.WorkerBusySec, stats.WorkerIdleSec, 0.15)
+}
@@ -1,12 +1,11 @@
 package server
 
 import (
-	"os"
 	"strconv"
 )
 
 func GetEnvInt(key string, defaultValue int) int {
-	if value, ok := os.LookupEnv(key); ok {
+	if value, ok := LookupConfig(key); ok {
 		val, err := strconv.Atoi(value)
 		if err == nil {
 			return val
@@ -16,8 +15,18 @@ func GetEnvInt(key string, defaultValue int) int {
 }
 
 func GetEnv(key, defaultValue string) string {
-	if value, ok := os.LookupEnv(key); ok {
+	if value, ok := LookupConfig(key); ok {
 		return value
 	}
 	return defaultValue
 }
+
+func GetEnvFloat(key string, defaultValue float64) float64 {
+	if value, ok := LookupConfig(key); ok {
+		val, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return val
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ResponseValidator checks a successful node response before it's returned to the client, i.e. to catch a 200 with an
+// empty result of a broken node. A returned error (or a panic) rejects the response: it's counted as validation_failed
+// error of the node and the request is retried, after the last try the invalid response is returned with the error
+// kind validation_failed.
+type ResponseValidator func(r *SimRequest, payload []byte) error
+
+// ResponseRules are the built-in response checks, set with RESPONSE_VALIDATION
+type ResponseRules struct {
+	ValidJSON      bool // the payload is valid JSON
+	NonEmptyResult bool // the JSON-RPC responses (also of batches) have a result which is not null, "", "0x", [] or {}, or an error
+	MinBytes       int  // 0 means no limit
+	MaxBytes       int  // 0 means no limit
+}
+
+// ParseResponseRules parses a comma separated list of "json", "result", "min=<bytes>" and "max=<bytes>", i.e.
+// "result,min=16"
+func ParseResponseRules(s string) (rules ResponseRules, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		key, value, hasValue := strings.Cut(entry, "=")
+		switch {
+		case entry == "":
+		case entry == "json":
+			rules.ValidJSON = true
+		case entry == "result":
+			rules.NonEmptyResult = true
+		case hasValue && (key == "min" || key == "max"):
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return rules, fmt.Errorf("invalid %s size: %s", key, value)
+			}
+			if key == "min" {
+				rules.MinBytes = n
+			} else {
+				rules.MaxBytes = n
+			}
+		default:
+			return rules, fmt.Errorf("unknown rule: %s", entry)
+		}
+	}
+	return rules, nil
+}
+
+// Enabled returns whether any response is checked
+func (rules ResponseRules) Enabled() bool {
+	return rules.ValidJSON || rules.NonEmptyResult || rules.MinBytes > 0 || rules.MaxBytes > 0
+}
+
+// Validator returns the validator which checks the rules
+func (rules ResponseRules) Validator() ResponseValidator {
+	return func(r *SimRequest, payload []byte) error {
+		if rules.MinBytes > 0 && len(payload) < rules.MinBytes {
+			return fmt.Errorf("response too small: %d bytes", len(payload))
+		} else if rules.MaxBytes > 0 && len(payload) > rules.MaxBytes {
+			return fmt.Errorf("response too large: %d bytes", len(payload))
+		}
+		if rules.NonEmptyResult {
+			return checkNonEmptyResult(payload)
+		} else if rules.ValidJSON && !json.Valid(payload) {
+			return fmt.Errorf("invalid JSON")
+		}
+		return nil
+	}
+}
+
+// checkNonEmptyResult returns an error if a JSON-RPC response (or a batch element) has neither error nor a non-empty
+// result
+func checkNonEmptyResult(payload []byte) error {
+	type jsonrpcResponse struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	var batch []jsonrpcResponse
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return fmt.Errorf("invalid JSON: %w", err)
+		}
+	} else {
+		var single jsonrpcResponse
+		if err := json.Unmarshal(trimmed, &single); err != nil {
+			return fmt.Errorf("invalid JSON: %w", err)
+		}
+		batch = append(batch, single)
+	}
+
+	for i, resp := range batch {
+		if len(resp.Error) > 0 && string(resp.Error) != "null" {
+			continue
+		}
+		switch string(bytes.TrimSpace(resp.Result)) {
+		case "", "null", `""`, `"0x"`, "[]", "{}":
+			return fmt.Errorf("empty result (response %d)", i)
+		}
+	}
+	return nil
+}
+
+// responseValidation holds the response validator of a pool, shared by all its nodes
+type responseValidation struct {
+	validator atomic.Pointer[ResponseValidator]
+}
+
+func (v *responseValidation) set(validator ResponseValidator) {
+	if validator == nil {
+		v.validator.Store(nil)
+		return
+	}
+	v.validator.Store(&validator)
+}
+
+// enabled returns whether a validator is set
+func (v *responseValidation) enabled() bool {
+	return v != nil && v.validator.Load() != nil
+}
+
+// validate runs the validator (if any), and wraps a failure with ErrValidationFailed
+func (v *responseValidation) validate(r *SimRequest, payload []byte) error {
+	if v == nil {
+		return nil
+	}
+	validator := v.validator.Load()
+	if validator == nil {
+		return nil
+	}
+	if err := runMiddleware(func() error { return (*validator)(r, payload) }); err != nil {
+		return fmt.Errorf("%w: %w", ErrValidationFailed, err)
+	}
+	return nil
+}
+
+// SetResponseValidator sets the validator of the successful node responses, replacing the previous one (nil
+// disables the validation)
+func (gp *NodePool) SetResponseValidator(validator ResponseValidator) {
+	gp.validation.set(validator)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseResponseRules(t *testing.T) {
+	rules, err := ParseResponseRules("")
+	require.Nil(t, err)
+	require.False(t, rules.Enabled())
+
+	rules, err = ParseResponseRules("json, result,min=16,max=1024")
+	require.Nil(t, err)
+	require.Equal(t, ResponseRules{ValidJSON: true, NonEmptyResult: true, MinBytes: 16, MaxBytes: 1024}, rules)
+	require.True(t, rules.Enabled())
+
+	_, err = ParseResponseRules("min=-1")
+	require.NotNil(t, err)
+	_, err = ParseResponseRules("nonempty")
+	require.NotNil(t, err)
+}
+
+func TestResponseRulesValidator(t *testing.T) {
+	r := NewSimRequest(context.Background(), "1", nil, false, false)
+	validate := func(rules ResponseRules, payload string) error {
+		return rules.Validator()(r, []byte(payload))
+	}
+
+	require.Nil(t, validate(ResponseRules{ValidJSON: true}, `{"result":null}`))
+	require.NotNil(t, validate(ResponseRules{ValidJSON: true}, `{"result":"0x`))
+	require.NotNil(t, validate(ResponseRules{MinBytes: 10}, `{}`))
+	require.NotNil(t, validate(ResponseRules{MaxBytes: 10}, `{"result":"0x1234"}`))
+
+	nonEmpty := ResponseRules{NonEmptyResult: true}
+	require.Nil(t, validate(nonEmpty, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	require.Nil(t, validate(nonEmpty, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"reverted"}}`))
+	require.Nil(t, validate(nonEmpty, `[{"result":{"a":1}},{"result":[1]}]`))
+	for _, payload := range []string{`{"result":null}`, `{"result":""}`, `{"result":"0x"}`, `{"result":[]}`, `{"result":{}}`, `{"id":1}`, `[{"result":"0x1"},{"result":null}]`, `{"result":"0x1`, ``} {
+		require.NotNil(t, validate(nonEmpty, payload), payload)
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	webserver.nodePool.SetResponseValidator(ResponseRules{NonEmptyResult: true}.Validator())
+	handler := webserver.Handler()
+
+	// An empty result once, then a good one
+	var numEmpty atomic.Int32
+	numEmpty.Store(1)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		if numEmpty.Add(-1) >= 0 {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`)) //nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)) //nolint:errcheck
+	}
+	send := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`))
+		return rr
+	}
+
+	rr := send()
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "2", rr.Header().Get("X-Tries"))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, rr.Body.String())
+	stats := webserver.nodePool.NodeStats()[0]
+	require.Equal(t, map[string]int64{ErrorKindValidationFailed: 1}, stats.Errors)
+	require.Empty(t, stats.ErrorStatusCodes)
+
+	// After the last try, the invalid response is returned
+	numEmpty.Store(int32(RequestMaxTries))
+	rr = send()
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	require.Equal(t, ErrorKindValidationFailed, rr.Header().Get("X-Error-Kind"))
+	require.Equal(t, "3", rr.Header().Get("X-Tries"))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":null}`, rr.Body.String())
+	require.Equal(t, int64(4), webserver.nodePool.NodeStats()[0].Errors[ErrorKindValidationFailed])
+
+	// A panicking validator rejects the response, nil disables the validation
+	webserver.nodePool.SetResponseValidator(func(r *SimRequest, payload []byte) error { panic("boom") })
+	require.Equal(t, ErrorKindValidationFailed, send().Header().Get("X-Error-Kind"))
+	webserver.nodePool.SetResponseValidator(nil)
+	numEmpty.Store(1)
+	require.Equal(t, http.StatusOK, send().Code)
+}
+
+func TestErrorKindValidationFailed(t *testing.T) {
+	err := (&responseValidation{}).validate(nil, nil)
+	require.Nil(t, err)
+	validation := &responseValidation{}
+	validation.set(func(r *SimRequest, payload []byte) error { return errors.New("empty result") })
+	err = validation.validate(nil, nil)
+	require.ErrorIs(t, err, ErrValidationFailed)
+	require.Equal(t, ErrorKindValidationFailed, errorKind(SimResponse{StatusCode: http.StatusBadGateway, Error: err}))
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrProxyStuck is the error of proxy calls which neither returned nor timed out, see PROXY_WATCHDOG_GRACE_MS
+var ErrProxyStuck = errors.New("proxy call stuck")
+
+// watchdogMaxStackBytes limits the goroutine dump which is logged for a stuck proxy call
+const watchdogMaxStackBytes = 1 << 20
+
+// watchedProxyRequest proxies the request like proxyRequest. With the watchdog enabled (ProxyWatchdogGrace), a call
+// which didn't return after its proxy timeout plus the grace is cancelled and abandoned: it fails with a timeout (which
+// is sent as the response of the try), is counted as stuck, and the stacks of the proxy calls are logged. The call
+// returns in the background (if ever), so that the worker continues with the next request.
+func (n *Node) watchedProxyRequest(log *zap.SugaredLogger, req *SimRequest, ctx context.Context, contentType string, target *HTTPRequest) (resp []byte, respContentType string, statusCode int, err error) {
+	timeout, grace := req.ProxyRequestTimeout(), ProxyWatchdogGrace
+	if grace <= 0 {
+		return n.proxyRequest(ctx, req.Payload, contentType, target, timeout)
+	}
+
+	type result struct {
+		resp        []byte
+		contentType string
+		statusCode  int
+		err         error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan result, 1) // the result of an abandoned call is dropped
+	startedAt := time.Now()
+	go func() {
+		var res result
+		res.resp, res.contentType, res.statusCode, res.err = n.proxyRequest(ctx, req.Payload, contentType, target, timeout)
+		done <- res
+	}()
+
+	watchdog := time.NewTimer(timeout + grace)
+	defer watchdog.Stop()
+	select {
+	case res := <-done:
+		return res.resp, res.contentType, res.statusCode, res.err
+	case <-watchdog.C:
+	}
+
+	cancel()
+	n.counters.numStuck.Add(1)
+	if n.metrics != nil {
+		n.metrics.Count(MetricNodeStuckRequests, 1, nodeMetricTag(n.URI))
+	}
+	log.Errorw("proxy call stuck, force-completing the request", "uri", n.URI, "elapsed", time.Since(startedAt), "timeout", timeout, "grace", grace, "numStuck", n.counters.numStuck.Load(), "stacks", proxyCallStacks())
+	return nil, "", 0, fmt.Errorf("%w: no response within the proxy timeout of %s plus %s (%w)", ErrProxyStuck, timeout, grace, context.DeadlineExceeded)
+}
+
+// proxyCallStacks returns the stacks of the goroutines in a proxy call, from a dump of all goroutines
+func proxyCallStacks() string {
+	buf := make([]byte, watchdogMaxStackBytes)
+	buf = buf[:runtime.Stack(buf, true)]
+	var stacks [][]byte
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.Contains(stack, []byte(".(*Node).proxyRequest(")) {
+			stacks = append(stacks, stack)
+		}
+	}
+	return string(bytes.Join(stacks, []byte("\n\n")))
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// contextIgnoringTransport doesn't cancel the round trip with the context of the request, like a transport which
+// misses the cancellation
+type contextIgnoringTransport struct{}
+
+func (contextIgnoringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(req.WithContext(context.Background()))
+}
+
+func TestNodeProxyWatchdog(t *testing.T) {
+	proxyWatchdogGrace := ProxyWatchdogGrace
+	ProxyWatchdogGrace = 100 * time.Millisecond
+	defer func() { ProxyWatchdogGrace = proxyWatchdogGrace }()
+
+	// The node accepts the connections, but never responds
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, err)
+	var lock sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+		}
+	}()
+	defer func() {
+		listener.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close() // lets the abandoned calls return
+		}
+	}()
+
+	jobC := make(chan *SimRequest)
+	node, err := NewNode(testLog, "http://"+listener.Addr().String(), jobC, 1)
+	require.Nil(t, err, err)
+	node.client.Transport = contextIgnoringTransport{}
+	node.StartWorkers()
+	defer node.StopWorkersAndWait()
+
+	// Both requests are force-completed with a timeout, the single worker isn't wedged by the first one
+	for i := 0; i < 2; i++ {
+		req := NewSimRequest(context.Background(), "1", []byte(`{"id":1}`), true, false)
+		req.ProxyTimeout = 100 * time.Millisecond
+		startedAt := time.Now()
+		jobC <- req
+		select {
+		case resp := <-req.ResponseC:
+			require.ErrorIs(t, resp.Error, ErrProxyStuck)
+			require.Equal(t, ErrorKindProxyTimeout, errorKind(resp))
+			require.True(t, resp.ShouldRetry)
+			require.GreaterOrEqual(t, time.Since(startedAt), 200*time.Millisecond)
+		case <-time.After(2 * time.Second):
+			t.Fatal("the stuck proxy call was not force-completed")
+		}
+
+		// exactly one response
+		time.Sleep(50 * time.Millisecond)
+		require.Len(t, req.ResponseC, 0)
+	}
+	stats := node.Stats()
+	require.Equal(t, int64(2), stats.NumStuck)
+	require.Equal(t, int64(2), stats.Errors[ErrorKindProxyTimeout])
+
+	// Without the watchdog, the proxy timeout still applies to a transport which respects it
+	node.client.Transport = http.DefaultTransport
+	ProxyWatchdogGrace = 0
+	req := NewSimRequest(context.Background(), "2", []byte(`{"id":1}`), true, false)
+	req.ProxyTimeout = 100 * time.Millisecond
+	jobC <- req
+	resp := <-req.ResponseC
+	require.NotErrorIs(t, resp.Error, ErrProxyStuck)
+	require.Equal(t, ErrorKindProxyTimeout, errorKind(resp))
+	require.Equal(t, int64(2), node.Stats().NumStuck)
+}
@@ -2,12 +2,18 @@
 package server
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	_ "net/http/pprof"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,52 +23,358 @@ import (
 type Webserver struct {
 	log        *zap.SugaredLogger
 	listenAddr string
-	prioQueue  *PrioQueue
+	prioQueue  Queue
 	nodePool   *NodePool
 	srv        *http.Server
+
+	tlsListenAddr string
+	certLoader    *CertLoader
+	tlsSrv        *http.Server
+
+	adminListenAddr string // if set, admin routes are only served on this address
+	adminSrv        *http.Server
+
+	tenants  *TenantQueue        // only set with multi-tenancy (if prioQueue is a TenantQueue)
+	logLevel *LogLevelController // (optional) runtime log level adjustment
+
+	clientStats *ClientStatsTracker // nil if disabled
+	audit       *AuditSink          // (optional) audit records of completed requests
+	payloadLog  *PayloadLogger      // (optional) logs the payloads of sampled requests
+	recorder    *RequestRecorder    // (optional) records the submitted requests, for replaying them
+	pathPrefix  string              // (optional) all routes are served under this prefix
+
+	simIPFilter   *IPFilter // (optional) source IP filter for the sim endpoint
+	adminIPFilter *IPFilter // (optional) source IP filter for the admin routes
+
+	profiler     *LatencyProfiler
+	events       *EventBroker
+	queueWait    *QueueWaitStats
+	payloadStats *PayloadStats
+	requests     requestCounters
+	pending      pendingRequests // the accepted requests without response, see HandleCancelRequest
+	asyncResults *asyncResults   // (optional) the async requests until their result is fetched
+	callbacks    *CallbackSender // (optional) POSTs the results of the requests with a callback_url
+	metrics      MetricsSink
+	prometheus   *PrometheusMetrics // (optional) served on /metrics
+
+	priorityRules *PriorityClassifier                // assigns the priority of requests without priority headers
+	reloadConfig  func() (ConfigReloadResult, error) // (optional) reloads the config file with /admin/config/reload
+
+	shutdown      shutdownProgress                                              // the graceful shutdown (if started)
+	startShutdown func(opts ShutdownOpts) (status ShutdownStatus, started bool) // (optional) starts it with /admin/shutdown
+
+	signer *ResponseSigner // (optional) signs the sim responses
+
+	retryBudget *RetryBudget        // (optional) limits the retries of failed requests
+	clientQueue *clientQueueCounter // (optional) limits the queued requests per client
+	duplicates  *DuplicateLimiter   // (optional) rejects the duplicate submissions of clients
+
+	shedder          *LoadShedder // (optional) rejects low-prio requests while the high-prio backlog is too large
+	shedFlushLowPrio bool         // fail the queued low-prio requests when the shedding starts
+
+	lowPrioScheduler *LowPrioScheduler      // (optional) the daily windows of the low-prio scheduling, with manual overrides
+	reservations     *FastTrackReservations // (optional) fast-track slots reserved for clients
+	peers            *PeerForwarder         // (optional) serves the requests rejected by the queue by other instances
+	dryRuns          *DryRunner             // (optional) validates payloads against a canary node, bypassing the queue
+	queuePersistence *QueuePersistence      // (optional) persists the queued async and callback requests
+
+	queuePopHooksLock sync.RWMutex
+	queuePopHooks     []func(r *SimRequest, wait time.Duration) // see OnQueuePop
 }
 
-func NewWebserver(log *zap.SugaredLogger, listenAddr string, prioQueue *PrioQueue, nodePool *NodePool) *Webserver {
-	return &Webserver{
-		log:        log,
-		listenAddr: listenAddr,
-		prioQueue:  prioQueue,
-		nodePool:   nodePool,
+func NewWebserver(log *zap.SugaredLogger, listenAddr string, prioQueue Queue, nodePool *NodePool) *Webserver {
+	s := &Webserver{
+		log:          log,
+		listenAddr:   listenAddr,
+		prioQueue:    prioQueue,
+		nodePool:     nodePool,
+		profiler:     NewLatencyProfiler(),
+		events:       NewEventBroker(),
+		queueWait:    NewQueueWaitStats(QueueWaitBuckets),
+		payloadStats: NewPayloadStats(PayloadSizeClasses, ProxyLatencyBuckets),
+		metrics:      NoopMetricsSink{},
+
+		priorityRules: &PriorityClassifier{},
+	}
+
+	if ClientStatsMaxClients > 0 {
+		s.clientStats = NewClientStatsTracker(ClientStatsMaxClients, ClientStatsWindow)
+	}
+	if AsyncMaxResults > 0 {
+		s.asyncResults = newAsyncResults(AsyncMaxResults, AsyncResultTTL)
+	}
+	if tenants, ok := prioQueue.(*TenantQueue); ok {
+		s.tenants = tenants
 	}
+
+	// Publish queue and node events to the /events stream
+	nodePool.SetEventBroker(s.events)
+	s.setQueueThreshold(EventsQueueThreshold)
+	prioQueue.OnPop(func(r *SimRequest, wait time.Duration) {
+		s.queueWait.Observe(r.Priority(), wait)
+		s.metrics.Timing(MetricQueueWait, wait, MetricTag(MetricTagPriority, r.Priority()))
+		recordQueueSpan(r)
+
+		s.queuePopHooksLock.RLock()
+		defer s.queuePopHooksLock.RUnlock()
+		for _, hook := range s.queuePopHooks {
+			hook(r, wait)
+		}
+	})
+	return s
 }
 
-func (s *Webserver) Start() {
-	r := mux.NewRouter()
-	r.HandleFunc("/", s.HandleRootRequest).Methods(http.MethodGet)
-	r.HandleFunc("/", s.HandleQueueRequest).Methods(http.MethodPost)
-	r.HandleFunc("/sim", s.HandleQueueRequest).Methods(http.MethodPost)
-	r.HandleFunc("/nodes", s.HandleNodesRequest).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+// OnQueuePop adds a callback for every request popped from the queue, with the time it waited (i.e. to inspect the
+// priorities in tests). Unlike Queue.OnPop, it keeps the queue wait stats.
+func (s *Webserver) OnQueuePop(cb func(r *SimRequest, wait time.Duration)) {
+	s.queuePopHooksLock.Lock()
+	defer s.queuePopHooksLock.Unlock()
+	s.queuePopHooks = append(s.queuePopHooks, cb)
+}
 
-	if EnablePprof {
-		s.log.Info("Enabling pprof")
-		r.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
+// EnableCallbacks accepts requests with a callback_url, whose results are POSTed there by sender
+func (s *Webserver) EnableCallbacks(sender *CallbackSender) {
+	s.callbacks = sender
+}
+
+// SetAsyncResultStore keeps the results of async requests in store, so that GET /sim/{id} can be served by any instance
+// using it. Must be called before the webserver is started.
+func (s *Webserver) SetAsyncResultStore(store AsyncResultStore) {
+	if s.asyncResults != nil {
+		s.asyncResults.log, s.asyncResults.store = s.log, store
+	}
+}
+
+// EnableAudit records every completed request with sink, and enables /audit/{id}
+func (s *Webserver) EnableAudit(sink *AuditSink) {
+	s.audit = sink
+}
+
+// SetMetricsSink sends the request and queue metrics to sink. The node metrics are sent by the node pool
+// (NodePool.SetMetricsSink).
+func (s *Webserver) SetMetricsSink(sink MetricsSink) {
+	s.metrics = sink
+}
+
+// SetPriorityRules sets the rules which assign the priority of requests without priority headers (can be changed at
+// runtime with /admin/priority-rules)
+func (s *Webserver) SetPriorityRules(rules []PriorityRule) error {
+	return s.priorityRules.SetRules(rules)
+}
+
+// EnableRecording records every submitted request with recorder
+func (s *Webserver) EnableRecording(recorder *RequestRecorder) {
+	s.recorder = recorder
+}
+
+// EnablePayloadLogging logs the payloads of the requests sampled by payloadLog
+func (s *Webserver) EnablePayloadLogging(payloadLog *PayloadLogger) {
+	s.payloadLog = payloadLog
+}
+
+// EnableTLS makes Start() also serve the API over TLS on listenAddr, using the (hot-reloaded) certificate of certLoader
+func (s *Webserver) EnableTLS(listenAddr string, certLoader *CertLoader) {
+	s.tlsListenAddr = listenAddr
+	s.certLoader = certLoader
+}
+
+// EnableAdminListener makes Start() serve the admin routes (node management, profiling, events, pprof) only on listenAddr
+func (s *Webserver) EnableAdminListener(listenAddr string) {
+	s.adminListenAddr = listenAddr
+}
+
+// EnableLogLevelAdjustment enables changing the log level at runtime (/admin/loglevel). The level should be shared by
+// all loggers (webserver and node workers).
+func (s *Webserver) EnableLogLevelAdjustment(level zap.AtomicLevel) {
+	s.logLevel = NewLogLevelController(s.log, level)
+}
+
+// setQueueThreshold sets the number of queued requests which triggers a queue_threshold event (0 disables)
+func (s *Webserver) setQueueThreshold(threshold int) {
+	s.prioQueue.OnThresholdCrossed(threshold, func(above bool, numRequests int) {
+		s.events.Publish(EventTypeQueueThreshold, QueueThresholdEvent{Above: above, Threshold: threshold, NumRequests: numRequests})
+	})
+}
+
+// EnableResponseSigning signs the sim responses with signer (nil disables it)
+func (s *Webserver) EnableResponseSigning(signer *ResponseSigner) {
+	s.signer = signer
+}
+
+// SetIPFilters sets the source IP filters for the sim endpoint and the admin routes (nil disables filtering)
+func (s *Webserver) SetIPFilters(simIPFilter, adminIPFilter *IPFilter) {
+	s.simIPFilter = simIPFilter
+	s.adminIPFilter = adminIPFilter
+}
+
+// SetPathPrefix makes all routes served under prefix (i.e. "/simulation")
+func (s *Webserver) SetPathPrefix(prefix string) {
+	s.pathPrefix = strings.TrimSuffix(prefix, "/")
+}
+
+// registerRoutes registers the API routes on api, and the admin routes on admin (which may be the same router). Admin
+// routes require AdminAuthMiddleware, and the sim endpoint and admin routes are filtered by their IP filters (if set).
+func (s *Webserver) registerRoutes(api, admin *mux.Router) {
+	simHandler := s.signer.Middleware(s.simIPFilter.Middleware(http.HandlerFunc(s.HandleQueueRequest)))
+	if s.pathPrefix != "" {
+		api.Handle(s.pathPrefix, simHandler).Methods(http.MethodPost)
+		api = api.PathPrefix(s.pathPrefix).Subrouter()
+		admin = admin.PathPrefix(s.pathPrefix).Subrouter()
 	}
 
+	api.HandleFunc("/", s.HandleRootRequest).Methods(http.MethodGet)
+	api.HandleFunc("/readyz", s.HandleReadinessRequest).Methods(http.MethodGet)
+	api.Handle("/", simHandler).Methods(http.MethodPost)
+	api.Handle("/sim", simHandler).Methods(http.MethodPost)
+	api.Handle("/sims", s.signer.Middleware(s.simIPFilter.Middleware(http.HandlerFunc(s.HandleSimsRequest)))).Methods(http.MethodPost)
+	api.Handle("/sim/dryrun", s.simIPFilter.Middleware(http.HandlerFunc(s.HandleDryRunRequest))).Methods(http.MethodPost)
+	api.Handle("/sim/{id}", s.simIPFilter.Middleware(http.HandlerFunc(s.HandleCancelRequest))).Methods(http.MethodDelete)
+	api.Handle("/sim/{id}", s.signer.Middleware(s.simIPFilter.Middleware(http.HandlerFunc(s.HandleAsyncResultRequest)))).Methods(http.MethodGet)
+	api.Handle("/admission", s.simIPFilter.Middleware(http.HandlerFunc(s.HandleAdmissionRequest))).Methods(http.MethodGet)
+
 	if EnableErrorTestAPI {
 		s.log.Info("Enabling error testing API")
-		r.HandleFunc("/debug/testLogLevels", s.HandleTestLogLevels).Methods(http.MethodGet)
+		api.HandleFunc("/debug/testLogLevels", s.HandleTestLogLevels).Methods(http.MethodGet)
 	}
 
-	loggedRouter := LoggingMiddleware(s.log, r)
+	adminRoute := func(path string, handler http.HandlerFunc) *mux.Route {
+		return admin.Handle(path, s.adminIPFilter.Middleware(AdminAuthMiddleware(handler)))
+	}
+	adminRoute("/nodes", s.HandleNodesRequest).Methods(http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete)
+	adminRoute("/admin/profile", s.HandleProfileRequest).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	adminRoute("/events", s.HandleEventsRequest).Methods(http.MethodGet)
+	adminRoute("/admin/tenants", s.HandleTenantsRequest).Methods(http.MethodGet, http.MethodPost)
+	adminRoute("/admin/loglevel", s.HandleLogLevelRequest).Methods(http.MethodGet, http.MethodPut)
+	adminRoute("/admin/priority-rules", s.HandlePriorityRulesRequest).Methods(http.MethodGet, http.MethodPut)
+	adminRoute("/admin/config/reload", s.HandleConfigReloadRequest).Methods(http.MethodPost)
+	adminRoute("/admin/shutdown", s.HandleShutdownRequest).Methods(http.MethodGet, http.MethodPost)
+	adminRoute("/admin/scheduler", s.HandleSchedulerRequest).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	adminRoute("/admin/reservations", s.HandleReservationsRequest).Methods(http.MethodGet, http.MethodPost)
+	adminRoute("/admin/reservations/{clientID}", s.HandleReservationsRequest).Methods(http.MethodDelete)
+	adminRoute("/requests", s.HandleRequestsRequest).Methods(http.MethodGet)
+	adminRoute("/stats/queue", s.HandleQueueStatsRequest).Methods(http.MethodGet)
+	adminRoute("/stats/nodes", s.HandleNodeStatsRequest).Methods(http.MethodGet)
+	adminRoute("/stats/payloads", s.HandlePayloadStatsRequest).Methods(http.MethodGet)
+	adminRoute("/stats/dryrun", s.HandleDryRunStatsRequest).Methods(http.MethodGet)
+	adminRoute("/metrics", s.HandlePrometheusRequest).Methods(http.MethodGet)
+	adminRoute("/stats/clients", s.HandleClientStatsRequest).Methods(http.MethodGet)
+	adminRoute("/stats/clients/{clientID}", s.HandleClientStatsRequest).Methods(http.MethodGet)
+	adminRoute("/audit", s.HandleAuditRequest).Methods(http.MethodGet)
+	adminRoute("/audit/{id}", s.HandleAuditRequest).Methods(http.MethodGet)
 
-	s.srv = &http.Server{
-		Addr:    s.listenAddr,
-		Handler: loggedRouter,
+	if EnableFaultInjection {
+		s.log.Warn("Enabling fault injection API")
+		adminRoute("/admin/faults", s.HandleFaultsRequest).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
 	}
 
-	go func() {
-		err := s.srv.ListenAndServe()
-		if err == http.ErrServerClosed {
-			return
+	if EnablePprof {
+		s.log.Info("Enabling pprof")
+		pprofHandler := http.StripPrefix(s.pathPrefix, http.DefaultServeMux)
+		admin.PathPrefix("/debug/pprof/").Handler(s.adminIPFilter.Middleware(AdminAuthMiddleware(pprofHandler)))
+	}
+
+	// Last, so that the other routes take precedence
+	if ReverseProxyPath != "" {
+		s.log.Infow("Enabling the reverse proxy route", "path", s.pathPrefix+ReverseProxyPath)
+		api.PathPrefix(ReverseProxyPath).Handler(s.signer.Middleware(s.simIPFilter.Middleware(http.HandlerFunc(s.HandleReverseProxyRequest))))
+	}
+}
+
+// Handler returns a handler with all routes (API and admin routes, under the path prefix), for embedding the balancer
+// into another service. Listening is up to the caller, i.e. with `mux.Handle("/simulation/", webserver.Handler())`.
+func (s *Webserver) Handler() http.Handler {
+	r := mux.NewRouter()
+	s.registerRoutes(r, r)
+	return LoggingMiddleware(s.log, r)
+}
+
+// Handlers returns the handler for the API, and the handler for the admin routes if they are served on a separate
+// listener (nil otherwise, then the admin routes are part of the API handler).
+func (s *Webserver) Handlers() (api, admin http.Handler) {
+	if s.adminListenAddr == "" {
+		return s.Handler(), nil
+	}
+
+	r := mux.NewRouter()
+	adminRouter := mux.NewRouter()
+	s.registerRoutes(r, adminRouter)
+	return LoggingMiddleware(s.log, r), LoggingMiddleware(s.log, adminRouter)
+}
+
+func (s *Webserver) Start() {
+	if !AdminAuthEnabled() {
+		s.log.Warn("Admin routes are not protected, set ADMIN_TOKEN or ADMIN_PASSWORD")
+	}
+	loggedRouter, adminRouter := s.Handlers()
+
+	if s.listenAddr != "" {
+		s.srv = &http.Server{
+			Addr:    s.listenAddr,
+			Handler: loggedRouter,
 		}
-		s.log.Errorw("Webserver error", "err", err)
-		panic(err)
-	}()
+
+		go func() {
+			err := s.srv.ListenAndServe()
+			if err == http.ErrServerClosed {
+				return
+			}
+			s.log.Errorw("Webserver error", "err", err)
+			panic(err)
+		}()
+	}
+
+	if adminRouter != nil {
+		s.log.Infow("Starting admin webserver", "listenAddr", s.adminListenAddr)
+		s.adminSrv = &http.Server{
+			Addr:    s.adminListenAddr,
+			Handler: adminRouter,
+		}
+
+		go func() {
+			err := s.adminSrv.ListenAndServe()
+			if err == http.ErrServerClosed {
+				return
+			}
+			s.log.Errorw("Admin webserver error", "err", err)
+			panic(err)
+		}()
+	}
+
+	if s.tlsListenAddr != "" && s.certLoader != nil {
+		s.log.Infow("Starting TLS webserver", "listenAddr", s.tlsListenAddr)
+		s.tlsSrv = &http.Server{
+			Addr:      s.tlsListenAddr,
+			Handler:   loggedRouter,
+			TLSConfig: &tls.Config{GetCertificate: s.certLoader.GetCertificate, MinVersion: tls.VersionTLS12},
+		}
+
+		go func() {
+			err := s.tlsSrv.ListenAndServeTLS("", "")
+			if err == http.ErrServerClosed {
+				return
+			}
+			s.log.Errorw("TLS webserver error", "err", err)
+			panic(err)
+		}()
+	}
+}
+
+// Shutdown stops the HTTP, HTTPS and admin listeners, and lets ongoing requests complete (event streams are closed)
+func (s *Webserver) Shutdown(ctx context.Context) {
+	s.events.Close()
+	defer s.audit.Close() // after the ongoing requests completed
+	defer s.callbacks.Close()
+	defer s.queuePersistence.Close()
+	defer s.recorder.Close()
+	if s.srv != nil {
+		s.srv.Shutdown(ctx)
+	}
+	if s.tlsSrv != nil {
+		s.tlsSrv.Shutdown(ctx)
+	}
+	if s.adminSrv != nil {
+		s.adminSrv.Shutdown(ctx)
+	}
 }
 
 func (s *Webserver) HandleRootRequest(w http.ResponseWriter, req *http.Request) {
@@ -70,30 +382,185 @@ func (s *Webserver) HandleRootRequest(w http.ResponseWriter, req *http.Request)
 	fmt.Fprintf(w, "prio-load-balancer\n")
 }
 
+type ReadinessResponse struct {
+	Status                string          `json:"status"`          // "ok", "degraded" if redis is unavailable (requests are still served), or "shutting_down"
+	Redis                 string          `json:"redis,omitempty"` // "ok" or "unavailable" (omitted without redis)
+	NumPendingRedisWrites int             `json:"numPendingRedisWrites"`
+	NumNodes              int             `json:"numNodes"`
+	NumHealthyNodes       int             `json:"numHealthyNodes"`
+	Shutdown              *ShutdownStatus `json:"shutdown,omitempty"` // the progress of the graceful shutdown (if started)
+}
+
+// HandleReadinessRequest reports whether the load balancer is degraded, with status 200 because requests are still
+// served. During a graceful shutdown it reports not ready (status 503), with the progress of the shutdown.
+func (s *Webserver) HandleReadinessRequest(w http.ResponseWriter, req *http.Request) {
+	res := ReadinessResponse{
+		Status:          "ok",
+		NumNodes:        len(s.nodePool.NodeUris()),
+		NumHealthyNodes: s.nodePool.NumHealthyNodes(),
+	}
+	if redisState, ok := s.nodePool.state.(*RedisState); ok {
+		degraded, numPendingWrites := redisState.Status()
+		res.Redis, res.NumPendingRedisWrites = "ok", numPendingWrites
+		if degraded {
+			res.Status, res.Redis = "degraded", "unavailable"
+		}
+	}
+	statusCode := http.StatusOK
+	if res.Shutdown = s.shutdownStatus(); res.Shutdown != nil {
+		res.Status, statusCode = ErrorKindShuttingDown, http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
+
 func (s *Webserver) HandleQueueRequest(w http.ResponseWriter, req *http.Request) {
+	s.handleQueueRequest(w, req, nil)
+}
+
+// handleQueueRequest queues the request, with the captured HTTP request of the reverse proxy route (otherwise nil).
+// Async and callback requests are answered once they are queued (see submitAsync), the others with the response (see
+// respondWhenDone).
+func (s *Webserver) handleQueueRequest(w http.ResponseWriter, req *http.Request, httpReq *HTTPRequest) {
 	startTime := time.Now().UTC()
 	defer req.Body.Close()
 
-	// Allow single `X-Request-ID:...` log field via header
-	reqID := req.Header.Get("X-Request-ID")
-	log := s.log
-	if reqID != "" {
-		log = s.log.With("reqID", reqID)
+	// Use the `X-Request-ID` header for logs, the node request and the response (generated if missing)
+	reqID := ensureRequestID(w, req)
+	log := s.log.With("reqID", reqID)
+
+	// Trace the request (a no-op unless tracing is enabled), with the status code and error of the response
+	ctx, traceSpan := startServerSpan(req)
+	req = req.WithContext(ctx)
+	span := &requestSpan{Span: traceSpan}
+	span.SetAttributes(AttrRequestID.String(reqID))
+	wrapped := wrapResponseWriter(w)
+	w = wrapped
+	defer func() { endSpan(span.Span, wrapped.Status(), span.err, span.errorKind) }()
+
+	// With multi-tenancy, the tenant is derived from the `X-API-Key` header
+	tenant := ""
+	if s.tenants != nil {
+		var found bool
+		tenant, found = s.tenants.TenantForAPIKey(req.Header.Get("X-API-Key"))
+		if !found {
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "unknown API key")
+			return
+		}
+		log = log.With("tenant", tenant)
+	}
+
+	// The optional deadline of the request in the queue, instead of the timeout of its priority
+	timeout, err := requestDeadlineHeader(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
 	}
 
-	// Read the body and start processing
-	body, err := io.ReadAll(req.Body)
+	// The optional timeout of the proxy requests, instead of the proxy timeout of its priority
+	proxyTimeout, err := proxyTimeoutHeader(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// The optional priority level, instead of the X-Fast-Track and X-High-Priority headers
+	priorityLevel, hasPriorityLevel, err := priorityLevelHeader(req, PriorityLevels)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// With `?async=1` the request ID is returned right away, and the result is fetched with GET /sim/{id}. With a
+	// `callback_url` it's POSTed there instead.
+	async := req.URL.Query().Get("async") == "1"
+	callbackURL := req.URL.Query().Get("callback_url")
+	if callbackURL != "" {
+		if s.callbacks == nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "callbacks are disabled")
+			return
+		} else if async {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "async=1 and callback_url can't be combined")
+			return
+		}
+		if callbackURL, err = s.callbacks.parseURL(callbackURL); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	background := async || callbackURL != "" // completed after the handler returned
+
+	// Decompress gzip request bodies. The payload size limit applies to the decompressed size.
+	if !limitRequestBody(w, req, PayloadMaxBytes) {
+		writePayloadTooLarge(w)
+		return
+	}
+	var body io.Reader = req.Body
+	isGzip := isGzipEncoded(req)
+	if isGzip {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid gzip body: "+err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// Read the body and start processing. Large payloads are spooled to disk, and removed when the request is done.
+	payload, err := ReadPayload(body, PayloadMaxBytes, PayloadSpoolThreshold, PayloadSpoolDir)
+	if errors.Is(err, ErrPayloadTooLarge) {
+		writePayloadTooLarge(w)
+		return
+	} else if err != nil && isGzip {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid gzip body: "+err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
 		return
 	}
+	detached := false // async and callback requests are completed in the background, which closes the payload
+	defer func() {
+		if !detached {
+			payload.Close()
+		}
+	}()
+
+	// Optionally split JSON-RPC batches into individual requests (batch elements are validated individually).
+	// In passthrough mode and of reverse proxy requests, payloads are not assumed to be JSON.
+	isJSON := !PassthroughMode && httpReq == nil
+	var batch []json.RawMessage
+	if SplitJSONRPCBatches && isJSON {
+		batch, err = splitJSONRPCBatch(payload)
+		if err != nil {
+			log.Infow("Invalid JSON-RPC batch", "err", err)
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidJSONRPC, "invalid JSON-RPC batch: "+err.Error())
+			return
+		}
+	}
+
+	// Optionally ensure the payload is a valid JSON-RPC request before queueing it
+	if ValidateJSONRPC && isJSON && batch == nil {
+		if err := validateJSONRPCPayload(payload, JSONRPCAllowedMethods); err != nil {
+			log.Infow("Invalid JSON-RPC request", "err", err)
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidJSONRPC, "invalid JSON-RPC request: "+err.Error())
+			return
+		}
+	}
 
-	if len(body) > PayloadMaxBytes {
-		http.Error(w, "Payload too large", http.StatusBadRequest)
+	if async && s.asyncResults == nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "async mode is disabled")
+		return
+	} else if background && (batch != nil || !isJSON) {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "async mode and callbacks are only supported for single JSON payloads")
 		return
 	}
 
-	ctx := req.Context()
+	ctx = ContextWithRequestID(req.Context(), reqID)
 	if ctx.Err() != nil {
 		log.Infow("client closed the connection before processing", "err", ctx.Err())
 		return
@@ -102,11 +569,110 @@ func (s *Webserver) HandleQueueRequest(w http.ResponseWriter, req *http.Request)
 	// Add new sim request to queue
 	isFastTrack := req.Header.Get("X-Fast-Track") == "true"
 	isHighPrio := req.Header.Get("high_prio") == "true" || req.Header.Get("X-High-Priority") == "true"
-	simReq := NewSimRequest(ctx, reqID, body, isHighPrio, isFastTrack)
-	wasAdded := s.prioQueue.Push(simReq)
-	if !wasAdded { // queue was full, job not added
-		log.Error("Couldn't add request, queue is full")
-		http.Error(w, "queue full", http.StatusInternalServerError)
+	if hasPriorityLevel {
+		isHighPrio, isFastTrack = priorityOfLevel(priorityLevel, PriorityLevels)
+	}
+	if batch == nil && s.priorityRules.HasRules() {
+		if body, err := payload.Bytes(); err == nil {
+			isHighPrio, isFastTrack = s.classifyPriority(req, body, isHighPrio, isFastTrack)
+		}
+	}
+	if isHighPrio, isFastTrack, err = s.limitTenantPriority(tenant, isHighPrio, isFastTrack); err != nil {
+		log.Infow("Couldn't add request, priority not allowed for the tenant", "priority", priorityClass(isHighPrio, isFastTrack))
+		w.Header().Set("X-Error-Kind", ErrorKindPriorityNotAllowed)
+		span.errorKind = ErrorKindPriorityNotAllowed
+		writeError(w, http.StatusForbidden, ErrorCodePriorityNotAllowed, err.Error())
+		return
+	}
+	clientID := clientIDForStats(req, tenant)
+	logEntry := accessLogEntryFromContext(ctx)
+	logEntry.isHighPrio, logEntry.isFastTrack, logEntry.payloadSize, logEntry.tenant = isHighPrio, isFastTrack, payload.Len(), tenant
+	logEntry.peerHops = peerHops(req)
+	if !s.allowSubmission(&SimRequest{ClientID: clientID, Tenant: tenant, Payload: payload, IsHighPrio: isHighPrio, IsFastTrack: isFastTrack}) {
+		log.Infow("Couldn't add request, duplicate submission of the client", "clientID", clientID)
+		w.Header().Set("X-Error-Kind", ErrorKindDuplicateSubmission)
+		span.errorKind = ErrorKindDuplicateSubmission
+		writeError(w, http.StatusConflict, ErrorCodeDuplicateSubmission, ErrDuplicateSubmission.Error())
+		return
+	}
+	s.recorder.Record(RecordedRequest{
+		ReqID:       reqID,
+		Priority:    priorityClass(isHighPrio, isFastTrack),
+		ClientID:    req.Header.Get("X-Client-ID"),
+		Tenant:      tenant,
+		ContentType: req.Header.Get("Content-Type"),
+	}, payload)
+	if batch != nil {
+		s.handleBatchRequest(ctx, w, req, log, reqID, tenant, clientID, batch, isHighPrio, isFastTrack, startTime)
+		return
+	}
+
+	if background {
+		ctx = ContextWithRequestID(context.Background(), reqID) // not cancelled when the handler returns
+	}
+	simReq := NewSimRequestWithPayload(ctx, reqID, payload, isHighPrio, isFastTrack)
+	simReq.Tenant = tenant
+	simReq.ContentType = req.Header.Get("Content-Type")
+	simReq.HTTP = httpReq
+	simReq.ClientID = clientID
+	simReq.SizeClass = s.payloadStats.Classify(payload.Len())
+	simReq.Timeout = timeout
+	simReq.ProxyTimeout = proxyTimeout
+	simReq.PriorityLevel = priorityLevel
+	simReq.Stream = StreamResponses && s.signer == nil && !background // signed responses are buffered anyway
+	if background && simReq.Timeout == 0 {
+		simReq.Timeout = simReq.RequestTimeout() // answered when it passes in the queue, no client connection waits for it
+	}
+	span.SetAttributes(AttrPriority.String(simReq.Priority()), AttrTenant.String(tenant))
+	if token := req.Header.Get("X-Reservation-Token"); token != "" {
+		reservation, ok := s.reservations.Lookup(token)
+		if !ok {
+			log.Infow("Invalid or expired reservation token", "clientID", clientID)
+			writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid or expired reservation token")
+			return
+		}
+		simReq.Reservation = reservation
+	}
+	if simReq.Priority() == PriorityLowPrio && s.shouldShed() {
+		if !background && s.forwardToPeer(w, req, simReq, ErrorKindLoadShed) {
+			return
+		}
+		log.Warn("Couldn't add request, shedding low-prio requests")
+		s.shedRequest(simReq)
+		w.Header().Set("X-Error-Kind", ErrorKindLoadShed)
+		span.errorKind = ErrorKindLoadShed
+		writeError(w, http.StatusServiceUnavailable, ErrorCodeLoadShed, ErrLoadShed.Error())
+		return
+	}
+	if !s.acquireClientSlot(simReq) {
+		log.Infow("Couldn't add request, too many queued requests of the client", "clientID", clientID)
+		w.Header().Set("X-Error-Kind", ErrorKindClientQueueLimit)
+		span.errorKind = ErrorKindClientQueueLimit
+		writeError(w, http.StatusTooManyRequests, ErrorCodeClientQueueLimit, ErrClientQueueLimit.Error())
+		return
+	}
+	defer func() {
+		if !detached {
+			s.releaseClientSlot(simReq)   // after the response, or the rejection by the queue
+			s.asyncResults.remove(simReq) // rejected by the queue
+		}
+	}()
+	if async {
+		if err := s.asyncResults.add(simReq, time.Now()); errors.Is(err, ErrAsyncLimit) {
+			log.Warn("Couldn't add async request, too many pending or unfetched results")
+			s.clientStats.Rejected(simReq)
+			s.requests.rejected()
+			s.metricsRejected(simReq, ErrorKindAsyncLimit)
+			w.Header().Set("X-Error-Kind", ErrorKindAsyncLimit)
+			span.errorKind = ErrorKindAsyncLimit
+			writeError(w, http.StatusServiceUnavailable, ErrorCodeAsyncLimit, ErrAsyncLimit.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusConflict, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	if !s.queueSimRequest(w, req, log, simReq, background, span) {
 		return
 	}
 
@@ -121,112 +687,710 @@ func (s *Webserver) HandleQueueRequest(w http.ResponseWriter, req *http.Request)
 	log = log.With(
 		"requestIsHighPrio", isHighPrio,
 		"requestIsFastTrack", isFastTrack,
-		"payloadSize", len(body),
+		"payloadSize", payload.Len(),
 
 		"startQueueSize", s.prioQueue.NumRequests(),
 		"startQueueSizeFastTrack", startQueueSizeFastTrack,
 		"startQueueSizeHighPrio", startQueueSizeHighPrio,
 		"startQueueSizeLowPrio", startQueueSizeLowPrio,
+		"startQueueBytes", s.prioQueue.NumBytes(),
 	)
 	log.Infow("Request added to queue")
+	s.clientStats.Queued(simReq)
+	s.requests.accepted()
+	s.payloadStats.ObserveRequest(simReq)
+
+	if background {
+		detached = true
+		s.submitAsync(w, req, log, simReq, payload, startTime, callbackURL)
+		return
+	}
+	s.respondWhenDone(ctx, w, req, log, simReq, span, logEntry, startTime, startItemQueueSize)
+}
+
+// queueSimRequest pushes the request into the queue. If it's not queued, the rejection is written (or the request is
+// forwarded to a peer, see forwardToPeer), and false is returned.
+func (s *Webserver) queueSimRequest(w http.ResponseWriter, req *http.Request, log *zap.SugaredLogger, simReq *SimRequest, background bool, span *requestSpan) bool {
+	injectedQueueFull := s.nodePool.faults.inject(FaultQueueFull, s.metrics)
+	wasAdded := !injectedQueueFull && s.prioQueue.Push(simReq)
+	if !wasAdded && s.prioQueue.IsClosed() { // shutting down, job not added
+		log.Info("Couldn't add request, shutting down")
+		s.clientStats.Rejected(simReq)
+		s.requests.rejected()
+		s.metricsRejected(simReq, ErrorKindShuttingDown)
+		w.Header().Set("X-Error-Kind", ErrorKindShuttingDown)
+		span.errorKind = ErrorKindShuttingDown
+		writeError(w, http.StatusServiceUnavailable, ErrorCodeShuttingDown, "shutting down")
+		return false
+	} else if !wasAdded && !injectedQueueFull && s.reservations.rejects(simReq) { // the capacity left is reserved
+		log.Infow("Couldn't add request, the fast-track capacity left is reserved", "clientID", simReq.ClientID)
+		s.clientStats.Rejected(simReq)
+		s.requests.rejected()
+		s.metricsRejected(simReq, ErrorKindFastTrackReserved)
+		w.Header().Set("X-Error-Kind", ErrorKindFastTrackReserved)
+		span.errorKind = ErrorKindFastTrackReserved
+		writeError(w, http.StatusTooManyRequests, ErrorCodeFastTrackReserved, ErrFastTrackReserved.Error())
+		return false
+	} else if !wasAdded { // queue was full, job not added
+		if !injectedQueueFull && !background && s.forwardToPeer(w, req, simReq, ErrorKindQueueFull) {
+			return false
+		}
+		if injectedQueueFull {
+			log.Warnw("Couldn't add request, injected fault", "fault", FaultQueueFull)
+			w.Header().Set("X-Fault-Injected", FaultQueueFull)
+		} else {
+			log.Error("Couldn't add request, queue is full")
+		}
+		s.clientStats.Rejected(simReq)
+		s.requests.rejected()
+		s.metricsRejected(simReq, ErrorKindQueueFull)
+		w.Header().Set("X-Error-Kind", ErrorKindQueueFull)
+		span.errorKind = ErrorKindQueueFull
+		writeError(w, http.StatusInternalServerError, ErrorCodeQueueFull, "queue full")
+		return false
+	}
+	return true
+}
+
+// submitAsync answers the queued async or callback request with its status, and completes it in the background
+func (s *Webserver) submitAsync(w http.ResponseWriter, req *http.Request, log *zap.SugaredLogger, simReq *SimRequest, payload Payload, startTime time.Time, callbackURL string) {
+	w.Header().Set("Content-Type", "application/json")
+	if res, err := json.Marshal(s.asyncStatus(simReq)); err == nil {
+		writePayload(w, req, http.StatusAccepted, append(res, '\n'))
+	}
+	s.queuePersistence.Save(simReq, callbackURL) // before it can complete
+	go s.completeAsync(log, simReq, payload, startTime, callbackURL)
+}
 
+// respondWhenDone waits for the response of the queued request (see waitForResponse), and writes it with the timing
+// headers. Nothing is written if the client went away.
+func (s *Webserver) respondWhenDone(ctx context.Context, w http.ResponseWriter, req *http.Request, log *zap.SugaredLogger, simReq *SimRequest, span *requestSpan, logEntry *accessLogEntry, startTime time.Time, startItemQueueSize int) {
 	// Wait for response or cancel
+	resp, ok := s.waitForResponse(ctx, log, simReq)
+	s.clientStats.Finished(simReq, resp, ok)
+	s.requests.finished(resp, ok)
+	s.metricsFinished(simReq, resp, ok, startTime)
+	span.SetAttributes(AttrTries.Int(simReq.Tries))
+	if !ok {
+		return
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close() // the node worker waits for it
+	} else {
+		s.payloadStats.ObserveResponse(simReq, resp)
+	}
+	defer s.audit.Record(simReq, resp, startTime) // after the response was sent
+	defer s.payloadLog.Log(simReq, resp)
+
+	if resp.Error != nil {
+		s.recordTiming(simReq, resp, startTime)
+		setResponseHeaders(w, simReq, resp, startTime)
+		kind := errorKind(resp)
+		w.Header().Set("X-Error-Kind", kind)
+		span.err, span.errorKind = resp.Error, kind
+		s.events.Publish(EventTypeRequestError, RequestErrorEvent{ReqID: simReq.ID, ErrorKind: kind, Error: resp.Error.Error(), NodeURI: resp.NodeURI, Tries: simReq.Tries})
+
+		if resp.StatusCode == 0 {
+			resp.StatusCode = http.StatusInternalServerError
+		}
+
+		if len(resp.Payload) > 0 {
+			if resp.ContentType != "" {
+				w.Header().Set("Content-Type", resp.ContentType)
+			}
+			writePayload(w, req, resp.StatusCode, resp.Payload)
+			return
+		}
+
+		writeError(w, resp.StatusCode, errorCode(kind), strings.Trim(resp.Error.Error(), "\n"))
+		return
+	}
+
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+
+	s.recordTiming(simReq, resp, startTime)
+	logEntry.queueDuration = resp.SimAt.Sub(startTime)
+	queueDurationUs := logEntry.queueDuration.Microseconds()
+	endQueueSizeFastTrack, endQueueSizeHighPrio, endQueueSizeLowPrio := s.prioQueue.Len()
+	endItemQueueSize := endQueueSizeLowPrio
+	if simReq.IsFastTrack {
+		endItemQueueSize = endQueueSizeFastTrack
+	} else if simReq.IsHighPrio {
+		endItemQueueSize = endQueueSizeHighPrio
+	}
+
+	// Add additional profiling information about this request as part of the response headers
+	w.Header().Set("X-PrioLB-QueueDurationUs", fmt.Sprint(queueDurationUs))
+	w.Header().Set("X-PrioLB-SimDurationUs", fmt.Sprint(resp.SimDuration.Microseconds()))
+	w.Header().Set("X-PrioLB-TotalDurationUs", fmt.Sprint(time.Since(startTime).Microseconds()))
+	w.Header().Set("X-PrioLB-QueueSizeStart", fmt.Sprint(startItemQueueSize))
+	w.Header().Set("X-PrioLB-QueueSizeEnd", fmt.Sprint(endItemQueueSize))
+	setResponseHeaders(w, simReq, resp, startTime)
+
+	// Send the response (with the content type of the node response in passthrough mode)
+	contentType := "application/json"
+	if resp.ContentType != "" {
+		contentType = resp.ContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	if resp.Body != nil {
+		size, err := writeStreamedPayload(w, req, resp.StatusCode, resp.Body)
+		s.payloadStats.observeResponse(simReq, resp, size)
+		if err != nil {
+			// the status code was sent already, the connection is closed without completing the response
+			log.Errorw("Streaming the response failed", "err", err, "nodeURI", resp.NodeURI, "responseSize", size)
+			span.err = err
+			panic(http.ErrAbortHandler)
+		}
+	} else {
+		writePayload(w, req, resp.StatusCode, resp.Payload)
+	}
+
+	log.Infow("Request completed",
+		"durationMs", time.Since(startTime).Milliseconds(), // full request duration in milliseconds
+		"durationUs", time.Since(startTime).Microseconds(), // full request duration in microseconds
+		"simDurationUs", resp.SimDuration.Microseconds(), // time only for simulation (proxying)
+		"queueDurationUs", queueDurationUs, // time until request was proxied (queue wait time)
+
+		"statusCode", resp.StatusCode,
+		"nodeURI", resp.NodeURI,
+		"requestTries", simReq.Tries,
+
+		"endQueueSize", s.prioQueue.NumRequests(),
+		"endQueueSizeFastTrack", endQueueSizeFastTrack,
+		"endQueueSizeHighPrio", endQueueSizeHighPrio,
+		"endQueueSizeLowPrio", endQueueSizeLowPrio,
+	)
+}
+
+// waitForResponse waits for the final response of a queued request, and re-queues it on retryable errors.
+// Returns false if the client closed the connection before a response arrived, and ErrRequestTimeout if the deadline
+// of the client request passed.
+func (s *Webserver) waitForResponse(ctx context.Context, log *zap.SugaredLogger, simReq *SimRequest) (resp SimResponse, ok bool) {
+	s.retryBudget.Deposit(time.Now())
+	defer s.pending.add(simReq)()
+
+	// With a deadline of the request, it's answered as soon as the deadline passes in the queue
+	var deadlineC <-chan time.Time
+	if simReq.Timeout > 0 {
+		deadline := time.NewTimer(time.Until(simReq.Deadline()))
+		defer deadline.Stop()
+		deadlineC = deadline.C
+	}
+	var retryC <-chan time.Time // the backoff of a retry, before it's queued again (see RetryBackoff)
 	for {
 		select {
-		case <-ctx.Done(): // if user closes connection, cancel the simreq
-			log.Infow("Client closed the connection prematurely", "err", ctx.Err(), "queueItems", s.prioQueue.NumRequests(), "payloadSize", len(body), "requestTries", simReq.Tries, "requestCancelled", simReq.Cancelled)
-			if ctx.Err() != nil {
-				simReq.Cancelled = true
+		case <-deadlineC:
+			deadlineC = nil
+			if simReq.expire() {
+				simReq.releaseWaiters(nil) // the identical requests which waited for it are queued again
+				log.Infow("Request deadline passed in the queue", "timeout", simReq.Timeout, "queueItems", s.prioQueue.NumRequests(), "requestTries", simReq.Tries)
+				s.prometheus.queueTimedOut(simReq)
+				return SimResponse{Error: simReq.timeoutError()}, true
 			}
-			return
-		case resp := <-simReq.ResponseC:
+			continue // taken by a node worker, which responds
+		case <-ctx.Done(): // if user closes connection (or its deadline passed), the simreq is cancelled with ctx
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// the client may still wait for a response
+				log.Infow("Request deadline passed", "queueItems", s.prioQueue.NumRequests(), "requestTries", simReq.Tries)
+				return SimResponse{Error: simReq.timeoutError()}, true
+			}
+			log.Infow("Client closed the connection prematurely", "err", ctx.Err(), "queueItems", s.prioQueue.NumRequests(), "requestTries", simReq.Tries, "requestCancelled", simReq.Cancelled)
+			return resp, false
+		case <-retryC:
+			retryC = nil
+			if simReq.queueState.Load() != requestQueued || s.prioQueue.Push(simReq) {
+				continue // expired or cancelled during the backoff, which is answered, or queued
+			}
+			return s.retryNotQueued(log, simReq, resp), true
+		case resp = <-simReq.ResponseC:
 			if resp.Error != nil {
-				log.Infow("Request proxying failed", "err", resp.Error, "try", simReq.Tries, "shouldRetry", resp.ShouldRetry, "nodeURI", resp.NodeURI)
+				log.Infow("Request proxying failed", "err", resp.Error, "try", simReq.Tries, "shouldRetry", resp.ShouldRetry, "nodeURI", resp.NodeURI, "fault", resp.Fault)
+				simReq.recordAttempt(resp)
 				if simReq.Tries < RequestMaxTries && resp.ShouldRetry {
-					s.prioQueue.Push(simReq)
-					continue
+					if !s.allowRetry(simReq) {
+						log.Infow("Retry budget exhausted, not retrying", "try", simReq.Tries)
+						resp.Error, resp.ShouldRetry = fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, resp.Error), false
+					} else {
+						simReq.requeue()
+						if deadlineC == nil && simReq.Timeout > 0 {
+							deadlineC = time.After(time.Until(simReq.Deadline())) // passed already while the try was proxied
+						}
+						if backoff := retryBackoff(simReq.Tries); backoff > 0 {
+							log.Debugw("Retrying after backoff", "try", simReq.Tries, "backoff", backoff)
+							retryC = time.After(backoff)
+							continue
+						} else if s.prioQueue.Push(simReq) {
+							continue
+						}
+						return s.retryNotQueued(log, simReq, resp), true
+					}
 				}
+				resp.Error = simReq.attemptsError(resp.Error)
+			}
+			return resp, true
+		}
+	}
+}
 
-				if resp.StatusCode == 0 {
-					resp.StatusCode = http.StatusInternalServerError
-				}
+// retryNotQueued returns the final response of a request whose retry couldn't be queued, with the error of the last try
+func (s *Webserver) retryNotQueued(log *zap.SugaredLogger, simReq *SimRequest, resp SimResponse) SimResponse {
+	if s.prioQueue.IsClosed() {
+		log.Infow("Not retrying, shutting down", "try", simReq.Tries)
+		resp.Error, resp.ShouldRetry = fmt.Errorf("%w: %w", ErrShuttingDown, resp.Error), false
+	}
+	resp.Error = simReq.attemptsError(resp.Error)
+	return resp
+}
 
-				if len(resp.Payload) > 0 {
-					w.WriteHeader(resp.StatusCode)
-					w.Write(resp.Payload)
-					return
-				}
+// setResponseHeaders adds the node URI (unless HideNodeURIHeader is set), timings and number of tries to the response headers
+func setResponseHeaders(w http.ResponseWriter, simReq *SimRequest, resp SimResponse, startTime time.Time) {
+	queueDuration := time.Since(startTime) // requests which were never proxied spent all the time in the queue
+	if !resp.SimAt.IsZero() {
+		queueDuration = resp.SimAt.Sub(startTime)
+	}
+
+	if resp.NodeURI != "" && !HideNodeURIHeader {
+		w.Header().Set("X-Node-URI", resp.NodeURI)
+	}
+	w.Header().Set("X-Sim-Duration-Ms", fmt.Sprint(resp.SimDuration.Milliseconds()))
+	w.Header().Set("X-Queue-Duration-Ms", fmt.Sprint(queueDuration.Milliseconds()))
+	w.Header().Set("X-Tries", fmt.Sprint(simReq.Tries))
+	if resp.Fault != "" {
+		w.Header().Set("X-Fault-Injected", resp.Fault)
+	}
+}
+
+// requestDeadlineHeader returns the max. time of the request in the queue, of the `X-Request-Deadline-Ms` header (0 if
+// not set)
+func requestDeadlineHeader(req *http.Request) (time.Duration, error) {
+	value := req.Header.Get("X-Request-Deadline-Ms")
+	if value == "" {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("invalid X-Request-Deadline-Ms header: %s", value)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// proxyTimeoutHeader returns the timeout of the proxy requests to the nodes, of the `X-Proxy-Timeout-Ms` header (0 if
+// not set). It must not exceed ProxyRequestTimeoutMax.
+func proxyTimeoutHeader(req *http.Request) (time.Duration, error) {
+	value := req.Header.Get("X-Proxy-Timeout-Ms")
+	if value == "" {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("invalid X-Proxy-Timeout-Ms header: %s", value)
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout > ProxyRequestTimeoutMax {
+		return 0, fmt.Errorf("X-Proxy-Timeout-Ms header exceeds the max. proxy timeout of %s", ProxyRequestTimeoutMax)
+	}
+	return timeout, nil
+}
+
+// priorityLevelHeader returns the priority level of the `X-Priority` header, 0 to numLevels-1 (see
+// PrioQueue.SetPriorityLevels). ok is false if it's not set.
+func priorityLevelHeader(req *http.Request, numLevels int) (level int, ok bool, err error) {
+	value := req.Header.Get("X-Priority")
+	if value == "" {
+		return 0, false, nil
+	}
+	if numLevels < 3 {
+		numLevels = 3
+	}
+	level, err = strconv.Atoi(value)
+	if err != nil || level < 0 || level >= numLevels {
+		return 0, false, fmt.Errorf("invalid X-Priority header: %s (levels 0 to %d)", value, numLevels-1)
+	}
+	return level, true, nil
+}
+
+// priorityOfLevel returns the priority flags of a priority level: 0 is fast-track, the last one low-prio, and the
+// ones in between are high-prio
+func priorityOfLevel(level, numLevels int) (isHighPrio, isFastTrack bool) {
+	if numLevels < 3 {
+		numLevels = 3
+	}
+	return level > 0 && level < numLevels-1, level == 0
+}
+
+// limitTenantPriority returns the priority of a request of the tenant, downgraded to the max. priority of the tenant
+// (see TenantConfig.MaxPriority). Returns ErrPriorityNotAllowed instead with TenantPriorityCapReject.
+func (s *Webserver) limitTenantPriority(tenant string, isHighPrio, isFastTrack bool) (bool, bool, error) {
+	maxPriority := ""
+	if s.tenants != nil && tenant != "" {
+		maxPriority = s.tenants.MaxPriority(tenant)
+	}
+	switch {
+	case maxPriority == "" || maxPriority == PriorityFastTrack:
+		return isHighPrio, isFastTrack, nil
+	case maxPriority == PriorityHighPrio && !isFastTrack, maxPriority == PriorityLowPrio && !isFastTrack && !isHighPrio:
+		return isHighPrio, isFastTrack, nil
+	case TenantPriorityCapReject:
+		return isHighPrio, isFastTrack, ErrPriorityNotAllowed
+	}
+	return maxPriority == PriorityHighPrio, false, nil
+}
+
+// unknownClientID is the client ID of requests without tenant and X-Client-ID header
+const unknownClientID = "unknown"
+
+// clientIDForStats returns the key of the per-client usage stats: the tenant with multi-tenancy, otherwise the
+// `X-Client-ID` header
+func clientIDForStats(req *http.Request, tenant string) string {
+	if tenant != "" {
+		return tenant
+	} else if clientID := req.Header.Get("X-Client-ID"); clientID != "" {
+		return clientID
+	}
+	return unknownClientID
+}
+
+// recordTiming adds the timing of a completed request to the latency profiler (if a profiling window is active)
+func (s *Webserver) recordTiming(simReq *SimRequest, resp SimResponse, startTime time.Time) {
+	if !s.profiler.IsRecording() {
+		return
+	}
+
+	timing := RequestTiming{
+		ReqID:           simReq.ID,
+		NodeURI:         resp.NodeURI,
+		IsHighPrio:      simReq.IsHighPrio,
+		IsFastTrack:     simReq.IsFastTrack,
+		SizeClass:       simReq.SizeClass,
+		ProxyDurationUs: resp.SimDuration.Microseconds(),
+		TotalDurationUs: time.Since(startTime).Microseconds(),
+		CompletedAt:     time.Now().UTC(),
+	}
+	if !resp.SimAt.IsZero() {
+		timing.QueueDurationUs = resp.SimAt.Sub(startTime).Microseconds()
+	}
+	if resp.Error != nil {
+		timing.Error = resp.Error.Error()
+	}
+	s.profiler.Record(timing)
+}
+
+// HandleProfileRequest manages latency profiling windows:
+// - POST starts a new window (query args: `seconds` and/or `requests` to limit it)
+// - GET returns the percentiles and slowest requests of the last window (query arg: `slowest`, default 10)
+// - DELETE stops the current window
+func (s *Webserver) HandleProfileRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	queryInt := func(key string, defaultValue int) (int, error) {
+		if query.Get(key) == "" {
+			return defaultValue, nil
+		}
+		val, err := strconv.Atoi(query.Get(key))
+		if err == nil && val < 0 {
+			err = fmt.Errorf("invalid %s: %d", key, val)
+		}
+		return val, err
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		seconds, err := queryInt("seconds", 0)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		requests, err := queryInt("requests", 0)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if seconds == 0 && requests == 0 {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "seconds or requests is required")
+			return
+		}
+		s.profiler.Start(time.Duration(seconds)*time.Second, requests, ProfilerBufferSize)
+		s.log.Infow("Latency profiling started", "seconds", seconds, "requests", requests)
+	case http.MethodDelete:
+		s.profiler.Stop()
+	}
+
+	numSlowest, err := queryInt("slowest", 10)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.profiler.Report(numSlowest)); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
+
+// HandleEventsRequest streams queue and node events, and periodic stats snapshots, as server-sent events.
+// Events are dropped for slow consumers, which is announced with a "dropped" event.
+func (s *Webserver) HandleEventsRequest(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, "streaming not supported")
+		return
+	}
+
+	sub := s.events.Subscribe(EventsBufferSize)
+	defer s.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	writeEvent := func(event Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		return err
+	}
+
+	var statsC <-chan time.Time
+	if EventsStatsInterval > 0 {
+		ticker := time.NewTicker(EventsStatsInterval)
+		defer ticker.Stop()
+		statsC = ticker.C
+	}
 
-				http.Error(w, strings.Trim(resp.Error.Error(), "\n"), resp.StatusCode)
+	for {
+		var event Event
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok { // shutdown
 				return
 			}
+			event = e
+		case <-statsC:
+			event = Event{Type: EventTypeStats, Time: time.Now().UTC(), Data: s.stats()}
+		}
 
-			if resp.StatusCode == 0 {
-				resp.StatusCode = http.StatusOK
+		if dropped := sub.TakeDropped(); dropped > 0 {
+			if err := writeEvent(Event{Type: EventTypeDropped, Time: time.Now().UTC(), Data: DroppedEvent{Count: dropped}}); err != nil {
+				return
 			}
+		}
+		if err := writeEvent(event); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
 
-			queueDurationUs := resp.SimAt.Sub(startTime).Microseconds()
-			endQueueSizeFastTrack, endQueueSizeHighPrio, endQueueSizeLowPrio := s.prioQueue.Len()
-			endItemQueueSize := endQueueSizeLowPrio
-			if isFastTrack {
-				endItemQueueSize = endQueueSizeFastTrack
-			} else if isHighPrio {
-				endItemQueueSize = endQueueSizeHighPrio
-			}
+func (s *Webserver) stats() StatsEvent {
+	lenFastTrack, lenHighPrio, lenLowPrio := s.prioQueue.Len()
+	return StatsEvent{
+		QueueSizeFastTrack: lenFastTrack,
+		QueueSizeHighPrio:  lenHighPrio,
+		QueueSizeLowPrio:   lenLowPrio,
+		QueueBytes:         s.prioQueue.NumBytes(),
+		NumNodes:           len(s.nodePool.NodeUris()),
+		NumHealthyNodes:    s.nodePool.NumHealthyNodes(),
+	}
+}
+
+type ClientStatsResponse struct {
+	Window  string        `json:"window"`
+	Clients []ClientUsage `json:"clients"`
+}
+
+// HandleClientStatsRequest returns the usage stats of all clients, or the detailed stats of a single client
+type QueueStatsResponse struct {
+	NumFastTrack int                               `json:"numFastTrack"`
+	NumHighPrio  int                               `json:"numHighPrio"`
+	NumLowPrio   int                               `json:"numLowPrio"`
+	NumBytes     int64                             `json:"numBytes"`
+	WaitTimes    map[string]QueueWaitPriorityStats `json:"waitTimes"`             // by priority class
+	LoadShed     *LoadShedStats                    `json:"loadShed,omitempty"`    // only with load shedding enabled
+	RetryBudget  *RetryBudgetStats                 `json:"retryBudget,omitempty"` // only with a retry budget
+
+	LowPrioSchedule *LowPrioScheduleStatus `json:"lowPrioSchedule,omitempty"` // the active window (only with the low-prio scheduler)
+	PeerForwarding  *PeerForwardingStats   `json:"peerForwarding,omitempty"`  // only with peers
+
+	// Requests whose client closed the connection (or whose deadline passed): discarded without proxying, and node
+	// responses which were not sent
+	NumCancelledSkipped int64 `json:"numCancelledSkipped"`
+	NumDroppedResponses int64 `json:"numDroppedResponses"`
+}
+
+// HandleQueueStatsRequest returns the current queue lengths, and the queue wait times by priority class
+func (s *Webserver) HandleQueueStatsRequest(w http.ResponseWriter, req *http.Request) {
+	res := QueueStatsResponse{
+		NumBytes:            s.prioQueue.NumBytes(),
+		WaitTimes:           s.queueWait.Stats(),
+		NumCancelledSkipped: cancelledCounters.skipped.Load(),
+		NumDroppedResponses: cancelledCounters.droppedResponses.Load(),
+	}
+	res.NumFastTrack, res.NumHighPrio, res.NumLowPrio = s.prioQueue.Len()
+	if s.shedder != nil {
+		stats := s.shedder.Stats()
+		res.LoadShed = &stats
+	}
+	if s.peers != nil {
+		stats := s.peers.Stats()
+		res.PeerForwarding = &stats
+	}
+	if s.retryBudget != nil {
+		stats := s.retryBudget.Stats(time.Now())
+		res.RetryBudget = &stats
+	}
+	if s.lowPrioScheduler != nil {
+		status := s.lowPrioScheduler.Status()
+		res.LowPrioSchedule = &status
+	}
 
-			// Add additional profiling information about this request as part of the response headers
-			w.Header().Set("X-PrioLB-QueueDurationUs", fmt.Sprint(queueDurationUs))
-			w.Header().Set("X-PrioLB-SimDurationUs", fmt.Sprint(resp.SimDuration.Microseconds()))
-			w.Header().Set("X-PrioLB-TotalDurationUs", fmt.Sprint(time.Since(startTime).Microseconds()))
-			w.Header().Set("X-PrioLB-QueueSizeStart", fmt.Sprint(startItemQueueSize))
-			w.Header().Set("X-PrioLB-QueueSizeEnd", fmt.Sprint(endItemQueueSize))
-
-			// Send the response
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(resp.StatusCode)
-			w.Write(resp.Payload)
-
-			log.Infow("Request completed",
-				"durationMs", time.Since(startTime).Milliseconds(), // full request duration in milliseconds
-				"durationUs", time.Since(startTime).Microseconds(), // full request duration in microseconds
-				"simDurationUs", resp.SimDuration.Microseconds(), // time only for simulation (proxying)
-				"queueDurationUs", queueDurationUs, // time until request was proxied (queue wait time)
-
-				"statusCode", resp.StatusCode,
-				"nodeURI", resp.NodeURI,
-				"requestTries", simReq.Tries,
-
-				"endQueueSize", s.prioQueue.NumRequests(),
-				"endQueueSizeFastTrack", endQueueSizeFastTrack,
-				"endQueueSizeHighPrio", endQueueSizeHighPrio,
-				"endQueueSizeLowPrio", endQueueSizeLowPrio,
-			)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
+
+// HandlePayloadStatsRequest returns the request and response size histograms, and the proxy latency by size class
+func (s *Webserver) HandlePayloadStatsRequest(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.payloadStats.Stats()); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
+
+// HandleNodeStatsRequest returns the request counters of every node, with the errors by kind
+func (s *Webserver) HandleNodeStatsRequest(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.nodePool.NodeStats()); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
+
+func (s *Webserver) HandleClientStatsRequest(w http.ResponseWriter, req *http.Request) {
+	if s.clientStats == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "client stats are disabled")
+		return
+	}
+
+	var res interface{}
+	if clientID, ok := mux.Vars(req)["clientID"]; ok {
+		detail, found := s.clientStats.Client(clientID)
+		if !found {
+			writeError(w, http.StatusNotFound, ErrorCodeNotFound, "client not found")
 			return
 		}
+		res = detail
+	} else {
+		res = ClientStatsResponse{Window: s.clientStats.Window().String(), Clients: s.clientStats.Clients()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+	}
+}
+
+type TenantsResponse struct {
+	Tenants []TenantConfig         `json:"tenants"` // API keys are masked
+	Stats   map[string]TenantStats `json:"stats"`
+}
+
+// maskSecret returns the first 4 characters of a secret, and masks the rest
+func maskSecret(secret string) string {
+	if len(secret) <= 4 {
+		return "****"
+	}
+	return secret[:4] + "****"
+}
+
+// HandleTenantsRequest returns the tenant configs and stats (GET), or replaces the tenant configs (POST)
+func (s *Webserver) HandleTenantsRequest(w http.ResponseWriter, req *http.Request) {
+	if s.tenants == nil {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "multi-tenancy is not enabled")
+		return
+	}
+
+	if req.Method == http.MethodPost {
+		var tenants []TenantConfig
+		if err := json.NewDecoder(req.Body).Decode(&tenants); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if err := ValidateTenants(tenants); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if err := s.tenants.UpdateTenants(tenants); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		s.log.Infow("Tenants updated", "numTenants", len(tenants))
+	}
+
+	res := TenantsResponse{Tenants: s.tenants.Tenants(), Stats: s.tenants.Stats()}
+	for i := range res.Tenants {
+		res.Tenants[i].APIKey = maskSecret(res.Tenants[i].APIKey)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
 	}
 }
 
 type NodeURIPayload struct {
-	URI string `json:"uri"`
+	URI     string            `json:"uri"`
+	Headers map[string]string `json:"headers,omitempty"` // (optional) set on every request to the node
 }
 
 func (s *Webserver) HandleNodesRequest(w http.ResponseWriter, req *http.Request) {
 	if req.Method == "GET" {
+		// the URIs, or with ?details=1 the entries of the nodes with masked header values
+		var res interface{} = s.nodePool.NodeUris()
+		if req.URL.Query().Get("details") == "1" {
+			res = s.nodePool.NodeEntries()
+		}
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(s.nodePool.NodeUris()); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
 			return
 		}
 
 	} else if req.Method == "POST" {
 		var payload NodeURIPayload
 		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
 			return
 		}
 
-		if err := s.nodePool.AddNode(payload.URI); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := s.nodePool.AddNodeWithHeaders(payload.URI, payload.Headers); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	} else if req.Method == "PATCH" { // replaces the headers of a node
+		var payload NodeURIPayload
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+
+		found, err := s.nodePool.SetNodeHeaders(payload.URI, payload.Headers)
+		if !found && err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		} else if !found {
+			writeError(w, http.StatusNotFound, ErrorCodeNotFound, "node not found")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrorCodeInternal, "headers updated, but saving them failed: "+err.Error())
 			return
 		}
 
@@ -235,18 +1399,18 @@ func (s *Webserver) HandleNodesRequest(w http.ResponseWriter, req *http.Request)
 	} else if req.Method == "DELETE" {
 		var payload NodeURIPayload
 		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
 			return
 		}
 
 		wasRemoved, err := s.nodePool.DelNode(payload.URI)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
 			return
 		}
 
 		if !wasRemoved {
-			http.Error(w, "node not found", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "node not found")
 			return
 		}
 
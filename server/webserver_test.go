@@ -3,12 +3,17 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,10 +21,37 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// newTestWebserver returns a webserver with a mock node backend, and pumps jobs from its queue to the node pool
+func newTestWebserver(t *testing.T, numWorkers int32) (*Webserver, *testutils.MockNodeBackend) {
+	t.Helper()
+	mockNodeBackend := testutils.NewMockNodeBackend()
+	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	t.Cleanup(prioQueue.Close)
+	nodePool := NewNodePool(testLog, nil, numWorkers)
+	err := nodePool.AddNode(mockNodeServer.URL)
+	require.Nil(t, err, err)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+
+	// Pump jobs from prioQueue to nodepool
+	go func() {
+		for {
+			job := prioQueue.Pop()
+			if job == nil {
+				return
+			}
+			nodePool.JobC <- job
+		}
+	}()
+
+	return webserver, mockNodeBackend
+}
+
 func TestWebserver(t *testing.T) {
 	resetTestRedis()
 
-	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
 	nodePool := NewNodePool(testLog, redisTestState, 1)
 	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
 
@@ -100,7 +132,7 @@ func TestWebserverSim(t *testing.T) {
 	mockNodeBackend := testutils.NewMockNodeBackend()
 	mockNodeServer := httptest.NewServer(http.HandlerFunc(mockNodeBackend.Handler))
 
-	prioQueue := NewPrioQueue(0, 0, 0, 2, false)
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
 	nodePool := NewNodePool(testLog, nil, 1)
 	nodePool.AddNode(mockNodeServer.URL)
 	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
@@ -161,3 +193,467 @@ func TestWebserverSim(t *testing.T) {
 	require.True(t, tX.Seconds() < 1, "should have been cancelled")
 	// Here no further requests can be made!
 }
+
+func TestWebserverSpooledPayloadCleanup(t *testing.T) {
+	spoolDir := t.TempDir()
+	defer func(threshold int, dir string, timeout time.Duration) {
+		PayloadSpoolThreshold, PayloadSpoolDir, RequestTimeout = threshold, dir, timeout
+	}(PayloadSpoolThreshold, PayloadSpoolDir, RequestTimeout)
+	PayloadSpoolThreshold = 10
+	PayloadSpoolDir = spoolDir
+
+	numSpoolFiles := func() int {
+		entries, err := os.ReadDir(spoolDir)
+		require.Nil(t, err, err)
+		return len(entries)
+	}
+
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	handler := http.HandlerFunc(webserver.HandleQueueRequest)
+
+	reqPayload := testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1")
+	reqPayloadBytes, err := json.Marshal(reqPayload)
+	require.Nil(t, err, err)
+
+	// Cleanup on success: payload is streamed to the node from disk
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, `{"id":1,"result":"cool","jsonrpc":"2.0"}`+"\n", rr.Body.String())
+	require.Equal(t, "eth_callBundle", mockNodeBackend.LastJSONRPCRequest.Method)
+	require.Equal(t, 0, numSpoolFiles())
+
+	// Cleanup on client cancellation
+	mockNodeBackend.RPCHandlerOverride = func(req *testutils.JSONRPCRequest) (result interface{}, err error) {
+		time.Sleep(500 * time.Millisecond)
+		return "cool", nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ = http.NewRequestWithContext(ctx, "POST", "/", bytes.NewBuffer(reqPayloadBytes))
+	doneC := make(chan bool)
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		doneC <- true
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, numSpoolFiles())
+	cancel()
+	<-doneC
+	require.Equal(t, 0, numSpoolFiles())
+	time.Sleep(500 * time.Millisecond) // let the node worker finish the cancelled request
+
+	// Cleanup on queue timeout: first request blocks the only worker, the second one times out
+	RequestTimeout = 100 * time.Millisecond
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes)))
+		doneC <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+	req, _ = http.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Contains(t, rr.Body.String(), ErrRequestTimeout.Error())
+	<-doneC
+	require.Equal(t, 0, numSpoolFiles())
+}
+
+func TestWebserverGzip(t *testing.T) {
+	defer func(maxBytes, minGzip int) {
+		PayloadMaxBytes, ResponseGzipMinBytes = maxBytes, minGzip
+	}(PayloadMaxBytes, ResponseGzipMinBytes)
+	ResponseGzipMinBytes = 10
+
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	handler := http.HandlerFunc(webserver.HandleQueueRequest)
+
+	gzipBytes := func(b []byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(b)
+		gz.Close()
+		return &buf
+	}
+
+	reqPayload := testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1")
+	reqPayloadBytes, err := json.Marshal(reqPayload)
+	require.Nil(t, err, err)
+	expectedResponse := `{"id":1,"result":"cool","jsonrpc":"2.0"}` + "\n"
+
+	// Compressed request, compressed response
+	req, _ := http.NewRequest("POST", "/", gzipBytes(reqPayloadBytes))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(rr.Body)
+	require.Nil(t, err, err)
+	body, err := io.ReadAll(gz)
+	require.Nil(t, err, err)
+	require.Equal(t, expectedResponse, string(body))
+	require.Equal(t, "eth_callBundle", mockNodeBackend.LastJSONRPCRequest.Method)
+
+	// Compressed request, plain response
+	req, _ = http.NewRequest("POST", "/", gzipBytes(reqPayloadBytes))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, expectedResponse, rr.Body.String())
+
+	// Responses below the threshold are not compressed
+	ResponseGzipMinBytes = 1000
+	req, _ = http.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, expectedResponse, rr.Body.String())
+
+	// Malformed gzip -> 400
+	req, _ = http.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Truncated gzip -> 400
+	compressed := gzipBytes(reqPayloadBytes).Bytes()
+	req, _ = http.NewRequest("POST", "/", bytes.NewBuffer(compressed[:len(compressed)-5]))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Size limit applies to the decompressed body
+	PayloadMaxBytes = 1000
+	largePayload := bytes.Repeat([]byte(" "), 2000)
+	compressed = gzipBytes(largePayload).Bytes()
+	require.Less(t, len(compressed), PayloadMaxBytes)
+	req, _ = http.NewRequest("POST", "/", bytes.NewBuffer(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	require.Contains(t, rr.Body.String(), "Payload too large")
+}
+
+func TestWebserverPayloadLimits(t *testing.T) {
+	defer func(payloadMaxBytes, responseMaxBytes int) {
+		PayloadMaxBytes, NodeResponseMaxBytes = payloadMaxBytes, responseMaxBytes
+	}(PayloadMaxBytes, NodeResponseMaxBytes)
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	handler := http.HandlerFunc(webserver.HandleQueueRequest)
+	serve := func(body string, contentLength bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if !contentLength {
+			req.ContentLength = -1
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Request payloads: exactly at the limit, and one byte over (with and without Content-Length)
+	payload := `{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`
+	PayloadMaxBytes = len(payload) + 10
+	atLimit := payload + strings.Repeat(" ", 10)
+	for _, contentLength := range []bool{true, false} {
+		rr := serve(atLimit, contentLength)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.NotNil(t, mockNodeBackend.LastJSONRPCRequest)
+
+		mockNodeBackend.Reset()
+		rr = serve(atLimit+" ", contentLength)
+		require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+		require.Equal(t, ErrorCodePayloadTooLarge, decodeErrorResponse(t, rr).Code)
+		require.Nil(t, mockNodeBackend.LastRawRequest) // never queued
+	}
+
+	// Node responses: exactly at the limit, and one byte over
+	response := `{"jsonrpc":"2.0","id":1,"result":"` + strings.Repeat("0", 100) + `"}`
+	NodeResponseMaxBytes = len(response)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(response))
+	}
+	rr := serve(payload, true)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, response, rr.Body.String())
+
+	NodeResponseMaxBytes = len(response) - 1
+	rr = serve(payload, true)
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	require.Equal(t, ErrorKindResponseTooLarge, rr.Header().Get("X-Error-Kind"))
+	require.Equal(t, ErrorCodeResponseTooLarge, decodeErrorResponse(t, rr).Code)
+	require.Equal(t, "1", rr.Header().Get("X-Tries")) // not retried
+
+	// Also for error responses of the node
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(response))
+	}
+	rr = serve(payload, true)
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	require.Equal(t, ErrorKindResponseTooLarge, rr.Header().Get("X-Error-Kind"))
+}
+
+func TestWebserverResponseHeaders(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	nodeURI := webserver.nodePool.NodeUris()[0]
+
+	reqPayloadBytes, err := json.Marshal(testutils.NewJSONRPCRequest1(1, "eth_callBundle", "0x1"))
+	require.Nil(t, err, err)
+	sendRequest := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, httptest.NewRequest("POST", "/", bytes.NewBuffer(reqPayloadBytes)))
+		return rr
+	}
+
+	// Successful response
+	mockNodeBackend.RPCHandlerOverride = func(req *testutils.JSONRPCRequest) (result interface{}, err error) {
+		time.Sleep(10 * time.Millisecond)
+		return "cool", nil
+	}
+	rr := sendRequest()
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, nodeURI, rr.Header().Get("X-Node-URI"))
+	simDurationMs, err := strconv.Atoi(rr.Header().Get("X-Sim-Duration-Ms"))
+	require.Nil(t, err, err)
+	require.GreaterOrEqual(t, simDurationMs, 10)
+	require.NotEmpty(t, rr.Header().Get("X-Queue-Duration-Ms"))
+	require.Equal(t, "1", rr.Header().Get("X-Tries"))
+	require.Empty(t, rr.Header().Get("X-Error-Kind"))
+
+	// Error response (retried until RequestMaxTries)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "node error", http.StatusInternalServerError)
+	}
+	rr = sendRequest()
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, nodeURI, rr.Header().Get("X-Node-URI"))
+	require.NotEmpty(t, rr.Header().Get("X-Sim-Duration-Ms"))
+	require.NotEmpty(t, rr.Header().Get("X-Queue-Duration-Ms"))
+	require.Equal(t, fmt.Sprint(RequestMaxTries), rr.Header().Get("X-Tries"))
+	require.Equal(t, ErrorKindNodeError, rr.Header().Get("X-Error-Kind"))
+
+	// Node URI can be hidden
+	defer func(hide bool) { HideNodeURIHeader = hide }(HideNodeURIHeader)
+	HideNodeURIHeader = true
+	rr = sendRequest()
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	_, found := rr.Header()["X-Node-Uri"]
+	require.False(t, found)
+	require.Equal(t, ErrorKindNodeError, rr.Header().Get("X-Error-Kind"))
+
+	mockNodeBackend.HTTPHandlerOverride = nil
+	rr = sendRequest()
+	require.Equal(t, http.StatusOK, rr.Code)
+	_, found = rr.Header()["X-Node-Uri"]
+	require.False(t, found)
+	require.Equal(t, "1", rr.Header().Get("X-Tries"))
+}
+
+func TestErrorKind(t *testing.T) {
+	require.Equal(t, ErrorKindRequestTimeout, errorKind(SimResponse{Error: ErrRequestTimeout}))
+	require.Equal(t, ErrorKindNodeTimeout, errorKind(SimResponse{Error: ErrNodeTimeout}))
+	require.Equal(t, ErrorKindNoNodesAvailable, errorKind(SimResponse{Error: ErrNoNodesAvailable}))
+	require.Equal(t, ErrorKindProxyTimeout, errorKind(SimResponse{Error: fmt.Errorf("proxying request failed: %w", context.DeadlineExceeded)}))
+	require.Equal(t, ErrorKindNodeError, errorKind(SimResponse{Error: errors.New("error in response"), StatusCode: 503}))
+	require.Equal(t, ErrorKindProxyError, errorKind(SimResponse{Error: errors.New("connection refused")}))
+	require.Equal(t, ErrorKindRetryBudgetExhausted, errorKind(SimResponse{Error: fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, context.DeadlineExceeded)}))
+	require.Equal(t, ErrorKindMiddleware, errorKind(SimResponse{Error: fmt.Errorf("%w: %w", ErrMiddleware, errors.New("invalid payload"))}))
+}
+
+func TestWebserverPassthrough(t *testing.T) {
+	payload := []byte{0x0a, 0x03, 'f', 'o', 'o', 0x00, 0xff, 0xfe, '{'}
+	respPayload := []byte{0x12, 0x02, 0x00, 0x01, 0xff}
+
+	var nodeReqContentType, nodeReqAccept string
+	var nodeReqBody []byte
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") == "application/json" { // health check
+			return
+		}
+		nodeReqContentType, nodeReqAccept = req.Header.Get("Content-Type"), req.Header.Get("Accept")
+		nodeReqBody, _ = io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(respPayload)
+	}))
+
+	// Passthrough mode disables JSON-RPC validation
+	_ValidateJSONRPC := ValidateJSONRPC
+	_PassthroughMode := PassthroughMode
+	defer func() { ValidateJSONRPC, PassthroughMode = _ValidateJSONRPC, _PassthroughMode }()
+	ValidateJSONRPC, PassthroughMode = true, true
+
+	prioQueue := NewPrioQueue(0, 0, 0, 2, false, PriorityAging{})
+	t.Cleanup(prioQueue.Close)
+	nodePool := NewNodePool(testLog, nil, 1)
+	err := nodePool.AddNode(nodeServer.URL + "?_healthcheck_success=status")
+	require.Nil(t, err, err)
+	webserver := NewWebserver(testLog, ":12345", prioQueue, nodePool)
+	go func() {
+		for {
+			job := prioQueue.Pop()
+			if job == nil {
+				return
+			}
+			nodePool.JobC <- job
+		}
+	}()
+
+	req, _ := http.NewRequest("POST", "/", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/x-protobuf", rr.Header().Get("Content-Type"))
+	require.Equal(t, respPayload, rr.Body.Bytes())
+
+	require.Equal(t, "application/x-protobuf", nodeReqContentType)
+	require.Equal(t, "", nodeReqAccept)
+	require.Equal(t, payload, nodeReqBody)
+}
+
+func TestWebserverNodeStats(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "error", http.StatusServiceUnavailable)
+	}
+
+	rr := httptest.NewRecorder()
+	webserver.HandleQueueRequest(rr, newSimTestRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`))
+	require.NotEqual(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	webserver.HandleNodeStatsRequest(rr, httptest.NewRequest("GET", "/stats/nodes", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	stats := []NodeStats{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	require.Equal(t, 1, len(stats))
+	require.Equal(t, int64(0), stats[0].NumSuccess)
+	require.Equal(t, int64(RequestMaxTries), stats[0].Errors[ErrorKindNodeError])
+}
+
+func TestWebserverRequestDeadline(t *testing.T) {
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	numProxied := make(chan string, 10)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		numProxied <- req.Header.Get("X-Request-ID")
+		time.Sleep(300 * time.Millisecond) // a long sim
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}
+	sim := func(reqID, deadline string, isHighPrio bool) *httptest.ResponseRecorder {
+		req := newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+		req.Header.Set("X-Request-ID", reqID)
+		if deadline != "" {
+			req.Header.Set("X-Request-Deadline-Ms", deadline)
+		}
+		if isHighPrio {
+			req.Header.Set("X-High-Priority", "true")
+		}
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		return rr
+	}
+
+	for _, invalid := range []string{"0", "-1", "soon"} {
+		rr := sim("invalid", invalid, false)
+		require.Equal(t, http.StatusBadRequest, rr.Code, invalid)
+		require.Equal(t, ErrorCodeInvalidRequest, decodeErrorResponse(t, rr).Code)
+	}
+
+	// The only worker is busy with a low-prio sim, the high-prio request is answered at its deadline
+	lowPrio := make(chan *httptest.ResponseRecorder)
+	go func() { lowPrio <- sim("low-prio", "", false) }()
+	require.Equal(t, "low-prio", <-numProxied)
+	start := time.Now()
+	rr := sim("high-prio", "50", true)
+	elapsed := time.Since(start)
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, ErrorKindRequestTimeout, rr.Header().Get("X-Error-Kind"))
+	require.Contains(t, decodeErrorResponse(t, rr).Message, "request deadline 50ms")
+	require.GreaterOrEqual(t, elapsed, 50*time.Millisecond)
+	require.Less(t, elapsed, 200*time.Millisecond)
+
+	// The low-prio request (without deadline) is served, the expired one is not proxied anymore
+	require.Equal(t, http.StatusOK, (<-lowPrio).Code)
+	require.Equal(t, http.StatusOK, sim("after", "1000", true).Code)
+	require.Equal(t, "after", <-numProxied)
+}
+
+func TestWebserverProxyTimeout(t *testing.T) {
+	defer func(timeout, max time.Duration) { ProxyRequestTimeout, ProxyRequestTimeoutMax = timeout, max }(ProxyRequestTimeout, ProxyRequestTimeoutMax)
+	ProxyRequestTimeout, ProxyRequestTimeoutMax = 100*time.Millisecond, time.Second
+
+	webserver, mockNodeBackend := newTestWebserver(t, 1)
+	mockNodeBackend.HTTPHandlerOverride = func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond) // a full-block sim
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}
+	sim := func(proxyTimeout string) *httptest.ResponseRecorder {
+		req := newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+		if proxyTimeout != "" {
+			req.Header.Set("X-Proxy-Timeout-Ms", proxyTimeout)
+		}
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		return rr
+	}
+
+	for _, invalid := range []string{"0", "-1", "soon", "1001"} {
+		rr := sim(invalid)
+		require.Equal(t, http.StatusBadRequest, rr.Code, invalid)
+		require.Equal(t, ErrorCodeInvalidRequest, decodeErrorResponse(t, rr).Code)
+	}
+
+	// The sim fails with the default proxy timeout, as proxy timeout (not a timeout in the queue)
+	rr := sim("")
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, ErrorKindProxyTimeout, rr.Header().Get("X-Error-Kind"))
+	errResp := decodeErrorResponse(t, rr)
+	require.Equal(t, ErrorCodeProxyTimeout, errResp.Code)
+	require.Contains(t, errResp.Message, "timeout 100ms")
+
+	// and succeeds with a longer proxy timeout of the request
+	rr = sim("1000")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, "1", rr.Header().Get("X-Tries"))
+}
+
+func TestWebserverPriorityLevel(t *testing.T) {
+	defer func(numLevels int) { PriorityLevels = numLevels }(PriorityLevels)
+	PriorityLevels = 5
+
+	webserver, _ := newTestWebserver(t, 1)
+	popped := make(chan *SimRequest, 10)
+	webserver.prioQueue.OnPop(func(r *SimRequest, wait time.Duration) {
+		popped <- r
+	})
+	sim := func(level string) *httptest.ResponseRecorder {
+		req := newSimTestRequest(`{"jsonrpc":"2.0","method":"eth_callBundle","params":[],"id":1}`)
+		req.Header.Set("X-Priority", level)
+		req.Header.Set("X-High-Priority", "true") // overridden by the level
+		rr := httptest.NewRecorder()
+		webserver.HandleQueueRequest(rr, req)
+		return rr
+	}
+
+	for _, invalid := range []string{"-1", "5", "high"} {
+		rr := sim(invalid)
+		require.Equal(t, http.StatusBadRequest, rr.Code, invalid)
+		require.Equal(t, ErrorCodeInvalidRequest, decodeErrorResponse(t, rr).Code)
+	}
+
+	for level, priority := range []string{PriorityFastTrack, PriorityHighPrio, PriorityHighPrio, PriorityHighPrio, PriorityLowPrio} {
+		require.Equal(t, http.StatusOK, sim(strconv.Itoa(level)).Code)
+		r := <-popped
+		require.Equal(t, priority, r.Priority(), level)
+		require.Equal(t, level, r.PriorityLevel)
+	}
+}
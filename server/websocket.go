@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	wsReconnectBackoff    = 100 * time.Millisecond // after the first failed dial, doubling with every further one
+	wsReconnectBackoffMax = 5 * time.Second
+)
+
+var errWebSocketClosed = errors.New("websocket connection closed")
+
+// wsTransport proxies JSON-RPC payloads to a node over persistent WebSocket connections. A worker uses an idle
+// connection or dials a new one, so there's a connection per worker which proxies concurrently. Failed dials are
+// retried with an exponential backoff, until then the requests fail without dialing.
+type wsTransport struct {
+	log       *zap.SugaredLogger
+	location  *url.URL
+	tlsConfig *tls.Config // (optional) for wss://
+
+	lock            sync.Mutex
+	idle            []*wsConn
+	numDialFailures int
+	nextDialAt      time.Time
+}
+
+func newWSTransport(log *zap.SugaredLogger, location *url.URL, tlsConfig *tls.Config) *wsTransport {
+	return &wsTransport{log: log, location: location, tlsConfig: tlsConfig}
+}
+
+// wsConn is a WebSocket connection, whose responses are read by a goroutine and matched to the pending requests by
+// their JSON-RPC id
+type wsConn struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[string]chan []byte // by the compacted JSON-RPC id
+	closed  chan struct{}          // closed once reading failed, err is set then
+	err     error
+}
+
+// get returns an idle connection, or dials a new one
+func (t *wsTransport) get(ctx context.Context) (*wsConn, error) {
+	t.lock.Lock()
+	for len(t.idle) > 0 {
+		c := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		if c.isOpen() {
+			t.lock.Unlock()
+			return c, nil
+		}
+	}
+	if wait := time.Until(t.nextDialAt); wait > 0 {
+		t.lock.Unlock()
+		return nil, fmt.Errorf("websocket reconnect backoff (%s left)", wait.Round(time.Millisecond))
+	}
+	t.lock.Unlock()
+
+	c, err := t.dial(ctx)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil {
+		t.numDialFailures++
+		backoff := wsReconnectBackoff << (t.numDialFailures - 1)
+		if backoff > wsReconnectBackoffMax || backoff <= 0 {
+			backoff = wsReconnectBackoffMax
+		}
+		t.nextDialAt = time.Now().Add(backoff)
+		return nil, err
+	}
+	if t.numDialFailures > 0 {
+		t.log.Infow("websocket reconnected", "uri", t.location.Redacted(), "numDialFailures", t.numDialFailures)
+	}
+	t.numDialFailures, t.nextDialAt = 0, time.Time{}
+	return c, nil
+}
+
+// put returns a connection to the idle ones, unless it was closed
+func (t *wsTransport) put(c *wsConn) {
+	if !c.isOpen() {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.idle = append(t.idle, c)
+}
+
+// Close closes the idle connections
+func (t *wsTransport) Close() error {
+	t.lock.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.lock.Unlock()
+	for _, c := range idle {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// dial opens a new connection, with the opening handshake bounded by the context
+func (t *wsTransport) dial(ctx context.Context) (*wsConn, error) {
+	origin := &url.URL{Scheme: "http", Host: t.location.Host}
+	if t.location.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config := &websocket.Config{Location: t.location, Origin: origin, Version: websocket.ProtocolVersionHybi13, Header: nodeHeadersFromContext(ctx).Clone()}
+
+	host := t.location.Host
+	if t.location.Port() == "" {
+		host = net.JoinHostPort(t.location.Hostname(), map[string]string{"ws": "80", "wss": "443"}[t.location.Scheme])
+	}
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, errors.Wrap(err, "websocket dial failed")
+	}
+	if t.location.Scheme == "wss" {
+		tlsConfig := &tls.Config{}
+		if t.tlsConfig != nil {
+			tlsConfig = t.tlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = t.location.Hostname()
+		}
+		netConn = tls.Client(netConn, tlsConfig)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+	conn, err := websocket.NewClient(config, netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, errors.Wrap(err, "websocket handshake failed")
+	}
+	_ = netConn.SetDeadline(time.Time{})
+
+	c := &wsConn{conn: conn, pending: make(map[string]chan []byte), closed: make(chan struct{})}
+	go c.readResponses(t.log)
+	return c, nil
+}
+
+func (c *wsConn) isOpen() bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// readResponses hands the messages to the pending requests with their id, until reading fails. Messages without a
+// pending request (i.e. subscription notifications, or responses to timed out requests) are dropped.
+func (c *wsConn) readResponses(log *zap.SugaredLogger) {
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(c.conn, &msg); err != nil {
+			c.conn.Close()
+			c.lock.Lock()
+			c.err = err
+			close(c.closed)
+			c.lock.Unlock()
+			return
+		}
+		id, err := jsonRPCID(msg)
+		c.lock.Lock()
+		respC, found := c.pending[id]
+		delete(c.pending, id)
+		c.lock.Unlock()
+		if err != nil || !found {
+			log.Debugw("dropping websocket message without pending request", "id", id, "err", err)
+			continue
+		}
+		respC <- msg
+	}
+}
+
+// call sends the payload as text frame, and waits for the response with its JSON-RPC id
+func (c *wsConn) call(ctx context.Context, payload []byte) ([]byte, error) {
+	id, err := jsonRPCID(payload)
+	if err != nil {
+		return nil, err
+	}
+	respC := make(chan []byte, 1)
+	c.lock.Lock()
+	if !c.isOpen() {
+		c.lock.Unlock()
+		return nil, errors.Wrap(c.err, errWebSocketClosed.Error())
+	} else if _, found := c.pending[id]; found {
+		c.lock.Unlock()
+		return nil, fmt.Errorf("a request with id %s is pending already", id)
+	}
+	c.pending[id] = respC
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	c.writeLock.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	}
+	err = websocket.Message.Send(c.conn, string(payload))
+	c.writeLock.Unlock()
+	if err != nil {
+		c.conn.Close() // a partially written frame breaks the connection
+		return nil, errors.Wrap(err, "websocket write failed")
+	}
+
+	select {
+	case resp := <-respC:
+		return resp, nil
+	case <-c.closed:
+		select {
+		case resp := <-respC: // read before the connection dropped
+			return resp, nil
+		default:
+			return nil, errors.Wrap(c.err, errWebSocketClosed.Error())
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// jsonRPCID returns the compacted id of a JSON-RPC request or response, of the first element of batches
+func jsonRPCID(msg []byte) (string, error) {
+	var message struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if trimmed := bytes.TrimSpace(msg); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil || len(batch) == 0 {
+			return "", fmt.Errorf("invalid JSON-RPC batch")
+		}
+		msg = batch[0]
+	}
+	if err := json.Unmarshal(msg, &message); err != nil {
+		return "", errors.Wrap(err, "invalid JSON-RPC message")
+	} else if len(message.ID) == 0 {
+		return "", fmt.Errorf("JSON-RPC message without id")
+	}
+	var id bytes.Buffer
+	if err := json.Compact(&id, message.ID); err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// Proxy sends the payload to the node over one of its WebSocket connections. The errors are wrapped like those of HTTP
+// proxy requests, and a successful response has status code 200.
+func (t *wsTransport) Proxy(ctx context.Context, payload Payload, timeout time.Duration) (resp []byte, statusCode int, err error) {
+	ctxx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := payload.Bytes()
+	if err != nil {
+		return resp, statusCode, errors.Wrap(err, "opening payload failed")
+	}
+
+	c, err := t.get(ctxx)
+	if err == nil {
+		resp, err = c.call(ctxx, body)
+		t.put(c)
+	}
+	if err != nil && ctxx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return resp, statusCode, errors.Wrapf(err, "proxying request failed (timeout %s)", timeout)
+	} else if err != nil {
+		return resp, statusCode, errors.Wrap(err, "proxying request failed")
+	} else if err = checkResponseSize(resp); err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return resp, http.StatusOK, nil
+}
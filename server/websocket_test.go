@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+// newWebSocketNode returns a node backend which answers JSON-RPC requests over WebSocket connections, after a
+// notification and a response with an unknown id. The "drop" method closes the connection.
+func newWebSocketNode(t *testing.T) (server *httptest.Server, numConns *int32) {
+	numConns = new(int32)
+	server = httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		atomic.AddInt32(numConns, 1)
+		for {
+			var msg string
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			var req jsonRPCRequestEnvelope
+			require.Nil(t, json.Unmarshal([]byte(msg), &req))
+			if string(req.Method) == `"drop"` {
+				ws.Close()
+				return
+			}
+			_ = websocket.Message.Send(ws, `{"jsonrpc":"2.0","method":"eth_subscription","params":{"result":"0x2"}}`)
+			_ = websocket.Message.Send(ws, `{"jsonrpc":"2.0","result":"0x3","id":999}`)
+			_ = websocket.Message.Send(ws, fmt.Sprintf(`{"jsonrpc":"2.0","result":"0x1","id":%s}`, req.ID))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, numConns
+}
+
+func TestJSONRPCID(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{`{"jsonrpc":"2.0","method":"eth_call","id":1}`, "1"},
+		{`{"id": "abc" }`, `"abc"`},
+		{`{"id":{"a": 1}}`, `{"a":1}`},
+		{` [{"id":7},{"id":8}]`, "7"},
+	}
+	for _, tt := range tests {
+		id, err := jsonRPCID([]byte(tt.msg))
+		require.Nil(t, err, err)
+		require.Equal(t, tt.want, id)
+	}
+	for _, msg := range []string{`{"jsonrpc":"2.0","method":"eth_subscription"}`, `[]`, `foo`} {
+		_, err := jsonRPCID([]byte(msg))
+		require.NotNil(t, err, msg)
+	}
+}
+
+func TestNodeWebSocket(t *testing.T) {
+	server, numConns := newWebSocketNode(t)
+	uri := "ws" + strings.TrimPrefix(server.URL, "http")
+	gp := NewNodePool(testLog, nil, 1)
+	defer gp.Shutdown()
+	require.Nil(t, gp.AddNode(uri))
+	sim := func(method string, id int) SimResponse {
+		payload := []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"%s","params":[],"id":%d}`, method, id))
+		r := NewSimRequest(context.Background(), "", payload, true, false)
+		gp.JobC <- r
+		return <-r.ResponseC
+	}
+
+	// The responses are matched by id, over the connection of the worker
+	for i := 1; i <= 3; i++ {
+		res := sim("eth_callBundle", i)
+		require.Nil(t, res.Error, res.Error)
+		require.Equal(t, fmt.Sprintf(`{"jsonrpc":"2.0","result":"0x1","id":%d}`, i), string(res.Payload))
+		require.Equal(t, 0, res.StatusCode) // like HTTP responses
+		require.Equal(t, uri, res.NodeURI)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(numConns)) // including the health check
+
+	// A dropped connection fails the request in flight, which is retried, and the next request reconnects
+	res := sim("drop", 4)
+	require.NotNil(t, res.Error)
+	require.True(t, res.ShouldRetry)
+	require.Contains(t, res.Error.Error(), "proxying request failed")
+	res = sim("eth_callBundle", 5)
+	require.Nil(t, res.Error, res.Error)
+	require.Equal(t, int32(2), atomic.LoadInt32(numConns))
+
+	// Responses larger than the limit fail, and are not retried
+	defer func(maxBytes int) { NodeResponseMaxBytes = maxBytes }(NodeResponseMaxBytes)
+	NodeResponseMaxBytes = 10
+	res = sim("eth_callBundle", 6)
+	require.ErrorIs(t, res.Error, ErrResponseTooLarge)
+	require.False(t, res.ShouldRetry)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
+
+func TestWebSocketReconnectBackoff(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	backend, _ := newWebSocketNode(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		backend.Config.Handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	node, err := NewNode(testLog, "ws"+strings.TrimPrefix(server.URL, "http"), nil, 1)
+	require.Nil(t, err, err)
+	defer node.StopWorkersAndWait()
+	payload := BytesPayload([]byte(`{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":1}`))
+
+	_, _, err = node.ProxyRequest(context.Background(), payload, time.Second)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "websocket handshake failed")
+
+	// No dials until the backoff ended
+	down.Store(false)
+	_, _, err = node.ProxyRequest(context.Background(), payload, time.Second)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "websocket reconnect backoff")
+	time.Sleep(wsReconnectBackoff)
+	resp, statusCode, err := node.ProxyRequest(context.Background(), payload, time.Second)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, `{"jsonrpc":"2.0","result":"0x1","id":1}`, string(resp))
+}
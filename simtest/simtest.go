@@ -0,0 +1,107 @@
+// Package simtest runs the load balancer in-process with fake nodes, for integration tests of clients. It takes no
+// testing.T and depends on no test-only modules, so it can also be used outside of tests (i.e. by the loadtest
+// subcommand).
+package simtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"go.uber.org/zap"
+)
+
+// Options of the in-process balancer
+type Options struct {
+	Log            *zap.SugaredLogger     // default: no logging
+	NumNodes       int                    // number of fake nodes (default: 1)
+	Node           testutils.FakeNodeOpts // options of the fake nodes
+	WorkersPerNode int32                  // default: 4
+	PathPrefix     string                 // (optional) serve all routes under this prefix
+}
+
+// Balancer is the full load balancer server running in-process (without Redis), with fake nodes
+type Balancer struct {
+	URL    string // base URL, the sim endpoint is SimURL
+	SimURL string
+	Server *server.Server
+	Nodes  []*testutils.FakeNode
+
+	httpServer *httptest.Server
+	done       chan struct{}
+}
+
+// Start starts the balancer and its nodes, which must be stopped with Close
+func Start(opts Options) (*Balancer, error) {
+	if opts.Log == nil {
+		opts.Log = zap.NewNop().Sugar()
+	}
+	if opts.NumNodes <= 0 {
+		opts.NumNodes = 1
+	}
+	if opts.WorkersPerNode <= 0 {
+		opts.WorkersPerNode = 4
+	}
+	srv, err := server.NewServer(server.ServerOpts{
+		Log:            opts.Log,
+		WorkersPerNode: opts.WorkersPerNode,
+		PathPrefix:     opts.PathPrefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Balancer{Server: srv, done: make(chan struct{})}
+	for i := 0; i < opts.NumNodes; i++ {
+		node := testutils.NewFakeNode(opts.Node)
+		b.Nodes = append(b.Nodes, node)
+		if err := srv.AddNode(node.URL); err != nil {
+			b.closeNodes()
+			return nil, err
+		}
+	}
+	b.httpServer = httptest.NewServer(srv.Handler())
+	b.URL = b.httpServer.URL + opts.PathPrefix
+	b.SimURL = b.URL + "/sim"
+	go func() {
+		srv.Run()
+		close(b.done)
+	}()
+	return b, nil
+}
+
+// Client returns a HTTP client for the balancer
+func (b *Balancer) Client() *http.Client {
+	return b.httpServer.Client()
+}
+
+// Node returns the first fake node
+func (b *Balancer) Node() *testutils.FakeNode {
+	return b.Nodes[0]
+}
+
+// QueueSize returns the number of queued requests by priority
+func (b *Balancer) QueueSize() (lenFastTrack, lenHighPrio, lenLowPrio int) {
+	return b.Server.QueueSize()
+}
+
+// OnQueuePop adds a callback for every request popped from the queue (i.e. to check the priorities)
+func (b *Balancer) OnQueuePop(cb func(r *server.SimRequest, wait time.Duration)) {
+	b.Server.OnQueuePop(cb)
+}
+
+// Close shuts down the balancer (waiting for the requests in flight) and the nodes
+func (b *Balancer) Close() {
+	b.Server.Shutdown()
+	<-b.done
+	b.httpServer.Close()
+	b.closeNodes()
+}
+
+func (b *Balancer) closeNodes() {
+	for _, node := range b.Nodes {
+		node.Close()
+	}
+}
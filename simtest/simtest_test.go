@@ -0,0 +1,86 @@
+package simtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/prio-load-balancer/server"
+	"github.com/flashbots/prio-load-balancer/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalancer(t *testing.T) {
+	balancer, err := Start(Options{NumNodes: 2, PathPrefix: "/simulation"})
+	require.Nil(t, err, err)
+	defer balancer.Close()
+	require.Equal(t, 2, len(balancer.Nodes))
+	require.True(t, strings.HasSuffix(balancer.SimURL, "/simulation/sim"))
+
+	priorities := make(chan string, 10)
+	balancer.OnQueuePop(func(r *server.SimRequest, wait time.Duration) {
+		priorities <- r.Priority()
+	})
+
+	req, err := http.NewRequest(http.MethodPost, balancer.SimURL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`))
+	require.Nil(t, err, err)
+	req.Header.Set("X-Fast-Track", "true")
+	resp, err := balancer.Client().Do(req)
+	require.Nil(t, err, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var jsonResp testutils.JSONRPCResponse
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&jsonResp))
+	require.Equal(t, `"0x1"`, string(jsonResp.Result))
+	require.Equal(t, server.PriorityFastTrack, <-priorities)
+	numSimRequests := 0
+	for _, node := range balancer.Nodes {
+		for _, req := range node.Requests() {
+			if req.Header.Get("X-Request-ID") != "" { // not a health check
+				numSimRequests++
+			}
+		}
+	}
+	require.Equal(t, 1, numSimRequests)
+
+	// The queue wait stats are kept with the hook
+	resp, err = balancer.Client().Get(balancer.URL + "/stats/queue")
+	require.Nil(t, err, err)
+	defer resp.Body.Close()
+	var queueStats server.QueueStatsResponse
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&queueStats))
+	require.Equal(t, 1, queueStats.WaitTimes[server.PriorityFastTrack].Summary.NumRequests)
+	lenFastTrack, lenHighPrio, lenLowPrio := balancer.QueueSize()
+	require.Equal(t, 0, lenFastTrack+lenHighPrio+lenLowPrio)
+}
+
+func TestBalancerQueue(t *testing.T) {
+	// With a slow node, requests wait in the queue. One is processed by the worker, and the ones in the job channel
+	// and waiting to be handed over to it are not queued.
+	balancer, err := Start(Options{WorkersPerNode: 1, Node: testutils.FakeNodeOpts{Latency: 100 * time.Millisecond}})
+	require.Nil(t, err, err)
+	defer balancer.Close()
+
+	numRequests := server.JobChannelBuffer + 4
+	done := make(chan int, numRequests)
+	for i := 0; i < numRequests; i++ {
+		go func() {
+			resp, err := balancer.Client().Post(balancer.SimURL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_call"}`))
+			if err != nil {
+				done <- 0
+				return
+			}
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+	}
+	require.Eventually(t, func() bool {
+		_, _, lenLowPrio := balancer.QueueSize()
+		return lenLowPrio == 2
+	}, time.Second, 5*time.Millisecond)
+	for i := 0; i < numRequests; i++ {
+		require.Equal(t, http.StatusOK, <-done)
+	}
+}
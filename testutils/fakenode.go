@@ -0,0 +1,208 @@
+package testutils
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// DefaultFakeNodeResult is the JSON-RPC result of methods without a canned response
+var DefaultFakeNodeResult interface{} = "0x1"
+
+// FakeNodeOpts configures a FakeNode. All options can be changed at runtime with FakeNode.SetOpts.
+type FakeNodeOpts struct {
+	Latency         time.Duration          // response time of every request
+	ErrorRate       float64                // fraction of the requests answered with ErrorStatusCode, spread evenly (0.25 fails every 4th request)
+	ErrorStatusCode int                    // default: 502
+	Responses       map[string]interface{} // canned JSON-RPC results by method, a JSONRPCError value is returned as JSON-RPC error and a HTTPErrorResponse as HTTP error
+}
+
+// HTTPErrorResponse is a canned response (see FakeNodeOpts.Responses) which fails the whole HTTP request
+type HTTPErrorResponse struct {
+	StatusCode int
+	Body       string
+}
+
+// CapturedRequest is a request received by a FakeNode
+type CapturedRequest struct {
+	ReceivedAt       time.Time
+	Header           http.Header
+	Body             []byte
+	Methods          []string // JSON-RPC methods (one per batch element), empty if the body is not JSON-RPC
+	ContentLength    int64    // of the Content-Length header, -1 if the body was sent without one
+	TransferEncoding []string // i.e. "chunked"
+}
+
+// FakeNode is a fake simulation node: a httptest server answering JSON-RPC requests (also batches) with canned
+// responses, which captures all requests. It is safe for concurrent use, unlike MockNodeBackend.
+type FakeNode struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	opts     FakeNodeOpts
+	requests []CapturedRequest
+	numFails int
+	numConns int
+}
+
+// NewFakeNode starts a fake node, which must be closed with Close
+func NewFakeNode(opts FakeNodeOpts) *FakeNode {
+	n := newFakeNode(opts)
+	n.Server.Start()
+	return n
+}
+
+// NewTLSFakeNode starts a fake node which is served over TLS (with the self-signed certificate of httptest), which must
+// be closed with Close
+func NewTLSFakeNode(opts FakeNodeOpts) *FakeNode {
+	n := newFakeNode(opts)
+	n.Server.StartTLS()
+	return n
+}
+
+func newFakeNode(opts FakeNodeOpts) *FakeNode {
+	n := &FakeNode{opts: opts}
+	n.Server = httptest.NewUnstartedServer(http.HandlerFunc(n.handle))
+	n.Server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			n.lock.Lock()
+			n.numConns++
+			n.lock.Unlock()
+		}
+	}
+	return n
+}
+
+// SetOpts replaces the options (i.e. to simulate a failing node during a test)
+func (n *FakeNode) SetOpts(opts FakeNodeOpts) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.opts = opts
+}
+
+// Requests returns the captured requests, including the health checks of the balancer
+func (n *FakeNode) Requests() []CapturedRequest {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]CapturedRequest{}, n.requests...)
+}
+
+// NumRequests returns the number of captured requests
+func (n *FakeNode) NumRequests() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return len(n.requests)
+}
+
+// NumConns returns the number of accepted connections (with TLS, every one is a full handshake)
+func (n *FakeNode) NumConns() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.numConns
+}
+
+// LastRequest returns the last captured request (false if there is none)
+func (n *FakeNode) LastRequest() (CapturedRequest, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.requests) == 0 {
+		return CapturedRequest{}, false
+	}
+	return n.requests[len(n.requests)-1], true
+}
+
+// Reset clears the captured requests
+func (n *FakeNode) Reset() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.requests, n.numFails = nil, 0
+}
+
+func (n *FakeNode) handle(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Parse the request, which can be a batch
+	var (
+		batch   []*JSONRPCRequest
+		isBatch = len(body) > 0 && body[0] == '['
+	)
+	if isBatch {
+		err = json.Unmarshal(body, &batch)
+	} else {
+		single := new(JSONRPCRequest)
+		err = json.Unmarshal(body, single)
+		batch = []*JSONRPCRequest{single}
+	}
+	captured := CapturedRequest{ReceivedAt: time.Now(), Header: req.Header.Clone(), Body: body, ContentLength: req.ContentLength, TransferEncoding: req.TransferEncoding}
+	if err == nil {
+		for _, r := range batch {
+			captured.Methods = append(captured.Methods, r.Method)
+		}
+	}
+
+	n.lock.Lock()
+	n.requests = append(n.requests, captured)
+	opts := n.opts
+	// Fail whenever the expected number of failures reaches the next integer
+	fail := int(float64(len(n.requests))*opts.ErrorRate) > n.numFails
+	if fail {
+		n.numFails++
+	}
+	n.lock.Unlock()
+
+	time.Sleep(opts.Latency)
+	if fail {
+		statusCode := opts.ErrorStatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusBadGateway
+		}
+		http.Error(w, "fake node error", statusCode)
+		return
+	} else if err != nil {
+		http.Error(w, "invalid JSON-RPC request", http.StatusBadRequest)
+		return
+	}
+	for _, method := range captured.Methods {
+		if httpErr, ok := opts.Responses[method].(HTTPErrorResponse); ok {
+			http.Error(w, httpErr.Body, httpErr.StatusCode)
+			return
+		}
+	}
+
+	responses := make([]*JSONRPCResponse, len(batch))
+	for i, r := range batch {
+		responses[i] = fakeNodeResponse(r, opts.Responses)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if isBatch {
+		_ = json.NewEncoder(w).Encode(responses)
+	} else {
+		_ = json.NewEncoder(w).Encode(responses[0])
+	}
+}
+
+func fakeNodeResponse(req *JSONRPCRequest, responses map[string]interface{}) *JSONRPCResponse {
+	result, found := responses[req.Method]
+	if !found {
+		result = DefaultFakeNodeResult
+	}
+	switch rpcErr := result.(type) {
+	case JSONRPCError:
+		return &JSONRPCResponse{ID: req.ID, Error: &rpcErr, Version: "2.0"}
+	case *JSONRPCError:
+		return &JSONRPCResponse{ID: req.ID, Error: rpcErr, Version: "2.0"}
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return &JSONRPCResponse{ID: req.ID, Error: &JSONRPCError{Code: -32603, Message: err.Error()}, Version: "2.0"}
+	}
+	return NewJSONRPCResponse(req.ID, resultBytes)
+}
@@ -0,0 +1,101 @@
+package testutils
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeNode(t *testing.T) {
+	node := NewFakeNode(FakeNodeOpts{Responses: map[string]interface{}{
+		"eth_callBundle": map[string]string{"bundleHash": "0x2"},
+		"eth_invalid":    JSONRPCError{Code: -32000, Message: "invalid"},
+		"eth_fail":       HTTPErrorResponse{StatusCode: http.StatusServiceUnavailable, Body: "unavailable"},
+	}})
+	defer node.Close()
+
+	post := func(body string, headers ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, node.URL, strings.NewReader(body))
+		require.Nil(t, err, err)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, err)
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(t, err, err)
+		return resp.StatusCode, strings.TrimSpace(string(respBody))
+	}
+
+	// Canned responses
+	statusCode, body := post(`{"jsonrpc":"2.0","id":1,"method":"eth_callBundle","params":[]}`, "X-Request-ID", "foo")
+	require.Equal(t, http.StatusOK, statusCode)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"bundleHash":"0x2"}}`, body)
+	statusCode, body = post(`{"jsonrpc":"2.0","id":2,"method":"net_version","params":[]}`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":"0x1"}`, body)
+	statusCode, body = post(`{"jsonrpc":"2.0","id":3,"method":"eth_invalid","params":[]}`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":3,"result":null,"error":{"code":-32000,"message":"invalid"}}`, body)
+	statusCode, body = post(`{"jsonrpc":"2.0","id":4,"method":"eth_fail","params":[]}`)
+	require.Equal(t, http.StatusServiceUnavailable, statusCode)
+	require.Equal(t, "unavailable", body)
+	statusCode, _ = post(`not json`)
+	require.Equal(t, http.StatusBadRequest, statusCode)
+
+	// Batches
+	statusCode, body = post(`[{"jsonrpc":"2.0","id":1,"method":"eth_callBundle"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.JSONEq(t, `[{"jsonrpc":"2.0","id":1,"result":{"bundleHash":"0x2"}},{"jsonrpc":"2.0","id":2,"result":"0x1"}]`, body)
+
+	// Request capture
+	require.Equal(t, 6, node.NumRequests())
+	requests := node.Requests()
+	require.Equal(t, "foo", requests[0].Header.Get("X-Request-ID"))
+	require.Equal(t, []string{"eth_callBundle"}, requests[0].Methods)
+	require.Nil(t, requests[4].Methods)
+	require.Equal(t, "not json", string(requests[4].Body))
+	last, found := node.LastRequest()
+	require.True(t, found)
+	require.Equal(t, []string{"eth_callBundle", "net_version"}, last.Methods)
+	node.Reset()
+	_, found = node.LastRequest()
+	require.False(t, found)
+
+	// Every 4th request fails
+	node.SetOpts(FakeNodeOpts{ErrorRate: 0.25})
+	statusCodes := []int{}
+	for i := 0; i < 8; i++ {
+		statusCode, _ := post(`{"jsonrpc":"2.0","id":1,"method":"net_version"}`)
+		statusCodes = append(statusCodes, statusCode)
+	}
+	require.Equal(t, []int{200, 200, 200, 502, 200, 200, 200, 502}, statusCodes)
+
+	// Latency
+	node.SetOpts(FakeNodeOpts{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	post(`{"jsonrpc":"2.0","id":1,"method":"net_version"}`)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestTLSFakeNode(t *testing.T) {
+	node := NewTLSFakeNode(FakeNodeOpts{})
+	defer node.Close()
+
+	client := node.Client()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(node.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"net_version"}`))
+		require.Nil(t, err, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.Equal(t, 2, node.NumRequests())
+	require.Equal(t, 1, node.NumConns()) // reused
+}